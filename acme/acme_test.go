@@ -0,0 +1,445 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin/registry"
+	. "gopkg.in/check.v1"
+)
+
+func TestACME(t *testing.T) { TestingT(t) }
+
+type ACMESuite struct {
+	ca     *fakeCA
+	solver *HTTP01Solver
+	proxy  *httptest.Server
+}
+
+var _ = Suite(&ACMESuite{})
+
+func (s *ACMESuite) SetUpTest(c *C) {
+	s.solver = NewHTTP01Solver()
+	s.proxy = httptest.NewServer(s.solver.Wrap(http.NotFoundHandler()))
+	s.ca = newFakeCA(c, s.proxy.URL)
+}
+
+func (s *ACMESuite) TearDownTest(c *C) {
+	s.ca.Close()
+	s.proxy.Close()
+}
+
+func (s *ACMESuite) client(c *C) *Client {
+	key, err := NewKey()
+	c.Assert(err, IsNil)
+	return &Client{DirectoryURL: s.ca.URL + "/directory", Key: key, PollInterval: time.Millisecond}
+}
+
+func (s *ACMESuite) TestObtainCertificate(c *C) {
+	cl := s.client(c)
+	c.Assert(cl.Register("admin@example.com"), IsNil)
+
+	certPEM, keyPEM, err := cl.ObtainCertificate("example.com", s.solver)
+	c.Assert(err, IsNil)
+
+	cert := parseCert(c, certPEM)
+	c.Assert(cert.DNSNames, DeepEquals, []string{"example.com"})
+
+	key, err := ParseKey(keyPEM)
+	c.Assert(err, IsNil)
+	c.Assert(cert.PublicKey.(*ecdsa.PublicKey).X.Cmp(key.PublicKey.X), Equals, 0)
+
+	// challenges are not served once validated
+	c.Assert(s.solver.tokens, HasLen, 0)
+	c.Assert(s.ca.contacts, DeepEquals, []string{"mailto:admin@example.com"})
+}
+
+func (s *ACMESuite) TestRegisterExistingAccount(c *C) {
+	cl := s.client(c)
+	c.Assert(cl.Register(""), IsNil)
+
+	again := &Client{DirectoryURL: cl.DirectoryURL, Key: cl.Key}
+	c.Assert(again.Register(""), IsNil)
+	c.Assert(again.kid, Equals, cl.kid)
+	c.Assert(s.ca.accounts, HasLen, 1)
+}
+
+func (s *ACMESuite) TestBadNonceRetried(c *C) {
+	s.ca.rejectNonces = 1
+
+	cl := s.client(c)
+	c.Assert(cl.Register(""), IsNil)
+}
+
+func (s *ACMESuite) TestChallengeFailed(c *C) {
+	s.ca.validateURL = s.proxy.URL + "/nowhere"
+
+	cl := s.client(c)
+	cl.PollTimeout = time.Second
+	c.Assert(cl.Register(""), IsNil)
+
+	_, _, err := cl.ObtainCertificate("example.com", s.solver)
+	c.Assert(err, NotNil)
+	c.Assert(err.(*Problem).Type, Equals, "urn:ietf:params:acme:error:unauthorized")
+}
+
+func (s *ACMESuite) TestSolverPassesOtherRequests(c *C) {
+	c.Assert(s.solver.add("token", "auth"), IsNil)
+
+	re, err := http.Get(s.proxy.URL + HTTP01ChallengePath + "token")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "auth")
+
+	re, err = http.Get(s.proxy.URL + HTTP01ChallengePath + "other")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ACMESuite) TestSharedSolver(c *C) {
+	ng := memng.New(registry.GetRegistry())
+	ordering := NewSharedHTTP01Solver(ng.(engine.ACMEStore))
+	other := httptest.NewServer(NewSharedHTTP01Solver(ng.(engine.ACMEStore)).Wrap(http.NotFoundHandler()))
+	defer other.Close()
+
+	// the challenge is answered by the instance that has not ordered the certificate
+	c.Assert(ordering.add("token", "auth"), IsNil)
+	re, err := http.Get(other.URL + HTTP01ChallengePath + "token")
+	c.Assert(err, IsNil)
+	body, _ := ioutil.ReadAll(re.Body)
+	re.Body.Close()
+	c.Assert(string(body), Equals, "auth")
+
+	ordering.remove("token")
+	re, err = http.Get(other.URL + HTTP01ChallengePath + "token")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ACMESuite) TestManagerIssuesAndRenews(c *C) {
+	ng := memng.New(registry.GetRegistry())
+	host := engine.Host{Name: "example.com"}
+	host.Settings.ACME = &engine.ACMESettings{Email: "admin@example.com", DirectoryURL: s.ca.URL + "/directory"}
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	// hosts without ACME settings are left intact
+	c.Assert(ng.UpsertHost(engine.Host{Name: "other.com"}), IsNil)
+
+	m := NewManager(ng, Options{Solver: s.solver})
+	m.check()
+
+	out, err := ng.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.KeyPair, NotNil)
+	c.Assert(out.Settings.ACME.AccountKey, NotNil)
+	c.Assert(parseCert(c, out.Settings.KeyPair.Cert).DNSNames, DeepEquals, []string{"example.com"})
+
+	other, err := ng.GetHost(engine.HostKey{Name: "other.com"})
+	c.Assert(err, IsNil)
+	c.Assert(other.Settings.KeyPair, IsNil)
+
+	// certificate is fresh, nothing to do
+	m.check()
+	c.Assert(s.ca.orders, Equals, 1)
+
+	// renewal reuses the stored account
+	m.options.TimeProvider = &timetools.FreezedTime{CurrentTime: time.Now().Add(70 * 24 * time.Hour)}
+	m.check()
+	c.Assert(s.ca.orders, Equals, 2)
+	c.Assert(s.ca.accounts, HasLen, 1)
+}
+
+func (s *ACMESuite) TestManagerOrderLock(c *C) {
+	ng := memng.New(registry.GetRegistry())
+	host := engine.Host{Name: "example.com"}
+	host.Settings.ACME = &engine.ACMESettings{DirectoryURL: s.ca.URL + "/directory"}
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	// the certificate ordered by another instance is not ordered again
+	ok, err := ng.(engine.ACMEStore).LockOrder(host.Name, "other", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	m := NewManager(ng, Options{Solver: s.solver, Owner: "owner"})
+	m.check()
+	c.Assert(s.ca.orders, Equals, 0)
+	c.Assert(m.failures, HasLen, 0)
+
+	// the lock is taken once released and it is released after the order
+	c.Assert(ng.(engine.ACMEStore).UnlockOrder(host.Name, "other"), IsNil)
+	m.check()
+	c.Assert(s.ca.orders, Equals, 1)
+	ok, err = ng.(engine.ACMEStore).LockOrder(host.Name, "other", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *ACMESuite) TestManagerBackoff(c *C) {
+	ng := memng.New(registry.GetRegistry())
+	host := engine.Host{Name: "example.com"}
+	host.Settings.ACME = &engine.ACMESettings{DirectoryURL: s.ca.URL + "/missing"}
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	m := NewManager(ng, Options{Solver: s.solver})
+	m.check()
+	c.Assert(m.failures[engine.HostKey{Name: host.Name}], Equals, 1)
+
+	// the next attempt is postponed
+	m.check()
+	c.Assert(m.failures[engine.HostKey{Name: host.Name}], Equals, 1)
+}
+
+func parseCert(c *C, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	c.Assert(block, NotNil)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	c.Assert(err, IsNil)
+	return cert
+}
+
+// fakeCA implements just enough of the ACME server to issue certificates
+type fakeCA struct {
+	*httptest.Server
+	c *C
+
+	mtx          sync.Mutex
+	caKey        *ecdsa.PrivateKey
+	caCert       *x509.Certificate
+	nonce        int
+	nonces       map[string]bool
+	rejectNonces int
+	accounts     map[string]*ecdsa.PublicKey
+	contacts     []string
+	orders       int
+	authzStatus  string
+	orderStatus  string
+	cert         []byte
+	token        string
+	validateURL  string
+}
+
+func newFakeCA(c *C, proxyURL string) *fakeCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, IsNil)
+
+	f := &fakeCA{
+		c:           c,
+		caKey:       key,
+		caCert:      cert,
+		nonces:      make(map[string]bool),
+		accounts:    make(map[string]*ecdsa.PublicKey),
+		validateURL: proxyURL + HTTP01ChallengePath,
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeCA) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if r.URL.Path == "/directory" {
+		json.NewEncoder(w).Encode(directory{
+			NewNonce:   f.URL + "/nonce",
+			NewAccount: f.URL + "/account",
+			NewOrder:   f.URL + "/order",
+		})
+		return
+	}
+	f.nonce++
+	n := fmt.Sprintf("nonce-%d", f.nonce)
+	f.nonces[n] = true
+	w.Header().Set("Replay-Nonce", n)
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	payload, kid, pub, err := f.verify(r)
+	if err != nil {
+		f.problem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch r.URL.Path {
+	case "/account":
+		kid = f.URL + "/account/" + thumbprint(f.c, pub)
+		if _, ok := f.accounts[kid]; !ok {
+			var req struct{ Contact []string }
+			json.Unmarshal(payload, &req)
+			f.accounts[kid] = pub
+			f.contacts = req.Contact
+			w.Header().Set("Location", kid)
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.Header().Set("Location", kid)
+		}
+		w.Write([]byte("{}"))
+	case "/order":
+		f.orders++
+		f.authzStatus, f.orderStatus, f.token = "pending", "pending", fmt.Sprintf("token-%d", f.orders)
+		w.Header().Set("Location", f.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		f.writeOrder(w)
+	case "/order/1":
+		f.writeOrder(w)
+	case "/authz/1":
+		ch := challenge{Type: "http-01", URL: f.URL + "/chal/1", Token: f.token, Status: f.authzStatus}
+		if f.authzStatus == statusInvalid {
+			ch.Error = &Problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: "wrong key authorization"}
+		}
+		json.NewEncoder(w).Encode(authorization{
+			Status:     f.authzStatus,
+			Identifier: identifier{Type: "dns", Value: "example.com"},
+			Challenges: []challenge{ch, {Type: "dns-01", URL: f.URL + "/chal/2", Token: "dns"}},
+		})
+	case "/chal/1":
+		f.authzStatus = statusInvalid
+		if f.fetch(f.validateURL+f.token) == f.token+"."+thumbprint(f.c, f.accounts[kid]) {
+			f.authzStatus = statusValid
+		}
+		w.Write([]byte("{}"))
+	case "/finalize/1":
+		if f.authzStatus != statusValid {
+			f.problem(w, http.StatusForbidden, "order is not ready")
+			return
+		}
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.problem(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		f.cert = f.issue(csr)
+		f.orderStatus = statusValid
+		f.writeOrder(w)
+	case "/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.cert)
+	default:
+		f.problem(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (f *fakeCA) writeOrder(w http.ResponseWriter) {
+	o := order{Status: f.orderStatus, Authorizations: []string{f.URL + "/authz/1"}, Finalize: f.URL + "/finalize/1"}
+	if f.orderStatus == statusValid {
+		o.Certificate = f.URL + "/cert/1"
+	}
+	json.NewEncoder(w).Encode(o)
+}
+
+func (f *fakeCA) problem(w http.ResponseWriter, code int, detail string) {
+	errType := "urn:ietf:params:acme:error:malformed"
+	if strings.Contains(detail, "nonce") {
+		errType = badNonceError
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Problem{Type: errType, Detail: detail, Status: code})
+}
+
+func (f *fakeCA) verify(r *http.Request) ([]byte, string, *ecdsa.PublicKey, error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "", nil, err
+	}
+	header, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *ecJWK
+	}
+	if err := json.Unmarshal(header, &protected); err != nil {
+		return nil, "", nil, err
+	}
+	if !f.nonces[protected.Nonce] || f.rejectNonces > 0 {
+		f.rejectNonces--
+		return nil, "", nil, fmt.Errorf("bad nonce %v", protected.Nonce)
+	}
+	delete(f.nonces, protected.Nonce)
+	if protected.URL != f.URL+r.URL.Path {
+		return nil, "", nil, fmt.Errorf("url mismatch %v", protected.URL)
+	}
+
+	var pub *ecdsa.PublicKey
+	if protected.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(protected.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(protected.JWK.Y)
+		pub = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	} else if pub = f.accounts[protected.Kid]; pub == nil {
+		return nil, "", nil, fmt.Errorf("unknown account %v", protected.Kid)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", nil, fmt.Errorf("bad signature")
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, protected.Kid, pub, nil
+}
+
+func (f *fakeCA) fetch(url string) string {
+	re, err := http.Get(url)
+	if err != nil {
+		return ""
+	}
+	defer re.Body.Close()
+	body, _ := ioutil.ReadAll(re.Body)
+	return string(body)
+}
+
+func (f *fakeCA) issue(csr *x509.CertificateRequest) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(f.orders + 1)),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+	f.c.Assert(err, IsNil)
+	return append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})...)
+}
+
+func thumbprint(c *C, pub *ecdsa.PublicKey) string {
+	t, err := Thumbprint(pub)
+	c.Assert(err, IsNil)
+	return t
+}
@@ -0,0 +1,452 @@
+// Package acme obtains and renews host certificates from ACME (RFC 8555) certificate authorities, e.g. Let's Encrypt.
+package acme
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+const (
+	statusValid   = "valid"
+	statusInvalid = "invalid"
+
+	badNonceError = "urn:ietf:params:acme:error:badNonce"
+
+	defaultPollInterval = time.Second
+	defaultPollTimeout  = 2 * time.Minute
+)
+
+// Client is a minimal ACME client that supports account registration and certificate issuance
+// with HTTP-01 challenges. It is not safe for concurrent use.
+type Client struct {
+	// DirectoryURL is the ACME directory of the certificate authority
+	DirectoryURL string
+	// Key is the account key
+	Key *ecdsa.PrivateKey
+	// HTTPClient is used to talk to the certificate authority, http.DefaultClient is used if nil
+	HTTPClient *http.Client
+	// PollInterval is the interval between checks of the pending authorizations and orders
+	PollInterval time.Duration
+	// PollTimeout limits the time spent waiting for pending authorizations and orders
+	PollTimeout time.Duration
+
+	dir    *directory
+	kid    string
+	nonces []string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+// Problem is the error returned by the ACME server
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *Problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// Register creates the ACME account for the client key, or looks up the existing one
+// if the key has been registered before
+func (c *Client) Register(email string) error {
+	if err := c.discover(); err != nil {
+		return err
+	}
+	req := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		req["contact"] = []string{"mailto:" + email}
+	}
+	re, _, err := c.post(c.dir.NewAccount, req)
+	if err != nil {
+		return err
+	}
+	kid := re.Header.Get("Location")
+	if kid == "" {
+		return fmt.Errorf("acme: account location is missing")
+	}
+	c.kid = kid
+	return nil
+}
+
+// ObtainCertificate orders the certificate for the domain proving control over it with HTTP-01 challenges
+// answered by the solver. It returns PEM encoded certificate chain and private key.
+func (c *Client) ObtainCertificate(domain string, solver *HTTP01Solver) ([]byte, []byte, error) {
+	if c.kid == "" {
+		return nil, nil, fmt.Errorf("acme: account is not registered")
+	}
+	var o order
+	re, body, err := c.post(c.dir.NewOrder, map[string]interface{}{
+		"identifiers": []identifier{{Type: "dns", Value: domain}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, nil, err
+	}
+	orderURL := re.Header.Get("Location")
+
+	for _, a := range o.Authorizations {
+		if err := c.authorize(a, solver); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domain},
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, body, err = c.post(o.Finalize, map[string]string{"csr": encode(csr)}); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, nil, err
+	}
+
+	err = c.poll(func() (bool, error) {
+		if o.Status == statusInvalid {
+			return false, fmt.Errorf("acme: order for %v is invalid", domain)
+		}
+		if o.Status == statusValid {
+			return true, nil
+		}
+		_, body, err := c.post(orderURL, nil)
+		if err != nil {
+			return false, err
+		}
+		return false, json.Unmarshal(body, &o)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, cert, err := c.post(o.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := MarshalKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, keyPEM, nil
+}
+
+func (c *Client) authorize(url string, solver *HTTP01Solver) error {
+	var a authorization
+	_, body, err := c.post(url, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &a); err != nil {
+		return err
+	}
+	if a.Status == statusValid {
+		return nil
+	}
+
+	var ch *challenge
+	for i := range a.Challenges {
+		if a.Challenges[i].Type == "http-01" {
+			ch = &a.Challenges[i]
+		}
+	}
+	if ch == nil {
+		return fmt.Errorf("acme: http-01 challenge is not offered for %v", a.Identifier.Value)
+	}
+
+	keyAuth, err := c.keyAuthorization(ch.Token)
+	if err != nil {
+		return err
+	}
+	if err := solver.add(ch.Token, keyAuth); err != nil {
+		return err
+	}
+	defer solver.remove(ch.Token)
+
+	if _, _, err := c.post(ch.URL, struct{}{}); err != nil {
+		return err
+	}
+	return c.poll(func() (bool, error) {
+		_, body, err := c.post(url, nil)
+		if err != nil {
+			return false, err
+		}
+		if err := json.Unmarshal(body, &a); err != nil {
+			return false, err
+		}
+		switch a.Status {
+		case statusValid:
+			return true, nil
+		case statusInvalid:
+			for _, ch := range a.Challenges {
+				if ch.Error != nil {
+					return false, ch.Error
+				}
+			}
+			return false, fmt.Errorf("acme: authorization for %v is invalid", a.Identifier.Value)
+		}
+		return false, nil
+	})
+}
+
+func (c *Client) poll(done func() (bool, error)) error {
+	interval, timeout := c.PollInterval, c.PollTimeout
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	if timeout == 0 {
+		timeout = defaultPollTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("acme: timeout waiting for the certificate authority")
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (c *Client) discover() error {
+	if c.dir != nil {
+		return nil
+	}
+	re, err := c.httpClient().Get(c.DirectoryURL)
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: failed to get directory %v: %v", c.DirectoryURL, re.Status)
+	}
+	var d directory
+	if err := json.NewDecoder(re.Body).Decode(&d); err != nil {
+		return err
+	}
+	c.dir = &d
+	return nil
+}
+
+func (c *Client) nonce() (string, error) {
+	if len(c.nonces) != 0 {
+		n := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		return n, nil
+	}
+	re, err := c.httpClient().Head(c.dir.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	re.Body.Close()
+	n := re.Header.Get("Replay-Nonce")
+	if n == "" {
+		return "", fmt.Errorf("acme: nonce is missing")
+	}
+	return n, nil
+}
+
+// post sends the JWS signed payload, nil payload sends POST-as-GET request. Requests rejected
+// because of the bad nonce are retried once, as servers may expire nonces at any time.
+func (c *Client) post(url string, payload interface{}) (*http.Response, []byte, error) {
+	for i := 0; ; i++ {
+		re, body, err := c.postOnce(url, payload)
+		if p, ok := err.(*Problem); ok && p.Type == badNonceError && i == 0 {
+			continue
+		}
+		return re, body, err
+	}
+}
+
+func (c *Client) postOnce(url string, payload interface{}) (*http.Response, []byte, error) {
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := c.sign(url, nonce, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	re, err := c.httpClient().Post(url, "application/jose+json", bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer re.Body.Close()
+	if n := re.Header.Get("Replay-Nonce"); n != "" {
+		c.nonces = append(c.nonces, n)
+	}
+	body, err := ioutil.ReadAll(re.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if re.StatusCode >= http.StatusBadRequest {
+		p := &Problem{Status: re.StatusCode}
+		if err := json.Unmarshal(body, p); err != nil || p.Type == "" {
+			return nil, nil, fmt.Errorf("acme: %v %v: %v", url, re.Status, string(body))
+		}
+		return nil, nil, p
+	}
+	return re, body, nil
+}
+
+// sign returns JWS in flattened JSON serialization, the account key is referenced by
+// its URL once the account is registered and embedded as JWK before that
+func (c *Client) sign(url, nonce string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = jwk(&c.Key.PublicKey)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if payload != nil {
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	input := encode(header) + "." + encode(body)
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, c.Key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return json.Marshal(map[string]string{
+		"protected": encode(header),
+		"payload":   encode(body),
+		"signature": encode(sig),
+	})
+}
+
+func (c *Client) keyAuthorization(token string) (string, error) {
+	t, err := Thumbprint(&c.Key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	return token + "." + t, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+type ecJWK struct {
+	Crv string `json:"crv"`
+	Kty string `json:"kty"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func jwk(pub *ecdsa.PublicKey) ecJWK {
+	return ecJWK{Crv: "P-256", Kty: "EC", X: encode(pad(pub.X)), Y: encode(pad(pub.Y))}
+}
+
+// Thumbprint returns RFC 7638 thumbprint of the account key used in the key authorizations
+func Thumbprint(pub *ecdsa.PublicKey) (string, error) {
+	// fields of ecJWK are declared in the lexicographic order required by the thumbprint
+	data, err := json.Marshal(jwk(pub))
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return encode(hash[:]), nil
+}
+
+// NewKey generates the account key
+func NewKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// MarshalKey returns PEM encoded private key
+func MarshalKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParseKey parses PEM encoded private key
+func ParseKey(data []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("acme: failed to decode PEM key")
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+func pad(v *big.Int) []byte {
+	out := make([]byte, 32)
+	return v.FillBytes(out)
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
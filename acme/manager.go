@@ -0,0 +1,264 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	DefaultRenewBefore   = 30 * 24 * time.Hour
+	DefaultCheckInterval = time.Minute
+	maxRetryInterval     = time.Hour
+	// orderLockTTL is how long the order lock of the crashed instance is held, it outlasts the order
+	orderLockTTL = 10 * time.Minute
+)
+
+type Options struct {
+	// Solver answers HTTP-01 challenges, it has to be wired to the proxy listeners
+	Solver *HTTP01Solver
+	// RenewBefore is how long before the expiry certificates are renewed. Certificates valid for a shorter
+	// period are renewed once two thirds of their lifetime have passed.
+	RenewBefore time.Duration
+	// CheckInterval is the interval between checks of the host certificates
+	CheckInterval time.Duration
+	// HTTPClient is used to talk to the certificate authorities
+	HTTPClient   *http.Client
+	TimeProvider timetools.TimeProvider
+	// Owner identifies the instance in the order locks, the host name and the pid with the random suffix by default
+	Owner string
+}
+
+// Manager keeps certificates of the hosts with ACME settings issued and up to date. Issued certificates
+// are stored in the engine, so all the proxy instances pick them up as any other host update. If the engine
+// keeps the ACME state, see engine.ACMEStore, the instances sharing it take the order lock of the host before
+// ordering its certificate and answer the challenges of each other's orders.
+type Manager struct {
+	ng      engine.Engine
+	options Options
+
+	failures map[engine.HostKey]int
+	retryAt  map[engine.HostKey]time.Time
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewManager(ng engine.Engine, o Options) *Manager {
+	if o.Solver == nil {
+		if st, ok := ng.(engine.ACMEStore); ok {
+			o.Solver = NewSharedHTTP01Solver(st)
+		} else {
+			o.Solver = NewHTTP01Solver()
+		}
+	}
+	if o.Owner == "" {
+		o.Owner = defaultOwner()
+	}
+	if o.RenewBefore == 0 {
+		o.RenewBefore = DefaultRenewBefore
+	}
+	if o.CheckInterval == 0 {
+		o.CheckInterval = DefaultCheckInterval
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Manager{
+		ng:       ng,
+		options:  o,
+		failures: make(map[engine.HostKey]int),
+		retryAt:  make(map[engine.HostKey]time.Time),
+		stopC:    make(chan struct{}),
+	}
+}
+
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go m.run()
+}
+
+// Stop stops the manager and waits for the certificate being issued, if any
+func (m *Manager) Stop() {
+	close(m.stopC)
+	m.wg.Wait()
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.options.CheckInterval)
+	defer ticker.Stop()
+	for {
+		m.check()
+		select {
+		case <-ticker.C:
+		case <-m.stopC:
+			return
+		}
+	}
+}
+
+// check issues certificates for the hosts that have none or have them expiring soon,
+// failed hosts are retried with exponential backoff
+func (m *Manager) check() {
+	hosts, err := m.ng.GetHosts()
+	if err != nil {
+		log.Errorf("acme: failed to get hosts: %v", err)
+		return
+	}
+	now := m.options.TimeProvider.UtcNow()
+	for _, h := range hosts {
+		hk := engine.HostKey{Name: h.Name}
+		if h.Settings.ACME == nil || !m.needsCertificate(h, now) {
+			delete(m.failures, hk)
+			delete(m.retryAt, hk)
+			continue
+		}
+		if t, ok := m.retryAt[hk]; ok && now.Before(t) {
+			continue
+		}
+		select {
+		case <-m.stopC:
+			return
+		default:
+		}
+		ordered, err := m.order(h)
+		if err != nil {
+			m.failures[hk]++
+			retry := m.options.CheckInterval << uint(m.failures[hk])
+			if retry > maxRetryInterval || retry <= 0 {
+				retry = maxRetryInterval
+			}
+			m.retryAt[hk] = now.Add(retry)
+			log.Errorf("acme: failed to obtain certificate for %v, retry in %v: %v", h.Name, retry, err)
+			continue
+		}
+		if !ordered {
+			continue
+		}
+		delete(m.failures, hk)
+		delete(m.retryAt, hk)
+		log.Infof("acme: obtained certificate for %v", h.Name)
+	}
+}
+
+func (m *Manager) needsCertificate(h engine.Host, now time.Time) bool {
+	if h.Settings.KeyPair == nil {
+		return true
+	}
+	block, _ := pem.Decode(h.Settings.KeyPair.Cert)
+	if block == nil {
+		return true
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true
+	}
+	renewBefore := m.options.RenewBefore
+	if lifetime := cert.NotAfter.Sub(cert.NotBefore); renewBefore > lifetime/3 {
+		renewBefore = lifetime / 3
+	}
+	return now.After(cert.NotAfter.Add(-renewBefore))
+}
+
+// order provisions the certificate of the host holding its order lock, so the instances sharing the engine do not
+// order it at the same time. Returns false if the certificate has not been ordered, e.g. another instance holds
+// the lock or has already renewed the certificate.
+func (m *Manager) order(h engine.Host) (bool, error) {
+	st, ok := m.ng.(engine.ACMEStore)
+	if !ok {
+		return true, m.provision(h)
+	}
+	locked, err := st.LockOrder(h.Name, m.options.Owner, orderLockTTL)
+	if err != nil {
+		return false, err
+	}
+	if !locked {
+		log.Infof("acme: certificate for %v is being ordered by another instance", h.Name)
+		return false, nil
+	}
+	defer func() {
+		if err := st.UnlockOrder(h.Name, m.options.Owner); err != nil {
+			log.Warningf("acme: failed to unlock order of %v, it expires in %v: %v", h.Name, orderLockTTL, err)
+		}
+	}()
+
+	// the certificate could have been issued by the instance holding the lock before
+	latest, err := m.ng.GetHost(engine.HostKey{Name: h.Name})
+	if err != nil {
+		return false, err
+	}
+	if latest.Settings.ACME == nil || !m.needsCertificate(*latest, m.options.TimeProvider.UtcNow()) {
+		return false, nil
+	}
+	return true, m.provision(*latest)
+}
+
+func (m *Manager) provision(h engine.Host) error {
+	key, err := m.accountKey(h)
+	if err != nil {
+		return err
+	}
+	s := h.Settings.ACME
+	c := &Client{DirectoryURL: s.Directory(), Key: key, HTTPClient: m.options.HTTPClient}
+	if err := c.Register(s.Email); err != nil {
+		return err
+	}
+	cert, certKey, err := c.ObtainCertificate(h.Name, m.options.Solver)
+	if err != nil {
+		return err
+	}
+
+	// the host could have been updated while the certificate was issued
+	latest, err := m.ng.GetHost(engine.HostKey{Name: h.Name})
+	if err != nil {
+		return err
+	}
+	if latest.Settings.ACME == nil {
+		return fmt.Errorf("ACME has been turned off for %v", h.Name)
+	}
+	latest.Settings.KeyPair = &engine.KeyPair{Cert: cert, Key: certKey}
+	return m.ng.UpsertHost(*latest)
+}
+
+// accountKey returns the host account key, the new key is generated and stored
+// along with the host before the registration, so restarts reuse the same account
+func (m *Manager) accountKey(h engine.Host) (*ecdsa.PrivateKey, error) {
+	if len(h.Settings.ACME.AccountKey) != 0 {
+		return ParseKey(h.Settings.ACME.AccountKey)
+	}
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := MarshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s := *h.Settings.ACME
+	s.AccountKey = data
+	h.Settings.ACME = &s
+	if err := m.ng.UpsertHost(h); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func defaultOwner() string {
+	host, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return fmt.Sprintf("%v-%d-%v", host, os.Getpid(), hex.EncodeToString(suffix))
+}
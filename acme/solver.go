@@ -0,0 +1,95 @@
+package acme
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// HTTP01ChallengePath is the path prefix the certificate authority fetches HTTP-01 challenge responses from
+const HTTP01ChallengePath = "/.well-known/acme-challenge/"
+
+// challengeTTL is how long the shared challenges are kept if the instance ordering the certificate fails to
+// delete them, it outlasts the validation of the challenge
+const challengeTTL = 10 * time.Minute
+
+// HTTP01Solver keeps key authorizations of pending HTTP-01 challenges and serves them on the proxy listeners
+type HTTP01Solver struct {
+	mtx    sync.RWMutex
+	tokens map[string]string
+	// store shares the challenges with the other proxy instances, nil if the challenges are kept locally
+	store engine.ACMEStore
+}
+
+func NewHTTP01Solver() *HTTP01Solver {
+	return &HTTP01Solver{tokens: make(map[string]string)}
+}
+
+// NewSharedHTTP01Solver returns the solver keeping the challenges in the store, so the certificate authority
+// reaching any of the proxy instances sharing the store gets the challenges ordered by any of them
+func NewSharedHTTP01Solver(store engine.ACMEStore) *HTTP01Solver {
+	return &HTTP01Solver{tokens: make(map[string]string), store: store}
+}
+
+// Wrap returns the handler answering pending challenges, all other requests are passed to the next handler
+func (s *HTTP01Solver) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, HTTP01ChallengePath) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		keyAuth, ok := s.get(strings.TrimPrefix(r.URL.Path, HTTP01ChallengePath))
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// get returns the key authorization of the token, the challenges of the other instances are looked up in the store
+func (s *HTTP01Solver) get(token string) (string, bool) {
+	s.mtx.RLock()
+	keyAuth, ok := s.tokens[token]
+	s.mtx.RUnlock()
+	if ok || s.store == nil {
+		return keyAuth, ok
+	}
+	keyAuth, err := s.store.GetChallenge(token)
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			log.Errorf("acme: failed to get challenge %v: %v", token, err)
+		}
+		return "", false
+	}
+	return keyAuth, true
+}
+
+// add makes the challenge served by this instance and, if there is the store, by the instances sharing it
+func (s *HTTP01Solver) add(token, keyAuth string) error {
+	if s.store != nil {
+		if err := s.store.UpsertChallenge(token, keyAuth, challengeTTL); err != nil {
+			return err
+		}
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.tokens[token] = keyAuth
+	return nil
+}
+
+func (s *HTTP01Solver) remove(token string) {
+	s.mtx.Lock()
+	delete(s.tokens, token)
+	s.mtx.Unlock()
+	if s.store != nil {
+		if err := s.store.DeleteChallenge(token); err != nil {
+			log.Warningf("acme: failed to delete challenge %v, it expires in %v: %v", token, challengeTTL, err)
+		}
+	}
+}
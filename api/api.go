@@ -1,6 +1,7 @@
 package api
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -18,65 +19,194 @@ import (
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
+	"github.com/vulcand/vulcand/secret"
 )
 
+// Supervisor provides the proxy stats and reports whether the proxy is ready to serve
+type Supervisor interface {
+	engine.StatsProvider
+	Ready() error
+	// SubscribeChanges returns the subscription to the changes applied to the proxy
+	SubscribeChanges() engine.ChangeSubscription
+	// ServerTimeouts returns the server timeouts of the proxy instance
+	ServerTimeouts() (*engine.ServerTimeouts, error)
+	// UpdateServerTimeouts applies the server timeouts to the proxy instance, they are not stored in the engine
+	UpdateServerTimeouts(engine.ServerTimeouts) error
+	PurgeCache(fk engine.FrontendKey, prefix string) (int, error)
+	QuarantineServer(sk engine.ServerKey, quarantined bool) error
+}
+
+// CertLister lists the host certificates with their expiry
+type CertLister interface {
+	Certs() []engine.CertExpiry
+}
+
 type ProxyController struct {
 	ng    engine.Engine
 	stats engine.StatsProvider
+	sup   Supervisor
+	box   *secret.Box
+	audit *AuditLog
+	// startup reports the phase the service startup is blocked on, optional
+	startup Startup
+	// namespace is the namespace the controller is scoped to, empty if it is not scoped
+	namespace string
+	// registrations are the servers registered through the API, shared by the scoped controllers
+	registrations *serverRegistrations
 }
 
-func InitProxyController(ng engine.Engine, stats engine.StatsProvider, router *mux.Router) {
-	c := &ProxyController{ng: ng, stats: stats}
+// InitProxyController registers the API handlers in the router. If auth is set, the mutating
+// endpoints require a valid API token. The box seals the host secrets in the configuration export, it can be nil.
+// If audit is set, the changes made through the API are recorded in it. If startup is set, the readiness reports
+// the startup phase the service is blocked on and the timings of the phases are served.
+func InitProxyController(ng engine.Engine, sup Supervisor, router *mux.Router, auth *TokenAuth, box *secret.Box, audit *AuditLog, startup Startup) {
+	c := &ProxyController{ng: ng, stats: sup, sup: sup, box: box, audit: audit, startup: startup, registrations: newServerRegistrations()}
+
+	mutating := func(fn handlerWithBodyFn) http.Handler {
+		h := handlerWithBody(fn)
+		if auth == nil {
+			return h
+		}
+		return auth.Wrap(h)
+	}
+
+	// scoped handlers work with the namespace given in the namespace parameter, if any
+	scoped := func(fn scopedHandlerFn) handlerWithBodyFn {
+		return func(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+			sc, err := c.scope(r)
+			if err != nil {
+				return nil, err
+			}
+			return fn(sc, w, r, params, body)
+		}
+	}
 
 	router.NotFoundHandler = http.HandlerFunc(c.handleError)
 
+	// Liveness and readiness probes
+	router.HandleFunc("/healthz", c.getHealth).Methods("GET")
+	router.HandleFunc("/readyz", c.getReadiness).Methods("GET")
+	if startup != nil {
+		router.HandleFunc("/v2/startup", handlerWithBody(c.getStartup)).Methods("GET")
+	}
+
 	router.HandleFunc("/v1/status", handlerWithBody(c.getStatus)).Methods("GET")
 	router.HandleFunc("/v2/status", handlerWithBody(c.getStatus)).Methods("GET")
 
 	router.HandleFunc("/v2/pprof/heap", http.HandlerFunc(getHeapProfile)).Methods("GET")
 
 	router.HandleFunc("/v2/log/severity", handlerWithBody(c.getLogSeverity)).Methods("GET")
-	router.HandleFunc("/v2/log/severity", handlerWithBody(c.updateLogSeverity)).Methods("PUT")
+	router.Handle("/v2/log/severity", mutating(c.updateLogSeverity)).Methods("PUT")
+
+	// Server timeouts of this instance, they are not stored in the engine and the other instances
+	// sharing the configuration keep their own ones
+	router.HandleFunc("/v2/instance/timeouts", handlerWithBody(c.getServerTimeouts)).Methods("GET")
+	router.Handle("/v2/instance/timeouts", mutating(c.updateServerTimeouts)).Methods("PUT")
 
 	// Hosts
-	router.HandleFunc("/v2/hosts", handlerWithBody(c.upsertHost)).Methods("POST")
-	router.HandleFunc("/v2/hosts", handlerWithBody(c.getHosts)).Methods("GET")
-	router.HandleFunc("/v2/hosts/{hostname}", handlerWithBody(c.getHost)).Methods("GET")
-	router.HandleFunc("/v2/hosts/{hostname}", handlerWithBody(c.deleteHost)).Methods("DELETE")
+	router.Handle("/v2/hosts", mutating(scoped((*ProxyController).upsertHost))).Methods("POST")
+	router.HandleFunc("/v2/hosts", handlerWithBody(scoped((*ProxyController).getHosts))).Methods("GET")
+	router.HandleFunc("/v2/hosts/{hostname}", handlerWithBody(scoped((*ProxyController).getHost))).Methods("GET")
+	router.Handle("/v2/hosts/{hostname}", mutating(scoped((*ProxyController).deleteHost))).Methods("DELETE")
 
 	// Listeners
-	router.HandleFunc("/v2/listeners", handlerWithBody(c.getListeners)).Methods("GET")
-	router.HandleFunc("/v2/listeners", handlerWithBody(c.upsertListener)).Methods("POST")
-	router.HandleFunc("/v2/listeners/{id}", handlerWithBody(c.getListener)).Methods("GET")
-	router.HandleFunc("/v2/listeners/{id}", handlerWithBody(c.deleteListener)).Methods("DELETE")
+	router.HandleFunc("/v2/listeners", handlerWithBody(scoped((*ProxyController).getListeners))).Methods("GET")
+	router.Handle("/v2/listeners", mutating(scoped((*ProxyController).upsertListener))).Methods("POST")
+	router.HandleFunc("/v2/listeners/{id}", handlerWithBody(scoped((*ProxyController).getListener))).Methods("GET")
+	router.Handle("/v2/listeners/{id}", mutating(scoped((*ProxyController).deleteListener))).Methods("DELETE")
+	router.Handle("/v2/listeners/{id}/sessionticketkeys", mutating(scoped((*ProxyController).rotateSessionTicketKeys))).Methods("POST")
 
 	// Top provides top-style realtime statistics about frontends and servers
 	router.HandleFunc("/v2/top/frontends", handlerWithBody(c.getTopFrontends)).Methods("GET")
 	router.HandleFunc("/v2/top/servers", handlerWithBody(c.getTopServers)).Methods("GET")
+	router.HandleFunc("/v2/stats", handlerWithBody(c.getProxyStats)).Methods("GET")
+	router.HandleFunc("/v2/stats/latency", handlerWithBody(c.getLatencyStats)).Methods("GET")
 
 	// Frontends
-	router.HandleFunc("/v2/frontends", handlerWithBody(c.upsertFrontend)).Methods("POST")
-	router.HandleFunc("/v2/frontends/{id}", handlerWithBody(c.getFrontend)).Methods("GET")
-	router.HandleFunc("/v2/frontends", handlerWithBody(c.getFrontends)).Methods("GET")
-	router.HandleFunc("/v2/frontends/{id}", handlerWithBody(c.deleteFrontend)).Methods("DELETE")
+	router.Handle("/v2/frontends", mutating(scoped((*ProxyController).upsertFrontend))).Methods("POST")
+	router.HandleFunc("/v2/frontends/{id}", handlerWithBody(scoped((*ProxyController).getFrontend))).Methods("GET")
+	router.HandleFunc("/v2/frontends", handlerWithBody(scoped((*ProxyController).getFrontends))).Methods("GET")
+	router.Handle("/v2/frontends/{id}", mutating(scoped((*ProxyController).deleteFrontend))).Methods("DELETE")
+	router.Handle("/v2/frontends/{id}/cache/purge", mutating(c.purgeCache)).Methods("POST")
 
 	// Backends
-	router.HandleFunc("/v2/backends", handlerWithBody(c.upsertBackend)).Methods("POST")
-	router.HandleFunc("/v2/backends", handlerWithBody(c.getBackends)).Methods("GET")
-	router.HandleFunc("/v2/backends/{id}", handlerWithBody(c.deleteBackend)).Methods("DELETE")
-	router.HandleFunc("/v2/backends/{id}", handlerWithBody(c.getBackend)).Methods("GET")
+	router.Handle("/v2/backends", mutating(scoped((*ProxyController).upsertBackend))).Methods("POST")
+	router.HandleFunc("/v2/backends", handlerWithBody(scoped((*ProxyController).getBackends))).Methods("GET")
+	router.Handle("/v2/backends/{id}", mutating(scoped((*ProxyController).deleteBackend))).Methods("DELETE")
+	router.HandleFunc("/v2/backends/{id}", handlerWithBody(scoped((*ProxyController).getBackend))).Methods("GET")
+	router.HandleFunc("/v2/backends/{id}/health", handlerWithBody(c.getBackendHealth)).Methods("GET")
 
 	// Servers
-	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(c.getServers)).Methods("GET")
-	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(c.upsertServer)).Methods("POST")
-	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.getServer)).Methods("GET")
-	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(c.deleteServer)).Methods("DELETE")
+	router.HandleFunc("/v2/backends/{backendId}/servers", handlerWithBody(scoped((*ProxyController).getServers))).Methods("GET")
+	router.Handle("/v2/backends/{backendId}/servers", mutating(scoped((*ProxyController).upsertServer))).Methods("POST")
+	router.HandleFunc("/v2/backends/{backendId}/servers/{id}", handlerWithBody(scoped((*ProxyController).getServer))).Methods("GET")
+	router.Handle("/v2/backends/{backendId}/servers/{id}", mutating(scoped((*ProxyController).deleteServer))).Methods("DELETE")
+	// Quarantine takes the server out of rotation of this instance keeping it in the engine, deleting the quarantine
+	// puts it back. The quarantine is not stored in the engine, the other instances keep the server in rotation and
+	// the quarantine is lost on restart.
+	router.Handle("/v2/backends/{backendId}/servers/{id}/quarantine", mutating(c.quarantineServer)).Methods("POST")
+	router.Handle("/v2/backends/{backendId}/servers/{id}/quarantine", mutating(c.releaseServer)).Methods("DELETE")
+	// Registration keeps the server in the engine while the client renews it by posting the registration again
+	// within the TTL, the server is deleted once the client stops. It needs the engine supporting registrations.
+	router.Handle("/v2/backends/{backendId}/servers/{id}/registration", mutating(scoped((*ProxyController).registerServer))).Methods("POST")
+	router.Handle("/v2/backends/{backendId}/servers/{id}/registration", mutating(scoped((*ProxyController).deregisterServer))).Methods("DELETE")
 
 	// Middlewares
-	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(c.upsertMiddleware)).Methods("POST")
-	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.getMiddleware)).Methods("GET")
-	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(c.getMiddlewares)).Methods("GET")
-	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(c.deleteMiddleware)).Methods("DELETE")
+	router.Handle("/v2/frontends/{frontend}/middlewares", mutating(scoped((*ProxyController).upsertMiddleware))).Methods("POST")
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares/{id}", handlerWithBody(scoped((*ProxyController).getMiddleware))).Methods("GET")
+	router.HandleFunc("/v2/frontends/{frontend}/middlewares", handlerWithBody(scoped((*ProxyController).getMiddlewares))).Methods("GET")
+	router.Handle("/v2/frontends/{frontend}/middlewares/{id}", mutating(scoped((*ProxyController).deleteMiddleware))).Methods("DELETE")
+
+	// Batch of changes applied atomically
+	router.Handle("/v2/batch", mutating(scoped((*ProxyController).applyBatch))).Methods("POST")
+	// Dry run of the batch, nothing is applied
+	router.Handle("/v2/validate", mutating(scoped((*ProxyController).validate))).Methods("POST")
+
+	// Configuration export and import as a single document
+	router.Handle("/v2/config", mutating(scoped((*ProxyController).exportConfig))).Methods("GET")
+	router.Handle("/v2/config", mutating(scoped((*ProxyController).importConfig))).Methods("POST")
+
+	// Stream of the configuration changes, it starts with the whole configuration like the export does.
+	// The stream writes the response on its own, it is scoped to the namespace like the handlers above.
+	var events http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := parseForm(r); err != nil {
+			sendResponse(w, fmt.Sprintf("failed to parse request, err=%v", err), http.StatusInternalServerError)
+			return
+		}
+		sc, err := c.scope(r)
+		if err != nil {
+			sendError(w, err)
+			return
+		}
+		sc.streamChanges(w, r)
+	})
+	if auth != nil {
+		events = auth.Wrap(events)
+	}
+	router.Handle("/v2/events", events).Methods("GET")
+}
+
+type scopedHandlerFn func(c *ProxyController, w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error)
+
+// scope returns the controller working with the engine of the namespace from the request, ids are
+// the ids in the namespace then
+func (c *ProxyController) scope(r *http.Request) (*ProxyController, error) {
+	name := r.Form.Get("namespace")
+	if name == "" {
+		return c, nil
+	}
+	namespaced, ok := c.ng.(engine.Namespaced)
+	if !ok {
+		return nil, &engine.InvalidFormatError{Message: "engine has no namespaces"}
+	}
+	ng, err := namespaced.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	sc := *c
+	sc.ng = ng
+	sc.namespace = name
+	return &sc, nil
 }
 
 func (c *ProxyController) handleError(w http.ResponseWriter, r *http.Request) {
@@ -89,26 +219,122 @@ func (c *ProxyController) getStatus(w http.ResponseWriter, r *http.Request, para
 	}, nil
 }
 
+// InitCertController registers the endpoint listing the host certificates with their expiry in the router
+func InitCertController(router *mux.Router, certs CertLister) {
+	router.HandleFunc("/v2/certs", handlerWithBody(func(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+		return Response{
+			"Certs": certs.Certs(),
+		}, nil
+	})).Methods("GET")
+}
+
+func (c *ProxyController) getHealth(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, Response{"Status": "ok"}, http.StatusOK)
+}
+
+// getReadiness reports the state of every subsystem, the status is 503 unless all of them are ready
+func (c *ProxyController) getReadiness(w http.ResponseWriter, r *http.Request) {
+	subsystems := map[string]string{}
+	ready := true
+	check := func(name string, err error) {
+		if err != nil {
+			subsystems[name] = err.Error()
+			ready = false
+			return
+		}
+		subsystems[name] = "ok"
+	}
+	if c.startup != nil {
+		check("startup", c.startup.StartupStatus().pendingError())
+	}
+	_, err := c.ng.GetHosts()
+	check("engine", err)
+	check("proxy", c.sup.Ready())
+
+	if !ready {
+		sendResponse(w, Response{"Status": "not ready", "Subsystems": subsystems}, http.StatusServiceUnavailable)
+		return
+	}
+	sendResponse(w, Response{"Status": "ok", "Subsystems": subsystems}, http.StatusOK)
+}
+
+func (c *ProxyController) getServerTimeouts(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	t, err := c.sup.ServerTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	return Response{"Read": t.Read.String(), "Write": t.Write.String(), "Idle": t.Idle.String()}, nil
+}
+
+// updateServerTimeouts applies the read, write and idle timeouts passed in the form to this instance, the
+// timeouts missing in the form are kept
+func (c *ProxyController) updateServerTimeouts(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	t, err := c.sup.ServerTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	old := *t
+	for name, d := range map[string]*time.Duration{"read": &t.Read, "write": &t.Write, "idle": &t.Idle} {
+		v := r.Form.Get(name)
+		if v == "" {
+			continue
+		}
+		if *d, err = time.ParseDuration(v); err != nil {
+			return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("invalid %v timeout: %v", name, err)}
+		}
+	}
+	if err := t.Check(); err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	err = c.sup.UpdateServerTimeouts(*t)
+	c.auditSetting(r, "timeouts", old.String(), t.String(), err)
+	if err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("Server timeouts have been updated to %v", t)}, nil
+}
+
+// getLogSeverity returns the severity the process logs with, the one set on startup until it is changed
 func (c *ProxyController) getLogSeverity(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	return Response{
-		"severity": c.ng.GetLogSeverity().String(),
+		"severity": log.GetLevel().String(),
 	}, nil
 }
 
+// updateLogSeverity changes the severity of the whole process right away, e.g. to debug during the incident and
+// back afterwards. The change is not stored, the restarted process logs with the severity of its options.
 func (c *ProxyController) updateLogSeverity(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	sev, err := log.ParseLevel(strings.ToLower(r.Form.Get("severity")))
 	if err != nil {
-		return nil, err
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	old := log.GetLevel()
+	// the change is logged while the more verbose of the two severities is set, so it shows up either way
+	if sev < old {
+		logSeverityChange(old, sev, old)
 	}
 	c.ng.SetLogSeverity(sev)
+	log.SetLevel(sev)
+	if sev >= old {
+		logSeverityChange(old, sev, sev)
+	}
+	c.auditSetting(r, "severity", old.String(), sev.String(), nil)
 	return Response{"message": fmt.Sprintf("Severity has been updated to %v", sev.String())}, nil
 }
 
+// logSeverityChange logs the severity change at the level the current severity shows, the fatal and panic levels
+// exit the process, so with both severities above the error level the change is in the audit log only
+func logSeverityChange(old, sev, current log.Level) {
+	switch {
+	case current >= log.WarnLevel:
+		log.Warnf("Log severity is changed from %v to %v", old, sev)
+	case current == log.ErrorLevel:
+		log.Errorf("Log severity is changed from %v to %v", old, sev)
+	}
+}
+
 func (c *ProxyController) getHosts(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	hosts, err := c.ng.GetHosts()
-	return Response{
-		"Hosts": hosts,
-	}, err
+	return listPage(r, "Hosts", c.ng.GetHosts, func(h engine.Host) string { return h.Name }, nil)
 }
 
 func (c *ProxyController) getHost(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -120,12 +346,30 @@ func (c *ProxyController) getHost(w http.ResponseWriter, r *http.Request, params
 }
 
 func (c *ProxyController) getFrontends(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	fs, err := c.ng.GetFrontends()
+	var pager func(engine.Page) ([]engine.Frontend, *engine.Page, error)
+	if pg, ok := c.ng.(engine.Pager); ok {
+		pager = pg.GetFrontendsPage
+	}
+	return listPage(r, "Frontends", c.ng.GetFrontends, func(f engine.Frontend) string { return f.Id }, pager)
+}
+
+func (c *ProxyController) getProxyStats(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	stats, err := c.stats.ProxyStats()
 	if err != nil {
 		return nil, err
 	}
 	return Response{
-		"Frontends": fs,
+		"Stats": stats,
+	}, nil
+}
+
+func (c *ProxyController) getLatencyStats(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	stats, err := c.stats.LatencyStats()
+	if err != nil {
+		return nil, err
+	}
+	return Response{
+		"Latency": stats,
 	}, nil
 }
 
@@ -160,14 +404,22 @@ func (c *ProxyController) upsertHost(w http.ResponseWriter, r *http.Request, par
 		return nil, err
 	}
 	log.Infof("Upsert %s", host)
-	return formatResult(host, c.ng.UpsertHost(*host))
+	return formatResult(host, c.apply(r, engine.BatchOp{Change: &engine.HostUpserted{Host: *host}}))
 }
 
 func (c *ProxyController) getListeners(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	ls, err := c.ng.GetListeners()
-	return Response{
-		"Listeners": ls,
-	}, err
+	list := func() ([]engine.Listener, error) {
+		ls, err := c.ng.GetListeners()
+		if err != nil {
+			return nil, err
+		}
+		// the session ticket keys decrypt the recorded sessions, they are never served
+		for i := range ls {
+			ls[i] = stripSessionTicketKeys(ls[i])
+		}
+		return ls, nil
+	}
+	return listPage(r, "Listeners", list, func(l engine.Listener) string { return l.Id }, nil)
 }
 
 func (c *ProxyController) upsertListener(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -176,17 +428,112 @@ func (c *ProxyController) upsertListener(w http.ResponseWriter, r *http.Request,
 		return nil, err
 	}
 	log.Infof("Upsert %s", listener)
-	return formatResult(listener, c.ng.UpsertListener(*listener))
+	if err := c.checkListenerAddress(*listener); err != nil {
+		return nil, err
+	}
+	if err := c.keepSessionTicketKeys(listener); err != nil {
+		return nil, err
+	}
+	if err := c.apply(r, engine.BatchOp{Change: &engine.ListenerUpserted{Listener: *listener}}); err != nil {
+		return nil, err
+	}
+	return stripSessionTicketKeys(*listener), nil
+}
+
+// keepSessionTicketKeys sets the current session ticket keys of the HTTPS listener upserted without them, the keys
+// are changed by the rotation only
+func (c *ProxyController) keepSessionTicketKeys(l *engine.Listener) error {
+	if l.Protocol != engine.HTTPS || (l.Settings != nil && len(l.Settings.TLS.SessionTicketKeys) != 0) {
+		return nil
+	}
+	existing, err := c.ng.GetListener(engine.ListenerKey{Id: l.Id})
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	if existing.Settings == nil || len(existing.Settings.TLS.SessionTicketKeys) == 0 {
+		return nil
+	}
+	if l.Settings == nil {
+		l.Settings = &engine.HTTPSListenerSettings{}
+	}
+	l.Settings.TLS.SessionTicketKeys = existing.Settings.TLS.SessionTicketKeys
+	return nil
+}
+
+// maxRotateAttempts is the amount of the session ticket key rotations tried before the conflict is returned
+const maxRotateAttempts = 5
+
+// rotateSessionTicketKeys appends the new random session ticket key to the keys of the HTTPS listener and retires
+// the oldest one, see engine.TLSSettings.RotateSessionTicketKeys. The proxy instances pick the keys up from the
+// engine, the sessions resumed with the retired key fall back to the full handshake. The listener is swapped, so the
+// concurrent rotations do not drop each other's keys, the rotation is retried with the listener read again on conflict.
+func (c *ProxyController) rotateSessionTicketKeys(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	for attempt := 1; ; attempt++ {
+		old, err := c.ng.GetListener(engine.ListenerKey{Id: params["id"]})
+		if err != nil {
+			return nil, err
+		}
+		if old.Protocol != engine.HTTPS {
+			return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("%v is not an %v listener", old, engine.HTTPS)}
+		}
+		key := make([]byte, engine.SessionTicketKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		// the settings are copied, the engine may share them with the listener it has returned
+		l := *old
+		settings := engine.HTTPSListenerSettings{}
+		if old.Settings != nil {
+			settings = *old.Settings
+		}
+		l.Settings = &settings
+		if err := l.Settings.TLS.RotateSessionTicketKeys(key); err != nil {
+			return nil, err
+		}
+		log.Infof("Rotate session ticket keys of %v", &l)
+		err = c.swapListener(r, *old, l)
+		if _, ok := err.(*engine.ConflictError); ok && attempt < maxRotateAttempts {
+			log.Infof("%v has been changed during the rotation, retrying: %v", &l, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return Response{"message": "session ticket keys rotated", "Keys": len(l.Settings.TLS.SessionTicketKeys)}, nil
+	}
+}
+
+// checkListenerAddress rejects the listener using the address of another listener, the proxy would refuse to start it.
+// The unix socket paths are compared as the addresses, the addresses taken by the other processes are reported
+// by the proxy binding the listener.
+func (c *ProxyController) checkListenerAddress(l engine.Listener) error {
+	ls, err := c.ng.GetListeners()
+	if err != nil {
+		return err
+	}
+	for _, o := range ls {
+		if o.Id != l.Id && o.Address.Equals(l.Address) {
+			return &engine.ListenerConflictError{Listener: engine.ListenerKey{Id: l.Id}, Existing: o}
+		}
+	}
+	return nil
 }
 
 func (c *ProxyController) getListener(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	log.Infof("Get Listener(id=%s)", params["id"])
-	return formatResult(c.ng.GetListener(engine.ListenerKey{Id: params["id"]}))
+	l, err := c.ng.GetListener(engine.ListenerKey{Id: params["id"]})
+	if err != nil {
+		return nil, err
+	}
+	return stripSessionTicketKeys(*l), nil
 }
 
 func (c *ProxyController) deleteListener(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	log.Infof("Delete Listener(id=%s)", params["id"])
-	if err := c.ng.DeleteListener(engine.ListenerKey{Id: params["id"]}); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: params["id"]}}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": "Listener deleted"}, nil
@@ -195,7 +542,7 @@ func (c *ProxyController) deleteListener(w http.ResponseWriter, r *http.Request,
 func (c *ProxyController) deleteHost(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	hostname := params["hostname"]
 	log.Infof("Delete host: %s", hostname)
-	if err := c.ng.DeleteHost(engine.HostKey{Name: hostname}); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.HostDeleted{HostKey: engine.HostKey{Name: hostname}}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": fmt.Sprintf("Host '%s' deleted", hostname)}, nil
@@ -207,23 +554,20 @@ func (c *ProxyController) upsertBackend(w http.ResponseWriter, r *http.Request,
 		return nil, err
 	}
 	log.Infof("Upsert Backend: %s", b)
-	return formatResult(b, c.ng.UpsertBackend(*b))
+	return formatResult(b, c.apply(r, engine.BatchOp{Change: &engine.BackendUpserted{Backend: *b}}))
 }
 
 func (c *ProxyController) deleteBackend(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	backendId := params["id"]
 	log.Infof("Delete Backend(id=%s)", backendId)
-	if err := c.ng.DeleteBackend(engine.BackendKey{Id: backendId}); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: backendId}}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": "Backend deleted"}, nil
 }
 
 func (c *ProxyController) getBackends(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	backends, err := c.ng.GetBackends()
-	return Response{
-		"Backends": backends,
-	}, err
+	return listPage(r, "Backends", c.ng.GetBackends, func(b engine.Backend) string { return b.Id }, nil)
 }
 
 func (c *ProxyController) getTopServers(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -254,23 +598,46 @@ func (c *ProxyController) getBackend(w http.ResponseWriter, r *http.Request, par
 	return formatResult(c.ng.GetBackend(engine.BackendKey{Id: params["id"]}))
 }
 
+func (c *ProxyController) getBackendHealth(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	servers, err := c.stats.BackendHealth(engine.BackendKey{Id: params["id"]})
+	if err != nil {
+		return nil, err
+	}
+	return Response{
+		"Servers": servers,
+	}, nil
+}
+
 func (c *ProxyController) upsertFrontend(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	frontend, ttl, err := parseFrontendPack(c.ng.GetRegistry().GetRouter(), body)
 	if err != nil {
 		return nil, err
 	}
 	log.Infof("Upsert %s", frontend)
-	return formatResult(frontend, c.ng.UpsertFrontend(*frontend, ttl))
+	return formatResult(frontend, c.apply(r, engine.BatchOp{Change: &engine.FrontendUpserted{Frontend: *frontend}, TTL: ttl}))
 }
 
 func (c *ProxyController) deleteFrontend(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	log.Infof("Delete Frontend(id=%s)", params["id"])
-	if err := c.ng.DeleteFrontend(engine.FrontendKey{Id: params["id"]}); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: params["id"]}}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": "Frontend deleted"}, nil
 }
 
+// purgeCache drops the cached responses of the frontend with the path starting with the prefix, all of them
+// if the prefix is empty. The caches are kept in memory by every proxy instance, the purge applies to this one.
+func (c *ProxyController) purgeCache(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	fk, prefix := engine.FrontendKey{Id: params["id"]}, r.Form.Get("prefix")
+	log.Infof("Purge cache of %v, prefix '%v'", fk, prefix)
+	purged, err := c.sup.PurgeCache(fk, prefix)
+	c.auditOperation(r, auditPurge, "cache", fk.Id, nil, Response{"Prefix": prefix}, err)
+	if err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("%d cached responses purged", purged), "Purged": purged}, nil
+}
+
 func (c *ProxyController) upsertServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	backendId := params["backendId"]
 	srv, ttl, err := parseServerPack(body)
@@ -279,7 +646,37 @@ func (c *ProxyController) upsertServer(w http.ResponseWriter, r *http.Request, p
 	}
 	bk := engine.BackendKey{Id: backendId}
 	log.Infof("Upsert %v %v", bk, srv)
-	return formatResult(srv, c.ng.UpsertServer(bk, *srv, ttl))
+	return formatResult(srv, c.apply(r, engine.BatchOp{Change: &engine.ServerUpserted{BackendKey: bk, Server: *srv}, TTL: ttl}))
+}
+
+func (c *ProxyController) quarantineServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	return c.setQuarantined(r, params, true)
+}
+
+func (c *ProxyController) releaseServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	return c.setQuarantined(r, params, false)
+}
+
+// setQuarantined quarantines or releases the server existing in the engine on this instance
+func (c *ProxyController) setQuarantined(r *http.Request, params map[string]string, quarantined bool) (interface{}, error) {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
+	log.Infof("Quarantine %v: %t", sk, quarantined)
+	if _, err := c.ng.GetServer(sk); err != nil {
+		return nil, err
+	}
+	operation := auditQuarantine
+	if !quarantined {
+		operation = auditRelease
+	}
+	err := c.sup.QuarantineServer(sk, quarantined)
+	c.auditOperation(r, operation, "server", sk.String(), nil, nil, err)
+	if err != nil {
+		return nil, err
+	}
+	if quarantined {
+		return Response{"message": fmt.Sprintf("%v quarantined", sk)}, nil
+	}
+	return Response{"message": fmt.Sprintf("%v released", sk)}, nil
 }
 
 func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -293,19 +690,19 @@ func (c *ProxyController) getServer(w http.ResponseWriter, r *http.Request, para
 }
 
 func (c *ProxyController) getServers(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
-	srvs, err := c.ng.GetServers(engine.BackendKey{Id: params["backendId"]})
-	if err != nil {
-		return nil, err
+	bk := engine.BackendKey{Id: params["backendId"]}
+	var pager func(engine.Page) ([]engine.Server, *engine.Page, error)
+	if pg, ok := c.ng.(engine.Pager); ok {
+		pager = func(p engine.Page) ([]engine.Server, *engine.Page, error) { return pg.GetServersPage(bk, p) }
 	}
-	return Response{
-		"Servers": srvs,
-	}, nil
+	list := func() ([]engine.Server, error) { return c.ng.GetServers(bk) }
+	return listPage(r, "Servers", list, func(s engine.Server) string { return s.Id }, pager)
 }
 
 func (c *ProxyController) deleteServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
 	log.Infof("Delete %v", sk)
-	if err := c.ng.DeleteServer(sk); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.ServerDeleted{ServerKey: sk}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": "Server deleted"}, nil
@@ -317,7 +714,7 @@ func (c *ProxyController) upsertMiddleware(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		return nil, err
 	}
-	return formatResult(m, c.ng.UpsertMiddleware(engine.FrontendKey{Id: frontend}, *m, ttl))
+	return formatResult(m, c.apply(r, engine.BatchOp{Change: &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: frontend}, Middleware: *m}, TTL: ttl}))
 }
 
 func (c *ProxyController) getMiddleware(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
@@ -327,23 +724,44 @@ func (c *ProxyController) getMiddleware(w http.ResponseWriter, r *http.Request,
 
 func (c *ProxyController) getMiddlewares(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	fk := engine.FrontendKey{Id: params["frontend"]}
-	out, err := c.ng.GetMiddlewares(fk)
-	if err != nil {
-		return nil, err
-	}
-	return Response{
-		"Middlewares": out,
-	}, nil
+	list := func() ([]engine.Middleware, error) { return c.ng.GetMiddlewares(fk) }
+	return listPage(r, "Middlewares", list, func(m engine.Middleware) string { return m.Id }, nil)
 }
 
 func (c *ProxyController) deleteMiddleware(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
 	fk := engine.MiddlewareKey{Id: params["id"], FrontendKey: engine.FrontendKey{Id: params["frontend"]}}
-	if err := c.ng.DeleteMiddleware(fk); err != nil {
+	if err := c.apply(r, engine.BatchOp{Change: &engine.MiddlewareDeleted{MiddlewareKey: fk}}); err != nil {
 		return nil, err
 	}
 	return Response{"message": "Middleware deleted"}, nil
 }
 
+// applyBatch validates all operations of the batch before applying any of them, the engine applies
+// the whole batch atomically
+func (c *ProxyController) applyBatch(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	batcher, ok := c.ng.(engine.Batcher)
+	if !ok {
+		return nil, &errNotImplemented{Message: "engine does not support atomic batches"}
+	}
+	var bp batchReadPack
+	if err := json.Unmarshal(body, &bp); err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	ops := make([]engine.BatchOp, len(bp.Operations))
+	for i, p := range bp.Operations {
+		op, err := parseBatchOp(p, c.ng.GetRegistry())
+		if err != nil {
+			return nil, &engine.BatchError{Index: i, Err: err}
+		}
+		ops[i] = op
+	}
+	log.Infof("Apply batch of %d operations", len(ops))
+	if err := c.applyAuditedBatch(r, batcher, ops); err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("%d operations applied", len(ops))}, nil
+}
+
 func formGet(form url.Values, key, def string) string {
 	if value := form.Get(key); value != "" {
 		return value
@@ -413,6 +831,215 @@ type serverPack struct {
 	TTL    string
 }
 
+const (
+	batchUpsert = "upsert"
+	batchDelete = "delete"
+)
+
+type batchReadPack struct {
+	Operations []batchOpReadPack
+}
+
+// batchOpReadPack is a single operation of the batch with exactly one entity set. Upserts carry the whole
+// entity as the regular upsert requests do, deletes only need the entity id, e.g.
+// {"Op": "delete", "Frontend": {"Id": "f1"}}. Middlewares and servers refer to their FrontendId and BackendId.
+type batchOpReadPack struct {
+	Op         string
+	Host       json.RawMessage
+	Listener   json.RawMessage
+	Frontend   json.RawMessage
+	Backend    json.RawMessage
+	Middleware json.RawMessage
+	Server     json.RawMessage
+	FrontendId string
+	BackendId  string
+	TTL        string
+}
+
+type batchOpPack struct {
+	Op         string
+	Host       *engine.Host       `json:",omitempty"`
+	Listener   *engine.Listener   `json:",omitempty"`
+	Frontend   *engine.Frontend   `json:",omitempty"`
+	Backend    *engine.Backend    `json:",omitempty"`
+	Middleware *engine.Middleware `json:",omitempty"`
+	Server     *engine.Server     `json:",omitempty"`
+	FrontendId string             `json:",omitempty"`
+	BackendId  string             `json:",omitempty"`
+	TTL        string             `json:",omitempty"`
+}
+
+type batchPack struct {
+	Operations []batchOpPack
+}
+
+func newBatchPack(ops []engine.BatchOp) (*batchPack, error) {
+	bp := &batchPack{}
+	for _, op := range ops {
+		p, err := newBatchOpPack(op)
+		if err != nil {
+			return nil, err
+		}
+		bp.Operations = append(bp.Operations, p)
+	}
+	return bp, nil
+}
+
+func parseBatchOp(p batchOpReadPack, r *plugin.Registry) (engine.BatchOp, error) {
+	var op engine.BatchOp
+	if p.TTL != "" {
+		ttl, err := time.ParseDuration(p.TTL)
+		if err != nil {
+			return op, &engine.InvalidFormatError{Message: fmt.Sprintf("bad TTL: %v", err)}
+		}
+		op.TTL = ttl
+	}
+
+	set := 0
+	for _, v := range []json.RawMessage{p.Host, p.Listener, p.Frontend, p.Backend, p.Middleware, p.Server} {
+		if len(v) != 0 {
+			set++
+		}
+	}
+	if set != 1 {
+		return op, &engine.InvalidFormatError{Message: "operation should have exactly one of Host, Listener, Frontend, Backend, Middleware or Server"}
+	}
+
+	var err error
+	switch p.Op {
+	case batchUpsert:
+		op.Change, err = parseBatchUpsert(p, r)
+	case batchDelete:
+		op.Change, err = parseBatchDelete(p)
+	default:
+		return op, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported operation '%v', expected '%v' or '%v'", p.Op, batchUpsert, batchDelete)}
+	}
+	if err != nil {
+		if _, ok := err.(*engine.InvalidFormatError); !ok {
+			err = &engine.InvalidFormatError{Message: err.Error()}
+		}
+		return op, err
+	}
+	return op, nil
+}
+
+func parseBatchUpsert(p batchOpReadPack, r *plugin.Registry) (interface{}, error) {
+	switch {
+	case len(p.Host) != 0:
+		h, err := engine.HostFromJSON(p.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	case len(p.Listener) != 0:
+		l, err := engine.ListenerFromJSON(p.Listener)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	case len(p.Frontend) != 0:
+		f, err := engine.FrontendFromJSON(r.GetRouter(), p.Frontend)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	case len(p.Backend) != 0:
+		b, err := engine.BackendFromJSON(p.Backend)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	case len(p.Middleware) != 0:
+		m, err := engine.MiddlewareFromJSON(p.Middleware, r.GetSpec)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: p.FrontendId}, Middleware: *m}, nil
+	default:
+		s, err := engine.ServerFromJSON(p.Server)
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: p.BackendId}, Server: *s}, nil
+	}
+}
+
+func parseBatchDelete(p batchOpReadPack) (interface{}, error) {
+	var key struct {
+		Id   string
+		Name string
+	}
+	switch {
+	case len(p.Host) != 0:
+		if err := json.Unmarshal(p.Host, &key); err != nil {
+			return nil, err
+		}
+		return &engine.HostDeleted{HostKey: engine.HostKey{Name: key.Name}}, nil
+	case len(p.Listener) != 0:
+		if err := json.Unmarshal(p.Listener, &key); err != nil {
+			return nil, err
+		}
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: key.Id}}, nil
+	case len(p.Frontend) != 0:
+		if err := json.Unmarshal(p.Frontend, &key); err != nil {
+			return nil, err
+		}
+		return &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: key.Id}}, nil
+	case len(p.Backend) != 0:
+		if err := json.Unmarshal(p.Backend, &key); err != nil {
+			return nil, err
+		}
+		return &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: key.Id}}, nil
+	case len(p.Middleware) != 0:
+		if err := json.Unmarshal(p.Middleware, &key); err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareDeleted{MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: p.FrontendId}, Id: key.Id}}, nil
+	default:
+		if err := json.Unmarshal(p.Server, &key); err != nil {
+			return nil, err
+		}
+		return &engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: p.BackendId}, Id: key.Id}}, nil
+	}
+}
+
+// newBatchOpPack returns the wire format of the batch operation
+func newBatchOpPack(op engine.BatchOp) (batchOpPack, error) {
+	p := batchOpPack{Op: batchUpsert}
+	if op.TTL != 0 {
+		p.TTL = op.TTL.String()
+	}
+	switch c := op.Change.(type) {
+	case *engine.HostUpserted:
+		p.Host = &c.Host
+	case *engine.ListenerUpserted:
+		p.Listener = &c.Listener
+	case *engine.FrontendUpserted:
+		p.Frontend = &c.Frontend
+	case *engine.BackendUpserted:
+		p.Backend = &c.Backend
+	case *engine.MiddlewareUpserted:
+		p.Middleware, p.FrontendId = &c.Middleware, c.FrontendKey.Id
+	case *engine.ServerUpserted:
+		p.Server, p.BackendId = &c.Server, c.BackendKey.Id
+	case *engine.HostDeleted:
+		p.Op, p.Host = batchDelete, &engine.Host{Name: c.HostKey.Name}
+	case *engine.ListenerDeleted:
+		p.Op, p.Listener = batchDelete, &engine.Listener{Id: c.ListenerKey.Id}
+	case *engine.FrontendDeleted:
+		p.Op, p.Frontend = batchDelete, &engine.Frontend{Id: c.FrontendKey.Id}
+	case *engine.BackendDeleted:
+		p.Op, p.Backend = batchDelete, &engine.Backend{Id: c.BackendKey.Id}
+	case *engine.MiddlewareDeleted:
+		p.Op, p.Middleware, p.FrontendId = batchDelete, &engine.Middleware{Id: c.MiddlewareKey.Id}, c.MiddlewareKey.FrontendKey.Id
+	case *engine.ServerDeleted:
+		p.Op, p.Server, p.BackendId = batchDelete, &engine.Server{Id: c.ServerKey.Id}, c.ServerKey.BackendKey.Id
+	default:
+		return p, fmt.Errorf("unsupported batch operation %T", op.Change)
+	}
+	return p, nil
+}
+
 func parseListenerPack(v []byte) (*engine.Listener, error) {
 	var lp listenerReadPack
 	if err := json.Unmarshal(v, &lp); err != nil {
@@ -542,26 +1169,51 @@ func handlerWithBody(fn handlerWithBodyFn) http.HandlerFunc {
 
 		rs, err := fn(w, r, mux.Vars(r), body)
 		if err != nil {
-			var status int
-			switch err.(type) {
-			case *engine.InvalidFormatError:
-				status = http.StatusBadRequest
-			case errMissingField:
-				status = http.StatusBadRequest
-			case *engine.NotFoundError:
-				status = http.StatusNotFound
-			case *engine.AlreadyExistsError:
-				status = http.StatusConflict
-			default:
-				status = http.StatusInternalServerError
-			}
-			sendResponse(w, Response{"message": err.Error()}, status)
+			sendError(w, err)
 			return
 		}
 		sendResponse(w, rs, http.StatusOK)
 	}
 }
 
+// sendError replies with the error message and the status code matching the error
+func sendError(w http.ResponseWriter, err error) {
+	var status int
+	response := Response{"message": err.Error()}
+	switch e := err.(type) {
+	case *engine.BatchError:
+		status = http.StatusBadRequest
+		response["index"] = e.Index
+	case *validationError:
+		status = http.StatusBadRequest
+		response["problems"] = e.Problems
+	case *errNotImplemented:
+		status = http.StatusNotImplemented
+	case *engine.InvalidFormatError:
+		status = http.StatusBadRequest
+	case errMissingField:
+		status = http.StatusBadRequest
+	case *engine.NotFoundError:
+		status = http.StatusNotFound
+	case *engine.AlreadyExistsError:
+		status = http.StatusConflict
+	case *engine.ConflictError:
+		status = http.StatusConflict
+	case *engine.ListenerConflictError:
+		status = http.StatusConflict
+		response["conflict"] = Response{"id": e.Existing.Id, "protocol": e.Existing.Protocol, "address": e.Existing.Address}
+	case *engine.AddressInUseError:
+		status = http.StatusConflict
+		response["address"] = e.Address
+	case *engine.CompactedError:
+		// the snapshot the pages are read at is gone, the listing starts over from the first page
+		status = http.StatusGone
+	default:
+		status = http.StatusInternalServerError
+	}
+	sendResponse(w, response, status)
+}
+
 type Response map[string]interface{}
 
 // Reply with the provided HTTP response and status code.
@@ -596,3 +1248,11 @@ type errMissingField struct {
 func (e errMissingField) Error() string {
 	return fmt.Sprintf("Missing mandatory parameter: %v", e.Field)
 }
+
+type errNotImplemented struct {
+	Message string
+}
+
+func (e *errNotImplemented) Error() string {
+	return e.Message
+}
@@ -1,21 +1,38 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	oxytest "github.com/vulcand/oxy/testutils"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/engine/nsng"
+	"github.com/vulcand/vulcand/plugin/basicauth"
 	"github.com/vulcand/vulcand/plugin/connlimit"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/secret"
 	"github.com/vulcand/vulcand/stapler"
 	"github.com/vulcand/vulcand/supervisor"
 	"github.com/vulcand/vulcand/testutils"
+	"golang.org/x/crypto/bcrypt"
 
 	. "gopkg.in/check.v1"
 )
@@ -26,6 +43,7 @@ type ApiSuite struct {
 	ng         engine.Engine
 	testServer *httptest.Server
 	client     *Client
+	sv         *supervisor.Supervisor
 }
 
 var _ = Suite(&ApiSuite{})
@@ -37,10 +55,10 @@ func (s *ApiSuite) SetUpTest(c *C) {
 
 	s.ng = memng.New(registry.GetRegistry())
 
-	sv := supervisor.New(newProxy, s.ng, supervisor.Options{})
+	s.sv = supervisor.New(newProxy, s.ng, supervisor.Options{})
 
 	router := mux.NewRouter()
-	InitProxyController(s.ng, sv, router)
+	InitProxyController(s.ng, s.sv, router, nil, nil, nil, nil)
 	s.testServer = httptest.NewServer(router)
 	s.client = NewClient(s.testServer.URL, registry.GetRegistry())
 }
@@ -60,21 +78,377 @@ func (s *ApiSuite) TestStatusV1(c *C) {
 	c.Assert(string(body), Equals, `{"Status":"ok"}`)
 }
 
+func (s *ApiSuite) TestHealth(c *C) {
+	re, body, err := oxytest.Get(s.testServer.URL + "/healthz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, `{"Status":"ok"}`)
+}
+
+func (s *ApiSuite) TestReadiness(c *C) {
+	// Supervisor has not started yet
+	re, body, err := oxytest.Get(s.testServer.URL + "/readyz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, `{"Status":"not ready","Subsystems":{"engine":"ok","proxy":"no current proxy"}}`)
+
+	c.Assert(s.sv.Start(), IsNil)
+	re, body, err = oxytest.Get(s.testServer.URL + "/readyz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, `{"Status":"ok","Subsystems":{"engine":"ok","proxy":"ok"}}`)
+
+	s.sv.Stop()
+	re, _, err = oxytest.Get(s.testServer.URL + "/readyz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+}
+
+type startupStatus struct {
+	st *StartupStatus
+}
+
+func (s startupStatus) StartupStatus() StartupStatus {
+	return *s.st
+}
+
+func (s *ApiSuite) TestReadinessStartup(c *C) {
+	st := &StartupStatus{
+		Pending: "supervisor",
+		Phases:  []StartupPhase{{Name: "engine", Duration: time.Second}, {Name: "supervisor", Duration: 3 * time.Second}},
+		Elapsed: 4 * time.Second,
+	}
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, nil, nil, nil, startupStatus{st})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	re, body, err := oxytest.Get(srv.URL + "/readyz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusServiceUnavailable)
+	c.Assert(string(body), Equals, `{"Status":"not ready","Subsystems":{"engine":"ok","proxy":"no current proxy","startup":"starting, waiting for supervisor for 3s"}}`)
+
+	re, body, err = oxytest.Get(srv.URL + "/v2/startup")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, `{"Complete":false,"Elapsed":"4s","Pending":"supervisor","Phases":[{"Duration":"1s","Name":"engine"},{"Duration":"3s","Name":"supervisor"}]}`)
+
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+	st.Pending = ""
+	re, body, err = oxytest.Get(srv.URL + "/readyz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(string(body), Equals, `{"Status":"ok","Subsystems":{"engine":"ok","proxy":"ok","startup":"ok"}}`)
+
+	re, body, err = oxytest.Get(srv.URL + "/v2/startup")
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, `{"Complete":true,.*`)
+}
+
+func (s *ApiSuite) TestProxyStats(c *C) {
+	_, err := s.client.GetProxyStats()
+	c.Assert(err, NotNil)
+
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+
+	stats, err := s.client.GetProxyStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.State, Equals, "active")
+	c.Assert(stats.Listeners, HasLen, 0)
+	c.Assert(stats.Frontends, HasLen, 0)
+}
+
+func (s *ApiSuite) TestLatencyStats(c *C) {
+	_, err := s.client.GetLatencyStats()
+	c.Assert(err, NotNil)
+
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+
+	stats, err := s.client.GetLatencyStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats.Window, Equals, proxy.DefaultLatencyWindow)
+	c.Assert(stats.Frontends, HasLen, 0)
+	c.Assert(stats.Backends, HasLen, 0)
+}
+
+func (s *ApiSuite) TestStreamChanges(c *C) {
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+
+	b := testutils.MakeBatch(testutils.Batch{Addr: "localhost:31000", Route: `Path("/")`, URL: "http://localhost:5000"})
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+
+	re, err := http.Get(s.testServer.URL + "/v2/events")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(re.Header.Get("Content-Type"), Equals, "text/event-stream")
+
+	events := readEvents(re.Body)
+
+	e := nextEvent(c, events)
+	c.Assert(e.name, Equals, "snapshot")
+	var cp configPack
+	c.Assert(json.Unmarshal([]byte(e.data), &cp), IsNil)
+	c.Assert(cp.BackendSpecs, HasLen, 1)
+	c.Assert(cp.BackendSpecs[0].Backend.Id, Equals, b.B.Id)
+
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	e = nextEvent(c, events)
+	c.Assert(e.name, Equals, "change")
+	var ch engine.ChangeEvent
+	c.Assert(json.Unmarshal([]byte(e.data), &ch), IsNil)
+	c.Assert(ch, DeepEquals, engine.ChangeEvent{Type: "server", Id: b.S.Id, Parent: b.B.Id, Op: engine.ChangeUpsert})
+}
+
+type sseEvent struct {
+	name string
+	data string
+}
+
+func readEvents(r io.Reader) chan sseEvent {
+	out := make(chan sseEvent, 16)
+	go func() {
+		defer close(out)
+		var e sseEvent
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if e.name != "" {
+					out <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "event: "):
+				e.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return out
+}
+
+func nextEvent(c *C, events chan sseEvent) sseEvent {
+	select {
+	case e, ok := <-events:
+		c.Assert(ok, Equals, true)
+		return e
+	case <-time.After(2 * time.Second):
+		c.Fatalf("timeout waiting for the event")
+	}
+	return sseEvent{}
+}
+
+func (s *ApiSuite) TestTokenAuth(c *C) {
+	f, err := ioutil.TempFile("", "vulcand-tokens")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# API tokens\nsecret\n\nother\n")
+	c.Assert(err, IsNil)
+	f.Close()
+
+	tokens, err := ReadTokens(f.Name())
+	c.Assert(err, IsNil)
+	c.Assert(tokens, DeepEquals, []string{"secret", "other"})
+	auth, err := NewTokenAuth(tokens)
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, auth, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// Probes and read-only endpoints are open
+	re, _, err := oxytest.Get(srv.URL + "/healthz")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	client := NewClient(srv.URL, registry.GetRegistry())
+	_, err = client.GetHosts()
+	c.Assert(err, IsNil)
+
+	// Mutating endpoints need one of the tokens
+	err = client.UpsertHost(engine.Host{Name: "localhost"})
+	c.Assert(err, ErrorMatches, "missing or invalid API token")
+
+	re, body, err := oxytest.MakeRequest(srv.URL+"/v2/hosts/localhost", oxytest.Method("DELETE"), oxytest.Header("Authorization", "Bearer bla"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(string(body), Equals, `{"message":"missing or invalid API token"}`)
+
+	client.Token = "other"
+	c.Assert(client.UpsertHost(engine.Host{Name: "localhost"}), IsNil)
+	client.Token = "secret"
+	c.Assert(client.DeleteHost(engine.HostKey{Name: "localhost"}), IsNil)
+
+	_, err = NewTokenAuth([]string{"", " "})
+	c.Assert(err, NotNil)
+}
+
+func (s *ApiSuite) TestDebugEndpoints(c *C) {
+	auth, err := NewTokenAuth([]string{"secret"})
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, auth, nil, nil, nil)
+	InitDebugController(router, auth)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// profiles need the token like the mutating endpoints
+	re, _, err := oxytest.Get(srv.URL + "/debug/pprof/goroutine")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusUnauthorized)
+
+	token := oxytest.Header("Authorization", "Bearer secret")
+	re, body, err := oxytest.Get(srv.URL+"/debug/pprof/goroutine?debug=1", token)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(strings.Contains(string(body), "goroutine profile"), Equals, true)
+
+	re, body, err = oxytest.Get(srv.URL+"/debug/pprof/", token)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	c.Assert(strings.Contains(string(body), "heap"), Equals, true)
+
+	re, body, err = oxytest.Get(srv.URL+"/v2/debug/goroutines", token)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	var dump struct {
+		Count  int
+		Stacks string
+	}
+	c.Assert(json.Unmarshal(body, &dump), IsNil)
+	c.Assert(dump.Count > 0, Equals, true)
+	c.Assert(strings.Contains(dump.Stacks, "getGoroutines"), Equals, true)
+
+	// profiling is off unless the controller is registered
+	router = mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, auth, nil, nil, nil)
+	srv2 := httptest.NewServer(router)
+	defer srv2.Close()
+	re, _, err = oxytest.Get(srv2.URL+"/debug/pprof/", token)
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+type certList []engine.CertExpiry
+
+func (l certList) Certs() []engine.CertExpiry {
+	return l
+}
+
+func (s *ApiSuite) TestCerts(c *C) {
+	certs := certList{
+		{Host: "example.com", Subject: "example.com", Issuer: "CA", NotAfter: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Host: "broken.example.com", Error: "no PEM certificate found"},
+	}
+	router := mux.NewRouter()
+	InitCertController(router, certs)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	out, err := NewClient(srv.URL, registry.GetRegistry()).GetCerts()
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, []engine.CertExpiry(certs))
+}
+
 func (s *ApiSuite) TestSeverity(c *C) {
-	for _, sev := range []log.Level{log.InfoLevel, log.WarnLevel, log.ErrorLevel} {
+	defer log.SetLevel(log.GetLevel())
+
+	// the severity set on startup is reported until it is changed
+	log.SetLevel(log.WarnLevel)
+	out, err := s.client.GetLogSeverity()
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, log.WarnLevel)
+
+	for _, sev := range []log.Level{log.DebugLevel, log.InfoLevel, log.WarnLevel, log.ErrorLevel} {
 		err := s.client.UpdateLogSeverity(sev)
 		c.Assert(err, IsNil)
 		out, err := s.client.GetLogSeverity()
 		c.Assert(err, IsNil)
 		c.Assert(out, Equals, sev)
+		// the process logs with the new severity right away
+		c.Assert(log.GetLevel(), Equals, sev)
+	}
+}
+
+func (s *ApiSuite) TestSeverityChangeLogged(c *C) {
+	defer log.SetLevel(log.GetLevel())
+	out := &bytes.Buffer{}
+	log.SetOutput(out)
+	defer log.SetOutput(os.Stderr)
+
+	// the change is logged at the level the more verbose severity shows
+	for _, t := range []struct{ from, to log.Level }{
+		{log.DebugLevel, log.ErrorLevel},
+		{log.ErrorLevel, log.InfoLevel},
+		{log.ErrorLevel, log.FatalLevel},
+		{log.FatalLevel, log.ErrorLevel},
+	} {
+		log.SetLevel(t.from)
+		out.Reset()
+		c.Assert(s.client.UpdateLogSeverity(t.to), IsNil)
+		c.Assert(strings.Contains(out.String(), fmt.Sprintf("Log severity is changed from %v to %v", t.from, t.to)), Equals, true,
+			Commentf("%v to %v: %s", t.from, t.to, out.String()))
 	}
 }
 
+func (s *ApiSuite) TestSeverityAuth(c *C) {
+	defer log.SetLevel(log.GetLevel())
+	auth, err := NewTokenAuth([]string{"secret"})
+	c.Assert(err, IsNil)
+
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, auth, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	log.SetLevel(log.InfoLevel)
+	client := NewClient(srv.URL, registry.GetRegistry())
+	c.Assert(client.UpdateLogSeverity(log.DebugLevel), ErrorMatches, "missing or invalid API token")
+	c.Assert(log.GetLevel(), Equals, log.InfoLevel)
+	// the severity is read without the token
+	out, err := client.GetLogSeverity()
+	c.Assert(err, IsNil)
+	c.Assert(out, Equals, log.InfoLevel)
+
+	client.Token = "secret"
+	c.Assert(client.UpdateLogSeverity(log.DebugLevel), IsNil)
+	c.Assert(log.GetLevel(), Equals, log.DebugLevel)
+}
+
 func (s *ApiSuite) TestInvalidSeverity(c *C) {
 	err := s.client.UpdateLogSeverity(255)
 	c.Assert(err, NotNil)
 }
 
+func (s *ApiSuite) TestServerTimeouts(c *C) {
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+
+	t := proxy.ServerTimeouts{Read: 5 * time.Second, Write: 7 * time.Second, Idle: 9 * time.Second}
+	c.Assert(s.client.UpdateServerTimeouts(t), IsNil)
+	out, err := s.client.GetServerTimeouts()
+	c.Assert(err, IsNil)
+	c.Assert(*out, Equals, t)
+
+	// The timeouts missing in the form are kept
+	c.Assert(s.client.PutForm(s.client.endpoint("instance", "timeouts"), url.Values{"read": {"3s"}}), IsNil)
+	out, err = s.client.GetServerTimeouts()
+	c.Assert(err, IsNil)
+	c.Assert(*out, Equals, proxy.ServerTimeouts{Read: 3 * time.Second, Write: t.Write, Idle: t.Idle})
+
+	c.Assert(s.client.UpdateServerTimeouts(proxy.ServerTimeouts{Read: -time.Second}), NotNil)
+	err = s.client.PutForm(s.client.endpoint("instance", "timeouts"), url.Values{"write": {"bad"}})
+	c.Assert(err, NotNil)
+}
+
 func (s *ApiSuite) TestNotFoundHandler(c *C) {
 	_, err := s.client.Get(s.client.endpoint("blabla"), nil)
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
@@ -197,6 +571,38 @@ func (s *ApiSuite) TestServerCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestServerQuarantine(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertBackend(*b), IsNil)
+	bk := engine.BackendKey{Id: b.Id}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	c.Assert(s.ng.UpsertServer(bk, srv, 0), IsNil)
+
+	c.Assert(s.sv.Start(), IsNil)
+	defer s.sv.Stop()
+
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+	c.Assert(s.client.QuarantineServer(sk), IsNil)
+	health, err := s.client.GetBackendHealth(bk)
+	c.Assert(err, IsNil)
+	c.Assert(len(health), Equals, 1)
+	c.Assert(health[0].Quarantined, Equals, true)
+
+	// The server is kept in the configuration
+	out, err := s.client.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &srv)
+
+	c.Assert(s.client.ReleaseServer(sk), IsNil)
+	health, err = s.client.GetBackendHealth(bk)
+	c.Assert(err, IsNil)
+	c.Assert(health[0].Quarantined, Equals, false)
+
+	err = s.client.QuarantineServer(engine.ServerKey{BackendKey: bk, Id: "missing"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
 func (s *ApiSuite) TestFrontendCRUD(c *C) {
 	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
 	c.Assert(err, IsNil)
@@ -230,6 +636,48 @@ func (s *ApiSuite) TestFrontendCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestFrontendsPage(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	for _, id := range []string{"api-2", "web", "api-1", "api-3"} {
+		f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), id, b.Id, `Path("/`+id+`")`, engine.HTTPFrontendSettings{})
+		c.Assert(err, IsNil)
+		c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+	}
+
+	fs, next, err := s.client.GetFrontendsPage("api-", "", 2)
+	c.Assert(err, IsNil)
+	c.Assert(frontendIds(fs), DeepEquals, []string{"api-1", "api-2"})
+	c.Assert(next, Not(Equals), "")
+
+	// the frontend added after the page the listing is at is listed on the next page
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "api-4", b.Id, `Path("/api-4")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+
+	fs, next, err = s.client.GetFrontendsPage("", next, 0)
+	c.Assert(err, IsNil)
+	c.Assert(frontendIds(fs), DeepEquals, []string{"api-3", "api-4"})
+	c.Assert(next, Equals, "")
+
+	fs, next, err = s.client.GetFrontendsPage("", "", 0)
+	c.Assert(err, IsNil)
+	c.Assert(len(fs), Equals, 5)
+	c.Assert(next, Equals, "")
+
+	_, _, err = s.client.GetFrontendsPage("", "bad", 0)
+	c.Assert(err, NotNil)
+}
+
+func frontendIds(fs []engine.Frontend) []string {
+	out := make([]string, len(fs))
+	for i, f := range fs {
+		out[i] = f.Id
+	}
+	return out
+}
+
 func (s *ApiSuite) TestListenerCRUD(c *C) {
 	l := engine.Listener{Id: "l1", Address: engine.Address{Network: "tcp", Address: "localhost:1300"}, Protocol: engine.HTTP}
 
@@ -250,6 +698,129 @@ func (s *ApiSuite) TestListenerCRUD(c *C) {
 	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
 }
 
+func (s *ApiSuite) TestRotateSessionTicketKeys(c *C) {
+	l := engine.Listener{Id: "l1", Address: engine.Address{Network: "tcp", Address: "localhost:1300"}, Protocol: engine.HTTPS}
+	c.Assert(s.client.UpsertListener(l), IsNil)
+	lk := engine.ListenerKey{Id: l.Id}
+
+	keys := [][]byte{}
+	for i := 1; i <= engine.MaxSessionTicketKeys+1; i++ {
+		n, err := s.client.RotateSessionTicketKeys(lk)
+		c.Assert(err, IsNil)
+		out, err := s.ng.GetListener(lk)
+		c.Assert(err, IsNil)
+		if i <= engine.MaxSessionTicketKeys {
+			c.Assert(n, Equals, i)
+			c.Assert(out.Settings.TLS.SessionTicketKeys[:i-1], DeepEquals, keys)
+		} else {
+			c.Assert(n, Equals, engine.MaxSessionTicketKeys)
+			c.Assert(out.Settings.TLS.SessionTicketKeys[:n-1], DeepEquals, keys[1:])
+		}
+		keys = out.Settings.TLS.SessionTicketKeys
+	}
+
+	// the listener upserted without the keys keeps them
+	l.Settings = &engine.HTTPSListenerSettings{TLS: engine.TLSSettings{PreferServerCipherSuites: true}}
+	c.Assert(s.client.UpsertListener(l), IsNil)
+	out, err := s.ng.GetListener(lk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.TLS.PreferServerCipherSuites, Equals, true)
+	c.Assert(out.Settings.TLS.SessionTicketKeys, DeepEquals, keys)
+
+	// the keys are not served by the API
+	out, err = s.client.GetListener(lk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.TLS.PreferServerCipherSuites, Equals, true)
+	c.Assert(out.Settings.TLS.SessionTicketKeys, IsNil)
+	ls, err := s.client.GetListeners()
+	c.Assert(err, IsNil)
+	c.Assert(ls, HasLen, 1)
+	c.Assert(ls[0].Settings.TLS.SessionTicketKeys, IsNil)
+
+	// only the HTTPS listeners have the keys
+	c.Assert(s.client.UpsertListener(engine.Listener{Id: "l2", Address: engine.Address{Network: "tcp", Address: "localhost:1301"}, Protocol: engine.HTTP}), IsNil)
+	_, err = s.client.RotateSessionTicketKeys(engine.ListenerKey{Id: "l2"})
+	c.Assert(err, NotNil)
+}
+
+// The rotation racing with the concurrent rotation is retried, so neither of the keys is lost
+func (s *ApiSuite) TestRotateSessionTicketKeysConflict(c *C) {
+	ng := &racingEngine{Mem: s.ng.(*memng.Mem)}
+	router := mux.NewRouter()
+	InitProxyController(ng, s.sv, router, nil, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	l := engine.Listener{Id: "l1", Address: engine.Address{Network: "tcp", Address: "localhost:1300"}, Protocol: engine.HTTPS}
+	c.Assert(client.UpsertListener(l), IsNil)
+	ng.concurrent = bytes.Repeat([]byte("c"), engine.SessionTicketKeySize)
+
+	n, err := client.RotateSessionTicketKeys(engine.ListenerKey{Id: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	c.Assert(ng.swaps, Equals, 2)
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.TLS.SessionTicketKeys, HasLen, 2)
+	c.Assert(out.Settings.TLS.SessionTicketKeys[0], DeepEquals, ng.concurrent)
+}
+
+func (s *ApiSuite) TestListenerAddressConflict(c *C) {
+	l := engine.Listener{Id: "l1", Address: engine.Address{Network: "tcp", Address: "localhost:1300"}, Protocol: engine.HTTP}
+	c.Assert(s.client.UpsertListener(l), IsNil)
+	// the listener can be updated in place
+	c.Assert(s.client.UpsertListener(l), IsNil)
+
+	err := s.client.UpsertListener(engine.Listener{Id: "l2", Address: l.Address, Protocol: engine.HTTP})
+	c.Assert(err, FitsTypeOf, &engine.AlreadyExistsError{})
+	c.Assert(err, ErrorMatches, ".*used by listener 'l1'.*")
+	_, err = s.client.GetListener(engine.ListenerKey{Id: "l2"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	re, body, err := oxytest.MakeRequest(s.testServer.URL+"/v2/listeners", oxytest.Method("POST"), oxytest.Body(`{"Listener": {
+		"Id": "l2", "Protocol": "http", "Address": {"Network": "tcp", "Address": "localhost:1300"}
+	}}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusConflict)
+	var out struct {
+		Message  string
+		Conflict struct {
+			Id       string
+			Protocol string
+			Address  engine.Address
+		}
+	}
+	c.Assert(json.Unmarshal(body, &out), IsNil)
+	c.Assert(out.Conflict.Id, Equals, "l1")
+	c.Assert(out.Conflict.Protocol, Equals, engine.HTTP)
+	c.Assert(out.Conflict.Address, DeepEquals, l.Address)
+	c.Assert(out.Message, Matches, ".*used by listener 'l1'.*")
+
+	// the addresses taken by the other processes are reported by the proxy binding the listener
+	w := httptest.NewRecorder()
+	sendError(w, &engine.AddressInUseError{Listener: engine.ListenerKey{Id: "l1"}, Address: l.Address})
+	c.Assert(w.Code, Equals, http.StatusConflict)
+}
+
+func (s *ApiSuite) TestListenerUnixAddressConflict(c *C) {
+	path := filepath.Join(c.MkDir(), "vulcand.sock")
+	l := engine.Listener{Id: "l1", Address: engine.Address{Network: engine.UNIX, Address: path}, Protocol: engine.HTTP}
+	c.Assert(s.client.UpsertListener(l), IsNil)
+
+	// the socket paths are compared as the addresses
+	other := engine.Listener{Id: "l2", Address: engine.Address{Network: engine.UNIX, Address: filepath.Dir(path) + "/./vulcand.sock"}, Protocol: engine.HTTP}
+	err := s.client.UpsertListener(other)
+	c.Assert(err, FitsTypeOf, &engine.AlreadyExistsError{})
+	c.Assert(err, ErrorMatches, ".*used by listener 'l1'.*")
+	_, err = s.client.GetListener(engine.ListenerKey{Id: "l2"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// the other socket path is not in conflict
+	other.Address.Address = filepath.Join(filepath.Dir(path), "other.sock")
+	c.Assert(s.client.UpsertListener(other), IsNil)
+}
+
 func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
 	c.Assert(err, IsNil)
@@ -284,6 +855,686 @@ func (s *ApiSuite) TestMiddlewareCRUD(c *C) {
 
 }
 
+func (s *ApiSuite) TestBatch(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	srv, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	cl := s.makeConnLimit("c1", 10, "client.ip", 2, f)
+
+	c.Assert(s.client.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: *b}},
+		{Change: &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: b.Id}, Server: *srv}},
+		{Change: &engine.FrontendUpserted{Frontend: *f}},
+		{Change: &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: cl}},
+	}), IsNil)
+
+	out, err := s.client.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	ms, err := s.client.GetMiddlewares(fk)
+	c.Assert(err, IsNil)
+	c.Assert(ms, DeepEquals, []engine.Middleware{cl})
+	svs, err := s.client.GetServers(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(svs, DeepEquals, []engine.Server{*srv})
+
+	// Bad middleware fails the whole batch, nothing is applied
+	re, body, err := oxytest.MakeRequest(s.testServer.URL+"/v2/batch", oxytest.Method("POST"), oxytest.Body(`{"Operations": [
+		{"Op": "delete", "Middleware": {"Id": "c1"}, "FrontendId": "f1"},
+		{"Op": "upsert", "Backend": {"Id": "b2", "Type": "http"}},
+		{"Op": "upsert", "FrontendId": "f1", "Middleware": {"Id": "c2", "Type": "connlimit", "Middleware": {"Connections": -1, "Variable": "client.ip"}}}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(string(body), Matches, `.*"index":2.*`)
+
+	_, err = s.client.GetBackend(engine.BackendKey{Id: "b2"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	ms, err = s.client.GetMiddlewares(fk)
+	c.Assert(err, IsNil)
+	c.Assert(ms, DeepEquals, []engine.Middleware{cl})
+
+	// Backend can be removed along with its frontend
+	c.Assert(s.client.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.FrontendDeleted{FrontendKey: fk}},
+		{Change: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: b.Id}}},
+	}), IsNil)
+	_, err = s.client.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestValidate(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	orphan, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f2", "missing", `Path("/other")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+
+	problems, err := s.client.Validate([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: *b}},
+		{Change: &engine.FrontendUpserted{Frontend: *f}},
+		{Change: &engine.FrontendUpserted{Frontend: *orphan}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(len(problems), Equals, 1)
+	c.Assert(problems[0].Index, Equals, 2)
+
+	// Nothing is applied
+	_, err = s.client.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// Existing configuration is taken into account, problems of all operations are reported
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	re, body, err := oxytest.MakeRequest(s.testServer.URL+"/v2/validate", oxytest.Method("POST"), oxytest.Body(`{"Operations": [
+		{"Frontend": {"Id": "f1", "Type": "http", "BackendId": "b1", "Route": "Path(\"/\")"}},
+		{"BackendId": "b1", "Server": {"Id": "s1", "URL": "not a url"}},
+		{"FrontendId": "f1", "Middleware": {"Id": "r1", "Type": "rewrite", "Middleware": {"Regexp": "["}}},
+		{"Op": "delete", "Backend": {"Id": "b1"}}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+
+	var out ValidationResponse
+	c.Assert(json.Unmarshal(body, &out), IsNil)
+	c.Assert(out.Valid, Equals, false)
+	var indexes []int
+	for _, p := range out.Problems {
+		indexes = append(indexes, p.Index)
+	}
+	c.Assert(indexes, DeepEquals, []int{1, 2, 3})
+	_, err = s.client.GetFrontend(engine.FrontendKey{Id: "f1"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestValidateClosesHandlers(c *C) {
+	var fetches int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte(`{"keys": []}`))
+	}))
+	defer jwks.Close()
+
+	re, body, err := oxytest.MakeRequest(s.testServer.URL+"/v2/validate", oxytest.Method("POST"), oxytest.Body(`{"Operations": [
+		{"Backend": {"Id": "b1", "Type": "http"}},
+		{"Frontend": {"Id": "f1", "Type": "http", "BackendId": "b1", "Route": "Path(\"/\")"}},
+		{"FrontendId": "f1", "Middleware": {"Id": "j1", "Type": "jwt", "Middleware": {"JWKSURL": "`+jwks.URL+`", "RefreshInterval": "10ms"}}}
+	]}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	var out ValidationResponse
+	c.Assert(json.Unmarshal(body, &out), IsNil)
+	c.Assert(out.Valid, Equals, true)
+
+	// the key set of the validated middleware is not refreshed
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&fetches) <= 1, Equals, true)
+}
+
+func (s *ApiSuite) TestConfigExportImport(c *C) {
+	host := engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: testutils.NewTestKeyPair()}}
+	c.Assert(s.client.UpsertHost(host), IsNil)
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	srv, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertServer(engine.BackendKey{Id: b.Id}, *srv, 0), IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertFrontend(*f, 0), IsNil)
+	m := s.makeConnLimit("cl1", 10, "client.ip", 1, f)
+	c.Assert(s.client.UpsertMiddleware(engine.FrontendKey{Id: f.Id}, m, 0), IsNil)
+
+	// Secrets are left out, they can be exported only with the seal key
+	data, err := s.client.ExportConfig(false)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "KeyPair\":null"), Equals, true)
+	_, err = s.client.ExportConfig(true)
+	c.Assert(err, NotNil)
+
+	// Merge keeps the objects missing from the document
+	extra, err := engine.NewHTTPBackend("b2", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*extra), IsNil)
+	c.Assert(s.client.ImportConfig(data, false), IsNil)
+	_, err = s.client.GetBackend(engine.BackendKey{Id: extra.Id})
+	c.Assert(err, IsNil)
+
+	// Replace deletes them, hosts exported without secrets keep their key pairs
+	c.Assert(s.client.ImportConfig(data, true), IsNil)
+	_, err = s.client.GetBackend(engine.BackendKey{Id: extra.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	out, err := s.client.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.KeyPair, DeepEquals, host.Settings.KeyPair)
+	_, err = s.client.GetMiddleware(engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: f.Id}, Id: m.Id})
+	c.Assert(err, IsNil)
+
+	// Invalid document is rejected as a whole
+	re, body, err := oxytest.MakeRequest(s.testServer.URL+"/v2/config?mode=replace", oxytest.Method("POST"), oxytest.Body(`{
+		"BackendSpecs": [{"Backend": {"Id": "b3", "Type": "http"}}],
+		"FrontendSpecs": [{"Frontend": {"Id": "f2", "Type": "http", "BackendId": "missing", "Route": "Path(\"/\")"}}]
+	}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(strings.Contains(string(body), "problems"), Equals, true)
+	_, err = s.client.GetBackend(engine.BackendKey{Id: "b3"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	_, err = s.client.GetFrontend(engine.FrontendKey{Id: f.Id})
+	c.Assert(err, IsNil)
+}
+
+func (s *ApiSuite) TestConfigExportSecrets(c *C) {
+	box, err := secret.NewBoxFromKeyString(mustKeyString())
+	c.Assert(err, IsNil)
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, nil, box, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	host := engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: testutils.NewTestKeyPair()}}
+	c.Assert(client.UpsertHost(host), IsNil)
+	data, err := client.ExportConfig(true)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), string(host.Settings.KeyPair.Key)), Equals, false)
+
+	c.Assert(client.DeleteHost(engine.HostKey{Name: host.Name}), IsNil)
+	c.Assert(client.ImportConfig(data, true), IsNil)
+	out, err := client.GetHost(engine.HostKey{Name: host.Name})
+	c.Assert(err, IsNil)
+	c.Assert(out.Settings.KeyPair, DeepEquals, host.Settings.KeyPair)
+}
+
+func (s *ApiSuite) TestConfigExportSealedMiddlewares(c *C) {
+	box, err := secret.NewBoxFromKeyString(mustKeyString())
+	c.Assert(err, IsNil)
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, nil, box, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertBackend(*b), IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertFrontend(*f, 0), IsNil)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	auth, err := basicauth.New(map[string]string{"user": string(hash)}, "")
+	c.Assert(err, IsNil)
+	m := engine.Middleware{Id: "auth", Type: basicauth.Type, Priority: 1, Middleware: auth}
+	mk := engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: f.Id}, Id: m.Id}
+	c.Assert(client.UpsertMiddleware(mk.FrontendKey, m, 0), IsNil)
+
+	// the middlewares holding credentials are never exported in the clear
+	data, err := client.ExportConfig(false)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), string(hash)), Equals, false)
+	c.Assert(strings.Contains(string(data), basicauth.Type), Equals, false)
+	sealed, err := client.ExportConfig(true)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(sealed), string(hash)), Equals, false)
+
+	// frontends imported without them keep the current ones
+	c.Assert(client.ImportConfig(data, true), IsNil)
+	out, err := client.GetMiddleware(mk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Middleware.(*basicauth.BasicAuth).Users, DeepEquals, auth.Users)
+
+	// the sealed ones are opened with the seal key
+	c.Assert(client.DeleteFrontend(mk.FrontendKey), IsNil)
+	c.Assert(client.ImportConfig(sealed, true), IsNil)
+	out, err = client.GetMiddleware(mk)
+	c.Assert(err, IsNil)
+	c.Assert(out.Middleware.(*basicauth.BasicAuth).Users, DeepEquals, auth.Users)
+}
+
+func (s *ApiSuite) TestConfigExportImportTTLs(c *C) {
+	ng := &ttlEngine{Mem: s.ng.(*memng.Mem), ttls: engine.NewTTLs()}
+	router := mux.NewRouter()
+	InitProxyController(ng, s.sv, router, nil, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertBackend(*b), IsNil)
+	bk := engine.BackendKey{Id: b.Id}
+	s1, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertServer(bk, *s1, time.Minute), IsNil)
+	s2, err := engine.NewServer("s2", "http://localhost:5001")
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertServer(bk, *s2, 0), IsNil)
+	f, err := engine.NewHTTPFrontend(s.ng.GetRegistry().GetRouter(), "f1", b.Id, `Path("/")`, engine.HTTPFrontendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(client.UpsertFrontend(*f, time.Hour), IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	m := s.makeConnLimit("cl1", 10, "client.ip", 1, f)
+	c.Assert(client.UpsertMiddleware(fk, m, time.Minute), IsNil)
+
+	data, err := client.ExportConfig(false)
+	c.Assert(err, IsNil)
+	var cp configReadPack
+	c.Assert(json.Unmarshal(data, &cp), IsNil)
+	c.Assert(cp.TTLs, DeepEquals, []objectTTL{
+		{BackendId: b.Id, ServerId: s1.Id, TTL: "1m0s"},
+		{FrontendId: f.Id, TTL: "1h0m0s"},
+		{FrontendId: f.Id, MiddlewareId: m.Id, TTL: "1m0s"},
+	})
+
+	// the imported objects expire as the exported ones did, the permanent ones stay permanent
+	c.Assert(client.DeleteFrontend(fk), IsNil)
+	c.Assert(client.DeleteBackend(bk), IsNil)
+	ng.ttls = engine.NewTTLs()
+	c.Assert(client.ImportConfig(data, true), IsNil)
+	c.Assert(ng.ttls, DeepEquals, &engine.TTLs{
+		Frontends:   map[engine.FrontendKey]time.Duration{fk: time.Hour},
+		Middlewares: map[engine.MiddlewareKey]time.Duration{{FrontendKey: fk, Id: m.Id}: time.Minute},
+		Servers:     map[engine.ServerKey]time.Duration{{BackendKey: bk, Id: s1.Id}: time.Minute},
+	})
+
+	// the TTLs of the objects missing from the document are rejected
+	re, body, err := oxytest.MakeRequest(srv.URL+"/v2/config", oxytest.Method("POST"), oxytest.Body(`{
+		"BackendSpecs": [{"Backend": {"Id": "b3", "Type": "http"}}],
+		"TTLs": [{"BackendId": "b3", "ServerId": "missing", "TTL": "1m"}]
+	}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest, Commentf("%s", body))
+	re, body, err = oxytest.MakeRequest(srv.URL+"/v2/config", oxytest.Method("POST"), oxytest.Body(`{
+		"BackendSpecs": [{"Backend": {"Id": "b3", "Type": "http"}, "Servers": [{"Id": "s3", "URL": "http://localhost:5003"}]}],
+		"TTLs": [{"BackendId": "b3", "ServerId": "s3", "TTL": "-1m"}]
+	}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest, Commentf("%s", body))
+	_, err = client.GetBackend(engine.BackendKey{Id: "b3"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ApiSuite) TestServerRegistration(c *C) {
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(s.client.UpsertBackend(*b), IsNil)
+	bk := engine.BackendKey{Id: b.Id}
+	srv, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+
+	// the engines without the registrations reject them
+	c.Assert(s.client.RegisterServer(bk, *srv, time.Second), NotNil)
+
+	ng := &registrarEngine{Mem: s.ng.(*memng.Mem)}
+	router := mux.NewRouter()
+	InitProxyController(ng, s.sv, router, nil, nil, nil, nil)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+	client := NewClient(ts.URL, registry.GetRegistry())
+
+	// the renewed registration keeps the server
+	for i := 0; i < 5; i++ {
+		c.Assert(client.RegisterServer(bk, *srv, 200*time.Millisecond), IsNil)
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.Assert(ng.registered(), Equals, 1)
+	_, err = client.GetServer(sk)
+	c.Assert(err, IsNil)
+
+	// the server is deleted once the client stops renewing it
+	for i := 0; i < 100; i++ {
+		if _, err = client.GetServer(sk); err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// deregistration deletes it right away
+	c.Assert(client.RegisterServer(bk, *srv, time.Minute), IsNil)
+	c.Assert(client.DeregisterServer(sk), IsNil)
+	_, err = client.GetServer(sk)
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(client.DeregisterServer(sk), FitsTypeOf, &engine.NotFoundError{})
+
+	// the server of the registration is the one in the path and the TTL is required
+	re, _, err := oxytest.MakeRequest(ts.URL+"/v2/backends/b1/servers/s2/registration", oxytest.Method("POST"),
+		oxytest.Body(`{"Server": {"Id": "s1", "URL": "http://localhost:5000"}, "TTL": "1m"}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+	re, _, err = oxytest.MakeRequest(ts.URL+"/v2/backends/b1/servers/s1/registration", oxytest.Method("POST"),
+		oxytest.Body(`{"Server": {"Id": "s1", "URL": "http://localhost:5000"}}`))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *ApiSuite) TestAuditLog(c *C) {
+	auth, err := NewTokenAuth([]string{"secret"})
+	c.Assert(err, IsNil)
+	out := &bytes.Buffer{}
+	router := mux.NewRouter()
+	InitProxyController(s.ng, s.sv, router, auth, nil, NewAuditLog(out), nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+	client.Token = "secret"
+
+	host := engine.Host{Name: "localhost", Settings: engine.HostSettings{KeyPair: testutils.NewTestKeyPair()}}
+	c.Assert(client.UpsertHost(host), IsNil)
+	host.Settings.Default = true
+	c.Assert(client.UpsertHost(host), IsNil)
+	c.Assert(client.DeleteHost(engine.HostKey{Name: host.Name}), IsNil)
+	c.Assert(client.DeleteBackend(engine.BackendKey{Id: "missing"}), NotNil)
+
+	c.Assert(strings.Contains(out.String(), "secret"), Equals, false)
+	c.Assert(strings.Contains(out.String(), string(host.Settings.KeyPair.Key)), Equals, false)
+
+	type record struct {
+		Source    string
+		Actor     string
+		Operation string
+		Kind      string
+		Id        string
+		Old       *engine.Host
+		New       *engine.Host
+		Error     string
+	}
+	var records []record
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var r record
+		c.Assert(dec.Decode(&r), IsNil)
+		records = append(records, r)
+	}
+	c.Assert(records, HasLen, 4)
+	for _, r := range records {
+		c.Assert(r.Source, Equals, "api")
+		c.Assert(r.Actor, Matches, "token:[0-9a-f]{16}")
+	}
+
+	c.Assert(records[0].Operation, Equals, "upsert")
+	c.Assert(records[0].Kind, Equals, "host")
+	c.Assert(records[0].Id, Equals, host.Name)
+	c.Assert(records[0].Old, IsNil)
+	c.Assert(records[0].New.Settings.KeyPair, DeepEquals, &engine.KeyPair{Cert: host.Settings.KeyPair.Cert})
+
+	c.Assert(records[1].Old.Settings.Default, Equals, false)
+	c.Assert(records[1].New.Settings.Default, Equals, true)
+
+	c.Assert(records[2].Operation, Equals, "delete")
+	c.Assert(records[2].Old.Name, Equals, host.Name)
+	c.Assert(records[2].New, IsNil)
+
+	// the failed changes are recorded too
+	c.Assert(records[3].Kind, Equals, "backend")
+	c.Assert(records[3].Error, Not(Equals), "")
+}
+
+// testSubscription is the change subscription fed by the test
+type testSubscription struct {
+	changesC chan *engine.ChangeEvent
+	lostC    chan struct{}
+	closed   chan struct{}
+}
+
+func (s *testSubscription) Changes() <-chan *engine.ChangeEvent { return s.changesC }
+func (s *testSubscription) Lost() <-chan struct{}               { return s.lostC }
+func (s *testSubscription) Close()                              { close(s.closed) }
+
+func (s *ApiSuite) TestAuditLogChanges(c *C) {
+	out := &bytes.Buffer{}
+	audit := NewAuditLog(out)
+	sub := &testSubscription{changesC: make(chan *engine.ChangeEvent), lostC: make(chan struct{}), closed: make(chan struct{})}
+	stopC := make(chan struct{})
+	go audit.RecordChanges(sub, stopC)
+
+	// the changes made to the engine directly are recorded with the ids the API records have
+	sub.changesC <- &engine.ChangeEvent{Type: "backend", Id: "b1", Op: engine.ChangeUpsert}
+	sub.changesC <- &engine.ChangeEvent{Type: "server", Id: "s1", Parent: "b1", Op: engine.ChangeDelete}
+	sub.changesC <- &engine.ChangeEvent{Op: engine.ChangeResync}
+	sub.lostC <- struct{}{}
+	close(stopC)
+	<-sub.closed
+
+	var records []auditRecord
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var r auditRecord
+		c.Assert(dec.Decode(&r), IsNil)
+		records = append(records, r)
+	}
+	c.Assert(records, HasLen, 4)
+	for _, r := range records {
+		c.Assert(r.Source, Equals, "engine")
+		c.Assert(r.Actor, Equals, "")
+	}
+	c.Assert(records[0].Operation, Equals, "upsert")
+	c.Assert(records[0].Kind, Equals, "backend")
+	c.Assert(records[0].Id, Equals, "b1")
+	c.Assert(records[1].Operation, Equals, "delete")
+	c.Assert(records[1].Id, Equals, engine.ServerKey{BackendKey: engine.BackendKey{Id: "b1"}, Id: "s1"}.String())
+	c.Assert(records[2].Operation, Equals, "resync")
+	c.Assert(records[2].Kind, Equals, "config")
+	// the changes dropped by the subscription are noted
+	c.Assert(records[3].Operation, Equals, "resync")
+	c.Assert(records[3].Error, Not(Equals), "")
+}
+
+func (s *ApiSuite) TestNamespaces(c *C) {
+	a := memng.New(registry.GetRegistry())
+	ng, err := nsng.New([]nsng.Namespace{{Name: "a", Engine: a}, {Name: "b", Engine: memng.New(registry.GetRegistry())}})
+	c.Assert(err, IsNil)
+	router := mux.NewRouter()
+	InitProxyController(ng, s.sv, router, nil, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	client := NewClient(srv.URL, registry.GetRegistry())
+
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+
+	// Scoped requests use the ids of the namespace
+	client.Namespace = "a"
+	c.Assert(client.UpsertBackend(*b), IsNil)
+	out, err := client.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out.Id, Equals, b.Id)
+	_, err = a.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+
+	client.Namespace = "b"
+	_, err = client.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	client.Namespace = "c"
+	_, err = client.GetBackends()
+	c.Assert(err, NotNil)
+
+	// Other requests see the merged configuration with the namespaced ids
+	client.Namespace = ""
+	backends, err := client.GetBackends()
+	c.Assert(err, IsNil)
+	c.Assert(len(backends), Equals, 1)
+	c.Assert(backends[0].Id, Equals, "a.b1")
+}
+
+func (s *ApiSuite) TestEventsNamespace(c *C) {
+	a, b := memng.New(registry.GetRegistry()), memng.New(registry.GetRegistry())
+	ng, err := nsng.New([]nsng.Namespace{{Name: "a", Engine: a}, {Name: "b", Engine: b}})
+	c.Assert(err, IsNil)
+	newProxy := func(id int) (proxy.Proxy, error) {
+		return proxy.New(id, stapler.New(), proxy.Options{})
+	}
+	sv := supervisor.New(newProxy, ng, supervisor.Options{})
+	c.Assert(sv.Start(), IsNil)
+	defer sv.Stop()
+
+	router := mux.NewRouter()
+	InitProxyController(ng, sv, router, nil, nil, nil, nil)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	b1, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(b.UpsertBackend(*b1), IsNil)
+
+	re, err := http.Get(srv.URL + "/v2/events?namespace=c")
+	c.Assert(err, IsNil)
+	re.Body.Close()
+	c.Assert(re.StatusCode, Not(Equals), http.StatusOK)
+
+	re, err = http.Get(srv.URL + "/v2/events?namespace=a")
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	events := readEvents(re.Body)
+
+	// the snapshot has the configuration of the namespace only
+	e := nextEvent(c, events)
+	c.Assert(e.name, Equals, "snapshot")
+	var cp configPack
+	c.Assert(json.Unmarshal([]byte(e.data), &cp), IsNil)
+	c.Assert(cp.BackendSpecs, HasLen, 0)
+
+	// the changes of the other namespaces are not streamed, the ids are the ids in the namespace
+	b2, err := engine.NewHTTPBackend("b2", engine.HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	c.Assert(b.UpsertBackend(*b2), IsNil)
+	c.Assert(a.UpsertBackend(*b1), IsNil)
+	srv1, err := engine.NewServer("s1", "http://localhost:5000")
+	c.Assert(err, IsNil)
+	c.Assert(a.UpsertServer(engine.BackendKey{Id: b1.Id}, *srv1, engine.NoTTL), IsNil)
+
+	var ch engine.ChangeEvent
+	e = nextEvent(c, events)
+	c.Assert(json.Unmarshal([]byte(e.data), &ch), IsNil)
+	c.Assert(ch, DeepEquals, engine.ChangeEvent{Type: "backend", Id: b1.Id, Op: engine.ChangeUpsert})
+	e = nextEvent(c, events)
+	c.Assert(json.Unmarshal([]byte(e.data), &ch), IsNil)
+	c.Assert(ch, DeepEquals, engine.ChangeEvent{Type: "server", Id: srv1.Id, Parent: b1.Id, Op: engine.ChangeUpsert})
+}
+
+// racingEngine rotates the session ticket keys of the listener right before the first swap
+type racingEngine struct {
+	*memng.Mem
+	concurrent []byte
+	swaps      int
+}
+
+func (e *racingEngine) SwapListener(old, l engine.Listener) error {
+	e.swaps++
+	if e.swaps == 1 {
+		rotated := old
+		rotated.Settings = &engine.HTTPSListenerSettings{}
+		if err := rotated.Settings.TLS.RotateSessionTicketKeys(e.concurrent); err != nil {
+			return err
+		}
+		if err := e.Mem.UpsertListener(rotated); err != nil {
+			return err
+		}
+	}
+	return e.Mem.SwapListener(old, l)
+}
+
+// registrarEngine registers the servers in the memory engine until the registrations are closed
+type registrarEngine struct {
+	*memng.Mem
+	mtx   sync.Mutex
+	count int
+}
+
+func (e *registrarEngine) RegisterServer(bk engine.BackendKey, srv engine.Server, ttl time.Duration) (engine.Registration, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	if err := e.Mem.UpsertServer(bk, srv, 0); err != nil {
+		return nil, err
+	}
+	e.count++
+	return &memRegistration{e: e, sk: engine.ServerKey{BackendKey: bk, Id: srv.Id}}, nil
+}
+
+// GetServer is locked as the registrations expire in the background
+func (e *registrarEngine) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.Mem.GetServer(sk)
+}
+
+// registered returns the amount of the registrations made
+func (e *registrarEngine) registered() int {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.count
+}
+
+type memRegistration struct {
+	e  *registrarEngine
+	sk engine.ServerKey
+}
+
+func (r *memRegistration) Close() error {
+	r.e.mtx.Lock()
+	defer r.e.mtx.Unlock()
+	return r.e.Mem.DeleteServer(r.sk)
+}
+
+// ttlEngine keeps the TTLs of the upserts and the batches the memory engine ignores
+type ttlEngine struct {
+	*memng.Mem
+	ttls *engine.TTLs
+}
+
+func (e *ttlEngine) GetTTLs() (*engine.TTLs, error) {
+	return e.ttls, nil
+}
+
+func (e *ttlEngine) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	return e.ApplyBatch([]engine.BatchOp{{Change: &engine.FrontendUpserted{Frontend: f}, TTL: ttl}})
+}
+
+func (e *ttlEngine) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	return e.ApplyBatch([]engine.BatchOp{{Change: &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: m}, TTL: ttl}})
+}
+
+func (e *ttlEngine) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.Duration) error {
+	return e.ApplyBatch([]engine.BatchOp{{Change: &engine.ServerUpserted{BackendKey: bk, Server: srv}, TTL: ttl}})
+}
+
+func (e *ttlEngine) ApplyBatch(ops []engine.BatchOp) error {
+	if err := e.Mem.ApplyBatch(ops); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.TTL <= 0 {
+			continue
+		}
+		switch c := op.Change.(type) {
+		case *engine.FrontendUpserted:
+			e.ttls.Frontends[engine.FrontendKey{Id: c.Frontend.Id}] = op.TTL
+		case *engine.MiddlewareUpserted:
+			e.ttls.Middlewares[engine.MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id}] = op.TTL
+		case *engine.ServerUpserted:
+			e.ttls.Servers[engine.ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id}] = op.TTL
+		}
+	}
+	return nil
+}
+
+func mustKeyString() string {
+	key, err := secret.NewKeyString()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
 func (s *ApiSuite) makeConnLimit(id string, connections int64, variable string, priority int, f *engine.Frontend) engine.Middleware {
 	cl, err := connlimit.NewConnLimit(connections, variable)
 	if err != nil {
@@ -0,0 +1,356 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// AuditLog writes a record of every change made through the API as JSON lines: who has made it, the operation,
+// the object and its values before and after the change. The private keys, the ACME account keys, the session
+// ticket keys and the parameters of the sealed middlewares are redacted. The changes applied to the proxy are
+// recorded from the change stream too, so the changes made to the engine directly are not missed, these records
+// have the engine source and carry neither the actor nor the values.
+type AuditLog struct {
+	mtx   sync.Mutex
+	enc   *json.Encoder
+	clock timetools.TimeProvider
+}
+
+// NewAuditLog returns the audit log writing the records to w
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{enc: json.NewEncoder(w), clock: &timetools.RealTime{}}
+}
+
+// auditRecord is a single line of the audit log
+type auditRecord struct {
+	Time time.Time `json:"time"`
+	// Source is api for the changes made through the API and engine for the changes applied to the proxy
+	Source string `json:"source"`
+	// Actor is the fingerprint of the API token the change is made with, empty if the API has no tokens
+	Actor      string `json:"actor,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	Operation  string `json:"operation"`
+	Kind       string `json:"kind"`
+	Id         string `json:"id"`
+	Namespace  string `json:"namespace,omitempty"`
+	// Batch is shared by the records of the changes applied in one batch
+	Batch string      `json:"batch,omitempty"`
+	Old   interface{} `json:"old,omitempty"`
+	New   interface{} `json:"new,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+const (
+	auditUpsert     = "upsert"
+	auditDelete     = "delete"
+	auditUpdate     = "update"
+	auditPurge      = "purge"
+	auditQuarantine = "quarantine"
+	auditRelease    = "release"
+	auditResync     = "resync"
+	auditRegister   = "register"
+	auditDeregister = "deregister"
+)
+
+const (
+	auditSourceAPI    = "api"
+	auditSourceEngine = "engine"
+)
+
+func (a *AuditLog) write(r *auditRecord) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.enc.Encode(r); err != nil {
+		log.Errorf("failed to write audit log: %v", err)
+	}
+}
+
+// newRecord returns the record of the change made by the request
+func (a *AuditLog) newRecord(r *http.Request, operation, kind, id string, err error) *auditRecord {
+	rec := &auditRecord{
+		Time:       a.clock.UtcNow(),
+		Source:     auditSourceAPI,
+		Actor:      auditActor(r),
+		RemoteAddr: r.RemoteAddr,
+		Operation:  operation,
+		Kind:       kind,
+		Id:         id,
+		Namespace:  r.Form.Get("namespace"),
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return rec
+}
+
+// RecordChanges writes the records of the changes applied to the proxy received on the subscription until stopC
+// is closed, the subscription is closed then
+func (a *AuditLog) RecordChanges(sub engine.ChangeSubscription, stopC <-chan struct{}) {
+	defer sub.Close()
+	for {
+		select {
+		case e := <-sub.Changes():
+			a.write(a.changeEventRecord(e))
+		case <-sub.Lost():
+			rec := &auditRecord{Time: a.clock.UtcNow(), Source: auditSourceEngine, Operation: auditResync, Kind: "config"}
+			rec.Error = "the audit log has fallen behind, the changes applied in between are not recorded"
+			a.write(rec)
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// changeEventRecord returns the record of the change applied to the proxy, the ids of the middlewares and the
+// servers are the ones the API records have
+func (a *AuditLog) changeEventRecord(e *engine.ChangeEvent) *auditRecord {
+	rec := &auditRecord{Time: a.clock.UtcNow(), Source: auditSourceEngine, Operation: e.Op, Kind: e.Type, Id: e.Id}
+	switch e.Type {
+	case "middleware":
+		rec.Id = engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: e.Parent}, Id: e.Id}.String()
+	case "server":
+		rec.Id = engine.ServerKey{BackendKey: engine.BackendKey{Id: e.Parent}, Id: e.Id}.String()
+	case "":
+		// the proxy has re-read the whole configuration
+		rec.Kind = "config"
+	}
+	return rec
+}
+
+// auditActor returns the fingerprint of the bearer token of the request, the token itself is not logged
+func auditActor(r *http.Request) string {
+	token, ok := bearerToken(r)
+	if !ok {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+// apply applies the change to the engine and records it with the value of the object before the change
+func (c *ProxyController) apply(r *http.Request, op engine.BatchOp) error {
+	if c.audit == nil {
+		return engine.ApplyChange(c.ng, op)
+	}
+	old := c.auditedValue(op.Change)
+	err := engine.ApplyChange(c.ng, op)
+	c.audit.write(c.changeRecord(r, op, old, err))
+	return err
+}
+
+// swapListener swaps the listener if the engine supports it, upserts it otherwise, and records the change
+func (c *ProxyController) swapListener(r *http.Request, old, l engine.Listener) error {
+	op := engine.BatchOp{Change: &engine.ListenerUpserted{Listener: l}}
+	s, ok := c.ng.(engine.ListenerSwapper)
+	if !ok {
+		return c.apply(r, op)
+	}
+	if c.audit == nil {
+		return s.SwapListener(old, l)
+	}
+	val := c.auditedValue(op.Change)
+	err := s.SwapListener(old, l)
+	c.audit.write(c.changeRecord(r, op, val, err))
+	return err
+}
+
+// applyAuditedBatch applies the batch to the engine and records every change of it
+func (c *ProxyController) applyAuditedBatch(r *http.Request, batcher engine.Batcher, ops []engine.BatchOp) error {
+	if c.audit == nil {
+		return batcher.ApplyBatch(ops)
+	}
+	olds := make([]interface{}, len(ops))
+	for i, op := range ops {
+		olds[i] = c.auditedValue(op.Change)
+	}
+	err := batcher.ApplyBatch(ops)
+	id := batchId()
+	for i, op := range ops {
+		rec := c.changeRecord(r, op, olds[i], err)
+		rec.Batch = id
+		c.audit.write(rec)
+	}
+	return err
+}
+
+// auditSetting records the update of the proxy setting
+func (c *ProxyController) auditSetting(r *http.Request, kind string, old, new interface{}, err error) {
+	c.auditOperation(r, auditUpdate, kind, kind, old, new, err)
+}
+
+// auditOperation records the operation of the running proxy, not stored in the engine
+func (c *ProxyController) auditOperation(r *http.Request, operation, kind, id string, old, new interface{}, err error) {
+	if c.audit == nil {
+		return
+	}
+	rec := c.audit.newRecord(r, operation, kind, id, err)
+	rec.Old, rec.New = old, new
+	c.audit.write(rec)
+}
+
+func (c *ProxyController) changeRecord(r *http.Request, op engine.BatchOp, old interface{}, err error) *auditRecord {
+	operation, kind, id := auditUpsert, "", ""
+	var new interface{}
+	switch ch := op.Change.(type) {
+	case *engine.HostUpserted:
+		kind, id, new = "host", ch.Host.Name, redactHost(ch.Host)
+	case *engine.HostDeleted:
+		operation, kind, id = auditDelete, "host", ch.HostKey.Name
+	case *engine.ListenerUpserted:
+		kind, id, new = "listener", ch.Listener.Id, stripSessionTicketKeys(ch.Listener)
+	case *engine.ListenerDeleted:
+		operation, kind, id = auditDelete, "listener", ch.ListenerKey.Id
+	case *engine.FrontendUpserted:
+		kind, id, new = "frontend", ch.Frontend.Id, ch.Frontend
+	case *engine.FrontendDeleted:
+		operation, kind, id = auditDelete, "frontend", ch.FrontendKey.Id
+	case *engine.MiddlewareUpserted:
+		kind, id, new = "middleware", engine.MiddlewareKey{FrontendKey: ch.FrontendKey, Id: ch.Middleware.Id}.String(), c.redactMiddleware(ch.Middleware)
+	case *engine.MiddlewareDeleted:
+		operation, kind, id = auditDelete, "middleware", ch.MiddlewareKey.String()
+	case *engine.BackendUpserted:
+		kind, id, new = "backend", ch.Backend.Id, redactBackend(ch.Backend)
+	case *engine.BackendDeleted:
+		operation, kind, id = auditDelete, "backend", ch.BackendKey.Id
+	case *engine.ServerUpserted:
+		kind, id, new = "server", engine.ServerKey{BackendKey: ch.BackendKey, Id: ch.Server.Id}.String(), ch.Server
+	case *engine.ServerDeleted:
+		operation, kind, id = auditDelete, "server", ch.ServerKey.String()
+	default:
+		kind = fmt.Sprintf("%T", op.Change)
+	}
+	rec := c.audit.newRecord(r, operation, kind, id, err)
+	rec.Old, rec.New = old, new
+	return rec
+}
+
+// auditedValue returns the redacted current value of the object the change is made to, nil if there is none
+func (c *ProxyController) auditedValue(change interface{}) interface{} {
+	var (
+		val interface{}
+		err error
+	)
+	switch ch := change.(type) {
+	case *engine.HostUpserted:
+		val, err = c.auditedHost(engine.HostKey{Name: ch.Host.Name})
+	case *engine.HostDeleted:
+		val, err = c.auditedHost(ch.HostKey)
+	case *engine.ListenerUpserted:
+		val, err = c.auditedListener(engine.ListenerKey{Id: ch.Listener.Id})
+	case *engine.ListenerDeleted:
+		val, err = c.auditedListener(ch.ListenerKey)
+	case *engine.FrontendUpserted:
+		val, err = c.ng.GetFrontend(engine.FrontendKey{Id: ch.Frontend.Id})
+	case *engine.FrontendDeleted:
+		val, err = c.ng.GetFrontend(ch.FrontendKey)
+	case *engine.MiddlewareUpserted:
+		val, err = c.auditedMiddleware(engine.MiddlewareKey{FrontendKey: ch.FrontendKey, Id: ch.Middleware.Id})
+	case *engine.MiddlewareDeleted:
+		val, err = c.auditedMiddleware(ch.MiddlewareKey)
+	case *engine.BackendUpserted:
+		val, err = c.auditedBackend(engine.BackendKey{Id: ch.Backend.Id})
+	case *engine.BackendDeleted:
+		val, err = c.auditedBackend(ch.BackendKey)
+	case *engine.ServerUpserted:
+		val, err = c.ng.GetServer(engine.ServerKey{BackendKey: ch.BackendKey, Id: ch.Server.Id})
+	case *engine.ServerDeleted:
+		val, err = c.ng.GetServer(ch.ServerKey)
+	}
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			log.Warningf("failed to read the audited value of %v: %v", change, err)
+		}
+		return nil
+	}
+	return val
+}
+
+func (c *ProxyController) auditedHost(hk engine.HostKey) (interface{}, error) {
+	h, err := c.ng.GetHost(hk)
+	if err != nil {
+		return nil, err
+	}
+	return redactHost(*h), nil
+}
+
+func (c *ProxyController) auditedListener(lk engine.ListenerKey) (interface{}, error) {
+	l, err := c.ng.GetListener(lk)
+	if err != nil {
+		return nil, err
+	}
+	return stripSessionTicketKeys(*l), nil
+}
+
+func (c *ProxyController) auditedMiddleware(mk engine.MiddlewareKey) (interface{}, error) {
+	m, err := c.ng.GetMiddleware(mk)
+	if err != nil {
+		return nil, err
+	}
+	return c.redactMiddleware(*m), nil
+}
+
+func (c *ProxyController) auditedBackend(bk engine.BackendKey) (interface{}, error) {
+	b, err := c.ng.GetBackend(bk)
+	if err != nil {
+		return nil, err
+	}
+	return redactBackend(*b), nil
+}
+
+// redactHost returns the copy of the host with the private keys and the ACME account key left out, the
+// certificates are kept
+func redactHost(h engine.Host) engine.Host {
+	out := stripSecrets(h)
+	out.Settings.KeyPair = redactKeyPair(h.Settings.KeyPair)
+	for _, kp := range h.Settings.KeyPairs {
+		out.Settings.KeyPairs = append(out.Settings.KeyPairs, *redactKeyPair(&kp))
+	}
+	return out
+}
+
+// redactBackend returns the copy of the backend with the private key of the client certificate left out
+func redactBackend(b engine.Backend) engine.Backend {
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if ok && s.TLS != nil && s.TLS.ClientKeyPair != nil {
+		tls := *s.TLS
+		tls.ClientKeyPair = redactKeyPair(tls.ClientKeyPair)
+		s.TLS = &tls
+		b.Settings = s
+	}
+	return b
+}
+
+func redactKeyPair(kp *engine.KeyPair) *engine.KeyPair {
+	if kp == nil {
+		return nil
+	}
+	return &engine.KeyPair{Cert: kp.Cert}
+}
+
+// redactMiddleware returns the copy of the middleware with the parameters left out if the middleware is sealed
+func (c *ProxyController) redactMiddleware(m engine.Middleware) engine.Middleware {
+	if spec := c.ng.GetRegistry().GetSpec(m.Type); spec != nil && spec.Sealed {
+		m.Middleware = nil
+	}
+	return m
+}
+
+// batchId returns the random id of the batch the records share
+func batchId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TokenAuth requires API requests to carry one of the bearer tokens in the Authorization header
+type TokenAuth struct {
+	tokens [][]byte
+}
+
+func NewTokenAuth(tokens []string) (*TokenAuth, error) {
+	a := &TokenAuth{}
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			a.tokens = append(a.tokens, []byte(t))
+		}
+	}
+	if len(a.tokens) == 0 {
+		return nil, fmt.Errorf("at least one API token is required")
+	}
+	return a, nil
+}
+
+// ReadTokens reads API tokens from the file, one token per line. Empty lines and lines starting with # are skipped.
+func ReadTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Wrap returns the handler rejecting requests without a valid token with 401
+func (a *TokenAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok || !a.valid(token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="vulcand"`)
+			sendResponse(w, Response{"message": "missing or invalid API token"}, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// valid compares the token with all the known tokens in constant time
+func (a *TokenAuth) valid(token string) bool {
+	found := 0
+	for _, t := range a.tokens {
+		found |= subtle.ConstantTimeCompare(t, []byte(token))
+	}
+	return found == 1
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(h[len(prefix):]), true
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/vulcand/vulcand/engine"
@@ -22,6 +23,10 @@ const CurrentVersion = "v2"
 type Client struct {
 	Addr     string
 	Registry *plugin.Registry
+	// Token is sent as the bearer token if set
+	Token string
+	// Namespace scopes the requests to the namespace if set
+	Namespace string
 }
 
 func NewClient(addr string, registry *plugin.Registry) *Client {
@@ -61,6 +66,37 @@ func (c *Client) GetLogSeverity() (log.Level, error) {
 	return lvl, nil
 }
 
+// GetServerTimeouts returns the server timeouts of the instance serving the API
+func (c *Client) GetServerTimeouts() (*engine.ServerTimeouts, error) {
+	data, err := c.Get(c.endpoint("instance", "timeouts"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var re *ServerTimeoutsResponse
+	if err := json.Unmarshal(data, &re); err != nil {
+		return nil, err
+	}
+	var t engine.ServerTimeouts
+	for _, d := range []struct {
+		out *time.Duration
+		in  string
+	}{{&t.Read, re.Read}, {&t.Write, re.Write}, {&t.Idle, re.Idle}} {
+		if *d.out, err = time.ParseDuration(d.in); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+// UpdateServerTimeouts applies the server timeouts to the instance serving the API only
+func (c *Client) UpdateServerTimeouts(t engine.ServerTimeouts) error {
+	return c.PutForm(c.endpoint("instance", "timeouts"), url.Values{
+		"read":  {t.Read.String()},
+		"write": {t.Write.String()},
+		"idle":  {t.Idle.String()},
+	})
+}
+
 func (c *Client) GetHost(hk engine.HostKey) (*engine.Host, error) {
 	response, err := c.Get(c.endpoint("hosts", hk.Name), url.Values{})
 	if err != nil {
@@ -95,6 +131,20 @@ func (c *Client) GetListeners() ([]engine.Listener, error) {
 	return engine.ListenersFromJSON(data)
 }
 
+// RotateSessionTicketKeys appends the new session ticket key to the keys of the HTTPS listener and returns
+// the amount of the keys the listener has
+func (c *Client) RotateSessionTicketKeys(lk engine.ListenerKey) (int, error) {
+	data, err := c.Post(c.endpoint("listeners", lk.Id, "sessionticketkeys"), nil)
+	if err != nil {
+		return 0, err
+	}
+	var out struct{ Keys int }
+	if err := json.Unmarshal(data, &out); err != nil {
+		return 0, err
+	}
+	return out.Keys, nil
+}
+
 func (c *Client) DeleteListener(lk engine.ListenerKey) error {
 	return c.Delete(c.endpoint("listeners", lk.Id))
 }
@@ -124,6 +174,21 @@ func (c *Client) GetFrontends() ([]engine.Frontend, error) {
 	return engine.FrontendsFromJSON(c.Registry.GetRouter(), data)
 }
 
+// GetFrontendsPage returns the page of the frontends with the ids starting with the prefix and the cursor of the
+// next page, empty for the last page. The empty cursor asks for the first page.
+func (c *Client) GetFrontendsPage(prefix, cursor string, limit int) ([]engine.Frontend, string, error) {
+	data, err := c.Get(c.endpoint("frontends"), pageValues(prefix, cursor, limit))
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := nextCursor(data)
+	if err != nil {
+		return nil, "", err
+	}
+	fs, err := engine.FrontendsFromJSON(c.Registry.GetRouter(), data)
+	return fs, next, err
+}
+
 func (c *Client) TopFrontends(bk *engine.BackendKey, limit int) ([]engine.Frontend, error) {
 	values := url.Values{
 		"limit": {fmt.Sprintf("%d", limit)},
@@ -142,6 +207,21 @@ func (c *Client) DeleteFrontend(fk engine.FrontendKey) error {
 	return c.Delete(c.endpoint("frontends", fk.Id))
 }
 
+// PurgeCache drops the cached responses of the frontend with the paths starting with the prefix, all of them if
+// the prefix is empty, and returns the amount of the dropped responses. Only the caches of the vulcand instance
+// serving the API are purged, the other instances keep their responses until they expire.
+func (c *Client) PurgeCache(fk engine.FrontendKey, prefix string) (int, error) {
+	data, err := c.Post(c.endpoint("frontends", fk.Id, "cache", "purge")+"?"+url.Values{"prefix": {prefix}}.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	var out struct{ Purged int }
+	if err := json.Unmarshal(data, &out); err != nil {
+		return 0, err
+	}
+	return out.Purged, nil
+}
+
 func (c *Client) UpsertBackend(b engine.Backend) error {
 	if b.Id == "" {
 		return fmt.Errorf("frontend id and middleware id can not be empty")
@@ -170,6 +250,59 @@ func (c *Client) GetBackends() ([]engine.Backend, error) {
 	return engine.BackendsFromJSON(data)
 }
 
+func (c *Client) GetBackendHealth(bk engine.BackendKey) ([]engine.ServerHealth, error) {
+	if bk.Id == "" {
+		return nil, fmt.Errorf("backend id can not be empty")
+	}
+	response, err := c.Get(c.endpoint("backends", bk.Id, "health"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var re *ServersHealthResponse
+	if err = json.Unmarshal(response, &re); err != nil {
+		return nil, err
+	}
+	return re.Servers, nil
+}
+
+func (c *Client) GetCerts() ([]engine.CertExpiry, error) {
+	response, err := c.Get(c.endpoint("certs"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var re *CertsResponse
+	if err = json.Unmarshal(response, &re); err != nil {
+		return nil, err
+	}
+	return re.Certs, nil
+}
+
+// GetProxyStats returns the listener connections and frontend request rates of the running proxy
+func (c *Client) GetProxyStats() (*engine.ProxyStats, error) {
+	response, err := c.Get(c.endpoint("stats"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var re *ProxyStatsResponse
+	if err = json.Unmarshal(response, &re); err != nil {
+		return nil, err
+	}
+	return re.Stats, nil
+}
+
+// GetLatencyStats returns the latency percentiles of the frontends and backends of the running proxy
+func (c *Client) GetLatencyStats() (*engine.LatencyStats, error) {
+	response, err := c.Get(c.endpoint("stats", "latency"), url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	var re *LatencyStatsResponse
+	if err = json.Unmarshal(response, &re); err != nil {
+		return nil, err
+	}
+	return re.Latency, nil
+}
+
 func (c *Client) UpsertServer(bk engine.BackendKey, srv engine.Server, ttl time.Duration) error {
 	if bk.Id == "" || srv.Id == "" {
 		return fmt.Errorf("backend id and server id can not be empty")
@@ -215,6 +348,23 @@ func (c *Client) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
 	return engine.ServersFromJSON(data)
 }
 
+// GetServersPage returns the page of the servers of the backend the way GetFrontendsPage does
+func (c *Client) GetServersPage(bk engine.BackendKey, prefix, cursor string, limit int) ([]engine.Server, string, error) {
+	if bk.Id == "" {
+		return nil, "", fmt.Errorf("backend id can not be empty")
+	}
+	data, err := c.Get(c.endpoint("backends", bk.Id, "servers"), pageValues(prefix, cursor, limit))
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := nextCursor(data)
+	if err != nil {
+		return nil, "", err
+	}
+	srvs, err := engine.ServersFromJSON(data)
+	return srvs, next, err
+}
+
 func (c *Client) DeleteServer(sk engine.ServerKey) error {
 	if sk.BackendKey.Id == "" {
 		return fmt.Errorf("backend id can not be empty")
@@ -222,6 +372,42 @@ func (c *Client) DeleteServer(sk engine.ServerKey) error {
 	return c.Delete(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id))
 }
 
+// QuarantineServer takes the server out of rotation of the instance serving the API keeping it in the configuration,
+// until it is released or the instance restarts. The other instances keep the server in rotation.
+func (c *Client) QuarantineServer(sk engine.ServerKey) error {
+	if sk.BackendKey.Id == "" {
+		return fmt.Errorf("backend id can not be empty")
+	}
+	_, err := c.Post(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "quarantine"), nil)
+	return err
+}
+
+// ReleaseServer puts the server quarantined on the instance serving the API back to rotation
+func (c *Client) ReleaseServer(sk engine.ServerKey) error {
+	if sk.BackendKey.Id == "" {
+		return fmt.Errorf("backend id can not be empty")
+	}
+	return c.Delete(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "quarantine"))
+}
+
+// RegisterServer registers the server that is deleted unless it is registered again within the ttl, registering
+// the same server again renews the registration
+func (c *Client) RegisterServer(bk engine.BackendKey, srv engine.Server, ttl time.Duration) error {
+	if bk.Id == "" || srv.Id == "" {
+		return fmt.Errorf("backend id and server id can not be empty")
+	}
+	_, err := c.Post(c.endpoint("backends", bk.Id, "servers", srv.Id, "registration"), serverPack{Server: srv, TTL: ttl.String()})
+	return err
+}
+
+// DeregisterServer closes the registration of the server, so it is deleted right away
+func (c *Client) DeregisterServer(sk engine.ServerKey) error {
+	if sk.BackendKey.Id == "" {
+		return fmt.Errorf("backend id can not be empty")
+	}
+	return c.Delete(c.endpoint("backends", sk.BackendKey.Id, "servers", sk.Id, "registration"))
+}
+
 func (c *Client) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
 	if fk.Id == "" || m.Id == "" {
 		return fmt.Errorf("frontend id and middleware id can not be empty")
@@ -251,6 +437,33 @@ func (c *Client) DeleteMiddleware(mk engine.MiddlewareKey) error {
 	return c.Delete(c.endpoint("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
 }
 
+// ApplyBatch applies the operations atomically, see engine.Batcher
+func (c *Client) ApplyBatch(ops []engine.BatchOp) error {
+	bp, err := newBatchPack(ops)
+	if err != nil {
+		return err
+	}
+	_, err = c.Post(c.endpoint("batch"), bp)
+	return err
+}
+
+// Validate checks the operations without applying them and returns the problems found
+func (c *Client) Validate(ops []engine.BatchOp) ([]Problem, error) {
+	bp, err := newBatchPack(ops)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.Post(c.endpoint("validate"), bp)
+	if err != nil {
+		return nil, err
+	}
+	var re *ValidationResponse
+	if err := json.Unmarshal(response, &re); err != nil {
+		return nil, err
+	}
+	return re.Problems, nil
+}
+
 func (c *Client) PutForm(endpoint string, values url.Values) error {
 	_, err := c.RoundTrip(func() (*http.Response, error) {
 		req, err := http.NewRequest("PUT", endpoint, strings.NewReader(values.Encode()))
@@ -258,7 +471,7 @@ func (c *Client) PutForm(endpoint string, values url.Values) error {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-		return http.DefaultClient.Do(req)
+		return c.do(req)
 	})
 	if err != nil {
 		return err
@@ -266,13 +479,40 @@ func (c *Client) PutForm(endpoint string, values url.Values) error {
 	return nil
 }
 
+// ExportConfig returns the whole configuration document, the host secrets are included sealed if requested
+func (c *Client) ExportConfig(secrets bool) ([]byte, error) {
+	return c.Get(c.endpoint("config"), url.Values{"secrets": {strconv.FormatBool(secrets)}})
+}
+
+// ImportConfig writes the configuration document, with replace set the objects missing from it are deleted
+func (c *Client) ImportConfig(data []byte, replace bool) error {
+	mode := importMerge
+	if replace {
+		mode = importReplace
+	}
+	_, err := c.Post(c.endpoint("config")+"?"+url.Values{"mode": {mode}}.Encode(), rawDocument(data))
+	return err
+}
+
+// rawDocument is the JSON document posted as is
+type rawDocument []byte
+
+func (d rawDocument) MarshalJSON() ([]byte, error) {
+	return d, nil
+}
+
 func (c *Client) Post(endpoint string, in interface{}) ([]byte, error) {
 	return c.RoundTrip(func() (*http.Response, error) {
 		data, err := json.Marshal(in)
 		if err != nil {
 			return nil, err
 		}
-		return http.Post(endpoint, "application/json", bytes.NewBuffer(data))
+		req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return c.do(req)
 	})
 }
 
@@ -287,8 +527,7 @@ func (c *Client) Put(endpoint string, in interface{}) ([]byte, error) {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", "application/json")
-		re, err := http.DefaultClient.Do(req)
-		return re, err
+		return c.do(req)
 	})
 }
 
@@ -298,7 +537,7 @@ func (c *Client) Delete(endpoint string) error {
 		if err != nil {
 			return nil, err
 		}
-		return http.DefaultClient.Do(req)
+		return c.do(req)
 	})
 	if err != nil {
 		return err
@@ -315,10 +554,26 @@ func (c *Client) Get(u string, params url.Values) ([]byte, error) {
 	}
 	baseUrl.RawQuery = params.Encode()
 	return c.RoundTrip(func() (*http.Response, error) {
-		return http.Get(baseUrl.String())
+		req, err := http.NewRequest("GET", baseUrl.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		return c.do(req)
 	})
 }
 
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Namespace != "" {
+		q := req.URL.Query()
+		q.Set("namespace", c.Namespace)
+		req.URL.RawQuery = q.Encode()
+	}
+	return http.DefaultClient.Do(req)
+}
+
 type RoundTripFn func() (*http.Response, error)
 
 func (c *Client) RoundTrip(fn RoundTripFn) ([]byte, error) {
@@ -351,6 +606,29 @@ func (c *Client) endpoint(params ...string) string {
 	return fmt.Sprintf("%s/%s/%s", c.Addr, CurrentVersion, strings.Join(params, "/"))
 }
 
+// pageValues returns the query of the listing page, none of the parameters is set for the whole listing
+func pageValues(prefix, cursor string, limit int) url.Values {
+	values := url.Values{}
+	if prefix != "" {
+		values.Set("prefix", prefix)
+	}
+	if cursor != "" {
+		values.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		values.Set("limit", fmt.Sprintf("%d", limit))
+	}
+	return values
+}
+
+func nextCursor(data []byte) (string, error) {
+	var page PageResponse
+	if err := json.Unmarshal(data, &page); err != nil {
+		return "", err
+	}
+	return page.NextCursor, nil
+}
+
 type BackendsResponse struct {
 	Backends []engine.Backend
 }
@@ -359,6 +637,22 @@ type ServersResponse struct {
 	Servers []engine.Server
 }
 
+type ServersHealthResponse struct {
+	Servers []engine.ServerHealth
+}
+
+type ProxyStatsResponse struct {
+	Stats *engine.ProxyStats
+}
+
+type LatencyStatsResponse struct {
+	Latency *engine.LatencyStats
+}
+
+type CertsResponse struct {
+	Certs []engine.CertExpiry
+}
+
 type StatusResponse struct {
 	Message string
 }
@@ -374,3 +668,13 @@ type ConnectionsResponse struct {
 type SeverityResponse struct {
 	Severity string
 }
+
+type ServerTimeoutsResponse struct {
+	Read  string
+	Write string
+	Idle  string
+}
+
+type PageResponse struct {
+	NextCursor string
+}
@@ -0,0 +1,542 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/secret"
+)
+
+const (
+	importMerge   = "merge"
+	importReplace = "replace"
+)
+
+// configPack is the whole configuration document. Host secrets and the middlewares holding credentials are
+// left out of the hosts and frontends and, if requested, exported sealed with the proxy seal key. TTLs list
+// the times left to the frontends, middlewares and servers expiring, if the engine reports them.
+type configPack struct {
+	Hosts         []engine.Host
+	Listeners     []engine.Listener
+	BackendSpecs  []engine.BackendSpec
+	FrontendSpecs []engine.FrontendSpec
+	Secrets       []hostSecrets      `json:",omitempty"`
+	Middlewares   []sealedMiddleware `json:",omitempty"`
+	TTLs          []objectTTL        `json:",omitempty"`
+}
+
+// hostSecrets are the sealed key pairs and ACME account key of the host
+type hostSecrets struct {
+	Host           string
+	KeyPair        json.RawMessage `json:",omitempty"`
+	KeyPairs       json.RawMessage `json:",omitempty"`
+	ACMEAccountKey json.RawMessage `json:",omitempty"`
+}
+
+// sealedMiddleware is the middleware of the frontend with its parameters sealed
+type sealedMiddleware struct {
+	FrontendId string
+	Middleware json.RawMessage
+}
+
+// objectTTL is the time left to the frontend, the middleware of the frontend or the server of the backend
+type objectTTL struct {
+	FrontendId   string `json:",omitempty"`
+	MiddlewareId string `json:",omitempty"`
+	BackendId    string `json:",omitempty"`
+	ServerId     string `json:",omitempty"`
+	TTL          string
+}
+
+type configReadPack struct {
+	Secrets     []hostSecrets
+	Middlewares []sealedMiddleware
+	TTLs        []objectTTL
+}
+
+// validationError is returned when the configuration failed validation, nothing was written in this case
+type validationError struct {
+	Problems []Problem
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("configuration is invalid, %d problems found", len(e.Problems))
+}
+
+func (c *ProxyController) exportConfig(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	withSecrets, err := strconv.ParseBool(formGet(r.Form, "secrets", "false"))
+	if err != nil {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("invalid secrets parameter: %v", err)}
+	}
+	if withSecrets && c.box == nil {
+		return nil, &engine.InvalidFormatError{Message: "can not export secrets, the seal key is not set"}
+	}
+	ss, err := c.ng.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	cp, err := c.packConfig(ss, withSecrets)
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := c.ng.(engine.TTLGetter); ok {
+		ttls, err := g.GetTTLs()
+		if err != nil {
+			return nil, err
+		}
+		cp.TTLs = c.packTTLs(ss, ttls, withSecrets)
+	}
+	return cp, nil
+}
+
+// packConfig converts the snapshot to the configuration document, the host secrets and the middlewares
+// holding credentials are sealed if requested
+func (c *ProxyController) packConfig(ss *engine.Snapshot, withSecrets bool) (*configPack, error) {
+	cp := &configPack{
+		Hosts:         make([]engine.Host, len(ss.Hosts)),
+		Listeners:     make([]engine.Listener, len(ss.Listeners)),
+		BackendSpecs:  ss.BackendSpecs,
+		FrontendSpecs: make([]engine.FrontendSpec, len(ss.FrontendSpecs)),
+	}
+	for i, h := range ss.Hosts {
+		if withSecrets {
+			hs, err := c.sealHostSecrets(h)
+			if err != nil {
+				return nil, err
+			}
+			if hs != nil {
+				cp.Secrets = append(cp.Secrets, *hs)
+			}
+		}
+		cp.Hosts[i] = stripSecrets(h)
+	}
+	for i, l := range ss.Listeners {
+		cp.Listeners[i] = stripSessionTicketKeys(l)
+	}
+	for i, fs := range ss.FrontendSpecs {
+		cp.FrontendSpecs[i] = engine.FrontendSpec{Frontend: fs.Frontend}
+		for _, m := range fs.Middlewares {
+			if !c.sealedMiddleware(m) {
+				cp.FrontendSpecs[i].Middlewares = append(cp.FrontendSpecs[i].Middlewares, m)
+				continue
+			}
+			if !withSecrets {
+				continue
+			}
+			bytes, err := secret.SealMiddlewareToJSON(c.box, m)
+			if err != nil {
+				return nil, err
+			}
+			cp.Middlewares = append(cp.Middlewares, sealedMiddleware{FrontendId: fs.Frontend.Id, Middleware: bytes})
+		}
+	}
+	return cp, nil
+}
+
+// sealedMiddleware tells whether the middleware holds credentials, these are never exported in the clear
+func (c *ProxyController) sealedMiddleware(m engine.Middleware) bool {
+	spec := c.ng.GetRegistry().GetSpec(m.Type)
+	return spec != nil && spec.Sealed
+}
+
+// importConfig writes the configuration document in one batch. Merge upserts all objects of the document,
+// replace deletes the objects missing from it as well. Hosts exported without secrets keep their current
+// key pairs and account keys, frontends keep their middlewares holding credentials and listeners keep their
+// session ticket keys.
+func (c *ProxyController) importConfig(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	mode := formGet(r.Form, "mode", importMerge)
+	if mode != importMerge && mode != importReplace {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported import mode '%v', expected %v or %v", mode, importMerge, importReplace)}
+	}
+	batcher, ok := c.ng.(engine.Batcher)
+	if !ok {
+		return nil, &errNotImplemented{Message: "engine does not support atomic batches"}
+	}
+	next, err := engine.SnapshotFromJSON(c.ng.GetRegistry().GetRouter(), c.ng.GetRegistry().GetSpec, body)
+	if err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	var cp configReadPack
+	if err := json.Unmarshal(body, &cp); err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	current, err := c.ng.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.restoreSecrets(next, current, cp.Secrets); err != nil {
+		return nil, err
+	}
+	if err := c.restoreMiddlewares(next, current, cp.Middlewares); err != nil {
+		return nil, err
+	}
+	restoreSessionTicketKeys(next, current)
+
+	ops := engine.SnapshotOps(current, next, mode == importReplace)
+	if err := applyTTLs(ops, cp.TTLs); err != nil {
+		return nil, err
+	}
+	problems, err := c.check(ops)
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) != 0 {
+		return nil, &validationError{Problems: problems}
+	}
+	log.Infof("Import configuration, mode=%v, %d operations", mode, len(ops))
+	if err := c.applyAuditedBatch(r, batcher, ops); err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("configuration imported, %d operations applied", len(ops))}, nil
+}
+
+// packTTLs lists the TTLs of the objects exported, sorted, so the exports of the same configuration are the same
+func (c *ProxyController) packTTLs(ss *engine.Snapshot, ttls *engine.TTLs, withSecrets bool) []objectTTL {
+	var out []objectTTL
+	for _, fs := range ss.FrontendSpecs {
+		fk := engine.FrontendKey{Id: fs.Frontend.Id}
+		if ttl, ok := ttls.Frontends[fk]; ok {
+			out = append(out, objectTTL{FrontendId: fk.Id, TTL: ttl.String()})
+		}
+		for _, m := range fs.Middlewares {
+			if !withSecrets && c.sealedMiddleware(m) {
+				continue
+			}
+			if ttl, ok := ttls.Middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: m.Id}]; ok {
+				out = append(out, objectTTL{FrontendId: fk.Id, MiddlewareId: m.Id, TTL: ttl.String()})
+			}
+		}
+	}
+	for _, bs := range ss.BackendSpecs {
+		for _, srv := range bs.Servers {
+			sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: bs.Backend.Id}, Id: srv.Id}
+			if ttl, ok := ttls.Servers[sk]; ok {
+				out = append(out, objectTTL{BackendId: sk.BackendKey.Id, ServerId: srv.Id, TTL: ttl.String()})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.FrontendId != b.FrontendId {
+			return a.FrontendId < b.FrontendId
+		}
+		if a.MiddlewareId != b.MiddlewareId {
+			return a.MiddlewareId < b.MiddlewareId
+		}
+		if a.BackendId != b.BackendId {
+			return a.BackendId < b.BackendId
+		}
+		return a.ServerId < b.ServerId
+	})
+	return out
+}
+
+// applyTTLs sets the TTLs of the document on the upserts of their objects, the objects with no TTL in the
+// document are upserted permanent
+func applyTTLs(ops []engine.BatchOp, ttls []objectTTL) error {
+	if len(ttls) == 0 {
+		return nil
+	}
+	frontends := map[engine.FrontendKey]time.Duration{}
+	middlewares := map[engine.MiddlewareKey]time.Duration{}
+	servers := map[engine.ServerKey]time.Duration{}
+	for _, t := range ttls {
+		ttl, err := time.ParseDuration(t.TTL)
+		if err != nil || ttl <= 0 {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("TTL of %v should be a positive duration, got '%v'", t.object(), t.TTL)}
+		}
+		switch {
+		case t.FrontendId != "" && t.MiddlewareId != "" && t.BackendId == "" && t.ServerId == "":
+			middlewares[engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: t.FrontendId}, Id: t.MiddlewareId}] = ttl
+		case t.FrontendId != "" && t.MiddlewareId == "" && t.BackendId == "" && t.ServerId == "":
+			frontends[engine.FrontendKey{Id: t.FrontendId}] = ttl
+		case t.FrontendId == "" && t.MiddlewareId == "" && t.BackendId != "" && t.ServerId != "":
+			servers[engine.ServerKey{BackendKey: engine.BackendKey{Id: t.BackendId}, Id: t.ServerId}] = ttl
+		default:
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("TTL should name the frontend, the middleware of the frontend or the server of the backend, got %v", t.object())}
+		}
+	}
+	applied := 0
+	for i, op := range ops {
+		var ttl time.Duration
+		var ok bool
+		switch c := op.Change.(type) {
+		case *engine.FrontendUpserted:
+			ttl, ok = frontends[engine.FrontendKey{Id: c.Frontend.Id}]
+		case *engine.MiddlewareUpserted:
+			ttl, ok = middlewares[engine.MiddlewareKey{FrontendKey: c.FrontendKey, Id: c.Middleware.Id}]
+		case *engine.ServerUpserted:
+			ttl, ok = servers[engine.ServerKey{BackendKey: c.BackendKey, Id: c.Server.Id}]
+		}
+		if ok {
+			ops[i].TTL = ttl
+			applied++
+		}
+	}
+	if applied != len(frontends)+len(middlewares)+len(servers) {
+		return &engine.InvalidFormatError{Message: "TTLs should name the frontends, middlewares and servers of the document"}
+	}
+	return nil
+}
+
+func (t objectTTL) object() string {
+	switch {
+	case t.MiddlewareId != "":
+		return fmt.Sprintf("middleware '%v' of frontend '%v'", t.MiddlewareId, t.FrontendId)
+	case t.ServerId != "":
+		return fmt.Sprintf("server '%v' of backend '%v'", t.ServerId, t.BackendId)
+	case t.BackendId != "":
+		return fmt.Sprintf("backend '%v'", t.BackendId)
+	}
+	return fmt.Sprintf("frontend '%v'", t.FrontendId)
+}
+
+// check validates the operations against the copy of the current configuration
+func (c *ProxyController) check(ops []engine.BatchOp) ([]Problem, error) {
+	state, err := c.configCopy()
+	if err != nil {
+		return nil, err
+	}
+	problems := []Problem{}
+	for i, op := range ops {
+		err := instantiate(op)
+		if err == nil {
+			err = engine.ApplyChange(state, op)
+		}
+		if err != nil {
+			problems = append(problems, Problem{Index: i, Message: err.Error()})
+		}
+	}
+	return problems, nil
+}
+
+func (c *ProxyController) sealHostSecrets(h engine.Host) (*hostSecrets, error) {
+	hs := &hostSecrets{Host: h.Name}
+	if h.Settings.KeyPair != nil {
+		bytes, err := secret.SealKeyPairToJSON(c.box, h.Settings.KeyPair)
+		if err != nil {
+			return nil, err
+		}
+		hs.KeyPair = bytes
+	}
+	if len(h.Settings.KeyPairs) != 0 {
+		data, err := json.Marshal(h.Settings.KeyPairs)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := c.box.Seal(data)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := secret.SealedValueToJSON(sealed)
+		if err != nil {
+			return nil, err
+		}
+		hs.KeyPairs = bytes
+	}
+	if h.Settings.ACME != nil && len(h.Settings.ACME.AccountKey) != 0 {
+		sealed, err := c.box.Seal(h.Settings.ACME.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := secret.SealedValueToJSON(sealed)
+		if err != nil {
+			return nil, err
+		}
+		hs.ACMEAccountKey = bytes
+	}
+	if hs.KeyPair == nil && hs.KeyPairs == nil && hs.ACMEAccountKey == nil {
+		return nil, nil
+	}
+	return hs, nil
+}
+
+// restoreSecrets sets the host secrets opened with the seal key, hosts with no secrets in the document
+// keep the secrets they have now
+func (c *ProxyController) restoreSecrets(next, current *engine.Snapshot, secrets []hostSecrets) error {
+	if len(secrets) != 0 && c.box == nil {
+		return &engine.InvalidFormatError{Message: "can not import secrets, the seal key is not set"}
+	}
+	sealed := map[string]hostSecrets{}
+	for _, hs := range secrets {
+		sealed[hs.Host] = hs
+	}
+	existing := map[string]engine.Host{}
+	for _, h := range current.Hosts {
+		existing[h.Name] = h
+	}
+	for i, h := range next.Hosts {
+		settings := h.Settings
+		if hs, ok := sealed[h.Name]; ok {
+			if err := c.openHostSecrets(hs, &settings); err != nil {
+				return &engine.InvalidFormatError{Message: fmt.Sprintf("failed to open secrets of host '%v': %v", h.Name, err)}
+			}
+		} else if e, ok := existing[h.Name]; ok {
+			if settings.KeyPair == nil {
+				settings.KeyPair = e.Settings.KeyPair
+			}
+			if settings.KeyPairs == nil {
+				settings.KeyPairs = e.Settings.KeyPairs
+			}
+			if settings.ACME != nil && len(settings.ACME.AccountKey) == 0 && e.Settings.ACME != nil {
+				acme := *settings.ACME
+				acme.AccountKey = e.Settings.ACME.AccountKey
+				settings.ACME = &acme
+			}
+		}
+		host, err := engine.NewHost(h.Name, settings)
+		if err != nil {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("bad host '%v': %v", h.Name, err)}
+		}
+		next.Hosts[i] = *host
+	}
+	return nil
+}
+
+// restoreMiddlewares adds the middlewares opened with the seal key to their frontends, frontends with no
+// sealed middlewares in the document keep the middlewares holding credentials they have now
+func (c *ProxyController) restoreMiddlewares(next, current *engine.Snapshot, sealed []sealedMiddleware) error {
+	if len(sealed) != 0 && c.box == nil {
+		return &engine.InvalidFormatError{Message: "can not import middlewares, the seal key is not set"}
+	}
+	frontends := map[string]*engine.FrontendSpec{}
+	for i := range next.FrontendSpecs {
+		frontends[next.FrontendSpecs[i].Frontend.Id] = &next.FrontendSpecs[i]
+	}
+	opened := map[string]bool{}
+	for _, sm := range sealed {
+		fs, ok := frontends[sm.FrontendId]
+		if !ok {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("frontend '%v' of the sealed middleware is not in the document", sm.FrontendId)}
+		}
+		bytes, err := secret.OpenMiddlewareJSON(c.box, sm.Middleware)
+		if err != nil {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("failed to open middleware of frontend '%v': %v", sm.FrontendId, err)}
+		}
+		m, err := engine.MiddlewareFromJSON(bytes, c.ng.GetRegistry().GetSpec)
+		if err != nil {
+			return &engine.InvalidFormatError{Message: fmt.Sprintf("bad middleware of frontend '%v': %v", sm.FrontendId, err)}
+		}
+		fs.Middlewares = append(fs.Middlewares, *m)
+		opened[sm.FrontendId] = true
+	}
+	for _, e := range current.FrontendSpecs {
+		fs, ok := frontends[e.Frontend.Id]
+		if !ok || opened[e.Frontend.Id] {
+			continue
+		}
+		for _, m := range e.Middlewares {
+			if c.sealedMiddleware(m) && !hasMiddleware(fs.Middlewares, m.Id) {
+				fs.Middlewares = append(fs.Middlewares, m)
+			}
+		}
+	}
+	return nil
+}
+
+func hasMiddleware(ms []engine.Middleware, id string) bool {
+	for _, m := range ms {
+		if m.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ProxyController) openHostSecrets(hs hostSecrets, settings *engine.HostSettings) error {
+	if len(hs.KeyPair) != 0 {
+		bytes, err := c.openSealed(hs.KeyPair)
+		if err != nil {
+			return err
+		}
+		var keyPair *engine.KeyPair
+		if err := json.Unmarshal(bytes, &keyPair); err != nil {
+			return err
+		}
+		settings.KeyPair = keyPair
+	}
+	if len(hs.KeyPairs) != 0 {
+		bytes, err := c.openSealed(hs.KeyPairs)
+		if err != nil {
+			return err
+		}
+		var keyPairs []engine.KeyPair
+		if err := json.Unmarshal(bytes, &keyPairs); err != nil {
+			return err
+		}
+		settings.KeyPairs = keyPairs
+	}
+	if len(hs.ACMEAccountKey) != 0 {
+		if settings.ACME == nil {
+			return fmt.Errorf("account key is set, but ACME is off")
+		}
+		bytes, err := c.openSealed(hs.ACMEAccountKey)
+		if err != nil {
+			return err
+		}
+		acme := *settings.ACME
+		acme.AccountKey = bytes
+		settings.ACME = &acme
+	}
+	return nil
+}
+
+func (c *ProxyController) openSealed(in []byte) ([]byte, error) {
+	sealed, err := secret.SealedValueFromJSON(in)
+	if err != nil {
+		return nil, err
+	}
+	return c.box.Open(sealed)
+}
+
+// stripSecrets returns the copy of the host without the key pairs and ACME account key
+func stripSecrets(h engine.Host) engine.Host {
+	h.Settings.KeyPair = nil
+	h.Settings.KeyPairs = nil
+	if h.Settings.ACME != nil {
+		acme := *h.Settings.ACME
+		acme.AccountKey = nil
+		h.Settings.ACME = &acme
+	}
+	return h
+}
+
+// stripSessionTicketKeys returns the copy of the listener without the session ticket keys, they are not exported
+func stripSessionTicketKeys(l engine.Listener) engine.Listener {
+	if l.Settings != nil && len(l.Settings.TLS.SessionTicketKeys) != 0 {
+		settings := *l.Settings
+		settings.TLS.SessionTicketKeys = nil
+		l.Settings = &settings
+	}
+	return l
+}
+
+// restoreSessionTicketKeys sets the current session ticket keys of the HTTPS listeners imported without them
+func restoreSessionTicketKeys(next, current *engine.Snapshot) {
+	existing := map[string]engine.Listener{}
+	for _, l := range current.Listeners {
+		existing[l.Id] = l
+	}
+	for i, l := range next.Listeners {
+		e, ok := existing[l.Id]
+		if !ok || l.Protocol != engine.HTTPS || e.Settings == nil || len(e.Settings.TLS.SessionTicketKeys) == 0 {
+			continue
+		}
+		if l.Settings != nil && len(l.Settings.TLS.SessionTicketKeys) != 0 {
+			continue
+		}
+		settings := &engine.HTTPSListenerSettings{}
+		if l.Settings != nil {
+			copied := *l.Settings
+			settings = &copied
+		}
+		settings.TLS.SessionTicketKeys = e.Settings.TLS.SessionTicketKeys
+		next.Listeners[i].Settings = settings
+	}
+}
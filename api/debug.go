@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// InitDebugController registers the runtime profiling endpoints of net/http/pprof under /debug/pprof/ and the
+// goroutine dump. If auth is set, all of them require a valid API token, as the profiles reveal the internals
+// of the running proxy.
+func InitDebugController(router *mux.Router, auth *TokenAuth) {
+	protected := func(h http.HandlerFunc) http.Handler {
+		// CPU profiles and traces are collected for the requested amount of seconds, longer than the write
+		// timeout of the API server
+		var out http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.NewResponseController(w).SetWriteDeadline(time.Time{})
+			h(w, r)
+		})
+		if auth != nil {
+			out = auth.Wrap(out)
+		}
+		return out
+	}
+
+	router.Handle("/v2/debug/goroutines", protected(getGoroutines)).Methods("GET")
+
+	router.Handle("/debug/pprof/cmdline", protected(pprof.Cmdline)).Methods("GET")
+	router.Handle("/debug/pprof/profile", protected(pprof.Profile)).Methods("GET")
+	router.Handle("/debug/pprof/symbol", protected(pprof.Symbol)).Methods("GET", "POST")
+	router.Handle("/debug/pprof/trace", protected(pprof.Trace)).Methods("GET")
+	// index lists the profiles and serves the named ones, e.g. /debug/pprof/goroutine?debug=2
+	router.PathPrefix("/debug/pprof/").Handler(protected(pprof.Index)).Methods("GET")
+}
+
+// getGoroutines responds with the amount of goroutines and the stack traces of all of them, for a quick look
+// at the wedged proxy without the pprof tooling
+func getGoroutines(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, Response{
+		"Count":  runtime.NumGoroutine(),
+		"Stacks": string(allStacks()),
+	}, http.StatusOK)
+}
+
+// allStacks returns the stack traces of all goroutines, the buffer grows until the traces fit
+func allStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
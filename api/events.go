@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// eventsKeepAlive is the interval of the comments sent to keep the idle stream open
+const eventsKeepAlive = 15 * time.Second
+
+// streamChanges sends the configuration changes as server-sent events. The stream starts with the snapshot
+// event carrying the whole configuration, followed by the change events. The snapshot is sent again if the
+// client has fallen behind and the changes were dropped, or the proxy itself resynced with the engine.
+// The controller scoped to the namespace streams the changes of the namespace only, with the ids in the namespace.
+func (c *ProxyController) streamChanges(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendResponse(w, Response{"message": "streaming is not supported"}, http.StatusInternalServerError)
+		return
+	}
+	// subscribe before reading the snapshot, so no changes are missed in between
+	sub := c.sup.SubscribeChanges()
+	defer sub.Close()
+
+	// the stream outlives the write timeout of the API server
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	scope := &eventScope{namespace: c.namespace, ng: c.ng}
+	if err := c.sendSnapshot(w, scope); err != nil {
+		log.Errorf("failed to send configuration snapshot: %v", err)
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		case <-sub.Lost():
+			err = c.sendSnapshot(w, scope)
+		case e := <-sub.Changes():
+			if e.Op == engine.ChangeResync {
+				err = c.sendSnapshot(w, scope)
+			} else if e, ok := scope.event(e); ok {
+				err = sendEvent(w, "change", e)
+			} else {
+				continue
+			}
+		}
+		if err != nil {
+			log.Infof("configuration changes stream closed: %v", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (c *ProxyController) sendSnapshot(w http.ResponseWriter, scope *eventScope) error {
+	ss, err := c.ng.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	scope.reset(ss)
+	cp, err := c.packConfig(ss, false)
+	if err != nil {
+		return err
+	}
+	return sendEvent(w, "snapshot", cp)
+}
+
+func sendEvent(w http.ResponseWriter, name string, data interface{}) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, bytes)
+	return err
+}
+
+// eventScope passes on the change events of the namespace with the ids in the namespace. The hosts are not
+// namespaced, the hosts of the namespace are the ones found in its engine.
+type eventScope struct {
+	namespace string
+	ng        engine.Engine
+	hosts     map[string]bool
+}
+
+// reset remembers the hosts of the namespace from the snapshot sent to the client
+func (s *eventScope) reset(ss *engine.Snapshot) {
+	s.hosts = make(map[string]bool, len(ss.Hosts))
+	for _, h := range ss.Hosts {
+		s.hosts[h.Name] = true
+	}
+}
+
+// event returns the change event in the namespace, false is returned for the changes of the other namespaces
+func (s *eventScope) event(e *engine.ChangeEvent) (*engine.ChangeEvent, bool) {
+	if s.namespace == "" {
+		return e, true
+	}
+	out := *e
+	switch e.Type {
+	case "host":
+		if e.Op == engine.ChangeDelete {
+			ok := s.hosts[e.Id]
+			delete(s.hosts, e.Id)
+			return e, ok
+		}
+		if _, err := s.ng.GetHost(engine.HostKey{Name: e.Id}); err != nil {
+			// the host is not in the namespace, the client knowing it has missed its deletion
+			ok := s.hosts[e.Id]
+			delete(s.hosts, e.Id)
+			if ok {
+				out.Op = engine.ChangeDelete
+			}
+			return &out, ok
+		}
+		s.hosts[e.Id] = true
+		return e, true
+	case "middleware", "server":
+		id, ok := s.unqualify(e.Parent)
+		out.Parent = id
+		return &out, ok
+	default:
+		id, ok := s.unqualify(e.Id)
+		out.Id = id
+		return &out, ok
+	}
+}
+
+func (s *eventScope) unqualify(id string) (string, bool) {
+	ns, out, err := engine.SplitNamespacedId(id)
+	if err != nil || ns != s.namespace {
+		return "", false
+	}
+	return out, true
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// maxPageLimit caps the amount of items on the page, the pages asking for more come with the cursor of the rest
+const maxPageLimit = 1000
+
+// parsePage returns the page of the listing asked for by the limit, the prefix and the cursor parameters and false
+// if none is set, so the whole listing is served as it is.
+//
+// The cursor of the next page is returned with the page. The pages of the engines implementing engine.Pager list
+// the snapshot of the configuration the first page was read at. The rest of the engines are paged by the API in the
+// order of the ids: the items not changed in between the pages are listed once, the items added or deleted in
+// between are listed if they are after the page the listing is at.
+func parsePage(r *http.Request) (engine.Page, bool, error) {
+	var p engine.Page
+	cursor, limit, prefix := r.Form.Get("cursor"), r.Form.Get("limit"), r.Form.Get("prefix")
+	if cursor == "" && limit == "" && prefix == "" {
+		return p, false, nil
+	}
+	if cursor != "" {
+		bytes, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return p, false, &engine.InvalidFormatError{Message: fmt.Sprintf("bad cursor: %v", err)}
+		}
+		if err := json.Unmarshal(bytes, &p); err != nil {
+			return p, false, &engine.InvalidFormatError{Message: fmt.Sprintf("bad cursor: %v", err)}
+		}
+		if prefix != "" && prefix != p.Prefix {
+			return p, false, &engine.InvalidFormatError{Message: fmt.Sprintf("prefix '%v' does not match the cursor", prefix)}
+		}
+	} else {
+		p.Prefix = prefix
+	}
+	if limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 0 {
+			return p, false, &engine.InvalidFormatError{Message: fmt.Sprintf("limit should be a number >= 0, got '%v'", limit)}
+		}
+		p.Limit = l
+	}
+	if p.Limit == 0 || p.Limit > maxPageLimit {
+		p.Limit = maxPageLimit
+	}
+	return p, true, nil
+}
+
+// listPage serves the listing of the items under the name, the page of it if the page is asked for. The pages are
+// read by pager if it is set, otherwise the items listed by list are paged in the order of their ids.
+func listPage[T any](r *http.Request, name string, list func() ([]T, error), id func(T) string, pager func(engine.Page) ([]T, *engine.Page, error)) (interface{}, error) {
+	p, paged, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+	if paged && pager != nil {
+		items, next, err := pager(p)
+		if err != nil {
+			return nil, err
+		}
+		return pageResponse(name, items, next)
+	}
+	items, err := list()
+	if err != nil {
+		return nil, err
+	}
+	if !paged {
+		return Response{name: items}, nil
+	}
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = id(item)
+	}
+	idx, next := pageIds(ids, p)
+	out := make([]T, len(idx))
+	for i, j := range idx {
+		out[i] = items[j]
+	}
+	return pageResponse(name, out, next)
+}
+
+// pageResponse returns the items of the page with the cursor of the next page, if any
+func pageResponse(name string, items interface{}, next *engine.Page) (Response, error) {
+	out := Response{name: items}
+	if next == nil {
+		return out, nil
+	}
+	bytes, err := json.Marshal(next)
+	if err != nil {
+		return nil, err
+	}
+	out["NextCursor"] = base64.RawURLEncoding.EncodeToString(bytes)
+	return out, nil
+}
+
+// pageIds returns the indexes of the ids on the page in the order of the ids and the next page, nil if the page
+// is the last one
+func pageIds(ids []string, p engine.Page) ([]int, *engine.Page) {
+	idx := make([]int, 0, len(ids))
+	for i, id := range ids {
+		if strings.HasPrefix(id, p.Prefix) && (p.After == "" || id > p.After) {
+			idx = append(idx, i)
+		}
+	}
+	sort.Slice(idx, func(i, j int) bool { return ids[idx[i]] < ids[idx[j]] })
+	if p.Limit == 0 || len(idx) <= p.Limit {
+		return idx, nil
+	}
+	idx = idx[:p.Limit]
+	return idx, &engine.Page{Prefix: p.Prefix, After: ids[idx[len(idx)-1]], Limit: p.Limit}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// serverRegistrations are the servers registered through the API. The engine keeps the server registered while
+// the client renews the registration, the registration is closed once the client has not renewed it for its TTL,
+// so the server is deleted when the registering process dies as well as when this process dies.
+type serverRegistrations struct {
+	mtx  sync.Mutex
+	regs map[string]*serverRegistration
+}
+
+type serverRegistration struct {
+	r      engine.Registration
+	server engine.Server
+	ttl    time.Duration
+	timer  *time.Timer
+}
+
+func newServerRegistrations() *serverRegistrations {
+	return &serverRegistrations{regs: make(map[string]*serverRegistration)}
+}
+
+// expire closes the registration the client has not renewed, unless it has been replaced meanwhile
+func (s *serverRegistrations) expire(key string, sr *serverRegistration) {
+	s.mtx.Lock()
+	if s.regs[key] != sr {
+		s.mtx.Unlock()
+		return
+	}
+	delete(s.regs, key)
+	s.mtx.Unlock()
+
+	log.Infof("Registration of %v has not been renewed for %v, deleting the server", key, sr.ttl)
+	if err := sr.r.Close(); err != nil {
+		log.Errorf("Failed to close registration of %v: %v", key, err)
+	}
+}
+
+// registerServer registers the server or renews its registration. The same server registered with the same TTL
+// renews the registration, the changed one is registered again.
+func (c *ProxyController) registerServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	registrar, ok := c.ng.(engine.Registrar)
+	if !ok {
+		return nil, &errNotImplemented{Message: "engine does not support server registrations"}
+	}
+	srv, ttl, err := parseServerPack(body)
+	if err != nil {
+		return nil, err
+	}
+	if srv.Id != params["id"] {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("server id '%v' does not match the registration of '%v'", srv.Id, params["id"])}
+	}
+	if ttl <= 0 {
+		return nil, &engine.InvalidFormatError{Message: "registration TTL should be > 0"}
+	}
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: srv.Id}
+	key := c.registrationKey(sk)
+
+	regs := c.registrations
+	regs.mtx.Lock()
+	defer regs.mtx.Unlock()
+
+	if sr, ok := regs.regs[key]; ok {
+		// the timer stopped after it has fired is expiring the registration, it is registered again then
+		stopped := sr.timer.Stop()
+		if stopped && sr.ttl == ttl && reflect.DeepEqual(sr.server, *srv) {
+			sr.timer.Reset(ttl)
+			return srv, nil
+		}
+		delete(regs.regs, key)
+		if err := sr.r.Close(); err != nil {
+			log.Errorf("Failed to close registration of %v: %v", key, err)
+		}
+	}
+	log.Infof("Register %v %v, ttl=%v", sk.BackendKey, srv, ttl)
+	reg, err := registrar.RegisterServer(sk.BackendKey, *srv, ttl)
+	c.auditOperation(r, auditRegister, "server", sk.String(), nil, srv, err)
+	if err != nil {
+		return nil, err
+	}
+	sr := &serverRegistration{r: reg, server: *srv, ttl: ttl}
+	sr.timer = time.AfterFunc(ttl, func() { regs.expire(key, sr) })
+	regs.regs[key] = sr
+	return srv, nil
+}
+
+// deregisterServer closes the registration, so the server is deleted right away
+func (c *ProxyController) deregisterServer(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: params["backendId"]}, Id: params["id"]}
+	key := c.registrationKey(sk)
+
+	regs := c.registrations
+	regs.mtx.Lock()
+	sr, ok := regs.regs[key]
+	if ok {
+		delete(regs.regs, key)
+		sr.timer.Stop()
+	}
+	regs.mtx.Unlock()
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v is not registered", sk)}
+	}
+
+	log.Infof("Deregister %v", sk)
+	err := sr.r.Close()
+	c.auditOperation(r, auditDeregister, "server", sk.String(), nil, nil, err)
+	if err != nil {
+		return nil, err
+	}
+	return Response{"message": fmt.Sprintf("%v deregistered", sk)}, nil
+}
+
+// registrationKey tells apart the servers of the same ids in the different namespaces
+func (c *ProxyController) registrationKey(sk engine.ServerKey) string {
+	if c.namespace == "" {
+		return sk.String()
+	}
+	return engine.NamespacedId(c.namespace, sk.String())
+}
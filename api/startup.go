@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Startup reports the progress of the service startup
+type Startup interface {
+	StartupStatus() StartupStatus
+}
+
+// StartupStatus lists the startup phases in the order they ran
+type StartupStatus struct {
+	// Pending is the phase the startup is blocked on, empty once the startup is complete
+	Pending string
+	Phases  []StartupPhase
+	// Elapsed is the time the startup took, or has taken so far if it is not complete
+	Elapsed time.Duration
+}
+
+// StartupPhase is the startup step with its duration, the duration of the pending phase is the time spent
+// in it so far
+type StartupPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// pendingError returns the error telling the phase the startup is blocked on, nil once the startup is complete
+func (s StartupStatus) pendingError() error {
+	if s.Pending == "" {
+		return nil
+	}
+	for _, p := range s.Phases {
+		if p.Name == s.Pending {
+			return fmt.Errorf("starting, waiting for %v for %v", p.Name, p.Duration)
+		}
+	}
+	return fmt.Errorf("starting, waiting for %v", s.Pending)
+}
+
+func (c *ProxyController) getStartup(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	st := c.startup.StartupStatus()
+	phases := make([]Response, 0, len(st.Phases))
+	for _, p := range st.Phases {
+		phases = append(phases, Response{"Name": p.Name, "Duration": p.Duration.String()})
+	}
+	return Response{
+		"Complete": st.Pending == "",
+		"Pending":  st.Pending,
+		"Elapsed":  st.Elapsed.String(),
+		"Phases":   phases,
+	}, nil
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+)
+
+// Problem is the configuration problem found by the validation
+type Problem struct {
+	// Index is the index of the offending operation
+	Index   int
+	Message string
+}
+
+type ValidationResponse struct {
+	Valid    bool
+	Problems []Problem
+}
+
+// validate checks the operations in the batch format without applying them. Operations are upserts unless
+// the Op is set. They are parsed as the upsert endpoints do, checked against the copy of the current
+// configuration and the middlewares and backend transports are created as the proxy does.
+func (c *ProxyController) validate(w http.ResponseWriter, r *http.Request, params map[string]string, body []byte) (interface{}, error) {
+	var bp batchReadPack
+	if err := json.Unmarshal(body, &bp); err != nil {
+		return nil, &engine.InvalidFormatError{Message: err.Error()}
+	}
+	state, err := c.configCopy()
+	if err != nil {
+		return nil, err
+	}
+	problems := []Problem{}
+	for i, p := range bp.Operations {
+		if p.Op == "" {
+			p.Op = batchUpsert
+		}
+		op, err := parseBatchOp(p, c.ng.GetRegistry())
+		if err == nil {
+			err = instantiate(op)
+		}
+		if err == nil {
+			err = engine.ApplyChange(state, op)
+		}
+		if err != nil {
+			problems = append(problems, Problem{Index: i, Message: err.Error()})
+		}
+	}
+	return ValidationResponse{Valid: len(problems) == 0, Problems: problems}, nil
+}
+
+// instantiate creates the middleware handlers and backend transport settings the way the frontend rebuild does
+func instantiate(op engine.BatchOp) error {
+	switch c := op.Change.(type) {
+	case *engine.MiddlewareUpserted:
+		h, err := c.Middleware.Middleware.NewHandler(http.NotFoundHandler())
+		if err != nil {
+			return fmt.Errorf("failed to create middleware '%v': %v", c.Middleware.Id, err)
+		}
+		// the handler is never used, its background work, e.g. the key refresh, is stopped right away
+		if closer, ok := h.(io.Closer); ok {
+			closer.Close()
+		}
+	case *engine.BackendUpserted:
+		if _, err := c.Backend.TransportSettings(); err != nil {
+			return fmt.Errorf("invalid transport settings of backend '%v': %v", c.Backend.Id, err)
+		}
+	}
+	return nil
+}
+
+// configCopy returns the in memory copy of the current configuration
+func (c *ProxyController) configCopy() (engine.Engine, error) {
+	ss, err := c.ng.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	m := memng.New(c.ng.GetRegistry())
+	for _, op := range engine.SnapshotOps(nil, ss, false) {
+		if err := engine.ApplyChange(m, op); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
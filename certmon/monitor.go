@@ -0,0 +1,193 @@
+// Package certmon watches the host certificates and their OCSP staples and reports the days left until
+// they expire, so the certificates are replaced before the clients start to reject them.
+package certmon
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/reporter"
+	"github.com/vulcand/vulcand/stapler"
+)
+
+const (
+	DefaultWarnBefore    = 14 * 24 * time.Hour
+	DefaultCheckInterval = time.Hour
+)
+
+type Options struct {
+	// WarnBefore is how long before the expiry of the certificate or the OCSP staple the warnings are logged
+	WarnBefore time.Duration
+	// CheckInterval is the interval between checks of the host certificates
+	CheckInterval time.Duration
+	// Stapler holds the OCSP staples of the hosts, staples are not checked if not set
+	Stapler stapler.Stapler
+	// Reporter receives the days left until the certificates expire
+	Reporter     reporter.Reporter
+	TimeProvider timetools.TimeProvider
+}
+
+// Monitor periodically inspects the certificates of all hosts, whether they are issued by ACME or not
+type Monitor struct {
+	ng      engine.Engine
+	options Options
+
+	mtx   sync.Mutex
+	certs []engine.CertExpiry
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func New(ng engine.Engine, o Options) *Monitor {
+	if o.WarnBefore == 0 {
+		o.WarnBefore = DefaultWarnBefore
+	}
+	if o.CheckInterval == 0 {
+		o.CheckInterval = DefaultCheckInterval
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Monitor{
+		ng:      ng,
+		options: o,
+		stopC:   make(chan struct{}),
+	}
+}
+
+func (m *Monitor) Start() {
+	m.wg.Add(1)
+	go m.run()
+}
+
+func (m *Monitor) Stop() {
+	close(m.stopC)
+	m.wg.Wait()
+}
+
+// Certs returns the certificates found by the last check sorted by the host name
+func (m *Monitor) Certs() []engine.CertExpiry {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	out := make([]engine.CertExpiry, len(m.certs))
+	copy(out, m.certs)
+	return out
+}
+
+func (m *Monitor) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.options.CheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.check(); err != nil {
+			log.Errorf("certmon: check failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-m.stopC:
+			return
+		}
+	}
+}
+
+// check inspects the certificates of the hosts, reports the days left and warns about the ones expiring soon.
+// Every key pair of the host is inspected, the reporter gets the days left of the one expiring first.
+func (m *Monitor) check() error {
+	hosts, err := m.ng.GetHosts()
+	if err != nil {
+		return err
+	}
+	now := m.options.TimeProvider.UtcNow()
+	var certs []engine.CertExpiry
+	var states []reporter.CertState
+	for i := range hosts {
+		h := &hosts[i]
+		var cert, ocsp *reporter.CertState
+		for j := range h.Settings.AllKeyPairs() {
+			c := m.inspect(h, j)
+			certs = append(certs, c)
+			if c.Error != "" {
+				log.Warningf("certmon: failed to inspect certificate %d of %v: %v", j, h.Name, c.Error)
+				continue
+			}
+			days := c.DaysLeft(now)
+			if cert == nil || days < cert.DaysLeft {
+				cert = &reporter.CertState{Host: h.Name, Kind: reporter.CertKindCertificate, DaysLeft: days}
+			}
+			if left := c.NotAfter.Sub(now); left < m.options.WarnBefore {
+				log.Warningf("certmon: certificate %v of %v expires at %v, %.1f days left", c.Subject, h.Name, c.NotAfter, days)
+			}
+			if c.OCSPNextUpdate.IsZero() {
+				continue
+			}
+			days = c.OCSPNextUpdate.Sub(now).Hours() / 24
+			if ocsp == nil || days < ocsp.DaysLeft {
+				ocsp = &reporter.CertState{Host: h.Name, Kind: reporter.CertKindOCSP, DaysLeft: days}
+			}
+			if left := c.OCSPNextUpdate.Sub(now); left < m.options.WarnBefore {
+				log.Warningf("certmon: OCSP staple of %v of %v expires at %v, %.1f days left", c.Subject, h.Name, c.OCSPNextUpdate, days)
+			}
+		}
+		if cert != nil {
+			states = append(states, *cert)
+		}
+		if ocsp != nil {
+			states = append(states, *ocsp)
+		}
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		if certs[i].Host != certs[j].Host {
+			return certs[i].Host < certs[j].Host
+		}
+		return certs[i].Index < certs[j].Index
+	})
+
+	m.mtx.Lock()
+	m.certs = certs
+	m.mtx.Unlock()
+
+	if m.options.Reporter != nil {
+		m.options.Reporter.ReportCerts(states)
+	}
+	return nil
+}
+
+// inspect reads the i-th key pair of the host, the OCSP staple is taken from the stapler cache as it is
+func (m *Monitor) inspect(h *engine.Host, i int) engine.CertExpiry {
+	c := engine.CertExpiry{Host: h.Name, Index: i}
+	cert, err := parseLeaf(h.Settings.AllKeyPairs()[i].Cert)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	c.Subject = cert.Subject.CommonName
+	c.Issuer = cert.Issuer.CommonName
+	c.NotAfter = cert.NotAfter
+
+	// only the staples fetched by the proxy are read, so the monitor neither queries the OCSP responders nor
+	// replaces the staplers of the proxy
+	if st := m.options.Stapler; st != nil && h.Settings.OCSP.Enabled {
+		if re, ok := st.CachedStaple(h, i); ok && re.Response != nil {
+			c.OCSPNextUpdate = re.Response.NextUpdate
+		}
+	}
+	return c
+}
+
+func parseLeaf(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,155 @@
+package certmon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/reporter"
+	"github.com/vulcand/vulcand/stapler"
+	"golang.org/x/crypto/ocsp"
+	. "gopkg.in/check.v1"
+)
+
+func TestCertmon(t *testing.T) { TestingT(t) }
+
+type MonitorSuite struct {
+	now time.Time
+}
+
+var _ = Suite(&MonitorSuite{})
+
+func (s *MonitorSuite) SetUpTest(c *C) {
+	s.now = time.Date(2016, 5, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *MonitorSuite) TestCheck(c *C) {
+	ng := memng.New(registry.GetRegistry())
+
+	good := engine.Host{Name: "example.com"}
+	good.Settings.KeyPair = newKeyPair(c, "example.com", s.now.Add(10*24*time.Hour))
+	c.Assert(ng.UpsertHost(good), IsNil)
+
+	broken := engine.Host{Name: "broken.com"}
+	broken.Settings.KeyPair = &engine.KeyPair{Cert: []byte("garbage"), Key: []byte("garbage")}
+	c.Assert(ng.UpsertHost(broken), IsNil)
+
+	// hosts without certificates are not reported
+	c.Assert(ng.UpsertHost(engine.Host{Name: "plain.com"}), IsNil)
+
+	r := &certReporter{}
+	m := New(ng, Options{Reporter: r, TimeProvider: &timetools.FreezedTime{CurrentTime: s.now}})
+	c.Assert(m.check(), IsNil)
+
+	certs := m.Certs()
+	c.Assert(certs, HasLen, 2)
+	c.Assert(certs[0].Host, Equals, "broken.com")
+	c.Assert(certs[0].Error, Not(Equals), "")
+	c.Assert(certs[1].Host, Equals, "example.com")
+	c.Assert(certs[1].Subject, Equals, "example.com")
+	c.Assert(certs[1].Error, Equals, "")
+	c.Assert(certs[1].DaysLeft(s.now), Equals, float64(10))
+
+	c.Assert(r.states, DeepEquals, []reporter.CertState{
+		{Host: "example.com", Kind: reporter.CertKindCertificate, DaysLeft: 10},
+	})
+}
+
+func (s *MonitorSuite) TestCheckReplacesCerts(c *C) {
+	ng := memng.New(registry.GetRegistry())
+
+	host := engine.Host{Name: "example.com"}
+	host.Settings.KeyPair = newKeyPair(c, "example.com", s.now.Add(24*time.Hour))
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	m := New(ng, Options{TimeProvider: &timetools.FreezedTime{CurrentTime: s.now}})
+	c.Assert(m.check(), IsNil)
+	c.Assert(m.Certs(), HasLen, 1)
+
+	c.Assert(ng.DeleteHost(engine.HostKey{Name: host.Name}), IsNil)
+	c.Assert(m.check(), IsNil)
+	c.Assert(m.Certs(), HasLen, 0)
+}
+
+func (s *MonitorSuite) TestCheckAllKeyPairs(c *C) {
+	ng := memng.New(registry.GetRegistry())
+
+	host := engine.Host{Name: "example.com"}
+	host.Settings.KeyPair = newKeyPair(c, "example.com", s.now.Add(10*24*time.Hour))
+	host.Settings.KeyPairs = []engine.KeyPair{*newKeyPair(c, "ecdsa.example.com", s.now.Add(5*24*time.Hour))}
+	host.Settings.OCSP.Enabled = true
+	c.Assert(ng.UpsertHost(host), IsNil)
+
+	// the staples are read from the cache, the monitor never staples the hosts itself
+	st := &cachedStapler{staples: map[int]*stapler.StapleResponse{
+		1: {Response: &ocsp.Response{NextUpdate: s.now.Add(2 * 24 * time.Hour)}},
+	}}
+	r := &certReporter{}
+	m := New(ng, Options{Reporter: r, Stapler: st, TimeProvider: &timetools.FreezedTime{CurrentTime: s.now}})
+	c.Assert(m.check(), IsNil)
+
+	certs := m.Certs()
+	c.Assert(certs, HasLen, 2)
+	c.Assert(certs[0].Index, Equals, 0)
+	c.Assert(certs[0].Subject, Equals, "example.com")
+	c.Assert(certs[0].OCSPNextUpdate.IsZero(), Equals, true)
+	c.Assert(certs[1].Index, Equals, 1)
+	c.Assert(certs[1].Subject, Equals, "ecdsa.example.com")
+	c.Assert(certs[1].OCSPNextUpdate, Equals, s.now.Add(2*24*time.Hour))
+
+	// the key pair expiring first is reported
+	c.Assert(r.states, DeepEquals, []reporter.CertState{
+		{Host: "example.com", Kind: reporter.CertKindCertificate, DaysLeft: 5},
+		{Host: "example.com", Kind: reporter.CertKindOCSP, DaysLeft: 2},
+	})
+}
+
+// cachedStapler holds the staples of the key pairs, the calls stapling the hosts panic on the nil Stapler
+type cachedStapler struct {
+	stapler.Stapler
+	staples map[int]*stapler.StapleResponse
+}
+
+func (s *cachedStapler) CachedStaple(host *engine.Host, i int) (*stapler.StapleResponse, bool) {
+	re, ok := s.staples[i]
+	return re, ok
+}
+
+type certReporter struct {
+	reporter.Reporter
+	states []reporter.CertState
+}
+
+func (r *certReporter) ReportCerts(states []reporter.CertState) {
+	r.states = states
+}
+
+func newKeyPair(c *C, name string, notAfter time.Time) *engine.KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	return &engine.KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
@@ -1,13 +1,46 @@
+// package conntracker defines the trackers of the client connections accepted by the proxy listeners. The tracker
+// is registered with the plugin registry, see plugin.Registry.SetIncomingConnectionTracker, the proxy falls back
+// to the default tracker counting the connections if none is registered.
 package conntracker
 
 import (
 	"net"
 	"net/http"
+	"time"
 )
 
+// ConnectionTracker is notified about the HTTP state changes of the client connections and returns the counts of
+// the connections by state and local address, the counts are emitted as the proxy metrics. It is called by the
+// servers of all listeners concurrently, so it should be safe for concurrent use.
 type ConnectionTracker interface {
 	RegisterStateChange(conn net.Conn, prev http.ConnState, cur http.ConnState)
 	Counts() ConnectionStats
 }
 
 type ConnectionStats map[http.ConnState]map[string]int64
+
+// ConnectionObserver is an optional interface of the ConnectionTracker observing the whole life of the connections.
+// ConnectionOpened is called once the connection is accepted and ConnectionClosed once it is closed, whatever has
+// closed it: the client, the server on the idle or read timeout, the drain of the deleted listener or the handler
+// of the upgraded connection, e.g. WebSocket, the server does not report the closing of.
+type ConnectionObserver interface {
+	ConnectionOpened(conn net.Conn)
+	ConnectionClosed(conn net.Conn, info ConnectionInfo)
+}
+
+// ConnectionInfo describes the closed connection
+type ConnectionInfo struct {
+	// Opened and Closed are the times the connection was accepted and closed at
+	Opened time.Time
+	Closed time.Time
+	// BytesRead and BytesWritten count the bytes received from and sent to the client, including the TLS records
+	BytesRead    int64
+	BytesWritten int64
+	// Hijacked is true if the connection was taken over from the HTTP server, e.g. upgraded to WebSocket
+	Hijacked bool
+}
+
+// Lifetime returns how long the connection was open
+func (i ConnectionInfo) Lifetime() time.Duration {
+	return i.Closed.Sub(i.Opened)
+}
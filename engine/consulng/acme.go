@@ -0,0 +1,59 @@
+package consulng
+
+import (
+	"time"
+)
+
+// UpsertChallenge writes the challenge held by the session with the ttl, Consul deletes it once the session expires
+func (n *ng) UpsertChallenge(token, keyAuth string, ttl time.Duration) error {
+	return n.setVal(n.path("acme", "challenges", token), []byte(keyAuth), ttl)
+}
+
+func (n *ng) GetChallenge(token string) (string, error) {
+	val, err := n.getVal(n.path("acme", "challenges", token))
+	if err != nil {
+		return "", err
+	}
+	return string(val), nil
+}
+
+func (n *ng) DeleteChallenge(token string) error {
+	return n.deleteKey(n.path("acme", "challenges", token))
+}
+
+// LockOrder acquires the lock key with the new session of the ttl, the session is not renewed, so the lock
+// expires along with it. The session of the lock that is not taken is destroyed.
+func (n *ng) LockOrder(host, owner string, ttl time.Duration) (bool, error) {
+	key := n.path("acme", "orders", host)
+	session, err := n.client.createSession(n.ctx, sessionTTL(ttl))
+	if err != nil {
+		return false, err
+	}
+	err = n.client.put(n.ctx, key, []byte(owner), session, "")
+	if err == nil {
+		return true, nil
+	}
+	if derr := n.client.destroySession(n.ctx, session); derr != nil && err == errKeyLocked {
+		err = derr
+	}
+	if err != errKeyLocked {
+		return false, err
+	}
+	pairs, _, err := n.client.get(n.ctx, key, false, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	return len(pairs) == 1 && string(pairs[0].Value) == owner, nil
+}
+
+// UnlockOrder destroys the session of the lock held by the owner, the lock key is deleted along with it
+func (n *ng) UnlockOrder(host, owner string) error {
+	pairs, _, err := n.client.get(n.ctx, n.path("acme", "orders", host), false, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(pairs) != 1 || string(pairs[0].Value) != owner || pairs[0].Session == "" {
+		return nil
+	}
+	return n.client.destroySession(n.ctx, pairs[0].Session)
+}
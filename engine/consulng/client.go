@@ -0,0 +1,238 @@
+package consulng
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errSessionNotFound is returned by renewSession once the session has been invalidated
+var errSessionNotFound = errors.New("session not found")
+
+// errKeyLocked is returned by put if the key is locked by another session
+var errKeyLocked = errors.New("consul did not update the key, it is locked by another session")
+
+// kvPair is the key of the Consul KV store, the value is base64 encoded by Consul and decoded by encoding/json
+type kvPair struct {
+	Key         string
+	Value       []byte
+	CreateIndex uint64
+	ModifyIndex uint64
+	Session     string `json:",omitempty"`
+}
+
+// client is the minimal client of the Consul HTTP API covering the KV store and the sessions
+type client struct {
+	addr        string
+	token       string
+	datacenter  string
+	consistency string
+	http        *http.Client
+}
+
+func newClient(addr string, o Options) (*client, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid consul address '%v'", addr)
+	}
+	switch o.Consistency {
+	case "", ConsistencyDefault, ConsistencyConsistent, ConsistencyStale:
+	default:
+		return nil, fmt.Errorf("unsupported consistency mode '%v'", o.Consistency)
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if o.CaFile != "" || o.CertFile != "" {
+		config, err := tlsConfig(o)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = config
+	}
+	return &client{
+		addr:        strings.TrimSuffix(u.String(), "/"),
+		token:       o.Token,
+		datacenter:  o.Datacenter,
+		consistency: o.Consistency,
+		http:        &http.Client{Transport: transport},
+	}, nil
+}
+
+func tlsConfig(o Options) (*tls.Config, error) {
+	config := &tls.Config{}
+	if o.CaFile != "" {
+		data, err := ioutil.ReadFile(o.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %v", o.CaFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// get reads the key, or the keys with the prefix if recurse is set. With the non zero index the call is the
+// blocking query returning once the index changes or the wait time passes. Missing keys are not an error.
+func (c *client) get(ctx context.Context, key string, recurse bool, index uint64, wait time.Duration) ([]kvPair, uint64, error) {
+	q := url.Values{}
+	if recurse {
+		q.Set("recurse", "")
+	}
+	if index != 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", fmt.Sprintf("%dms", wait/time.Millisecond))
+	}
+	switch c.consistency {
+	case ConsistencyConsistent:
+		q.Set("consistent", "")
+	case ConsistencyStale:
+		q.Set("stale", "")
+	}
+	var pairs []kvPair
+	re, err := c.do(ctx, "GET", "/v1/kv/"+key, q, nil, &pairs)
+	if err != nil {
+		return nil, 0, err
+	}
+	idx, _ := strconv.ParseUint(re.Header.Get("X-Consul-Index"), 10, 64)
+	return pairs, idx, nil
+}
+
+// put writes the key. The key is locked by the session if acquire is set, it is deleted once the session
+// is invalidated. The lock of the session is released if release is set.
+func (c *client) put(ctx context.Context, key string, value []byte, acquire, release string) error {
+	q := url.Values{}
+	if acquire != "" {
+		q.Set("acquire", acquire)
+	}
+	if release != "" {
+		q.Set("release", release)
+	}
+	var ok bool
+	if _, err := c.do(ctx, "PUT", "/v1/kv/"+key, q, value, &ok); err != nil {
+		return err
+	}
+	if !ok {
+		return errKeyLocked
+	}
+	return nil
+}
+
+func (c *client) delete(ctx context.Context, key string, recurse bool) error {
+	q := url.Values{}
+	if recurse {
+		q.Set("recurse", "")
+	}
+	_, err := c.do(ctx, "DELETE", "/v1/kv/"+key, q, nil, nil)
+	return err
+}
+
+// createSession creates the session deleting the keys it holds once it is invalidated, the session is
+// invalidated if it is not renewed within the ttl
+func (c *client) createSession(ctx context.Context, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"Name":      "vulcand",
+		"TTL":       fmt.Sprintf("%ds", int64(ttl/time.Second)),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	})
+	if err != nil {
+		return "", err
+	}
+	var out struct {
+		ID string
+	}
+	if _, err := c.do(ctx, "PUT", "/v1/session/create", nil, body, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+func (c *client) renewSession(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "PUT", "/v1/session/renew/"+id, nil, nil, nil)
+	if e, ok := err.(*statusError); ok && e.code == http.StatusNotFound {
+		return errSessionNotFound
+	}
+	return err
+}
+
+func (c *client) destroySession(ctx context.Context, id string) error {
+	_, err := c.do(ctx, "PUT", "/v1/session/destroy/"+id, nil, nil, nil)
+	return err
+}
+
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("consul returned %d: %s", e.code, e.message)
+}
+
+// do sends the request and decodes the JSON response into out, the 404 of the KV store is an empty response
+func (c *client) do(ctx context.Context, method, path string, q url.Values, body []byte, out interface{}) (*http.Response, error) {
+	if q == nil {
+		q = url.Values{}
+	}
+	if c.datacenter != "" {
+		q.Set("dc", c.datacenter)
+	}
+	u := c.addr + path
+	if len(q) != 0 {
+		// Consul checks only the presence of the flags like recurse, their empty values are fine
+		u += "?" + q.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	re, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode == http.StatusNotFound && strings.HasPrefix(path, "/v1/kv/") {
+		io.Copy(ioutil.Discard, re.Body)
+		return re, nil
+	}
+	if re.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(io.LimitReader(re.Body, 1024))
+		return nil, &statusError{code: re.StatusCode, message: strings.TrimSpace(string(data))}
+	}
+	if out == nil {
+		io.Copy(ioutil.Discard, re.Body)
+		return re, nil
+	}
+	return re, json.NewDecoder(re.Body).Decode(out)
+}
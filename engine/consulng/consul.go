@@ -0,0 +1,967 @@
+// Package consulng contains the implementation of the Consul-backed engine. Properties are stored in the Consul KV
+// store with the same key layout as in the etcd engines, and the changes are watched with the blocking queries.
+package consulng
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/secret"
+	"github.com/vulcand/vulcand/utils/json"
+)
+
+const (
+	// ConsistencyDefault reads from the leader, which may serve stale data in rare cases
+	ConsistencyDefault = "default"
+	// ConsistencyConsistent makes the leader confirm its leadership before reading
+	ConsistencyConsistent = "consistent"
+	// ConsistencyStale reads from any server
+	ConsistencyStale = "stale"
+)
+
+// watchWait is the time the blocking query of the watch waits for the changes, Consul caps it at 10 minutes
+const watchWait = 5 * time.Minute
+
+// minSessionTTL is the smallest session ttl accepted by Consul, the shorter ttls are rounded up to it
+var minSessionTTL = 10 * time.Second
+
+type ng struct {
+	registry *plugin.Registry
+	key      string
+	client   *client
+	options  Options
+	logsev   log.Level
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mtx sync.Mutex
+	// baseline is the state read by the last snapshot, the watch from the snapshot index diffs against it
+	baseline *watchState
+}
+
+type Options struct {
+	// Token is the ACL token of the requests
+	Token string
+	// Datacenter is the datacenter of the KV store, the datacenter of the agent if empty
+	Datacenter string
+	// Consistency is the consistency mode of the reads, one of ConsistencyDefault, ConsistencyConsistent
+	// or ConsistencyStale
+	Consistency string
+	CaFile      string
+	CertFile    string
+	KeyFile     string
+	Box         *secret.Box
+}
+
+var (
+	frontendRegex   = regexp.MustCompile("^/frontends/([^/]+)/frontend$")
+	backendRegex    = regexp.MustCompile("^/backends/([^/]+)/backend$")
+	hostnameRegex   = regexp.MustCompile("^/hosts/([^/]+)/host$")
+	listenerRegex   = regexp.MustCompile("^/listeners/([^/]+)$")
+	middlewareRegex = regexp.MustCompile("^/frontends/([^/]+)/middlewares/([^/]+)$")
+	serverRegex     = regexp.MustCompile("^/backends/([^/]+)/servers/([^/]+)$")
+)
+
+// New returns the engine storing the configuration under the key of the Consul KV store of the agent
+// at the address, e.g. http://localhost:8500
+func New(addr, key string, registry *plugin.Registry, options Options) (engine.Engine, error) {
+	c, err := newClient(addr, options)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ng{
+		registry: registry,
+		key:      strings.Trim(key, "/"),
+		client:   c,
+		options:  options,
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+func (n *ng) Close() {
+	n.cancel()
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.registry
+}
+
+func (n *ng) GetLogSeverity() log.Level {
+	return n.logsev
+}
+
+func (n *ng) SetLogSeverity(sev log.Level) {
+	n.logsev = sev
+	log.SetLevel(n.logsev)
+}
+
+func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
+	pairs, idx, err := n.client.get(n.ctx, n.key+"/", true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &engine.Snapshot{Index: idx}
+
+	frontends := map[string]int{}
+	backends := map[string]int{}
+	s.FrontendSpecs = []engine.FrontendSpec{}
+	s.BackendSpecs = []engine.BackendSpec{}
+	s.Hosts = []engine.Host{}
+	s.Listeners = []engine.Listener{}
+	// pairs are sorted by key, so the frontends and the backends come before their middlewares and servers
+	for _, p := range pairs {
+		change, err := n.upsertedChange(p)
+		if err != nil {
+			return nil, err
+		}
+		switch c := change.(type) {
+		case *engine.HostUpserted:
+			s.Hosts = append(s.Hosts, c.Host)
+		case *engine.ListenerUpserted:
+			s.Listeners = append(s.Listeners, c.Listener)
+		case *engine.FrontendUpserted:
+			frontends[c.Frontend.Id] = len(s.FrontendSpecs)
+			s.FrontendSpecs = append(s.FrontendSpecs, engine.FrontendSpec{Frontend: c.Frontend, Middlewares: []engine.Middleware{}})
+		case *engine.MiddlewareUpserted:
+			if i, ok := frontends[c.FrontendKey.Id]; ok {
+				s.FrontendSpecs[i].Middlewares = append(s.FrontendSpecs[i].Middlewares, c.Middleware)
+			}
+		case *engine.BackendUpserted:
+			backends[c.Backend.Id] = len(s.BackendSpecs)
+			s.BackendSpecs = append(s.BackendSpecs, engine.BackendSpec{Backend: c.Backend, Servers: []engine.Server{}})
+		case *engine.ServerUpserted:
+			if i, ok := backends[c.BackendKey.Id]; ok {
+				s.BackendSpecs[i].Servers = append(s.BackendSpecs[i].Servers, c.Server)
+			}
+		}
+	}
+
+	n.mtx.Lock()
+	n.baseline = newWatchState(idx, pairs)
+	n.mtx.Unlock()
+	return s, nil
+}
+
+// upsertedChange decodes the key into the upserted event, nil is returned for the keys not used by vulcand
+func (n *ng) upsertedChange(p kvPair) (interface{}, error) {
+	key := strings.TrimPrefix(p.Key, n.key)
+	if out := serverRegex.FindStringSubmatch(key); len(out) == 3 {
+		srv, err := engine.ServerFromJSON(p.Value, out[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: out[1]}, Server: *srv}, nil
+	}
+	if out := backendRegex.FindStringSubmatch(key); len(out) == 2 {
+		b, err := n.backendFromJSON(p.Value, out[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.BackendUpserted{Backend: *b}, nil
+	}
+	if out := middlewareRegex.FindStringSubmatch(key); len(out) == 3 {
+		m, err := n.middlewareFromJSON(p.Value, out[2])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: out[1]}, Middleware: *m}, nil
+	}
+	if out := frontendRegex.FindStringSubmatch(key); len(out) == 2 {
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), p.Value, out[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.FrontendUpserted{Frontend: *f}, nil
+	}
+	if out := hostnameRegex.FindStringSubmatch(key); len(out) == 2 {
+		h, err := n.hostFromJSON(p.Value, out[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.HostUpserted{Host: *h}, nil
+	}
+	if out := listenerRegex.FindStringSubmatch(key); len(out) == 2 {
+		l, err := n.listenerFromJSON(p.Value, out[1])
+		if err != nil {
+			return nil, err
+		}
+		return &engine.ListenerUpserted{Listener: *l}, nil
+	}
+	return nil, nil
+}
+
+// deletedChange returns the deleted event of the key, nil is returned for the keys not used by vulcand
+func (n *ng) deletedChange(k string) interface{} {
+	key := strings.TrimPrefix(k, n.key)
+	if out := serverRegex.FindStringSubmatch(key); len(out) == 3 {
+		return &engine.ServerDeleted{ServerKey: engine.ServerKey{BackendKey: engine.BackendKey{Id: out[1]}, Id: out[2]}}
+	}
+	if out := backendRegex.FindStringSubmatch(key); len(out) == 2 {
+		return &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: out[1]}}
+	}
+	if out := middlewareRegex.FindStringSubmatch(key); len(out) == 3 {
+		return &engine.MiddlewareDeleted{MiddlewareKey: engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: out[1]}, Id: out[2]}}
+	}
+	if out := frontendRegex.FindStringSubmatch(key); len(out) == 2 {
+		return &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: out[1]}}
+	}
+	if out := hostnameRegex.FindStringSubmatch(key); len(out) == 2 {
+		return &engine.HostDeleted{HostKey: engine.HostKey{Name: out[1]}}
+	}
+	if out := listenerRegex.FindStringSubmatch(key); len(out) == 2 {
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: out[1]}}
+	}
+	return nil
+}
+
+// list returns the objects decoded from the keys with the prefix
+func (n *ng) list(prefix string) ([]interface{}, error) {
+	pairs, _, err := n.client.get(n.ctx, prefix, true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	for _, p := range pairs {
+		change, err := n.upsertedChange(p)
+		if err != nil {
+			log.Warningf("Invalid config for %v: %v", p.Key, err)
+			continue
+		}
+		if change != nil {
+			out = append(out, change)
+		}
+	}
+	return out, nil
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	changes, err := n.list(n.path("hosts") + "/")
+	if err != nil {
+		return nil, err
+	}
+	hosts := []engine.Host{}
+	for _, c := range changes {
+		if h, ok := c.(*engine.HostUpserted); ok {
+			hosts = append(hosts, h.Host)
+		}
+	}
+	return hosts, nil
+}
+
+func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
+	bytes, err := n.getVal(n.path("hosts", key.Name, "host"))
+	if err != nil {
+		return nil, err
+	}
+	return n.hostFromJSON(bytes, key.Name)
+}
+
+// hostFromJSON decodes the host opening its sealed key pairs and ACME account key
+func (n *ng) hostFromJSON(bytes []byte, name string) (*engine.Host, error) {
+	var h *host
+	if err := json.Unmarshal(bytes, &h); err != nil {
+		return nil, err
+	}
+	if h == nil {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("empty host %v", name)}
+	}
+	var keyPair *engine.KeyPair
+	if len(h.Settings.KeyPair) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPair, &keyPair); err != nil {
+			return nil, err
+		}
+	}
+	var keyPairs []engine.KeyPair
+	if len(h.Settings.KeyPairs) != 0 {
+		if err := n.openSealedJSONVal(h.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+	acme, err := n.openACME(h.Settings.ACME)
+	if err != nil {
+		return nil, err
+	}
+	return engine.NewHost(name, engine.HostSettings{Default: h.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: h.Settings.OCSP, ACME: acme, TLS: h.Settings.TLS, ClientAuth: h.Settings.ClientAuth, SecurityHeaders: h.Settings.SecurityHeaders})
+}
+
+func (n *ng) UpsertHost(h engine.Host) error {
+	if h.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val := &host{
+		Name: h.Name,
+		Settings: hostSettings{
+			Default:         h.Settings.Default,
+			OCSP:            h.Settings.OCSP,
+			TLS:             h.Settings.TLS,
+			ClientAuth:      h.Settings.ClientAuth,
+			SecurityHeaders: h.Settings.SecurityHeaders,
+		},
+	}
+	if h.Settings.KeyPair != nil {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPair = bytes
+	}
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPairs)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPairs = bytes
+	}
+	acme, err := n.sealACME(h.Settings.ACME)
+	if err != nil {
+		return err
+	}
+	val.Settings.ACME = acme
+	return n.setJSONVal(n.path("hosts", h.Name, "host"), val, noTTL)
+}
+
+// sealACME returns a copy of the ACME settings with the account key sealed
+func (n *ng) sealACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	bytes, err := n.sealJSONVal(a.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *a
+	sealed.AccountKey = bytes
+	return &sealed, nil
+}
+
+// openACME returns a copy of the ACME settings with the account key opened
+func (n *ng) openACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	var key []byte
+	if err := n.openSealedJSONVal(a.AccountKey, &key); err != nil {
+		return nil, err
+	}
+	opened := *a
+	opened.AccountKey = key
+	return &opened, nil
+}
+
+func (n *ng) DeleteHost(key engine.HostKey) error {
+	if key.Name == "" {
+		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	return n.deleteDir(n.path("hosts", key.Name))
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	changes, err := n.list(n.path("listeners") + "/")
+	if err != nil {
+		return nil, err
+	}
+	ls := []engine.Listener{}
+	for _, c := range changes {
+		if l, ok := c.(*engine.ListenerUpserted); ok {
+			ls = append(ls, l.Listener)
+		}
+	}
+	return ls, nil
+}
+
+func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
+	bytes, err := n.getVal(n.path("listeners", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	return n.listenerFromJSON(bytes, key.Id)
+}
+
+func (n *ng) UpsertListener(listener engine.Listener) error {
+	val, err := n.listenerValue(listener)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("listeners", listener.Id), val, noTTL)
+}
+
+// listenerValue returns the listener as it is stored, with the session ticket keys sealed
+func (n *ng) listenerValue(l engine.Listener) (*listener, error) {
+	if l.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	val := &listener{Listener: l}
+	if l.Settings == nil || len(l.Settings.TLS.SessionTicketKeys) == 0 {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.TLS.SessionTicketKeys)
+	if err != nil {
+		return nil, err
+	}
+	settings := *l.Settings
+	settings.TLS.SessionTicketKeys = nil
+	val.Settings = &settings
+	val.SessionTicketKeys = bytes
+	return val, nil
+}
+
+// listenerFromJSON reads the stored listener and opens its session ticket keys
+func (n *ng) listenerFromJSON(bytes []byte, id string) (*engine.Listener, error) {
+	l, err := engine.ListenerFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed listener
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.SessionTicketKeys) == 0 {
+		return l, nil
+	}
+	if l.Settings == nil {
+		return nil, fmt.Errorf("%v: session ticket keys without TLS settings", l)
+	}
+	var keys [][]byte
+	if err := n.openSealedJSONVal(sealed.SessionTicketKeys, &keys); err != nil {
+		return nil, err
+	}
+	l.Settings.TLS.SessionTicketKeys = keys
+	if _, err := engine.NewTLSConfig(&l.Settings.TLS); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (n *ng) DeleteListener(key engine.ListenerKey) error {
+	if key.Id == "" {
+		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	return n.deleteKey(n.path("listeners", key.Id))
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	changes, err := n.list(n.path("frontends") + "/")
+	if err != nil {
+		return nil, err
+	}
+	fs := []engine.Frontend{}
+	for _, c := range changes {
+		if f, ok := c.(*engine.FrontendUpserted); ok {
+			fs = append(fs, f.Frontend)
+		}
+	}
+	return fs, nil
+}
+
+func (n *ng) GetFrontend(key engine.FrontendKey) (*engine.Frontend, error) {
+	bytes, err := n.getVal(n.path("frontends", key.Id, "frontend"))
+	if err != nil {
+		return nil, err
+	}
+	return engine.FrontendFromJSON(n.registry.GetRouter(), bytes, key.Id)
+}
+
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	if f.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
+	}
+	return n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, ttl)
+}
+
+func (n *ng) DeleteFrontend(fk engine.FrontendKey) error {
+	if fk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+	}
+	return n.deleteDir(n.path("frontends", fk.Id))
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	changes, err := n.list(n.path("frontends", fk.Id, "middlewares") + "/")
+	if err != nil {
+		return nil, err
+	}
+	ms := []engine.Middleware{}
+	for _, c := range changes {
+		if m, ok := c.(*engine.MiddlewareUpserted); ok {
+			ms = append(ms, m.Middleware)
+		}
+	}
+	return ms, nil
+}
+
+func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error) {
+	bytes, err := n.getVal(n.path("frontends", key.FrontendKey.Id, "middlewares", key.Id))
+	if err != nil {
+		return nil, err
+	}
+	return n.middlewareFromJSON(bytes, key.Id)
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	if fk.Id == "" || m.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	if _, err := n.GetFrontend(fk); err != nil {
+		return err
+	}
+	key := n.path("frontends", fk.Id, "middlewares", m.Id)
+	// middlewares holding credentials are sealed if the engine has the secret box
+	if spec := n.registry.GetSpec(m.Type); spec != nil && spec.Sealed && n.options.Box != nil {
+		bytes, err := secret.SealMiddlewareToJSON(n.options.Box, m)
+		if err != nil {
+			return err
+		}
+		return n.setVal(key, bytes, ttl)
+	}
+	return n.setJSONVal(key, m, ttl)
+}
+
+// middlewareFromJSON decodes the middleware opening its sealed parameters
+func (n *ng) middlewareFromJSON(bytes []byte, id string) (*engine.Middleware, error) {
+	opened, err := secret.OpenMiddlewareJSON(n.options.Box, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(opened, n.registry.GetSpec, id)
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	if mk.FrontendKey.Id == "" || mk.Id == "" {
+		return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+	}
+	return n.deleteKey(n.path("frontends", mk.FrontendKey.Id, "middlewares", mk.Id))
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	changes, err := n.list(n.path("backends") + "/")
+	if err != nil {
+		return nil, err
+	}
+	bs := []engine.Backend{}
+	for _, c := range changes {
+		if b, ok := c.(*engine.BackendUpserted); ok {
+			bs = append(bs, b.Backend)
+		}
+	}
+	return bs, nil
+}
+
+func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
+	bytes, err := n.getVal(n.path("backends", key.Id, "backend"))
+	if err != nil {
+		return nil, err
+	}
+	return n.backendFromJSON(bytes, key.Id)
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	val, err := n.backendValue(b)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// backendValue returns the backend as it is stored, with the key pair of the client certificate sealed
+func (n *ng) backendValue(b engine.Backend) (*backend, error) {
+	if b.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	val := &backend{Backend: b}
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.ClientKeyPair == nil {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.ClientKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tls := *s.TLS
+	tls.ClientKeyPair = nil
+	s.TLS = &tls
+	val.Settings = s
+	val.ClientKeyPair = bytes
+	return val, nil
+}
+
+// backendFromJSON reads the stored backend and opens the key pair of its client certificate
+func (n *ng) backendFromJSON(bytes []byte, id string) (*engine.Backend, error) {
+	b, err := engine.BackendFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed struct {
+		ClientKeyPair []byte
+	}
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.ClientKeyPair) == 0 {
+		return b, nil
+	}
+	s := b.HTTPSettings()
+	if s.TLS == nil {
+		return nil, fmt.Errorf("%v: client key pair without TLS settings", b)
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.ClientKeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s.TLS.ClientKeyPair = keyPair
+	if _, err := engine.NewTLSConfig(s.TLS); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+	if bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	fs, err := n.backendUsedBy(bk)
+	if err != nil {
+		return err
+	}
+	if len(fs) != 0 {
+		return fmt.Errorf("can not delete backend '%v', it is in use by %s", bk, fs)
+	}
+	return n.deleteDir(n.path("backends", bk.Id))
+}
+
+func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
+	fs, err := n.GetFrontends()
+	if err != nil {
+		return nil, err
+	}
+	usedFs := []engine.Frontend{}
+	for _, f := range fs {
+		if f.UsesBackend(bk) {
+			usedFs = append(usedFs, f)
+		}
+	}
+	return usedFs, nil
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	changes, err := n.list(n.path("backends", bk.Id, "servers") + "/")
+	if err != nil {
+		return nil, err
+	}
+	svs := []engine.Server{}
+	for _, c := range changes {
+		if s, ok := c.(*engine.ServerUpserted); ok {
+			svs = append(svs, s.Server)
+		}
+	}
+	return svs, nil
+}
+
+func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	bytes, err := n.getVal(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+	if err != nil {
+		return nil, err
+	}
+	return engine.ServerFromJSON(bytes, sk.Id)
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	if s.Id == "" || bk.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if _, err := n.GetBackend(bk); err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", bk.Id, "servers", s.Id), s, ttl)
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey) error {
+	if sk.Id == "" || sk.BackendKey.Id == "" {
+		return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	return n.deleteKey(n.path("backends", sk.BackendKey.Id, "servers", sk.Id))
+}
+
+func (n *ng) openSealedJSONVal(bytes []byte, val interface{}) error {
+	if n.options.Box == nil {
+		return errors.New("need secretbox to open sealed data")
+	}
+	sv, err := secret.SealedValueFromJSON(bytes)
+	if err != nil {
+		return err
+	}
+	unsealed, err := n.options.Box.Open(sv)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(unsealed, val)
+}
+
+func (n *ng) sealJSONVal(val interface{}) ([]byte, error) {
+	if n.options.Box == nil {
+		return nil, errors.New("this backend does not support encryption")
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	v, err := n.options.Box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	return secret.SealedValueToJSON(v)
+}
+
+// watchState is the modify index of every key under the engine key at the index of the KV store
+type watchState struct {
+	index uint64
+	keys  map[string]uint64
+}
+
+func newWatchState(index uint64, pairs []kvPair) *watchState {
+	s := &watchState{index: index, keys: make(map[string]uint64, len(pairs))}
+	for _, p := range pairs {
+		s.keys[p.Key] = p.ModifyIndex
+	}
+	return s
+}
+
+// deleteOrder makes the deletes of the nested keys come before the deletes of their parents
+var deleteOrder = map[string]int{
+	"*engine.MiddlewareDeleted": 0,
+	"*engine.FrontendDeleted":   1,
+	"*engine.ServerDeleted":     2,
+	"*engine.BackendDeleted":    3,
+	"*engine.HostDeleted":       4,
+	"*engine.ListenerDeleted":   5,
+}
+
+// Subscribe watches the engine key with the blocking queries and generates the events of the keys changed
+// since the previous query. Consul keeps no history of the changes, so the watch starting from the index of
+// the last snapshot diffs against the snapshot, and the watch from an older index returns *CompactedError
+// if the store has changed since then. Several updates of the key between the queries are seen as one.
+func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
+	ctx, cancel := context.WithCancel(n.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-cancelC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	prev, err := n.watchBaseline(ctx, afterIdx)
+	if err != nil {
+		return err
+	}
+	log.Infof("Begin watching: consul index %d", prev.index)
+	for {
+		pairs, idx, err := n.client.get(ctx, n.key+"/", true, prev.index, watchWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Infof("Stop watching: graceful shutdown")
+				return nil
+			}
+			log.Errorf("Stop watching: error: %v", err)
+			return err
+		}
+		if idx == prev.index {
+			continue
+		}
+		next := newWatchState(idx, pairs)
+		// the index going backwards means the store was restored, the keys are compared as they are
+		if idx < prev.index {
+			log.Warningf("Consul index went backwards from %d to %d", prev.index, idx)
+		}
+		for _, change := range n.diff(prev, next, pairs) {
+			log.Infof("%v", change)
+			select {
+			case changes <- change:
+			case <-cancelC:
+				return nil
+			}
+		}
+		prev = next
+	}
+}
+
+// watchBaseline returns the state the watch from the index diffs against
+func (n *ng) watchBaseline(ctx context.Context, afterIdx uint64) (*watchState, error) {
+	n.mtx.Lock()
+	baseline := n.baseline
+	n.mtx.Unlock()
+	if baseline != nil && baseline.index == afterIdx {
+		return baseline, nil
+	}
+	pairs, idx, err := n.client.get(ctx, n.key+"/", true, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if idx > afterIdx {
+		log.Warningf("Stop watching: consul index %d is ahead of %d and the changes in between are unknown", idx, afterIdx)
+		return nil, &engine.CompactedError{Index: idx}
+	}
+	return newWatchState(idx, pairs), nil
+}
+
+// diff returns the upserts of the changed keys in the order of the changes, followed by the deletes
+func (n *ng) diff(prev, next *watchState, pairs []kvPair) []interface{} {
+	var upserted []kvPair
+	for _, p := range pairs {
+		if idx, ok := prev.keys[p.Key]; !ok || idx != p.ModifyIndex {
+			upserted = append(upserted, p)
+		}
+	}
+	sort.SliceStable(upserted, func(i, j int) bool { return upserted[i].ModifyIndex < upserted[j].ModifyIndex })
+
+	var out []interface{}
+	for _, p := range upserted {
+		change, err := n.upsertedChange(p)
+		if err != nil {
+			log.Warningf("Ignore '%v', error: %s", p.Key, err)
+			continue
+		}
+		if change != nil {
+			out = append(out, change)
+		}
+	}
+
+	var deleted []interface{}
+	for key := range prev.keys {
+		if _, ok := next.keys[key]; ok {
+			continue
+		}
+		if change := n.deletedChange(key); change != nil {
+			deleted = append(deleted, change)
+		}
+	}
+	sort.SliceStable(deleted, func(i, j int) bool {
+		oi, oj := deleteOrder[fmt.Sprintf("%T", deleted[i])], deleteOrder[fmt.Sprintf("%T", deleted[j])]
+		if oi != oj {
+			return oi < oj
+		}
+		return fmt.Sprintf("%v", deleted[i]) < fmt.Sprintf("%v", deleted[j])
+	})
+	return append(out, deleted...)
+}
+
+func (n *ng) path(keys ...string) string {
+	return strings.Join(append([]string{n.key}, keys...), "/")
+}
+
+func (n *ng) setJSONVal(key string, v interface{}, ttl time.Duration) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return n.setVal(key, bytes, ttl)
+}
+
+// setVal writes the key, the key with the ttl is held by the session deleting it once the session expires.
+// The key written before with the ttl is released, so it does not expire with the old session.
+func (n *ng) setVal(key string, val []byte, ttl time.Duration) error {
+	pairs, _, err := n.client.get(n.ctx, key, false, 0, 0)
+	if err != nil {
+		return err
+	}
+	var held string
+	if len(pairs) == 1 {
+		held = pairs[0].Session
+	}
+	if ttl <= 0 {
+		return n.client.put(n.ctx, key, val, "", held)
+	}
+	session, err := n.client.createSession(n.ctx, sessionTTL(ttl))
+	if err != nil {
+		return err
+	}
+	if held != "" {
+		if err := n.client.put(n.ctx, key, val, "", held); err != nil {
+			return err
+		}
+	}
+	return n.client.put(n.ctx, key, val, session, "")
+}
+
+func (n *ng) getVal(key string) ([]byte, error) {
+	pairs, _, err := n.client.get(n.ctx, key, false, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pairs) != 1 {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("key %v not found", key)}
+	}
+	return pairs[0].Value, nil
+}
+
+func (n *ng) deleteKey(key string) error {
+	if _, err := n.getVal(key); err != nil {
+		return err
+	}
+	return n.client.delete(n.ctx, key, false)
+}
+
+// deleteDir deletes the keys under the key, the trailing slash keeps the siblings sharing the prefix
+func (n *ng) deleteDir(key string) error {
+	pairs, _, err := n.client.get(n.ctx, key+"/", true, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(pairs) == 0 {
+		return &engine.NotFoundError{Message: fmt.Sprintf("key %v not found", key)}
+	}
+	return n.client.delete(n.ctx, key+"/", true)
+}
+
+func sessionTTL(ttl time.Duration) time.Duration {
+	if ttl < minSessionTTL {
+		return minSessionTTL
+	}
+	return ttl
+}
+
+const noTTL = 0
+
+type host struct {
+	Name     string
+	Settings hostSettings
+}
+
+// listener is the listener as it is stored, with the session ticket keys sealed
+type listener struct {
+	engine.Listener
+	SessionTicketKeys []byte `json:",omitempty"`
+}
+
+// backend is the backend as it is stored, with the key pair of the client certificate sealed
+type backend struct {
+	engine.Backend
+	ClientKeyPair []byte `json:",omitempty"`
+}
+
+type hostSettings struct {
+	Default         bool
+	KeyPair         []byte
+	KeyPairs        []byte `json:",omitempty"`
+	OCSP            engine.OCSPSettings
+	ACME            *engine.ACMESettings            `json:",omitempty"`
+	TLS             *engine.HostTLSSettings         `json:",omitempty"`
+	ClientAuth      *engine.ClientAuthSettings      `json:",omitempty"`
+	SecurityHeaders *engine.SecurityHeadersSettings `json:",omitempty"`
+}
@@ -0,0 +1,415 @@
+package consulng
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/registry"
+	"github.com/vulcand/vulcand/secret"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestConsul(t *testing.T) { TestingT(t) }
+
+type ConsulSuite struct {
+	ng       *ng
+	suite    test.EngineSuite
+	consul   *fakeConsul
+	srv      *httptest.Server
+	changesC chan interface{}
+	key      string
+	stopC    chan struct{}
+}
+
+var _ = Suite(&ConsulSuite{})
+
+func (s *ConsulSuite) SetUpSuite(c *C) {
+	key, err := secret.NewKeyString()
+	c.Assert(err, IsNil)
+	s.key = key
+	// the fake Consul expires the sessions right after their ttl
+	minSessionTTL = 0
+}
+
+func (s *ConsulSuite) SetUpTest(c *C) {
+	s.consul = newFakeConsul()
+	s.srv = httptest.NewServer(s.consul)
+
+	key, err := secret.KeyFromString(s.key)
+	c.Assert(err, IsNil)
+	box, err := secret.NewBox(key)
+	c.Assert(err, IsNil)
+
+	e, err := New(s.srv.URL, "/vulcandtest", registry.GetRegistry(), Options{Box: box, Consistency: ConsistencyConsistent})
+	c.Assert(err, IsNil)
+	s.ng = e.(*ng)
+
+	snapshot, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+
+	s.changesC = make(chan interface{})
+	s.stopC = make(chan struct{})
+	go s.ng.Subscribe(s.changesC, snapshot.Index, s.stopC)
+
+	s.suite.ChangesC = s.changesC
+	s.suite.Engine = e
+}
+
+func (s *ConsulSuite) TearDownTest(c *C) {
+	close(s.stopC)
+	s.ng.Close()
+	s.srv.Close()
+}
+
+func (s *ConsulSuite) TestEmptyParams(c *C) {
+	s.suite.EmptyParams(c)
+}
+
+func (s *ConsulSuite) TestHostCRUD(c *C) {
+	s.suite.HostCRUD(c)
+}
+
+func (s *ConsulSuite) TestHostWithKeyPair(c *C) {
+	s.suite.HostWithKeyPair(c)
+}
+
+func (s *ConsulSuite) TestHostWithOCSP(c *C) {
+	s.suite.HostWithOCSP(c)
+}
+
+func (s *ConsulSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *ConsulSuite) TestACMEStore(c *C) {
+	s.suite.ACMEStore(c)
+}
+
+func (s *ConsulSuite) TestHostWithTLS(c *C) {
+	s.suite.HostWithTLS(c)
+}
+
+func (s *ConsulSuite) TestHostUpsertKeyPair(c *C) {
+	s.suite.HostUpsertKeyPair(c)
+}
+
+func (s *ConsulSuite) TestListenerCRUD(c *C) {
+	s.suite.ListenerCRUD(c)
+}
+
+func (s *ConsulSuite) TestListenerSettingsCRUD(c *C) {
+	s.suite.ListenerSettingsCRUD(c)
+}
+
+func (s *ConsulSuite) TestBackendCRUD(c *C) {
+	s.suite.BackendCRUD(c)
+}
+
+func (s *ConsulSuite) TestBackendDeleteUsed(c *C) {
+	s.suite.BackendDeleteUsed(c)
+}
+
+func (s *ConsulSuite) TestBackendDeleteUnused(c *C) {
+	s.suite.BackendDeleteUnused(c)
+}
+
+func (s *ConsulSuite) TestServerCRUD(c *C) {
+	s.suite.ServerCRUD(c)
+}
+
+func (s *ConsulSuite) TestServerExpire(c *C) {
+	s.suite.ServerExpire(c)
+}
+
+func (s *ConsulSuite) TestServerRegister(c *C) {
+	s.suite.ServerRegister(c)
+}
+
+func (s *ConsulSuite) TestFrontendCRUD(c *C) {
+	s.suite.FrontendCRUD(c)
+}
+
+func (s *ConsulSuite) TestFrontendExpire(c *C) {
+	s.suite.FrontendExpire(c)
+}
+
+func (s *ConsulSuite) TestFrontendBadBackend(c *C) {
+	s.suite.FrontendBadBackend(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareCRUD(c *C) {
+	s.suite.MiddlewareCRUD(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareExpire(c *C) {
+	s.suite.MiddlewareExpire(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareBadFrontend(c *C) {
+	s.suite.MiddlewareBadFrontend(c)
+}
+
+func (s *ConsulSuite) TestMiddlewareBadType(c *C) {
+	s.suite.MiddlewareBadType(c)
+}
+
+// Deleting the host keeps the hosts sharing its name as the prefix
+func (s *ConsulSuite) TestDeleteKeepsSiblings(c *C) {
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com"}), IsNil)
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "example.com.au"}), IsNil)
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "example.com"}), IsNil)
+
+	hosts, err := s.ng.GetHosts()
+	c.Assert(err, IsNil)
+	c.Assert(len(hosts), Equals, 1)
+	c.Assert(hosts[0].Name, Equals, "example.com.au")
+
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "example.com"}), FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *ConsulSuite) TestBackendClientKeyPairSealed(c *C) {
+	keyPair := test.NewKeyPair(c, "client.internal")
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{TLS: &engine.TLSSettings{ClientKeyPair: keyPair}})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertBackend(*b), IsNil)
+
+	s.consul.mtx.Lock()
+	var stored []byte
+	for k, p := range s.consul.kv {
+		if strings.HasSuffix(k, "backends/b1/backend") {
+			stored = p.Value
+		}
+	}
+	s.consul.mtx.Unlock()
+	c.Assert(stored, NotNil)
+	c.Assert(strings.Contains(string(stored), base64.StdEncoding.EncodeToString(keyPair.Key)), Equals, false)
+
+	out, err := s.ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+}
+
+func (s *ConsulSuite) TestListenerSessionTicketKeysSealed(c *C) {
+	settings := &engine.HTTPSListenerSettings{}
+	c.Assert(settings.TLS.RotateSessionTicketKeys(bytes.Repeat([]byte("k"), engine.SessionTicketKeySize)), IsNil)
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTPS, Address: engine.Address{Network: "tcp", Address: "localhost:443"}, Settings: settings}
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+
+	s.consul.mtx.Lock()
+	var stored []byte
+	for k, p := range s.consul.kv {
+		if strings.HasSuffix(k, "listeners/l1") {
+			stored = p.Value
+		}
+	}
+	s.consul.mtx.Unlock()
+	c.Assert(stored, NotNil)
+	c.Assert(strings.Contains(string(stored), base64.StdEncoding.EncodeToString(settings.TLS.SessionTicketKeys[0])), Equals, false)
+
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &l)
+}
+
+// The changes made after the index of the watch can not be replayed, the watch is compacted
+func (s *ConsulSuite) TestSubscribeCompacted(c *C) {
+	snapshot, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+
+	c.Assert(s.ng.UpsertListener(engine.Listener{Id: "l1", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "localhost:31000"}}), IsNil)
+	<-s.changesC
+
+	c.Assert(s.ng.UpsertListener(engine.Listener{Id: "l2", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "localhost:31001"}}), IsNil)
+	<-s.changesC
+
+	// the baseline of the last snapshot is gone once another snapshot is taken
+	s.ng.mtx.Lock()
+	s.ng.baseline = nil
+	s.ng.mtx.Unlock()
+
+	err = s.ng.Subscribe(make(chan interface{}), snapshot.Index, make(chan struct{}))
+	c.Assert(err, FitsTypeOf, &engine.CompactedError{})
+}
+
+// fakeConsul implements the KV store and the sessions of the Consul HTTP API used by the engine
+type fakeConsul struct {
+	mtx      sync.Mutex
+	index    uint64
+	kv       map[string]*kvPair
+	sessions map[string]*time.Timer
+	ttls     map[string]time.Duration
+	changedC chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		kv:       map[string]*kvPair{},
+		sessions: map[string]*time.Timer{},
+		ttls:     map[string]time.Duration{},
+		changedC: make(chan struct{}),
+	}
+}
+
+// changed bumps the index and wakes up the blocking queries, called with the lock held
+func (f *fakeConsul) changed() uint64 {
+	f.index++
+	close(f.changedC)
+	f.changedC = make(chan struct{})
+	return f.index
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		_, recurse := q["recurse"]
+		switch r.Method {
+		case "GET":
+			f.get(w, r, key, recurse)
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			f.put(w, key, body, q.Get("acquire"), q.Get("release"))
+		case "DELETE":
+			f.delete(w, key, recurse)
+		}
+	case r.URL.Path == "/v1/session/create":
+		var req struct{ TTL string }
+		json.NewDecoder(r.Body).Decode(&req)
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mtx.Lock()
+		id := fmt.Sprintf("session-%d", f.changed())
+		f.sessions[id] = time.AfterFunc(ttl, func() { f.invalidate(id) })
+		f.ttls[id] = ttl
+		f.mtx.Unlock()
+		fmt.Fprintf(w, `{"ID": %q}`, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/renew/")
+		f.mtx.Lock()
+		defer f.mtx.Unlock()
+		t, ok := f.sessions[id]
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		t.Reset(f.ttls[id])
+		fmt.Fprintf(w, `[{"ID": %q}]`, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.invalidate(strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/"))
+		fmt.Fprint(w, "true")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) get(w http.ResponseWriter, r *http.Request, key string, recurse bool) {
+	f.mtx.Lock()
+	if idx, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); err == nil && idx >= f.index {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		changedC := f.changedC
+		f.mtx.Unlock()
+		select {
+		case <-changedC:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+		f.mtx.Lock()
+	}
+	defer f.mtx.Unlock()
+
+	pairs := []kvPair{}
+	for k, p := range f.kv {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, *p)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	if len(pairs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func (f *fakeConsul) put(w http.ResponseWriter, key string, value []byte, acquire, release string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	p, ok := f.kv[key]
+	if !ok {
+		p = &kvPair{Key: key, CreateIndex: f.index + 1}
+	}
+	session := p.Session
+	switch {
+	case acquire != "":
+		if _, ok := f.sessions[acquire]; !ok {
+			http.Error(w, "invalid session", http.StatusInternalServerError)
+			return
+		}
+		if session != "" && session != acquire {
+			fmt.Fprint(w, "false")
+			return
+		}
+		session = acquire
+	case release != "":
+		if session != release {
+			fmt.Fprint(w, "false")
+			return
+		}
+		session = ""
+	}
+	p.Value, p.Session, p.ModifyIndex = value, session, f.changed()
+	f.kv[key] = p
+	fmt.Fprint(w, "true")
+}
+
+func (f *fakeConsul) delete(w http.ResponseWriter, key string, recurse bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for k := range f.kv {
+		if k == key || (recurse && strings.HasPrefix(k, key)) {
+			delete(f.kv, k)
+		}
+	}
+	f.changed()
+	fmt.Fprint(w, "true")
+}
+
+// invalidate destroys the session and deletes the keys held by it
+func (f *fakeConsul) invalidate(id string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	t, ok := f.sessions[id]
+	if !ok {
+		return
+	}
+	t.Stop()
+	delete(f.sessions, id)
+	delete(f.ttls, id)
+	for k, p := range f.kv {
+		if p.Session == id {
+			delete(f.kv, k)
+		}
+	}
+	f.changed()
+}
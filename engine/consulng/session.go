@@ -0,0 +1,109 @@
+package consulng
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/utils/json"
+)
+
+// RegisterServer writes the server held by the session with the ttl and renews the session until the registration
+// is closed. Once the session is invalidated, Consul deletes the server key and the watchers get the server deleted.
+func (n *ng) RegisterServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) (engine.Registration, error) {
+	if s.Id == "" || bk.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if ttl < time.Second {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("session ttl should be at least 1s, got %v", ttl)}
+	}
+	if _, err := n.GetBackend(bk); err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(n.ctx)
+	r := &registration{
+		n:      n,
+		key:    n.path("backends", bk.Id, "servers", s.Id),
+		value:  bytes,
+		ttl:    sessionTTL(ttl),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	if err := r.register(); err != nil {
+		cancel()
+		return nil, err
+	}
+	go r.keepAlive()
+	return r, nil
+}
+
+type registration struct {
+	n      *ng
+	key    string
+	value  []byte
+	ttl    time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mtx     sync.Mutex
+	session string
+}
+
+// register creates the new session and writes the server held by it
+func (r *registration) register() error {
+	session, err := r.n.client.createSession(r.ctx, r.ttl)
+	if err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	r.session = session
+	r.mtx.Unlock()
+	return r.n.client.put(r.ctx, r.key, r.value, session, "")
+}
+
+// keepAlive renews the session three times per ttl, so a single failed renewal does not expire it. The server is
+// registered again under the new session once the session has been invalidated, e.g. during the longer outage.
+func (r *registration) keepAlive() {
+	defer close(r.done)
+	for {
+		select {
+		case <-time.After(r.ttl / 3):
+		case <-r.ctx.Done():
+			return
+		}
+		r.mtx.Lock()
+		session := r.session
+		r.mtx.Unlock()
+		err := r.n.client.renewSession(r.ctx, session)
+		if err == nil || r.ctx.Err() != nil {
+			continue
+		}
+		if err != errSessionNotFound {
+			log.Warningf("Failed to renew session of %v: %v", r.key, err)
+			continue
+		}
+		log.Warningf("Lost session of %v, registering again", r.key)
+		if err := r.register(); err != nil {
+			log.Errorf("Failed to register %v: %v", r.key, err)
+		}
+	}
+}
+
+// Close stops the renewals and destroys the session, so the server is deleted right away
+func (r *registration) Close() error {
+	r.cancel()
+	<-r.done
+	r.mtx.Lock()
+	session := r.session
+	r.mtx.Unlock()
+	return r.n.client.destroySession(r.n.ctx, session)
+}
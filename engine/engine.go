@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -9,10 +11,16 @@ import (
 
 type NewEngineFn func() (Engine, error)
 
-// Engine is an interface for storage and configuration engine, e.g. Etcd.
+// Engine is an interface for storage and configuration engine, e.g. Etcd or Consul.
 // Simple in memory implementation is available at engine/memng package
 // Engines should pass the following acceptance suite to be compatible:
-// engine/test/suite.go, see engine/etcdng/etcd_test.go and engine/memng/mem_test.go for details
+// engine/test/suite.go, see engine/etcdv3ng/etcd_test.go and engine/consulng/consul_test.go for details
+//
+// All methods of Engine are required. Subscribe should deliver every change made after the index of the snapshot,
+// or return *CompactedError if it can not, so the supervisor reloads the snapshot. The TTLs of the upserts are
+// required as well. Batcher, Namespaced, Registrar and Pager are optional, without them the API rejects the batches
+// and the imports, the servers can be kept registered only with the TTL upserts and the API reads the whole
+// listings to serve their pages. Without TTLGetter the exported configuration upserts everything with no TTL.
 type Engine interface {
 	// GetSnapshot returns a complete configuration snapshot.
 	GetSnapshot() (*Snapshot, error)
@@ -84,6 +92,7 @@ type Engine interface {
 	// It should be a blocking function generating events from change.go to the changes channel.
 	// Each change should be an instance of the struct provided in events.go
 	// In  case if cancel channel is closed, the subscribe events should no longer be generated.
+	// Returns *CompactedError if the changes after afterIdx are no longer available.
 	Subscribe(events chan interface{}, afterIdx uint64, cancel chan struct{}) error
 
 	// GetRegistry returns registry with the supported plugins. It should be stored by Engine instance.
@@ -97,3 +106,248 @@ type Engine interface {
 	// Close should close all underlying resources such as connections, files, etc.
 	Close()
 }
+
+// BatchOp is a single operation of the configuration batch. Change is one of the upsert or delete
+// events from events.go, e.g. *FrontendUpserted or *ServerDeleted. TTL applies to the upserted frontends,
+// middlewares and servers.
+type BatchOp struct {
+	Change interface{}
+	TTL    time.Duration
+}
+
+// Batcher is implemented by the engines able to apply several changes atomically
+type Batcher interface {
+	// ApplyBatch applies the operations in order, the batch is validated as a whole against the resulting
+	// state and either all operations are applied or none of them. Returns *BatchError with the index of
+	// the offending operation if the batch is invalid.
+	ApplyBatch([]BatchOp) error
+}
+
+// ListenerSwapper is implemented by the engines able to update the listener only if it has not changed since it was
+// read, so the concurrent read-modify-write updates of the listener, e.g. the session ticket key rotations, do not
+// overwrite each other
+type ListenerSwapper interface {
+	// SwapListener stores the listener if the stored listener is equal to old, returns *ConflictError if the
+	// listener has been changed and *NotFoundError if it has been deleted
+	SwapListener(old, l Listener) error
+}
+
+// TTLs are the times left to the frontends, middlewares and servers upserted with the TTL
+type TTLs struct {
+	Frontends   map[FrontendKey]time.Duration
+	Middlewares map[MiddlewareKey]time.Duration
+	Servers     map[ServerKey]time.Duration
+}
+
+// NewTTLs returns the empty TTLs
+func NewTTLs() *TTLs {
+	return &TTLs{
+		Frontends:   map[FrontendKey]time.Duration{},
+		Middlewares: map[MiddlewareKey]time.Duration{},
+		Servers:     map[ServerKey]time.Duration{},
+	}
+}
+
+// TTLGetter is implemented by the engines expiring the keys upserted with the TTL, so the exported configuration
+// carries the times left and the imported objects expire instead of becoming permanent
+type TTLGetter interface {
+	// GetTTLs returns the times left to the objects expiring, the permanent ones are not listed
+	GetTTLs() (*TTLs, error)
+}
+
+// Page selects a page of the listing
+type Page struct {
+	// Prefix lists the items with the ids starting with the prefix only
+	Prefix string
+	// After is where the previous page has ended, it is set on the next page returned by the lister and is opaque
+	// to the callers. The listing starts from the first item if empty.
+	After string
+	// Limit is the maximum amount of items on the page, the rest of the items is listed if 0
+	Limit int
+	// Revision is the revision of the configuration the pages are read at, it is set by the engine on the page
+	// following the first one
+	Revision int64
+}
+
+// Pager is implemented by the engines reading the pages of the listings with ranged reads, so the whole listing
+// is not read for every page. The pages following the first one are read at the revision of the first page, so
+// all pages list the same snapshot of the configuration whatever is changed in between. Returns *CompactedError
+// if the revision of the page is no longer available, the listing should start over then.
+type Pager interface {
+	// GetFrontendsPage returns the frontends on the page and the next page, nil if the page is the last one
+	GetFrontendsPage(Page) ([]Frontend, *Page, error)
+	// GetServersPage returns the servers of the backend on the page and the next page, nil if the page is the last one.
+	// NotFoundError is returned if the backend does not exist.
+	GetServersPage(BackendKey, Page) ([]Server, *Page, error)
+}
+
+// NamespaceSeparator separates the namespace from the id in the namespaced ids
+const NamespaceSeparator = "."
+
+// Namespaced is implemented by the engines merging the configurations of several namespaces. Ids of the
+// listeners, frontends and backends are prefixed with their namespace, see NamespacedId, so the same ids
+// in different namespaces do not collide. Host names are shared by all namespaces.
+type Namespaced interface {
+	// Namespace returns the engine reading and writing the configuration of the namespace with its own ids. The
+	// engine rejects the hosts defined in the other namespaces with AlreadyExistsError.
+	Namespace(name string) (Engine, error)
+}
+
+// NamespacedId returns the id of the object in the namespace
+func NamespacedId(namespace, id string) string {
+	return namespace + NamespaceSeparator + id
+}
+
+// SplitNamespacedId returns the namespace and the id of the object in the namespace
+func SplitNamespacedId(id string) (string, string, error) {
+	parts := strings.SplitN(id, NamespaceSeparator, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", &InvalidFormatError{Message: fmt.Sprintf("expected id in namespace%vid format, got '%v'", NamespaceSeparator, id)}
+	}
+	return parts[0], parts[1], nil
+}
+
+// Registrar is implemented by the engines able to keep the servers registered while the registering process is alive
+type Registrar interface {
+	// RegisterServer upserts the server that expires once no keepalive was sent for the ttl. Keepalives are sent
+	// until the registration is closed. BackendKey.Id and Server.Id should not be empty.
+	RegisterServer(bk BackendKey, s Server, ttl time.Duration) (Registration, error)
+}
+
+// Registration is the server registered by the Registrar
+type Registration interface {
+	// Close stops the keepalives and deletes the server
+	Close() error
+}
+
+// ACMEStore is implemented by the engines sharing the ACME state of the proxy instances: the key authorizations of
+// the pending HTTP-01 challenges, so any instance the certificate authority reaches answers the challenge, and the
+// order locks, so one instance at a time orders the certificate of the host. Without it every instance orders the
+// certificates on its own and answers its own challenges only, which works for a single instance.
+type ACMEStore interface {
+	// UpsertChallenge stores the key authorization of the challenge token, the challenge expires after the ttl
+	UpsertChallenge(token, keyAuth string, ttl time.Duration) error
+	// GetChallenge returns the key authorization of the token or engine.NotFoundError if it is not pending
+	GetChallenge(token string) (string, error)
+	// DeleteChallenge deletes the challenge, returns engine.NotFoundError if it is not pending
+	DeleteChallenge(token string) error
+	// LockOrder takes the order lock of the host for the owner, returns false if another owner holds it.
+	// The lock expires after the ttl, so the lock of the crashed owner is taken over.
+	LockOrder(host, owner string, ttl time.Duration) (bool, error)
+	// UnlockOrder releases the order lock of the host if the owner holds it
+	UnlockOrder(host, owner string) error
+}
+
+// ApplyChange applies the batch operation to the engine with the regular upsert and delete calls
+func ApplyChange(ng Engine, op BatchOp) error {
+	switch c := op.Change.(type) {
+	case *HostUpserted:
+		return ng.UpsertHost(c.Host)
+	case *HostDeleted:
+		return ng.DeleteHost(c.HostKey)
+	case *ListenerUpserted:
+		return ng.UpsertListener(c.Listener)
+	case *ListenerDeleted:
+		return ng.DeleteListener(c.ListenerKey)
+	case *FrontendUpserted:
+		return ng.UpsertFrontend(c.Frontend, op.TTL)
+	case *FrontendDeleted:
+		return ng.DeleteFrontend(c.FrontendKey)
+	case *MiddlewareUpserted:
+		return ng.UpsertMiddleware(c.FrontendKey, c.Middleware, op.TTL)
+	case *MiddlewareDeleted:
+		return ng.DeleteMiddleware(c.MiddlewareKey)
+	case *BackendUpserted:
+		return ng.UpsertBackend(c.Backend)
+	case *BackendDeleted:
+		return ng.DeleteBackend(c.BackendKey)
+	case *ServerUpserted:
+		return ng.UpsertServer(c.BackendKey, c.Server, op.TTL)
+	case *ServerDeleted:
+		return ng.DeleteServer(c.ServerKey)
+	}
+	return &InvalidFormatError{Message: fmt.Sprintf("unsupported batch operation %T", op.Change)}
+}
+
+// SnapshotOps returns the batch turning the current configuration into the next one. All objects of the next
+// configuration are upserted, the objects missing from it are deleted only if replace is set.
+func SnapshotOps(current, next *Snapshot, replace bool) []BatchOp {
+	var ops []BatchOp
+	add := func(change interface{}) {
+		ops = append(ops, BatchOp{Change: change})
+	}
+
+	hosts := map[string]bool{}
+	for _, h := range next.Hosts {
+		hosts[h.Name] = true
+		add(&HostUpserted{Host: h})
+	}
+	listeners := map[string]bool{}
+	for _, l := range next.Listeners {
+		listeners[l.Id] = true
+		add(&ListenerUpserted{Listener: l})
+	}
+	servers := map[BackendKey]map[string]bool{}
+	for _, bs := range next.BackendSpecs {
+		bk := BackendKey{Id: bs.Backend.Id}
+		servers[bk] = map[string]bool{}
+		add(&BackendUpserted{Backend: bs.Backend})
+		for _, srv := range bs.Servers {
+			servers[bk][srv.Id] = true
+			add(&ServerUpserted{BackendKey: bk, Server: srv})
+		}
+	}
+	middlewares := map[FrontendKey]map[string]bool{}
+	for _, fs := range next.FrontendSpecs {
+		fk := FrontendKey{Id: fs.Frontend.Id}
+		middlewares[fk] = map[string]bool{}
+		add(&FrontendUpserted{Frontend: fs.Frontend})
+		for _, m := range fs.Middlewares {
+			middlewares[fk][m.Id] = true
+			add(&MiddlewareUpserted{FrontendKey: fk, Middleware: m})
+		}
+	}
+	if !replace || current == nil {
+		return ops
+	}
+
+	// frontends go before the backends they use, the middlewares and servers are deleted along
+	// with their frontends and backends
+	for _, fs := range current.FrontendSpecs {
+		fk := FrontendKey{Id: fs.Frontend.Id}
+		kept, ok := middlewares[fk]
+		if !ok {
+			add(&FrontendDeleted{FrontendKey: fk})
+			continue
+		}
+		for _, m := range fs.Middlewares {
+			if !kept[m.Id] {
+				add(&MiddlewareDeleted{MiddlewareKey: MiddlewareKey{FrontendKey: fk, Id: m.Id}})
+			}
+		}
+	}
+	for _, bs := range current.BackendSpecs {
+		bk := BackendKey{Id: bs.Backend.Id}
+		kept, ok := servers[bk]
+		if !ok {
+			add(&BackendDeleted{BackendKey: bk})
+			continue
+		}
+		for _, srv := range bs.Servers {
+			if !kept[srv.Id] {
+				add(&ServerDeleted{ServerKey: ServerKey{BackendKey: bk, Id: srv.Id}})
+			}
+		}
+	}
+	for _, l := range current.Listeners {
+		if !listeners[l.Id] {
+			add(&ListenerDeleted{ListenerKey: ListenerKey{Id: l.Id}})
+		}
+	}
+	for _, h := range current.Hosts {
+		if !hosts[h.Name] {
+			add(&HostDeleted{HostKey: HostKey{Name: h.Name}})
+		}
+	}
+	return ops
+}
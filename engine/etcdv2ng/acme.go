@@ -0,0 +1,51 @@
+package etcdv2ng
+
+import (
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// UpsertChallenge writes the challenge key with the ttl, etcd deletes it once it expires
+func (n *ng) UpsertChallenge(token, keyAuth string, ttl time.Duration) error {
+	return n.setVal(n.path("acme", "challenges", token), []byte(keyAuth), ttl)
+}
+
+func (n *ng) GetChallenge(token string) (string, error) {
+	return n.getVal(n.path("acme", "challenges", token))
+}
+
+func (n *ng) DeleteChallenge(token string) error {
+	_, err := n.kapi.Delete(n.context, n.path("acme", "challenges", token), nil)
+	return convertErr(err)
+}
+
+// LockOrder creates the lock key with the ttl unless the key exists
+func (n *ng) LockOrder(host, owner string, ttl time.Duration) (bool, error) {
+	key := n.path("acme", "orders", host)
+	_, err := n.kapi.Set(n.context, key, owner, &etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: ttl})
+	if err == nil {
+		return true, nil
+	}
+	if e, ok := err.(etcd.Error); !ok || e.Code != etcd.ErrorCodeNodeExist {
+		return false, convertErr(err)
+	}
+	held, err := n.getVal(key)
+	if err != nil {
+		if _, ok := err.(*engine.NotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return held == owner, nil
+}
+
+// UnlockOrder deletes the lock key unless it has been taken over by another owner
+func (n *ng) UnlockOrder(host, owner string) error {
+	_, err := n.kapi.Delete(n.context, n.path("acme", "orders", host), &etcd.DeleteOptions{PrevValue: owner})
+	if e, ok := err.(etcd.Error); ok && (e.Code == etcd.ErrorCodeKeyNotFound || e.Code == etcd.ErrorCodeTestFailed) {
+		return nil
+	}
+	return convertErr(err)
+}
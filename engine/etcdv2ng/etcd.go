@@ -122,7 +122,7 @@ func (n *ng) parseFrontends(node *etcd.Node, skipMiddlewares ...bool) ([]engine.
 				middlewares := make([]engine.Middleware, len(node.Nodes))
 				for idx, node := range node.Nodes {
 					middlewareId := suffix(node.Key)
-					middleware, err := engine.MiddlewareFromJSON([]byte(node.Value), n.registry.GetSpec, middlewareId)
+					middleware, err := n.middlewareFromJSON([]byte(node.Value), middlewareId)
 					if err != nil {
 						return nil, err
 					}
@@ -145,7 +145,7 @@ func (n *ng) parseBackends(node *etcd.Node, skipServers ...bool) ([]engine.Backe
 		for _, node := range node.Nodes {
 			switch suffix(node.Key) {
 			case "backend":
-				backend, err := engine.BackendFromJSON([]byte(node.Value), backendId)
+				backend, err := n.backendFromJSON([]byte(node.Value), backendId)
 				if err != nil {
 					return nil, err
 				}
@@ -190,7 +190,17 @@ func (n *ng) parseHosts(node *etcd.Node) ([]engine.Host, error) {
 						return nil, err
 					}
 				}
-				host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, OCSP: sealedHost.Settings.OCSP})
+				var keyPairs []engine.KeyPair
+				if len(sealedHost.Settings.KeyPairs) != 0 {
+					if err := n.openSealedJSONVal(sealedHost.Settings.KeyPairs, &keyPairs); err != nil {
+						return nil, err
+					}
+				}
+				acme, err := n.openACME(sealedHost.Settings.ACME)
+				if err != nil {
+					return nil, err
+				}
+				host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: sealedHost.Settings.OCSP, ACME: acme, TLS: sealedHost.Settings.TLS, ClientAuth: sealedHost.Settings.ClientAuth, SecurityHeaders: sealedHost.Settings.SecurityHeaders})
 				if err != nil {
 					return nil, err
 				}
@@ -208,7 +218,7 @@ func (n *ng) parseListeners(node *etcd.Node) ([]engine.Listener, error) {
 	listeners := make([]engine.Listener, len(node.Nodes))
 	for idx, node := range node.Nodes {
 		listenerId := suffix(node.Key)
-		listener, err := engine.ListenerFromJSON([]byte(node.Value), listenerId)
+		listener, err := n.listenerFromJSON([]byte(node.Value), listenerId)
 		if err != nil {
 			return nil, err
 		}
@@ -335,7 +345,18 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 		}
 	}
 
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+	var keyPairs []engine.KeyPair
+	if len(host.Settings.KeyPairs) != 0 {
+		if err := n.openSealedJSONVal(host.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+	acme, err := n.openACME(host.Settings.ACME)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: host.Settings.OCSP, ACME: acme, TLS: host.Settings.TLS, ClientAuth: host.Settings.ClientAuth, SecurityHeaders: host.Settings.SecurityHeaders})
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
@@ -347,8 +368,11 @@ func (n *ng) UpsertHost(h engine.Host) error {
 	val := host{
 		Name: h.Name,
 		Settings: hostSettings{
-			Default: h.Settings.Default,
-			OCSP:    h.Settings.OCSP,
+			Default:         h.Settings.Default,
+			OCSP:            h.Settings.OCSP,
+			TLS:             h.Settings.TLS,
+			ClientAuth:      h.Settings.ClientAuth,
+			SecurityHeaders: h.Settings.SecurityHeaders,
 		},
 	}
 
@@ -360,9 +384,51 @@ func (n *ng) UpsertHost(h engine.Host) error {
 		val.Settings.KeyPair = bytes
 	}
 
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPairs)
+		if err != nil {
+			return err
+		}
+		val.Settings.KeyPairs = bytes
+	}
+
+	acme, err := n.sealACME(h.Settings.ACME)
+	if err != nil {
+		return err
+	}
+	val.Settings.ACME = acme
+
 	return n.setJSONVal(hostKey, val, noTTL)
 }
 
+// sealACME returns a copy of the ACME settings with the account key sealed
+func (n *ng) sealACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	bytes, err := n.sealJSONVal(a.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *a
+	sealed.AccountKey = bytes
+	return &sealed, nil
+}
+
+// openACME returns a copy of the ACME settings with the account key opened
+func (n *ng) openACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	var key []byte
+	if err := n.openSealedJSONVal(a.AccountKey, &key); err != nil {
+		return nil, err
+	}
+	opened := *a
+	opened.AccountKey = key
+	return &opened, nil
+}
+
 func (n *ng) DeleteHost(key engine.HostKey) error {
 	if key.Name == "" {
 		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
@@ -392,18 +458,62 @@ func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l, err := engine.ListenerFromJSON([]byte(bytes), key.Id)
+	return n.listenerFromJSON([]byte(bytes), key.Id)
+}
+
+func (n *ng) UpsertListener(listener engine.Listener) error {
+	val, err := n.listenerValue(listener)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("listeners", listener.Id), val, noTTL)
+}
+
+// listenerValue returns the listener as it is stored, with the session ticket keys sealed
+func (n *ng) listenerValue(l engine.Listener) (*listener, error) {
+	if l.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	val := &listener{Listener: l}
+	if l.Settings == nil || len(l.Settings.TLS.SessionTicketKeys) == 0 {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.TLS.SessionTicketKeys)
 	if err != nil {
 		return nil, err
 	}
-	return l, nil
+	settings := *l.Settings
+	settings.TLS.SessionTicketKeys = nil
+	val.Settings = &settings
+	val.SessionTicketKeys = bytes
+	return val, nil
 }
 
-func (n *ng) UpsertListener(listener engine.Listener) error {
-	if listener.Id == "" {
-		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+// listenerFromJSON reads the stored listener and opens its session ticket keys
+func (n *ng) listenerFromJSON(bytes []byte, id string) (*engine.Listener, error) {
+	l, err := engine.ListenerFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed listener
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.SessionTicketKeys) == 0 {
+		return l, nil
+	}
+	if l.Settings == nil {
+		return nil, fmt.Errorf("%v: session ticket keys without TLS settings", l)
+	}
+	var keys [][]byte
+	if err := n.openSealedJSONVal(sealed.SessionTicketKeys, &keys); err != nil {
+		return nil, err
+	}
+	l.Settings.TLS.SessionTicketKeys = keys
+	if _, err := engine.NewTLSConfig(&l.Settings.TLS); err != nil {
+		return nil, err
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	return l, nil
 }
 
 func (n *ng) DeleteListener(key engine.ListenerKey) error {
@@ -417,8 +527,10 @@ func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
 	}
 	if err := n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, noTTL); err != nil {
 		return err
@@ -493,14 +605,67 @@ func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	return n.backendFromJSON([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
+	val, err := n.backendValue(b)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// backendValue returns the backend as it is stored, with the key pair of the client certificate sealed
+func (n *ng) backendValue(b engine.Backend) (*backend, error) {
 	if b.Id == "" {
-		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+		return nil, &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	val := &backend{Backend: b}
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.ClientKeyPair == nil {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.ClientKeyPair)
+	if err != nil {
+		return nil, err
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	tls := *s.TLS
+	tls.ClientKeyPair = nil
+	s.TLS = &tls
+	val.Settings = s
+	val.ClientKeyPair = bytes
+	return val, nil
+}
+
+// backendFromJSON reads the stored backend and opens the key pair of its client certificate
+func (n *ng) backendFromJSON(bytes []byte, id string) (*engine.Backend, error) {
+	b, err := engine.BackendFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed struct {
+		ClientKeyPair []byte
+	}
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.ClientKeyPair) == 0 {
+		return b, nil
+	}
+	s := b.HTTPSettings()
+	if s.TLS == nil {
+		return nil, fmt.Errorf("%v: client key pair without TLS settings", b)
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.ClientKeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s.TLS.ClientKeyPair = keyPair
+	if _, err := engine.NewTLSConfig(s.TLS); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 func (n *ng) DeleteBackend(bk engine.BackendKey) error {
@@ -541,7 +706,7 @@ func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error)
 	if err != nil {
 		return nil, err
 	}
-	return engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
+	return n.middlewareFromJSON([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
@@ -551,7 +716,25 @@ func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl ti
 	if _, err := n.GetFrontend(fk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
+	key := n.path("frontends", fk.Id, "middlewares", m.Id)
+	// middlewares holding credentials are sealed if the engine has the secret box
+	if spec := n.registry.GetSpec(m.Type); spec != nil && spec.Sealed && n.options.Box != nil {
+		bytes, err := secret.SealMiddlewareToJSON(n.options.Box, m)
+		if err != nil {
+			return err
+		}
+		return n.setVal(key, bytes, ttl)
+	}
+	return n.setJSONVal(key, m, ttl)
+}
+
+// middlewareFromJSON decodes the middleware opening its sealed parameters
+func (n *ng) middlewareFromJSON(bytes []byte, id string) (*engine.Middleware, error) {
+	opened, err := secret.OpenMiddlewareJSON(n.options.Box, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(opened, n.registry.GetSpec, id)
 }
 
 func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
@@ -640,7 +823,7 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			usedFs = append(usedFs, f)
 		}
 	}
@@ -1003,8 +1186,25 @@ type host struct {
 	Settings hostSettings
 }
 
+// listener is the listener as it is stored, with the session ticket keys sealed
+type listener struct {
+	engine.Listener
+	SessionTicketKeys []byte `json:",omitempty"`
+}
+
+// backend is the backend as it is stored, with the key pair of the client certificate sealed
+type backend struct {
+	engine.Backend
+	ClientKeyPair []byte `json:",omitempty"`
+}
+
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default         bool
+	KeyPair         []byte
+	KeyPairs        []byte `json:",omitempty"`
+	OCSP            engine.OCSPSettings
+	ACME            *engine.ACMESettings            `json:",omitempty"`
+	TLS             *engine.HostTLSSettings         `json:",omitempty"`
+	ClientAuth      *engine.ClientAuthSettings      `json:",omitempty"`
+	SecurityHeaders *engine.SecurityHeadersSettings `json:",omitempty"`
 }
@@ -1,11 +1,14 @@
 package etcdv2ng
 
 import (
+	"bytes"
+	"encoding/base64"
 	"os"
 	"strings"
 	"testing"
 
 	etcd "github.com/coreos/etcd/client"
+	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/test"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/secret"
@@ -120,6 +123,49 @@ func (s *EtcdSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *EtcdSuite) TestBackendClientKeyPairSealed(c *C) {
+	keyPair := test.NewKeyPair(c, "client.internal")
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{TLS: &engine.TLSSettings{ClientKeyPair: keyPair}})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertBackend(*b), IsNil)
+
+	re, err := s.kapi.Get(s.context, s.ng.path("backends", b.Id, "backend"), nil)
+	c.Assert(err, IsNil)
+	stored := re.Node.Value
+	c.Assert(strings.Contains(string(stored), base64.StdEncoding.EncodeToString(keyPair.Key)), Equals, false)
+
+	out, err := s.ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+}
+
+func (s *EtcdSuite) TestListenerSessionTicketKeysSealed(c *C) {
+	settings := &engine.HTTPSListenerSettings{}
+	c.Assert(settings.TLS.RotateSessionTicketKeys(bytes.Repeat([]byte("k"), engine.SessionTicketKeySize)), IsNil)
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTPS, Address: engine.Address{Network: "tcp", Address: "localhost:443"}, Settings: settings}
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+
+	re, err := s.kapi.Get(s.context, s.ng.path("listeners", l.Id), nil)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(re.Node.Value, base64.StdEncoding.EncodeToString(settings.TLS.SessionTicketKeys[0])), Equals, false)
+
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &l)
+}
+
+func (s *EtcdSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *EtcdSuite) TestACMEStore(c *C) {
+	s.suite.ACMEStore(c)
+}
+
+func (s *EtcdSuite) TestHostWithTLS(c *C) {
+	s.suite.HostWithTLS(c)
+}
+
 func (s *EtcdSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
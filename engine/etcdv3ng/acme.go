@@ -0,0 +1,73 @@
+package etcdv3ng
+
+import (
+	"fmt"
+	"time"
+
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// UpsertChallenge writes the challenge under the lease with the ttl, etcd deletes it once the lease expires
+func (n *ng) UpsertChallenge(token, keyAuth string, ttl time.Duration) error {
+	return n.setVal(n.path("acme", "challenges", token), []byte(keyAuth), leaseTTL(ttl))
+}
+
+func (n *ng) GetChallenge(token string) (string, error) {
+	return n.getVal(n.path("acme", "challenges", token))
+}
+
+func (n *ng) DeleteChallenge(token string) error {
+	re, err := n.client.Delete(n.context, n.path("acme", "challenges", token))
+	if err != nil {
+		return convertErr(err)
+	}
+	if re.Deleted == 0 {
+		return &engine.NotFoundError{Message: fmt.Sprintf("challenge %v not found", token)}
+	}
+	return nil
+}
+
+// LockOrder creates the lock key under the lease with the ttl unless the key exists, the lease of the lock
+// that is not taken is revoked
+func (n *ng) LockOrder(host, owner string, ttl time.Duration) (bool, error) {
+	key := n.path("acme", "orders", host)
+	lgr, err := n.client.Grant(n.context, int64(leaseTTL(ttl)/time.Second))
+	if err != nil {
+		return false, convertErr(err)
+	}
+	re, err := n.client.Txn(n.context).
+		If(etcd.Compare(etcd.CreateRevision(key), "=", 0)).
+		Then(etcd.OpPut(key, owner, etcd.WithLease(lgr.ID))).
+		Else(etcd.OpGet(key)).
+		Commit()
+	if err == nil && re.Succeeded {
+		return true, nil
+	}
+	if _, rerr := n.client.Revoke(n.context, lgr.ID); rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return false, convertErr(err)
+	}
+	kvs := re.Responses[0].GetResponseRange().Kvs
+	return len(kvs) == 1 && string(kvs[0].Value) == owner, nil
+}
+
+// UnlockOrder deletes the lock key unless it has been taken over by another owner
+func (n *ng) UnlockOrder(host, owner string) error {
+	key := n.path("acme", "orders", host)
+	_, err := n.client.Txn(n.context).
+		If(etcd.Compare(etcd.Value(key), "=", owner)).
+		Then(etcd.OpDelete(key)).
+		Commit()
+	return convertErr(err)
+}
+
+// leaseTTL rounds the ttl up to the whole seconds of the etcd leases
+func leaseTTL(ttl time.Duration) time.Duration {
+	if ttl < time.Second {
+		return time.Second
+	}
+	return (ttl + time.Second - 1) / time.Second * time.Second
+}
@@ -0,0 +1,323 @@
+package etcdv3ng
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// ApplyBatch validates every operation against the state left by the previous operations of the batch
+// and commits all of them in a single transaction
+func (n *ng) ApplyBatch(ops []engine.BatchOp) error {
+	b, err := n.newBatch()
+	if err != nil {
+		return err
+	}
+	for i, op := range ops {
+		if err := b.add(op); err != nil {
+			b.revokeLeases()
+			return &engine.BatchError{Index: i, Err: err}
+		}
+	}
+	return b.commit()
+}
+
+// newBatch starts the batch reading the state at the current revision
+func (n *ng) newBatch() (*batch, error) {
+	re, err := n.client.Get(n.context, n.etcdKey, etcd.WithCountOnly())
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	return &batch{
+		n:         n,
+		rev:       re.Header.Revision,
+		entries:   map[string]*batchEntry{},
+		guarded:   map[string]bool{},
+		frontends: map[string][]string{},
+	}, nil
+}
+
+// commit applies the operations in a single transaction, committed only if none of the keys the batch has
+// read or changed has been modified after the revision of the batch. The leases of the batch are revoked
+// if it is not committed.
+func (b *batch) commit() error {
+	txn, err := b.n.client.Txn(b.n.context).If(b.guards()...).Then(b.txnOps()...).Commit()
+	if err != nil {
+		b.revokeLeases()
+		return convertErr(err)
+	}
+	if !txn.Succeeded {
+		b.revokeLeases()
+		return &engine.ConflictError{Message: "configuration has been changed while the batch was applied, none of its operations were applied"}
+	}
+	return nil
+}
+
+// batchEntry is the last operation of the batch on the key, etcd rejects transactions changing the same key twice
+type batchEntry struct {
+	op  etcd.Op
+	put bool
+}
+
+type batch struct {
+	n *ng
+	// rev is the revision the batch reads the state at
+	rev     int64
+	keys    []string
+	entries map[string]*batchEntry
+	// guarded are the keys read or changed by the batch, they must not be modified after the revision
+	guarded map[string]bool
+	// leases are granted to the keys put with the ttl
+	leases []etcd.LeaseID
+	// frontends are backend ids of the frontends changed by the batch, empty for the deleted frontends
+	frontends map[string][]string
+}
+
+func (b *batch) add(op engine.BatchOp) error {
+	n := b.n
+	switch c := op.Change.(type) {
+	case *engine.HostUpserted:
+		val, err := n.hostValue(c.Host)
+		if err != nil {
+			return err
+		}
+		return b.put(n.path("hosts", c.Host.Name, "host"), val, noTTL)
+	case *engine.HostDeleted:
+		if c.HostKey.Name == "" {
+			return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+		}
+		return b.delete(n.path("hosts", c.HostKey.Name))
+	case *engine.ListenerUpserted:
+		val, err := n.listenerValue(c.Listener)
+		if err != nil {
+			return err
+		}
+		return b.put(n.path("listeners", c.Listener.Id), val, noTTL)
+	case *engine.ListenerDeleted:
+		if c.ListenerKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+		}
+		return b.delete(n.path("listeners", c.ListenerKey.Id))
+	case *engine.FrontendUpserted:
+		if c.Frontend.Id == "" {
+			return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+		}
+		for _, id := range c.Frontend.BackendIds() {
+			if err := b.mustExist(n.path("backends", id, "backend"), engine.BackendKey{Id: id}); err != nil {
+				return err
+			}
+		}
+		b.frontends[c.Frontend.Id] = c.Frontend.BackendIds()
+		return b.put(n.path("frontends", c.Frontend.Id, "frontend"), c.Frontend, op.TTL)
+	case *engine.FrontendDeleted:
+		if c.FrontendKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
+		}
+		b.frontends[c.FrontendKey.Id] = nil
+		return b.delete(n.path("frontends", c.FrontendKey.Id))
+	case *engine.MiddlewareUpserted:
+		if c.FrontendKey.Id == "" || c.Middleware.Id == "" {
+			return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+		}
+		if err := b.mustExist(n.path("frontends", c.FrontendKey.Id, "frontend"), c.FrontendKey); err != nil {
+			return err
+		}
+		bytes, err := n.middlewareValue(c.Middleware)
+		if err != nil {
+			return err
+		}
+		return b.putVal(n.path("frontends", c.FrontendKey.Id, "middlewares", c.Middleware.Id), bytes, op.TTL)
+	case *engine.MiddlewareDeleted:
+		if c.MiddlewareKey.FrontendKey.Id == "" || c.MiddlewareKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "frontend id and middleware id can not be empty"}
+		}
+		return b.delete(n.path("frontends", c.MiddlewareKey.FrontendKey.Id, "middlewares", c.MiddlewareKey.Id))
+	case *engine.BackendUpserted:
+		val, err := n.backendValue(c.Backend)
+		if err != nil {
+			return err
+		}
+		return b.put(n.path("backends", c.Backend.Id, "backend"), val, noTTL)
+	case *engine.BackendDeleted:
+		if c.BackendKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+		}
+		fs, err := b.backendUsedBy(c.BackendKey)
+		if err != nil {
+			return err
+		}
+		if len(fs) != 0 {
+			return fmt.Errorf("can not delete backend '%v', it is in use by %s", c.BackendKey, fs)
+		}
+		return b.delete(n.path("backends", c.BackendKey.Id))
+	case *engine.ServerUpserted:
+		if c.Server.Id == "" || c.BackendKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+		}
+		if err := b.mustExist(n.path("backends", c.BackendKey.Id, "backend"), c.BackendKey); err != nil {
+			return err
+		}
+		return b.put(n.path("backends", c.BackendKey.Id, "servers", c.Server.Id), c.Server, op.TTL)
+	case *engine.ServerDeleted:
+		if c.ServerKey.Id == "" || c.ServerKey.BackendKey.Id == "" {
+			return &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+		}
+		return b.delete(n.path("backends", c.ServerKey.BackendKey.Id, "servers", c.ServerKey.Id))
+	}
+	return &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported batch operation %T", op.Change)}
+}
+
+func (b *batch) set(key string, e *batchEntry) {
+	b.guarded[key] = true
+	if _, ok := b.entries[key]; !ok {
+		b.keys = append(b.keys, key)
+	}
+	b.entries[key] = e
+}
+
+func (b *batch) put(key string, v interface{}, ttl time.Duration) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.putVal(key, bytes, ttl)
+}
+
+func (b *batch) putVal(key string, bytes []byte, ttl time.Duration) error {
+	ops := []etcd.OpOption{}
+	if ttl > 0 {
+		lgr, err := b.n.client.Grant(b.n.context, int64(ttl.Seconds()))
+		if err != nil {
+			return err
+		}
+		b.leases = append(b.leases, lgr.ID)
+		ops = append(ops, etcd.WithLease(lgr.ID))
+	}
+	b.set(key, &batchEntry{op: etcd.OpPut(key, string(bytes), ops...), put: true})
+	return nil
+}
+
+// delete removes the key and all keys below it one by one, so the later operations of the batch can put them back
+func (b *batch) delete(prefix string) error {
+	response, err := b.get(prefix, etcd.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	children, err := b.get(prefix+"/", etcd.WithPrefix(), etcd.WithKeysOnly())
+	if err != nil {
+		return err
+	}
+	for _, kv := range append(response.Kvs, children.Kvs...) {
+		key := string(kv.Key)
+		b.set(key, &batchEntry{op: etcd.OpDelete(key)})
+	}
+	for key, e := range b.entries {
+		if e.put && (key == prefix || strings.HasPrefix(key, prefix+"/")) {
+			// the key is not in etcd yet, dropping the put is enough
+			delete(b.entries, key)
+		}
+	}
+	return nil
+}
+
+func (b *batch) exists(key string) (bool, error) {
+	if e, ok := b.entries[key]; ok {
+		return e.put, nil
+	}
+	response, err := b.get(key, etcd.WithKeysOnly())
+	if err != nil {
+		return false, err
+	}
+	b.guarded[key] = true
+	return len(response.Kvs) != 0, nil
+}
+
+// get reads the keys at the revision of the batch, the keys found are guarded
+func (b *batch) get(key string, opts ...etcd.OpOption) (*etcd.GetResponse, error) {
+	response, err := b.n.client.Get(b.n.context, key, append(opts, etcd.WithRev(b.rev))...)
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	for _, kv := range response.Kvs {
+		b.guarded[string(kv.Key)] = true
+	}
+	return response, nil
+}
+
+// guards compare the revisions of the guarded keys with the revision of the batch, the keys created by
+// the concurrent changes under the prefixes the batch has listed are not detected
+func (b *batch) guards() []etcd.Cmp {
+	cmps := make([]etcd.Cmp, 0, len(b.guarded))
+	for key := range b.guarded {
+		cmps = append(cmps, etcd.Compare(etcd.ModRevision(key), "<", b.rev+1))
+	}
+	return cmps
+}
+
+// revokeLeases revokes the leases granted to the batch that is not committed
+func (b *batch) revokeLeases() {
+	for _, id := range b.leases {
+		if _, err := b.n.client.Revoke(b.n.context, id); err != nil {
+			log.Warningf("failed to revoke lease %v of the batch: %v", id, err)
+		}
+	}
+}
+
+func (b *batch) mustExist(key string, object interface{}) error {
+	ok, err := b.exists(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("'%v' not found", object)}
+	}
+	return nil
+}
+
+// backendUsedBy returns ids of the frontends using the backend once the batch is applied
+func (b *batch) backendUsedBy(bk engine.BackendKey) ([]string, error) {
+	response, err := b.get(b.n.path("frontends")+"/", etcd.WithPrefix(), etcd.WithSort(etcd.SortByKey, etcd.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	specs, err := b.n.parseFrontends(response.Kvs, true)
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]engine.Frontend, len(specs))
+	for i, spec := range specs {
+		fs[i] = spec.Frontend
+	}
+	var used []string
+	for _, f := range fs {
+		if _, changed := b.frontends[f.Id]; !changed && f.UsesBackend(bk) {
+			used = append(used, f.Id)
+		}
+	}
+	for id, backendIds := range b.frontends {
+		for _, backendId := range backendIds {
+			if backendId == bk.Id {
+				used = append(used, id)
+				break
+			}
+		}
+	}
+	return used, nil
+}
+
+func (b *batch) txnOps() []etcd.Op {
+	ops := make([]etcd.Op, 0, len(b.entries))
+	for _, key := range b.keys {
+		if e, ok := b.entries[key]; ok {
+			ops = append(ops, e.op)
+			// the key dropped and set again is listed twice
+			delete(b.entries, key)
+		}
+	}
+	return ops
+}
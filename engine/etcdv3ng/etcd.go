@@ -4,6 +4,7 @@ package etcdv3ng
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 	"time"
@@ -116,7 +117,7 @@ func (n *ng) parseFrontends(keyValues []*mvccpb.KeyValue, skipMiddlewares ...boo
 				middlewares := []engine.Middleware{}
 				for _, subKeyValue := range subKeyValues {
 					if middlewareId := suffix(string(subKeyValue.Key)); suffix(prefix(string(subKeyValue.Key))) == "middlewares" {
-						middleware, err := engine.MiddlewareFromJSON([]byte(subKeyValue.Value), n.registry.GetSpec, middlewareId)
+						middleware, err := n.middlewareFromJSON([]byte(subKeyValue.Value), middlewareId)
 						if err != nil {
 							return nil, err
 						}
@@ -140,7 +141,7 @@ func (n *ng) parseBackends(keyValues []*mvccpb.KeyValue, skipServers ...bool) ([
 	for _, keyValue := range keyValues {
 		if backendIds := backendIdRegex.FindStringSubmatch(string(keyValue.Key)); len(backendIds) == 2 {
 			backendId := backendIds[1]
-			backend, err := engine.BackendFromJSON([]byte(keyValue.Value), backendId)
+			backend, err := n.backendFromJSON([]byte(keyValue.Value), backendId)
 			if err != nil {
 				return nil, err
 			}
@@ -190,7 +191,17 @@ func (n *ng) parseHosts(keyValues []*mvccpb.KeyValue) ([]engine.Host, error) {
 					return nil, err
 				}
 			}
-			host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, OCSP: sealedHost.Settings.OCSP})
+			var keyPairs []engine.KeyPair
+			if len(sealedHost.Settings.KeyPairs) != 0 {
+				if err := n.openSealedJSONVal(sealedHost.Settings.KeyPairs, &keyPairs); err != nil {
+					return nil, err
+				}
+			}
+			acme, err := n.openACME(sealedHost.Settings.ACME)
+			if err != nil {
+				return nil, err
+			}
+			host, err := engine.NewHost(hostname, engine.HostSettings{Default: sealedHost.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: sealedHost.Settings.OCSP, ACME: acme, TLS: sealedHost.Settings.TLS, ClientAuth: sealedHost.Settings.ClientAuth, SecurityHeaders: sealedHost.Settings.SecurityHeaders})
 			if err != nil {
 				return nil, err
 			}
@@ -209,7 +220,7 @@ func (n *ng) parseListeners(keyValues []*mvccpb.KeyValue) ([]engine.Listener, er
 		if listenerIds := listenerIdRegex.FindStringSubmatch(string(keyValue.Key)); len(listenerIds) == 2 {
 			listenerId := listenerIds[1]
 
-			listener, err := engine.ListenerFromJSON([]byte(keyValue.Value), listenerId)
+			listener, err := n.listenerFromJSON([]byte(keyValue.Value), listenerId)
 			if err != nil {
 				return nil, err
 			}
@@ -295,32 +306,94 @@ func (n *ng) GetHost(key engine.HostKey) (*engine.Host, error) {
 		}
 	}
 
-	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, OCSP: host.Settings.OCSP})
+	var keyPairs []engine.KeyPair
+	if len(host.Settings.KeyPairs) != 0 {
+		if err := n.openSealedJSONVal(host.Settings.KeyPairs, &keyPairs); err != nil {
+			return nil, err
+		}
+	}
+	acme, err := n.openACME(host.Settings.ACME)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.NewHost(key.Name, engine.HostSettings{Default: host.Settings.Default, KeyPair: keyPair, KeyPairs: keyPairs, OCSP: host.Settings.OCSP, ACME: acme, TLS: host.Settings.TLS, ClientAuth: host.Settings.ClientAuth, SecurityHeaders: host.Settings.SecurityHeaders})
 }
 
 func (n *ng) UpsertHost(h engine.Host) error {
-	if h.Name == "" {
-		return &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	val, err := n.hostValue(h)
+	if err != nil {
+		return err
 	}
-	hostKey := n.path("hosts", h.Name, "host")
+	return n.setJSONVal(n.path("hosts", h.Name, "host"), val, noTTL)
+}
 
-	val := host{
+// hostValue returns the host as it is stored, with the secrets sealed
+func (n *ng) hostValue(h engine.Host) (*host, error) {
+	if h.Name == "" {
+		return nil, &engine.InvalidFormatError{Message: "hostname can not be empty"}
+	}
+	val := &host{
 		Name: h.Name,
 		Settings: hostSettings{
-			Default: h.Settings.Default,
-			OCSP:    h.Settings.OCSP,
+			Default:         h.Settings.Default,
+			OCSP:            h.Settings.OCSP,
+			TLS:             h.Settings.TLS,
+			ClientAuth:      h.Settings.ClientAuth,
+			SecurityHeaders: h.Settings.SecurityHeaders,
 		},
 	}
 
 	if h.Settings.KeyPair != nil {
 		bytes, err := n.sealJSONVal(h.Settings.KeyPair)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		val.Settings.KeyPair = bytes
 	}
 
-	return n.setJSONVal(hostKey, val, noTTL)
+	if len(h.Settings.KeyPairs) != 0 {
+		bytes, err := n.sealJSONVal(h.Settings.KeyPairs)
+		if err != nil {
+			return nil, err
+		}
+		val.Settings.KeyPairs = bytes
+	}
+
+	acme, err := n.sealACME(h.Settings.ACME)
+	if err != nil {
+		return nil, err
+	}
+	val.Settings.ACME = acme
+	return val, nil
+}
+
+// sealACME returns a copy of the ACME settings with the account key sealed
+func (n *ng) sealACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	bytes, err := n.sealJSONVal(a.AccountKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := *a
+	sealed.AccountKey = bytes
+	return &sealed, nil
+}
+
+// openACME returns a copy of the ACME settings with the account key opened
+func (n *ng) openACME(a *engine.ACMESettings) (*engine.ACMESettings, error) {
+	if a == nil || len(a.AccountKey) == 0 {
+		return a, nil
+	}
+	var key []byte
+	if err := n.openSealedJSONVal(a.AccountKey, &key); err != nil {
+		return nil, err
+	}
+	opened := *a
+	opened.AccountKey = key
+	return &opened, nil
 }
 
 func (n *ng) DeleteHost(key engine.HostKey) error {
@@ -352,18 +425,102 @@ func (n *ng) GetListener(key engine.ListenerKey) (*engine.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	l, err := engine.ListenerFromJSON([]byte(bytes), key.Id)
+	return n.listenerFromJSON([]byte(bytes), key.Id)
+}
+
+func (n *ng) UpsertListener(listener engine.Listener) error {
+	val, err := n.listenerValue(listener)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("listeners", listener.Id), val, noTTL)
+}
+
+// SwapListener puts the listener in the transaction committed only if the stored listener equal to old has not been
+// modified after it was read
+func (n *ng) SwapListener(old, l engine.Listener) error {
+	key := n.path("listeners", l.Id)
+	re, err := n.client.Get(n.context, key)
+	if err != nil {
+		return convertErr(err)
+	}
+	if len(re.Kvs) != 1 {
+		return &engine.NotFoundError{Message: "Key not found"}
+	}
+	stored, err := n.listenerFromJSON(re.Kvs[0].Value, l.Id)
+	if err != nil {
+		return err
+	}
+	conflict := &engine.ConflictError{Message: fmt.Sprintf("listener '%v' has been changed, it was not updated", l.Id)}
+	if !reflect.DeepEqual(*stored, old) {
+		return conflict
+	}
+	val, err := n.listenerValue(l)
+	if err != nil {
+		return err
+	}
+	bytes, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	txn, err := n.client.Txn(n.context).
+		If(etcd.Compare(etcd.ModRevision(key), "=", re.Kvs[0].ModRevision)).
+		Then(etcd.OpPut(key, string(bytes))).
+		Commit()
+	if err != nil {
+		return convertErr(err)
+	}
+	if !txn.Succeeded {
+		return conflict
+	}
+	return nil
+}
+
+// listenerValue returns the listener as it is stored, with the session ticket keys sealed
+func (n *ng) listenerValue(l engine.Listener) (*listener, error) {
+	if l.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "listener id can not be empty"}
+	}
+	val := &listener{Listener: l}
+	if l.Settings == nil || len(l.Settings.TLS.SessionTicketKeys) == 0 {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(l.Settings.TLS.SessionTicketKeys)
 	if err != nil {
 		return nil, err
 	}
-	return l, nil
+	settings := *l.Settings
+	settings.TLS.SessionTicketKeys = nil
+	val.Settings = &settings
+	val.SessionTicketKeys = bytes
+	return val, nil
 }
 
-func (n *ng) UpsertListener(listener engine.Listener) error {
-	if listener.Id == "" {
-		return &engine.InvalidFormatError{Message: "listener id can not be empty"}
+// listenerFromJSON reads the stored listener and opens its session ticket keys
+func (n *ng) listenerFromJSON(bytes []byte, id string) (*engine.Listener, error) {
+	l, err := engine.ListenerFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed listener
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.SessionTicketKeys) == 0 {
+		return l, nil
+	}
+	if l.Settings == nil {
+		return nil, fmt.Errorf("%v: session ticket keys without TLS settings", l)
+	}
+	var keys [][]byte
+	if err := n.openSealedJSONVal(sealed.SessionTicketKeys, &keys); err != nil {
+		return nil, err
+	}
+	l.Settings.TLS.SessionTicketKeys = keys
+	if _, err := engine.NewTLSConfig(&l.Settings.TLS); err != nil {
+		return nil, err
 	}
-	return n.setJSONVal(n.path("listeners", listener.Id), listener, noTTL)
+	return l, nil
 }
 
 func (n *ng) DeleteListener(key engine.ListenerKey) error {
@@ -377,8 +534,10 @@ func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
 	if f.Id == "" {
 		return &engine.InvalidFormatError{Message: "frontend id can not be empty"}
 	}
-	if _, err := n.GetBackend(engine.BackendKey{Id: f.BackendId}); err != nil {
-		return err
+	for _, id := range f.BackendIds() {
+		if _, err := n.GetBackend(engine.BackendKey{Id: id}); err != nil {
+			return err
+		}
 	}
 
 	return n.setJSONVal(n.path("frontends", f.Id, "frontend"), f, ttl)
@@ -441,14 +600,67 @@ func (n *ng) GetBackend(key engine.BackendKey) (*engine.Backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return engine.BackendFromJSON([]byte(bytes), key.Id)
+	return n.backendFromJSON([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertBackend(b engine.Backend) error {
+	val, err := n.backendValue(b)
+	if err != nil {
+		return err
+	}
+	return n.setJSONVal(n.path("backends", b.Id, "backend"), val, noTTL)
+}
+
+// backendValue returns the backend as it is stored, with the key pair of the client certificate sealed
+func (n *ng) backendValue(b engine.Backend) (*backend, error) {
 	if b.Id == "" {
-		return &engine.InvalidFormatError{Message: "backend id can not be empty"}
+		return nil, &engine.InvalidFormatError{Message: "backend id can not be empty"}
+	}
+	val := &backend{Backend: b}
+	s, ok := b.Settings.(engine.HTTPBackendSettings)
+	if !ok || s.TLS == nil || s.TLS.ClientKeyPair == nil {
+		return val, nil
+	}
+	bytes, err := n.sealJSONVal(s.TLS.ClientKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	tls := *s.TLS
+	tls.ClientKeyPair = nil
+	s.TLS = &tls
+	val.Settings = s
+	val.ClientKeyPair = bytes
+	return val, nil
+}
+
+// backendFromJSON reads the stored backend and opens the key pair of its client certificate
+func (n *ng) backendFromJSON(bytes []byte, id string) (*engine.Backend, error) {
+	b, err := engine.BackendFromJSON(bytes, id)
+	if err != nil {
+		return nil, err
+	}
+	var sealed struct {
+		ClientKeyPair []byte
+	}
+	if err := json.Unmarshal(bytes, &sealed); err != nil {
+		return nil, err
+	}
+	if len(sealed.ClientKeyPair) == 0 {
+		return b, nil
+	}
+	s := b.HTTPSettings()
+	if s.TLS == nil {
+		return nil, fmt.Errorf("%v: client key pair without TLS settings", b)
+	}
+	var keyPair *engine.KeyPair
+	if err := n.openSealedJSONVal(sealed.ClientKeyPair, &keyPair); err != nil {
+		return nil, err
+	}
+	s.TLS.ClientKeyPair = keyPair
+	if _, err := engine.NewTLSConfig(s.TLS); err != nil {
+		return nil, err
 	}
-	return n.setJSONVal(n.path("backends", b.Id, "backend"), b, noTTL)
+	return b, nil
 }
 
 func (n *ng) DeleteBackend(bk engine.BackendKey) error {
@@ -489,7 +701,7 @@ func (n *ng) GetMiddleware(key engine.MiddlewareKey) (*engine.Middleware, error)
 	if err != nil {
 		return nil, err
 	}
-	return engine.MiddlewareFromJSON([]byte(bytes), n.registry.GetSpec, key.Id)
+	return n.middlewareFromJSON([]byte(bytes), key.Id)
 }
 
 func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
@@ -499,7 +711,28 @@ func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl ti
 	if _, err := n.GetFrontend(fk); err != nil {
 		return err
 	}
-	return n.setJSONVal(n.path("frontends", fk.Id, "middlewares", m.Id), m, ttl)
+	bytes, err := n.middlewareValue(m)
+	if err != nil {
+		return err
+	}
+	return n.setVal(n.path("frontends", fk.Id, "middlewares", m.Id), bytes, ttl)
+}
+
+// middlewareValue encodes the middleware, middlewares holding credentials are sealed if the engine has the secret box
+func (n *ng) middlewareValue(m engine.Middleware) ([]byte, error) {
+	if spec := n.registry.GetSpec(m.Type); spec != nil && spec.Sealed && n.options.Box != nil {
+		return secret.SealMiddlewareToJSON(n.options.Box, m)
+	}
+	return json.Marshal(m)
+}
+
+// middlewareFromJSON decodes the middleware opening its sealed parameters
+func (n *ng) middlewareFromJSON(bytes []byte, id string) (*engine.Middleware, error) {
+	opened, err := secret.OpenMiddlewareJSON(n.options.Box, bytes)
+	if err != nil {
+		return nil, err
+	}
+	return engine.MiddlewareFromJSON(opened, n.registry.GetSpec, id)
 }
 
 func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
@@ -588,7 +821,7 @@ func (n *ng) backendUsedBy(bk engine.BackendKey) ([]engine.Frontend, error) {
 		return nil, err
 	}
 	for _, f := range fs {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			usedFs = append(usedFs, f)
 		}
 	}
@@ -605,6 +838,11 @@ func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan s
 	watchChan := watcher.Watch(n.context, n.etcdKey, etcd.WithRev(int64(afterIdx)), etcd.WithPrefix())
 
 	for response := range watchChan {
+		// the watch is canceled when the requested revision has been compacted
+		if response.CompactRevision != 0 {
+			log.Warningf("Stop watching: revisions up to %d were compacted", response.CompactRevision)
+			return &engine.CompactedError{Index: uint64(response.CompactRevision)}
+		}
 		if response.Canceled {
 			log.Infof("Stop watching: graceful shutdown")
 			return nil
@@ -970,8 +1208,25 @@ type host struct {
 	Settings hostSettings
 }
 
+// listener is the listener as it is stored, with the session ticket keys sealed
+type listener struct {
+	engine.Listener
+	SessionTicketKeys []byte `json:",omitempty"`
+}
+
+// backend is the backend as it is stored, with the key pair of the client certificate sealed
+type backend struct {
+	engine.Backend
+	ClientKeyPair []byte `json:",omitempty"`
+}
+
 type hostSettings struct {
-	Default bool
-	KeyPair []byte
-	OCSP    engine.OCSPSettings
+	Default         bool
+	KeyPair         []byte
+	KeyPairs        []byte `json:",omitempty"`
+	OCSP            engine.OCSPSettings
+	ACME            *engine.ACMESettings            `json:",omitempty"`
+	TLS             *engine.HostTLSSettings         `json:",omitempty"`
+	ClientAuth      *engine.ClientAuthSettings      `json:",omitempty"`
+	SecurityHeaders *engine.SecurityHeadersSettings `json:",omitempty"`
 }
@@ -1,12 +1,17 @@
 package etcdv3ng
 
 import (
+	"bytes"
+	"encoding/base64"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/engine/test"
+	"github.com/vulcand/vulcand/plugin/basicauth"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/secret"
 
@@ -125,6 +130,18 @@ func (s *EtcdSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *EtcdSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *EtcdSuite) TestACMEStore(c *C) {
+	s.suite.ACMEStore(c)
+}
+
+func (s *EtcdSuite) TestHostWithTLS(c *C) {
+	s.suite.HostWithTLS(c)
+}
+
 func (s *EtcdSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -153,6 +170,10 @@ func (s *EtcdSuite) TestServerExpire(c *C) {
 	s.suite.ServerExpire(c)
 }
 
+func (s *EtcdSuite) TestServerRegister(c *C) {
+	s.suite.ServerRegister(c)
+}
+
 func (s *EtcdSuite) TestFrontendCRUD(c *C) {
 	s.suite.FrontendCRUD(c)
 }
@@ -181,3 +202,139 @@ func (s *EtcdSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *EtcdSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+// Middlewares holding credentials are stored sealed
+func (s *EtcdSuite) TestMiddlewareSealed(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	f := engine.Frontend{Id: "f1", Type: engine.HTTP, Route: `Path("/")`, Settings: engine.HTTPFrontendSettings{}, BackendId: b.Id}
+	c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+
+	hash := "$2a$04$NJHPhi5AnTS2rvrVGkT2WOeDSpeD9CpRzBbJPwmfVeAPNYvVSAQMa"
+	auth, err := basicauth.New(map[string]string{"admin": hash}, "")
+	c.Assert(err, IsNil)
+	m := engine.Middleware{Id: "auth", Type: basicauth.Type, Priority: 1, Middleware: auth}
+	fk := engine.FrontendKey{Id: f.Id}
+	c.Assert(s.ng.UpsertMiddleware(fk, m, 0), IsNil)
+
+	re, err := s.client.Get(s.context, s.ng.path("frontends", f.Id, "middlewares", m.Id))
+	c.Assert(err, IsNil)
+	c.Assert(re.Kvs, HasLen, 1)
+	c.Assert(strings.Contains(string(re.Kvs[0].Value), hash), Equals, false)
+
+	out, err := s.ng.GetMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: m.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &m)
+
+	// the batches seal them too
+	m.Id = "batched"
+	c.Assert(s.ng.ApplyBatch([]engine.BatchOp{{Change: &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: m}}}), IsNil)
+	re, err = s.client.Get(s.context, s.ng.path("frontends", f.Id, "middlewares", m.Id))
+	c.Assert(err, IsNil)
+	c.Assert(re.Kvs, HasLen, 1)
+	c.Assert(strings.Contains(string(re.Kvs[0].Value), hash), Equals, false)
+	out, err = s.ng.GetMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: m.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &m)
+}
+
+func (s *EtcdSuite) TestBackendClientKeyPairSealed(c *C) {
+	keyPair := test.NewKeyPair(c, "client.internal")
+	b, err := engine.NewHTTPBackend("b1", engine.HTTPBackendSettings{TLS: &engine.TLSSettings{ClientKeyPair: keyPair}})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertBackend(*b), IsNil)
+
+	re, err := s.client.Get(s.context, s.ng.path("backends", b.Id, "backend"))
+	c.Assert(err, IsNil)
+	c.Assert(re.Kvs, HasLen, 1)
+	stored := re.Kvs[0].Value
+	c.Assert(strings.Contains(string(stored), base64.StdEncoding.EncodeToString(keyPair.Key)), Equals, false)
+
+	out, err := s.ng.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, b)
+}
+
+func (s *EtcdSuite) TestListenerSessionTicketKeysSealed(c *C) {
+	settings := &engine.HTTPSListenerSettings{}
+	c.Assert(settings.TLS.RotateSessionTicketKeys(bytes.Repeat([]byte("k"), engine.SessionTicketKeySize)), IsNil)
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTPS, Address: engine.Address{Network: "tcp", Address: "localhost:443"}, Settings: settings}
+	c.Assert(s.ng.UpsertListener(l), IsNil)
+
+	re, err := s.client.Get(s.context, s.ng.path("listeners", l.Id))
+	c.Assert(err, IsNil)
+	c.Assert(re.Kvs, HasLen, 1)
+	c.Assert(strings.Contains(string(re.Kvs[0].Value), base64.StdEncoding.EncodeToString(settings.TLS.SessionTicketKeys[0])), Equals, false)
+
+	out, err := s.ng.GetListener(engine.ListenerKey{Id: l.Id})
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &l)
+}
+
+func (s *EtcdSuite) TestSwapListener(c *C) {
+	s.suite.SwapListener(c)
+}
+
+func (s *EtcdSuite) TestTTLs(c *C) {
+	s.suite.TTLs(c)
+}
+
+func (s *EtcdSuite) TestBatch(c *C) {
+	s.suite.Batch(c)
+}
+
+func (s *EtcdSuite) TestBatchInvalid(c *C) {
+	s.suite.BatchInvalid(c)
+}
+
+func (s *EtcdSuite) TestBatchConflict(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+
+	batch, err := s.ng.newBatch()
+	c.Assert(err, IsNil)
+	c.Assert(batch.add(engine.BatchOp{Change: &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: b.Id}, Server: srv}, TTL: time.Minute}), IsNil)
+	c.Assert(batch.leases, HasLen, 1)
+
+	// the backend the batch has checked is deleted before the commit
+	c.Assert(s.ng.DeleteBackend(engine.BackendKey{Id: b.Id}), IsNil)
+	c.Assert(batch.commit(), FitsTypeOf, &engine.ConflictError{})
+
+	_, err = s.ng.GetServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: b.Id}, Id: srv.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	ttl, err := s.client.TimeToLive(s.context, batch.leases[0])
+	c.Assert(err, IsNil)
+	c.Assert(ttl.TTL, Equals, int64(-1))
+}
+
+func (s *EtcdSuite) TestFrontendsPage(c *C) {
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.ng.UpsertBackend(b), IsNil)
+	// "api-x" goes before "api" in the order of the keys, "api-x/frontend" < "api/frontend"
+	for _, id := range []string{"api", "api-x", "api-y", "web"} {
+		f := engine.Frontend{Id: id, Type: engine.HTTP, Route: `Path("/` + id + `")`, Settings: engine.HTTPFrontendSettings{}, BackendId: b.Id}
+		c.Assert(s.ng.UpsertFrontend(f, 0), IsNil)
+	}
+	fk := engine.FrontendKey{Id: "api-x"}
+	auth, err := basicauth.New(map[string]string{"admin": "$2a$04$NJHPhi5AnTS2rvrVGkT2WOeDSpeD9CpRzBbJPwmfVeAPNYvVSAQMa"}, "")
+	c.Assert(err, IsNil)
+	m := engine.Middleware{Id: "auth", Type: basicauth.Type, Priority: 1, Middleware: auth}
+	c.Assert(s.ng.UpsertMiddleware(fk, m, 0), IsNil)
+
+	fs, next, err := s.ng.GetFrontendsPage(engine.Page{Prefix: "api", Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(fs, HasLen, 2)
+	c.Assert(fs[0].Id, Equals, "api-x")
+	c.Assert(fs[1].Id, Equals, "api-y")
+	c.Assert(next, NotNil)
+
+	// the next page is read at the revision of the first one
+	c.Assert(s.ng.DeleteFrontend(engine.FrontendKey{Id: "api"}), IsNil)
+
+	fs, next, err = s.ng.GetFrontendsPage(*next)
+	c.Assert(err, IsNil)
+	c.Assert(fs, HasLen, 1)
+	c.Assert(fs[0].Id, Equals, "api")
+	c.Assert(next, IsNil)
+}
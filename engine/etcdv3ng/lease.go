@@ -0,0 +1,158 @@
+package etcdv3ng
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/utils/json"
+	"golang.org/x/net/context"
+)
+
+// RegisterServer writes the server under the lease with the ttl and keeps the lease alive until the registration
+// is closed. Once the lease expires etcd deletes the server key and the watchers get the server deleted.
+func (n *ng) RegisterServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) (engine.Registration, error) {
+	if s.Id == "" || bk.Id == "" {
+		return nil, &engine.InvalidFormatError{Message: "backend id and server id can not be empty"}
+	}
+	if ttl < time.Second {
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("lease ttl should be at least 1s, got %v", ttl)}
+	}
+	if _, err := n.GetBackend(bk); err != nil {
+		return nil, err
+	}
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(n.context)
+	r := &registration{
+		n:      n,
+		key:    n.path("backends", bk.Id, "servers", s.Id),
+		value:  string(bytes),
+		ttl:    ttl,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	keepAlives, err := r.register()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go r.keepAlive(keepAlives)
+	return r, nil
+}
+
+type registration struct {
+	n      *ng
+	key    string
+	value  string
+	ttl    time.Duration
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mtx   sync.Mutex
+	lease etcd.LeaseID
+}
+
+// register grants the new lease and writes the server under it
+func (r *registration) register() (<-chan *etcd.LeaseKeepAliveResponse, error) {
+	lgr, err := r.n.client.Grant(r.ctx, int64(r.ttl/time.Second))
+	if err != nil {
+		return nil, convertErr(err)
+	}
+	r.mtx.Lock()
+	r.lease = lgr.ID
+	r.mtx.Unlock()
+	if _, err := r.n.client.Put(r.ctx, r.key, r.value, etcd.WithLease(lgr.ID)); err != nil {
+		return nil, convertErr(err)
+	}
+	return r.n.client.KeepAlive(r.ctx, lgr.ID)
+}
+
+// keepAlive drains the keepalive responses. The client keeps retrying through short etcd disconnects,
+// the channel is closed only once the lease can not be renewed any more, e.g. it has expired during
+// the longer outage. The server is registered again under the new lease in this case.
+func (r *registration) keepAlive(keepAlives <-chan *etcd.LeaseKeepAliveResponse) {
+	defer close(r.done)
+	for {
+		for range keepAlives {
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		log.Warningf("Lost lease of %v, registering again", r.key)
+		for {
+			var err error
+			if keepAlives, err = r.register(); err == nil {
+				break
+			}
+			log.Errorf("Failed to register %v: %v", r.key, err)
+			select {
+			case <-time.After(r.ttl / 3):
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Close stops the keepalives and revokes the lease, so the server is deleted right away
+func (r *registration) Close() error {
+	r.cancel()
+	<-r.done
+	r.mtx.Lock()
+	lease := r.lease
+	r.mtx.Unlock()
+	_, err := r.n.client.Revoke(r.n.context, lease)
+	if err == rpctypes.ErrLeaseNotFound {
+		return nil
+	}
+	return convertErr(err)
+}
+
+// GetTTLs reads the time left to the leases of the frontends, middlewares and servers, the leases are read once
+// for the keys sharing them
+func (n *ng) GetTTLs() (*engine.TTLs, error) {
+	out := engine.NewTTLs()
+	ttls := map[int64]time.Duration{}
+	for _, section := range []string{"frontends", "backends"} {
+		response, err := n.client.Get(n.context, n.path(section)+"/", etcd.WithPrefix(), etcd.WithKeysOnly())
+		if err != nil {
+			return nil, convertErr(err)
+		}
+		for _, kv := range response.Kvs {
+			if kv.Lease == 0 {
+				continue
+			}
+			ttl, ok := ttls[kv.Lease]
+			if !ok {
+				re, err := n.client.TimeToLive(n.context, etcd.LeaseID(kv.Lease))
+				if err != nil {
+					return nil, convertErr(err)
+				}
+				ttl = time.Duration(re.TTL) * time.Second
+				ttls[kv.Lease] = ttl
+			}
+			// the lease has expired and the key is about to be deleted
+			if ttl <= 0 {
+				continue
+			}
+			key := string(kv.Key)
+			if ids := middlewareRegex.FindStringSubmatch(key); len(ids) == 3 {
+				out.Middlewares[engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: ids[1]}, Id: ids[2]}] = ttl
+			} else if ids := serverRegex.FindStringSubmatch(key); len(ids) == 3 {
+				out.Servers[engine.ServerKey{BackendKey: engine.BackendKey{Id: ids[1]}, Id: ids[2]}] = ttl
+			} else if ids := frontendIdRegex.FindStringSubmatch(key); len(ids) == 2 {
+				out.Frontends[engine.FrontendKey{Id: ids[1]}] = ttl
+			}
+		}
+	}
+	return out, nil
+}
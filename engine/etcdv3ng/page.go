@@ -0,0 +1,103 @@
+package etcdv3ng
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	etcd "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// GetFrontendsPage reads the frontends of the page in the order of their keys, the middlewares under the frontend
+// keys are skipped
+func (n *ng) GetFrontendsPage(p engine.Page) ([]engine.Frontend, *engine.Page, error) {
+	kvs, next, err := n.readPage(n.path("frontends")+"/", p, func(key string) bool {
+		return strings.Count(key, "/") == 1 && strings.HasSuffix(key, "/frontend")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	frontends := make([]engine.Frontend, 0, len(kvs))
+	for _, kv := range kvs {
+		id := suffix(prefix(string(kv.Key)))
+		f, err := engine.FrontendFromJSON(n.registry.GetRouter(), kv.Value, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		frontends = append(frontends, *f)
+	}
+	return frontends, next, nil
+}
+
+// GetServersPage reads the servers of the page in the order of their keys. The backend is looked up with the first
+// page, so the servers of the missing backend are not found instead of being listed as the empty page.
+func (n *ng) GetServersPage(bk engine.BackendKey, p engine.Page) ([]engine.Server, *engine.Page, error) {
+	if p.Revision == 0 {
+		if _, err := n.getVal(n.path("backends", bk.Id, "backend")); err != nil {
+			return nil, nil, err
+		}
+	}
+	kvs, next, err := n.readPage(n.path("backends", bk.Id, "servers")+"/", p, func(key string) bool {
+		return !strings.Contains(key, "/")
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	servers := make([]engine.Server, 0, len(kvs))
+	for _, kv := range kvs {
+		srv, err := engine.ServerFromJSON(kv.Value, suffix(string(kv.Key)))
+		if err != nil {
+			log.Warningf("Invalid server config for %s (backend: %v): %v\n", kv.Key, bk, err)
+			continue
+		}
+		servers = append(servers, *srv)
+	}
+	return servers, next, nil
+}
+
+// readPage reads the keys under the directory picked by the function, starting after the key the previous page
+// has ended with. The keys are read in batches at the revision of the first page until the page is full,
+// the key the page ends with is relative to the directory and is passed to the next page.
+func (n *ng) readPage(dir string, p engine.Page, pick func(key string) bool) ([]*mvccpb.KeyValue, *engine.Page, error) {
+	from, end := dir+p.Prefix, etcd.GetPrefixRangeEnd(dir+p.Prefix)
+	if p.After != "" {
+		from = dir + p.After + "\x00"
+	}
+	rev := p.Revision
+	var out []*mvccpb.KeyValue
+	for {
+		opts := []etcd.OpOption{etcd.WithRange(end), etcd.WithSort(etcd.SortByKey, etcd.SortAscend), etcd.WithRev(rev)}
+		if p.Limit > 0 {
+			// one more key tells if there is the next page
+			opts = append(opts, etcd.WithLimit(int64(p.Limit+1)))
+		}
+		response, err := n.client.Get(n.context, from, opts...)
+		if err != nil {
+			if err == rpctypes.ErrCompacted {
+				return nil, nil, &engine.CompactedError{Index: uint64(rev)}
+			}
+			return nil, nil, err
+		}
+		// the first page is read at the latest revision, the rest of the pages are read at the same revision
+		rev = response.Header.Revision
+		if p.Revision != 0 {
+			rev = p.Revision
+		}
+		for _, kv := range response.Kvs {
+			if !pick(strings.TrimPrefix(string(kv.Key), dir)) {
+				continue
+			}
+			if p.Limit > 0 && len(out) == p.Limit {
+				last := strings.TrimPrefix(string(out[len(out)-1].Key), dir)
+				return out, &engine.Page{Prefix: p.Prefix, After: last, Limit: p.Limit, Revision: rev}, nil
+			}
+			out = append(out, kv)
+		}
+		if !response.More || len(response.Kvs) == 0 {
+			return out, nil, nil
+		}
+		from = string(response.Kvs[len(response.Kvs)-1].Key) + "\x00"
+	}
+}
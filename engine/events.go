@@ -100,3 +100,67 @@ type ServerDeleted struct {
 func (s *ServerDeleted) String() string {
 	return fmt.Sprintf("ServerDeleted(serverKey=%v)", &s.ServerKey)
 }
+
+// Operations of the change events
+const (
+	ChangeUpsert = "upsert"
+	ChangeDelete = "delete"
+	// ChangeResync means the changes could not be followed and the whole configuration was re-read
+	ChangeResync = "resync"
+)
+
+// ChangeEvent describes the configuration change applied to the proxy
+type ChangeEvent struct {
+	// Type is the type of the changed object: host, listener, frontend, middleware, backend or server
+	Type string `json:",omitempty"`
+	Id   string `json:",omitempty"`
+	// Parent is the frontend id of the middleware or the backend id of the server
+	Parent string `json:",omitempty"`
+	Op     string
+}
+
+// ChangeSubscription receives the change events applied to the proxy
+type ChangeSubscription interface {
+	// Changes receives the change events in the order they are applied
+	Changes() <-chan *ChangeEvent
+	// Lost is signalled when events were dropped because the subscriber has fallen behind,
+	// the subscriber should re-read the configuration then
+	Lost() <-chan struct{}
+	// Close unsubscribes from the changes
+	Close()
+}
+
+func (e *ChangeEvent) String() string {
+	return fmt.Sprintf("ChangeEvent(%s %s %s)", e.Op, e.Type, e.Id)
+}
+
+// NewChangeEvent describes the change emitted by the engine, false is returned for unknown changes
+func NewChangeEvent(change interface{}) (*ChangeEvent, bool) {
+	switch ch := change.(type) {
+	case *HostUpserted:
+		return &ChangeEvent{Type: "host", Id: ch.Host.Name, Op: ChangeUpsert}, true
+	case *HostDeleted:
+		return &ChangeEvent{Type: "host", Id: ch.HostKey.Name, Op: ChangeDelete}, true
+	case *ListenerUpserted:
+		return &ChangeEvent{Type: "listener", Id: ch.Listener.Id, Op: ChangeUpsert}, true
+	case *ListenerDeleted:
+		return &ChangeEvent{Type: "listener", Id: ch.ListenerKey.Id, Op: ChangeDelete}, true
+	case *FrontendUpserted:
+		return &ChangeEvent{Type: "frontend", Id: ch.Frontend.Id, Op: ChangeUpsert}, true
+	case *FrontendDeleted:
+		return &ChangeEvent{Type: "frontend", Id: ch.FrontendKey.Id, Op: ChangeDelete}, true
+	case *MiddlewareUpserted:
+		return &ChangeEvent{Type: "middleware", Id: ch.Middleware.Id, Parent: ch.FrontendKey.Id, Op: ChangeUpsert}, true
+	case *MiddlewareDeleted:
+		return &ChangeEvent{Type: "middleware", Id: ch.MiddlewareKey.Id, Parent: ch.MiddlewareKey.FrontendKey.Id, Op: ChangeDelete}, true
+	case *BackendUpserted:
+		return &ChangeEvent{Type: "backend", Id: ch.Backend.Id, Op: ChangeUpsert}, true
+	case *BackendDeleted:
+		return &ChangeEvent{Type: "backend", Id: ch.BackendKey.Id, Op: ChangeDelete}, true
+	case *ServerUpserted:
+		return &ChangeEvent{Type: "server", Id: ch.Server.Id, Parent: ch.BackendKey.Id, Op: ChangeUpsert}, true
+	case *ServerDeleted:
+		return &ChangeEvent{Type: "server", Id: ch.ServerKey.Id, Parent: ch.ServerKey.BackendKey.Id, Op: ChangeDelete}, true
+	}
+	return nil, false
+}
@@ -3,6 +3,7 @@ package engine
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/router"
@@ -32,6 +33,23 @@ type rawListeners struct {
 	Listeners []json.RawMessage
 }
 
+type rawBackendSpec struct {
+	Backend json.RawMessage
+	Servers []json.RawMessage
+}
+
+type rawFrontendSpec struct {
+	Frontend    json.RawMessage
+	Middlewares []json.RawMessage
+}
+
+type rawSnapshot struct {
+	Hosts         []json.RawMessage
+	Listeners     []json.RawMessage
+	BackendSpecs  []rawBackendSpec
+	FrontendSpecs []rawFrontendSpec
+}
+
 type rawFrontend struct {
 	Id        string
 	Route     string
@@ -53,6 +71,8 @@ type RawMiddleware struct {
 	Type       string
 	Priority   int
 	Middleware json.RawMessage
+	// Sealed tells that the middleware parameters are sealed with the secret box by the engine
+	Sealed bool `json:",omitempty"`
 }
 
 func HostsFromJSON(in []byte) ([]Host, error) {
@@ -117,7 +137,60 @@ func ListenerFromJSON(in []byte, id ...string) (*Listener, error) {
 			return nil, err
 		}
 	}
-	return NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.ProxyProtocol, rl.Settings)
+	l, err := NewListener(rl.Id, rl.Protocol, rl.Address.Network, rl.Address.Address, rl.Scope, rl.ProxyProtocol, rl.Settings)
+	if err != nil {
+		return nil, err
+	}
+	if rl.MaxConnections < 0 {
+		return nil, fmt.Errorf("max connections should be >= 0, got %d", rl.MaxConnections)
+	}
+	l.MaxConnections = rl.MaxConnections
+	if rl.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("max header bytes should be >= 0, got %d", rl.MaxHeaderBytes)
+	}
+	l.MaxHeaderBytes = rl.MaxHeaderBytes
+	if rl.DisableHTTP2 && l.Protocol != HTTPS {
+		return nil, fmt.Errorf("only %s listeners negotiate HTTP/2", HTTPS)
+	}
+	l.DisableHTTP2 = rl.DisableHTTP2
+	if rl.RedirectToHTTPS != nil {
+		if l.Protocol != HTTP {
+			return nil, fmt.Errorf("only %s listeners can redirect to https", HTTP)
+		}
+		if err := rl.RedirectToHTTPS.Check(); err != nil {
+			return nil, err
+		}
+	}
+	l.RedirectToHTTPS = rl.RedirectToHTTPS
+	if rl.IdleTimeout != "" {
+		d, err := time.ParseDuration(rl.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid idle timeout: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("idle timeout should be > 0, got %v", d)
+		}
+	}
+	l.IdleTimeout = rl.IdleTimeout
+	if rl.SocketMode != "" {
+		if l.Address.Network != UNIX {
+			return nil, fmt.Errorf("socket mode is supported by %s listeners only", UNIX)
+		}
+		if _, err := parseSocketMode(rl.SocketMode); err != nil {
+			return nil, err
+		}
+	}
+	l.SocketMode = rl.SocketMode
+	if len(rl.ProxyProtocolTrustedCIDRs) != 0 {
+		if l.ProxyProtocol == "" {
+			return nil, fmt.Errorf("PROXY protocol trusted networks require the PROXY protocol")
+		}
+		if _, err := rl.ProxyProtocolTrustedNets(); err != nil {
+			return nil, err
+		}
+	}
+	l.ProxyProtocolTrustedCIDRs = rl.ProxyProtocolTrustedCIDRs
+	return l, nil
 }
 
 func ListenersFromJSON(in []byte) ([]Listener, error) {
@@ -153,18 +226,27 @@ func FrontendFromJSON(router router.Router, in []byte, id ...string) (*Frontend,
 	if err := json.Unmarshal(in, &rf); err != nil {
 		return nil, err
 	}
-	if rf.Type != HTTP {
+	if rf.Type != HTTP && rf.Type != TCP {
 		return nil, fmt.Errorf("Unsupported frontend type: %v", rf.Type)
 	}
+	if len(id) != 0 {
+		rf.Id = id[0]
+	}
+	if rf.Type == TCP {
+		var s TCPFrontendSettings
+		if rf.Settings != nil {
+			if err := json.Unmarshal(rf.Settings, &s); err != nil {
+				return nil, err
+			}
+		}
+		return NewTCPFrontend(rf.Id, rf.BackendId, s)
+	}
 	var s HTTPFrontendSettings
 	if rf.Settings != nil {
 		if err := json.Unmarshal(rf.Settings, &s); err != nil {
 			return nil, err
 		}
 	}
-	if len(id) != 0 {
-		rf.Id = id[0]
-	}
 	f, err := NewHTTPFrontend(router, rf.Id, rf.BackendId, rf.Route, s)
 	if err != nil {
 		return nil, err
@@ -296,5 +378,67 @@ func ServerFromJSON(in []byte, id ...string) (*Server, error) {
 	if len(id) != 0 {
 		e.Id = id[0]
 	}
-	return NewServer(e.Id, e.URL)
+	if e.Weight < 0 {
+		return nil, fmt.Errorf("server weight should be >= 0, got %d", e.Weight)
+	}
+	s, err := NewServer(e.Id, e.URL)
+	if err != nil {
+		return nil, err
+	}
+	s.Weight = e.Weight
+	return s, nil
+}
+
+// SnapshotFromJSON parses the whole configuration, every object is checked as if it was upserted alone
+func SnapshotFromJSON(router router.Router, getter plugin.SpecGetter, in []byte) (*Snapshot, error) {
+	var rs rawSnapshot
+	if err := json.Unmarshal(in, &rs); err != nil {
+		return nil, err
+	}
+	ss := &Snapshot{}
+	for _, raw := range rs.Hosts {
+		h, err := HostFromJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad host %s: %v", raw, err)
+		}
+		ss.Hosts = append(ss.Hosts, *h)
+	}
+	for _, raw := range rs.Listeners {
+		l, err := ListenerFromJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("bad listener %s: %v", raw, err)
+		}
+		ss.Listeners = append(ss.Listeners, *l)
+	}
+	for _, raw := range rs.BackendSpecs {
+		b, err := BackendFromJSON(raw.Backend)
+		if err != nil {
+			return nil, fmt.Errorf("bad backend %s: %v", raw.Backend, err)
+		}
+		bs := BackendSpec{Backend: *b}
+		for _, rawSrv := range raw.Servers {
+			srv, err := ServerFromJSON(rawSrv)
+			if err != nil {
+				return nil, fmt.Errorf("bad server %s of backend %v: %v", rawSrv, b.Id, err)
+			}
+			bs.Servers = append(bs.Servers, *srv)
+		}
+		ss.BackendSpecs = append(ss.BackendSpecs, bs)
+	}
+	for _, raw := range rs.FrontendSpecs {
+		f, err := FrontendFromJSON(router, raw.Frontend)
+		if err != nil {
+			return nil, fmt.Errorf("bad frontend %s: %v", raw.Frontend, err)
+		}
+		fs := FrontendSpec{Frontend: *f}
+		for _, rawM := range raw.Middlewares {
+			m, err := MiddlewareFromJSON(rawM, getter)
+			if err != nil {
+				return nil, fmt.Errorf("bad middleware %s of frontend %v: %v", rawM, f.Id, err)
+			}
+			fs.Middlewares = append(fs.Middlewares, *m)
+		}
+		ss.FrontendSpecs = append(ss.FrontendSpecs, fs)
+	}
+	return ss, nil
 }
@@ -3,6 +3,8 @@ package memng
 
 import (
 	"fmt"
+	"reflect"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,6 +27,16 @@ type Mem struct {
 	ChangesC    chan interface{}
 	ErrorsC     chan error
 	LogSeverity log.Level
+
+	// Challenges are the key authorizations of the pending ACME challenges, Orders are the owners of the order locks
+	acmeMtx    sync.Mutex
+	Challenges map[string]string
+	Orders     map[string]orderLock
+}
+
+type orderLock struct {
+	owner   string
+	expires time.Time
 }
 
 func New(r *plugin.Registry) engine.Engine {
@@ -39,6 +51,8 @@ func New(r *plugin.Registry) engine.Engine {
 		Registry:    r,
 		ChangesC:    make(chan interface{}, 1000),
 		ErrorsC:     make(chan error),
+		Challenges:  map[string]string{},
+		Orders:      map[string]orderLock{},
 	}
 }
 
@@ -167,6 +181,17 @@ func (m *Mem) UpsertListener(l engine.Listener) error {
 	return nil
 }
 
+func (m *Mem) SwapListener(old, l engine.Listener) error {
+	stored, ok := m.Listeners[engine.ListenerKey{Id: l.Id}]
+	if !ok {
+		return &engine.NotFoundError{}
+	}
+	if !reflect.DeepEqual(stored, old) {
+		return &engine.ConflictError{Message: fmt.Sprintf("listener '%v' has been changed, it was not updated", l.Id)}
+	}
+	return m.UpsertListener(l)
+}
+
 func (m *Mem) DeleteListener(lk engine.ListenerKey) error {
 	if _, ok := m.Listeners[lk]; !ok {
 		return &engine.NotFoundError{}
@@ -193,8 +218,10 @@ func (m *Mem) GetFrontend(k engine.FrontendKey) (*engine.Frontend, error) {
 }
 
 func (m *Mem) UpsertFrontend(f engine.Frontend, d time.Duration) error {
-	if _, ok := m.Backends[engine.BackendKey{Id: f.BackendId}]; !ok {
-		return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", f.BackendId)}
+	for _, id := range f.BackendIds() {
+		if _, ok := m.Backends[engine.BackendKey{Id: id}]; !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("backend: %v not found", id)}
+		}
 	}
 	m.Frontends[engine.FrontendKey{Id: f.Id}] = f
 	m.emit(&engine.FrontendUpserted{Frontend: f})
@@ -294,7 +321,7 @@ func (m *Mem) UpsertBackend(b engine.Backend) error {
 
 func (m *Mem) DeleteBackend(bk engine.BackendKey) error {
 	for _, f := range m.Frontends {
-		if f.BackendId == bk.Id {
+		if f.UsesBackend(bk) {
 			return fmt.Errorf("Backend is in use by %v", f)
 		}
 	}
@@ -362,6 +389,109 @@ func (m *Mem) DeleteServer(sk engine.ServerKey) error {
 	return &engine.NotFoundError{}
 }
 
+// UpsertChallenge stores the challenge, the ttl is not applied as the state is kept by the process only
+func (m *Mem) UpsertChallenge(token, keyAuth string, ttl time.Duration) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+	m.Challenges[token] = keyAuth
+	return nil
+}
+
+func (m *Mem) GetChallenge(token string) (string, error) {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+	keyAuth, ok := m.Challenges[token]
+	if !ok {
+		return "", &engine.NotFoundError{Message: fmt.Sprintf("challenge %v not found", token)}
+	}
+	return keyAuth, nil
+}
+
+func (m *Mem) DeleteChallenge(token string) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+	if _, ok := m.Challenges[token]; !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("challenge %v not found", token)}
+	}
+	delete(m.Challenges, token)
+	return nil
+}
+
+func (m *Mem) LockOrder(host, owner string, ttl time.Duration) (bool, error) {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+	now := time.Now()
+	if l, ok := m.Orders[host]; ok && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+	m.Orders[host] = orderLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *Mem) UnlockOrder(host, owner string) error {
+	m.acmeMtx.Lock()
+	defer m.acmeMtx.Unlock()
+	if l, ok := m.Orders[host]; ok && l.owner == owner {
+		delete(m.Orders, host)
+	}
+	return nil
+}
+
+// ApplyBatch applies the operations to the copy of the state, the state is replaced and the changes
+// are emitted only if all the operations have succeeded
+func (m *Mem) ApplyBatch(ops []engine.BatchOp) error {
+	c := m.clone(len(ops))
+	for i, op := range ops {
+		if err := engine.ApplyChange(c, op); err != nil {
+			return &engine.BatchError{Index: i, Err: err}
+		}
+	}
+	m.Hosts, m.Frontends, m.Backends, m.Listeners = c.Hosts, c.Frontends, c.Backends, c.Listeners
+	m.Middlewares, m.Servers = c.Middlewares, c.Servers
+	for {
+		select {
+		case change := <-c.ChangesC:
+			m.emit(change)
+		default:
+			return nil
+		}
+	}
+}
+
+// clone returns the deep copy of the state collecting changes of up to the given amount of operations
+func (m *Mem) clone(ops int) *Mem {
+	c := &Mem{
+		Hosts:       make(map[engine.HostKey]engine.Host, len(m.Hosts)),
+		Frontends:   make(map[engine.FrontendKey]engine.Frontend, len(m.Frontends)),
+		Backends:    make(map[engine.BackendKey]engine.Backend, len(m.Backends)),
+		Listeners:   make(map[engine.ListenerKey]engine.Listener, len(m.Listeners)),
+		Middlewares: make(map[engine.FrontendKey][]engine.Middleware, len(m.Middlewares)),
+		Servers:     make(map[engine.BackendKey][]engine.Server, len(m.Servers)),
+		Registry:    m.Registry,
+		ChangesC:    make(chan interface{}, ops),
+		LogSeverity: m.LogSeverity,
+	}
+	for k, v := range m.Hosts {
+		c.Hosts[k] = v
+	}
+	for k, v := range m.Frontends {
+		c.Frontends[k] = v
+	}
+	for k, v := range m.Backends {
+		c.Backends[k] = v
+	}
+	for k, v := range m.Listeners {
+		c.Listeners[k] = v
+	}
+	for k, v := range m.Middlewares {
+		c.Middlewares[k] = append([]engine.Middleware(nil), v...)
+	}
+	for k, v := range m.Servers {
+		c.Servers[k] = append([]engine.Server(nil), v...)
+	}
+	return c
+}
+
 func (m *Mem) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
 	for {
 		select {
@@ -48,6 +48,18 @@ func (s *MemSuite) TestHostWithOCSP(c *C) {
 	s.suite.HostWithOCSP(c)
 }
 
+func (s *MemSuite) TestHostWithACME(c *C) {
+	s.suite.HostWithACME(c)
+}
+
+func (s *MemSuite) TestACMEStore(c *C) {
+	s.suite.ACMEStore(c)
+}
+
+func (s *MemSuite) TestHostWithTLS(c *C) {
+	s.suite.HostWithTLS(c)
+}
+
 func (s *MemSuite) TestListenerCRUD(c *C) {
 	s.suite.ListenerCRUD(c)
 }
@@ -87,3 +99,15 @@ func (s *MemSuite) TestMiddlewareBadFrontend(c *C) {
 func (s *MemSuite) TestMiddlewareBadType(c *C) {
 	s.suite.MiddlewareBadType(c)
 }
+
+func (s *MemSuite) TestSwapListener(c *C) {
+	s.suite.SwapListener(c)
+}
+
+func (s *MemSuite) TestBatch(c *C) {
+	s.suite.Batch(c)
+}
+
+func (s *MemSuite) TestBatchInvalid(c *C) {
+	s.suite.BatchInvalid(c)
+}
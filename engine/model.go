@@ -4,13 +4,22 @@ package engine
 import (
 	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/vulcand/oxy/buffer"
+	"github.com/vulcand/oxy/cbreaker"
 	"github.com/vulcand/oxy/memmetrics"
 	"github.com/vulcand/route"
 	"github.com/vulcand/vulcand/plugin"
@@ -30,6 +39,36 @@ type StatsProvider interface {
 	// TopServers returns endpoints sorted by criteria (faulty, slow, mos used)
 	// if backendId is not empty, will filter out endpoints for that backendId
 	TopServers(*BackendKey) ([]Server, error)
+
+	// BackendHealth returns health state of the backend servers
+	BackendHealth(BackendKey) ([]ServerHealth, error)
+
+	// ProxyStats returns the snapshot of the listener connections and frontend request rates
+	ProxyStats() (*ProxyStats, error)
+
+	// LatencyStats returns the latency percentiles of the frontends and backends within the rolling window
+	LatencyStats() (*LatencyStats, error)
+}
+
+// ServerTimeouts are the read, write and idle timeouts of the listener servers, zero disables the timeout.
+// Listeners setting the idle timeout of their own keep it. The timeouts are the settings of the proxy instance,
+// they are not stored in the engine and the instance starts with the timeouts given on the command line.
+type ServerTimeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+}
+
+func (t ServerTimeouts) String() string {
+	return fmt.Sprintf("read=%v, write=%v, idle=%v", t.Read, t.Write, t.Idle)
+}
+
+// Check returns an error if any of the timeouts is negative
+func (t ServerTimeouts) Check() error {
+	if t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return fmt.Errorf("server timeouts should be >= 0, got %v", t)
+	}
+	return nil
 }
 
 type KeyPair struct {
@@ -70,7 +109,7 @@ func (l ListenerKey) String() string {
 // Listener specifies the listening point - the network and interface for each host. Host can have multiple interfaces.
 type Listener struct {
 	Id string
-	// HTTP or HTTPS
+	// HTTP, HTTPS or TCP, the connections of the TCP listener are passed as is to the TCP frontends
 	Protocol string
 	// Adddress specifies network (tcp or unix) and address (ip:port or path to unix socket)
 	Address Address
@@ -80,6 +119,111 @@ type Listener struct {
 	Settings *HTTPSListenerSettings `json:",omitempty"`
 	// Expect a ProxyProtocol Header on this listener: http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
 	ProxyProtocol string
+	// ProxyProtocolTrustedCIDRs are the networks allowed to send the PROXY protocol header, connections from other
+	// peers sending the header are closed. No peers are trusted if empty, ProxyProtocolTrustUnix trusts the peers
+	// of the unix socket listener.
+	ProxyProtocolTrustedCIDRs []string `json:",omitempty"`
+	// MaxConnections limits the amount of concurrent client connections, connections over the limit are closed
+	// right after they are accepted. Upgraded connections, e.g. WebSockets, count until they are closed.
+	// 0 means no limit.
+	MaxConnections int `json:",omitempty"`
+	// RedirectToHTTPS makes the plain HTTP listener answer every request with the permanent redirect
+	// to https, frontends are not matched for these requests
+	RedirectToHTTPS *HTTPSRedirectSettings `json:",omitempty"`
+	// IdleTimeout closes keep-alive connections idle for longer than this duration, overrides the idle timeout
+	// of the proxy if set
+	IdleTimeout string `json:",omitempty"`
+	// SocketMode sets the permissions of the socket file of the unix listener in octal, e.g. "0660".
+	// The socket file gets the permissions of the process umask if not set.
+	SocketMode string `json:",omitempty"`
+	// MaxHeaderBytes limits the size of the request headers, the requests with larger headers are rejected
+	// with 431. Overrides the limit of the proxy if set.
+	MaxHeaderBytes int `json:",omitempty"`
+	// DisableHTTP2 makes the HTTPS listener serve HTTP/1.1 only, the clients negotiate HTTP/2 with ALPN otherwise
+	DisableHTTP2 bool `json:",omitempty"`
+}
+
+// ProxyProtocolTrustUnix in the PROXY protocol trusted networks trusts the peers connecting to the unix socket,
+// they have no address to match the networks with
+const ProxyProtocolTrustUnix = "unix"
+
+// ProxyProtocolTrustedNets returns the parsed networks allowed to send the PROXY protocol header
+func (l *Listener) ProxyProtocolTrustedNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(l.ProxyProtocolTrustedCIDRs))
+	for _, c := range l.ProxyProtocolTrustedCIDRs {
+		if c == ProxyProtocolTrustUnix {
+			continue
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PROXY protocol trusted network '%v': %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ProxyProtocolTrustsUnix returns true if the peers of the unix socket are allowed to send the PROXY protocol header
+func (l *Listener) ProxyProtocolTrustsUnix() bool {
+	for _, c := range l.ProxyProtocolTrustedCIDRs {
+		if c == ProxyProtocolTrustUnix {
+			return true
+		}
+	}
+	return false
+}
+
+// SocketFileMode returns the parsed permissions of the unix socket file, 0 if not set
+func (l *Listener) SocketFileMode() os.FileMode {
+	m, err := parseSocketMode(l.SocketMode)
+	if err != nil {
+		return 0
+	}
+	return m
+}
+
+func parseSocketMode(v string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid socket mode '%v', expected octal permissions, e.g. 0660", v)
+	}
+	if m == 0 || m > 0777 {
+		return 0, fmt.Errorf("socket mode should be within 0001 and 0777, got %v", v)
+	}
+	return os.FileMode(m), nil
+}
+
+// IdleTimeoutDuration returns the parsed idle timeout of the listener connections, 0 if not set
+func (l *Listener) IdleTimeoutDuration() time.Duration {
+	d, err := time.ParseDuration(l.IdleTimeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// HTTPSRedirectSettings control the redirects of the HTTP listener to https
+type HTTPSRedirectSettings struct {
+	// Port is the https port put in the redirect location, the default https port is implied if 0
+	Port int `json:",omitempty"`
+	// ACME makes the listener answer ACME HTTP-01 challenges instead of redirecting them,
+	// so certificates can still be issued for the hosts
+	ACME bool `json:",omitempty"`
+}
+
+// Check validates the redirect settings
+func (r *HTTPSRedirectSettings) Check() error {
+	if r.Port < 0 || r.Port > 65535 {
+		return fmt.Errorf("redirect port should be in range 0-65535, got %d", r.Port)
+	}
+	return nil
+}
+
+func (r *HTTPSRedirectSettings) Equals(o *HTTPSRedirectSettings) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	return *r == *o
 }
 
 func (l *Listener) TLSConfig() (*tls.Config, error) {
@@ -89,6 +233,9 @@ func (l *Listener) TLSConfig() (*tls.Config, error) {
 	if l.Settings == nil {
 		return NewTLSConfig(&TLSSettings{})
 	}
+	if l.Settings.TLS.HasUpstreamSettings() {
+		return nil, fmt.Errorf("CA, client key pair and server name apply to the backend TLS settings only")
+	}
 	return NewTLSConfig(&l.Settings.TLS)
 }
 
@@ -96,12 +243,32 @@ func (l *Listener) String() string {
 	return fmt.Sprintf("Listener(%s, %s://%s, scope=%s)", l.Protocol, l.Address.Network, l.Address.Address, l.Scope)
 }
 
+// Equals returns true if the addresses are the same, the socket paths of the unix addresses are compared
+// in their clean form, so "/run/vulcand/../vulcand.sock" and "/run/vulcand.sock" are the same address
 func (a *Address) Equals(o Address) bool {
-	return a.Network == o.Network && a.Address == o.Address
+	if a.Network != o.Network {
+		return false
+	}
+	if a.Network == UNIX {
+		return filepath.Clean(a.Address) == filepath.Clean(o.Address)
+	}
+	return a.Address == o.Address
 }
 
 func (l *Listener) SettingsEquals(o *Listener) bool {
-	if o.ProxyProtocol != l.ProxyProtocol {
+	if o.ProxyProtocol != l.ProxyProtocol || o.MaxConnections != l.MaxConnections || o.IdleTimeout != l.IdleTimeout ||
+		o.SocketMode != l.SocketMode || o.MaxHeaderBytes != l.MaxHeaderBytes || o.DisableHTTP2 != l.DisableHTTP2 {
+		return false
+	}
+	if len(o.ProxyProtocolTrustedCIDRs) != len(l.ProxyProtocolTrustedCIDRs) {
+		return false
+	}
+	for i := range o.ProxyProtocolTrustedCIDRs {
+		if o.ProxyProtocolTrustedCIDRs[i] != l.ProxyProtocolTrustedCIDRs[i] {
+			return false
+		}
+	}
+	if !l.RedirectToHTTPS.Equals(o.RedirectToHTTPS) {
 		return false
 	}
 	if l.Settings == nil && o.Settings == nil {
@@ -167,7 +334,156 @@ func (o *OCSPSettings) Equals(other *OCSPSettings) bool {
 type HostSettings struct {
 	Default bool
 	KeyPair *KeyPair
-	OCSP    OCSPSettings
+	// KeyPairs are served along with KeyPair, e.g. the ECDSA certificate next to the RSA one. The certificate
+	// is selected by the server name and the signature algorithms supported by the client.
+	KeyPairs []KeyPair `json:",omitempty"`
+	OCSP     OCSPSettings
+	// ACME enables automatic provisioning of the host key pair
+	ACME *ACMESettings `json:",omitempty"`
+	// TLS restricts TLS versions and cipher suites for the host
+	TLS *HostTLSSettings `json:",omitempty"`
+	// ClientAuth turns on verification of the client certificates
+	ClientAuth *ClientAuthSettings `json:",omitempty"`
+	// ErrorPages replace the error responses of the proxy for requests to the host, keyed by the status code.
+	// They take precedence over the error pages set in the proxy options.
+	ErrorPages map[int]ErrorPage `json:",omitempty"`
+	// SecurityHeaders are added to the responses to the TLS requests of the host, whichever frontend has matched.
+	// Frontends can opt out with DisableSecurityHeaders.
+	SecurityHeaders *SecurityHeadersSettings `json:",omitempty"`
+}
+
+// SecurityHeadersSettings are the security headers set on the responses, they replace the headers of the same
+// name sent by the backends. Headers with empty values are not set.
+type SecurityHeadersSettings struct {
+	// HSTS sets Strict-Transport-Security
+	HSTS *HSTSSettings `json:",omitempty"`
+	// ContentTypeNosniff sets X-Content-Type-Options: nosniff
+	ContentTypeNosniff bool `json:",omitempty"`
+	// FrameOptions is the value of X-Frame-Options, DENY or SAMEORIGIN
+	FrameOptions string `json:",omitempty"`
+	// ContentSecurityPolicy is the value of Content-Security-Policy
+	ContentSecurityPolicy string `json:",omitempty"`
+}
+
+// HSTSSettings control the Strict-Transport-Security header
+type HSTSSettings struct {
+	// MaxAge is the time in seconds browsers should access the host over HTTPS only, 0 makes them forget the host
+	MaxAge int64
+	// IncludeSubDomains applies the policy to the subdomains of the host
+	IncludeSubDomains bool `json:",omitempty"`
+	// Preload allows the host to be included in the browser preload lists, it requires IncludeSubDomains
+	Preload bool `json:",omitempty"`
+}
+
+func (s *SecurityHeadersSettings) Check() error {
+	if s.HSTS != nil {
+		if s.HSTS.MaxAge < 0 {
+			return fmt.Errorf("HSTS max age should be >= 0, got %d", s.HSTS.MaxAge)
+		}
+		if s.HSTS.Preload && !s.HSTS.IncludeSubDomains {
+			return fmt.Errorf("HSTS preload requires includeSubDomains")
+		}
+	}
+	switch strings.ToUpper(s.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("unsupported X-Frame-Options '%v', use DENY or SAMEORIGIN", s.FrameOptions)
+	}
+	if strings.ContainsAny(s.ContentSecurityPolicy, "\r\n") {
+		return fmt.Errorf("Content-Security-Policy can not contain line breaks")
+	}
+	return nil
+}
+
+// Header returns the headers to set on the responses
+func (s *SecurityHeadersSettings) Header() http.Header {
+	h := make(http.Header)
+	if s.HSTS != nil {
+		v := fmt.Sprintf("max-age=%d", s.HSTS.MaxAge)
+		if s.HSTS.IncludeSubDomains {
+			v += "; includeSubDomains"
+		}
+		if s.HSTS.Preload {
+			v += "; preload"
+		}
+		h.Set("Strict-Transport-Security", v)
+	}
+	if s.ContentTypeNosniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if s.FrameOptions != "" {
+		h.Set("X-Frame-Options", strings.ToUpper(s.FrameOptions))
+	}
+	if s.ContentSecurityPolicy != "" {
+		h.Set("Content-Security-Policy", s.ContentSecurityPolicy)
+	}
+	return h
+}
+
+// ErrorPage is the response served instead of the error response generated by the proxy, e.g. 404 for
+// requests not matching any frontend or 502 when the backend is unreachable
+type ErrorPage struct {
+	// ContentType of the page, text/plain is used if empty. Templates of text/html pages escape the request fields,
+	// the fields of JSON pages are escaped to be placed inside the JSON strings and those of XML pages as XML text.
+	ContentType string `json:",omitempty"`
+	// Body is the Go template of the page, the request fields Status, StatusText, Method, Host and Path are
+	// available to the template
+	Body string
+}
+
+// CheckErrorPages validates the status codes and parses the templates of the error pages
+func CheckErrorPages(pages map[int]ErrorPage) error {
+	for code, p := range pages {
+		if code < 400 || code > 599 {
+			return fmt.Errorf("error page status should be between 400 and 599, got %d", code)
+		}
+		if _, err := template.New("").Parse(p.Body); err != nil {
+			return fmt.Errorf("error page %d: %v", code, err)
+		}
+	}
+	return nil
+}
+
+// AllKeyPairs returns KeyPair followed by KeyPairs, the first key pair is preferred
+// for the clients supporting several of them
+func (s *HostSettings) AllKeyPairs() []KeyPair {
+	if s.KeyPair == nil {
+		return s.KeyPairs
+	}
+	return append([]KeyPair{*s.KeyPair}, s.KeyPairs...)
+}
+
+// ACMESettings controls obtaining and renewing host certificates from the ACME certificate authority, e.g. Let's Encrypt.
+type ACMESettings struct {
+	// Email is the contact of the ACME account
+	Email string
+	// DirectoryURL is the ACME directory of the certificate authority, Let's Encrypt is default
+	DirectoryURL string
+	// Challenge is the challenge type used to prove control over the host, "http-01" is default and the only one supported
+	Challenge string
+	// AccountKey is the PEM encoded account key generated on the first registration, engines store it sealed
+	AccountKey []byte `json:",omitempty"`
+}
+
+// Check validates the ACME settings
+func (a *ACMESettings) Check() error {
+	if a.Challenge != "" && a.Challenge != ACMEChallengeHTTP01 {
+		return fmt.Errorf("unsupported ACME challenge '%s', supported challenges are %s", a.Challenge, ACMEChallengeHTTP01)
+	}
+	if a.DirectoryURL != "" {
+		if _, err := url.ParseRequestURI(a.DirectoryURL); err != nil {
+			return fmt.Errorf("invalid ACME directory URL '%s': %v", a.DirectoryURL, err)
+		}
+	}
+	return nil
+}
+
+// Directory returns the ACME directory URL with defaults applied
+func (a *ACMESettings) Directory() string {
+	if a.DirectoryURL == "" {
+		return DefaultACMEDirectoryURL
+	}
+	return a.DirectoryURL
 }
 
 type HostKey struct {
@@ -189,6 +505,34 @@ func NewHost(name string, settings HostSettings) (*Host, error) {
 	if name == "" {
 		return nil, fmt.Errorf("Hostname can not be empty")
 	}
+	if settings.ACME != nil {
+		if err := settings.ACME.Check(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.TLS != nil {
+		if err := settings.TLS.Check(); err != nil {
+			return nil, err
+		}
+	}
+	if settings.ClientAuth != nil {
+		if err := settings.ClientAuth.Check(); err != nil {
+			return nil, err
+		}
+	}
+	for i, kp := range settings.KeyPairs {
+		if _, err := NewKeyPair(kp.Cert, kp.Key); err != nil {
+			return nil, fmt.Errorf("key pair %d: %v", i, err)
+		}
+	}
+	if err := CheckErrorPages(settings.ErrorPages); err != nil {
+		return nil, err
+	}
+	if settings.SecurityHeaders != nil {
+		if err := settings.SecurityHeaders.Check(); err != nil {
+			return nil, err
+		}
+	}
 	return &Host{
 		Name:     name,
 		Settings: settings,
@@ -196,7 +540,8 @@ func NewHost(name string, settings HostSettings) (*Host, error) {
 }
 
 func (h *Host) String() string {
-	return fmt.Sprintf("Host(%s, keyPair=%t, ocsp=%t)", h.Name, h.Settings.KeyPair != nil, h.Settings.OCSP.Enabled)
+	return fmt.Sprintf("Host(%s, keyPairs=%d, ocsp=%t, acme=%t, clientAuth=%t)",
+		h.Name, len(h.Settings.AllKeyPairs()), h.Settings.OCSP.Enabled, h.Settings.ACME != nil, h.Settings.ClientAuth != nil)
 }
 
 func (h *Host) GetId() string {
@@ -214,7 +559,7 @@ type Frontend struct {
 	Settings interface{}     `json:",omitempty"`
 }
 
-// Limits contains various limits one can supply for a location.
+// Limits contains various limits one can supply for a location. Zero limits fall back to the limits of the proxy.
 type HTTPFrontendLimits struct {
 	MaxMemBodyBytes int64 // Maximum size to keep in memory before buffering to disk
 	MaxBodyBytes    int64 // Maximum size of a request body in bytes
@@ -228,7 +573,8 @@ type HTTPFrontendSettings struct {
 	FailoverPredicate string
 	// Used in forwarding headers
 	Hostname string
-	// In this case appends new forward info to the existing header
+	// The frontend is behind another proxy: appends new forward info to the existing X-Forwarded-For and passes
+	// X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port set by the proxy instead of replacing them
 	TrustForwardHeader bool
 	// Should host header be forwarded as-is?
 	PassHostHeader bool
@@ -236,6 +582,514 @@ type HTTPFrontendSettings struct {
 	Stream bool
 	// How frequently should we flush the stream?
 	StreamFlushIntervalNanoSecs int64
+	// Retry enables retries of failed upstream requests against the next server
+	Retry *HTTPFrontendRetry `json:",omitempty"`
+	// DisableAccessLog turns off access logging for this frontend
+	DisableAccessLog bool `json:",omitempty"`
+	// RateLimit limits the rate of requests per client
+	RateLimit *HTTPFrontendRateLimit `json:",omitempty"`
+	// CircuitBreaker serves the fallback response instead of forwarding requests while the backend is failing
+	CircuitBreaker *HTTPFrontendCircuitBreaker `json:",omitempty"`
+	// UpgradeIdleTimeout closes upgraded connections, e.g. WebSockets, idle for longer than this duration.
+	// Upgraded connections are not subject to the server write timeout and are not limited by default.
+	UpgradeIdleTimeout string `json:",omitempty"`
+	// Canary sends a share of the requests to another backend
+	Canary *HTTPFrontendCanary `json:",omitempty"`
+	// Mirror copies a share of the requests to the shadow backend
+	Mirror *HTTPFrontendMirror `json:",omitempty"`
+	// ForwardTimeout limits the time the server has to respond to the request forwarded by this frontend,
+	// including the response body. It takes precedence over the read and the response header timeouts of the
+	// backend, requests are cancelled with 504 once it expires. The body idle timeout of the backend applies
+	// with it, the frontends serving long downloads or streams should leave it unset and rely on the response
+	// header and the body idle timeouts of the backend instead.
+	ForwardTimeout string `json:",omitempty"`
+	// MaxRequestBodyBytes rejects requests with bodies larger than this with 413, whether the requests are
+	// buffered or streamed to the backend. 0 means no limit.
+	MaxRequestBodyBytes int64 `json:",omitempty"`
+	// Maintenance serves 503 to all requests of the frontend without forwarding them to the backend
+	Maintenance bool `json:",omitempty"`
+	// MaintenanceBody is the body of the maintenance response, the 503 error page of the host is served if empty
+	MaintenanceBody string `json:",omitempty"`
+	// MaintenanceContentType is the content type of the maintenance body, detected from the body if empty
+	MaintenanceContentType string `json:",omitempty"`
+	// DisableSecurityHeaders turns off the security headers of the host for this frontend
+	DisableSecurityHeaders bool `json:",omitempty"`
+	// MaxInFlight bounds the requests the frontend handles at once, the requests over the limit are rejected
+	// with 503. 0 means no limit.
+	MaxInFlight int64 `json:",omitempty"`
+	// MaxInFlightWait is how long the requests over the limit wait for a slot before they are rejected,
+	// they are rejected right away by default
+	MaxInFlightWait string `json:",omitempty"`
+	// RequestID assigns the id to every request of the frontend
+	RequestID *HTTPFrontendRequestID `json:",omitempty"`
+	// RouteHeader passes the ids of the frontend and the backend to the backend, the route header of the proxy
+	// applies if nil
+	RouteHeader *HTTPFrontendRouteHeader `json:",omitempty"`
+	// AllowedMethods rejects the requests with other methods with 405 and the Allow header listing the allowed
+	// ones, HEAD is allowed along with GET. All methods are allowed if empty.
+	AllowedMethods []string `json:",omitempty"`
+	// AllowedContentTypes rejects the requests with bodies of other media types with 415, e.g. "application/json"
+	// or "text/*". All types are allowed if empty.
+	AllowedContentTypes []string `json:",omitempty"`
+}
+
+// UpgradeIdleTimeoutDuration returns the parsed idle timeout of upgraded connections, 0 means no limit
+func (l HTTPFrontendSettings) UpgradeIdleTimeoutDuration() time.Duration {
+	d, err := time.ParseDuration(l.UpgradeIdleTimeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// ForwardTimeoutDuration returns the parsed forward timeout, 0 means the backend read timeout applies
+func (l HTTPFrontendSettings) ForwardTimeoutDuration() time.Duration {
+	d, err := time.ParseDuration(l.ForwardTimeout)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// MaxInFlightWaitDuration returns the parsed time the requests over the in flight limit wait for a slot
+func (l HTTPFrontendSettings) MaxInFlightWaitDuration() time.Duration {
+	d, err := time.ParseDuration(l.MaxInFlightWait)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// HTTPFrontendRetry controls retries of the failed upstream requests. Only requests with empty bodies
+// or bodies small enough to be buffered in memory are retried.
+type HTTPFrontendRetry struct {
+	// Attempts is the maximum amount of attempts including the first one, 2 is default
+	Attempts int
+	// On lists conditions that trigger a retry: "connect-failure", "timeout" and "5xx", "connect-failure" is default
+	On []string
+	// MaxBodyBytes is the maximum request body size that is buffered to be replayed, 64KB is default
+	MaxBodyBytes int64
+	// Budget caps the retries of the frontend, so the retries do not multiply the load on the failing backend.
+	// Retries are not limited if nil.
+	Budget *HTTPFrontendRetryBudget `json:",omitempty"`
+}
+
+// HTTPFrontendRetryBudget caps the retries at the share of the requests of the frontend over the sliding window,
+// the failed requests over the budget are served as is without retries
+type HTTPFrontendRetryBudget struct {
+	// Ratio is the maximum share of the retries to the requests, e.g. 0.1 allows one retry per 10 requests
+	Ratio float64
+	// Window is the sliding window the requests and the retries are counted over, 10s is default
+	Window string `json:",omitempty"`
+	// MinRetries are the retries allowed within the window regardless of the ratio, so the frontends with
+	// little traffic retry as well
+	MinRetries int64 `json:",omitempty"`
+}
+
+// Check validates the retry budget settings
+func (b *HTTPFrontendRetryBudget) Check() error {
+	if b.Ratio <= 0 || b.Ratio > 1 {
+		return fmt.Errorf("retry budget ratio should be within (0, 1], got %v", b.Ratio)
+	}
+	if b.Window != "" {
+		d, err := time.ParseDuration(b.Window)
+		if err != nil {
+			return fmt.Errorf("invalid retry budget window: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("retry budget window should be > 0, got %v", d)
+		}
+	}
+	if b.MinRetries < 0 {
+		return fmt.Errorf("retry budget min retries should be >= 0, got %d", b.MinRetries)
+	}
+	return nil
+}
+
+// WindowDuration returns the parsed sliding window with defaults applied
+func (b *HTTPFrontendRetryBudget) WindowDuration() time.Duration {
+	d, err := time.ParseDuration(b.Window)
+	if err != nil || d <= 0 {
+		return DefaultRetryBudgetWindow
+	}
+	return d
+}
+
+// HTTPFrontendRateLimit limits the rate of requests sharing the same key, requests over the limit are rejected
+// with 429 and the Retry-After header.
+type HTTPFrontendRateLimit struct {
+	// Requests is the average amount of requests per second allowed for every key
+	Requests int64
+	// Burst is the maximum amount of requests allowed at once, defaults to Requests
+	Burst int64 `json:",omitempty"`
+	// Key is the source requests are limited by: "client.ip" (default), "request.header.<Name>" or
+	// "request.claim.<name>", a claim of the bearer JWT. The rate limiter runs before the middlewares and
+	// does not verify the token signature, so the client picks the claim it is limited by. The claim keeps
+	// the well-behaved clients apart, it is not a defense against abuse, which the client.ip limit is.
+	Key string `json:",omitempty"`
+	// TrustedProxies lists CIDRs of the proxies allowed to set X-Forwarded-For to identify the client IP,
+	// the client address resolved with the proxy wide trusted proxies is used if empty
+	TrustedProxies []string `json:",omitempty"`
+	// MaxKeys bounds the amount of keys tracked in memory, expired and least recently used keys are evicted,
+	// 65536 is default
+	MaxKeys int `json:",omitempty"`
+}
+
+// Check validates the rate limit settings
+func (r *HTTPFrontendRateLimit) Check() error {
+	if r.Requests <= 0 {
+		return fmt.Errorf("rate limit requests should be > 0, got %d", r.Requests)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("rate limit burst should be >= 0, got %d", r.Burst)
+	}
+	if r.MaxKeys < 0 {
+		return fmt.Errorf("rate limit max keys should be >= 0, got %d", r.MaxKeys)
+	}
+	switch {
+	case r.Key == "" || r.Key == RateLimitKeyClientIP:
+	case strings.HasPrefix(r.Key, RateLimitKeyHeader) && len(r.Key) > len(RateLimitKeyHeader):
+	case strings.HasPrefix(r.Key, RateLimitKeyClaim) && len(r.Key) > len(RateLimitKeyClaim):
+	default:
+		return fmt.Errorf("unsupported rate limit key '%s'", r.Key)
+	}
+	if _, err := r.TrustedNets(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TrustedNets returns the parsed trusted proxy CIDRs
+func (r *HTTPFrontendRateLimit) TrustedNets() ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(r.TrustedProxies))
+	for _, cidr := range r.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy CIDR '%s': %v", cidr, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// BurstOrDefault returns the configured burst or the average rate if the burst is not set
+func (r *HTTPFrontendRateLimit) BurstOrDefault() int64 {
+	if r.Burst == 0 {
+		return r.Requests
+	}
+	return r.Burst
+}
+
+func (r *HTTPFrontendRateLimit) Equals(o *HTTPFrontendRateLimit) bool {
+	if r.Requests != o.Requests ||
+		r.Burst != o.Burst ||
+		r.Key != o.Key ||
+		r.MaxKeys != o.MaxKeys ||
+		len(r.TrustedProxies) != len(o.TrustedProxies) {
+		return false
+	}
+	for i := range r.TrustedProxies {
+		if r.TrustedProxies[i] != o.TrustedProxies[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// HTTPFrontendCircuitBreaker trips once the condition matches the recent responses of the backend. Tripped circuit
+// breaker serves the fallback response without forwarding requests for the fallback duration, then it gradually
+// lets the traffic back during the recovery duration and goes to standby unless the condition matches again.
+type HTTPFrontendCircuitBreaker struct {
+	// Condition trips the circuit breaker, e.g. "NetworkErrorRatio() > 0.5", "LatencyAtQuantileMS(50.0) > 50"
+	// or "ResponseCodeRatio(500, 600, 0, 600) > 0.5"
+	Condition string
+	// Fallback is the response served by the tripped circuit breaker, 503 with empty body is default
+	Fallback HTTPFallbackResponse
+	// FallbackDuration is the time the fallback is served for before recovery, "10s" is default
+	FallbackDuration string `json:",omitempty"`
+	// RecoveryDuration is the time to bring back the traffic to the backend, "10s" is default
+	RecoveryDuration string `json:",omitempty"`
+	// CheckPeriod is the period between condition checks, "100ms" is default
+	CheckPeriod string `json:",omitempty"`
+}
+
+// HTTPFrontendCanary splits the frontend traffic between the frontend backend and the canary backend, every request
+// is sent to the canary backend with the given probability.
+type HTTPFrontendCanary struct {
+	// BackendId is the id of the canary backend
+	BackendId string
+	// Percent of the requests sent to the canary backend, from 0 to 100
+	Percent float64
+	// Header is set on the responses to "canary" or "stable" naming the backend that served the request,
+	// no header is set if empty
+	Header string `json:",omitempty"`
+}
+
+// Check validates the canary settings of the frontend forwarding the requests to the backend
+func (c *HTTPFrontendCanary) Check(backendId string) error {
+	if c.BackendId == "" {
+		return fmt.Errorf("canary backend id can not be empty")
+	}
+	if c.BackendId == backendId {
+		return fmt.Errorf("canary backend should be different from the frontend backend '%v'", backendId)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent should be in range 0-100, got %v", c.Percent)
+	}
+	return nil
+}
+
+func (c *HTTPFrontendCanary) Equals(o *HTTPFrontendCanary) bool {
+	return *c == *o
+}
+
+// HTTPFrontendMirror copies the requests of the frontend to the shadow backend, every request is copied with the
+// given probability. Responses of the shadow backend are discarded, the clients get the responses of the frontend
+// backend only.
+type HTTPFrontendMirror struct {
+	// BackendId is the id of the shadow backend
+	BackendId string
+	// Percent of the requests copied to the shadow backend, from 0 to 100
+	Percent float64
+	// MaxBodyBytes is the largest request body buffered to be copied, requests with larger bodies are not
+	// copied, 64KB is default
+	MaxBodyBytes int64 `json:",omitempty"`
+}
+
+// Check validates the mirror settings of the frontend forwarding the requests to the backend
+func (m *HTTPFrontendMirror) Check(backendId string) error {
+	if m.BackendId == "" {
+		return fmt.Errorf("mirror backend id can not be empty")
+	}
+	if m.BackendId == backendId {
+		return fmt.Errorf("mirror backend should be different from the frontend backend '%v'", backendId)
+	}
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("mirror percent should be in range 0-100, got %v", m.Percent)
+	}
+	if m.MaxBodyBytes < 0 {
+		return fmt.Errorf("mirror max body bytes should be >= 0, got %d", m.MaxBodyBytes)
+	}
+	return nil
+}
+
+// BodyLimit returns the maximum size of the copied request body with defaults applied
+func (m *HTTPFrontendMirror) BodyLimit() int64 {
+	if m.MaxBodyBytes == 0 {
+		return DefaultMirrorMaxBodyBytes
+	}
+	return m.MaxBodyBytes
+}
+
+func (m *HTTPFrontendMirror) Equals(o *HTTPFrontendMirror) bool {
+	return *m == *o
+}
+
+// HTTPFrontendRequestID assigns the id to the requests of the frontend, so the log lines of the proxy and the
+// services can be correlated. The id is passed to the backend, returned to the client and recorded in the access
+// log and the trace of the request. The id supplied by the client is kept, unless it does not match the pattern.
+type HTTPFrontendRequestID struct {
+	// Header carrying the id, X-Request-Id by default
+	Header string `json:",omitempty"`
+	// Pattern is the regular expression the ids supplied by the clients should match as a whole, the ids that
+	// do not match are replaced with the generated ones. Any id is accepted if empty.
+	Pattern string `json:",omitempty"`
+}
+
+// Check validates the request id settings
+func (r *HTTPFrontendRequestID) Check() error {
+	if r.Header != "" && !plugin.ValidHeaderName(r.Header) {
+		return fmt.Errorf("invalid request id header '%v'", r.Header)
+	}
+	if _, err := r.Regexp(); err != nil {
+		return fmt.Errorf("invalid request id pattern: %v", err)
+	}
+	return nil
+}
+
+// HeaderName returns the canonical name of the request id header with defaults applied
+func (r *HTTPFrontendRequestID) HeaderName() string {
+	if r.Header == "" {
+		return DefaultRequestIDHeader
+	}
+	return http.CanonicalHeaderKey(r.Header)
+}
+
+// Regexp returns the compiled pattern of the supplied ids, nil if any id is accepted. The pattern is anchored,
+// the id should match it as a whole.
+func (r *HTTPFrontendRequestID) Regexp() (*regexp.Regexp, error) {
+	if r.Pattern == "" {
+		return nil, nil
+	}
+	if _, err := regexp.Compile(r.Pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + r.Pattern + ")$")
+}
+
+func (r *HTTPFrontendRequestID) Equals(o *HTTPFrontendRequestID) bool {
+	return *r == *o
+}
+
+// HTTPFrontendRouteHeader adds the header carrying the ids of the frontend that has matched the request and
+// the backend it is forwarded to, e.g. "frontend=f1; backend=b1", so the log lines of the backends can be
+// correlated with the access log. The header sent by the client is kept unless Override is set.
+type HTTPFrontendRouteHeader struct {
+	// Header carrying the ids, X-Vulcand-Route by default
+	Header string `json:",omitempty"`
+	// Override replaces the header sent by the client
+	Override bool `json:",omitempty"`
+	// Disabled turns the route header of the proxy off for the frontend
+	Disabled bool `json:",omitempty"`
+}
+
+// Check validates the route header settings
+func (r *HTTPFrontendRouteHeader) Check() error {
+	if r.Header != "" && !plugin.ValidHeaderName(r.Header) {
+		return fmt.Errorf("invalid route header '%v'", r.Header)
+	}
+	return nil
+}
+
+// HeaderName returns the canonical name of the route header with defaults applied
+func (r *HTTPFrontendRouteHeader) HeaderName() string {
+	if r.Header == "" {
+		return DefaultRouteHeader
+	}
+	return http.CanonicalHeaderKey(r.Header)
+}
+
+func (r *HTTPFrontendRouteHeader) Equals(o *HTTPFrontendRouteHeader) bool {
+	return *r == *o
+}
+
+// HTTPFallbackResponse is a static response served instead of the backend one
+type HTTPFallbackResponse struct {
+	StatusCode  int    `json:",omitempty"`
+	ContentType string `json:",omitempty"`
+	Body        string `json:",omitempty"`
+}
+
+// CircuitBreakerSettings contains parsed circuit breaker parameters
+type CircuitBreakerSettings struct {
+	Condition        string
+	Fallback         HTTPFallbackResponse
+	FallbackDuration time.Duration
+	RecoveryDuration time.Duration
+	CheckPeriod      time.Duration
+}
+
+// Settings validates the circuit breaker and returns parsed parameters with defaults applied
+func (b *HTTPFrontendCircuitBreaker) Settings() (*CircuitBreakerSettings, error) {
+	s := &CircuitBreakerSettings{
+		Condition:        b.Condition,
+		Fallback:         b.Fallback,
+		FallbackDuration: DefaultCircuitBreakerFallbackDuration,
+		RecoveryDuration: DefaultCircuitBreakerRecoveryDuration,
+		CheckPeriod:      DefaultCircuitBreakerCheckPeriod,
+	}
+	if _, err := cbreaker.New(nil, b.Condition); err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker condition '%s': %v", b.Condition, err)
+	}
+	if s.Fallback.StatusCode == 0 {
+		s.Fallback.StatusCode = http.StatusServiceUnavailable
+	}
+	if s.Fallback.StatusCode < 100 || s.Fallback.StatusCode > 599 {
+		return nil, fmt.Errorf("invalid circuit breaker fallback status code: %d", s.Fallback.StatusCode)
+	}
+	durations := []struct {
+		name string
+		in   string
+		out  *time.Duration
+	}{
+		{"fallback duration", b.FallbackDuration, &s.FallbackDuration},
+		{"recovery duration", b.RecoveryDuration, &s.RecoveryDuration},
+		{"check period", b.CheckPeriod, &s.CheckPeriod},
+	}
+	for _, d := range durations {
+		if d.in == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid circuit breaker %s: %s", d.name, err)
+		}
+		if v <= 0 {
+			return nil, fmt.Errorf("circuit breaker %s should be > 0, got %v", d.name, v)
+		}
+		*d.out = v
+	}
+	return s, nil
+}
+
+func (b *HTTPFrontendCircuitBreaker) Equals(o *HTTPFrontendCircuitBreaker) bool {
+	return *b == *o
+}
+
+// Check validates the retry settings
+func (r *HTTPFrontendRetry) Check() error {
+	if r.Attempts < 0 {
+		return fmt.Errorf("retry attempts should be >= 0, got %d", r.Attempts)
+	}
+	if r.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry max body bytes should be >= 0, got %d", r.MaxBodyBytes)
+	}
+	for _, on := range r.On {
+		switch on {
+		case RetryOnConnectFailure, RetryOnTimeout, RetryOn5xx:
+		default:
+			return fmt.Errorf("unsupported retry condition '%s', supported conditions are %s, %s and %s",
+				on, RetryOnConnectFailure, RetryOnTimeout, RetryOn5xx)
+		}
+	}
+	if r.Budget != nil {
+		return r.Budget.Check()
+	}
+	return nil
+}
+
+// MaxAttempts returns the maximum amount of attempts with defaults applied
+func (r *HTTPFrontendRetry) MaxAttempts() int {
+	if r.Attempts == 0 {
+		return DefaultRetryAttempts
+	}
+	return r.Attempts
+}
+
+// BodyLimit returns the maximum size of the replayable request body with defaults applied
+func (r *HTTPFrontendRetry) BodyLimit() int64 {
+	if r.MaxBodyBytes == 0 {
+		return DefaultRetryMaxBodyBytes
+	}
+	return r.MaxBodyBytes
+}
+
+// RetryOn returns true if the requests should be retried on the given condition
+func (r *HTTPFrontendRetry) RetryOn(condition string) bool {
+	if len(r.On) == 0 {
+		return condition == RetryOnConnectFailure
+	}
+	for _, on := range r.On {
+		if on == condition {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *HTTPFrontendRetry) Equals(o *HTTPFrontendRetry) bool {
+	if r.Attempts != o.Attempts || r.MaxBodyBytes != o.MaxBodyBytes || len(r.On) != len(o.On) {
+		return false
+	}
+	if (r.Budget == nil) != (o.Budget == nil) || (r.Budget != nil && *r.Budget != *o.Budget) {
+		return false
+	}
+	for i := range r.On {
+		if r.On[i] != o.On[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func NewAddress(network, address string) (*Address, error) {
@@ -253,8 +1107,8 @@ func NewAddress(network, address string) (*Address, error) {
 
 func NewListener(id, protocol, network, address, scope, proxyHeader string, settings *HTTPSListenerSettings) (*Listener, error) {
 	protocol = strings.ToLower(protocol)
-	if protocol != HTTP && protocol != HTTPS {
-		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http and https", protocol)
+	if protocol != HTTP && protocol != HTTPS && protocol != TCP {
+		return nil, fmt.Errorf("unsupported protocol '%s', supported protocols are http, https and tcp", protocol)
 	}
 
 	if scope != "" {
@@ -270,7 +1124,7 @@ func NewListener(id, protocol, network, address, scope, proxyHeader string, sett
 
 	proxyHeader = strings.ToUpper(proxyHeader)
 	switch proxyHeader {
-	case "PROXY_V1":
+	case PROXY_PROTO_V1, PROXY_PROTO_V2:
 		break
 	case "":
 		break
@@ -278,7 +1132,7 @@ func NewListener(id, protocol, network, address, scope, proxyHeader string, sett
 		proxyHeader = ""
 		break
 	default:
-		return nil, fmt.Errorf("Unsupported Proxy Header '%s', must be `PROXY_V1` or `NONE`", proxyHeader)
+		return nil, fmt.Errorf("Unsupported Proxy Header '%s', must be `PROXY_V1`, `PROXY_V2` or `NONE`", proxyHeader)
 
 	}
 
@@ -297,13 +1151,110 @@ func NewHTTPFrontend(router router.Router, id, backendId string, routeExpr strin
 		return nil, fmt.Errorf("supply valid  route, id, and backendId")
 	}
 
-	// Make sure location path is a valid route expression
-	if !router.IsValid(routeExpr) {
-		return nil, fmt.Errorf("route should be a valid route expression: %s", routeExpr)
+	// Make sure location path is a valid route expression
+	if !router.IsValid(routeExpr) {
+		return nil, fmt.Errorf("route should be a valid route expression: %s", routeExpr)
+	}
+
+	if !settings.Stream && settings.FailoverPredicate != "" && !buffer.IsValidExpression(settings.FailoverPredicate) {
+		return nil, fmt.Errorf("invalid failover predicate: %s", settings.FailoverPredicate)
+	}
+
+	if settings.Retry != nil {
+		if err := settings.Retry.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.RateLimit != nil {
+		if err := settings.RateLimit.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.CircuitBreaker != nil {
+		if _, err := settings.CircuitBreaker.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.Canary != nil {
+		if err := settings.Canary.Check(backendId); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.Mirror != nil {
+		if err := settings.Mirror.Check(backendId); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.ForwardTimeout != "" {
+		d, err := time.ParseDuration(settings.ForwardTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid forward timeout: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("forward timeout should be > 0, got %v", d)
+		}
+	}
+
+	if settings.Limits.MaxMemBodyBytes < 0 || settings.Limits.MaxBodyBytes < 0 {
+		return nil, fmt.Errorf("buffer limits should be >= 0, got memory %v and total %v",
+			settings.Limits.MaxMemBodyBytes, settings.Limits.MaxBodyBytes)
+	}
+
+	if settings.MaxRequestBodyBytes < 0 {
+		return nil, fmt.Errorf("max request body bytes should be >= 0, got %v", settings.MaxRequestBodyBytes)
+	}
+
+	if settings.UpgradeIdleTimeout != "" {
+		d, err := time.ParseDuration(settings.UpgradeIdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upgrade idle timeout: %v", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("upgrade idle timeout should be >= 0, got %v", d)
+		}
+	}
+
+	if settings.RequestID != nil {
+		if err := settings.RequestID.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.RouteHeader != nil {
+		if err := settings.RouteHeader.Check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.MaxInFlight < 0 {
+		return nil, fmt.Errorf("max in flight requests should be >= 0, got %v", settings.MaxInFlight)
+	}
+
+	for _, m := range settings.AllowedMethods {
+		if !plugin.ValidHeaderName(m) {
+			return nil, fmt.Errorf("invalid allowed method '%v'", m)
+		}
+	}
+
+	for _, t := range settings.AllowedContentTypes {
+		if err := checkMediaRange(t); err != nil {
+			return nil, err
+		}
 	}
 
-	if !settings.Stream && settings.FailoverPredicate != "" && !buffer.IsValidExpression(settings.FailoverPredicate) {
-		return nil, fmt.Errorf("invalid failover predicate: %s", settings.FailoverPredicate)
+	if settings.MaxInFlightWait != "" {
+		d, err := time.ParseDuration(settings.MaxInFlightWait)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max in flight wait: %v", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("max in flight wait should be >= 0, got %v", d)
+		}
 	}
 
 	return &Frontend{
@@ -324,7 +1275,58 @@ func (l HTTPFrontendSettings) Equals(o HTTPFrontendSettings) bool {
 		l.Limits.MaxBodyBytes == o.Limits.MaxBodyBytes &&
 		l.FailoverPredicate == o.FailoverPredicate &&
 		l.Hostname == o.Hostname &&
-		l.TrustForwardHeader == o.TrustForwardHeader)
+		l.TrustForwardHeader == o.TrustForwardHeader &&
+		l.DisableAccessLog == o.DisableAccessLog &&
+		l.UpgradeIdleTimeout == o.UpgradeIdleTimeout &&
+		l.MaxRequestBodyBytes == o.MaxRequestBodyBytes &&
+		l.ForwardTimeout == o.ForwardTimeout &&
+		l.Maintenance == o.Maintenance &&
+		l.MaintenanceBody == o.MaintenanceBody &&
+		l.MaintenanceContentType == o.MaintenanceContentType &&
+		l.DisableSecurityHeaders == o.DisableSecurityHeaders &&
+		l.MaxInFlight == o.MaxInFlight &&
+		l.MaxInFlightWait == o.MaxInFlightWait &&
+		((l.RateLimit == nil && o.RateLimit == nil) ||
+			((l.RateLimit != nil && o.RateLimit != nil) && l.RateLimit.Equals(o.RateLimit))) &&
+		((l.CircuitBreaker == nil && o.CircuitBreaker == nil) ||
+			((l.CircuitBreaker != nil && o.CircuitBreaker != nil) && l.CircuitBreaker.Equals(o.CircuitBreaker))) &&
+		((l.Retry == nil && o.Retry == nil) ||
+			((l.Retry != nil && o.Retry != nil) && l.Retry.Equals(o.Retry))) &&
+		((l.Canary == nil && o.Canary == nil) ||
+			((l.Canary != nil && o.Canary != nil) && l.Canary.Equals(o.Canary))) &&
+		((l.Mirror == nil && o.Mirror == nil) ||
+			((l.Mirror != nil && o.Mirror != nil) && l.Mirror.Equals(o.Mirror))) &&
+		((l.RequestID == nil && o.RequestID == nil) ||
+			((l.RequestID != nil && o.RequestID != nil) && l.RequestID.Equals(o.RequestID))) &&
+		((l.RouteHeader == nil && o.RouteHeader == nil) ||
+			((l.RouteHeader != nil && o.RouteHeader != nil) && l.RouteHeader.Equals(o.RouteHeader))) &&
+		stringsEqual(l.AllowedMethods, o.AllowedMethods) &&
+		stringsEqual(l.AllowedContentTypes, o.AllowedContentTypes))
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMediaRange validates the media type or the range of them, e.g. "application/json", "text/*" or "*/*"
+func checkMediaRange(t string) error {
+	mt, params, err := mime.ParseMediaType(t)
+	if err != nil {
+		return fmt.Errorf("invalid allowed content type '%v': %v", t, err)
+	}
+	i := strings.Index(mt, "/")
+	if i <= 0 || i == len(mt)-1 || len(params) != 0 || (mt[:i] == "*" && mt[i+1:] != "*") {
+		return fmt.Errorf("allowed content type should be 'type/subtype', 'type/*' or '*/*', got '%v'", t)
+	}
+	return nil
 }
 
 func (f *Frontend) String() string {
@@ -339,6 +1341,138 @@ func (l *Frontend) GetKey() FrontendKey {
 	return FrontendKey{Id: l.Id}
 }
 
+// TCPFrontendSettings are the settings of the TCP frontend, it takes the connections of the TCP listener and passes
+// them as is to the backend server with the least connections. The connections are matched by the server name the
+// TLS clients send, so the TLS is terminated by the backend servers.
+type TCPFrontendSettings struct {
+	// ListenerId is the TCP listener the frontend takes the connections of
+	ListenerId string
+	// ServerNames are matched against the server name of the TLS connections, "*.example.com" matches the names
+	// one label below example.com. The frontend without the server names takes the rest of the listener
+	// connections, including the ones not speaking TLS and the ones the clients do not speak first on, e.g. to
+	// the servers greeting the clients.
+	ServerNames []string `json:",omitempty"`
+	// DialTimeout limits the time connecting to the backend server, the connection to the server is not limited
+	// in time if not set
+	DialTimeout string `json:",omitempty"`
+	// IdleTimeout closes the connections no bytes were passed over for this long, idle connections are kept
+	// open if not set
+	IdleTimeout string `json:",omitempty"`
+}
+
+// Check validates the TCP frontend settings
+func (s *TCPFrontendSettings) Check() error {
+	if s.ListenerId == "" {
+		return fmt.Errorf("supply listener id of the TCP frontend")
+	}
+	for _, name := range s.ServerNames {
+		if !validServerName(name) {
+			return fmt.Errorf("invalid server name '%v'", name)
+		}
+	}
+	if _, _, err := s.Timeouts(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Timeouts returns the parsed dial and idle timeouts, zero timeouts are not set
+func (s *TCPFrontendSettings) Timeouts() (time.Duration, time.Duration, error) {
+	var dial, idle time.Duration
+	var err error
+	if s.DialTimeout != "" {
+		if dial, err = time.ParseDuration(s.DialTimeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid dial timeout: %v", err)
+		}
+		if dial < 0 {
+			return 0, 0, fmt.Errorf("dial timeout should be >= 0, got %v", dial)
+		}
+	}
+	if s.IdleTimeout != "" {
+		if idle, err = time.ParseDuration(s.IdleTimeout); err != nil {
+			return 0, 0, fmt.Errorf("invalid idle timeout: %v", err)
+		}
+		if idle < 0 {
+			return 0, 0, fmt.Errorf("idle timeout should be >= 0, got %v", idle)
+		}
+	}
+	return dial, idle, nil
+}
+
+func (s TCPFrontendSettings) Equals(o TCPFrontendSettings) bool {
+	if s.ListenerId != o.ListenerId || s.DialTimeout != o.DialTimeout || s.IdleTimeout != o.IdleTimeout ||
+		len(s.ServerNames) != len(o.ServerNames) {
+		return false
+	}
+	for i := range s.ServerNames {
+		if s.ServerNames[i] != o.ServerNames[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// validServerName returns true for the lower case host names, the first label can be the wildcard
+func validServerName(name string) bool {
+	if name == "" || name != strings.ToLower(name) || strings.HasSuffix(name, ".") {
+		return false
+	}
+	for i, label := range strings.Split(name, ".") {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func NewTCPFrontend(id, backendId string, settings TCPFrontendSettings) (*Frontend, error) {
+	if len(id) == 0 || len(backendId) == 0 {
+		return nil, fmt.Errorf("supply valid id and backendId")
+	}
+	if err := settings.Check(); err != nil {
+		return nil, err
+	}
+	return &Frontend{
+		Id:        id,
+		BackendId: backendId,
+		Type:      TCP,
+		Settings:  settings,
+	}, nil
+}
+
+func (f *Frontend) TCPSettings() TCPFrontendSettings {
+	return (f.Settings).(TCPFrontendSettings)
+}
+
+// BackendIds returns the ids of all backends the frontend forwards requests to
+func (l *Frontend) BackendIds() []string {
+	ids := []string{l.BackendId}
+	s, ok := l.Settings.(HTTPFrontendSettings)
+	if !ok {
+		return ids
+	}
+	if s.Canary != nil {
+		ids = append(ids, s.Canary.BackendId)
+	}
+	if s.Mirror != nil && (s.Canary == nil || s.Canary.BackendId != s.Mirror.BackendId) {
+		ids = append(ids, s.Mirror.BackendId)
+	}
+	return ids
+}
+
+// UsesBackend returns true if the frontend forwards requests to the backend
+func (l *Frontend) UsesBackend(bk BackendKey) bool {
+	for _, id := range l.BackendIds() {
+		if id == bk.Id {
+			return true
+		}
+	}
+	return false
+}
+
 type HTTPBackendTimeouts struct {
 	// Socket read timeout (before we receive the first reply header)
 	Read string
@@ -346,6 +1480,14 @@ type HTTPBackendTimeouts struct {
 	Dial string
 	// TLS handshake timeout
 	TLSHandshake string
+	// Drain is how long the deleted servers are given to finish the requests in flight before they are removed
+	Drain string `json:",omitempty"`
+	// ResponseHeader limits the time to the first byte: from the request being written to the server to the
+	// response headers being read. It takes precedence over the read timeout, which limits the same time.
+	ResponseHeader string `json:",omitempty"`
+	// BodyIdle cancels the responses with no bytes of the body read from the server for this long, so the
+	// stalled servers are cut off while the long downloads and streams go on. Not limited by default.
+	BodyIdle string `json:",omitempty"`
 }
 
 type HTTPBackendKeepAlive struct {
@@ -353,6 +1495,11 @@ type HTTPBackendKeepAlive struct {
 	Period string
 	// How many idle connections will be kept per host
 	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits connections to every server, requests over the limit wait for a connection
+	// up to the dial timeout and fail with 503 afterwards, no limit by default. It applies to the HTTP/1.1
+	// backends only, the h2c backends multiplex the requests over the single connection to every server
+	// and open another one only when the server limits the concurrent streams, so the limit is ignored.
+	MaxConnsPerHost int `json:",omitempty"`
 }
 
 type HTTPBackendSettings struct {
@@ -362,16 +1509,527 @@ type HTTPBackendSettings struct {
 	KeepAlive HTTPBackendKeepAlive
 	// TLS provides optional TLS settings for HTTP backend
 	TLS *TLSSettings `json:",omitempty"`
+	// HealthCheck enables active health checking of the backend servers
+	HealthCheck *HealthCheck `json:",omitempty"`
+	// OutlierDetection enables passive ejection of servers failing live requests
+	OutlierDetection *OutlierDetection `json:",omitempty"`
+	// StickySession pins clients to the servers with the affinity cookie
+	StickySession *StickySession `json:",omitempty"`
+	// Protocol spoken to the backend servers, "http/1.1" is default, "h2c" is HTTP/2 with prior knowledge over
+	// cleartext connections, e.g. for gRPC servers
+	Protocol string `json:",omitempty"`
+	// Discovery adds the servers resolved from the DNS SRV records to the backend
+	Discovery *ServerDiscovery `json:",omitempty"`
+	// SlowStart ramps up the traffic to the servers added to the backend or recovered from health check failures
+	SlowStart *SlowStart `json:",omitempty"`
+	// LoadBalancer selects the algorithm picking the server for the request, weighted round robin is default
+	LoadBalancer *LoadBalancer `json:",omitempty"`
 }
 
 func (s *HTTPBackendSettings) Equals(o HTTPBackendSettings) bool {
-	return (s.Timeouts.Read == o.Timeouts.Read &&
+	return (s.Protocol == o.Protocol &&
+		s.Timeouts.Read == o.Timeouts.Read &&
 		s.Timeouts.Dial == o.Timeouts.Dial &&
 		s.Timeouts.TLSHandshake == o.Timeouts.TLSHandshake &&
+		s.Timeouts.Drain == o.Timeouts.Drain &&
+		s.Timeouts.ResponseHeader == o.Timeouts.ResponseHeader &&
+		s.Timeouts.BodyIdle == o.Timeouts.BodyIdle &&
 		s.KeepAlive.Period == o.KeepAlive.Period &&
 		s.KeepAlive.MaxIdleConnsPerHost == o.KeepAlive.MaxIdleConnsPerHost &&
+		s.KeepAlive.MaxConnsPerHost == o.KeepAlive.MaxConnsPerHost &&
 		((s.TLS == nil && o.TLS == nil) ||
-			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS))))
+			((s.TLS != nil && o.TLS != nil) && s.TLS.Equals(o.TLS))) &&
+		((s.HealthCheck == nil && o.HealthCheck == nil) ||
+			((s.HealthCheck != nil && o.HealthCheck != nil) && s.HealthCheck.Equals(o.HealthCheck))) &&
+		((s.StickySession == nil && o.StickySession == nil) ||
+			((s.StickySession != nil && o.StickySession != nil) && *s.StickySession == *o.StickySession)) &&
+		((s.OutlierDetection == nil && o.OutlierDetection == nil) ||
+			((s.OutlierDetection != nil && o.OutlierDetection != nil) && *s.OutlierDetection == *o.OutlierDetection)) &&
+		((s.Discovery == nil && o.Discovery == nil) ||
+			((s.Discovery != nil && o.Discovery != nil) && *s.Discovery == *o.Discovery)) &&
+		((s.SlowStart == nil && o.SlowStart == nil) ||
+			((s.SlowStart != nil && o.SlowStart != nil) && *s.SlowStart == *o.SlowStart)) &&
+		((s.LoadBalancer == nil && o.LoadBalancer == nil) ||
+			((s.LoadBalancer != nil && o.LoadBalancer != nil) && *s.LoadBalancer == *o.LoadBalancer)))
+}
+
+// LoadBalancer is the algorithm the frontends pick the backend servers with, all of them respect the server weights
+type LoadBalancer struct {
+	// Algorithm is one of roundrobin, leastconn, random or hash. The round robin adjusts the weights by the error
+	// ratios of the servers, leastconn picks the server with the least requests in flight and hash sends the
+	// requests with the same hash key to the same server.
+	Algorithm string
+	// HashKey is the part of the request the hash algorithm hashes, "ip" hashes the client IP and is default,
+	// "header:<name>" hashes the header value and falls back to the client IP if the header is missing,
+	// "path" hashes the URL path, "path:<n>" the prefix of the first n path segments, and "url" hashes
+	// the host with the path and the query
+	HashKey string `json:",omitempty"`
+	// LoadFactor bounds the load of the servers picked by the hash algorithm: the server takes at most
+	// LoadFactor times its share of the requests in flight, the requests over the bound go to the next servers
+	// on the ring. Unbounded if zero.
+	LoadFactor float64 `json:",omitempty"`
+}
+
+// LoadBalancerSettings contains parsed load balancer parameters
+type LoadBalancerSettings struct {
+	Algorithm string
+	// HashSource is the part of the request hashed by the hash algorithm, one of the HashKey constants
+	HashSource string
+	// HashHeader is the header hashed by the hash algorithm, the client IP is hashed if it is missing
+	HashHeader string
+	// HashPathSegments is the amount of the leading path segments hashed, the whole path is hashed if zero
+	HashPathSegments int
+	// LoadFactor bounds the load of the servers picked by the hash algorithm, unbounded if zero
+	LoadFactor float64
+}
+
+// Settings validates the load balancer and returns parsed parameters with defaults applied
+func (l *LoadBalancer) Settings() (*LoadBalancerSettings, error) {
+	o := &LoadBalancerSettings{Algorithm: l.Algorithm}
+	switch l.Algorithm {
+	case "":
+		o.Algorithm = LBRoundRobin
+	case LBRoundRobin, LBLeastConn, LBRandom, LBConsistentHash:
+	default:
+		return nil, fmt.Errorf("unsupported load balancer algorithm '%s', supported algorithms are %s, %s, %s and %s",
+			l.Algorithm, LBRoundRobin, LBLeastConn, LBRandom, LBConsistentHash)
+	}
+	if o.Algorithm != LBConsistentHash {
+		if l.HashKey != "" || l.LoadFactor != 0 {
+			return nil, fmt.Errorf("hash key and load factor are supported by the %s algorithm only", LBConsistentHash)
+		}
+		return o, nil
+	}
+	if l.LoadFactor != 0 && l.LoadFactor < 1 {
+		return nil, fmt.Errorf("load factor should be at least 1, got %v", l.LoadFactor)
+	}
+	o.LoadFactor = l.LoadFactor
+	kind, arg := l.HashKey, ""
+	if i := strings.Index(l.HashKey, ":"); i != -1 {
+		kind, arg = l.HashKey[:i], l.HashKey[i+1:]
+	}
+	switch kind {
+	case "", HashKeyIP:
+		if arg != "" {
+			return nil, fmt.Errorf("hash key '%s' takes no argument", HashKeyIP)
+		}
+		o.HashSource = HashKeyIP
+	case HashKeyHeader:
+		if arg == "" {
+			return nil, fmt.Errorf("hash key '%s' needs the header name, e.g. '%s:X-User'", HashKeyHeader, HashKeyHeader)
+		}
+		o.HashSource, o.HashHeader = HashKeyHeader, http.CanonicalHeaderKey(arg)
+	case HashKeyPath:
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("hash key '%s' takes the amount of the path segments, e.g. '%s:2', got '%s'", HashKeyPath, HashKeyPath, arg)
+			}
+			o.HashPathSegments = n
+		}
+		o.HashSource = HashKeyPath
+	case HashKeyURL:
+		if arg != "" {
+			return nil, fmt.Errorf("hash key '%s' takes no argument", HashKeyURL)
+		}
+		o.HashSource = HashKeyURL
+	default:
+		return nil, fmt.Errorf("unsupported hash key '%s', supported keys are '%s', '%s:<name>', '%s', '%s:<segments>' and '%s'",
+			l.HashKey, HashKeyIP, HashKeyHeader, HashKeyPath, HashKeyPath, HashKeyURL)
+	}
+	return o, nil
+}
+
+// SlowStart linearly ramps up the weight of the server from near zero to the full weight, so the server
+// warms up before it takes the full share of the traffic
+type SlowStart struct {
+	// Duration of the ramp, e.g. "30s", at least MinSlowStartDuration
+	Duration string
+}
+
+// SlowStartSettings contains parsed slow start parameters
+type SlowStartSettings struct {
+	Duration time.Duration
+}
+
+// Settings validates the slow start and returns parsed parameters
+func (s *SlowStart) Settings() (*SlowStartSettings, error) {
+	d, err := time.ParseDuration(s.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slow start duration: %s", err)
+	}
+	if d < MinSlowStartDuration {
+		return nil, fmt.Errorf("slow start duration should be >= %v, got %v", MinSlowStartDuration, d)
+	}
+	return &SlowStartSettings{Duration: d}, nil
+}
+
+// OutlierDetection sets up passive health checking of backend servers. Servers returning consecutive
+// 5xx responses or failing to connect are ejected from rotation for the ejection time that grows
+// with every repeated ejection. The last server in rotation is never ejected.
+type OutlierDetection struct {
+	// ConsecutiveErrors is the amount of consecutive 5xx responses or network errors that trigger ejection, 5 is default
+	ConsecutiveErrors int
+	// BaseEjectionTime is the ejection time, multiplied by the number of times the server has been ejected, "30s" is default
+	BaseEjectionTime string
+	// MaxEjectionTime caps the ejection time, "300s" or the base ejection time if greater is default
+	MaxEjectionTime string
+}
+
+// OutlierDetectionSettings contains parsed outlier detection parameters
+type OutlierDetectionSettings struct {
+	ConsecutiveErrors int
+	BaseEjectionTime  time.Duration
+	MaxEjectionTime   time.Duration
+}
+
+// Settings validates the outlier detection and returns parsed parameters with defaults applied
+func (o *OutlierDetection) Settings() (*OutlierDetectionSettings, error) {
+	s := &OutlierDetectionSettings{
+		ConsecutiveErrors: o.ConsecutiveErrors,
+		BaseEjectionTime:  DefaultBaseEjectionTime,
+		MaxEjectionTime:   DefaultMaxEjectionTime,
+	}
+	var err error
+	if s.ConsecutiveErrors < 0 {
+		return nil, fmt.Errorf("outlier detection consecutive errors should be >= 0, got %d", s.ConsecutiveErrors)
+	}
+	if s.ConsecutiveErrors == 0 {
+		s.ConsecutiveErrors = DefaultConsecutiveErrors
+	}
+	if o.BaseEjectionTime != "" {
+		if s.BaseEjectionTime, err = time.ParseDuration(o.BaseEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid base ejection time: %s", err)
+		}
+		if s.BaseEjectionTime <= 0 {
+			return nil, fmt.Errorf("base ejection time should be > 0, got %v", s.BaseEjectionTime)
+		}
+	}
+	if o.MaxEjectionTime != "" {
+		if s.MaxEjectionTime, err = time.ParseDuration(o.MaxEjectionTime); err != nil {
+			return nil, fmt.Errorf("invalid max ejection time: %s", err)
+		}
+	} else if s.MaxEjectionTime < s.BaseEjectionTime {
+		s.MaxEjectionTime = s.BaseEjectionTime
+	}
+	if s.MaxEjectionTime < s.BaseEjectionTime {
+		return nil, fmt.Errorf("max ejection time %v should be >= base ejection time %v", s.MaxEjectionTime, s.BaseEjectionTime)
+	}
+	return s, nil
+}
+
+// EjectionTime returns the ejection time for the server ejected the given amount of times
+func (s *OutlierDetectionSettings) EjectionTime(ejections int) time.Duration {
+	d := s.BaseEjectionTime * time.Duration(ejections)
+	if d > s.MaxEjectionTime || d <= 0 {
+		return s.MaxEjectionTime
+	}
+	return d
+}
+
+// ServerDiscovery resolves the backend servers from the DNS SRV records. Records are refreshed once their TTL
+// expires, servers are added and removed as the records change and the last resolved servers are kept
+// while the name can not be resolved.
+type ServerDiscovery struct {
+	// SRV is the name looked up, e.g. _http._tcp.example.com
+	SRV string
+	// Scheme of the server URLs, "http" is default
+	Scheme string `json:",omitempty"`
+	// MinRefresh is the shortest interval between lookups, also used to retry failed lookups, "5s" is default
+	MinRefresh string `json:",omitempty"`
+	// MaxRefresh is the longest interval between lookups, "300s" is default
+	MaxRefresh string `json:",omitempty"`
+}
+
+// ServerDiscoverySettings contains parsed server discovery parameters
+type ServerDiscoverySettings struct {
+	SRV        string
+	Scheme     string
+	MinRefresh time.Duration
+	MaxRefresh time.Duration
+}
+
+// Settings validates the server discovery and returns parsed parameters with defaults applied
+func (d *ServerDiscovery) Settings() (*ServerDiscoverySettings, error) {
+	s := &ServerDiscoverySettings{
+		SRV:        d.SRV,
+		Scheme:     d.Scheme,
+		MinRefresh: DefaultDiscoveryMinRefresh,
+		MaxRefresh: DefaultDiscoveryMaxRefresh,
+	}
+	if s.SRV == "" {
+		return nil, fmt.Errorf("server discovery needs SRV name")
+	}
+	switch s.Scheme {
+	case "":
+		s.Scheme = HTTP
+	case HTTP, HTTPS:
+	default:
+		return nil, fmt.Errorf("unsupported server discovery scheme '%s', supported schemes are %s and %s", s.Scheme, HTTP, HTTPS)
+	}
+	var err error
+	if d.MinRefresh != "" {
+		if s.MinRefresh, err = time.ParseDuration(d.MinRefresh); err != nil {
+			return nil, fmt.Errorf("invalid min refresh interval: %s", err)
+		}
+		if s.MinRefresh <= 0 {
+			return nil, fmt.Errorf("min refresh interval should be > 0, got %v", s.MinRefresh)
+		}
+	}
+	if d.MaxRefresh != "" {
+		if s.MaxRefresh, err = time.ParseDuration(d.MaxRefresh); err != nil {
+			return nil, fmt.Errorf("invalid max refresh interval: %s", err)
+		}
+	} else if s.MaxRefresh < s.MinRefresh {
+		s.MaxRefresh = s.MinRefresh
+	}
+	if s.MaxRefresh < s.MinRefresh {
+		return nil, fmt.Errorf("max refresh interval %v should be >= min refresh interval %v", s.MaxRefresh, s.MinRefresh)
+	}
+	return s, nil
+}
+
+// RefreshInterval returns the time to the next lookup for the records with the given TTL
+func (s *ServerDiscoverySettings) RefreshInterval(ttl time.Duration) time.Duration {
+	if ttl < s.MinRefresh {
+		return s.MinRefresh
+	}
+	if ttl > s.MaxRefresh {
+		return s.MaxRefresh
+	}
+	return ttl
+}
+
+// HealthCheck sets up active health checking of backend servers. Every server of the backend
+// is periodically probed with a GET request, servers failing the check are taken out of rotation
+// and are put back once they recover.
+type HealthCheck struct {
+	// Path is requested on every server, "/" is default
+	Path string
+	// Interval between checks, "10s" is default
+	Interval string
+	// Timeout for a single check request, defaults to the interval
+	Timeout string
+	// HealthyThreshold is the amount of consecutive successful checks to consider server healthy, 1 is default
+	HealthyThreshold int
+	// UnhealthyThreshold is the amount of consecutive failed checks to consider server unhealthy, 1 is default
+	UnhealthyThreshold int
+	// ExpectedCodes are the status codes treated as success, any 2xx code is accepted if empty
+	ExpectedCodes []int
+	// ExpectBody is the substring the response body should contain, the body is not checked if empty
+	ExpectBody string `json:",omitempty"`
+	// ExpectJSONPath is the dot separated path of the JSON response field, e.g. "status" or "checks.0.state",
+	// the field should be equal to ExpectJSONValue
+	ExpectJSONPath  string `json:",omitempty"`
+	ExpectJSONValue string `json:",omitempty"`
+}
+
+// HealthCheckSettings contains parsed health check parameters
+type HealthCheckSettings struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+	ExpectedCodes      []int
+	ExpectBody         string
+	// ExpectJSONPath are the keys and the array indexes of the expected JSON field, nil if the field is not checked
+	ExpectJSONPath  []string
+	ExpectJSONValue string
+}
+
+// Settings validates the health check and returns parsed parameters with defaults applied
+func (h *HealthCheck) Settings() (*HealthCheckSettings, error) {
+	s := &HealthCheckSettings{
+		Path:               h.Path,
+		Interval:           DefaultHealthCheckInterval,
+		HealthyThreshold:   h.HealthyThreshold,
+		UnhealthyThreshold: h.UnhealthyThreshold,
+		ExpectedCodes:      h.ExpectedCodes,
+		ExpectBody:         h.ExpectBody,
+		ExpectJSONValue:    h.ExpectJSONValue,
+	}
+	var err error
+	if s.Path == "" {
+		s.Path = "/"
+	}
+	if !strings.HasPrefix(s.Path, "/") {
+		return nil, fmt.Errorf("health check path should start with '/', got '%s'", s.Path)
+	}
+	if h.Interval != "" {
+		if s.Interval, err = time.ParseDuration(h.Interval); err != nil {
+			return nil, fmt.Errorf("invalid health check interval: %s", err)
+		}
+		if s.Interval <= 0 {
+			return nil, fmt.Errorf("health check interval should be > 0, got %v", s.Interval)
+		}
+	}
+	s.Timeout = s.Interval
+	if h.Timeout != "" {
+		if s.Timeout, err = time.ParseDuration(h.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid health check timeout: %s", err)
+		}
+		if s.Timeout <= 0 {
+			return nil, fmt.Errorf("health check timeout should be > 0, got %v", s.Timeout)
+		}
+	}
+	if s.HealthyThreshold < 0 || s.UnhealthyThreshold < 0 {
+		return nil, fmt.Errorf("health check thresholds should be >= 0")
+	}
+	if s.HealthyThreshold == 0 {
+		s.HealthyThreshold = 1
+	}
+	if s.UnhealthyThreshold == 0 {
+		s.UnhealthyThreshold = 1
+	}
+	for _, code := range s.ExpectedCodes {
+		if code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid expected status code: %d", code)
+		}
+	}
+	if h.ExpectJSONPath != "" {
+		s.ExpectJSONPath = strings.Split(h.ExpectJSONPath, ".")
+		for _, key := range s.ExpectJSONPath {
+			if key == "" {
+				return nil, fmt.Errorf("invalid health check JSON path: '%s'", h.ExpectJSONPath)
+			}
+		}
+	} else if h.ExpectJSONValue != "" {
+		return nil, fmt.Errorf("health check JSON value is set without the JSON path")
+	}
+	return s, nil
+}
+
+// ChecksBody returns true if the response body of the check is validated
+func (s *HealthCheckSettings) ChecksBody() bool {
+	return s.ExpectBody != "" || s.ExpectJSONPath != nil
+}
+
+// CheckBody returns an error if the response body does not contain the expected substring or the JSON field
+// does not have the expected value
+func (s *HealthCheckSettings) CheckBody(body []byte) error {
+	if s.ExpectBody != "" && !strings.Contains(string(body), s.ExpectBody) {
+		return fmt.Errorf("response body does not contain '%s'", s.ExpectBody)
+	}
+	if s.ExpectJSONPath == nil {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("response body is not JSON: %v", err)
+	}
+	path := strings.Join(s.ExpectJSONPath, ".")
+	for _, key := range s.ExpectJSONPath {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return fmt.Errorf("response JSON has no field '%s'", path)
+			}
+			v = node[i]
+		default:
+			return fmt.Errorf("response JSON has no field '%s'", path)
+		}
+		if v == nil {
+			return fmt.Errorf("response JSON has no field '%s'", path)
+		}
+	}
+	// strings are compared as is, the other values by their JSON form, e.g. true or 1
+	value, ok := v.(string)
+	if !ok {
+		out, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		value = string(out)
+	}
+	if value != s.ExpectJSONValue {
+		return fmt.Errorf("response JSON field '%s' is '%s', expected '%s'", path, value, s.ExpectJSONValue)
+	}
+	return nil
+}
+
+// IsExpectedCode returns true if the given status code means the server is healthy
+func (s *HealthCheckSettings) IsExpectedCode(code int) bool {
+	if len(s.ExpectedCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, c := range s.ExpectedCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *HealthCheck) Equals(o *HealthCheck) bool {
+	if h.Path != o.Path ||
+		h.Interval != o.Interval ||
+		h.Timeout != o.Timeout ||
+		h.HealthyThreshold != o.HealthyThreshold ||
+		h.UnhealthyThreshold != o.UnhealthyThreshold ||
+		h.ExpectBody != o.ExpectBody ||
+		h.ExpectJSONPath != o.ExpectJSONPath ||
+		h.ExpectJSONValue != o.ExpectJSONValue ||
+		len(h.ExpectedCodes) != len(o.ExpectedCodes) {
+		return false
+	}
+	for i := range h.ExpectedCodes {
+		if h.ExpectedCodes[i] != o.ExpectedCodes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// StickySession makes repeated requests of the client hit the same server. The server picked by the load balancer
+// is remembered in the affinity cookie, clients are rebalanced once their server leaves the backend.
+type StickySession struct {
+	// CookieName is the name of the affinity cookie, "vulcand_sticky" is default
+	CookieName string
+	// TTL of the affinity cookie, the cookie lasts for the browser session if empty
+	TTL string `json:",omitempty"`
+	// Secure restricts the cookie to HTTPS requests
+	Secure bool `json:",omitempty"`
+	// HTTPOnly hides the cookie from the client scripts
+	HTTPOnly bool `json:",omitempty"`
+}
+
+// StickySessionSettings contains parsed sticky session parameters
+type StickySessionSettings struct {
+	CookieName string
+	TTL        time.Duration
+	Secure     bool
+	HTTPOnly   bool
+}
+
+// Settings validates the sticky session and returns parsed parameters with defaults applied
+func (s *StickySession) Settings() (*StickySessionSettings, error) {
+	o := &StickySessionSettings{
+		CookieName: s.CookieName,
+		Secure:     s.Secure,
+		HTTPOnly:   s.HTTPOnly,
+	}
+	if o.CookieName == "" {
+		o.CookieName = DefaultStickyCookieName
+	}
+	if strings.IndexFunc(o.CookieName, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", r)
+	}) != -1 {
+		return nil, fmt.Errorf("invalid sticky session cookie name '%s'", o.CookieName)
+	}
+	if s.TTL != "" {
+		var err error
+		if o.TTL, err = time.ParseDuration(s.TTL); err != nil {
+			return nil, fmt.Errorf("invalid sticky session TTL: %s", err)
+		}
+		if o.TTL <= 0 {
+			return nil, fmt.Errorf("sticky session TTL should be > 0, got %v", o.TTL)
+		}
+	}
+	return o, nil
 }
 
 type MiddlewareKey struct {
@@ -385,7 +2043,10 @@ func (m MiddlewareKey) String() string {
 
 // Middleware contains information about this middleware backend-specific data used for serialization/deserialization
 type Middleware struct {
-	Id         string
+	Id string
+	// Priority defines the order of the frontend middlewares, the middleware with the lower priority
+	// handles the request before the middlewares with the higher priority. Middlewares with the same
+	// priority are ordered by id.
 	Priority   int
 	Type       string
 	Middleware plugin.Middleware
@@ -433,8 +2094,16 @@ func (b *Backend) TransportSettings() (*TransportSettings, error) {
 }
 
 func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
-	t := &TransportSettings{}
+	t := &TransportSettings{Protocol: s.Protocol}
 	var err error
+	switch s.Protocol {
+	case "":
+		t.Protocol = BackendProtocolHTTP1
+	case BackendProtocolHTTP1, BackendProtocolH2C:
+	default:
+		return nil, fmt.Errorf("unsupported backend protocol '%s', supported protocols are %s and %s",
+			s.Protocol, BackendProtocolHTTP1, BackendProtocolH2C)
+	}
 	// Connection timeouts
 	if len(s.Timeouts.Read) != 0 {
 		if t.Timeouts.Read, err = time.ParseDuration(s.Timeouts.Read); err != nil {
@@ -451,6 +2120,22 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 			return nil, fmt.Errorf("invalid tls handshake timeout: %s", err)
 		}
 	}
+	if len(s.Timeouts.Drain) != 0 {
+		if t.Timeouts.Drain, err = time.ParseDuration(s.Timeouts.Drain); err != nil {
+			return nil, fmt.Errorf("invalid drain timeout: %s", err)
+		}
+	}
+	t.Timeouts.ResponseHeader = t.Timeouts.Read
+	if len(s.Timeouts.ResponseHeader) != 0 {
+		if t.Timeouts.ResponseHeader, err = time.ParseDuration(s.Timeouts.ResponseHeader); err != nil {
+			return nil, fmt.Errorf("invalid response header timeout: %s", err)
+		}
+	}
+	if len(s.Timeouts.BodyIdle) != 0 {
+		if t.Timeouts.BodyIdle, err = time.ParseDuration(s.Timeouts.BodyIdle); err != nil {
+			return nil, fmt.Errorf("invalid body idle timeout: %s", err)
+		}
+	}
 
 	// Keep Alive parameters
 	if len(s.KeepAlive.Period) != 0 {
@@ -458,7 +2143,50 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 			return nil, fmt.Errorf("invalid keepalive period: %s", err)
 		}
 	}
+	if s.KeepAlive.MaxIdleConnsPerHost < 0 {
+		return nil, fmt.Errorf("max idle connections per host should be >= 0, got %d", s.KeepAlive.MaxIdleConnsPerHost)
+	}
 	t.KeepAlive.MaxIdleConnsPerHost = s.KeepAlive.MaxIdleConnsPerHost
+	if s.KeepAlive.MaxConnsPerHost < 0 {
+		return nil, fmt.Errorf("max connections per host should be >= 0, got %d", s.KeepAlive.MaxConnsPerHost)
+	}
+	t.KeepAlive.MaxConnsPerHost = s.KeepAlive.MaxConnsPerHost
+
+	if s.HealthCheck != nil {
+		if t.HealthCheck, err = s.HealthCheck.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.StickySession != nil {
+		if t.StickySession, err = s.StickySession.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.OutlierDetection != nil {
+		if t.OutlierDetection, err = s.OutlierDetection.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Discovery != nil {
+		if t.Discovery, err = s.Discovery.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.SlowStart != nil {
+		if t.SlowStart, err = s.SlowStart.Settings(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.LoadBalancer != nil {
+		if t.LoadBalancer, err = s.LoadBalancer.Settings(); err != nil {
+			return nil, err
+		}
+	}
 
 	if s.TLS != nil {
 		config, err := NewTLSConfig(s.TLS)
@@ -472,9 +2200,11 @@ func transportSettings(s HTTPBackendSettings) (*TransportSettings, error) {
 
 // Server is a final destination of the request
 type Server struct {
-	Id    string
-	URL   string
-	Stats *RoundTripStats `json:",omitempty"`
+	Id  string
+	URL string
+	// Weight is the relative share of traffic sent to the server by the load balancer, 1 is default
+	Weight int             `json:",omitempty"`
+	Stats  *RoundTripStats `json:",omitempty"`
 }
 
 func NewServer(id, u string) (*Server, error) {
@@ -495,6 +2225,106 @@ func (e *Server) GetId() string {
 	return e.Id
 }
 
+// LBWeight returns the weight the server should have in the load balancer
+func (e *Server) LBWeight() int {
+	if e.Weight == 0 {
+		return DefaultServerWeight
+	}
+	return e.Weight
+}
+
+// ServerHealth describes the health state of the server as seen by the active health checks
+// and outlier detection
+type ServerHealth struct {
+	Id      string
+	URL     string
+	Healthy bool
+	// LastCheck is the time of the last completed check, zero if the server has not been checked yet
+	LastCheck time.Time
+	// LastError describes the reason of the last failed check
+	LastError string `json:",omitempty"`
+	// Ejected is set when the server is out of rotation because of errors observed on live traffic
+	Ejected bool `json:",omitempty"`
+	// Draining is set when the server has been deleted and finishes the requests in flight
+	Draining bool `json:",omitempty"`
+	// Quarantined is set when the server is taken out of rotation of the instance through the API
+	Quarantined bool `json:",omitempty"`
+}
+
+// ProxyStats is the runtime state of the proxy taken at once, so the numbers are consistent with each other
+type ProxyStats struct {
+	// State is the state of the proxy, e.g. active or shutting down
+	State     string
+	Listeners []ListenerStats
+	Frontends []FrontendRate
+}
+
+// ListenerStats are the client connection counters of the listener
+type ListenerStats struct {
+	Id      string
+	Address Address
+	// ActiveConnections is the amount of the client connections open now, the upgraded ones included
+	ActiveConnections int
+	// AcceptedConnections is the total amount of the client connections accepted since the listener has started
+	AcceptedConnections int64
+}
+
+// FrontendRate is the request rate of the frontend within the stats window
+type FrontendRate struct {
+	Id string
+	// Period is the window the requests are counted in
+	Period            time.Duration
+	Requests          int64
+	NetErrors         int64
+	RequestsPerSecond float64
+}
+
+// LatencyStats are the latency percentiles of the frontends and backends
+type LatencyStats struct {
+	// Window is the rotation period of the histograms, the percentiles cover the last one or two windows
+	Window    time.Duration
+	Frontends []LatencyPercentiles
+	Backends  []LatencyPercentiles
+}
+
+// LatencyPercentiles are the percentiles of the frontend or backend latency, backend latency is measured
+// per forwarding attempt
+type LatencyPercentiles struct {
+	Id string
+	// Count is the amount of the latencies observed
+	Count int64
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+func (h *ServerHealth) String() string {
+	return fmt.Sprintf("ServerHealth(%s, %s, healthy=%t, ejected=%t)", h.Id, h.URL, h.Healthy, h.Ejected)
+}
+
+// CertExpiry tells when the host certificate and its OCSP staple expire
+type CertExpiry struct {
+	Host string
+	// Index is the index of the key pair among the host key pairs, see HostSettings.AllKeyPairs
+	Index    int `json:",omitempty"`
+	Subject  string
+	Issuer   string
+	NotAfter time.Time
+	// OCSPNextUpdate is the time the OCSP staple of the host is valid until, zero if the host is not stapled
+	OCSPNextUpdate time.Time
+	// Error tells why the certificate could not be inspected
+	Error string `json:",omitempty"`
+}
+
+func (c *CertExpiry) String() string {
+	return fmt.Sprintf("CertExpiry(%s, notAfter=%v, ocspNextUpdate=%v)", c.Host, c.NotAfter, c.OCSPNextUpdate)
+}
+
+// DaysLeft returns the days left until the certificate expires, the value is negative for the expired certificates
+func (c *CertExpiry) DaysLeft(now time.Time) float64 {
+	return c.NotAfter.Sub(now).Hours() / 24
+}
+
 type LatencyBrackets []Bracket
 
 func (l LatencyBrackets) GetQuantile(q float64) (*Bracket, error) {
@@ -637,6 +2467,59 @@ func (n *AlreadyExistsError) Error() string {
 	return n.Message
 }
 
+// ListenerConflictError is returned when the address of the listener is already used by another listener
+type ListenerConflictError struct {
+	Listener ListenerKey
+	Existing Listener
+}
+
+func (e *ListenerConflictError) Error() string {
+	return fmt.Sprintf("listener '%v' can not use %v://%v: it is used by listener '%v' (protocol %v, scope '%v'), choose another address or delete listener '%v' first",
+		e.Listener.Id, e.Existing.Address.Network, e.Existing.Address.Address, e.Existing.Id, e.Existing.Protocol, e.Existing.Scope, e.Existing.Id)
+}
+
+// AddressInUseError is returned when the address of the listener is bound by another process
+type AddressInUseError struct {
+	Listener ListenerKey
+	Address  Address
+}
+
+func (e *AddressInUseError) Error() string {
+	return fmt.Sprintf("listener '%v' can not bind %v://%v: the address is already in use by another process, stop it or choose another address",
+		e.Listener.Id, e.Address.Network, e.Address.Address)
+}
+
+// ConflictError is returned when the batch or the listener swap conflicts with the concurrent changes of the
+// configuration, none of the changes are applied and they can be retried
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
+}
+
+// BatchError reports the invalid operation of the batch, none of the batch operations are applied
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (b *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", b.Index, b.Err)
+}
+
+// CompactedError is returned by Subscribe when the changes after the requested index are no longer
+// available, the subscriber has to read the snapshot again and subscribe from its index
+type CompactedError struct {
+	// Index is the oldest index changes are still available from
+	Index uint64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("changes were compacted, oldest available index is %d", e.Index)
+}
+
 type Counters struct {
 	Period      time.Duration
 	NetErrors   int64
@@ -714,7 +2597,58 @@ const (
 	TCP            = "tcp"
 	UNIX           = "unix"
 	PROXY_PROTO_V1 = "PROXY_V1"
+	PROXY_PROTO_V2 = "PROXY_V2"
 	NoTTL          = 0
+
+	DefaultHealthCheckInterval = 10 * time.Second
+	MaxHealthCheckBodyBytes    = 64 * 1024
+	DefaultServerWeight        = 1
+	DefaultConsecutiveErrors   = 5
+	DefaultBaseEjectionTime    = 30 * time.Second
+	DefaultMaxEjectionTime     = 300 * time.Second
+	DefaultRetryAttempts       = 2
+	DefaultRetryMaxBodyBytes   = 64 * 1024
+	DefaultRetryBudgetWindow   = 10 * time.Second
+	DefaultMirrorMaxBodyBytes  = 64 * 1024
+	DefaultRequestIDHeader     = "X-Request-Id"
+	DefaultRouteHeader         = "X-Vulcand-Route"
+
+	RetryOnConnectFailure = "connect-failure"
+	RetryOnTimeout        = "timeout"
+	RetryOn5xx            = "5xx"
+
+	DefaultDiscoveryMinRefresh = 5 * time.Second
+	DefaultDiscoveryMaxRefresh = 300 * time.Second
+
+	// MinSlowStartDuration keeps the steps of the ramp apart
+	MinSlowStartDuration = time.Second
+
+	DefaultStickyCookieName = "vulcand_sticky"
+
+	RateLimitKeyClientIP    = "client.ip"
+	RateLimitKeyHeader      = "request.header."
+	RateLimitKeyClaim       = "request.claim."
+	DefaultRateLimitMaxKeys = 65536
+
+	DefaultCircuitBreakerFallbackDuration = 10 * time.Second
+	DefaultCircuitBreakerRecoveryDuration = 10 * time.Second
+	DefaultCircuitBreakerCheckPeriod      = 100 * time.Millisecond
+
+	BackendProtocolHTTP1 = "http/1.1"
+	BackendProtocolH2C   = "h2c"
+
+	ACMEChallengeHTTP01     = "http-01"
+	DefaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+
+	LBRoundRobin     = "roundrobin"
+	LBLeastConn      = "leastconn"
+	LBRandom         = "random"
+	LBConsistentHash = "hash"
+
+	HashKeyIP     = "ip"
+	HashKeyHeader = "header"
+	HashKeyPath   = "path"
+	HashKeyURL    = "url"
 )
 
 type TransportTimeouts struct {
@@ -724,6 +2658,12 @@ type TransportTimeouts struct {
 	Dial time.Duration
 	// TLS handshake timeout
 	TLSHandshake time.Duration
+	// Drain is how long the deleted servers are given to finish the requests in flight
+	Drain time.Duration
+	// ResponseHeader is the time to the first byte of the response, the read timeout if not set
+	ResponseHeader time.Duration
+	// BodyIdle is the longest pause in between the reads of the response body, 0 means no limit
+	BodyIdle time.Duration
 }
 
 type TransportKeepAlive struct {
@@ -731,12 +2671,21 @@ type TransportKeepAlive struct {
 	Period time.Duration
 	// How many idle connections will be kept per host
 	MaxIdleConnsPerHost int
+	// Maximum connections per host, 0 means no limit
+	MaxConnsPerHost int
 }
 
 type TransportSettings struct {
-	Timeouts  TransportTimeouts
-	KeepAlive TransportKeepAlive
-	TLS       *tls.Config
+	Protocol         string
+	Timeouts         TransportTimeouts
+	KeepAlive        TransportKeepAlive
+	TLS              *tls.Config
+	HealthCheck      *HealthCheckSettings
+	StickySession    *StickySessionSettings
+	OutlierDetection *OutlierDetectionSettings
+	Discovery        *ServerDiscoverySettings
+	SlowStart        *SlowStartSettings
+	LoadBalancer     *LoadBalancerSettings
 }
 
 // FrontendSpec fully specifies a particular frontend.
@@ -1,8 +1,11 @@
 package engine
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"net/http"
+	"os"
 	"testing"
 	"time"
 
@@ -33,6 +36,116 @@ func (s *BackendSuite) TestHostBad(c *C) {
 	c.Assert(h, IsNil)
 }
 
+func (s *BackendSuite) TestHostWithTLS(c *C) {
+	settings := &HostTLSSettings{
+		MinVersion:               "VersionTLS11",
+		CipherSuites:             []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		PreferServerCipherSuites: true,
+	}
+	h, err := NewHost("localhost", HostSettings{TLS: settings})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.TLS, DeepEquals, settings)
+
+	// Empty fields keep the listener settings
+	cfg := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}}
+	c.Assert(settings.Apply(cfg), IsNil)
+	c.Assert(cfg.MinVersion, Equals, uint16(tls.VersionTLS11))
+	c.Assert(cfg.MaxVersion, Equals, uint16(tls.VersionTLS12))
+	c.Assert(cfg.CipherSuites, DeepEquals, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+	c.Assert(cfg.PreferServerCipherSuites, Equals, true)
+
+	cfg = &tls.Config{MinVersion: tls.VersionTLS10, CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}}
+	c.Assert((&HostTLSSettings{}).Apply(cfg), IsNil)
+	c.Assert(cfg.MinVersion, Equals, uint16(tls.VersionTLS10))
+	c.Assert(cfg.CipherSuites, DeepEquals, []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA})
+}
+
+func (s *BackendSuite) TestHostWithBadTLS(c *C) {
+	tcs := []HostTLSSettings{
+		{MinVersion: "SSLv3"},
+		{MaxVersion: "bla"},
+		{MinVersion: "VersionTLS12", MaxVersion: "VersionTLS11"},
+		{CipherSuites: []string{"TLS_BOGUS"}},
+	}
+	for i, tc := range tcs {
+		h, err := NewHost("localhost", HostSettings{TLS: &tc})
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Assert(h, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestHostWithBadClientAuth(c *C) {
+	tcs := []ClientAuthSettings{
+		{},
+		{CA: []byte("bla"), Required: true},
+	}
+	for i, tc := range tcs {
+		h, err := NewHost("localhost", HostSettings{ClientAuth: &tc})
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Assert(h, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestHostWithSecurityHeaders(c *C) {
+	settings := &SecurityHeadersSettings{
+		HSTS:                  &HSTSSettings{MaxAge: 600},
+		FrameOptions:          "sameorigin",
+		ContentSecurityPolicy: "default-src 'self'",
+	}
+	h, err := NewHost("localhost", HostSettings{SecurityHeaders: settings})
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.SecurityHeaders.Header(), DeepEquals, http.Header{
+		"Strict-Transport-Security": {"max-age=600"},
+		"X-Frame-Options":           {"SAMEORIGIN"},
+		"Content-Security-Policy":   {"default-src 'self'"},
+	})
+
+	tcs := []SecurityHeadersSettings{
+		{HSTS: &HSTSSettings{MaxAge: -1}},
+		{HSTS: &HSTSSettings{MaxAge: 600, Preload: true}},
+		{FrameOptions: "ALLOW-FROM https://example.com"},
+		{ContentSecurityPolicy: "default-src 'self'\r\nX-Injected: 1"},
+	}
+	for i, tc := range tcs {
+		h, err := NewHost("localhost", HostSettings{SecurityHeaders: &tc})
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Assert(h, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestHostWithBadErrorPages(c *C) {
+	tcs := []map[int]ErrorPage{
+		{200: {Body: "ok"}},
+		{600: {Body: "bad"}},
+		{502: {Body: "{{.Status"}},
+	}
+	for i, tc := range tcs {
+		h, err := NewHost("localhost", HostSettings{ErrorPages: tc})
+		c.Assert(err, NotNil, Commentf("test case %d", i))
+		c.Assert(h, IsNil)
+	}
+
+	h, err := HostFromJSON([]byte(`{"Name": "localhost", "Settings": {"ErrorPages": {"502": {"ContentType": "text/html", "Body": "<h1>{{.Status}}</h1>"}}}}`))
+	c.Assert(err, IsNil)
+	c.Assert(h.Settings.ErrorPages, DeepEquals, map[int]ErrorPage{502: {ContentType: "text/html", Body: "<h1>{{.Status}}</h1>"}})
+}
+
+func (s *BackendSuite) TestHostAllKeyPairs(c *C) {
+	primary := KeyPair{Cert: []byte("rsa cert"), Key: []byte("rsa key")}
+	extra := KeyPair{Cert: []byte("ecdsa cert"), Key: []byte("ecdsa key")}
+
+	settings := HostSettings{KeyPair: &primary, KeyPairs: []KeyPair{extra}}
+	c.Assert(settings.AllKeyPairs(), DeepEquals, []KeyPair{primary, extra})
+
+	settings = HostSettings{KeyPairs: []KeyPair{extra}}
+	c.Assert(settings.AllKeyPairs(), DeepEquals, []KeyPair{extra})
+
+	c.Assert((&HostSettings{}).AllKeyPairs(), HasLen, 0)
+
+	_, err := NewHost("localhost", HostSettings{KeyPairs: []KeyPair{extra}})
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestFrontendDefaults(c *C) {
 	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{})
 	c.Assert(err, IsNil)
@@ -50,6 +163,7 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 		FailoverPredicate:  "IsNetworkError() && Attempts() <= 1",
 		Hostname:           "host1",
 		TrustForwardHeader: true,
+		UpgradeIdleTimeout: "1m",
 	}
 	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
 	c.Assert(err, IsNil)
@@ -63,6 +177,227 @@ func (s *BackendSuite) TestNewFrontendWithOptions(c *C) {
 	c.Assert(o.FailoverPredicate, NotNil)
 	c.Assert(o.TrustForwardHeader, Equals, true)
 	c.Assert(o.Hostname, Equals, "host1")
+	c.Assert(o.UpgradeIdleTimeoutDuration(), Equals, time.Minute)
+}
+
+func (s *BackendSuite) TestNewFrontendWithRetry(c *C) {
+	settings := HTTPFrontendSettings{Retry: &HTTPFrontendRetry{}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+
+	r := f.HTTPSettings().Retry
+	c.Assert(r.MaxAttempts(), Equals, DefaultRetryAttempts)
+	c.Assert(r.BodyLimit(), Equals, int64(DefaultRetryMaxBodyBytes))
+	c.Assert(r.RetryOn(RetryOnConnectFailure), Equals, true)
+	c.Assert(r.RetryOn(RetryOn5xx), Equals, false)
+
+	r = &HTTPFrontendRetry{Attempts: 3, On: []string{RetryOn5xx, RetryOnTimeout}}
+	c.Assert(r.Check(), IsNil)
+	c.Assert(r.MaxAttempts(), Equals, 3)
+	c.Assert(r.RetryOn(RetryOnConnectFailure), Equals, false)
+	c.Assert(r.RetryOn(RetryOn5xx), Equals, true)
+	c.Assert(r.RetryOn(RetryOnTimeout), Equals, true)
+
+	b := &HTTPFrontendRetryBudget{Ratio: 0.2}
+	c.Assert(b.Check(), IsNil)
+	c.Assert(b.WindowDuration(), Equals, DefaultRetryBudgetWindow)
+	b.Window = "1m"
+	c.Assert(b.WindowDuration(), Equals, time.Minute)
+}
+
+func (s *BackendSuite) TestFrontendRetryEq(c *C) {
+	a := HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 3, On: []string{RetryOn5xx}}}
+	b := HTTPFrontendSettings{Retry: &HTTPFrontendRetry{Attempts: 3, On: []string{RetryOn5xx}}}
+	c.Assert(a.Equals(b), Equals, true)
+
+	b.Retry.On = []string{RetryOnTimeout}
+	c.Assert(a.Equals(b), Equals, false)
+
+	b.Retry.On = []string{RetryOn5xx}
+	b.Retry.Budget = &HTTPFrontendRetryBudget{Ratio: 0.1}
+	c.Assert(a.Equals(b), Equals, false)
+	a.Retry.Budget = &HTTPFrontendRetryBudget{Ratio: 0.1}
+	c.Assert(a.Equals(b), Equals, true)
+	a.Retry.Budget.Window = "1m"
+	c.Assert(a.Equals(b), Equals, false)
+
+	c.Assert(a.Equals(HTTPFrontendSettings{}), Equals, false)
+}
+
+func (s *BackendSuite) TestFrontendRequestConstraints(c *C) {
+	settings := HTTPFrontendSettings{AllowedMethods: []string{"GET", "POST"}, AllowedContentTypes: []string{"application/json", "text/*"}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, settings)
+	c.Assert(err, IsNil)
+	c.Assert(f.HTTPSettings().Equals(settings), Equals, true)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{AllowedMethods: []string{"GET"}, AllowedContentTypes: settings.AllowedContentTypes}), Equals, false)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{AllowedMethods: settings.AllowedMethods}), Equals, false)
+
+	bad := []HTTPFrontendSettings{
+		{AllowedMethods: []string{""}},
+		{AllowedMethods: []string{"GET POST"}},
+		{AllowedContentTypes: []string{"json"}},
+		{AllowedContentTypes: []string{"*/json"}},
+		{AllowedContentTypes: []string{"text/plain; charset=utf-8"}},
+	}
+	for _, s := range bad {
+		f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, s)
+		c.Assert(err, NotNil, Commentf("%#v", s))
+		c.Assert(f, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestFrontendRateLimit(c *C) {
+	rl := &HTTPFrontendRateLimit{Requests: 10, Key: "request.header.X-User", TrustedProxies: []string{"10.0.0.0/8"}}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{RateLimit: rl})
+	c.Assert(err, IsNil)
+	c.Assert(f.HTTPSettings().RateLimit.BurstOrDefault(), Equals, int64(10))
+
+	nets, err := rl.TrustedNets()
+	c.Assert(err, IsNil)
+	c.Assert(len(nets), Equals, 1)
+	c.Assert(nets[0].String(), Equals, "10.0.0.0/8")
+
+	other := *rl
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RateLimit: &other}), Equals, true)
+	other.TrustedProxies = []string{"192.168.0.0/16"}
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RateLimit: &other}), Equals, false)
+}
+
+func (s *BackendSuite) TestFrontendCircuitBreaker(c *C) {
+	cb := &HTTPFrontendCircuitBreaker{Condition: "LatencyAtQuantileMS(50.0) > 50", RecoveryDuration: "1m"}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{CircuitBreaker: cb})
+	c.Assert(err, IsNil)
+
+	o, err := f.HTTPSettings().CircuitBreaker.Settings()
+	c.Assert(err, IsNil)
+	c.Assert(o, DeepEquals, &CircuitBreakerSettings{
+		Condition:        cb.Condition,
+		Fallback:         HTTPFallbackResponse{StatusCode: 503},
+		FallbackDuration: DefaultCircuitBreakerFallbackDuration,
+		RecoveryDuration: time.Minute,
+		CheckPeriod:      DefaultCircuitBreakerCheckPeriod,
+	})
+
+	other := *cb
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{CircuitBreaker: &other}), Equals, true)
+	other.Fallback.Body = "down"
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{CircuitBreaker: &other}), Equals, false)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{}), Equals, false)
+}
+
+func (s *BackendSuite) TestFrontendMirror(c *C) {
+	mirror := &HTTPFrontendMirror{BackendId: "b2", Percent: 5}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{Mirror: mirror})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1", "b2"})
+	c.Assert(f.UsesBackend(BackendKey{Id: "b2"}), Equals, true)
+	c.Assert(mirror.BodyLimit(), Equals, int64(DefaultMirrorMaxBodyBytes))
+
+	// the backend shared by the canary and the mirror is listed once
+	f, err = NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{
+		Mirror: mirror, Canary: &HTTPFrontendCanary{BackendId: "b2", Percent: 5}})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1", "b2"})
+
+	other := *mirror
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{Mirror: &other, Canary: f.HTTPSettings().Canary}), Equals, true)
+	other.Percent = 10
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{Mirror: &other, Canary: f.HTTPSettings().Canary}), Equals, false)
+}
+
+func (s *BackendSuite) TestFrontendRequestID(c *C) {
+	r := &HTTPFrontendRequestID{}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{RequestID: r})
+	c.Assert(err, IsNil)
+	c.Assert(r.HeaderName(), Equals, DefaultRequestIDHeader)
+	c.Assert((&HTTPFrontendRequestID{Header: "x-trace-id"}).HeaderName(), Equals, "X-Trace-Id")
+
+	other := *r
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RequestID: &other}), Equals, true)
+	other.Pattern = "^[a-f0-9-]+$"
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RequestID: &other}), Equals, false)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{}), Equals, false)
+
+	// the id should match the pattern as a whole
+	re, err := (&HTTPFrontendRequestID{Pattern: "[0-9a-f]{4}|[0-9]{2}"}).Regexp()
+	c.Assert(err, IsNil)
+	c.Assert(re.MatchString("0a1b"), Equals, true)
+	c.Assert(re.MatchString("12"), Equals, true)
+	c.Assert(re.MatchString("<script>0a1b"), Equals, false)
+	c.Assert(re.MatchString("0a1b12"), Equals, false)
+	_, err = (&HTTPFrontendRequestID{Pattern: "a)|(b"}).Regexp()
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestFrontendRouteHeader(c *C) {
+	r := &HTTPFrontendRouteHeader{}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{RouteHeader: r})
+	c.Assert(err, IsNil)
+	c.Assert(r.HeaderName(), Equals, DefaultRouteHeader)
+	c.Assert((&HTTPFrontendRouteHeader{Header: "x-route"}).HeaderName(), Equals, "X-Route")
+
+	other := *r
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RouteHeader: &other}), Equals, true)
+	other.Override = true
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{RouteHeader: &other}), Equals, false)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{}), Equals, false)
+}
+
+func (s *BackendSuite) TestFrontendCanary(c *C) {
+	canary := &HTTPFrontendCanary{BackendId: "b2", Percent: 5}
+	f, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{Canary: canary})
+	c.Assert(err, IsNil)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1", "b2"})
+	c.Assert(f.UsesBackend(BackendKey{Id: "b2"}), Equals, true)
+	c.Assert(f.UsesBackend(BackendKey{Id: "b3"}), Equals, false)
+
+	other := *canary
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{Canary: &other}), Equals, true)
+	other.Percent = 10
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{Canary: &other}), Equals, false)
+	c.Assert(f.HTTPSettings().Equals(HTTPFrontendSettings{}), Equals, false)
+
+	for _, bad := range []HTTPFrontendCanary{
+		{Percent: 5},
+		{BackendId: "b1", Percent: 5},
+		{BackendId: "b2", Percent: -1},
+		{BackendId: "b2", Percent: 101},
+	} {
+		canary := bad
+		_, err := NewHTTPFrontend(route.NewMux(), "f1", "b1", `Path("/home")`, HTTPFrontendSettings{Canary: &canary})
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *BackendSuite) TestTCPFrontend(c *C) {
+	settings := TCPFrontendSettings{ListenerId: "l1", ServerNames: []string{"db.example.com", "*.example.org"}, DialTimeout: "3s"}
+	f, err := NewTCPFrontend("f1", "b1", settings)
+	c.Assert(err, IsNil)
+	c.Assert(f.Type, Equals, TCP)
+	c.Assert(f.BackendIds(), DeepEquals, []string{"b1"})
+
+	bytes, err := json.Marshal(f)
+	c.Assert(err, IsNil)
+	out, err := FrontendFromJSON(route.NewMux(), bytes)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+	c.Assert(out.TCPSettings().Equals(settings), Equals, true)
+
+	other := settings
+	other.ServerNames = []string{"db.example.com"}
+	c.Assert(f.TCPSettings().Equals(other), Equals, false)
+
+	for _, bad := range []TCPFrontendSettings{
+		{},
+		{ListenerId: "l1", ServerNames: []string{"DB.example.com"}},
+		{ListenerId: "l1", ServerNames: []string{"db.*.com"}},
+		{ListenerId: "l1", ServerNames: []string{"db..com"}},
+		{ListenerId: "l1", DialTimeout: "-1s"},
+		{ListenerId: "l1", IdleTimeout: "forever"},
+	} {
+		_, err := NewTCPFrontend("f1", "b1", bad)
+		c.Assert(err, NotNil, Commentf("%v", bad))
+	}
 }
 
 func (s *BackendSuite) TestFrontendBadParams(c *C) {
@@ -80,6 +415,87 @@ func (s *BackendSuite) TestFrontendBadOptions(c *C) {
 		HTTPFrontendSettings{
 			FailoverPredicate: "bad predicate",
 		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{Attempts: -1},
+		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{MaxBodyBytes: -1},
+		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{On: []string{"4xx"}},
+		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{Budget: &HTTPFrontendRetryBudget{}},
+		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{Budget: &HTTPFrontendRetryBudget{Ratio: 0.1, Window: "-1s"}},
+		},
+		HTTPFrontendSettings{
+			Retry: &HTTPFrontendRetry{Budget: &HTTPFrontendRetryBudget{Ratio: 0.1, MinRetries: -1}},
+		},
+		HTTPFrontendSettings{
+			UpgradeIdleTimeout: "1what?",
+		},
+		HTTPFrontendSettings{
+			RateLimit: &HTTPFrontendRateLimit{},
+		},
+		HTTPFrontendSettings{
+			RateLimit: &HTTPFrontendRateLimit{Requests: 1, Key: "request.body"},
+		},
+		HTTPFrontendSettings{
+			RateLimit: &HTTPFrontendRateLimit{Requests: 1, TrustedProxies: []string{"10.0.0.1"}},
+		},
+		HTTPFrontendSettings{
+			CircuitBreaker: &HTTPFrontendCircuitBreaker{Condition: "Bad()"},
+		},
+		HTTPFrontendSettings{
+			CircuitBreaker: &HTTPFrontendCircuitBreaker{Condition: "NetworkErrorRatio() > 0.5", FallbackDuration: "-1s"},
+		},
+		HTTPFrontendSettings{
+			CircuitBreaker: &HTTPFrontendCircuitBreaker{
+				Condition: "NetworkErrorRatio() > 0.5",
+				Fallback:  HTTPFallbackResponse{StatusCode: 1000},
+			},
+		},
+		HTTPFrontendSettings{
+			UpgradeIdleTimeout: "-1s",
+		},
+		HTTPFrontendSettings{
+			MaxRequestBodyBytes: -1,
+		},
+		HTTPFrontendSettings{
+			ForwardTimeout: "soon",
+		},
+		HTTPFrontendSettings{
+			ForwardTimeout: "0s",
+		},
+		HTTPFrontendSettings{
+			MaxInFlight: -1,
+		},
+		HTTPFrontendSettings{
+			Limits: HTTPFrontendLimits{MaxMemBodyBytes: -1},
+		},
+		HTTPFrontendSettings{
+			Mirror: &HTTPFrontendMirror{BackendId: "b", Percent: 10},
+		},
+		HTTPFrontendSettings{
+			Mirror: &HTTPFrontendMirror{BackendId: "m", Percent: 101},
+		},
+		HTTPFrontendSettings{
+			MaxInFlight: 1, MaxInFlightWait: "-1s",
+		},
+		HTTPFrontendSettings{
+			RequestID: &HTTPFrontendRequestID{Header: "X Request Id"},
+		},
+		HTTPFrontendSettings{
+			RequestID: &HTTPFrontendRequestID{Pattern: "[a-z"},
+		},
+		HTTPFrontendSettings{
+			RouteHeader: &HTTPFrontendRouteHeader{Header: "X Route"},
+		},
+		HTTPFrontendSettings{
+			RouteHeader: &HTTPFrontendRouteHeader{Header: "X-Route:"},
+		},
 	}
 	for _, s := range settings {
 		f, err := NewHTTPFrontend(route.NewMux(), "f1", "b", `Path("/home")`, s)
@@ -102,6 +518,8 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 			Read:         "1s",
 			Dial:         "2s",
 			TLSHandshake: "3s",
+			Drain:        "5s",
+			BodyIdle:     "6s",
 		},
 		KeepAlive: HTTPBackendKeepAlive{
 			Period:              "4s",
@@ -118,11 +536,71 @@ func (s *BackendSuite) TestNewBackendWithOptions(c *C) {
 	c.Assert(o.Timeouts.Read, Equals, time.Second)
 	c.Assert(o.Timeouts.Dial, Equals, 2*time.Second)
 	c.Assert(o.Timeouts.TLSHandshake, Equals, 3*time.Second)
+	c.Assert(o.Timeouts.Drain, Equals, 5*time.Second)
+	c.Assert(o.Timeouts.BodyIdle, Equals, 6*time.Second)
+	// response header timeout defaults to the read timeout
+	c.Assert(o.Timeouts.ResponseHeader, Equals, time.Second)
+
+	options.Timeouts.ResponseHeader = "7s"
+	b, err = NewHTTPBackend("b1", options)
+	c.Assert(err, IsNil)
+	o, err = b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.Timeouts.Read, Equals, time.Second)
+	c.Assert(o.Timeouts.ResponseHeader, Equals, 7*time.Second)
 
 	c.Assert(o.KeepAlive.Period, Equals, 4*time.Second)
 	c.Assert(o.KeepAlive.MaxIdleConnsPerHost, Equals, 3)
 }
 
+func (s *BackendSuite) TestBackendUpstreamTLS(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{TLS: &TLSSettings{ServerName: "upstream.internal"}})
+	c.Assert(err, IsNil)
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.TLS.ServerName, Equals, "upstream.internal")
+	c.Assert(o.TLS.RootCAs, IsNil)
+
+	_, err = NewHTTPBackend("b1", HTTPBackendSettings{TLS: &TLSSettings{CA: []byte("bla")}})
+	c.Assert(err, NotNil)
+	_, err = NewHTTPBackend("b1", HTTPBackendSettings{TLS: &TLSSettings{ClientKeyPair: &KeyPair{Cert: []byte("a"), Key: []byte("b")}}})
+	c.Assert(err, NotNil)
+
+	// the settings of the backends are rejected by the listeners
+	l := Listener{Protocol: HTTPS, Settings: &HTTPSListenerSettings{TLS: TLSSettings{ServerName: "upstream.internal"}}}
+	_, err = l.TLSConfig()
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestSessionTicketKeysRotation(c *C) {
+	key := func(b byte) []byte { return bytes.Repeat([]byte{b}, SessionTicketKeySize) }
+	var t TLSSettings
+	c.Assert(t.RotateSessionTicketKeys([]byte("short")), NotNil)
+
+	c.Assert(t.RotateSessionTicketKeys(key(1)), IsNil)
+	keys, err := t.sessionTicketKeys()
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 1)
+	c.Assert(keys[0][0], Equals, byte(1))
+
+	// the newest key is staged, the key before it encrypts the tickets and the oldest one goes last
+	for _, b := range []byte{2, 3, 4} {
+		c.Assert(t.RotateSessionTicketKeys(key(b)), IsNil)
+	}
+	c.Assert(t.SessionTicketKeys, DeepEquals, [][]byte{key(2), key(3), key(4)})
+	keys, err = t.sessionTicketKeys()
+	c.Assert(err, IsNil)
+	c.Assert([]byte{keys[0][0], keys[1][0], keys[2][0]}, DeepEquals, []byte{3, 4, 2})
+
+	other := TLSSettings{SessionTicketKeys: [][]byte{key(2), key(3)}}
+	c.Assert(t.Equals(&other), Equals, false)
+	c.Assert(other.RotateSessionTicketKeys(key(4)), IsNil)
+	c.Assert(t.Equals(&other), Equals, true)
+
+	_, err = NewTLSConfig(&TLSSettings{SessionTicketKeys: [][]byte{[]byte("short")}})
+	c.Assert(err, NotNil)
+}
+
 func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 	options := []struct {
 		a HTTPBackendSettings
@@ -150,11 +628,21 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{Read: "1s"}},
 			e: false,
 		},
+		{
+			a: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{BodyIdle: "2s"}},
+			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{BodyIdle: "1s"}},
+			e: false,
+		},
 		{
 			a: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{TLSHandshake: "2s"}},
 			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{TLSHandshake: "1s"}},
 			e: false,
 		},
+		{
+			a: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{Drain: "2s"}},
+			b: HTTPBackendSettings{Timeouts: HTTPBackendTimeouts{Drain: "1s"}},
+			e: false,
+		},
 
 		{
 			a: HTTPBackendSettings{KeepAlive: HTTPBackendKeepAlive{Period: "2s"}},
@@ -177,6 +665,31 @@ func (s *BackendSuite) TestBackendSettingsEq(c *C) {
 			b: HTTPBackendSettings{TLS: &TLSSettings{SessionTicketsDisabled: true}},
 			e: false,
 		},
+		{
+			a: HTTPBackendSettings{TLS: &TLSSettings{ServerName: "a"}},
+			b: HTTPBackendSettings{TLS: &TLSSettings{ServerName: "b"}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{KeepAlive: HTTPBackendKeepAlive{MaxConnsPerHost: 1}},
+			b: HTTPBackendSettings{KeepAlive: HTTPBackendKeepAlive{MaxConnsPerHost: 2}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{StickySession: &StickySession{CookieName: "a"}},
+			b: HTTPBackendSettings{StickySession: &StickySession{CookieName: "a"}},
+			e: true,
+		},
+		{
+			a: HTTPBackendSettings{StickySession: &StickySession{CookieName: "a"}},
+			b: HTTPBackendSettings{StickySession: &StickySession{CookieName: "a", Secure: true}},
+			e: false,
+		},
+		{
+			a: HTTPBackendSettings{Protocol: BackendProtocolH2C},
+			b: HTTPBackendSettings{},
+			e: false,
+		},
 	}
 	for _, o := range options {
 		c.Assert(o.a.Equals(o.b), Equals, o.e)
@@ -253,12 +766,148 @@ func (s *BackendSuite) TestListenerSettingsEq(c *C) {
 			e: false,
 			c: "session tickets",
 		},
+		{
+			a: Listener{RedirectToHTTPS: &HTTPSRedirectSettings{}},
+			b: Listener{},
+			e: false,
+			c: "redirect",
+		},
+		{
+			a: Listener{RedirectToHTTPS: &HTTPSRedirectSettings{Port: 8443}},
+			b: Listener{RedirectToHTTPS: &HTTPSRedirectSettings{Port: 8443}},
+			e: true,
+			c: "same redirect",
+		},
+		{
+			a: Listener{IdleTimeout: "30s"},
+			b: Listener{},
+			e: false,
+			c: "idle timeout",
+		},
+		{
+			a: Listener{ProxyProtocol: PROXY_PROTO_V2, ProxyProtocolTrustedCIDRs: []string{"10.0.0.0/8"}},
+			b: Listener{ProxyProtocol: PROXY_PROTO_V2, ProxyProtocolTrustedCIDRs: []string{"10.0.0.0/16"}},
+			e: false,
+			c: "proxy protocol trusted networks",
+		},
+		{
+			a: Listener{SocketMode: "0660"},
+			b: Listener{SocketMode: "0600"},
+			e: false,
+			c: "socket mode",
+		},
+		{
+			a: Listener{MaxHeaderBytes: 1024},
+			b: Listener{MaxHeaderBytes: 2048},
+			e: false,
+			c: "max header bytes",
+		},
+		{
+			a: Listener{DisableHTTP2: true},
+			b: Listener{},
+			e: false,
+			c: "disable http2",
+		},
 	}
 	for _, o := range options {
 		c.Assert((&o.a).SettingsEquals(&o.b), Equals, o.e, Commentf("TC: %v", o.c))
 	}
 }
 
+func (s *BackendSuite) TestListenerRedirectFromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"RedirectToHTTPS":{"Port":8443,"ACME":true}}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.RedirectToHTTPS, DeepEquals, &HTTPSRedirectSettings{Port: 8443, ACME: true})
+
+	// https listeners and bad ports are rejected
+	_, err = ListenerFromJSON([]byte(`{"Protocol":"https","Address":{"Network":"tcp","Address":"localhost:443"},"RedirectToHTTPS":{}}`), "l1")
+	c.Assert(err, NotNil)
+	_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"RedirectToHTTPS":{"Port":-1}}`), "l1")
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestListenerIdleTimeoutFromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"IdleTimeout":"30s"}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.IdleTimeoutDuration(), Equals, 30*time.Second)
+
+	for _, t := range []string{"forever", "0s", "-1s"} {
+		_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"IdleTimeout":"`+t+`"}`), "l1")
+		c.Assert(err, NotNil, Commentf(t))
+	}
+}
+
+func (s *BackendSuite) TestListenerMaxHeaderBytesFromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"MaxHeaderBytes":4096}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.MaxHeaderBytes, Equals, 4096)
+
+	_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"MaxHeaderBytes":-1}`), "l1")
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestListenerDisableHTTP2FromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"https","Address":{"Network":"tcp","Address":"localhost:443"},"DisableHTTP2":true}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.DisableHTTP2, Equals, true)
+
+	_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"DisableHTTP2":true}`), "l1")
+	c.Assert(err, NotNil)
+}
+
+func (s *BackendSuite) TestListenerSocketModeFromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"unix","Address":"/run/vulcand.sock"},"SocketMode":"0660"}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.SocketFileMode(), Equals, os.FileMode(0660))
+
+	for _, t := range []string{
+		`{"Network":"unix","Address":"/run/vulcand.sock"},"SocketMode":"rw"`,
+		`{"Network":"unix","Address":"/run/vulcand.sock"},"SocketMode":"0"`,
+		`{"Network":"unix","Address":"/run/vulcand.sock"},"SocketMode":"1777"`,
+		`{"Network":"tcp","Address":"localhost:80"},"SocketMode":"0660"`,
+	} {
+		_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":`+t+`}`), "l1")
+		c.Assert(err, NotNil, Commentf(t))
+	}
+}
+
+func (s *BackendSuite) TestAddressEquals(c *C) {
+	a := Address{Network: UNIX, Address: "/run/vulcand.sock"}
+	c.Assert(a.Equals(Address{Network: UNIX, Address: "/run/vulcand/../vulcand.sock"}), Equals, true)
+	c.Assert(a.Equals(Address{Network: TCP, Address: "/run/vulcand.sock"}), Equals, false)
+	c.Assert(a.Equals(Address{Network: UNIX, Address: "/run/other.sock"}), Equals, false)
+
+	t := Address{Network: TCP, Address: "localhost:80"}
+	c.Assert(t.Equals(Address{Network: TCP, Address: "localhost:80"}), Equals, true)
+	c.Assert(t.Equals(Address{Network: TCP, Address: "localhost:81"}), Equals, false)
+}
+
+func (s *BackendSuite) TestListenerProxyProtocolFromJSON(c *C) {
+	l, err := ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},"ProxyProtocol":"proxy_v2","ProxyProtocolTrustedCIDRs":["10.0.0.0/8"]}`), "l1")
+	c.Assert(err, IsNil)
+	c.Assert(l.ProxyProtocol, Equals, PROXY_PROTO_V2)
+	nets, err := l.ProxyProtocolTrustedNets()
+	c.Assert(err, IsNil)
+	c.Assert(nets[0].String(), Equals, "10.0.0.0/8")
+	c.Assert(l.ProxyProtocolTrustsUnix(), Equals, false)
+
+	l, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"unix","Address":"/run/vulcand.sock"},"ProxyProtocol":"proxy_v1","ProxyProtocolTrustedCIDRs":["unix"]}`), "l1")
+	c.Assert(err, IsNil)
+	nets, err = l.ProxyProtocolTrustedNets()
+	c.Assert(err, IsNil)
+	c.Assert(nets, HasLen, 0)
+	c.Assert(l.ProxyProtocolTrustsUnix(), Equals, true)
+
+	for _, t := range []string{
+		`"ProxyProtocol":"PROXY_V3"`,
+		`"ProxyProtocol":"PROXY_V1","ProxyProtocolTrustedCIDRs":["10.0.0.0"]`,
+		`"ProxyProtocolTrustedCIDRs":["10.0.0.0/8"]`,
+	} {
+		_, err = ListenerFromJSON([]byte(`{"Protocol":"http","Address":{"Network":"tcp","Address":"localhost:80"},`+t+`}`), "l1")
+		c.Assert(err, NotNil, Commentf(t))
+	}
+}
+
 func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 	options := []HTTPBackendSettings{
 		HTTPBackendSettings{
@@ -276,11 +925,35 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 				TLSHandshake: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			Timeouts: HTTPBackendTimeouts{
+				ResponseHeader: "1what?",
+			},
+		},
+		HTTPBackendSettings{
+			Timeouts: HTTPBackendTimeouts{
+				BodyIdle: "1what?",
+			},
+		},
 		HTTPBackendSettings{
 			KeepAlive: HTTPBackendKeepAlive{
 				Period: "1what?",
 			},
 		},
+		HTTPBackendSettings{
+			Protocol: "spdy",
+		},
+		HTTPBackendSettings{
+			KeepAlive: HTTPBackendKeepAlive{
+				MaxConnsPerHost: -1,
+			},
+		},
+		HTTPBackendSettings{
+			StickySession: &StickySession{CookieName: "a;b"},
+		},
+		HTTPBackendSettings{
+			StickySession: &StickySession{TTL: "-1s"},
+		},
 	}
 	for _, o := range options {
 		b, err := NewHTTPBackend("b1", o)
@@ -289,6 +962,269 @@ func (s *BackendSuite) TestNewBackendWithBadOptions(c *C) {
 	}
 }
 
+func (s *BackendSuite) TestNewBackendWithHealthCheck(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		HealthCheck: &HealthCheck{Interval: "2s", UnhealthyThreshold: 3, ExpectedCodes: []int{200, 204}},
+	})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.HealthCheck, NotNil)
+	c.Assert(o.HealthCheck.Path, Equals, "/")
+	c.Assert(o.HealthCheck.Interval, Equals, 2*time.Second)
+	c.Assert(o.HealthCheck.Timeout, Equals, 2*time.Second)
+	c.Assert(o.HealthCheck.HealthyThreshold, Equals, 1)
+	c.Assert(o.HealthCheck.UnhealthyThreshold, Equals, 3)
+	c.Assert(o.HealthCheck.IsExpectedCode(204), Equals, true)
+	c.Assert(o.HealthCheck.IsExpectedCode(201), Equals, false)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	o, err = b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.HealthCheck, IsNil)
+}
+
+func (s *BackendSuite) TestNewBackendWithStickySession(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		StickySession: &StickySession{TTL: "30m", Secure: true},
+	})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.StickySession, DeepEquals, &StickySessionSettings{
+		CookieName: DefaultStickyCookieName,
+		TTL:        30 * time.Minute,
+		Secure:     true,
+	})
+}
+
+func (s *BackendSuite) TestNewBackendWithBadHealthCheck(c *C) {
+	checks := []HealthCheck{
+		{Path: "health"},
+		{Interval: "1what?"},
+		{Interval: "-1s"},
+		{Timeout: "1what?"},
+		{HealthyThreshold: -1},
+		{ExpectedCodes: []int{1000}},
+		{ExpectJSONPath: "checks..status"},
+		{ExpectJSONValue: "ok"},
+	}
+	for _, hc := range checks {
+		check := hc
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{HealthCheck: &check})
+		c.Assert(err, NotNil)
+		c.Assert(b, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestHealthCheckBody(c *C) {
+	hc := &HealthCheck{ExpectBody: "healthy"}
+	o, err := hc.Settings()
+	c.Assert(err, IsNil)
+	c.Assert(o.ChecksBody(), Equals, true)
+	c.Assert(o.CheckBody([]byte("I'm healthy")), IsNil)
+	c.Assert(o.CheckBody([]byte("I'm sick")), NotNil)
+
+	hc = &HealthCheck{ExpectJSONPath: "checks.1.status", ExpectJSONValue: "ok"}
+	o, err = hc.Settings()
+	c.Assert(err, IsNil)
+	c.Assert(o.ExpectJSONPath, DeepEquals, []string{"checks", "1", "status"})
+	c.Assert(o.CheckBody([]byte(`{"checks":[{"status":"degraded"},{"status":"ok"}]}`)), IsNil)
+	for _, body := range []string{
+		`{"checks":[{"status":"ok"},{"status":"degraded"}]}`,
+		`{"checks":[{"status":"ok"}]}`,
+		`{"checks":{"status":"ok"}}`,
+		`{"status":"ok"}`,
+		`ok`,
+	} {
+		c.Assert(o.CheckBody([]byte(body)), NotNil, Commentf(body))
+	}
+
+	// the values other than strings are compared by their JSON form
+	o, err = (&HealthCheck{ExpectJSONPath: "up", ExpectJSONValue: "true"}).Settings()
+	c.Assert(err, IsNil)
+	c.Assert(o.CheckBody([]byte(`{"up":true}`)), IsNil)
+	c.Assert(o.CheckBody([]byte(`{"up":false}`)), NotNil)
+
+	o, err = (&HealthCheck{}).Settings()
+	c.Assert(err, IsNil)
+	c.Assert(o.ChecksBody(), Equals, false)
+}
+
+func (s *BackendSuite) TestHealthCheckEq(c *C) {
+	a := HTTPBackendSettings{HealthCheck: &HealthCheck{Path: "/health", ExpectedCodes: []int{200}}}
+	b := HTTPBackendSettings{HealthCheck: &HealthCheck{Path: "/health", ExpectedCodes: []int{200}}}
+	c.Assert(a.Equals(b), Equals, true)
+
+	b.HealthCheck.ExpectedCodes = []int{204}
+	c.Assert(a.Equals(b), Equals, false)
+
+	b.HealthCheck.ExpectedCodes = []int{200}
+	b.HealthCheck.ExpectJSONPath, b.HealthCheck.ExpectJSONValue = "status", "ok"
+	c.Assert(a.Equals(b), Equals, false)
+
+	c.Assert(a.Equals(HTTPBackendSettings{}), Equals, false)
+}
+
+func (s *BackendSuite) TestNewBackendWithOutlierDetection(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		OutlierDetection: &OutlierDetection{BaseEjectionTime: "10s", MaxEjectionTime: "25s"},
+	})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.OutlierDetection, NotNil)
+	c.Assert(o.OutlierDetection.ConsecutiveErrors, Equals, DefaultConsecutiveErrors)
+	c.Assert(o.OutlierDetection.EjectionTime(1), Equals, 10*time.Second)
+	c.Assert(o.OutlierDetection.EjectionTime(2), Equals, 20*time.Second)
+	c.Assert(o.OutlierDetection.EjectionTime(3), Equals, 25*time.Second)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{})
+	c.Assert(err, IsNil)
+	o, err = b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.OutlierDetection, IsNil)
+}
+
+func (s *BackendSuite) TestNewBackendWithBadOutlierDetection(c *C) {
+	detections := []OutlierDetection{
+		{ConsecutiveErrors: -1},
+		{BaseEjectionTime: "1what?"},
+		{BaseEjectionTime: "-1s"},
+		{MaxEjectionTime: "1what?"},
+		{BaseEjectionTime: "10s", MaxEjectionTime: "1s"},
+	}
+	for _, od := range detections {
+		detection := od
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{OutlierDetection: &detection})
+		c.Assert(err, NotNil)
+		c.Assert(b, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestNewBackendWithDiscovery(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		Discovery: &ServerDiscovery{SRV: "_http._tcp.example.com", MinRefresh: "10s"},
+	})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.Discovery, NotNil)
+	c.Assert(o.Discovery.Scheme, Equals, HTTP)
+	c.Assert(o.Discovery.RefreshInterval(time.Second), Equals, 10*time.Second)
+	c.Assert(o.Discovery.RefreshInterval(time.Minute), Equals, time.Minute)
+	c.Assert(o.Discovery.RefreshInterval(time.Hour), Equals, DefaultDiscoveryMaxRefresh)
+
+	discoveries := []ServerDiscovery{
+		{},
+		{SRV: "_http._tcp.example.com", Scheme: "ftp"},
+		{SRV: "_http._tcp.example.com", MinRefresh: "1what?"},
+		{SRV: "_http._tcp.example.com", MinRefresh: "0s"},
+		{SRV: "_http._tcp.example.com", MinRefresh: "10s", MaxRefresh: "1s"},
+	}
+	for _, d := range discoveries {
+		discovery := d
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{Discovery: &discovery})
+		c.Assert(err, NotNil)
+		c.Assert(b, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestNewBackendWithSlowStart(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{SlowStart: &SlowStart{Duration: "30s"}})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.SlowStart, DeepEquals, &SlowStartSettings{Duration: 30 * time.Second})
+
+	settings := b.HTTPSettings()
+	c.Assert(settings.Equals(HTTPBackendSettings{SlowStart: &SlowStart{Duration: "30s"}}), Equals, true)
+	c.Assert(settings.Equals(HTTPBackendSettings{SlowStart: &SlowStart{Duration: "10s"}}), Equals, false)
+	c.Assert(settings.Equals(HTTPBackendSettings{}), Equals, false)
+
+	for _, d := range []string{"", "1what?", "0s", "-1s", "10ns", "500ms"} {
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{SlowStart: &SlowStart{Duration: d}})
+		c.Assert(err, NotNil)
+		c.Assert(b, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestNewBackendWithLoadBalancer(c *C) {
+	b, err := NewHTTPBackend("b1", HTTPBackendSettings{
+		LoadBalancer: &LoadBalancer{Algorithm: LBConsistentHash, HashKey: "header:x-user"},
+	})
+	c.Assert(err, IsNil)
+
+	o, err := b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.LoadBalancer, DeepEquals, &LoadBalancerSettings{Algorithm: LBConsistentHash, HashSource: HashKeyHeader, HashHeader: "X-User"})
+
+	settings := b.HTTPSettings()
+	c.Assert(settings.Equals(HTTPBackendSettings{
+		LoadBalancer: &LoadBalancer{Algorithm: LBConsistentHash, HashKey: "header:x-user"},
+	}), Equals, true)
+	c.Assert(settings.Equals(HTTPBackendSettings{LoadBalancer: &LoadBalancer{Algorithm: LBConsistentHash}}), Equals, false)
+	c.Assert(settings.Equals(HTTPBackendSettings{}), Equals, false)
+
+	b, err = NewHTTPBackend("b1", HTTPBackendSettings{LoadBalancer: &LoadBalancer{}})
+	c.Assert(err, IsNil)
+	o, err = b.TransportSettings()
+	c.Assert(err, IsNil)
+	c.Assert(o.LoadBalancer.Algorithm, Equals, LBRoundRobin)
+
+	keys := map[LoadBalancer]LoadBalancerSettings{
+		{Algorithm: LBConsistentHash}:                  {Algorithm: LBConsistentHash, HashSource: HashKeyIP},
+		{Algorithm: LBConsistentHash, HashKey: "path"}: {Algorithm: LBConsistentHash, HashSource: HashKeyPath},
+		{Algorithm: LBConsistentHash, HashKey: "path:2", LoadFactor: 1.25}: {
+			Algorithm: LBConsistentHash, HashSource: HashKeyPath, HashPathSegments: 2, LoadFactor: 1.25},
+		{Algorithm: LBConsistentHash, HashKey: "url"}: {Algorithm: LBConsistentHash, HashSource: HashKeyURL},
+	}
+	for l, expected := range keys {
+		l := l
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{LoadBalancer: &l})
+		c.Assert(err, IsNil)
+		o, err := b.TransportSettings()
+		c.Assert(err, IsNil)
+		c.Assert(*o.LoadBalancer, DeepEquals, expected)
+	}
+
+	bad := []LoadBalancer{
+		{Algorithm: "fastest"},
+		{Algorithm: LBLeastConn, HashKey: HashKeyIP},
+		{Algorithm: LBConsistentHash, HashKey: "cookie"},
+		{Algorithm: LBConsistentHash, HashKey: "ip:x"},
+		{Algorithm: LBConsistentHash, HashKey: "header:"},
+		{Algorithm: LBConsistentHash, HashKey: "path:0"},
+		{Algorithm: LBConsistentHash, HashKey: "path:x"},
+		{Algorithm: LBConsistentHash, HashKey: "url:x"},
+		{Algorithm: LBConsistentHash, LoadFactor: 0.5},
+		{Algorithm: LBRandom, LoadFactor: 1.25},
+	}
+	for _, l := range bad {
+		l := l
+		b, err := NewHTTPBackend("b1", HTTPBackendSettings{LoadBalancer: &l})
+		c.Assert(err, NotNil, Commentf("%#v", l))
+		c.Assert(b, IsNil)
+	}
+}
+
+func (s *BackendSuite) TestOutlierDetectionEq(c *C) {
+	a := HTTPBackendSettings{OutlierDetection: &OutlierDetection{ConsecutiveErrors: 3}}
+	b := HTTPBackendSettings{OutlierDetection: &OutlierDetection{ConsecutiveErrors: 3}}
+	c.Assert(a.Equals(b), Equals, true)
+
+	b.OutlierDetection.ConsecutiveErrors = 4
+	c.Assert(a.Equals(b), Equals, false)
+
+	c.Assert(a.Equals(HTTPBackendSettings{}), Equals, false)
+}
+
 func (s *BackendSuite) TestNewServer(c *C) {
 	sv, err := NewServer("s1", "http://falhost")
 	c.Assert(err, IsNil)
@@ -386,6 +1322,17 @@ func (s *BackendSuite) TestServerFromJSON(c *C) {
 	c.Assert(out, NotNil)
 
 	c.Assert(out, DeepEquals, e)
+	c.Assert(out.LBWeight(), Equals, DefaultServerWeight)
+}
+
+func (s *BackendSuite) TestServerWithWeightFromJSON(c *C) {
+	out, err := ServerFromJSON([]byte(`{"Id": "sv1", "URL": "http://localhost", "Weight": 3}`))
+	c.Assert(err, IsNil)
+	c.Assert(out.Weight, Equals, 3)
+	c.Assert(out.LBWeight(), Equals, 3)
+
+	_, err = ServerFromJSON([]byte(`{"Id": "sv1", "URL": "http://localhost", "Weight": -1}`))
+	c.Assert(err, NotNil)
 }
 
 func (s *BackendSuite) TestNewTLSSettings(c *C) {
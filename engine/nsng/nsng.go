@@ -0,0 +1,925 @@
+// Package nsng merges the configurations of several engines, called namespaces, into one configuration.
+// Listeners, frontends and backends of every namespace get namespaced ids, e.g. tenant1.frontend1, so
+// the objects with the same ids in different namespaces do not collide. Host names are shared, so the host
+// belongs to one namespace: the engines returned by Namespace reject the hosts defined in another namespace.
+// The host written to several namespaces bypassing them is taken from the namespace listed first.
+//
+// Namespaces are expected to be prefixes in the same etcd cluster, so their change indexes are comparable.
+package nsng
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// Namespace is the named engine serving the part of the configuration
+type Namespace struct {
+	Name   string
+	Engine engine.Engine
+}
+
+type ng struct {
+	namespaces []Namespace
+	byName     map[string]engine.Engine
+}
+
+// New returns the engine merging the namespaces, namespace names should be unique and can not contain
+// the namespace separator
+func New(namespaces []Namespace) (engine.Engine, error) {
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("at least one namespace is required")
+	}
+	n := &ng{namespaces: namespaces, byName: make(map[string]engine.Engine, len(namespaces))}
+	for _, ns := range namespaces {
+		if ns.Name == "" || strings.Contains(ns.Name, engine.NamespaceSeparator) || strings.Contains(ns.Name, "/") {
+			return nil, fmt.Errorf("invalid namespace name '%v'", ns.Name)
+		}
+		if _, ok := n.byName[ns.Name]; ok {
+			return nil, fmt.Errorf("duplicate namespace '%v'", ns.Name)
+		}
+		n.byName[ns.Name] = ns.Engine
+	}
+	return n, nil
+}
+
+// Namespace returns the engine of the namespace rejecting the hosts defined in the other namespaces
+func (n *ng) Namespace(name string) (engine.Engine, error) {
+	for i := range n.namespaces {
+		if n.namespaces[i].Name != name {
+			continue
+		}
+		ns := &namespace{Engine: n.namespaces[i].Engine, n: n, i: i}
+		if pg, ok := ns.Engine.(engine.Pager); ok {
+			return &pagedNamespace{namespace: ns, Pager: pg}, nil
+		}
+		return ns, nil
+	}
+	return nil, &engine.NotFoundError{Message: fmt.Sprintf("namespace '%v' not found", name)}
+}
+
+// split returns the engine of the namespace and the id in the namespace
+func (n *ng) split(id string) (engine.Engine, string, string, error) {
+	ns, id, err := engine.SplitNamespacedId(id)
+	if err != nil {
+		return nil, "", "", err
+	}
+	e, ok := n.byName[ns]
+	if !ok {
+		return nil, "", "", &engine.NotFoundError{Message: fmt.Sprintf("namespace '%v' not found", ns)}
+	}
+	return e, ns, id, nil
+}
+
+func (n *ng) Close() {
+	for _, ns := range n.namespaces {
+		ns.Engine.Close()
+	}
+}
+
+func (n *ng) GetSnapshot() (*engine.Snapshot, error) {
+	ss := &engine.Snapshot{}
+	hosts := map[string]bool{}
+	for i, ns := range n.namespaces {
+		s, err := ns.Engine.GetSnapshot()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get snapshot of namespace %v", ns.Name)
+		}
+		// the changes are replayed from the oldest index, upserts are idempotent
+		if i == 0 || s.Index < ss.Index {
+			ss.Index = s.Index
+		}
+		for _, h := range s.Hosts {
+			if hosts[h.Name] {
+				log.Warningf("Host %v of namespace %v is shadowed by the namespace listed before", h.Name, ns.Name)
+				continue
+			}
+			hosts[h.Name] = true
+			ss.Hosts = append(ss.Hosts, h)
+		}
+		for _, l := range s.Listeners {
+			ss.Listeners = append(ss.Listeners, qualifyListener(ns.Name, l))
+		}
+		for _, bs := range s.BackendSpecs {
+			bs.Backend = qualifyBackend(ns.Name, bs.Backend)
+			ss.BackendSpecs = append(ss.BackendSpecs, bs)
+		}
+		for _, fs := range s.FrontendSpecs {
+			fs.Frontend = qualifyFrontend(ns.Name, fs.Frontend)
+			ss.FrontendSpecs = append(ss.FrontendSpecs, fs)
+		}
+	}
+	return ss, nil
+}
+
+func (n *ng) GetLogSeverity() log.Level {
+	return n.namespaces[0].Engine.GetLogSeverity()
+}
+
+func (n *ng) SetLogSeverity(sev log.Level) {
+	for _, ns := range n.namespaces {
+		ns.Engine.SetLogSeverity(sev)
+	}
+}
+
+func (n *ng) GetRegistry() *plugin.Registry {
+	return n.namespaces[0].Engine.GetRegistry()
+}
+
+func (n *ng) GetHosts() ([]engine.Host, error) {
+	var out []engine.Host
+	seen := map[string]bool{}
+	for _, ns := range n.namespaces {
+		hosts, err := ns.Engine.GetHosts()
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hosts {
+			if !seen[h.Name] {
+				seen[h.Name] = true
+				out = append(out, h)
+			}
+		}
+	}
+	return out, nil
+}
+
+// hostOwner returns the first namespace having the host, nil if there is none
+func (n *ng) hostOwner(name string, namespaces []Namespace) (*Namespace, error) {
+	for i := range namespaces {
+		_, err := namespaces[i].Engine.GetHost(engine.HostKey{Name: name})
+		if err == nil {
+			return &namespaces[i], nil
+		}
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// hostConflict returns AlreadyExistsError if the host is defined in a namespace other than the i-th one
+func (n *ng) hostConflict(i int, name string) error {
+	for j, ns := range n.namespaces {
+		if j == i {
+			continue
+		}
+		_, err := ns.Engine.GetHost(engine.HostKey{Name: name})
+		if err == nil {
+			return &engine.AlreadyExistsError{Message: fmt.Sprintf("host '%v' is defined in namespace %v", name, ns.Name)}
+		}
+		if _, ok := err.(*engine.NotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *ng) GetHost(k engine.HostKey) (*engine.Host, error) {
+	owner, err := n.hostOwner(k.Name, n.namespaces)
+	if err != nil {
+		return nil, err
+	}
+	if owner == nil {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("host '%v' not found", k.Name)}
+	}
+	return owner.Engine.GetHost(k)
+}
+
+// UpsertHost updates the host in the namespace it is taken from, new hosts go to the first namespace
+func (n *ng) UpsertHost(h engine.Host) error {
+	owner, err := n.hostOwner(h.Name, n.namespaces)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		owner = &n.namespaces[0]
+	}
+	return owner.Engine.UpsertHost(h)
+}
+
+func (n *ng) DeleteHost(k engine.HostKey) error {
+	owner, err := n.hostOwner(k.Name, n.namespaces)
+	if err != nil {
+		return err
+	}
+	if owner == nil {
+		return &engine.NotFoundError{Message: fmt.Sprintf("host '%v' not found", k.Name)}
+	}
+	return owner.Engine.DeleteHost(k)
+}
+
+func (n *ng) GetListeners() ([]engine.Listener, error) {
+	var out []engine.Listener
+	for _, ns := range n.namespaces {
+		ls, err := ns.Engine.GetListeners()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ls {
+			out = append(out, qualifyListener(ns.Name, l))
+		}
+	}
+	return out, nil
+}
+
+func (n *ng) GetListener(lk engine.ListenerKey) (*engine.Listener, error) {
+	e, ns, id, err := n.split(lk.Id)
+	if err != nil {
+		return nil, err
+	}
+	l, err := e.GetListener(engine.ListenerKey{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	out := qualifyListener(ns, *l)
+	return &out, nil
+}
+
+func (n *ng) UpsertListener(l engine.Listener) error {
+	e, _, id, err := n.split(l.Id)
+	if err != nil {
+		return err
+	}
+	l.Id = id
+	return e.UpsertListener(l)
+}
+
+// SwapListener swaps the listener in its namespace, the listener is upserted if the engine of the namespace
+// is not a swapper
+func (n *ng) SwapListener(old, l engine.Listener) error {
+	e, _, id, err := n.split(l.Id)
+	if err != nil {
+		return err
+	}
+	l.Id = id
+	s, ok := e.(engine.ListenerSwapper)
+	if !ok {
+		return e.UpsertListener(l)
+	}
+	old.Id = id
+	return s.SwapListener(old, l)
+}
+
+func (n *ng) DeleteListener(lk engine.ListenerKey) error {
+	e, _, id, err := n.split(lk.Id)
+	if err != nil {
+		return err
+	}
+	return e.DeleteListener(engine.ListenerKey{Id: id})
+}
+
+func (n *ng) GetFrontends() ([]engine.Frontend, error) {
+	var out []engine.Frontend
+	for _, ns := range n.namespaces {
+		fs, err := ns.Engine.GetFrontends()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fs {
+			out = append(out, qualifyFrontend(ns.Name, f))
+		}
+	}
+	return out, nil
+}
+
+func (n *ng) GetFrontend(fk engine.FrontendKey) (*engine.Frontend, error) {
+	e, ns, id, err := n.split(fk.Id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := e.GetFrontend(engine.FrontendKey{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	out := qualifyFrontend(ns, *f)
+	return &out, nil
+}
+
+// UpsertFrontend upserts the frontend in its namespace, the frontend can use the backends of its namespace only
+func (n *ng) UpsertFrontend(f engine.Frontend, ttl time.Duration) error {
+	e, ns, id, err := n.split(f.Id)
+	if err != nil {
+		return err
+	}
+	if f, err = unqualifyFrontend(ns, id, f); err != nil {
+		return err
+	}
+	return e.UpsertFrontend(f, ttl)
+}
+
+func (n *ng) DeleteFrontend(fk engine.FrontendKey) error {
+	e, _, id, err := n.split(fk.Id)
+	if err != nil {
+		return err
+	}
+	return e.DeleteFrontend(engine.FrontendKey{Id: id})
+}
+
+func (n *ng) GetMiddlewares(fk engine.FrontendKey) ([]engine.Middleware, error) {
+	e, _, id, err := n.split(fk.Id)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetMiddlewares(engine.FrontendKey{Id: id})
+}
+
+func (n *ng) GetMiddleware(mk engine.MiddlewareKey) (*engine.Middleware, error) {
+	e, _, id, err := n.split(mk.FrontendKey.Id)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetMiddleware(engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: id}, Id: mk.Id})
+}
+
+func (n *ng) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware, ttl time.Duration) error {
+	e, _, id, err := n.split(fk.Id)
+	if err != nil {
+		return err
+	}
+	return e.UpsertMiddleware(engine.FrontendKey{Id: id}, m, ttl)
+}
+
+func (n *ng) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	e, _, id, err := n.split(mk.FrontendKey.Id)
+	if err != nil {
+		return err
+	}
+	return e.DeleteMiddleware(engine.MiddlewareKey{FrontendKey: engine.FrontendKey{Id: id}, Id: mk.Id})
+}
+
+func (n *ng) GetBackends() ([]engine.Backend, error) {
+	var out []engine.Backend
+	for _, ns := range n.namespaces {
+		bs, err := ns.Engine.GetBackends()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bs {
+			out = append(out, qualifyBackend(ns.Name, b))
+		}
+	}
+	return out, nil
+}
+
+func (n *ng) GetBackend(bk engine.BackendKey) (*engine.Backend, error) {
+	e, ns, id, err := n.split(bk.Id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := e.GetBackend(engine.BackendKey{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	out := qualifyBackend(ns, *b)
+	return &out, nil
+}
+
+func (n *ng) UpsertBackend(b engine.Backend) error {
+	e, _, id, err := n.split(b.Id)
+	if err != nil {
+		return err
+	}
+	b.Id = id
+	return e.UpsertBackend(b)
+}
+
+func (n *ng) DeleteBackend(bk engine.BackendKey) error {
+	e, _, id, err := n.split(bk.Id)
+	if err != nil {
+		return err
+	}
+	return e.DeleteBackend(engine.BackendKey{Id: id})
+}
+
+func (n *ng) GetServers(bk engine.BackendKey) ([]engine.Server, error) {
+	e, _, id, err := n.split(bk.Id)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetServers(engine.BackendKey{Id: id})
+}
+
+func (n *ng) GetServer(sk engine.ServerKey) (*engine.Server, error) {
+	e, _, id, err := n.split(sk.BackendKey.Id)
+	if err != nil {
+		return nil, err
+	}
+	return e.GetServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: id}, Id: sk.Id})
+}
+
+func (n *ng) UpsertServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) error {
+	e, _, id, err := n.split(bk.Id)
+	if err != nil {
+		return err
+	}
+	return e.UpsertServer(engine.BackendKey{Id: id}, s, ttl)
+}
+
+func (n *ng) DeleteServer(sk engine.ServerKey) error {
+	e, _, id, err := n.split(sk.BackendKey.Id)
+	if err != nil {
+		return err
+	}
+	return e.DeleteServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: id}, Id: sk.Id})
+}
+
+// RegisterServer registers the server in the namespace of the backend if its engine supports registrations
+func (n *ng) RegisterServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) (engine.Registration, error) {
+	e, ns, id, err := n.split(bk.Id)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := e.(engine.Registrar)
+	if !ok {
+		return nil, fmt.Errorf("engine of namespace %v does not support server registrations", ns)
+	}
+	return r.RegisterServer(engine.BackendKey{Id: id}, s, ttl)
+}
+
+// acmeStore returns the store of the ACME state, the state is kept by the namespace listed first as the host
+// names are shared by all namespaces
+func (n *ng) acmeStore() (engine.ACMEStore, error) {
+	ns := n.namespaces[0]
+	st, ok := ns.Engine.(engine.ACMEStore)
+	if !ok {
+		return nil, fmt.Errorf("engine of namespace %v does not support ACME state", ns.Name)
+	}
+	return st, nil
+}
+
+func (n *ng) UpsertChallenge(token, keyAuth string, ttl time.Duration) error {
+	st, err := n.acmeStore()
+	if err != nil {
+		return err
+	}
+	return st.UpsertChallenge(token, keyAuth, ttl)
+}
+
+func (n *ng) GetChallenge(token string) (string, error) {
+	st, err := n.acmeStore()
+	if err != nil {
+		return "", err
+	}
+	return st.GetChallenge(token)
+}
+
+func (n *ng) DeleteChallenge(token string) error {
+	st, err := n.acmeStore()
+	if err != nil {
+		return err
+	}
+	return st.DeleteChallenge(token)
+}
+
+func (n *ng) LockOrder(host, owner string, ttl time.Duration) (bool, error) {
+	st, err := n.acmeStore()
+	if err != nil {
+		return false, err
+	}
+	return st.LockOrder(host, owner, ttl)
+}
+
+func (n *ng) UnlockOrder(host, owner string) error {
+	st, err := n.acmeStore()
+	if err != nil {
+		return err
+	}
+	return st.UnlockOrder(host, owner)
+}
+
+// GetTTLs returns the TTLs of all namespaces qualified with the namespace names, the namespaces with the engines
+// not reporting the TTLs have none
+func (n *ng) GetTTLs() (*engine.TTLs, error) {
+	out := engine.NewTTLs()
+	for _, ns := range n.namespaces {
+		g, ok := ns.Engine.(engine.TTLGetter)
+		if !ok {
+			continue
+		}
+		ttls, err := g.GetTTLs()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get TTLs of namespace %v", ns.Name)
+		}
+		for fk, ttl := range ttls.Frontends {
+			out.Frontends[qualifyFrontendKey(ns.Name, fk)] = ttl
+		}
+		for mk, ttl := range ttls.Middlewares {
+			mk.FrontendKey = qualifyFrontendKey(ns.Name, mk.FrontendKey)
+			out.Middlewares[mk] = ttl
+		}
+		for sk, ttl := range ttls.Servers {
+			sk.BackendKey = qualifyBackendKey(ns.Name, sk.BackendKey)
+			out.Servers[sk] = ttl
+		}
+	}
+	return out, nil
+}
+
+// ApplyBatch applies the batch in a single namespace, batches spanning several namespaces are rejected
+// as they can not be applied atomically
+func (n *ng) ApplyBatch(ops []engine.BatchOp) error {
+	var target *Namespace
+	out := make([]engine.BatchOp, len(ops))
+	for i, op := range ops {
+		ns, err := n.opNamespace(op)
+		if err != nil {
+			return &engine.BatchError{Index: i, Err: err}
+		}
+		if target != nil && target.Name != ns.Name {
+			return &engine.BatchError{Index: i, Err: fmt.Errorf("operation is in namespace %v, batch is in namespace %v", ns.Name, target.Name)}
+		}
+		target = ns
+		change, err := unqualifyChange(ns.Name, op.Change)
+		if err != nil {
+			return &engine.BatchError{Index: i, Err: err}
+		}
+		out[i] = engine.BatchOp{Change: change, TTL: op.TTL}
+	}
+	if target == nil {
+		return nil
+	}
+	b, ok := target.Engine.(engine.Batcher)
+	if !ok {
+		return fmt.Errorf("engine of namespace %v does not support batches", target.Name)
+	}
+	return b.ApplyBatch(out)
+}
+
+// opNamespace returns the namespace the batch operation belongs to
+func (n *ng) opNamespace(op engine.BatchOp) (*Namespace, error) {
+	var id string
+	switch c := op.Change.(type) {
+	case *engine.HostUpserted:
+		return n.hostNamespace(c.Host.Name)
+	case *engine.HostDeleted:
+		return n.hostNamespace(c.HostKey.Name)
+	case *engine.ListenerUpserted:
+		id = c.Listener.Id
+	case *engine.ListenerDeleted:
+		id = c.ListenerKey.Id
+	case *engine.FrontendUpserted:
+		id = c.Frontend.Id
+	case *engine.FrontendDeleted:
+		id = c.FrontendKey.Id
+	case *engine.MiddlewareUpserted:
+		id = c.FrontendKey.Id
+	case *engine.MiddlewareDeleted:
+		id = c.MiddlewareKey.FrontendKey.Id
+	case *engine.BackendUpserted:
+		id = c.Backend.Id
+	case *engine.BackendDeleted:
+		id = c.BackendKey.Id
+	case *engine.ServerUpserted:
+		id = c.BackendKey.Id
+	case *engine.ServerDeleted:
+		id = c.ServerKey.BackendKey.Id
+	default:
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported batch operation %T", op.Change)}
+	}
+	name, _, err := engine.SplitNamespacedId(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range n.namespaces {
+		if n.namespaces[i].Name == name {
+			return &n.namespaces[i], nil
+		}
+	}
+	return nil, &engine.NotFoundError{Message: fmt.Sprintf("namespace '%v' not found", name)}
+}
+
+func (n *ng) hostNamespace(name string) (*Namespace, error) {
+	owner, err := n.hostOwner(name, n.namespaces)
+	if err != nil || owner != nil {
+		return owner, err
+	}
+	return &n.namespaces[0], nil
+}
+
+// Subscribe watches all namespaces and passes on their changes with the namespaced ids. The first
+// watch error stops the watches of all namespaces.
+func (n *ng) Subscribe(changes chan interface{}, afterIdx uint64, cancelC chan struct{}) error {
+	stopC := make(chan struct{})
+	errorC := make(chan error, len(n.namespaces))
+	wg := &sync.WaitGroup{}
+	for i := range n.namespaces {
+		ns := n.namespaces[i]
+		i := i
+		nsChanges := make(chan interface{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer close(nsChanges)
+			errorC <- ns.Engine.Subscribe(nsChanges, afterIdx, stopC)
+		}()
+		go func() {
+			defer wg.Done()
+			for change := range nsChanges {
+				out, err := n.qualifyChange(i, change)
+				if err != nil {
+					log.Warningf("Ignore change %v of namespace %v, error: %v", change, ns.Name, err)
+					continue
+				}
+				if out == nil {
+					continue
+				}
+				select {
+				case changes <- out:
+				case <-stopC:
+				}
+			}
+		}()
+	}
+	var err error
+	select {
+	case err = <-errorC:
+		if err != nil {
+			log.Errorf("Stop watching namespaces: %v", err)
+		}
+	case <-cancelC:
+	}
+	close(stopC)
+	wg.Wait()
+	return err
+}
+
+// qualifyChange returns the change of the namespace with the namespaced ids. Changes of the hosts shadowed
+// by the namespaces listed before are dropped, the deleted host is taken over by the following namespace.
+func (n *ng) qualifyChange(i int, change interface{}) (interface{}, error) {
+	ns := n.namespaces[i]
+	switch c := change.(type) {
+	case *engine.HostUpserted:
+		owner, err := n.hostOwner(c.Host.Name, n.namespaces[:i])
+		if err != nil || owner != nil {
+			return nil, err
+		}
+		return c, nil
+	case *engine.HostDeleted:
+		owner, err := n.hostOwner(c.HostKey.Name, n.namespaces[:i])
+		if err != nil || owner != nil {
+			return nil, err
+		}
+		next, err := n.hostOwner(c.HostKey.Name, n.namespaces[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if next == nil {
+			return c, nil
+		}
+		h, err := next.Engine.GetHost(c.HostKey)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Host %v is taken over by namespace %v", h.Name, next.Name)
+		return &engine.HostUpserted{Host: *h}, nil
+	case *engine.ListenerUpserted:
+		return &engine.ListenerUpserted{HostKey: c.HostKey, Listener: qualifyListener(ns.Name, c.Listener)}, nil
+	case *engine.ListenerDeleted:
+		return &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: engine.NamespacedId(ns.Name, c.ListenerKey.Id)}}, nil
+	case *engine.FrontendUpserted:
+		return &engine.FrontendUpserted{Frontend: qualifyFrontend(ns.Name, c.Frontend)}, nil
+	case *engine.FrontendDeleted:
+		return &engine.FrontendDeleted{FrontendKey: qualifyFrontendKey(ns.Name, c.FrontendKey)}, nil
+	case *engine.MiddlewareUpserted:
+		return &engine.MiddlewareUpserted{FrontendKey: qualifyFrontendKey(ns.Name, c.FrontendKey), Middleware: c.Middleware}, nil
+	case *engine.MiddlewareDeleted:
+		mk := c.MiddlewareKey
+		mk.FrontendKey = qualifyFrontendKey(ns.Name, mk.FrontendKey)
+		return &engine.MiddlewareDeleted{MiddlewareKey: mk}, nil
+	case *engine.BackendUpserted:
+		return &engine.BackendUpserted{Backend: qualifyBackend(ns.Name, c.Backend)}, nil
+	case *engine.BackendDeleted:
+		return &engine.BackendDeleted{BackendKey: qualifyBackendKey(ns.Name, c.BackendKey)}, nil
+	case *engine.ServerUpserted:
+		return &engine.ServerUpserted{BackendKey: qualifyBackendKey(ns.Name, c.BackendKey), Server: c.Server}, nil
+	case *engine.ServerDeleted:
+		sk := c.ServerKey
+		sk.BackendKey = qualifyBackendKey(ns.Name, sk.BackendKey)
+		return &engine.ServerDeleted{ServerKey: sk}, nil
+	}
+	return nil, fmt.Errorf("unsupported change %T", change)
+}
+
+// unqualifyChange returns the batch change with the ids of the namespace
+func unqualifyChange(ns string, change interface{}) (interface{}, error) {
+	var err error
+	id := func(in string) string {
+		if err != nil {
+			return ""
+		}
+		var out string
+		out, err = unqualify(ns, in)
+		return out
+	}
+	var out interface{}
+	switch c := change.(type) {
+	case *engine.HostUpserted, *engine.HostDeleted:
+		return c, nil
+	case *engine.ListenerUpserted:
+		l := c.Listener
+		l.Id = id(l.Id)
+		out = &engine.ListenerUpserted{HostKey: c.HostKey, Listener: l}
+	case *engine.ListenerDeleted:
+		out = &engine.ListenerDeleted{ListenerKey: engine.ListenerKey{Id: id(c.ListenerKey.Id)}}
+	case *engine.FrontendUpserted:
+		fid := id(c.Frontend.Id)
+		if err != nil {
+			return nil, err
+		}
+		var f engine.Frontend
+		if f, err = unqualifyFrontend(ns, fid, c.Frontend); err != nil {
+			return nil, err
+		}
+		out = &engine.FrontendUpserted{Frontend: f}
+	case *engine.FrontendDeleted:
+		out = &engine.FrontendDeleted{FrontendKey: engine.FrontendKey{Id: id(c.FrontendKey.Id)}}
+	case *engine.MiddlewareUpserted:
+		out = &engine.MiddlewareUpserted{FrontendKey: engine.FrontendKey{Id: id(c.FrontendKey.Id)}, Middleware: c.Middleware}
+	case *engine.MiddlewareDeleted:
+		mk := c.MiddlewareKey
+		mk.FrontendKey.Id = id(mk.FrontendKey.Id)
+		out = &engine.MiddlewareDeleted{MiddlewareKey: mk}
+	case *engine.BackendUpserted:
+		b := c.Backend
+		b.Id = id(b.Id)
+		out = &engine.BackendUpserted{Backend: b}
+	case *engine.BackendDeleted:
+		out = &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: id(c.BackendKey.Id)}}
+	case *engine.ServerUpserted:
+		out = &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: id(c.BackendKey.Id)}, Server: c.Server}
+	case *engine.ServerDeleted:
+		sk := c.ServerKey
+		sk.BackendKey.Id = id(sk.BackendKey.Id)
+		out = &engine.ServerDeleted{ServerKey: sk}
+	default:
+		return nil, &engine.InvalidFormatError{Message: fmt.Sprintf("unsupported batch operation %T", change)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// unqualify returns the id in the namespace, objects can refer to the objects of their own namespace only
+func unqualify(ns, id string) (string, error) {
+	idNs, out, err := engine.SplitNamespacedId(id)
+	if err != nil {
+		return "", err
+	}
+	if idNs != ns {
+		return "", &engine.InvalidFormatError{Message: fmt.Sprintf("'%v' is not in namespace %v", id, ns)}
+	}
+	return out, nil
+}
+
+func unqualifyFrontend(ns, id string, f engine.Frontend) (engine.Frontend, error) {
+	backendId, err := unqualify(ns, f.BackendId)
+	if err != nil {
+		return f, err
+	}
+	f.Id, f.BackendId = id, backendId
+	unqualifyId := func(id string) (string, error) { return unqualify(ns, id) }
+	if f, err = mapSettingsListener(f, unqualifyId); err != nil {
+		return f, err
+	}
+	return mapSettingsBackends(f, unqualifyId)
+}
+
+func qualifyListener(ns string, l engine.Listener) engine.Listener {
+	l.Id = engine.NamespacedId(ns, l.Id)
+	return l
+}
+
+func qualifyFrontend(ns string, f engine.Frontend) engine.Frontend {
+	f.Id = engine.NamespacedId(ns, f.Id)
+	f.BackendId = engine.NamespacedId(ns, f.BackendId)
+	qualifyId := func(id string) (string, error) { return engine.NamespacedId(ns, id), nil }
+	f, _ = mapSettingsListener(f, qualifyId)
+	f, _ = mapSettingsBackends(f, qualifyId)
+	return f
+}
+
+// mapSettingsListener replaces the listener id of the TCP frontend, settings are copied as they are shared with
+// the frontend of the namespace engine
+func mapSettingsListener(f engine.Frontend, fn func(string) (string, error)) (engine.Frontend, error) {
+	s, ok := f.Settings.(engine.TCPFrontendSettings)
+	if !ok {
+		return f, nil
+	}
+	id, err := fn(s.ListenerId)
+	if err != nil {
+		return f, err
+	}
+	s.ListenerId = id
+	f.Settings = s
+	return f, nil
+}
+
+// mapSettingsBackends replaces the canary and mirror backend ids of the frontend, settings are copied as they
+// are shared with the frontend of the namespace engine
+func mapSettingsBackends(f engine.Frontend, fn func(string) (string, error)) (engine.Frontend, error) {
+	s, ok := f.Settings.(engine.HTTPFrontendSettings)
+	if !ok || (s.Canary == nil && s.Mirror == nil) {
+		return f, nil
+	}
+	if s.Canary != nil {
+		canary := *s.Canary
+		id, err := fn(canary.BackendId)
+		if err != nil {
+			return f, err
+		}
+		canary.BackendId = id
+		s.Canary = &canary
+	}
+	if s.Mirror != nil {
+		mirror := *s.Mirror
+		id, err := fn(mirror.BackendId)
+		if err != nil {
+			return f, err
+		}
+		mirror.BackendId = id
+		s.Mirror = &mirror
+	}
+	f.Settings = s
+	return f, nil
+}
+
+func qualifyFrontendKey(ns string, fk engine.FrontendKey) engine.FrontendKey {
+	return engine.FrontendKey{Id: engine.NamespacedId(ns, fk.Id)}
+}
+
+func qualifyBackend(ns string, b engine.Backend) engine.Backend {
+	b.Id = engine.NamespacedId(ns, b.Id)
+	return b
+}
+
+func qualifyBackendKey(ns string, bk engine.BackendKey) engine.BackendKey {
+	return engine.BackendKey{Id: engine.NamespacedId(ns, bk.Id)}
+}
+
+// namespace is the engine of the namespace, the hosts are checked against the other namespaces as the host names
+// are shared by all namespaces
+type namespace struct {
+	engine.Engine
+	n *ng
+	i int
+}
+
+func (ns *namespace) UpsertHost(h engine.Host) error {
+	if err := ns.n.hostConflict(ns.i, h.Name); err != nil {
+		return err
+	}
+	return ns.Engine.UpsertHost(h)
+}
+
+func (ns *namespace) ApplyBatch(ops []engine.BatchOp) error {
+	b, ok := ns.Engine.(engine.Batcher)
+	if !ok {
+		return fmt.Errorf("engine of namespace %v does not support batches", ns.n.namespaces[ns.i].Name)
+	}
+	for i, op := range ops {
+		if c, ok := op.Change.(*engine.HostUpserted); ok {
+			if err := ns.n.hostConflict(ns.i, c.Host.Name); err != nil {
+				return &engine.BatchError{Index: i, Err: err}
+			}
+		}
+	}
+	return b.ApplyBatch(ops)
+}
+
+func (ns *namespace) RegisterServer(bk engine.BackendKey, s engine.Server, ttl time.Duration) (engine.Registration, error) {
+	r, ok := ns.Engine.(engine.Registrar)
+	if !ok {
+		return nil, fmt.Errorf("engine of namespace %v does not support server registrations", ns.n.namespaces[ns.i].Name)
+	}
+	return r.RegisterServer(bk, s, ttl)
+}
+
+func (ns *namespace) GetTTLs() (*engine.TTLs, error) {
+	g, ok := ns.Engine.(engine.TTLGetter)
+	if !ok {
+		return engine.NewTTLs(), nil
+	}
+	return g.GetTTLs()
+}
+
+func (ns *namespace) SwapListener(old, l engine.Listener) error {
+	s, ok := ns.Engine.(engine.ListenerSwapper)
+	if !ok {
+		return ns.Engine.UpsertListener(l)
+	}
+	return s.SwapListener(old, l)
+}
+
+// pagedNamespace is the engine of the namespace that pages the frontends and the servers
+type pagedNamespace struct {
+	*namespace
+	engine.Pager
+}
@@ -0,0 +1,260 @@
+package nsng
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/memng"
+	"github.com/vulcand/vulcand/plugin/registry"
+	. "gopkg.in/check.v1"
+)
+
+func TestNamespaces(t *testing.T) { TestingT(t) }
+
+type NamespacesSuite struct {
+	a, b *memng.Mem
+	ng   engine.Engine
+}
+
+var _ = Suite(&NamespacesSuite{})
+
+func (s *NamespacesSuite) SetUpTest(c *C) {
+	s.a = memng.New(registry.GetRegistry()).(*memng.Mem)
+	s.b = memng.New(registry.GetRegistry()).(*memng.Mem)
+	ng, err := New([]Namespace{{Name: "a", Engine: s.a}, {Name: "b", Engine: s.b}})
+	c.Assert(err, IsNil)
+	s.ng = ng
+}
+
+func (s *NamespacesSuite) TestBadNamespaces(c *C) {
+	_, err := New(nil)
+	c.Assert(err, NotNil)
+	_, err = New([]Namespace{{Name: "a.b", Engine: s.a}})
+	c.Assert(err, NotNil)
+	_, err = New([]Namespace{{Name: "a", Engine: s.a}, {Name: "a", Engine: s.b}})
+	c.Assert(err, NotNil)
+}
+
+func (s *NamespacesSuite) TestACMEStore(c *C) {
+	st := s.ng.(engine.ACMEStore)
+	c.Assert(st.UpsertChallenge("token", "token.auth", time.Minute), IsNil)
+	c.Assert(s.a.Challenges, DeepEquals, map[string]string{"token": "token.auth"})
+	c.Assert(s.b.Challenges, HasLen, 0)
+
+	ok, err := st.LockOrder("example.com", "a", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	ok, err = s.a.LockOrder("example.com", "b", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+}
+
+func (s *NamespacesSuite) TestSameIds(c *C) {
+	for _, m := range []*memng.Mem{s.a, s.b} {
+		c.Assert(m.UpsertBackend(engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}), IsNil)
+		c.Assert(m.UpsertFrontend(engine.Frontend{Id: "f1", BackendId: "b1", Type: engine.HTTP, Route: `Path("/")`, Settings: engine.HTTPFrontendSettings{}}, 0), IsNil)
+	}
+
+	ss, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	c.Assert(len(ss.FrontendSpecs), Equals, 2)
+	c.Assert(ss.FrontendSpecs[0].Frontend.Id, Equals, "a.f1")
+	c.Assert(ss.FrontendSpecs[0].Frontend.BackendId, Equals, "a.b1")
+	c.Assert(ss.FrontendSpecs[1].Frontend.Id, Equals, "b.f1")
+	c.Assert(ss.FrontendSpecs[1].Frontend.BackendId, Equals, "b.b1")
+
+	// Writes go to the namespace of the id
+	c.Assert(s.ng.DeleteFrontend(engine.FrontendKey{Id: "b.f1"}), IsNil)
+	_, err = s.b.GetFrontend(engine.FrontendKey{Id: "f1"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	_, err = s.a.GetFrontend(engine.FrontendKey{Id: "f1"})
+	c.Assert(err, IsNil)
+
+	// Frontends can not use the backends of the other namespaces
+	err = s.ng.UpsertFrontend(engine.Frontend{Id: "b.f2", BackendId: "a.b1", Type: engine.HTTP, Route: `Path("/")`, Settings: engine.HTTPFrontendSettings{}}, 0)
+	c.Assert(err, FitsTypeOf, &engine.InvalidFormatError{})
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "b1"})
+	c.Assert(err, FitsTypeOf, &engine.InvalidFormatError{})
+	_, err = s.ng.GetBackend(engine.BackendKey{Id: "c.b1"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *NamespacesSuite) TestTCPFrontendListener(c *C) {
+	c.Assert(s.a.UpsertBackend(engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}), IsNil)
+	f, err := engine.NewTCPFrontend("f1", "b1", engine.TCPFrontendSettings{ListenerId: "l1"})
+	c.Assert(err, IsNil)
+	c.Assert(s.a.UpsertFrontend(*f, 0), IsNil)
+
+	ss, err := s.ng.GetSnapshot()
+	c.Assert(err, IsNil)
+	c.Assert(len(ss.FrontendSpecs), Equals, 1)
+	c.Assert(ss.FrontendSpecs[0].Frontend.TCPSettings().ListenerId, Equals, "a.l1")
+	out, err := s.ng.GetFrontend(engine.FrontendKey{Id: "a.f1"})
+	c.Assert(err, IsNil)
+	c.Assert(out.TCPSettings().ListenerId, Equals, "a.l1")
+
+	// Frontends take the connections of the listeners of their own namespace only
+	f, err = engine.NewTCPFrontend("a.f2", "a.b1", engine.TCPFrontendSettings{ListenerId: "b.l1"})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertFrontend(*f, 0), FitsTypeOf, &engine.InvalidFormatError{})
+
+	f, err = engine.NewTCPFrontend("a.f2", "a.b1", engine.TCPFrontendSettings{ListenerId: "a.l1"})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.UpsertFrontend(*f, 0), IsNil)
+	out, err = s.a.GetFrontend(engine.FrontendKey{Id: "f2"})
+	c.Assert(err, IsNil)
+	c.Assert(out.TCPSettings().ListenerId, Equals, "l1")
+}
+
+func (s *NamespacesSuite) TestSharedHosts(c *C) {
+	c.Assert(s.a.UpsertHost(engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}), IsNil)
+	c.Assert(s.b.UpsertHost(engine.Host{Name: "localhost"}), IsNil)
+	c.Assert(s.b.UpsertHost(engine.Host{Name: "example.com"}), IsNil)
+
+	hosts, err := s.ng.GetHosts()
+	c.Assert(err, IsNil)
+	byName := map[string]engine.Host{}
+	for _, h := range hosts {
+		byName[h.Name] = h
+	}
+	c.Assert(byName, DeepEquals, map[string]engine.Host{
+		"localhost":   {Name: "localhost", Settings: engine.HostSettings{Default: true}},
+		"example.com": {Name: "example.com"},
+	})
+
+	// New hosts go to the first namespace, existing ones are updated where they are
+	c.Assert(s.ng.UpsertHost(engine.Host{Name: "new.example.com"}), IsNil)
+	_, err = s.a.GetHost(engine.HostKey{Name: "new.example.com"})
+	c.Assert(err, IsNil)
+	c.Assert(s.ng.DeleteHost(engine.HostKey{Name: "example.com"}), IsNil)
+	_, err = s.b.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+}
+
+func (s *NamespacesSuite) TestNamespaceHosts(c *C) {
+	c.Assert(s.a.UpsertHost(engine.Host{Name: "localhost"}), IsNil)
+	a, err := s.ng.(engine.Namespaced).Namespace("a")
+	c.Assert(err, IsNil)
+	b, err := s.ng.(engine.Namespaced).Namespace("b")
+	c.Assert(err, IsNil)
+	_, err = s.ng.(engine.Namespaced).Namespace("c")
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// The namespace can not define the host of the other namespace
+	c.Assert(b.UpsertHost(engine.Host{Name: "localhost"}), FitsTypeOf, &engine.AlreadyExistsError{})
+	err = b.(engine.Batcher).ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}}},
+		{Change: &engine.HostUpserted{Host: engine.Host{Name: "localhost"}}},
+	})
+	c.Assert(err, FitsTypeOf, &engine.BatchError{})
+	c.Assert(err.(*engine.BatchError).Index, Equals, 1)
+	c.Assert(err.(*engine.BatchError).Err, FitsTypeOf, &engine.AlreadyExistsError{})
+	_, err = s.b.GetHost(engine.HostKey{Name: "localhost"})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// The namespace updates its own hosts and defines the new ones
+	c.Assert(a.UpsertHost(engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}), IsNil)
+	c.Assert(b.UpsertHost(engine.Host{Name: "example.com"}), IsNil)
+	_, err = s.b.GetHost(engine.HostKey{Name: "example.com"})
+	c.Assert(err, IsNil)
+}
+
+func (s *NamespacesSuite) TestSubscribe(c *C) {
+	// the lookups of the first namespace hosts are passed through the channel, so the test changes the
+	// namespace only after the watch is done reading it
+	a := &watchedMem{Mem: s.a, getsC: make(chan engine.HostKey, 10)}
+	ng, err := New([]Namespace{{Name: "a", Engine: a}, {Name: "b", Engine: s.b}})
+	c.Assert(err, IsNil)
+
+	changes := make(chan interface{})
+	cancelC := make(chan struct{})
+	errorC := make(chan error)
+	go func() {
+		errorC <- ng.Subscribe(changes, 0, cancelC)
+	}()
+
+	c.Assert(s.a.UpsertHost(engine.Host{Name: "localhost"}), IsNil)
+	c.Assert(expectChange(c, changes), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "localhost"}})
+
+	// The host shadowed by the first namespace is ignored, then taken over once the first namespace deletes it
+	c.Assert(s.b.UpsertHost(engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}), IsNil)
+	select {
+	case k := <-a.getsC:
+		c.Assert(k, Equals, engine.HostKey{Name: "localhost"})
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for the host lookup")
+	}
+	c.Assert(s.a.DeleteHost(engine.HostKey{Name: "localhost"}), IsNil)
+	c.Assert(expectChange(c, changes), DeepEquals, &engine.HostUpserted{Host: engine.Host{Name: "localhost", Settings: engine.HostSettings{Default: true}}})
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.b.UpsertBackend(b), IsNil)
+	c.Assert(expectChange(c, changes), DeepEquals, &engine.BackendUpserted{Backend: engine.Backend{Id: "b.b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}})
+	srv := engine.Server{Id: "s1", URL: "http://localhost:5000"}
+	c.Assert(s.b.UpsertServer(engine.BackendKey{Id: b.Id}, srv, 0), IsNil)
+	c.Assert(expectChange(c, changes), DeepEquals, &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: "b.b1"}, Server: srv})
+
+	close(cancelC)
+	c.Assert(<-errorC, IsNil)
+}
+
+func (s *NamespacesSuite) TestSwapListener(c *C) {
+	l := engine.Listener{Id: "l1", Protocol: engine.HTTP, Address: engine.Address{Network: "tcp", Address: "127.0.0.1:9000"}}
+	c.Assert(s.a.UpsertListener(l), IsNil)
+	old, err := s.ng.GetListener(engine.ListenerKey{Id: "a.l1"})
+	c.Assert(err, IsNil)
+
+	// The listener is swapped in its namespace, the stale listener is rejected
+	sw := s.ng.(engine.ListenerSwapper)
+	updated := *old
+	updated.Scope = `Host("localhost")`
+	c.Assert(sw.SwapListener(*old, updated), IsNil)
+	c.Assert(sw.SwapListener(*old, updated), FitsTypeOf, &engine.ConflictError{})
+	out, err := s.a.GetListener(engine.ListenerKey{Id: "l1"})
+	c.Assert(err, IsNil)
+	c.Assert(out.Scope, Equals, updated.Scope)
+}
+
+func (s *NamespacesSuite) TestBatch(c *C) {
+	b := engine.Backend{Id: "a.b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	f := engine.Frontend{Id: "a.f1", BackendId: "a.b1", Type: engine.HTTP, Route: `Path("/")`, Settings: engine.HTTPFrontendSettings{}}
+	batcher := s.ng.(engine.Batcher)
+	c.Assert(batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: b}},
+		{Change: &engine.FrontendUpserted{Frontend: f}},
+	}), IsNil)
+	out, err := s.a.GetFrontend(engine.FrontendKey{Id: "f1"})
+	c.Assert(err, IsNil)
+	c.Assert(out.BackendId, Equals, "b1")
+
+	// Batches spanning namespaces are rejected
+	err = batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: engine.Backend{Id: "a.b2", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}}},
+		{Change: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: "b.b1"}}},
+	})
+	c.Assert(err, FitsTypeOf, &engine.BatchError{})
+	c.Assert(err.(*engine.BatchError).Index, Equals, 1)
+}
+
+func expectChange(c *C, changes chan interface{}) interface{} {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for change")
+	}
+	return nil
+}
+
+// watchedMem passes the keys of the looked up hosts to getsC
+type watchedMem struct {
+	*memng.Mem
+	getsC chan engine.HostKey
+}
+
+func (m *watchedMem) GetHost(k engine.HostKey) (*engine.Host, error) {
+	h, err := m.Mem.GetHost(k)
+	m.getsC <- k
+	return h, err
+}
@@ -1,6 +1,14 @@
 package test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"testing"
 	"time"
 
@@ -133,6 +141,43 @@ func (s *EngineSuite) HostWithOCSP(c *C) {
 	c.Assert(h2, DeepEquals, &host)
 }
 
+func (s *EngineSuite) HostWithACME(c *C) {
+	host := engine.Host{Name: "localhost"}
+
+	host.Settings.ACME = &engine.ACMESettings{
+		Email:        "admin@localhost",
+		DirectoryURL: "https://localhost/directory",
+		Challenge:    engine.ACMEChallengeHTTP01,
+		AccountKey:   []byte("account key"),
+	}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	hk := engine.HostKey{Name: host.Name}
+	h2, err := s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(h2, DeepEquals, &host)
+}
+
+func (s *EngineSuite) HostWithTLS(c *C) {
+	host := engine.Host{Name: "localhost"}
+
+	host.Settings.TLS = &engine.HostTLSSettings{
+		MinVersion:   "VersionTLS12",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	}
+	host.Settings.ClientAuth = &engine.ClientAuthSettings{CA: []byte(clientCA), Required: true}
+
+	c.Assert(s.Engine.UpsertHost(host), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: host})
+
+	hk := engine.HostKey{Name: host.Name}
+	h2, err := s.Engine.GetHost(hk)
+	c.Assert(err, IsNil)
+	c.Assert(h2, DeepEquals, &host)
+}
+
 func (s *EngineSuite) HostUpsertKeyPair(c *C) {
 	host := engine.Host{Name: "localhost"}
 
@@ -221,6 +266,42 @@ func (s *EngineSuite) ListenerSettingsCRUD(c *C) {
 	)
 }
 
+func (s *EngineSuite) SwapListener(c *C) {
+	sw := s.Engine.(engine.ListenerSwapper)
+	withKeys := func(keys ...string) engine.Listener {
+		l := engine.Listener{
+			Id:       "l1",
+			Protocol: engine.HTTPS,
+			Address:  engine.Address{Network: "tcp", Address: "127.0.0.1:9000"},
+			Settings: &engine.HTTPSListenerSettings{},
+		}
+		for _, k := range keys {
+			l.Settings.TLS.SessionTicketKeys = append(l.Settings.TLS.SessionTicketKeys, bytes.Repeat([]byte(k), engine.SessionTicketKeySize))
+		}
+		return l
+	}
+	lk := engine.ListenerKey{Id: "l1"}
+
+	l := withKeys("a")
+	c.Assert(sw.SwapListener(l, withKeys("a", "b")), FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(s.Engine.UpsertListener(l), IsNil)
+	old, err := s.Engine.GetListener(lk)
+	c.Assert(err, IsNil)
+	c.Assert(sw.SwapListener(*old, withKeys("a", "b")), IsNil)
+
+	// The listener read before the swap is stale, the second swap based on it is rejected
+	c.Assert(sw.SwapListener(*old, withKeys("a", "c")), FitsTypeOf, &engine.ConflictError{})
+	out, err := s.Engine.GetListener(lk)
+	c.Assert(err, IsNil)
+	updated := withKeys("a", "b")
+	c.Assert(out, DeepEquals, &updated)
+
+	s.expectChanges(c,
+		&engine.ListenerUpserted{Listener: l},
+		&engine.ListenerUpserted{Listener: updated},
+	)
+}
+
 func (s *EngineSuite) BackendCRUD(c *C) {
 	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 
@@ -352,6 +433,29 @@ func (s *EngineSuite) ServerExpire(c *C) {
 		})
 }
 
+func (s *EngineSuite) ServerRegister(c *C) {
+	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	s.collectChanges(c, 1)
+
+	srv := engine.Server{Id: "srv0", URL: "http://localhost:1000"}
+	bk := engine.BackendKey{Id: b.Id}
+	sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+	r, err := s.Engine.(engine.Registrar).RegisterServer(bk, srv, time.Second)
+	c.Assert(err, IsNil)
+	s.expectChanges(c, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+
+	// Keepalives outlive the ttl
+	time.Sleep(3 * time.Second)
+	out, err := s.Engine.GetServer(sk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &srv)
+
+	c.Assert(r.Close(), IsNil)
+	s.expectChanges(c, &engine.ServerDeleted{ServerKey: sk})
+}
+
 func (s *EngineSuite) FrontendCRUD(c *C) {
 	b := engine.Backend{Id: "b0", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
 	c.Assert(s.Engine.UpsertBackend(b), IsNil)
@@ -511,6 +615,36 @@ func (s *EngineSuite) MiddlewareExpire(c *C) {
 	})
 }
 
+// TTLs checks the engine implementing engine.TTLGetter lists the expiring objects only
+func (s *EngineSuite) TTLs(c *C) {
+	g, ok := s.Engine.(engine.TTLGetter)
+	c.Assert(ok, Equals, true)
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	c.Assert(s.Engine.UpsertBackend(b), IsNil)
+	bk := engine.BackendKey{Id: b.Id}
+	c.Assert(s.Engine.UpsertServer(bk, engine.Server{Id: "s1", URL: "http://localhost:1000"}, time.Minute), IsNil)
+	c.Assert(s.Engine.UpsertServer(bk, engine.Server{Id: "s2", URL: "http://localhost:1001"}, 0), IsNil)
+
+	f := engine.Frontend{Id: "f1", Route: `Path("/hello")`, BackendId: b.Id, Type: engine.HTTP, Settings: engine.HTTPFrontendSettings{}}
+	c.Assert(s.Engine.UpsertFrontend(f, time.Hour), IsNil)
+	fk := engine.FrontendKey{Id: f.Id}
+	c.Assert(s.Engine.UpsertMiddleware(fk, s.makeConnLimit("cl1", "client.ip", 10), time.Minute), IsNil)
+	c.Assert(s.Engine.UpsertMiddleware(fk, s.makeConnLimit("cl2", "client.ip", 10), 0), IsNil)
+
+	ttls, err := g.GetTTLs()
+	c.Assert(err, IsNil)
+	c.Assert(ttls.Servers, HasLen, 1)
+	ttl := ttls.Servers[engine.ServerKey{BackendKey: bk, Id: "s1"}]
+	c.Assert(ttl > 50*time.Second && ttl <= time.Minute, Equals, true, Commentf("got %v", ttl))
+	c.Assert(ttls.Frontends, HasLen, 1)
+	ttl = ttls.Frontends[fk]
+	c.Assert(ttl > 59*time.Minute && ttl <= time.Hour, Equals, true, Commentf("got %v", ttl))
+	c.Assert(ttls.Middlewares, HasLen, 1)
+	ttl = ttls.Middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: "cl1"}]
+	c.Assert(ttl > 50*time.Second && ttl <= time.Minute, Equals, true, Commentf("got %v", ttl))
+}
+
 func (s *EngineSuite) MiddlewareBadFrontend(c *C) {
 	fk := engine.FrontendKey{Id: "wrong"}
 	m := s.makeConnLimit("cl1", "client.ip", 10)
@@ -536,3 +670,159 @@ func (s *EngineSuite) MiddlewareBadType(c *C) {
 	m.Type = "blabla"
 	c.Assert(s.Engine.UpsertMiddleware(fk, m, 0), NotNil)
 }
+
+const clientCA = `-----BEGIN CERTIFICATE-----
+MIIBgDCCASWgAwIBAgIUJ8I3u7L4BzHhn9fdWU9xHqovLRswCgYIKoZIzj0EAwIw
+FDESMBAGA1UEAwwJQ2xpZW50IENBMCAXDTI2MTAxNDA4MTIyMVoYDzIxMjYwOTIw
+MDgxMjIxWjAUMRIwEAYDVQQDDAlDbGllbnQgQ0EwWTATBgcqhkjOPQIBBggqhkjO
+PQMBBwNCAAR2Qnmj2AhKEng44QwN5PzIyBgd9pTb/Qcs06R82ZJKq6CF1M0NIV8S
+iLq5a+VF3JYBZfqNB/yAgyi1QB7quZaho1MwUTAdBgNVHQ4EFgQUltWeO1lfcEKX
+X9wPgagcFok2q14wHwYDVR0jBBgwFoAUltWeO1lfcEKXX9wPgagcFok2q14wDwYD
+VR0TAQH/BAUwAwEB/zAKBggqhkjOPQQDAgNJADBGAiEAsh1ecJeJwRIGhlatej7Q
+02sPAfnLzgLxICKUR1aC40UCIQD8xKsr31dCQJ3yBaa9JiZvxBK2GmR+tLZwBQeZ
+GZbFXQ==
+-----END CERTIFICATE-----`
+
+func (s *EngineSuite) Batch(c *C) {
+	batcher := s.Engine.(engine.Batcher)
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	srv := engine.Server{Id: "srv1", URL: "http://localhost:5000"}
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		BackendId: b.Id,
+		Type:      engine.HTTP,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+	fk := engine.FrontendKey{Id: f.Id}
+	m := s.makeConnLimit("cl1", "client.ip", 10)
+
+	c.Assert(batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: b}},
+		{Change: &engine.ServerUpserted{BackendKey: engine.BackendKey{Id: b.Id}, Server: srv}},
+		{Change: &engine.FrontendUpserted{Frontend: f}},
+		{Change: &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: m}},
+	}), IsNil)
+
+	out, err := s.Engine.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, &f)
+	mout, err := s.Engine.GetMiddleware(engine.MiddlewareKey{FrontendKey: fk, Id: m.Id})
+	c.Assert(err, IsNil)
+	c.Assert(mout, DeepEquals, &m)
+	sout, err := s.Engine.GetServer(engine.ServerKey{BackendKey: engine.BackendKey{Id: b.Id}, Id: srv.Id})
+	c.Assert(err, IsNil)
+	c.Assert(sout, DeepEquals, &srv)
+
+	// The frontend is moved to the new backend, the old one is not used anymore
+	b2 := engine.Backend{Id: "b2", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	f.BackendId = b2.Id
+	c.Assert(batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: b2}},
+		{Change: &engine.FrontendUpserted{Frontend: f}},
+		{Change: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: b.Id}}},
+	}), IsNil)
+
+	_, err = s.Engine.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	out, err = s.Engine.GetFrontend(fk)
+	c.Assert(err, IsNil)
+	c.Assert(out.BackendId, Equals, b2.Id)
+}
+
+func (s *EngineSuite) BatchInvalid(c *C) {
+	batcher := s.Engine.(engine.Batcher)
+
+	b := engine.Backend{Id: "b1", Type: engine.HTTP, Settings: engine.HTTPBackendSettings{}}
+	f := engine.Frontend{
+		Id:        "f1",
+		Route:     `Path("/hello")`,
+		BackendId: "missing",
+		Type:      engine.HTTP,
+		Settings:  engine.HTTPFrontendSettings{},
+	}
+
+	err := batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: b}},
+		{Change: &engine.FrontendUpserted{Frontend: f}},
+	})
+	c.Assert(err, FitsTypeOf, &engine.BatchError{})
+	c.Assert(err.(*engine.BatchError).Index, Equals, 1)
+
+	// Nothing has been applied
+	_, err = s.Engine.GetBackend(engine.BackendKey{Id: b.Id})
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+
+	// Backend in use by the frontend can not be deleted
+	f.BackendId = b.Id
+	err = batcher.ApplyBatch([]engine.BatchOp{
+		{Change: &engine.BackendUpserted{Backend: b}},
+		{Change: &engine.FrontendUpserted{Frontend: f}},
+		{Change: &engine.BackendDeleted{BackendKey: engine.BackendKey{Id: b.Id}}},
+	})
+	c.Assert(err, FitsTypeOf, &engine.BatchError{})
+	c.Assert(err.(*engine.BatchError).Index, Equals, 2)
+}
+
+func (s *EngineSuite) ACMEStore(c *C) {
+	st := s.Engine.(engine.ACMEStore)
+
+	_, err := st.GetChallenge("token")
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(st.UpsertChallenge("token", "token.auth", time.Minute), IsNil)
+	keyAuth, err := st.GetChallenge("token")
+	c.Assert(err, IsNil)
+	c.Assert(keyAuth, Equals, "token.auth")
+	c.Assert(st.DeleteChallenge("token"), IsNil)
+	_, err = st.GetChallenge("token")
+	c.Assert(err, FitsTypeOf, &engine.NotFoundError{})
+	c.Assert(st.DeleteChallenge("token"), FitsTypeOf, &engine.NotFoundError{})
+
+	// The order lock is held by one owner at a time
+	ok, err := st.LockOrder("example.com", "a", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	ok, err = st.LockOrder("example.com", "b", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+
+	// Only the owner releases the lock
+	c.Assert(st.UnlockOrder("example.com", "b"), IsNil)
+	ok, err = st.LockOrder("example.com", "b", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, false)
+	c.Assert(st.UnlockOrder("example.com", "a"), IsNil)
+	ok, err = st.LockOrder("example.com", "b", time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ok, Equals, true)
+	c.Assert(st.UnlockOrder("example.com", "b"), IsNil)
+
+	// The ACME state is not the configuration, the watchers get no changes
+	h := engine.Host{Name: "localhost"}
+	c.Assert(s.Engine.UpsertHost(h), IsNil)
+	s.expectChanges(c, &engine.HostUpserted{Host: h})
+}
+
+// NewKeyPair returns the self signed key pair of the host valid for the server and client authentication
+func NewKeyPair(c *C, host string) *engine.KeyPair {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+	return &engine.KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
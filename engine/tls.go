@@ -1,7 +1,9 @@
 package engine
 
 import (
+	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 )
 
@@ -36,6 +38,77 @@ type TLSSettings struct {
 	// TLS_RSA_WITH_AES_256_CBC_SHA
 	// TLS_RSA_WITH_AES_128_CBC_SHA
 	CipherSuites []string
+
+	// CA is the PEM encoded bundle of certificate authorities the backend server certificates are verified against,
+	// the system roots are used if empty. Backends only.
+	CA []byte `json:",omitempty"`
+
+	// ClientKeyPair is the certificate presented to the backend servers requiring client certificates. Backends only.
+	ClientKeyPair *KeyPair `json:",omitempty"`
+
+	// ServerName is sent to the backend servers in SNI and their certificates are verified against it instead
+	// of the host of the server URL. Backends only.
+	ServerName string `json:",omitempty"`
+
+	// SessionTicketKeys are the 32 byte keys of the session tickets, from the oldest to the newest, so the proxy
+	// instances sharing them resume the sessions of each other. Random keys of the instance are used if empty.
+	// The keys are rotated with RotateSessionTicketKeys, engines store them sealed. Listeners only.
+	SessionTicketKeys [][]byte `json:",omitempty"`
+}
+
+// SessionTicketKeySize is the size of the session ticket keys
+const SessionTicketKeySize = 32
+
+// MaxSessionTicketKeys is the number of the session ticket keys kept by the rotation: the key the tickets of the
+// previous period are decrypted with, the key encrypting the tickets and the key the next rotation promotes
+const MaxSessionTicketKeys = 3
+
+// RotateSessionTicketKeys appends the new key and retires the oldest keys over MaxSessionTicketKeys.
+//
+// The newest key only decrypts the tickets until the next rotation, the tickets are encrypted with the key
+// before it. The rotated settings reach the proxy instances at different times, so the key the instances encrypt
+// with is the one all of them have had since the previous rotation, and the tickets encrypted with the promoted key
+// are accepted by the instances still encrypting with the previous one. The interval between the rotations
+// should be longer than it takes the settings to reach all instances.
+func (s *TLSSettings) RotateSessionTicketKeys(key []byte) error {
+	if len(key) != SessionTicketKeySize {
+		return fmt.Errorf("session ticket key should be %d bytes, got %d", SessionTicketKeySize, len(key))
+	}
+	keys := append(append([][]byte{}, s.SessionTicketKeys...), key)
+	if len(keys) > MaxSessionTicketKeys {
+		keys = keys[len(keys)-MaxSessionTicketKeys:]
+	}
+	s.SessionTicketKeys = keys
+	return nil
+}
+
+// sessionTicketKeys returns the keys in the order of tls.Config.SetSessionTicketKeys, the key encrypting the
+// tickets goes first
+func (s *TLSSettings) sessionTicketKeys() ([][32]byte, error) {
+	keys, n := s.SessionTicketKeys, len(s.SessionTicketKeys)
+	ordered := keys
+	if n > 1 {
+		// the newest key waits for the next rotation, the key before it encrypts the tickets
+		ordered = [][]byte{keys[n-2], keys[n-1]}
+		for i := n - 3; i >= 0; i-- {
+			ordered = append(ordered, keys[i])
+		}
+	}
+	out := make([][32]byte, 0, n)
+	for _, k := range ordered {
+		if len(k) != SessionTicketKeySize {
+			return nil, fmt.Errorf("session ticket key should be %d bytes, got %d", SessionTicketKeySize, len(k))
+		}
+		var key [32]byte
+		copy(key[:], k)
+		out = append(out, key)
+	}
+	return out, nil
+}
+
+// HasUpstreamSettings returns true if any of the settings applying to the backends only is set
+func (s *TLSSettings) HasUpstreamSettings() bool {
+	return len(s.CA) != 0 || s.ClientKeyPair != nil || s.ServerName != ""
 }
 
 // TLSSessionCache sets up parameters for TLS session cache
@@ -102,7 +175,29 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		}
 	}
 
-	return &tls.Config{
+	var roots *x509.CertPool
+	if len(s.CA) != 0 {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(s.CA) {
+			return nil, fmt.Errorf("CA bundle has no valid PEM encoded certificates")
+		}
+	}
+
+	var certs []tls.Certificate
+	if s.ClientKeyPair != nil {
+		cert, err := tls.X509KeyPair(s.ClientKeyPair.Cert, s.ClientKeyPair.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client key pair: %v", err)
+		}
+		certs = []tls.Certificate{cert}
+	}
+
+	ticketKeys, err := s.sessionTicketKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
 		MinVersion: min,
 		MaxVersion: max,
 
@@ -113,7 +208,15 @@ func NewTLSConfig(s *TLSSettings) (*tls.Config, error) {
 		CipherSuites:             css,
 
 		InsecureSkipVerify: s.InsecureSkipVerify,
-	}, nil
+
+		RootCAs:      roots,
+		Certificates: certs,
+		ServerName:   s.ServerName,
+	}
+	if len(ticketKeys) != 0 && !s.SessionTicketsDisabled {
+		config.SetSessionTicketKeys(ticketKeys)
+	}
+	return config, nil
 }
 
 // NewTLSSessionCache validates parameters and creates a new TLS session cache
@@ -138,6 +241,113 @@ func NewTLSSessionCache(s *TLSSessionCache) (tls.ClientSessionCache, error) {
 	return tls.NewLRUClientSessionCache(capacity), nil
 }
 
+// HostTLSSettings restricts TLS versions and cipher suites negotiated with the host clients,
+// empty fields inherit the listener TLS settings
+type HostTLSSettings struct {
+	// MinVersion is minimal TLS version, e.g. "VersionTLS12". It applies to the clients sending no server name
+	// as well, unless the default host has TLS settings of its own
+	MinVersion string
+
+	// MaxVersion is max supported TLS version
+	MaxVersion string
+
+	// CipherSuites lists allowed cipher suites in the order of preference
+	CipherSuites []string
+
+	// PreferServerCipherSuites controls whether the server selects the CipherSuites
+	PreferServerCipherSuites bool
+}
+
+// Check validates the host TLS settings
+func (s *HostTLSSettings) Check() error {
+	return s.Apply(&tls.Config{})
+}
+
+// Apply overrides the listener TLS config with the host settings
+func (s *HostTLSSettings) Apply(c *tls.Config) error {
+	var err error
+	if s.MinVersion != "" {
+		if c.MinVersion, err = ParseTLSVersion(s.MinVersion); err != nil {
+			return err
+		}
+	}
+	if s.MaxVersion != "" {
+		if c.MaxVersion, err = ParseTLSVersion(s.MaxVersion); err != nil {
+			return err
+		}
+	}
+	if c.MinVersion != 0 && c.MaxVersion != 0 && c.MinVersion > c.MaxVersion {
+		return fmt.Errorf("min TLS version %v should be <= max TLS version %v", s.MinVersion, s.MaxVersion)
+	}
+	if len(s.CipherSuites) != 0 {
+		css := make([]uint16, len(s.CipherSuites))
+		for i, suite := range s.CipherSuites {
+			if css[i], err = ParseCipherSuite(suite); err != nil {
+				return err
+			}
+		}
+		c.CipherSuites = css
+	}
+	if s.PreferServerCipherSuites {
+		c.PreferServerCipherSuites = true
+	}
+	return nil
+}
+
+func (s *HostTLSSettings) Equals(o *HostTLSSettings) bool {
+	if s.MinVersion != o.MinVersion || s.MaxVersion != o.MaxVersion ||
+		s.PreferServerCipherSuites != o.PreferServerCipherSuites || len(s.CipherSuites) != len(o.CipherSuites) {
+		return false
+	}
+	for i := range s.CipherSuites {
+		if s.CipherSuites[i] != o.CipherSuites[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ClientAuthSettings controls verification of the client certificates presented to the host
+type ClientAuthSettings struct {
+	// CA is the PEM encoded bundle of certificate authorities the client certificates are verified against
+	CA []byte
+	// Required rejects clients without a valid certificate, otherwise the certificate is verified only if presented
+	Required bool
+}
+
+// Check validates the client auth settings
+func (s *ClientAuthSettings) Check() error {
+	_, err := s.CertPool()
+	return err
+}
+
+// CertPool returns the pool of certificate authorities parsed from the CA bundle
+func (s *ClientAuthSettings) CertPool() (*x509.CertPool, error) {
+	if len(s.CA) == 0 {
+		return nil, fmt.Errorf("client auth CA bundle can not be empty")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(s.CA) {
+		return nil, fmt.Errorf("client auth CA bundle has no valid PEM encoded certificates")
+	}
+	return pool, nil
+}
+
+// Apply sets the client certificate verification in the host TLS config
+func (s *ClientAuthSettings) Apply(c *tls.Config) error {
+	pool, err := s.CertPool()
+	if err != nil {
+		return err
+	}
+	c.ClientCAs = pool
+	if s.Required {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return nil
+}
+
 func ParseCipherSuite(cs string) (uint16, error) {
 	switch cs {
 	case "TLS_RSA_WITH_RC4_128_SHA":
@@ -216,6 +426,21 @@ func (s *TLSSettings) Equals(other *TLSSettings) bool {
 	if !(&s.SessionCache).Equals(&other.SessionCache) {
 		return false
 	}
+	if !bytes.Equal(s.CA, other.CA) || s.ServerName != other.ServerName {
+		return false
+	}
+	if (s.ClientKeyPair == nil) != (other.ClientKeyPair == nil) ||
+		(s.ClientKeyPair != nil && !s.ClientKeyPair.Equals(other.ClientKeyPair)) {
+		return false
+	}
+	if len(s.SessionTicketKeys) != len(other.SessionTicketKeys) {
+		return false
+	}
+	for i := range s.SessionTicketKeys {
+		if !bytes.Equal(s.SessionTicketKeys[i], other.SessionTicketKeys[i]) {
+			return false
+		}
+	}
 
 	return true
 }
@@ -0,0 +1,206 @@
+package basicauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const Type = "basicauth"
+
+// DefaultRealm is the realm of the WWW-Authenticate challenge if none is set
+const DefaultRealm = "Restricted"
+
+// verifiedTTL is the time the verified password is accepted without running bcrypt, so the changed hash or the
+// leaked digest are not trusted for long
+const verifiedTTL = 5 * time.Minute
+
+// digestKey is the random key of the password digests, the digests can not be checked against the guessed
+// passwords without it
+var digestKey = newDigestKey()
+
+func newDigestKey() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// BasicAuth plugin authenticates requests with the Authorization header of the Basic scheme against the
+// bcrypt hashes of the user passwords, e.g. generated by 'htpasswd -nbB user password'. Requests without
+// valid credentials are rejected with 401 and the WWW-Authenticate challenge. The engines supporting
+// encryption store the plugin sealed.
+type BasicAuth struct {
+	// Users maps the user names to the bcrypt hashes of their passwords
+	Users map[string]string
+	// Realm is the realm of the challenge, "Restricted" is default
+	Realm string `json:",omitempty"`
+}
+
+// New returns a new BasicAuth plugin, it checks that the hashes are bcrypt hashes
+func New(users map[string]string, realm string) (*BasicAuth, error) {
+	if len(users) == 0 {
+		return nil, fmt.Errorf("supply at least one user")
+	}
+	for name, hash := range users {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid user name '%v'", name)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash of user '%v': %v", name, err)
+		}
+	}
+	if strings.ContainsAny(realm, "\"\r\n") {
+		return nil, fmt.Errorf("invalid realm '%v'", realm)
+	}
+	return &BasicAuth{Users: users, Realm: realm}, nil
+}
+
+// NewHandler creates a new http.Handler middleware
+func (a *BasicAuth) NewHandler(next http.Handler) (http.Handler, error) {
+	return newAuthHandler(next, a), nil
+}
+
+// String is a user-friendly representation of the handler, the hashes are never printed
+func (a *BasicAuth) String() string {
+	names := make([]string, 0, len(a.Users))
+	for name := range a.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("users=%v, realm=%v", names, a.Realm)
+}
+
+// FromOther creates and validates BasicAuth plugin instance from serialized format
+func FromOther(a BasicAuth) (plugin.Middleware, error) {
+	return New(a.Users, a.Realm)
+}
+
+// FromCli creates a BasicAuth plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	users := make(map[string]string)
+	for _, v := range c.StringSlice("user") {
+		i := strings.Index(v, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("expected user in 'name:hash' format, got '%v'", v)
+		}
+		users[v[:i]] = v[i+1:]
+	}
+	return New(users, c.String("realm"))
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+		Sealed:    true,
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "user", Usage: "user name and bcrypt hash of the password, e.g. 'admin:$2y$10$...'", Value: &cli.StringSlice{}},
+		cli.StringFlag{Name: "realm", Usage: "realm of the WWW-Authenticate challenge"},
+	}
+}
+
+type authHandler struct {
+	next      http.Handler
+	users     map[string][]byte
+	challenge string
+	// dummy is compared against for the unknown users, so they take as long as the known ones
+	dummy []byte
+
+	// verified holds the digest of the last password verified against the bcrypt hash of every user,
+	// so the repeated requests of the user are checked without running bcrypt until the digest expires
+	mtx      sync.RWMutex
+	verified map[string]verifiedPassword
+	clock    timetools.TimeProvider
+}
+
+type verifiedPassword struct {
+	digest  []byte
+	expires time.Time
+}
+
+func newAuthHandler(next http.Handler, a *BasicAuth) *authHandler {
+	users := make(map[string][]byte, len(a.Users))
+	var dummy []byte
+	for name, hash := range a.Users {
+		users[name] = []byte(hash)
+		dummy = users[name]
+	}
+	realm := a.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return &authHandler{
+		next:      next,
+		users:     users,
+		challenge: fmt.Sprintf(`Basic realm="%s", charset="UTF-8"`, realm),
+		dummy:     dummy,
+		verified:  make(map[string]verifiedPassword),
+		clock:     &timetools.RealTime{},
+	}
+}
+
+func (h *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, password, ok := req.BasicAuth()
+	if !ok || !h.authenticate(name, password) {
+		if ok {
+			log.Infof("basicauth rejected %v %v of user '%v' from %v", req.Method, req.URL, name, plugin.ClientIP(req))
+		}
+		w.Header().Set("WWW-Authenticate", h.challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+		return
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+func (h *authHandler) authenticate(name, password string) bool {
+	hash, known := h.users[name]
+	digest := passwordDigest(name, password)
+	now := h.clock.UtcNow()
+	if known {
+		h.mtx.RLock()
+		verified, ok := h.verified[name]
+		h.mtx.RUnlock()
+		if ok && now.Before(verified.expires) && subtle.ConstantTimeCompare(verified.digest, digest) == 1 {
+			return true
+		}
+	} else {
+		hash = h.dummy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !known {
+		return false
+	}
+	h.mtx.Lock()
+	h.verified[name] = verifiedPassword{digest: digest, expires: now.Add(verifiedTTL)}
+	h.mtx.Unlock()
+	return true
+}
+
+func passwordDigest(name, password string) []byte {
+	mac := hmac.New(sha256.New, digestKey)
+	mac.Write([]byte(name + ":" + password))
+	return mac.Sum(nil)
+}
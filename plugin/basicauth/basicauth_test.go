@@ -0,0 +1,133 @@
+package basicauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+	"golang.org/x/crypto/bcrypt"
+	. "gopkg.in/check.v1"
+)
+
+func TestBasicAuth(t *testing.T) { TestingT(t) }
+
+type BasicAuthSuite struct {
+	hash string
+}
+
+var _ = Suite(&BasicAuthSuite{})
+
+func (s *BasicAuthSuite) SetUpSuite(c *C) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	s.hash = string(hash)
+}
+
+// Make sure the BasicAuth spec is compatible and will be accepted by middleware registry
+func (s *BasicAuthSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+	c.Assert(GetSpec().Sealed, Equals, true)
+}
+
+func (s *BasicAuthSuite) TestNewBadParams(c *C) {
+	bad := []map[string]string{
+		nil,
+		{"admin": "secret"},
+		{"": s.hash},
+		{"ad:min": s.hash},
+	}
+	for _, users := range bad {
+		_, err := New(users, "")
+		c.Assert(err, NotNil, Commentf("%v", users))
+	}
+	_, err := New(map[string]string{"admin": s.hash}, `bad"realm`)
+	c.Assert(err, NotNil)
+}
+
+func (s *BasicAuthSuite) TestFromOther(c *C) {
+	a, err := New(map[string]string{"admin": s.hash}, "admin")
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*a)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, a)
+
+	_, err = GetSpec().FromJSON([]byte(`{"Users": {"admin": "plain"}}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *BasicAuthSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		a := out.(*BasicAuth)
+		c.Assert(a.Users, DeepEquals, map[string]string{"admin": s.hash})
+		c.Assert(a.Realm, Equals, "admin")
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--user=admin:" + s.hash, "--realm=admin"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *BasicAuthSuite) TestAuth(c *C) {
+	a, err := New(map[string]string{"admin": s.hash}, "")
+	c.Assert(err, IsNil)
+	h, err := a.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	c.Assert(err, IsNil)
+
+	get := func(name, password string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://localhost/admin", nil)
+		c.Assert(err, IsNil)
+		if name != "" {
+			req.SetBasicAuth(name, password)
+		}
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// the verified password is accepted again without running bcrypt
+	for i := 0; i < 2; i++ {
+		rw := get("admin", "secret")
+		c.Assert(rw.Code, Equals, http.StatusOK)
+		c.Assert(rw.Body.String(), Equals, "hello")
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"admin", "wrong"}, {"admin", ""}, {"root", "secret"}} {
+		rw := get(creds[0], creds[1])
+		c.Assert(rw.Code, Equals, http.StatusUnauthorized, Commentf("%v", creds))
+		c.Assert(rw.Header().Get("WWW-Authenticate"), Equals, `Basic realm="Restricted", charset="UTF-8"`)
+	}
+}
+
+func (s *BasicAuthSuite) TestVerifiedExpire(c *C) {
+	a, err := New(map[string]string{"admin": s.hash}, "")
+	c.Assert(err, IsNil)
+	out, err := a.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	c.Assert(err, IsNil)
+	h := out.(*authHandler)
+	clock := &timetools.FreezedTime{CurrentTime: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h.clock = clock
+
+	c.Assert(h.authenticate("admin", "secret"), Equals, true)
+	// the verified password is accepted without bcrypt until it expires, then it is checked against the hash again
+	hash, err := bcrypt.GenerateFromPassword([]byte("changed"), bcrypt.MinCost)
+	c.Assert(err, IsNil)
+	h.users["admin"] = hash
+	c.Assert(h.authenticate("admin", "secret"), Equals, true)
+	clock.Sleep(verifiedTTL)
+	c.Assert(h.authenticate("admin", "secret"), Equals, false)
+	c.Assert(h.authenticate("admin", "changed"), Equals, true)
+}
@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+)
+
+// Purger is implemented by the middlewares keeping the responses, e.g. the response cache
+type Purger interface {
+	// Purge drops the kept responses of the URLs with the path starting with the prefix, returns the amount
+	// of the dropped responses
+	Purge(prefix string) int
+}
+
+// cacheObserverKey is the request context key of the observer of the cache lookups set by the proxy
+type cacheObserverKey struct{}
+
+// CacheObserver records the lookup of the response cache, hit tells whether the response was served from the cache
+type CacheObserver func(hit bool)
+
+// WithCacheObserver returns the shallow copy of the request carrying the observer of the cache lookups
+func WithCacheObserver(req *http.Request, o CacheObserver) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheObserverKey{}, o))
+}
+
+// cacheBypassKey is the request context key set by the proxy for the requests the response caches should not serve
+type cacheBypassKey struct{}
+
+// WithCacheBypass returns the shallow copy of the request the response caches forward without serving or keeping
+// the response, e.g. the requests of the frontends splitting the traffic between the backends, as the cached
+// response of one backend would be served to the clients picked for another one
+func WithCacheBypass(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheBypassKey{}, true))
+}
+
+// CacheBypassed tells whether the response caches should forward the request without serving or keeping the response
+func CacheBypassed(req *http.Request) bool {
+	bypass, _ := req.Context().Value(cacheBypassKey{}).(bool)
+	return bypass
+}
+
+// ObserveCacheLookup passes the lookup of the response cache to the observer of the request, if the proxy
+// has set one
+func ObserveCacheLookup(req *http.Request, hit bool) {
+	if o, ok := req.Context().Value(cacheObserverKey{}).(CacheObserver); ok {
+		o(hit)
+	}
+}
@@ -0,0 +1,519 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "cache"
+
+const (
+	// DefaultMaxObjectSize is the size of the largest cached response body if not set
+	DefaultMaxObjectSize = 1 << 20
+	// DefaultMaxSize is the total size of the cached responses if not set
+	DefaultMaxSize = 64 << 20
+)
+
+// Cache plugin keeps the cacheable responses to GET and HEAD requests in memory and serves them without
+// forwarding the requests to the backend until they expire. The lifetime of the response is taken from
+// s-maxage, max-age or Expires, the responses with none of them are kept for the default TTL. Responses are
+// keyed by the method, the host, the URL and the values of the request headers listed in Vary, the least
+// recently used ones are evicted once the cache is full.
+//
+// Responses marked no-store, no-cache or private, responses setting cookies and responses to the requests
+// with credentials are not cached. Frontends splitting the traffic with a canary backend bypass the cache.
+// Every proxy instance has a cache of its own, purging it drops the responses kept by this instance only.
+type Cache struct {
+	// MaxObjectSize is the size of the largest cached response body in bytes, DefaultMaxObjectSize if 0
+	MaxObjectSize int64 `json:",omitempty"`
+	// MaxSize is the total size of the cached responses in bytes, DefaultMaxSize if 0
+	MaxSize int64 `json:",omitempty"`
+	// DefaultTTL is the lifetime of the responses without the cache headers, e.g. "30s". Such responses
+	// are not cached if not set.
+	DefaultTTL string `json:",omitempty"`
+
+	store *store
+}
+
+// New returns a new Cache plugin, it checks the sizes and the default TTL
+func New(maxObjectSize, maxSize int64, defaultTTL string) (*Cache, error) {
+	if maxObjectSize < 0 || maxSize < 0 {
+		return nil, fmt.Errorf("sizes should be >= 0, got maxObjectSize=%v, maxSize=%v", maxObjectSize, maxSize)
+	}
+	c := &Cache{MaxObjectSize: maxObjectSize, MaxSize: maxSize, DefaultTTL: defaultTTL}
+	if c.maxObjectSize() > c.maxSize() {
+		return nil, fmt.Errorf("max object size %v exceeds the cache size %v", c.maxObjectSize(), c.maxSize())
+	}
+	var ttl time.Duration
+	if defaultTTL != "" {
+		d, err := time.ParseDuration(defaultTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default TTL: %v", err)
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("default TTL should be >= 0, got %v", d)
+		}
+		ttl = d
+	}
+	c.store = newStore(c.maxSize(), ttl, &timetools.RealTime{})
+	return c, nil
+}
+
+func (c *Cache) maxObjectSize() int64 {
+	if c.MaxObjectSize == 0 {
+		return DefaultMaxObjectSize
+	}
+	return c.MaxObjectSize
+}
+
+func (c *Cache) maxSize() int64 {
+	if c.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return c.MaxSize
+}
+
+// NewHandler creates a new http.Handler middleware, the handlers of the rebuilt frontend keep the cached responses
+func (c *Cache) NewHandler(next http.Handler) (http.Handler, error) {
+	return &cacheHandler{next: next, store: c.store, maxObjectSize: c.maxObjectSize()}, nil
+}
+
+// Purge drops the cached responses of the URLs with the path starting with the prefix, the responses cached by
+// the other proxy instances are kept
+func (c *Cache) Purge(prefix string) int {
+	return c.store.purge(prefix)
+}
+
+// String is a user-friendly representation of the handler
+func (c *Cache) String() string {
+	return fmt.Sprintf("maxObjectSize=%v, maxSize=%v, defaultTTL=%v", c.maxObjectSize(), c.maxSize(), c.DefaultTTL)
+}
+
+// FromOther creates and validates Cache plugin instance from serialized format
+func FromOther(c Cache) (plugin.Middleware, error) {
+	return New(c.MaxObjectSize, c.MaxSize, c.DefaultTTL)
+}
+
+// FromCli creates a Cache plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	var ttl string
+	if d := c.Duration("defaultTTL"); d != 0 {
+		ttl = d.String()
+	}
+	return New(int64(c.Int("maxObjectSize")), int64(c.Int("maxSize")), ttl)
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.IntFlag{Name: "maxObjectSize", Usage: fmt.Sprintf("largest cached response body in bytes, %d if not set", DefaultMaxObjectSize)},
+		cli.IntFlag{Name: "maxSize", Usage: fmt.Sprintf("total size of the cached responses in bytes, %d if not set", DefaultMaxSize)},
+		cli.DurationFlag{Name: "defaultTTL", Usage: "lifetime of the responses without cache headers, such responses are not cached if not set"},
+	}
+}
+
+type cacheHandler struct {
+	next          http.Handler
+	store         *store
+	maxObjectSize int64
+}
+
+func (h *cacheHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !cacheableRequest(req) || plugin.CacheBypassed(req) {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	cc := parseCacheControl(req.Header)
+	now := h.store.clock.UtcNow()
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	primary := req.Method + " " + scheme + "://" + req.Host + req.URL.RequestURI()
+
+	// the clients asking to revalidate get the response of the backend, it replaces the cached one
+	_, noCache := cc["no-cache"]
+	if maxAge, ok := cc["max-age"]; ok && maxAge == "0" {
+		noCache = true
+	}
+	if _, ok := req.Header["Cache-Control"]; !ok && strings.EqualFold(req.Header.Get("Pragma"), "no-cache") {
+		noCache = true
+	}
+	if !noCache {
+		if e := h.store.get(primary, req.Header, now); e != nil {
+			plugin.ObserveCacheLookup(req, true)
+			e.serve(w, req, now)
+			return
+		}
+	}
+	plugin.ObserveCacheLookup(req, false)
+
+	rw := &recorder{w: w, max: h.maxObjectSize}
+	h.next.ServeHTTP(rw, req)
+	if _, ok := cc["no-store"]; ok || rw.overflow || rw.code == 0 {
+		return
+	}
+	if e := h.store.newEntry(primary, req, rw.code, rw.Header(), rw.body.Bytes(), now); e != nil {
+		h.store.put(e, req.Header)
+	}
+}
+
+// cacheableRequest tells whether the response to the request can be cached, the requests with credentials,
+// the ranges and the upgrades are forwarded as they are
+func cacheableRequest(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	for _, name := range []string{"Authorization", "Range", "Upgrade"} {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheableCodes are the status codes of the responses cacheable by default, RFC 7231 section 6.1
+var cacheableCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// parseCacheControl returns the directives of the Cache-Control header with their values, the directive names
+// are lower case
+func parseCacheControl(h http.Header) map[string]string {
+	out := map[string]string{}
+	for _, v := range h["Cache-Control"] {
+		for _, d := range strings.Split(v, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			name, value := d, ""
+			if i := strings.Index(d, "="); i != -1 {
+				name, value = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			out[strings.ToLower(strings.TrimSpace(name))] = value
+		}
+	}
+	return out
+}
+
+// varyNames returns the canonical names of the request headers listed in Vary, false if the response varies
+// on everything and can not be cached
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// variantKey returns the key of the response variant picked by the values of the request headers
+func variantKey(primary string, names []string, h http.Header) string {
+	if len(names) == 0 {
+		return primary
+	}
+	var b bytes.Buffer
+	b.WriteString(primary)
+	for _, name := range names {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(h[name], ","))
+	}
+	return b.String()
+}
+
+// entry is the cached response
+type entry struct {
+	key     string
+	primary string
+	// uri is the path and the query the cache is purged by
+	uri  string
+	vary []string
+	code int
+	// header is the copy of the response headers
+	header http.Header
+	body   []byte
+	// stored is when the response was cached less the age of the response reported by the backend
+	stored  time.Time
+	expires time.Time
+}
+
+func (e *entry) size() int64 {
+	n := len(e.key) + len(e.body)
+	for k, vs := range e.header {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return int64(n)
+}
+
+func (e *entry) serve(w http.ResponseWriter, req *http.Request, now time.Time) {
+	header := w.Header()
+	for k, vs := range e.header {
+		header[k] = append([]string(nil), vs...)
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(e.stored)/time.Second)))
+	w.WriteHeader(e.code)
+	if req.Method != "HEAD" {
+		w.Write(e.body)
+	}
+}
+
+// store is the LRU of the cached responses bounded by their total size
+type store struct {
+	mtx        sync.Mutex
+	maxSize    int64
+	size       int64
+	defaultTTL time.Duration
+	clock      timetools.TimeProvider
+	// entries are the list elements of the keys, the most recently used elements are in the front
+	entries map[string]*list.Element
+	lru     *list.List
+	// variants are the header names the responses to the same method and URL vary on
+	variants map[string]*variants
+}
+
+type variants struct {
+	names []string
+	count int
+}
+
+func newStore(maxSize int64, defaultTTL time.Duration, clock timetools.TimeProvider) *store {
+	return &store{
+		maxSize:    maxSize,
+		defaultTTL: defaultTTL,
+		clock:      clock,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		variants:   make(map[string]*variants),
+	}
+}
+
+// newEntry returns the entry of the response if it is cacheable, nil otherwise
+func (s *store) newEntry(primary string, req *http.Request, code int, header http.Header, body []byte, now time.Time) *entry {
+	if !cacheableCodes[code] || header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	cc := parseCacheControl(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := cc[d]; ok {
+			return nil
+		}
+	}
+	names, ok := varyNames(header)
+	if !ok {
+		return nil
+	}
+	ttl, ok := s.ttl(cc, header, now)
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	stored := now
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		stored = now.Add(-time.Duration(age) * time.Second)
+	}
+	e := &entry{
+		primary: primary,
+		uri:     req.URL.RequestURI(),
+		vary:    names,
+		code:    code,
+		header:  make(http.Header, len(header)),
+		body:    append([]byte(nil), body...),
+		stored:  stored,
+		expires: stored.Add(ttl),
+	}
+	for k, vs := range header {
+		e.header[k] = append([]string(nil), vs...)
+	}
+	e.key = variantKey(primary, names, req.Header)
+	return e
+}
+
+// ttl returns the lifetime of the response: s-maxage takes precedence over max-age and max-age over Expires,
+// the default TTL applies to the responses with none of them
+func (s *store) ttl(cc map[string]string, header http.Header, now time.Time) (time.Duration, bool) {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[d]; ok {
+			seconds, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if v, ok := header["Expires"]; ok {
+		expires, err := http.ParseTime(v[0])
+		if err != nil {
+			// invalid dates mean the response has already expired
+			return 0, false
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date), true
+	}
+	return s.defaultTTL, true
+}
+
+// get returns the fresh response to the request, the expired one is dropped
+func (s *store) get(primary string, h http.Header, now time.Time) *entry {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	v, ok := s.variants[primary]
+	if !ok {
+		return nil
+	}
+	el, ok := s.entries[variantKey(primary, v.names, h)]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*entry)
+	if !now.Before(e.expires) {
+		s.remove(el)
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	return e
+}
+
+// put caches the response, the least recently used responses are evicted to make room for it
+func (s *store) put(e *entry, h http.Header) {
+	size := e.size()
+	if size > s.maxSize {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if el, ok := s.entries[e.key]; ok {
+		s.remove(el)
+	}
+	v, ok := s.variants[e.primary]
+	if !ok {
+		v = &variants{}
+		s.variants[e.primary] = v
+	}
+	// the latest response tells the headers the responses vary on
+	v.names = e.vary
+	v.count++
+	s.entries[e.key] = s.lru.PushFront(e)
+	s.size += size
+	for s.size > s.maxSize {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *store) purge(prefix string) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	purged := 0
+	for el := s.lru.Front(); el != nil; {
+		next := el.Next()
+		if strings.HasPrefix(el.Value.(*entry).uri, prefix) {
+			s.remove(el)
+			purged++
+		}
+		el = next
+	}
+	return purged
+}
+
+func (s *store) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	s.lru.Remove(el)
+	delete(s.entries, e.key)
+	s.size -= e.size()
+	if v, ok := s.variants[e.primary]; ok {
+		if v.count--; v.count <= 0 {
+			delete(s.variants, e.primary)
+		}
+	}
+}
+
+// recorder passes the response to the client and keeps a copy of the body up to the size of the largest
+// cached response
+type recorder struct {
+	w        http.ResponseWriter
+	max      int64
+	code     int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) Header() http.Header {
+	return r.w.Header()
+}
+
+func (r *recorder) WriteHeader(code int) {
+	// informational responses are sent as is, the final response follows
+	if code >= http.StatusOK && r.code == 0 {
+		r.code = code
+	}
+	r.w.WriteHeader(code)
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	if !r.overflow {
+		if int64(r.body.Len()+len(b)) > r.max {
+			r.overflow = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(b)
+		}
+	}
+	return r.w.Write(b)
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,363 @@
+package cache
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCache(t *testing.T) { TestingT(t) }
+
+type CacheSuite struct {
+	clock *timetools.FreezedTime
+}
+
+var _ = Suite(&CacheSuite{})
+
+func (s *CacheSuite) SetUpTest(c *C) {
+	s.clock = &timetools.FreezedTime{CurrentTime: time.Date(2015, 4, 16, 0, 0, 0, 0, time.UTC)}
+}
+
+// Make sure the Cache spec is compatible and will be accepted by middleware registry
+func (s *CacheSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CacheSuite) TestNewBadParams(c *C) {
+	_, err := New(-1, 0, "")
+	c.Assert(err, NotNil)
+	_, err = New(0, -1, "")
+	c.Assert(err, NotNil)
+	_, err = New(100, 10, "")
+	c.Assert(err, NotNil)
+	_, err = New(0, 0, "soon")
+	c.Assert(err, NotNil)
+	_, err = New(0, 0, "-1s")
+	c.Assert(err, NotNil)
+}
+
+func (s *CacheSuite) TestFromOther(c *C) {
+	cl, err := New(10, 100, "1m")
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*cl)
+	c.Assert(err, IsNil)
+	o := out.(*Cache)
+	c.Assert(o.MaxObjectSize, Equals, int64(10))
+	c.Assert(o.MaxSize, Equals, int64(100))
+	c.Assert(o.DefaultTTL, Equals, "1m")
+	c.Assert(o.String(), Not(Equals), "")
+}
+
+func (s *CacheSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cl := out.(*Cache)
+		c.Assert(cl.MaxObjectSize, Equals, int64(1024))
+		c.Assert(cl.MaxSize, Equals, int64(4096))
+		c.Assert(cl.DefaultTTL, Equals, "30s")
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--maxObjectSize=1024", "--maxSize=4096", "--defaultTTL=30s"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CacheSuite) TestHitAndMiss(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+
+	var lookups []bool
+	get := func() *httptest.ResponseRecorder {
+		req := plugin.WithCacheObserver(newRequest("GET", "/a?b=c"), func(hit bool) { lookups = append(lookups, hit) })
+		re := httptest.NewRecorder()
+		h.ServeHTTP(re, req)
+		return re
+	}
+
+	re := get()
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Body.String(), Equals, "response 1")
+
+	s.clock.Sleep(10 * time.Second)
+	re = get()
+	c.Assert(re.Body.String(), Equals, "response 1")
+	c.Assert(re.Header().Get("Age"), Equals, "10")
+	c.Assert(*calls, Equals, 1)
+	c.Assert(lookups, DeepEquals, []bool{false, true})
+
+	// expired
+	s.clock.Sleep(time.Minute)
+	re = get()
+	c.Assert(re.Body.String(), Equals, "response 2")
+	c.Assert(*calls, Equals, 2)
+
+	// other query
+	h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/a?b=d"))
+	c.Assert(*calls, Equals, 3)
+}
+
+func (s *CacheSuite) TestHeadServedWithoutBody(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), newRequest("HEAD", "/"))
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, newRequest("HEAD", "/"))
+	c.Assert(*calls, Equals, 1)
+	c.Assert(re.Body.Len(), Equals, 0)
+
+	// GET is cached separately
+	h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/"))
+	c.Assert(*calls, Equals, 2)
+}
+
+func (s *CacheSuite) TestExpiresAndDefaultTTL(c *C) {
+	var header http.Header
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, "20s"), func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+	})
+
+	header = http.Header{
+		"Date":    {s.clock.UtcNow().Format(http.TimeFormat)},
+		"Expires": {s.clock.UtcNow().Add(5 * time.Second).Format(http.TimeFormat)},
+	}
+	s.requests(h, "/expires", 2)
+	c.Assert(*calls, Equals, 1)
+	s.clock.Sleep(5 * time.Second)
+	s.requests(h, "/expires", 1)
+	c.Assert(*calls, Equals, 2)
+
+	// max-age takes precedence over Expires
+	header["Cache-Control"] = []string{"max-age=60"}
+	s.requests(h, "/max-age", 1)
+	s.clock.Sleep(10 * time.Second)
+	s.requests(h, "/max-age", 1)
+	c.Assert(*calls, Equals, 3)
+
+	// invalid Expires means expired already
+	header = http.Header{"Expires": {"0"}}
+	s.requests(h, "/invalid", 2)
+	c.Assert(*calls, Equals, 5)
+
+	header = http.Header{}
+	s.requests(h, "/default", 2)
+	c.Assert(*calls, Equals, 6)
+	s.clock.Sleep(20 * time.Second)
+	s.requests(h, "/default", 1)
+	c.Assert(*calls, Equals, 7)
+}
+
+func (s *CacheSuite) TestNotCached(c *C) {
+	var (
+		header http.Header
+		code   int
+	)
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, "1m"), func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if code != 0 {
+			w.WriteHeader(code)
+		}
+	})
+
+	cases := []http.Header{
+		{"Cache-Control": {"no-store"}},
+		{"Cache-Control": {"no-cache"}},
+		{"Cache-Control": {"private, max-age=60"}},
+		{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}},
+		{"Cache-Control": {"max-age=60"}, "Vary": {"*"}},
+		{"Cache-Control": {"max-age=0"}},
+	}
+	for i, hdr := range cases {
+		header = hdr
+		s.requests(h, fmt.Sprintf("/case-%d", i), 2)
+		c.Assert(*calls, Equals, 2*(i+1), Commentf("case %d: %v", i, hdr))
+	}
+
+	header, code = http.Header{}, http.StatusInternalServerError
+	s.requests(h, "/error", 2)
+	c.Assert(*calls, Equals, 2*len(cases)+2)
+
+	// requests with credentials and POSTs are passed as is
+	code = 0
+	for _, req := range []*http.Request{newRequest("POST", "/post"), newRequest("GET", "/auth")} {
+		if req.Method == "GET" {
+			req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+		}
+		before := *calls
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		c.Assert(*calls, Equals, before+2)
+	}
+}
+
+func (s *CacheSuite) TestClientNoCache(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/"))
+
+	req := newRequest("GET", "/")
+	req.Header.Set("Cache-Control", "no-cache")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(*calls, Equals, 2)
+
+	// the revalidated response replaces the cached one
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, newRequest("GET", "/"))
+	c.Assert(*calls, Equals, 2)
+	c.Assert(re.Body.String(), Equals, "response 2")
+}
+
+func (s *CacheSuite) TestVary(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "accept-language")
+	})
+	get := func(lang string) string {
+		req := newRequest("GET", "/")
+		req.Header.Set("Accept-Language", lang)
+		re := httptest.NewRecorder()
+		h.ServeHTTP(re, req)
+		return re.Body.String()
+	}
+	c.Assert(get("en"), Equals, "response 1")
+	c.Assert(get("de"), Equals, "response 2")
+	c.Assert(get("en"), Equals, "response 1")
+	c.Assert(get("de"), Equals, "response 2")
+	c.Assert(*calls, Equals, 2)
+}
+
+func (s *CacheSuite) TestMaxObjectSize(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 12, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+	})
+	s.requests(h, "/big", 2)
+	c.Assert(*calls, Equals, 2)
+
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, newRequest("GET", "/big"))
+	c.Assert(re.Body.String(), Equals, "bigresponse 3")
+
+	s.requests(h, "/s", 2)
+	c.Assert(*calls, Equals, 4)
+}
+
+func (s *CacheSuite) TestEviction(c *C) {
+	// two of the responses fit with their keys and headers
+	h, calls := s.newHandler(c, s.newCache(c, 100, 200, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	s.requests(h, "/a", 1)
+	s.requests(h, "/b", 1)
+	// /a is used more recently than /b
+	s.requests(h, "/a", 1)
+	c.Assert(*calls, Equals, 2)
+
+	s.requests(h, "/c", 1)
+	c.Assert(*calls, Equals, 3)
+
+	s.requests(h, "/a", 1)
+	s.requests(h, "/c", 1)
+	c.Assert(*calls, Equals, 3)
+	s.requests(h, "/b", 1)
+	c.Assert(*calls, Equals, 4)
+}
+
+func (s *CacheSuite) TestPurge(c *C) {
+	cl := s.newCache(c, 0, 0, "")
+	h, calls := s.newHandler(c, cl, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	for _, path := range []string{"/img/a", "/img/b?c=d", "/index"} {
+		s.requests(h, path, 1)
+	}
+	c.Assert(cl.Purge("/img"), Equals, 2)
+	c.Assert(cl.Purge("/img"), Equals, 0)
+
+	s.requests(h, "/img/a", 1)
+	s.requests(h, "/index", 1)
+	c.Assert(*calls, Equals, 4)
+
+	c.Assert(cl.Purge(""), Equals, 2)
+}
+
+// newCache returns the cache with the clock of the suite
+func (s *CacheSuite) TestSchemeAndBypass(c *C) {
+	h, calls := s.newHandler(c, s.newCache(c, 0, 0, ""), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	})
+	h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/"))
+	c.Assert(*calls, Equals, 1)
+
+	// https responses are cached separately
+	req := newRequest("GET", "/")
+	req.TLS = &tls.ConnectionState{}
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	c.Assert(re.Body.String(), Equals, "response 2")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(*calls, Equals, 2)
+
+	// bypassed requests neither get the cached response nor replace it
+	re = httptest.NewRecorder()
+	h.ServeHTTP(re, plugin.WithCacheBypass(newRequest("GET", "/")))
+	c.Assert(re.Body.String(), Equals, "response 3")
+	re = httptest.NewRecorder()
+	h.ServeHTTP(re, newRequest("GET", "/"))
+	c.Assert(re.Body.String(), Equals, "response 1")
+	c.Assert(*calls, Equals, 3)
+}
+
+func (s *CacheSuite) newCache(c *C, maxObjectSize, maxSize int64, defaultTTL string) *Cache {
+	cl, err := New(maxObjectSize, maxSize, defaultTTL)
+	c.Assert(err, IsNil)
+	cl.store.clock = s.clock
+	return cl
+}
+
+// newHandler returns the cache handler in front of the handler counting the calls and writing the count to
+// the body
+func (s *CacheSuite) newHandler(c *C, cl *Cache, fn func(w http.ResponseWriter, r *http.Request)) (http.Handler, *int) {
+	calls := new(int)
+	h, err := cl.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if fn != nil {
+			fn(w, r)
+		}
+		fmt.Fprintf(w, "response %d", *calls)
+	}))
+	c.Assert(err, IsNil)
+	return h, calls
+}
+
+func (s *CacheSuite) requests(h http.Handler, path string, count int) {
+	for i := 0; i < count; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", path))
+	}
+}
+
+func newRequest(method, path string) *http.Request {
+	return httptest.NewRequest(method, "http://example.com"+path, nil)
+}
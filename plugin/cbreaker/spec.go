@@ -120,6 +120,11 @@ func (c *Spec) NewHandler(next http.Handler) (http.Handler, error) {
 	return fromSpec(c, next)
 }
 
+// SharesLimits makes the workers of the proxy share the state of the circuit breaker
+func (c *Spec) SharesLimits() bool {
+	return true
+}
+
 // NewSpec check parameters and returns new specification for the middleware
 func NewSpec(condition string, fallback, onTripped, onStandby interface{}, fallbackDuration, recoveryDuration, checkPeriod time.Duration) (*Spec, error) {
 	spec := &Spec{
@@ -0,0 +1,41 @@
+package plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// clientIPKey is the request context key of the client address resolved by the proxy
+type clientIPKey struct{}
+
+// WithClientIP returns the shallow copy of the request carrying the resolved client address
+func WithClientIP(req *http.Request, ip string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ip))
+}
+
+// ClientIP returns the client address resolved by the proxy, it accounts for the trusted proxies in front
+// of vulcand, so middlewares should use it instead of the peer address. The peer address is returned for
+// the requests that have not passed the proxy.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// NewExtractor returns the source extractor for the variable, client.ip is resolved by ClientIP
+func NewExtractor(variable string) (utils.SourceExtractor, error) {
+	if variable == "client.ip" {
+		return utils.ExtractorFunc(func(req *http.Request) (string, int64, error) {
+			return ClientIP(req), 1, nil
+		}), nil
+	}
+	return utils.NewExtractor(variable)
+}
@@ -0,0 +1,361 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "compress"
+
+// DefaultMinSize is the minimum size of the compressed responses if not set
+const DefaultMinSize = 1024
+
+// DefaultContentTypes are the compressible media types used if none are set
+var DefaultContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"image/svg+xml",
+}
+
+// Compress plugin gzips responses for the clients accepting gzip encoding. Only responses of the compressible
+// content types and of at least the minimum size are compressed, responses with Content-Encoding are left as is.
+type Compress struct {
+	// MinSize is the minimum size of the response in bytes, DefaultMinSize if 0. Responses of unknown size are
+	// compressed once this many bytes are written, or once the streamed response is flushed.
+	MinSize int `json:",omitempty"`
+	// ContentTypes are the compressible media types, "type/*" matches all subtypes. DefaultContentTypes if empty.
+	ContentTypes []string `json:",omitempty"`
+	// Level is the gzip compression level from 1 (best speed) to 9 (best compression), gzip default if 0
+	Level int `json:",omitempty"`
+}
+
+// New returns a new Compress plugin, it checks the compression level and the content types
+func New(minSize int, contentTypes []string, level int) (*Compress, error) {
+	if minSize < 0 {
+		return nil, fmt.Errorf("minimum size should be >= 0, got %v", minSize)
+	}
+	if level < 0 || level > gzip.BestCompression {
+		return nil, fmt.Errorf("compression level should be from 1 to %d, got %v", gzip.BestCompression, level)
+	}
+	for _, t := range contentTypes {
+		if i := strings.Index(t, "/"); i <= 0 || i == len(t)-1 {
+			return nil, fmt.Errorf("invalid content type '%v', expected type/subtype or type/*", t)
+		}
+	}
+	return &Compress{MinSize: minSize, ContentTypes: contentTypes, Level: level}, nil
+}
+
+// NewHandler creates a new http.Handler middleware
+func (c *Compress) NewHandler(next http.Handler) (http.Handler, error) {
+	return newCompressHandler(next, c), nil
+}
+
+// String is a user-friendly representation of the handler
+func (c *Compress) String() string {
+	return fmt.Sprintf("minSize=%v, contentTypes=%v, level=%v", c.MinSize, c.ContentTypes, c.Level)
+}
+
+// FromOther creates and validates Compress plugin instance from serialized format
+func FromOther(c Compress) (plugin.Middleware, error) {
+	return New(c.MinSize, c.ContentTypes, c.Level)
+}
+
+// FromCli creates a Compress plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return New(c.Int("minSize"), c.StringSlice("contentType"), c.Int("level"))
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.IntFlag{Name: "minSize", Usage: fmt.Sprintf("minimum response size in bytes to compress, %d if not set", DefaultMinSize)},
+		cli.StringSliceFlag{Name: "contentType", Usage: "compressible content type, e.g. 'text/*' or 'application/json'", Value: &cli.StringSlice{}},
+		cli.IntFlag{Name: "level", Usage: "gzip compression level from 1 to 9"},
+	}
+}
+
+type compressHandler struct {
+	next         http.Handler
+	minSize      int
+	contentTypes []string
+	writers      sync.Pool
+}
+
+func newCompressHandler(next http.Handler, c *Compress) *compressHandler {
+	h := &compressHandler{
+		next:         next,
+		minSize:      c.MinSize,
+		contentTypes: c.ContentTypes,
+	}
+	if h.minSize == 0 {
+		h.minSize = DefaultMinSize
+	}
+	if len(h.contentTypes) == 0 {
+		h.contentTypes = DefaultContentTypes
+	}
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	h.writers.New = func() interface{} {
+		// the level is checked by New
+		w, _ := gzip.NewWriterLevel(nil, level)
+		return w
+	}
+	return h
+}
+
+func (h *compressHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// upgraded connections are hijacked and responses to HEAD requests have no body to compress
+	if req.Method == "HEAD" || req.Header.Get("Upgrade") != "" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	cw := &compressWriter{w: w, h: h, accepts: acceptsGzip(req.Header.Get("Accept-Encoding"))}
+	defer cw.finish()
+	h.next.ServeHTTP(cw, req)
+}
+
+// compressible tells whether the media type of the Content-Type value is in the list
+func (h *compressHandler) compressible(contentType string) bool {
+	t := contentType
+	if i := strings.Index(t, ";"); i >= 0 {
+		t = t[:i]
+	}
+	t = strings.ToLower(strings.TrimSpace(t))
+	for _, p := range h.contentTypes {
+		p = strings.ToLower(p)
+		if strings.HasSuffix(p, "/*") && strings.HasPrefix(t, p[:len(p)-1]) || t == p {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip tells whether the Accept-Encoding value allows gzip, codings with zero quality are refused
+func acceptsGzip(value string) bool {
+	accepted := false
+	for _, part := range strings.Split(value, ",") {
+		coding, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding = part[:i]
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			// explicit gzip quality takes precedence over the wildcard
+			return q > 0
+		case "*":
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
+
+// compressWriter decides whether to compress the response once its headers and, if needed, the first bytes
+// of the body are known. Until then the body is buffered, at most the minimum size of it.
+type compressWriter struct {
+	w           http.ResponseWriter
+	h           *compressHandler
+	accepts     bool
+	code        int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	gz          *gzip.Writer
+}
+
+func (cw *compressWriter) Header() http.Header {
+	return cw.w.Header()
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	// informational responses are sent as is, the final response follows
+	if code < http.StatusOK {
+		cw.w.WriteHeader(code)
+		return
+	}
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.code = code
+
+	header := cw.w.Header()
+	if !cw.candidate(header) {
+		cw.passThrough()
+		return
+	}
+	addVary(header)
+	if !cw.accepts {
+		cw.passThrough()
+		return
+	}
+	if v := header.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n < int64(cw.h.minSize) {
+			cw.passThrough()
+			return
+		}
+		if header.Get("Content-Type") != "" {
+			cw.compress()
+		}
+	}
+	// the size or the content type are not known yet, the body decides
+}
+
+// candidate tells whether the response could be compressed judging by its code and headers
+func (cw *compressWriter) candidate(header http.Header) bool {
+	switch cw.code {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if t := header.Get("Content-Type"); t != "" && !cw.h.compressible(t) {
+		return false
+	}
+	return true
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.gz != nil {
+			return cw.gz.Write(b)
+		}
+		return cw.w.Write(b)
+	}
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.h.minSize {
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush compresses the streamed response regardless of the size written so far, as the size of
+// the stream is not known
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		if err := cw.decide(); err != nil {
+			return
+		}
+	}
+	if cw.gz != nil {
+		if err := cw.gz.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// decide compresses the response with the compressible content type and writes out the buffered body,
+// the content type is detected the same way the server does if it is not set
+func (cw *compressWriter) decide() error {
+	header := cw.w.Header()
+	if _, ok := header["Content-Type"]; !ok && len(cw.buf) != 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if cw.h.compressible(header.Get("Content-Type")) {
+		cw.compress()
+	} else {
+		cw.passThrough()
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.gz != nil {
+		_, err = cw.gz.Write(buf)
+	} else {
+		_, err = cw.w.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) passThrough() {
+	cw.decided = true
+	cw.w.WriteHeader(cw.code)
+}
+
+func (cw *compressWriter) compress() {
+	cw.decided = true
+	header := cw.w.Header()
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "gzip")
+	// compressed body is not byte to byte equal to the original one
+	if etag := header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("Etag", "W/"+etag)
+	}
+	cw.w.WriteHeader(cw.code)
+	cw.gz = cw.h.writers.Get().(*gzip.Writer)
+	cw.gz.Reset(cw.w)
+}
+
+// finish writes out the bodies smaller than the minimum size and completes the compressed stream
+func (cw *compressWriter) finish() {
+	if !cw.wroteHeader {
+		return
+	}
+	if !cw.decided {
+		cw.passThrough()
+		if len(cw.buf) != 0 {
+			cw.w.Write(cw.buf)
+		}
+		return
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+		cw.h.writers.Put(cw.gz)
+		cw.gz = nil
+	}
+}
+
+func addVary(header http.Header) {
+	for _, v := range header["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			if n := strings.TrimSpace(name); n == "*" || strings.EqualFold(n, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
@@ -0,0 +1,188 @@
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCompress(t *testing.T) { TestingT(t) }
+
+type CompressSuite struct {
+}
+
+var _ = Suite(&CompressSuite{})
+
+// Make sure the Compress spec is compatible and will be accepted by middleware registry
+func (s *CompressSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CompressSuite) TestNewBadParams(c *C) {
+	_, err := New(-1, nil, 0)
+	c.Assert(err, NotNil)
+	_, err = New(0, nil, 10)
+	c.Assert(err, NotNil)
+	_, err = New(0, nil, -1)
+	c.Assert(err, NotNil)
+	_, err = New(0, []string{"text"}, 0)
+	c.Assert(err, NotNil)
+	_, err = New(0, []string{"text/"}, 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *CompressSuite) TestFromOther(c *C) {
+	cm, err := New(100, []string{"text/*"}, 5)
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*cm)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cm)
+
+	_, err = GetSpec().FromJSON([]byte(`{"Level": 42}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *CompressSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cm := out.(*Compress)
+		c.Assert(cm.MinSize, Equals, 512)
+		c.Assert(cm.ContentTypes, DeepEquals, []string{"text/*", "application/json"})
+		c.Assert(cm.Level, Equals, 6)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--minSize=512", "--contentType=text/*", "--contentType=application/json", "--level=6"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CompressSuite) TestAcceptsGzip(c *C) {
+	c.Assert(acceptsGzip("gzip"), Equals, true)
+	c.Assert(acceptsGzip("deflate, gzip;q=0.5"), Equals, true)
+	c.Assert(acceptsGzip("*"), Equals, true)
+	c.Assert(acceptsGzip(""), Equals, false)
+	c.Assert(acceptsGzip("br"), Equals, false)
+	c.Assert(acceptsGzip("gzip;q=0"), Equals, false)
+	c.Assert(acceptsGzip("*, gzip;q=0"), Equals, false)
+}
+
+func (s *CompressSuite) TestCompress(c *C) {
+	body := strings.Repeat("hello, world ", 200)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/small":
+			w.Write([]byte("hi"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(body))
+		case "/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(body))
+		default:
+			w.Header().Set("Etag", `"v1"`)
+			w.Write([]byte(body))
+		}
+	})
+	re := serve(c, handler, "/", "gzip")
+	c.Assert(re.Code, Equals, http.StatusOK)
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(re.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(re.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(re.Header().Get("Etag"), Equals, `W/"v1"`)
+	c.Assert(re.Body.Len() < len(body), Equals, true)
+	c.Assert(gunzip(c, re.Body.Bytes()), Equals, body)
+
+	// clients not accepting gzip get the original response
+	re = serve(c, handler, "/", "")
+	c.Assert(re.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(re.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(re.Body.String(), Equals, body)
+
+	// so do the responses below the minimum size, not compressible or already encoded ones
+	for _, path := range []string{"/small", "/image", "/encoded"} {
+		re = serve(c, handler, path, "gzip")
+		c.Assert(re.Header().Get("Content-Encoding"), Not(Equals), "gzip", Commentf(path))
+	}
+	c.Assert(serve(c, handler, "/small", "gzip").Body.String(), Equals, "hi")
+	c.Assert(serve(c, handler, "/encoded", "gzip").Body.String(), Equals, body)
+}
+
+func (s *CompressSuite) TestStreaming(c *C) {
+	next := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			w.Write([]byte("data: event\n\n"))
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	})
+	cm, err := New(0, nil, 0)
+	c.Assert(err, IsNil)
+	mw, err := cm.NewHandler(handler)
+	c.Assert(err, IsNil)
+	srv := httptest.NewServer(mw)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	c.Assert(err, IsNil)
+	// the request asking for gzip explicitly is not decompressed by the transport
+	req.Header.Set("Accept-Encoding", "gzip")
+	re, err := http.DefaultClient.Do(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.Header.Get("Content-Encoding"), Equals, "gzip")
+
+	// flushed events arrive before the stream is complete
+	r, err := gzip.NewReader(re.Body)
+	c.Assert(err, IsNil)
+	lines := bufio.NewReader(r)
+	line, err := lines.ReadString('\n')
+	c.Assert(err, IsNil)
+	c.Assert(line, Equals, "data: event\n")
+	next <- true
+	next <- true
+	rest, err := ioutil.ReadAll(lines)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "\ndata: event\n\n")
+}
+
+func serve(c *C, handler http.Handler, path, acceptEncoding string) *httptest.ResponseRecorder {
+	cm, err := New(0, nil, 0)
+	c.Assert(err, IsNil)
+	mw, err := cm.NewHandler(handler)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+	c.Assert(err, IsNil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	re := httptest.NewRecorder()
+	mw.ServeHTTP(re, req)
+	return re
+}
+
+func gunzip(c *C, data []byte) string {
+	r, err := gzip.NewReader(strings.NewReader(string(data)))
+	c.Assert(err, IsNil)
+	out, err := ioutil.ReadAll(r)
+	c.Assert(err, IsNil)
+	return string(out)
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/codegangsta/cli"
 	"github.com/vulcand/oxy/connlimit"
-	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/plugin"
 )
 
@@ -29,15 +28,20 @@ type ConnLimit struct {
 
 // Returns vulcan library compatible middleware
 func (c *ConnLimit) NewHandler(next http.Handler) (http.Handler, error) {
-	extract, err := utils.NewExtractor(c.Variable)
+	extract, err := plugin.NewExtractor(c.Variable)
 	if err != nil {
 		return nil, err
 	}
 	return connlimit.New(next, extract, c.Connections)
 }
 
+// SharesLimits makes the workers of the proxy share the limits
+func (c *ConnLimit) SharesLimits() bool {
+	return true
+}
+
 func NewConnLimit(connections int64, variable string) (*ConnLimit, error) {
-	if _, err := utils.NewExtractor(variable); err != nil {
+	if _, err := plugin.NewExtractor(variable); err != nil {
 		return nil, err
 	}
 	if connections < 0 {
@@ -0,0 +1,360 @@
+package cors
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "cors"
+
+// defaultMethods are allowed when the methods are not set, these are the methods of the simple requests
+var defaultMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORS plugin answers the preflight requests and adds the CORS headers to the responses of the allowed origins,
+// so the services behind the proxy do not have to. The preflight requests carry no credentials, give the middleware
+// the lower priority than the auth middlewares of the frontend so the preflights are answered before the auth.
+type CORS struct {
+	// AllowedOrigins are the origins allowed to make the requests, e.g. https://example.com. The origin may have
+	// a single wildcard, e.g. https://*.example.com, and "*" allows any origin.
+	AllowedOrigins []string
+	// AllowedMethods are the methods allowed in the requests, GET, HEAD and POST if not set
+	AllowedMethods []string `json:",omitempty"`
+	// AllowedHeaders are the request headers allowed in the requests, "*" allows any header
+	AllowedHeaders []string `json:",omitempty"`
+	// ExposedHeaders are the response headers the scripts are allowed to read
+	ExposedHeaders []string `json:",omitempty"`
+	// AllowCredentials allows the requests with the cookies and the auth headers
+	AllowCredentials bool `json:",omitempty"`
+	// MaxAge is the time in seconds the browser caches the preflight response for
+	MaxAge int `json:",omitempty"`
+}
+
+// New returns a new CORS plugin, it checks the origin patterns, the methods and the headers
+func New(c CORS) (*CORS, error) {
+	if len(c.AllowedOrigins) == 0 {
+		return nil, fmt.Errorf("at least one allowed origin is required")
+	}
+	for _, o := range c.AllowedOrigins {
+		if _, err := parseOrigin(o); err != nil {
+			return nil, err
+		}
+		if o == "*" && c.AllowCredentials {
+			return nil, fmt.Errorf("origin '*' can not be allowed together with credentials, list the origins instead")
+		}
+	}
+	for _, m := range c.AllowedMethods {
+		if !plugin.ValidHeaderName(m) {
+			return nil, fmt.Errorf("invalid method '%v'", m)
+		}
+	}
+	for _, h := range append(append([]string{}, c.AllowedHeaders...), c.ExposedHeaders...) {
+		if h != "*" && !plugin.ValidHeaderName(h) {
+			return nil, fmt.Errorf("invalid header name '%v'", h)
+		}
+	}
+	if c.MaxAge < 0 {
+		return nil, fmt.Errorf("max age should be >= 0, got %v", c.MaxAge)
+	}
+	return &c, nil
+}
+
+// NewHandler creates a new http.Handler middleware
+func (c *CORS) NewHandler(next http.Handler) (http.Handler, error) {
+	return newCORSHandler(next, c)
+}
+
+// String is a user-friendly representation of the handler
+func (c *CORS) String() string {
+	return fmt.Sprintf("origins=%v, methods=%v, headers=%v, expose=%v, credentials=%v, maxAge=%v",
+		c.AllowedOrigins, c.methods(), c.AllowedHeaders, c.ExposedHeaders, c.AllowCredentials, c.MaxAge)
+}
+
+func (c *CORS) methods() []string {
+	if len(c.AllowedMethods) == 0 {
+		return defaultMethods
+	}
+	return c.AllowedMethods
+}
+
+// FromOther creates and validates CORS plugin instance from serialized format
+func FromOther(c CORS) (plugin.Middleware, error) {
+	return New(c)
+}
+
+// FromCli creates a CORS plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return New(CORS{
+		AllowedOrigins:   c.StringSlice("origin"),
+		AllowedMethods:   c.StringSlice("method"),
+		AllowedHeaders:   c.StringSlice("header"),
+		ExposedHeaders:   c.StringSlice("exposeHeader"),
+		AllowCredentials: c.Bool("credentials"),
+		MaxAge:           c.Int("maxAge"),
+	})
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "origin", Usage: "allowed origin, e.g. https://example.com, https://*.example.com or *", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "method", Usage: "allowed method, GET, HEAD and POST if not set", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "header", Usage: "allowed request header, * allows any header", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "exposeHeader", Usage: "response header exposed to the scripts", Value: &cli.StringSlice{}},
+		cli.BoolFlag{Name: "credentials", Usage: "allow the requests with credentials"},
+		cli.IntFlag{Name: "maxAge", Usage: "time in seconds the preflight response is cached for"},
+	}
+}
+
+// origin is the parsed origin pattern, the pattern without the wildcard has the prefix only
+type origin struct {
+	any      bool
+	wildcard bool
+	prefix   string
+	suffix   string
+}
+
+func parseOrigin(o string) (*origin, error) {
+	if o == "*" {
+		return &origin{any: true}, nil
+	}
+	o = strings.ToLower(o)
+	if !strings.Contains(o, "://") {
+		return nil, fmt.Errorf("origin '%v' should have the scheme, e.g. https://example.com", o)
+	}
+	switch strings.Count(o, "*") {
+	case 0:
+		return &origin{prefix: o}, nil
+	case 1:
+		i := strings.Index(o, "*")
+		return &origin{wildcard: true, prefix: o[:i], suffix: o[i+1:]}, nil
+	}
+	return nil, fmt.Errorf("origin '%v' should have at most one wildcard", o)
+}
+
+func (o *origin) match(value string) bool {
+	switch {
+	case o.any:
+		return true
+	case o.wildcard:
+		return len(value) > len(o.prefix)+len(o.suffix) && strings.HasPrefix(value, o.prefix) && strings.HasSuffix(value, o.suffix)
+	}
+	return value == o.prefix
+}
+
+type corsHandler struct {
+	next        http.Handler
+	origins     []*origin
+	anyOrigin   bool
+	methods     map[string]bool
+	allowMethod string
+	headers     map[string]bool
+	anyHeader   bool
+	allowHeader string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+func newCORSHandler(next http.Handler, c *CORS) (*corsHandler, error) {
+	h := &corsHandler{
+		next:        next,
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: c.AllowCredentials,
+	}
+	for _, o := range c.AllowedOrigins {
+		p, err := parseOrigin(o)
+		if err != nil {
+			return nil, err
+		}
+		h.anyOrigin = h.anyOrigin || p.any
+		h.origins = append(h.origins, p)
+	}
+	for _, m := range c.methods() {
+		h.methods[strings.ToUpper(m)] = true
+	}
+	h.allowMethod = strings.Join(c.methods(), ", ")
+	var headers []string
+	for _, name := range c.AllowedHeaders {
+		if name == "*" {
+			h.anyHeader = true
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		h.headers[name] = true
+		headers = append(headers, name)
+	}
+	h.allowHeader = strings.Join(headers, ", ")
+	var expose []string
+	for _, name := range c.ExposedHeaders {
+		expose = append(expose, http.CanonicalHeaderKey(name))
+	}
+	h.expose = strings.Join(expose, ", ")
+	if c.MaxAge > 0 {
+		h.maxAge = strconv.Itoa(c.MaxAge)
+	}
+	return h, nil
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	value := req.Header.Get("Origin")
+	if value == "" {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	if req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != "" {
+		h.preflight(w, req, value)
+		return
+	}
+	if !h.allowOrigin(value) {
+		// the response depends on the origin, the shared caches should not serve it to the allowed origins
+		w.Header().Add("Vary", "Origin")
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	h.next.ServeHTTP(&corsWriter{ResponseWriter: w, h: h, origin: value}, req)
+}
+
+// preflight answers the preflight request without passing it on, the requests of the origins, methods
+// and headers that are not allowed are rejected
+func (h *corsHandler) preflight(w http.ResponseWriter, req *http.Request, value string) {
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	method := req.Header.Get("Access-Control-Request-Method")
+	requested := requestedHeaders(req)
+	if !h.allowOrigin(value) || !h.methods[strings.ToUpper(method)] || !h.allowHeaders(requested) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.setOrigin(header, value)
+	header.Set("Access-Control-Allow-Methods", h.allowMethod)
+	if h.anyHeader && len(requested) != 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	} else if h.allowHeader != "" {
+		header.Set("Access-Control-Allow-Headers", h.allowHeader)
+	}
+	if h.maxAge != "" {
+		header.Set("Access-Control-Max-Age", h.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *corsHandler) allowOrigin(value string) bool {
+	value = strings.ToLower(value)
+	for _, o := range h.origins {
+		if o.match(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *corsHandler) allowHeaders(requested []string) bool {
+	if h.anyHeader {
+		return true
+	}
+	for _, name := range requested {
+		if !h.headers[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets the allowed origin, the origin of the request is echoed unless any origin is allowed
+func (h *corsHandler) setOrigin(header http.Header, value string) {
+	if h.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", value)
+	}
+	if h.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// requestedHeaders returns the canonical names of the headers listed in the preflight request
+func requestedHeaders(req *http.Request) []string {
+	var out []string
+	for _, v := range req.Header["Access-Control-Request-Headers"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				out = append(out, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return out
+}
+
+// corsWriter replaces the CORS headers set by the backend right before the response headers are written
+type corsWriter struct {
+	http.ResponseWriter
+	h           *corsHandler
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		header := w.ResponseWriter.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+		w.h.setOrigin(header, w.origin)
+		if !w.h.anyOrigin {
+			header.Add("Vary", "Origin")
+		}
+		if w.h.expose != "" {
+			header.Set("Access-Control-Expose-Headers", w.h.expose)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the upgraded connections pass through, the upgrade response is written by the backend
+func (w *corsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,211 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestCORS(t *testing.T) { TestingT(t) }
+
+type CORSSuite struct {
+}
+
+var _ = Suite(&CORSSuite{})
+
+// Make sure the CORS spec is compatible and will be accepted by middleware registry
+func (s *CORSSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *CORSSuite) TestNewBadParams(c *C) {
+	bad := []CORS{
+		{},
+		{AllowedOrigins: []string{"example.com"}},
+		{AllowedOrigins: []string{"https://*.*.example.com"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET POST"}},
+		{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"X Header"}},
+		{AllowedOrigins: []string{"*"}, ExposedHeaders: []string{"X-Header:"}},
+		{AllowedOrigins: []string{"*"}, MaxAge: -1},
+	}
+	for _, cors := range bad {
+		_, err := New(cors)
+		c.Assert(err, NotNil, Commentf("%v", cors))
+	}
+}
+
+func (s *CORSSuite) TestFromOther(c *C) {
+	cors, err := New(CORS{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true, MaxAge: 600})
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*cors)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, cors)
+
+	_, err = GetSpec().FromJSON([]byte(`{"AllowedOrigins": ["*"], "AllowCredentials": true}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *CORSSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		cors := out.(*CORS)
+		c.Assert(cors.AllowedOrigins, DeepEquals, []string{"https://a.com", "https://*.b.com"})
+		c.Assert(cors.AllowedMethods, DeepEquals, []string{"GET", "PUT"})
+		c.Assert(cors.AllowedHeaders, DeepEquals, []string{"Authorization"})
+		c.Assert(cors.ExposedHeaders, DeepEquals, []string{"X-Request-Id"})
+		c.Assert(cors.AllowCredentials, Equals, true)
+		c.Assert(cors.MaxAge, Equals, 300)
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--origin=https://a.com", "--origin=https://*.b.com", "--method=GET", "--method=PUT",
+		"--header=Authorization", "--exposeHeader=X-Request-Id", "--credentials", "--maxAge=300"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *CORSSuite) TestPreflight(c *C) {
+	called := false
+	mw := s.newHandler(c, CORS{
+		AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+		AllowedMethods:   []string{"GET", "PUT"},
+		AllowedHeaders:   []string{"authorization", "content-type"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+
+	re := s.preflight(mw, "https://app.example.com", "PUT", "Authorization, Content-Type")
+	c.Assert(re.Code, Equals, http.StatusNoContent)
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(re.Header().Get("Access-Control-Allow-Methods"), Equals, "GET, PUT")
+	c.Assert(re.Header().Get("Access-Control-Allow-Headers"), Equals, "Authorization, Content-Type")
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(re.Header().Get("Access-Control-Max-Age"), Equals, "600")
+
+	re = s.preflight(mw, "https://API.example.org", "GET", "")
+	c.Assert(re.Code, Equals, http.StatusNoContent)
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "https://API.example.org")
+
+	// origin, method or headers not allowed
+	for _, r := range [][]string{
+		{"https://evil.com", "GET", ""},
+		{"https://example.org", "GET", ""},
+		{"https://app.example.com", "DELETE", ""},
+		{"https://app.example.com", "GET", "X-Secret"},
+	} {
+		re = s.preflight(mw, r[0], r[1], r[2])
+		c.Assert(re.Code, Equals, http.StatusForbidden, Commentf("%v", r))
+		c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	}
+	// preflights are never passed to the backend
+	c.Assert(called, Equals, false)
+}
+
+func (s *CORSSuite) TestPreflightAnyHeader(c *C) {
+	mw := s.newHandler(c, CORS{AllowedOrigins: []string{"*"}, AllowedHeaders: []string{"*"}}, http.NotFoundHandler())
+
+	re := s.preflight(mw, "https://any.com", "POST", "x-a,x-b")
+	c.Assert(re.Code, Equals, http.StatusNoContent)
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(re.Header().Get("Access-Control-Allow-Headers"), Equals, "X-A, X-B")
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "")
+}
+
+func (s *CORSSuite) TestActualRequest(c *C) {
+	mw := s.newHandler(c, CORS{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		ExposedHeaders:   []string{"x-request-id"},
+		AllowCredentials: true,
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write([]byte("hello"))
+	}))
+
+	get := func(origin string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(http.MethodOptions, "http://localhost/", nil)
+		c.Assert(err, IsNil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		re := httptest.NewRecorder()
+		mw.ServeHTTP(re, req)
+		return re
+	}
+
+	// OPTIONS without the requested method is the actual request
+	re := get("https://app.example.com")
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(re.Header()["Access-Control-Allow-Origin"], DeepEquals, []string{"https://app.example.com"})
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(re.Header().Get("Access-Control-Expose-Headers"), Equals, "X-Request-Id")
+	c.Assert(re.Header().Get("Vary"), Equals, "Origin")
+
+	// responses to the other origins and the requests without origin are passed as is
+	re = get("https://evil.com")
+	c.Assert(re.Body.String(), Equals, "hello")
+	c.Assert(re.Header().Get("Access-Control-Allow-Origin"), Equals, "*")
+	c.Assert(re.Header().Get("Access-Control-Allow-Credentials"), Equals, "")
+	c.Assert(re.Header().Get("Vary"), Equals, "Origin")
+
+	re = get("")
+	c.Assert(re.Header().Get("Access-Control-Expose-Headers"), Equals, "")
+}
+
+func (s *CORSSuite) TestUpgrade(c *C) {
+	mw := s.newHandler(c, CORS{AllowedOrigins: []string{"https://app.example.com"}}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	}))
+	srv := httptest.NewServer(mw)
+	defer srv.Close()
+
+	// the browsers send the origin with the upgrade requests
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	re, err := http.DefaultTransport.RoundTrip(req)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusSwitchingProtocols)
+}
+
+func (s *CORSSuite) newHandler(c *C, cors CORS, next http.Handler) http.Handler {
+	m, err := New(cors)
+	c.Assert(err, IsNil)
+	h, err := m.NewHandler(next)
+	c.Assert(err, IsNil)
+	return h
+}
+
+func (s *CORSSuite) preflight(h http.Handler, origin, method, headers string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(http.MethodOptions, "http://localhost/", nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+	re := httptest.NewRecorder()
+	h.ServeHTTP(re, req)
+	return re
+}
@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// FailClosed rejects the requests with 503 when the middleware can not reach the service it depends on
+	FailClosed = "closed"
+	// FailOpen passes the requests through when the middleware can not reach the service it depends on
+	FailOpen = "open"
+)
+
+// CheckFailMode returns the error if the fail mode is neither open nor closed, empty mode is closed
+func CheckFailMode(mode string) error {
+	switch mode {
+	case "", FailClosed, FailOpen:
+		return nil
+	}
+	return fmt.Errorf("fail mode should be either '%v' or '%v', got '%v'", FailOpen, FailClosed, mode)
+}
+
+// Degrader is implemented by the middlewares depending on external services, e.g. the key set of the JWT
+// middleware, and deciding on the requests by their fail mode when the service is unreachable
+type Degrader interface {
+	// FailsOpen tells whether the requests are passed through when the service is unreachable
+	FailsOpen() bool
+}
+
+// degradedObserverKey is the request context key of the observer of the degraded decisions set by the proxy
+type degradedObserverKey struct{}
+
+// DegradedObserver records the decision the middleware of the type has made without the service it depends on,
+// allowed tells whether the request was passed through
+type DegradedObserver func(middleware string, allowed bool)
+
+// WithDegradedObserver returns the shallow copy of the request carrying the observer of the degraded decisions
+func WithDegradedObserver(req *http.Request, o DegradedObserver) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), degradedObserverKey{}, o))
+}
+
+// ObserveDegraded passes the degraded decision to the observer of the request, if the proxy has set one
+func ObserveDegraded(req *http.Request, middleware string, allowed bool) {
+	if o, ok := req.Context().Value(degradedObserverKey{}).(DegradedObserver); ok {
+		o(middleware, allowed)
+	}
+}
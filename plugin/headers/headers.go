@@ -0,0 +1,266 @@
+package headers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "headers"
+
+// Header is the header name and value. Value is a Go text/template with the request fields available,
+// e.g. {{.Host}}, {{.Path}}, {{.ClientIP}} or {{.Request.Header.Get "X-Header"}}.
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Ops are header operations, applied in order: remove, set, add
+type Ops struct {
+	// Set replaces all values of the header
+	Set []Header `json:",omitempty"`
+	// Add appends the value to the existing values of the header
+	Add []Header `json:",omitempty"`
+	// Remove deletes the header
+	Remove []string `json:",omitempty"`
+}
+
+// Headers plugin rewrites request headers before passing the request on and response headers before
+// writing the response to the client
+type Headers struct {
+	Request  Ops
+	Response Ops
+}
+
+// New returns a new Headers plugin, it checks header names and value templates
+func New(request, response Ops) (*Headers, error) {
+	h := &Headers{Request: request, Response: response}
+	if _, err := compileOps(h.Request); err != nil {
+		return nil, fmt.Errorf("bad request headers: %v", err)
+	}
+	if _, err := compileOps(h.Response); err != nil {
+		return nil, fmt.Errorf("bad response headers: %v", err)
+	}
+	return h, nil
+}
+
+// NewHandler creates a new http.Handler middleware
+func (h *Headers) NewHandler(next http.Handler) (http.Handler, error) {
+	return newHeadersHandler(next, h)
+}
+
+// String is a user-friendly representation of the handler
+func (h *Headers) String() string {
+	return fmt.Sprintf("request=%v, response=%v", h.Request, h.Response)
+}
+
+func (o Ops) String() string {
+	return fmt.Sprintf("set=%v, add=%v, remove=%v", o.Set, o.Add, o.Remove)
+}
+
+// FromOther creates and validates Headers plugin instance from serialized format
+func FromOther(h Headers) (plugin.Middleware, error) {
+	return New(h.Request, h.Response)
+}
+
+// FromCli creates a Headers plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	var request, response Ops
+	var err error
+	if request.Set, err = parseHeaders(c.StringSlice("setRequest")); err != nil {
+		return nil, err
+	}
+	if request.Add, err = parseHeaders(c.StringSlice("addRequest")); err != nil {
+		return nil, err
+	}
+	request.Remove = c.StringSlice("removeRequest")
+	if response.Set, err = parseHeaders(c.StringSlice("setResponse")); err != nil {
+		return nil, err
+	}
+	if response.Add, err = parseHeaders(c.StringSlice("addResponse")); err != nil {
+		return nil, err
+	}
+	response.Remove = c.StringSlice("removeResponse")
+	return New(request, response)
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "setRequest", Usage: "set request header, e.g. 'X-Real-IP: {{.ClientIP}}'", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "addRequest", Usage: "add request header value, e.g. 'X-Tag: edge'", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "removeRequest", Usage: "remove request header", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "setResponse", Usage: "set response header, e.g. 'Cache-Control: no-store'", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "addResponse", Usage: "add response header value", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "removeResponse", Usage: "remove response header, e.g. Server", Value: &cli.StringSlice{}},
+	}
+}
+
+// parseHeaders parses headers in 'Name: Value' format
+func parseHeaders(values []string) ([]Header, error) {
+	var headers []Header
+	for _, v := range values {
+		i := strings.Index(v, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("expected header in 'Name: Value' format, got '%v'", v)
+		}
+		headers = append(headers, Header{Name: strings.TrimSpace(v[:i]), Value: strings.TrimSpace(v[i+1:])})
+	}
+	return headers, nil
+}
+
+type headersHandler struct {
+	next     http.Handler
+	request  *compiledOps
+	response *compiledOps
+}
+
+func newHeadersHandler(next http.Handler, h *Headers) (*headersHandler, error) {
+	request, err := compileOps(h.Request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := compileOps(h.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &headersHandler{next: next, request: request, response: response}, nil
+}
+
+func (h *headersHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d := newData(req)
+	h.request.apply(req.Header, d)
+	if h.response.empty() {
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	h.next.ServeHTTP(&headersWriter{ResponseWriter: w, ops: h.response, data: d}, req)
+}
+
+// data is the template data of the header values
+type data struct {
+	Request  *http.Request
+	Host     string
+	Path     string
+	ClientIP string
+}
+
+func newData(req *http.Request) *data {
+	return &data{Request: req, Host: req.Host, Path: req.URL.Path, ClientIP: plugin.ClientIP(req)}
+}
+
+type compiledHeader struct {
+	name  string
+	value *template.Template
+}
+
+type compiledOps struct {
+	set    []compiledHeader
+	add    []compiledHeader
+	remove []string
+}
+
+func compileOps(o Ops) (*compiledOps, error) {
+	c := &compiledOps{}
+	var err error
+	if c.set, err = compileHeaders(o.Set); err != nil {
+		return nil, err
+	}
+	if c.add, err = compileHeaders(o.Add); err != nil {
+		return nil, err
+	}
+	for _, name := range o.Remove {
+		if !plugin.ValidHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name '%v'", name)
+		}
+		c.remove = append(c.remove, http.CanonicalHeaderKey(name))
+	}
+	return c, nil
+}
+
+func compileHeaders(headers []Header) ([]compiledHeader, error) {
+	var out []compiledHeader
+	for _, h := range headers {
+		if !plugin.ValidHeaderName(h.Name) {
+			return nil, fmt.Errorf("invalid header name '%v'", h.Name)
+		}
+		t, err := template.New(h.Name).Parse(h.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of header '%v': %v", h.Name, err)
+		}
+		out = append(out, compiledHeader{name: http.CanonicalHeaderKey(h.Name), value: t})
+	}
+	return out, nil
+}
+
+func (c *compiledOps) empty() bool {
+	return len(c.set) == 0 && len(c.add) == 0 && len(c.remove) == 0
+}
+
+func (c *compiledOps) apply(header http.Header, d *data) {
+	for _, name := range c.remove {
+		header.Del(name)
+	}
+	for _, h := range c.set {
+		header.Set(h.name, h.execute(d))
+	}
+	for _, h := range c.add {
+		header.Add(h.name, h.execute(d))
+	}
+}
+
+// execute renders the header value, new lines are dropped so the values can not inject headers
+func (h compiledHeader) execute(d *data) string {
+	buf := &bytes.Buffer{}
+	if err := h.value.Execute(buf, d); err != nil {
+		return ""
+	}
+	return strings.NewReplacer("\r", "", "\n", "").Replace(buf.String())
+}
+
+// headersWriter rewrites the response headers right before they are written
+type headersWriter struct {
+	http.ResponseWriter
+	ops         *compiledOps
+	data        *data
+	wroteHeader bool
+}
+
+func (w *headersWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.ops.apply(w.ResponseWriter.Header(), w.data)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headersWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
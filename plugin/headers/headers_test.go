@@ -0,0 +1,134 @@
+package headers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/oxy/testutils"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestHeaders(t *testing.T) { TestingT(t) }
+
+type HeadersSuite struct {
+}
+
+var _ = Suite(&HeadersSuite{})
+
+// Make sure the Headers spec is compatible and will be accepted by middleware registry
+func (s *HeadersSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *HeadersSuite) TestNewBadParams(c *C) {
+	bad := []Ops{
+		{Set: []Header{{Name: "", Value: "v"}}},
+		{Set: []Header{{Name: "X Header", Value: "v"}}},
+		{Add: []Header{{Name: "X-Header:", Value: "v"}}},
+		{Add: []Header{{Name: "X-Header", Value: "{{.Host"}}},
+		{Remove: []string{"X-Header\r\n"}},
+	}
+	for _, o := range bad {
+		_, err := New(o, Ops{})
+		c.Assert(err, NotNil, Commentf("%v", o))
+		_, err = New(Ops{}, o)
+		c.Assert(err, NotNil, Commentf("%v", o))
+	}
+}
+
+func (s *HeadersSuite) TestFromOther(c *C) {
+	h, err := New(Ops{Set: []Header{{Name: "X-A", Value: "a"}}}, Ops{Remove: []string{"Server"}})
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*h)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, h)
+
+	_, err = GetSpec().FromJSON([]byte(`{"Request": {"Remove": ["Bad Header"]}}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *HeadersSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		h := out.(*Headers)
+		c.Assert(h.Request.Set, DeepEquals, []Header{{Name: "X-Real-IP", Value: "{{.ClientIP}}"}})
+		c.Assert(h.Request.Add, DeepEquals, []Header{{Name: "X-Tag", Value: "a:b"}})
+		c.Assert(h.Request.Remove, DeepEquals, []string{"Cookie"})
+		c.Assert(h.Response.Remove, DeepEquals, []string{"Server", "X-Powered-By"})
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--setRequest=X-Real-IP: {{.ClientIP}}", "--addRequest=X-Tag: a:b", "--removeRequest=Cookie",
+		"--removeResponse=Server", "--removeResponse=X-Powered-By"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *HeadersSuite) TestRewrite(c *C) {
+	var got http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Cache", "miss")
+		w.Write([]byte("hello"))
+	})
+
+	h, err := New(
+		Ops{
+			Set:    []Header{{Name: "X-Real-IP", Value: "{{.ClientIP}}"}, {Name: "X-Original-Path", Value: "{{.Host}}{{.Path}}"}},
+			Add:    []Header{{Name: "X-Tag", Value: "edge"}},
+			Remove: []string{"cookie"},
+		},
+		Ops{
+			Set:    []Header{{Name: "X-Cache", Value: "{{.Request.Header.Get \"X-Tag\"}}"}},
+			Remove: []string{"Server"},
+		})
+	c.Assert(err, IsNil)
+	mw, err := h.NewHandler(handler)
+	c.Assert(err, IsNil)
+
+	srv := testutils.NewHandler(mw.ServeHTTP)
+	defer srv.Close()
+
+	re, body, err := testutils.Get(srv.URL+"/path",
+		testutils.Host("example.com"),
+		testutils.Header("Cookie", "secret"),
+		testutils.Header("X-Tag", "client"),
+	)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "hello")
+
+	c.Assert(got.Get("X-Real-IP"), Equals, "127.0.0.1")
+	c.Assert(got.Get("X-Original-Path"), Equals, "example.com/path")
+	c.Assert(got["X-Tag"], DeepEquals, []string{"client", "edge"})
+	c.Assert(got.Get("Cookie"), Equals, "")
+
+	c.Assert(re.Header.Get("Server"), Equals, "")
+	c.Assert(re.Header.Get("X-Cache"), Equals, "client")
+}
+
+func (s *HeadersSuite) TestNoHeaderInjection(c *C) {
+	var got http.Header
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	})
+	h, err := New(Ops{Set: []Header{{Name: "X-Path", Value: "{{.Request.Header.Get \"X-In\"}}"}}}, Ops{})
+	c.Assert(err, IsNil)
+	mw, err := h.NewHandler(handler)
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	c.Assert(err, IsNil)
+	req.Header.Set("X-In", "a\r\nX-Evil: 1")
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.Get("X-Path"), Equals, "aX-Evil: 1")
+}
@@ -0,0 +1,151 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "ipfilter"
+
+// IPFilter plugin rejects requests with 403 based on the client address resolved by the proxy, so the
+// addresses set by the trusted proxies in X-Forwarded-For are matched rather than the proxy peer.
+// Addresses of the allow list pass even if they are in the deny list too. If the allow list is set, the
+// addresses not in it are denied.
+type IPFilter struct {
+	// Allow lists CIDRs or addresses of the clients allowed to pass
+	Allow []string `json:",omitempty"`
+	// Deny lists CIDRs or addresses of the clients denied
+	Deny []string `json:",omitempty"`
+}
+
+// New returns a new IPFilter plugin, at least one of the lists should be set
+func New(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{Allow: allow, Deny: deny}
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, fmt.Errorf("supply allow or deny list")
+	}
+	if _, err := parseNets(allow); err != nil {
+		return nil, fmt.Errorf("bad allow list: %v", err)
+	}
+	if _, err := parseNets(deny); err != nil {
+		return nil, fmt.Errorf("bad deny list: %v", err)
+	}
+	return f, nil
+}
+
+// NewHandler creates a new http.Handler middleware
+func (f *IPFilter) NewHandler(next http.Handler) (http.Handler, error) {
+	allow, err := parseNets(f.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := parseNets(f.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipFilterHandler{next: next, allow: allow, deny: deny}, nil
+}
+
+// String is a user-friendly representation of the handler
+func (f *IPFilter) String() string {
+	return fmt.Sprintf("allow=%v, deny=%v", f.Allow, f.Deny)
+}
+
+// FromOther creates and validates IPFilter plugin instance from serialized format
+func FromOther(f IPFilter) (plugin.Middleware, error) {
+	return New(f.Allow, f.Deny)
+}
+
+// FromCli creates an IPFilter plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	return New(c.StringSlice("allow"), c.StringSlice("deny"))
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{Name: "allow", Usage: "CIDR or address of the clients allowed to pass, e.g. 10.0.0.0/8", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "deny", Usage: "CIDR or address of the clients denied, e.g. 192.168.1.15", Value: &cli.StringSlice{}},
+	}
+}
+
+// parseNets parses CIDRs, the addresses without the prefix length match the single address
+func parseNets(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%v'", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR '%v': %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+type ipFilterHandler struct {
+	next  http.Handler
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (h *ipFilterHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ip := plugin.ClientIP(req)
+	if !h.allowed(net.ParseIP(ip)) {
+		log.Infof("ipfilter denied %v %v to %v", req.Method, req.URL, ip)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(http.StatusText(http.StatusForbidden)))
+		return
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+// allowed checks the allow list first, the unparsable addresses are denied
+func (h *ipFilterHandler) allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if contains(h.allow, ip) {
+		return true
+	}
+	if contains(h.deny, ip) {
+		return false
+	}
+	return len(h.allow) == 0
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package ipfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/codegangsta/cli"
+	"github.com/vulcand/vulcand/plugin"
+	. "gopkg.in/check.v1"
+)
+
+func TestIPFilter(t *testing.T) { TestingT(t) }
+
+type IPFilterSuite struct {
+}
+
+var _ = Suite(&IPFilterSuite{})
+
+// Make sure the IPFilter spec is compatible and will be accepted by middleware registry
+func (s *IPFilterSuite) TestSpecIsOK(c *C) {
+	c.Assert(plugin.NewRegistry().AddSpec(GetSpec()), IsNil)
+}
+
+func (s *IPFilterSuite) TestNewBadParams(c *C) {
+	_, err := New(nil, nil)
+	c.Assert(err, NotNil)
+
+	for _, v := range []string{"", "10.0.0.0/33", "10.0.0", "example.com"} {
+		_, err := New([]string{v}, nil)
+		c.Assert(err, NotNil, Commentf("%v", v))
+		_, err = New(nil, []string{v})
+		c.Assert(err, NotNil, Commentf("%v", v))
+	}
+}
+
+func (s *IPFilterSuite) TestFromOther(c *C) {
+	f, err := New([]string{"10.0.0.0/8"}, []string{"10.1.0.0/16"})
+	c.Assert(err, IsNil)
+
+	out, err := FromOther(*f)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, f)
+
+	_, err = GetSpec().FromJSON([]byte(`{"Allow": ["bad"]}`))
+	c.Assert(err, NotNil)
+}
+
+func (s *IPFilterSuite) TestFromCli(c *C) {
+	app := cli.NewApp()
+	app.Name = "test"
+	executed := false
+	app.Action = func(ctx *cli.Context) error {
+		executed = true
+		out, err := FromCli(ctx)
+		c.Assert(err, IsNil)
+
+		f := out.(*IPFilter)
+		c.Assert(f.Allow, DeepEquals, []string{"10.0.0.0/8", "192.168.1.1"})
+		c.Assert(f.Deny, DeepEquals, []string{"10.1.0.0/16"})
+		return nil
+	}
+	app.Flags = CliFlags()
+	app.Run([]string{"test", "--allow=10.0.0.0/8", "--allow=192.168.1.1", "--deny=10.1.0.0/16"})
+	c.Assert(executed, Equals, true)
+}
+
+func (s *IPFilterSuite) TestFilter(c *C) {
+	tcs := []struct {
+		allow    []string
+		deny     []string
+		ip       string
+		expected int
+	}{
+		{allow: []string{"10.0.0.0/8"}, ip: "10.2.3.4", expected: http.StatusOK},
+		{allow: []string{"10.0.0.0/8"}, ip: "192.168.1.1", expected: http.StatusForbidden},
+		{allow: []string{"192.168.1.1"}, ip: "192.168.1.1", expected: http.StatusOK},
+		{allow: []string{"192.168.1.1"}, ip: "192.168.1.2", expected: http.StatusForbidden},
+		{deny: []string{"10.0.0.0/8"}, ip: "10.2.3.4", expected: http.StatusForbidden},
+		{deny: []string{"10.0.0.0/8"}, ip: "192.168.1.1", expected: http.StatusOK},
+		{deny: []string{"2001:db8::/32"}, ip: "2001:db8::1", expected: http.StatusForbidden},
+		// allow list takes precedence
+		{allow: []string{"10.1.2.3"}, deny: []string{"10.0.0.0/8"}, ip: "10.1.2.3", expected: http.StatusOK},
+		{allow: []string{"10.1.2.3"}, deny: []string{"10.0.0.0/8"}, ip: "10.1.2.4", expected: http.StatusForbidden},
+		{allow: []string{"10.1.2.3"}, deny: []string{"10.0.0.0/8"}, ip: "192.168.1.1", expected: http.StatusForbidden},
+	}
+	for i, tc := range tcs {
+		comment := Commentf("tc%d: %v", i, tc)
+		f, err := New(tc.allow, tc.deny)
+		c.Assert(err, IsNil, comment)
+		h, err := f.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		c.Assert(err, IsNil, comment)
+
+		req, err := http.NewRequest("GET", "http://localhost/admin", nil)
+		c.Assert(err, IsNil)
+		req.RemoteAddr = "127.0.0.1:45000"
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, plugin.WithClientIP(req, tc.ip))
+		c.Assert(rw.Code, Equals, tc.expected, comment)
+	}
+}
+
+// The client address resolved by the proxy is matched, not the peer address
+func (s *IPFilterSuite) TestResolvedClientIP(c *C) {
+	f, err := New([]string{"127.0.0.1"}, nil)
+	c.Assert(err, IsNil)
+	h, err := f.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	c.Assert(err, IsNil)
+
+	req, err := http.NewRequest("GET", "http://localhost/admin", nil)
+	c.Assert(err, IsNil)
+	req.RemoteAddr = "127.0.0.1:45000"
+	req.Header.Set("X-Forwarded-For", "127.0.0.1")
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusOK)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, plugin.WithClientIP(req, "203.0.113.5"))
+	c.Assert(rw.Code, Equals, http.StatusForbidden)
+}
@@ -0,0 +1,268 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// minRefreshInterval limits the refreshes of the key set requested by the tokens signed with unknown keys
+	minRefreshInterval = 10 * time.Second
+	// maxKeySetBytes limits the size of the key set document
+	maxKeySetBytes = 1 << 20
+)
+
+// errKeySetUnavailable is returned when no key verifies the token and the key set could not be fetched, so the
+// token may be signed with the key the proxy does not know yet
+var errKeySetUnavailable = errors.New("JWKS is unavailable")
+
+// verificationKey is the public key of the key set or the static key, empty id matches any token
+type verificationKey struct {
+	id  string
+	alg string
+	key interface{}
+}
+
+// jwk is the JSON Web Key, only the public keys of RSA and EC key types are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%v'", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %v", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%v'", k.Kty)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// keySet holds the keys of the JWKS URL, they are refreshed periodically by the goroutine running
+// while the handlers of the middleware hold the key set
+type keySet struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mtx       sync.RWMutex
+	keys      []verificationKey
+	refreshed time.Time
+	// failed is set if the last fetch of the key set has failed
+	failed bool
+	// loaded is set once the key set has been fetched, the keys are kept after the failed fetches
+	loaded bool
+
+	refreshC chan struct{}
+
+	runMtx sync.Mutex
+	// refs is the number of the handlers holding the key set, stopC stops the goroutine once it drops to zero
+	refs  int
+	stopC chan struct{}
+}
+
+func newKeySet(url string, interval time.Duration) *keySet {
+	return &keySet{
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		refreshC: make(chan struct{}, 1),
+	}
+}
+
+// acquire launches the refresh goroutine unless it is running for the other handlers
+func (s *keySet) acquire() {
+	s.runMtx.Lock()
+	defer s.runMtx.Unlock()
+	s.refs++
+	if s.refs == 1 {
+		s.stopC = make(chan struct{})
+		go s.run(s.stopC)
+	}
+}
+
+// release stops the refresh goroutine once the last handler holding the key set is closed
+func (s *keySet) release() {
+	s.runMtx.Lock()
+	defer s.runMtx.Unlock()
+	if s.refs == 0 {
+		return
+	}
+	s.refs--
+	if s.refs == 0 {
+		close(s.stopC)
+	}
+}
+
+func (s *keySet) run(stopC chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	s.refresh()
+	for {
+		select {
+		case <-ticker.C:
+			s.refresh()
+		case <-s.refreshC:
+			// tokens signed with the unknown keys do not make the key set refresh more often than the limit,
+			// the requests coming too early are dropped and the later tokens request the refresh again
+			if time.Since(s.lastRefresh()) >= minRefreshInterval {
+				s.refresh()
+			}
+		case <-stopC:
+			return
+		}
+	}
+}
+
+// requestRefresh asks the goroutine to refresh the keys without waiting for the refresh
+func (s *keySet) requestRefresh() {
+	select {
+	case s.refreshC <- struct{}{}:
+	default:
+	}
+}
+
+func (s *keySet) lastRefresh() time.Time {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.refreshed
+}
+
+// refresh fetches the key set, the keys are kept if the fetch fails
+func (s *keySet) refresh() {
+	keys, err := s.fetch()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.refreshed = time.Now()
+	s.failed = err != nil
+	if err != nil {
+		log.Errorf("failed to refresh JWKS %v: %v", s.url, err)
+		return
+	}
+	s.keys = keys
+	s.loaded = true
+}
+
+// unavailable tells whether the key set has never been loaded and its last fetch has failed, the tokens
+// with the unknown key ids are rejected once the key set has been loaded
+func (s *keySet) unavailable() bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.failed && !s.loaded
+}
+
+func (s *keySet) fetch() ([]verificationKey, error) {
+	re, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer re.Body.Close()
+	if re.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", re.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(re.Body, maxKeySetBytes)).Decode(&set); err != nil {
+		return nil, err
+	}
+	var keys []verificationKey
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Warningf("skipping key '%v' of JWKS %v: %v", k.Kid, s.url, err)
+			continue
+		}
+		keys = append(keys, verificationKey{id: k.Kid, alg: k.Alg, key: pub})
+	}
+	return keys, nil
+}
+
+// find returns the keys matching the key id and the algorithm of the token, the refresh is requested if
+// none are found, as the key set may have been rotated
+func (s *keySet) find(kid, alg string) []verificationKey {
+	s.mtx.RLock()
+	keys := matchingKeys(s.keys, kid, alg)
+	s.mtx.RUnlock()
+	if len(keys) == 0 {
+		s.requestRefresh()
+	}
+	return keys
+}
+
+func matchingKeys(keys []verificationKey, kid, alg string) []verificationKey {
+	var out []verificationKey
+	for _, k := range keys {
+		if (k.id == "" || kid == "" || k.id == kid) && (k.alg == "" || k.alg == alg) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
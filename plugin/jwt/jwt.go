@@ -0,0 +1,335 @@
+package jwt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const Type = "jwt"
+
+// DefaultRefreshInterval is the interval between the refreshes of the JWKS
+const DefaultRefreshInterval = 5 * time.Minute
+
+// ClaimHeader forwards the claim of the verified token to the upstream in the header
+type ClaimHeader struct {
+	Claim  string
+	Header string
+}
+
+// JWT plugin authenticates requests with the bearer JSON Web Token from the Authorization header, or the cookie
+// if the header is not set. The token signature is verified with the keys of the JWKS URL or the static key,
+// the token must expire unless AllowNoExpiry is set, the not before time is checked if present. Requests without
+// the valid token are rejected with 401.
+//
+// If the JWKS can not be fetched and none of the keys fetched before verifies the token, the request is decided by
+// the fail mode: rejected with 503 if the mode is closed, the default, or passed through without the claim
+// headers if the mode is open.
+type JWT struct {
+	// JWKSURL is the URL of the JSON Web Key Set, the keys are refreshed periodically
+	JWKSURL string `json:",omitempty"`
+	// Key is the static PEM encoded RSA or ECDSA public key or certificate, or the HMAC secret
+	Key string `json:",omitempty"`
+	// Issuer is the expected issuer claim, not checked if empty
+	Issuer string `json:",omitempty"`
+	// Audience is the audience the token has to be issued for, not checked if empty
+	Audience string `json:",omitempty"`
+	// Cookie is the name of the cookie holding the token of the requests without the Authorization header
+	Cookie string `json:",omitempty"`
+	// Claims are forwarded to the upstream in the headers, the headers set by the client are removed
+	Claims []ClaimHeader `json:",omitempty"`
+	// RefreshInterval is the interval between the refreshes of the JWKS, "5m" is default
+	RefreshInterval string `json:",omitempty"`
+	// Leeway is the clock skew allowed when checking the expiry and the not before time
+	Leeway string `json:",omitempty"`
+	// AllowNoExpiry accepts the tokens without the expiry claim, such tokens are valid forever once issued
+	AllowNoExpiry bool `json:",omitempty"`
+	// FailMode is either "closed" or "open", the behavior when the JWKS is unreachable, "closed" is default
+	FailMode string `json:",omitempty"`
+
+	keys      *keySet
+	staticKey interface{}
+	clock     timetools.TimeProvider
+}
+
+// New returns a new JWT plugin, exactly one of the JWKS URL and the static key should be set. The key set
+// is not fetched until the plugin creates its first handler.
+func New(j JWT) (*JWT, error) {
+	out := &JWT{
+		JWKSURL:         j.JWKSURL,
+		Key:             j.Key,
+		Issuer:          j.Issuer,
+		Audience:        j.Audience,
+		Cookie:          j.Cookie,
+		Claims:          j.Claims,
+		RefreshInterval: j.RefreshInterval,
+		Leeway:          j.Leeway,
+		AllowNoExpiry:   j.AllowNoExpiry,
+		FailMode:        j.FailMode,
+		clock:           &timetools.RealTime{},
+	}
+	if (out.JWKSURL == "") == (out.Key == "") {
+		return nil, fmt.Errorf("supply either JWKS URL or static key")
+	}
+	interval, err := parseDuration(out.RefreshInterval, DefaultRefreshInterval)
+	if err != nil {
+		return nil, fmt.Errorf("bad refresh interval: %v", err)
+	}
+	if _, err := parseDuration(out.Leeway, 0); err != nil {
+		return nil, fmt.Errorf("bad leeway: %v", err)
+	}
+	if err := plugin.CheckFailMode(out.FailMode); err != nil {
+		return nil, err
+	}
+	if out.JWKSURL != "" {
+		u, err := url.Parse(out.JWKSURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid JWKS URL '%v'", out.JWKSURL)
+		}
+		out.keys = newKeySet(out.JWKSURL, interval)
+	} else if out.staticKey, err = parseStaticKey(out.Key); err != nil {
+		return nil, fmt.Errorf("bad static key: %v", err)
+	}
+	for _, c := range out.Claims {
+		if c.Claim == "" || c.Header == "" || strings.ContainsAny(c.Header, " :\r\n") {
+			return nil, fmt.Errorf("invalid claim header %v", c)
+		}
+	}
+	return out, nil
+}
+
+func parseDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("duration should be >= 0, got %v", d)
+	}
+	if d == 0 && def != 0 {
+		return 0, fmt.Errorf("duration should be > 0")
+	}
+	return d, nil
+}
+
+// NewHandler creates a new http.Handler middleware, the key set is refreshed until all of the handlers
+// are closed
+func (j *JWT) NewHandler(next http.Handler) (http.Handler, error) {
+	if j.keys != nil {
+		j.keys.acquire()
+	}
+	leeway, _ := parseDuration(j.Leeway, 0)
+	return &jwtHandler{next: next, j: j, leeway: leeway}, nil
+}
+
+// FailsOpen tells whether the requests are passed through when the JWKS is unreachable
+func (j *JWT) FailsOpen() bool {
+	return j.FailMode == plugin.FailOpen
+}
+
+// String is a user-friendly representation of the handler, the static key is never printed
+func (j *JWT) String() string {
+	source := "jwks=" + j.JWKSURL
+	if j.JWKSURL == "" {
+		source = "key=<static>"
+	}
+	return fmt.Sprintf("%v, issuer=%v, audience=%v, cookie=%v, claims=%v, allowNoExpiry=%v, failMode=%v", source, j.Issuer, j.Audience, j.Cookie, j.Claims, j.AllowNoExpiry, j.FailMode)
+}
+
+// FromOther creates and validates JWT plugin instance from serialized format
+func FromOther(j JWT) (plugin.Middleware, error) {
+	return New(j)
+}
+
+// FromCli creates a JWT plugin object from command line
+func FromCli(c *cli.Context) (plugin.Middleware, error) {
+	j := JWT{
+		JWKSURL:       c.String("jwks"),
+		Key:           c.String("key"),
+		Issuer:        c.String("issuer"),
+		Audience:      c.String("audience"),
+		Cookie:        c.String("cookie"),
+		AllowNoExpiry: c.Bool("allowNoExpiry"),
+		FailMode:      c.String("failMode"),
+	}
+	if d := c.Duration("refreshInterval"); d != 0 {
+		j.RefreshInterval = d.String()
+	}
+	if d := c.Duration("leeway"); d != 0 {
+		j.Leeway = d.String()
+	}
+	for _, v := range c.StringSlice("claim") {
+		i := strings.Index(v, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected claim in 'claim=Header' format, got '%v'", v)
+		}
+		j.Claims = append(j.Claims, ClaimHeader{Claim: v[:i], Header: v[i+1:]})
+	}
+	return New(j)
+}
+
+// GetSpec is part of the Vulcan middleware interface
+func GetSpec() *plugin.MiddlewareSpec {
+	return &plugin.MiddlewareSpec{
+		Type:      Type,
+		FromOther: FromOther,
+		FromCli:   FromCli,
+		CliFlags:  CliFlags(),
+		Sealed:    true,
+	}
+}
+
+// CliFlags will be used by Vulcan construct help and CLI command for `vctl` command
+func CliFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "jwks", Usage: "URL of the JSON Web Key Set the signatures are verified with"},
+		cli.StringFlag{Name: "key", Usage: "static PEM encoded public key or HMAC secret the signatures are verified with"},
+		cli.StringFlag{Name: "issuer", Usage: "expected issuer of the tokens"},
+		cli.StringFlag{Name: "audience", Usage: "audience the tokens have to be issued for"},
+		cli.StringFlag{Name: "cookie", Usage: "cookie holding the token of the requests without the Authorization header"},
+		cli.StringSliceFlag{Name: "claim", Usage: "claim forwarded to the upstream in the header, e.g. 'sub=X-User'", Value: &cli.StringSlice{}},
+		cli.DurationFlag{Name: "refreshInterval", Usage: "interval between the refreshes of the JWKS"},
+		cli.DurationFlag{Name: "leeway", Usage: "clock skew allowed when checking the expiry"},
+		cli.BoolFlag{Name: "allowNoExpiry", Usage: "accept the tokens without the expiry claim"},
+		cli.StringFlag{Name: "failMode", Usage: "'closed' rejects the requests with 503 when the JWKS is unreachable, 'open' passes them through, closed by default"},
+	}
+}
+
+type jwtHandler struct {
+	next      http.Handler
+	j         *JWT
+	leeway    time.Duration
+	closeOnce sync.Once
+}
+
+// Close releases the key set held by the handler
+func (h *jwtHandler) Close() error {
+	h.closeOnce.Do(func() {
+		if h.j.keys != nil {
+			h.j.keys.release()
+		}
+	})
+	return nil
+}
+
+func (h *jwtHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the claim headers are only set by the proxy
+	for _, c := range h.j.Claims {
+		req.Header.Del(c.Header)
+	}
+	raw := h.extract(req)
+	if raw == "" {
+		h.reject(w, "Bearer")
+		return
+	}
+	t, err := h.verify(raw)
+	if err == errKeySetUnavailable {
+		h.degraded(w, req)
+		return
+	}
+	if err != nil {
+		log.Infof("jwt rejected %v %v from %v: %v", req.Method, req.URL, plugin.ClientIP(req), err)
+		h.reject(w, `Bearer error="invalid_token"`)
+		return
+	}
+	for _, c := range h.j.Claims {
+		if v, ok := claimValue(t.claims[c.Claim]); ok {
+			req.Header.Set(c.Header, v)
+		}
+	}
+	h.next.ServeHTTP(w, req)
+}
+
+// extract returns the bearer token of the Authorization header, or the token of the cookie
+func (h *jwtHandler) extract(req *http.Request) string {
+	if v := req.Header.Get("Authorization"); v != "" {
+		if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+		return ""
+	}
+	if h.j.Cookie != "" {
+		if c, err := req.Cookie(h.j.Cookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (h *jwtHandler) verify(raw string) (*token, error) {
+	t, err := parseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	var keys []verificationKey
+	if h.j.keys != nil {
+		keys = h.j.keys.find(t.header.Kid, t.header.Alg)
+	} else {
+		keys = []verificationKey{{key: h.j.staticKey}}
+	}
+	if len(keys) == 0 {
+		if h.j.keys != nil && h.j.keys.unavailable() {
+			return nil, errKeySetUnavailable
+		}
+		return nil, errNoKey
+	}
+	for _, k := range keys {
+		if err = t.verifyWith(k.key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(h.j.clock.UtcNow(), h.leeway, !h.j.AllowNoExpiry, h.j.Issuer, h.j.Audience); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// degraded decides on the request by the fail mode when the token can not be verified without the key set
+func (h *jwtHandler) degraded(w http.ResponseWriter, req *http.Request) {
+	open := h.j.FailsOpen()
+	plugin.ObserveDegraded(req, Type, open)
+	if open {
+		log.Warningf("jwt passed %v %v from %v unverified: %v", req.Method, req.URL, plugin.ClientIP(req), errKeySetUnavailable)
+		h.next.ServeHTTP(w, req)
+		return
+	}
+	log.Warningf("jwt rejected %v %v from %v: %v", req.Method, req.URL, plugin.ClientIP(req), errKeySetUnavailable)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+}
+
+func (h *jwtHandler) reject(w http.ResponseWriter, challenge string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+}
+
+// claimValue returns the header value of the claim, the claims other than strings are JSON encoded
+func claimValue(v interface{}) (string, bool) {
+	switch c := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return strings.NewReplacer("\r", "", "\n", "").Replace(c), true
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
@@ -0,0 +1,214 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	// hash functions of the signature algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+var errNoKey = errors.New("no key to verify the token")
+
+// curveBits is the curve size of the ES algorithms by their hash, ES512 uses P-521
+var curveBits = map[crypto.Hash]int{crypto.SHA256: 256, crypto.SHA384: 384, crypto.SHA512: 521}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// token is the decoded JWS compact serialization, the signature is not verified by the parser
+type token struct {
+	header    tokenHeader
+	claims    map[string]interface{}
+	signed    []byte
+	signature []byte
+}
+
+func parseToken(raw string) (*token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	t := &token{signed: []byte(parts[0] + "." + parts[1])}
+	if err := decodeSegment(parts[0], &t.header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if err := decodeSegment(parts[1], &t.claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	t.signature = sig
+	return t, nil
+}
+
+func decodeSegment(s string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// validate checks the registered claims, the token without the expiry is rejected if requireExp is set, the not
+// before time is checked if present
+func (t *token) validate(now time.Time, leeway time.Duration, requireExp bool, issuer, audience string) error {
+	exp, ok, err := t.timeClaim("exp")
+	if err != nil {
+		return err
+	}
+	if !ok && requireExp {
+		return errors.New("token has no expiry")
+	}
+	if ok && !now.Before(exp.Add(leeway)) {
+		return errors.New("token is expired")
+	}
+	nbf, ok, err := t.timeClaim("nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now.Before(nbf.Add(-leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if issuer != "" {
+		if iss, _ := t.claims["iss"].(string); iss != issuer {
+			return fmt.Errorf("unexpected issuer '%v'", t.claims["iss"])
+		}
+	}
+	if audience != "" && !t.hasAudience(audience) {
+		return fmt.Errorf("unexpected audience '%v'", t.claims["aud"])
+	}
+	return nil
+}
+
+func (t *token) timeClaim(name string) (time.Time, bool, error) {
+	v, ok := t.claims[name]
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	n, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("claim '%v' is not a number", name)
+	}
+	return time.Unix(int64(n), 0), true, nil
+}
+
+// hasAudience checks the audience claim, a string or an array of strings
+func (t *token) hasAudience(audience string) bool {
+	switch aud := t.claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyWith checks the token signature with the key, the algorithm has to match the type of the key,
+// so the public key can not be used as the HMAC secret
+func (t *token) verifyWith(key interface{}) error {
+	alg := t.header.Alg
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm '%v'", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%v'", alg)
+	}
+	h := hash.New()
+	h.Write(t.signed)
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, hash, digest, t.signature)
+		case "PS":
+			return rsa.VerifyPSS(k, hash, digest, t.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" || k.Curve.Params().BitSize != curveBits[hash] {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errors.New("invalid signature size")
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case []byte:
+		if alg[:2] != "HS" {
+			break
+		}
+		mac := hmac.New(hash.New, k)
+		mac.Write(t.signed)
+		if !hmac.Equal(mac.Sum(nil), t.signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm '%v' does not match the key", alg)
+}
+
+// parseStaticKey parses the PEM encoded RSA or ECDSA public key or certificate, other values are HMAC secrets
+func parseStaticKey(s string) (interface{}, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return []byte(s), nil
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block '%v'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
@@ -21,6 +21,9 @@ type MiddlewareSpec struct {
 	CliFlags []cli.Flag
 	// Function that construtcs a middleware from CLI parameters
 	FromCli CliReader
+	// Sealed tells the engines supporting encryption to store the middleware parameters sealed,
+	// e.g. for the middlewares holding credentials
+	Sealed bool
 }
 
 func (ms *MiddlewareSpec) FromJSON(data []byte) (Middleware, error) {
@@ -44,10 +47,24 @@ func (ms *MiddlewareSpec) FromJSON(data []byte) (Middleware, error) {
 	return m.(Middleware), nil
 }
 
+// Middleware creates the handlers of the frontend chain. Handlers running background work, e.g. refreshing
+// keys, implement io.Closer, the proxy closes them once the chain is rebuilt without them, the frontend is
+// deleted or the proxy stops, the validation closes them right after creating them.
+// The handler may write the final response without calling the next one, e.g. to redirect or to deny the
+// request, the inner middlewares and the forwarder are skipped then and the backend is never contacted.
 type Middleware interface {
 	NewHandler(http.Handler) (http.Handler, error)
 }
 
+// Limiter is implemented by the middlewares keeping the limits in their handlers, e.g. the rate and the connection
+// limits and the circuit breakers. The proxy running several workers builds one handler of such a middleware for
+// all of them, so the limits apply to the proxy as a whole, and keeps it over the rebuilds of the frontend until
+// the middleware is updated. The shared handler should pass the request on with the context it was given.
+type Limiter interface {
+	// SharesLimits tells whether the handler of the middleware is shared by the workers
+	SharesLimits() bool
+}
+
 // Reader constructs the middleware from the CLI interface
 type CliReader func(c *cli.Context) (Middleware, error)
 
@@ -115,6 +132,13 @@ func (r *Registry) GetRouter() router.Router {
 	return r.router
 }
 
+// SetIncomingConnectionTracker replaces the default tracker of the client connections, the tracker implementing
+// conntracker.ConnectionObserver is also notified when the connections are opened and closed. The tracker is
+// picked up by the proxy created with the registry, e.g. in the custom build of vulcand:
+//
+//	r := registry.GetRegistry()
+//	r.SetIncomingConnectionTracker(myTracker)
+//	service.Run(r)
 func (r *Registry) SetIncomingConnectionTracker(connTracker conntracker.ConnectionTracker) error {
 	r.incomingConnectionTracker = connTracker
 	return nil
@@ -128,6 +152,7 @@ func (r *Registry) GetOutgoingConnectionTracker() forward.UrlForwardingStateList
 	return r.outgoingConnectionTracker
 }
 
+// SetOutgoingConnectionTracker sets the listener of the connections to the backend servers
 func (r *Registry) SetOutgoingConnectionTracker(connTracker forward.UrlForwardingStateListener) error {
 	r.outgoingConnectionTracker = connTracker
 	return nil
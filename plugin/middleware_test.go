@@ -127,3 +127,13 @@ func GetSpec() *MiddlewareSpec {
 		},
 	}
 }
+
+func (s *MiddlewareSuite) TestValidHeaderName(c *C) {
+	for _, name := range []string{"X-Request-Id", "GET", "x_trace.id", "!#$%&'*+-.^_`|~"} {
+		c.Assert(ValidHeaderName(name), Equals, true, Commentf(name))
+	}
+	// the names carrying the valid token among the other characters are not valid
+	for _, name := range []string{"", "X Request Id", "X-Id:", "(X-Id)", "X-Id\r\nX-Other", "Ключ", "X-Id\x00"} {
+		c.Assert(ValidHeaderName(name), Equals, false, Commentf("%q", name))
+	}
+}
@@ -41,7 +41,7 @@ func FromOther(o RateLimit) (plugin.Middleware, error) {
 	if o.PeriodSeconds <= 0 {
 		return nil, fmt.Errorf("period seconds should be > 0, got %d", o.PeriodSeconds)
 	}
-	extract, err := utils.NewExtractor(o.Variable)
+	extract, err := plugin.NewExtractor(o.Variable)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +96,11 @@ func (r *RateLimit) NewHandler(next http.Handler) (http.Handler, error) {
 		ratelimit.ExtractRates(r.extractRates), ratelimit.Clock(r.clock))
 }
 
+// SharesLimits makes the workers of the proxy share the limits
+func (r *RateLimit) SharesLimits() bool {
+	return true
+}
+
 func (rl *RateLimit) String() string {
 	return fmt.Sprintf("reqs/%s=%d, burst=%d, var=%s, rateVar=%s",
 		time.Duration(rl.PeriodSeconds)*time.Second, rl.Requests, rl.Burst, rl.Variable, rl.RateVar)
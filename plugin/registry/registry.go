@@ -3,8 +3,15 @@ package registry
 
 import (
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/plugin/basicauth"
+	"github.com/vulcand/vulcand/plugin/cache"
 	"github.com/vulcand/vulcand/plugin/cbreaker"
+	"github.com/vulcand/vulcand/plugin/compress"
 	"github.com/vulcand/vulcand/plugin/connlimit"
+	"github.com/vulcand/vulcand/plugin/cors"
+	"github.com/vulcand/vulcand/plugin/headers"
+	"github.com/vulcand/vulcand/plugin/ipfilter"
+	"github.com/vulcand/vulcand/plugin/jwt"
 	"github.com/vulcand/vulcand/plugin/ratelimit"
 	"github.com/vulcand/vulcand/plugin/rewrite"
 	"github.com/vulcand/vulcand/plugin/trace"
@@ -19,6 +26,13 @@ func GetRegistry() *plugin.Registry {
 		rewrite.GetSpec(),
 		cbreaker.GetSpec(),
 		trace.GetSpec(),
+		headers.GetSpec(),
+		compress.GetSpec(),
+		ipfilter.GetSpec(),
+		basicauth.GetSpec(),
+		jwt.GetSpec(),
+		cors.GetSpec(),
+		cache.GetSpec(),
 	}
 
 	for _, spec := range specs {
@@ -0,0 +1,20 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+)
+
+// requestIDKey is the request context key of the request id assigned by the proxy
+type requestIDKey struct{}
+
+// WithRequestID returns the shallow copy of the request carrying the request id
+func WithRequestID(req *http.Request, id string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id))
+}
+
+// RequestID returns the id assigned to the request by the proxy, empty if the frontend does not assign the ids
+func RequestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,13 @@
+package plugin
+
+import (
+	"regexp"
+)
+
+// tokenRe matches the HTTP token as a whole, RFC 7230 3.2.6
+var tokenRe = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
+// ValidHeaderName checks that the header name, or the method, is a valid HTTP token
+func ValidHeaderName(name string) bool {
+	return tokenRe.MatchString(name)
+}
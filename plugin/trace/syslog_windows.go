@@ -0,0 +1,11 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+)
+
+// newWriter fails as there is no syslog on Windows
+func newWriter(addr string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog output '%v' is not supported on Windows", addr)
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log/syslog"
 	"net/http"
 	"net/url"
 
@@ -95,32 +94,6 @@ func CliFlags() []cli.Flag {
 	}
 }
 
-func newWriter(addr string) (io.Writer, error) {
-	u, err := url.Parse(addr)
-	if u.Scheme != "syslog" {
-		return nil, fmt.Errorf("unsupported scheme '%v' currently supported only 'syslog'", u.Scheme)
-	}
-	pr, err := parseSyslogPriority(u)
-	if err != nil {
-		return nil, err
-	}
-
-	var w io.Writer
-	if u.Host != "" {
-		w, err = syslog.Dial("udp", u.Host, pr, SyslogTag)
-	} else if u.Path != "" {
-		w, err = syslog.Dial("unixgram", u.Path, pr, SyslogTag)
-	} else if u.Host == "" && u.Path == "" {
-		w, err = syslog.Dial("", "", pr, SyslogTag)
-	} else {
-		return nil, fmt.Errorf("unsupported address format: %v", addr)
-	}
-	if err != nil {
-		return nil, err
-	}
-	return &prefixWriter{p: []byte(parsePrefix(u)), w: w}, nil
-}
-
 func parsePrefix(u *url.URL) string {
 	t := u.Query().Get("prefix")
 	if t != "" {
@@ -129,87 +102,6 @@ func parsePrefix(u *url.URL) string {
 	return SyslogPrefix
 }
 
-func parseSyslogPriority(u *url.URL) (syslog.Priority, error) {
-	vals := u.Query()
-	pr, err := sevToString(vals.Get("sev"))
-	if err != nil {
-		return 0, err
-	}
-	f, err := fToString(vals.Get("f"))
-	if err != nil {
-		return 0, err
-	}
-	return pr | f, nil
-}
-
-func sevToString(sev string) (pr syslog.Priority, err error) {
-	switch sev {
-	case "ALERT":
-		pr |= syslog.LOG_ALERT
-	case "CRIT":
-		pr |= syslog.LOG_CRIT
-	case "ERR":
-		pr |= syslog.LOG_ERR
-	case "WARNING":
-		pr |= syslog.LOG_WARNING
-	case "NOTICE":
-		pr |= syslog.LOG_NOTICE
-	case "INFO":
-		pr |= syslog.LOG_INFO
-	case "DEBUG", "":
-		pr |= syslog.LOG_DEBUG
-	default:
-		return 0, fmt.Errorf("uknown severity: %v", sev)
-	}
-	return pr, nil
-}
-
-func fToString(v string) (f syslog.Priority, err error) {
-	switch v {
-	case "USER":
-		f |= syslog.LOG_USER
-	case "MAIL":
-		f |= syslog.LOG_MAIL
-	case "DAEMON":
-		f |= syslog.LOG_DAEMON
-	case "AUTH":
-		f |= syslog.LOG_AUTH
-	case "SYSLOG":
-		f |= syslog.LOG_SYSLOG
-	case "LPR":
-		f |= syslog.LOG_LPR
-	case "NEWS":
-		f |= syslog.LOG_NEWS
-	case "UUCP":
-		f |= syslog.LOG_UUCP
-	case "CRON":
-		f |= syslog.LOG_CRON
-	case "AUTHPRIV":
-		f |= syslog.LOG_AUTHPRIV
-	case "FTP":
-		f |= syslog.LOG_FTP
-	case "LOG_LOCAL0", "":
-		f |= syslog.LOG_LOCAL0
-	case "LOG_LOCAL1":
-		f |= syslog.LOG_LOCAL1
-	case "LOG_LOCAL2":
-		f |= syslog.LOG_LOCAL2
-	case "LOG_LOCAL3":
-		f |= syslog.LOG_LOCAL3
-	case "LOG_LOCAL4":
-		f |= syslog.LOG_LOCAL4
-	case "LOG_LOCAL5":
-		f |= syslog.LOG_LOCAL5
-	case "LOG_LOCAL6":
-		f |= syslog.LOG_LOCAL6
-	case "LOG_LOCAL7":
-		f |= syslog.LOG_LOCAL7
-	default:
-		return 0, fmt.Errorf("unsupported facility: %v", v)
-	}
-	return f, nil
-}
-
 const SyslogPrefix = "@cee: "
 const SyslogTag = "pid"
 
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/tracing"
+)
+
+type accessRecordKey struct{}
+
+// accessRecord collects request details known only to the inner handlers
+type accessRecord struct {
+	server string
+}
+
+// accessLogEntry is a single line of the access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	Frontend   string    `json:"frontend"`
+	Backend    string    `json:"backend"`
+	Server     string    `json:"server,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	ClientIP   string    `json:"client_ip"`
+	Method     string    `json:"method"`
+	Host       string    `json:"host"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+}
+
+// accessLogWriter serializes access log entries written by all frontends as JSON lines
+type accessLogWriter struct {
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+func newAccessLogWriter(w io.Writer) *accessLogWriter {
+	return &accessLogWriter{enc: json.NewEncoder(w)}
+}
+
+func (a *accessLogWriter) write(e *accessLogEntry) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if err := a.enc.Encode(e); err != nil {
+		log.Errorf("failed to write access log: %v", err)
+	}
+}
+
+// accessLogger is the outermost frontend handler, it logs every request once the response is written.
+// Bytes are counted as they are written to the client, so responses buffered by middlewares are not counted twice.
+type accessLogger struct {
+	next     http.Handler
+	frontend string
+	backend  string
+	writer   *accessLogWriter
+	clock    timetools.TimeProvider
+}
+
+func newAccessLogger(f *frontend, next http.Handler) *accessLogger {
+	return &accessLogger{
+		next:     next,
+		frontend: f.key.Id,
+		backend:  f.backend.backend.Id,
+		writer:   f.mux.accessLog,
+		clock:    f.mux.options.TimeProvider,
+	}
+}
+
+func (a *accessLogger) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := a.clock.UtcNow()
+	rec := &accessRecord{}
+	pw := &utils.ProxyWriter{W: w}
+	a.next.ServeHTTP(pw, req.WithContext(context.WithValue(req.Context(), accessRecordKey{}, rec)))
+	a.writer.write(&accessLogEntry{
+		Time:       start,
+		Frontend:   a.frontend,
+		Backend:    a.backend,
+		Server:     rec.server,
+		RequestID:  plugin.RequestID(req),
+		ClientIP:   plugin.ClientIP(req),
+		Method:     req.Method,
+		Host:       req.Host,
+		Path:       req.URL.Path,
+		Status:     pw.StatusCode(),
+		Bytes:      pw.Length,
+		DurationMs: float64(a.clock.UtcNow().Sub(start)) / float64(time.Millisecond),
+	})
+}
+
+// serverRecorder sits right below the load balancer and records the chosen server for the access log
+// and the trace, the last attempted server wins in case of retries
+type serverRecorder struct {
+	next http.Handler
+}
+
+func (s *serverRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	server := req.URL.Scheme + "://" + req.URL.Host
+	if rec, ok := req.Context().Value(accessRecordKey{}).(*accessRecord); ok {
+		rec.server = server
+	}
+	if span := tracing.SpanFromContext(req.Context()); span != nil {
+		span.SetAttribute("vulcand.server", server)
+	}
+	s.next.ServeHTTP(w, req)
+}
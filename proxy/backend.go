@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/vulcand/vulcand/engine"
 )
 
@@ -14,7 +16,18 @@ type backend struct {
 
 	frontends map[engine.FrontendKey]*frontend
 	servers   []engine.Server
-	transport *http.Transport
+	transport backendTransport
+	// headless is the transport without the response header timeout used by the frontends with
+	// the forward timeout, it is created once such a frontend uses the backend
+	headless  backendTransport
+	settings  *engine.TransportSettings
+	checker   *healthChecker
+	detector  *outlierDetector
+	discovery *srvDiscovery
+	slowStart *slowStart
+	sticky    *engine.StickySessionSettings
+	// drain keeps the deleted servers until the requests in flight have finished
+	drain *serverDrain
 }
 
 func newBackend(m *mux, b engine.Backend) (*backend, error) {
@@ -22,13 +35,23 @@ func newBackend(m *mux, b engine.Backend) (*backend, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &backend{
+	be := &backend{
 		mux:       m,
 		backend:   b,
 		transport: newTransport(s),
+		settings:  s,
 		servers:   []engine.Server{},
 		frontends: make(map[engine.FrontendKey]*frontend),
-	}, nil
+		sticky:    s.StickySession,
+	}
+	be.drain = newServerDrain(be)
+	be.startHealthCheck(s)
+	be.startOutlierDetection(s, nil)
+	be.startDiscovery(s, nil)
+	be.startSlowStart(s, nil)
+	// the metric labels are taken in the order the backends are created
+	m.backendLabel(b.Id)
+	return be, nil
 }
 
 func (b *backend) String() string {
@@ -44,10 +67,218 @@ func (b *backend) unlinkFrontend(key engine.FrontendKey) {
 }
 
 func (b *backend) Close() error {
+	b.stopHealthCheck()
+	b.stopOutlierDetection()
+	b.stopDiscovery()
+	b.stopSlowStart()
+	b.drain.stop()
 	b.transport.CloseIdleConnections()
+	if b.headless != nil {
+		b.headless.CloseIdleConnections()
+	}
 	return nil
 }
 
+func (b *backend) startHealthCheck(s *engine.TransportSettings) {
+	if s.HealthCheck == nil {
+		return
+	}
+	b.checker = newHealthChecker(b, *s.HealthCheck)
+	b.checker.start()
+}
+
+func (b *backend) stopHealthCheck() {
+	if b.checker != nil {
+		b.checker.stop()
+		b.checker = nil
+	}
+}
+
+// startOutlierDetection starts the outlier detection, servers ejected by the previous detection stay ejected
+func (b *backend) startOutlierDetection(s *engine.TransportSettings, previous *outlierDetector) {
+	if s.OutlierDetection == nil {
+		return
+	}
+	b.detector = newOutlierDetector(b, *s.OutlierDetection)
+	if previous != nil {
+		b.detector.takeOver(previous)
+	}
+}
+
+// stopOutlierDetection stops the outlier detection and returns the stopped detector
+func (b *backend) stopOutlierDetection() *outlierDetector {
+	d := b.detector
+	if d != nil {
+		d.stop()
+		b.detector = nil
+	}
+	return d
+}
+
+// startDiscovery starts resolving the servers, servers discovered by the previous discovery of the same name
+// are taken over and the rest of them are removed
+func (b *backend) startDiscovery(s *engine.TransportSettings, previous *srvDiscovery) {
+	var servers map[string]bool
+	if previous != nil {
+		if s.Discovery != nil && s.Discovery.SRV == previous.settings.SRV {
+			servers = previous.servers
+		} else {
+			for id := range previous.servers {
+				b.removeServer(id)
+			}
+		}
+	}
+	if s.Discovery == nil {
+		return
+	}
+	b.discovery = newSRVDiscovery(b, *s.Discovery, servers)
+	b.discovery.start()
+}
+
+// stopDiscovery stops resolving the servers and returns the stopped discovery, the discovered servers
+// stay in the backend
+func (b *backend) stopDiscovery() *srvDiscovery {
+	d := b.discovery
+	if d != nil {
+		d.stop()
+		b.discovery = nil
+	}
+	return d
+}
+
+// startSlowStart starts the ramps, ramps in progress of the previous slow start are carried over
+func (b *backend) startSlowStart(s *engine.TransportSettings, previous *slowStart) {
+	if s.SlowStart == nil {
+		return
+	}
+	var started map[string]time.Time
+	if previous != nil {
+		started = previous.started
+	}
+	b.slowStart = newSlowStart(b, *s.SlowStart, started)
+	b.slowStart.start()
+}
+
+// stopSlowStart stops the ramps and returns the stopped slow start
+func (b *backend) stopSlowStart() *slowStart {
+	ss := b.slowStart
+	if ss != nil {
+		ss.stop()
+		b.slowStart = nil
+	}
+	return ss
+}
+
+// beginSlowStart starts the ramp of the server if the slow start is enabled
+func (b *backend) beginSlowStart(id string) {
+	if b.slowStart != nil {
+		b.slowStart.begin(id)
+	}
+}
+
+// serverWeight returns the weight of the server in the load balancer
+func (b *backend) serverWeight(s engine.Server) int {
+	if b.slowStart == nil {
+		return s.LBWeight()
+	}
+	return b.slowStart.weight(s)
+}
+
+// configuredServers returns the servers set in the engine, discovered and draining servers are excluded
+func (b *backend) configuredServers() []engine.Server {
+	servers := make([]engine.Server, 0, len(b.servers))
+	for _, s := range b.servers {
+		if (b.discovery == nil || !b.discovery.isDiscovered(s.Id)) && !b.drain.isDraining(s.Id) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// roundTripper returns the round tripper frontends use to forward requests to the backend servers
+func (b *backend) roundTripper() http.RoundTripper {
+	return b.observed(b.transport)
+}
+
+// timeoutRoundTripper returns the round tripper of the frontends with the forward timeout. The forward
+// timeout takes precedence over the response header timeout of the backend, so the transport does not limit
+// the time waiting for the response headers. The body idle timeout still applies.
+func (b *backend) timeoutRoundTripper() http.RoundTripper {
+	if b.settings.Timeouts.ResponseHeader <= 0 {
+		return b.roundTripper()
+	}
+	if b.headless == nil {
+		s := *b.settings
+		s.Timeouts.Read, s.Timeouts.ResponseHeader = 0, 0
+		b.headless = newTransport(&s)
+	}
+	return b.observed(b.headless)
+}
+
+func (b *backend) observed(t http.RoundTripper) http.RoundTripper {
+	if b.detector == nil {
+		return t
+	}
+	return &outlierTransport{d: b.detector, next: t}
+}
+
+// activeServers returns servers that should receive traffic, servers draining, quarantined through the API, failing
+// health checks or ejected by the outlier detection are excluded
+func (b *backend) activeServers() []engine.Server {
+	servers := make([]engine.Server, 0, len(b.servers))
+	for _, s := range b.servers {
+		if !b.drain.isDraining(s.Id) && !b.isQuarantined(s.Id) {
+			servers = append(servers, s)
+		}
+	}
+	if b.checker == nil && b.detector == nil {
+		return servers
+	}
+	healthy := make([]engine.Server, 0, len(servers))
+	for _, s := range servers {
+		if b.checker == nil || b.checker.isHealthy(s.Id) {
+			healthy = append(healthy, s)
+		}
+	}
+	if b.detector == nil {
+		return healthy
+	}
+	out := make([]engine.Server, 0, len(healthy))
+	for _, s := range healthy {
+		if !b.detector.isEjected(s) {
+			out = append(out, s)
+		}
+	}
+	// Ejection never takes out the last healthy server, but servers could have been removed
+	// since, so serve the ejected ones rather than nothing at all
+	if len(out) == 0 {
+		return healthy
+	}
+	return out
+}
+
+// isQuarantined returns true if the server of the backend is quarantined through the API
+func (b *backend) isQuarantined(id string) bool {
+	return b.mux.quarantined[engine.ServerKey{BackendKey: engine.BackendKey{Id: b.backend.Id}, Id: id}]
+}
+
+func (b *backend) serversHealth() []engine.ServerHealth {
+	out := make([]engine.ServerHealth, len(b.servers))
+	for i, s := range b.servers {
+		if b.checker != nil {
+			out[i] = b.checker.serverHealth(s)
+		} else {
+			out[i] = engine.ServerHealth{Id: s.Id, URL: s.URL, Healthy: true}
+		}
+		if b.detector != nil {
+			out[i].Ejected = b.detector.isEjected(s)
+		}
+		out[i].Quarantined = b.isQuarantined(s.Id)
+		out[i].Draining = b.drain.isDraining(s.Id)
+	}
+	return out
+}
+
 func (b *backend) update(be engine.Backend) error {
 	if err := b.updateSettings(be); err != nil {
 		return err
@@ -71,6 +302,19 @@ func (b *backend) updateSettings(be engine.Backend) error {
 	t := newTransport(s)
 	b.transport.CloseIdleConnections()
 	b.transport = t
+	if b.headless != nil {
+		b.headless.CloseIdleConnections()
+		b.headless = nil
+	}
+	b.settings = s
+	// frontends rebuilt below consult the new settings
+	b.backend = be
+	b.sticky = s.StickySession
+	b.stopHealthCheck()
+	b.startHealthCheck(s)
+	b.startOutlierDetection(s, b.stopOutlierDetection())
+	b.startDiscovery(s, b.stopDiscovery())
+	b.startSlowStart(s, b.stopSlowStart())
 	for _, f := range b.frontends {
 		f.updateTransport(t)
 	}
@@ -95,41 +339,104 @@ func (b *backend) findServer(sk engine.ServerKey) (*engine.Server, bool) {
 }
 
 func (b *backend) upsertServer(s engine.Server) error {
+	if b.discovery != nil {
+		// the server set in the engine takes over the discovered one
+		delete(b.discovery.servers, s.Id)
+	}
 	if i := b.indexOfServer(s.Id); i != -1 {
 		b.servers[i] = s
+		if b.drain.cancel(s.Id) {
+			// the server is back before it has drained, e.g. its registration has been renewed
+			log.Infof("%v %v is back, stopped draining", b, &s)
+		}
 	} else {
 		b.servers = append(b.servers, s)
+		b.beginSlowStart(s.Id)
 	}
 	return b.updateFrontends()
 }
 
 func (b *backend) deleteServer(sk engine.ServerKey) error {
-	i := b.indexOfServer(sk.Id)
-	if i == -1 {
+	if b.drain.isDraining(sk.Id) {
+		// the server has been deleted already and is waiting for its requests to finish
+		return nil
+	}
+	if !b.removeServer(sk.Id) {
 		return fmt.Errorf("%v not found %v", b, sk)
 	}
-	b.servers = append(b.servers[:i], b.servers[i+1:]...)
 	return b.updateFrontends()
 }
 
+// removeServer takes the server out of rotation without updating the frontends, returns false if there is no
+// such server or it is already draining. The server stays in the backend until the requests in flight have finished.
+func (b *backend) removeServer(id string) bool {
+	i := b.indexOfServer(id)
+	if i == -1 || b.drain.isDraining(id) {
+		return false
+	}
+	b.drain.start(b.servers[i])
+	return true
+}
+
+// dropServer removes the drained server from the backend and drops the state kept for it
+func (b *backend) dropServer(id string) {
+	i := b.indexOfServer(id)
+	if i == -1 {
+		return
+	}
+	key := urlKey(b.servers[i].URL)
+	b.servers = append(b.servers[:i], b.servers[i+1:]...)
+	if b.slowStart != nil {
+		b.slowStart.forget(id)
+	}
+	for _, s := range b.servers {
+		if urlKey(s.URL) == key {
+			return
+		}
+	}
+	b.drain.forget(key)
+}
+
 func (b *backend) updateFrontends() error {
 	for _, f := range b.frontends {
-		if err := f.updateBackend(b); err != nil {
+		if err := f.syncBackend(b); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func newTransport(s *engine.TransportSettings) *http.Transport {
-	return &http.Transport{
+// isHTTP2 returns true if requests are forwarded to the servers over HTTP/2
+func (b *backend) isHTTP2() bool {
+	return b.backend.HTTPSettings().Protocol == engine.BackendProtocolH2C
+}
+
+func newTransport(s *engine.TransportSettings) backendTransport {
+	t := newProtocolTransport(s)
+	if s.Timeouts.BodyIdle > 0 {
+		return &bodyIdleTransport{backendTransport: t, timeout: s.Timeouts.BodyIdle}
+	}
+	return t
+}
+
+func newProtocolTransport(s *engine.TransportSettings) backendTransport {
+	if s.Protocol == engine.BackendProtocolH2C {
+		return newH2CTransport(s)
+	}
+	t := &http.Transport{
 		Dial: (&net.Dialer{
 			Timeout:   s.Timeouts.Dial,
 			KeepAlive: s.KeepAlive.Period,
 		}).Dial,
-		ResponseHeaderTimeout: s.Timeouts.Read,
+		ResponseHeaderTimeout: s.Timeouts.ResponseHeader,
 		TLSHandshakeTimeout:   s.Timeouts.TLSHandshake,
 		MaxIdleConnsPerHost:   s.KeepAlive.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       s.KeepAlive.MaxConnsPerHost,
 		TLSClientConfig:       s.TLS,
 	}
+	if s.KeepAlive.MaxConnsPerHost > 0 {
+		// requests queued for a connection give up after the dial timeout instead of waiting forever
+		return newPoolLimitTransport(t, s.Timeouts.Dial)
+	}
+	return t
 }
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/reporter"
+)
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// bodyLimit rejects requests with bodies larger than the frontend limit with 413. Requests declaring the
+// length are rejected before they reach the backend. Bodies of chunked requests are cut at the limit, so
+// the forwarding fails and its response is replaced with 413.
+type bodyLimit struct {
+	next     http.Handler
+	limit    int64
+	frontend string
+	reporter reporter.Reporter
+}
+
+func newBodyLimit(f *frontend, limit int64, next http.Handler) *bodyLimit {
+	return &bodyLimit{
+		next:     next,
+		limit:    limit,
+		frontend: f.key.Id,
+		reporter: f.mux.options.Reporter,
+	}
+}
+
+func (l *bodyLimit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > l.limit {
+		l.reject(w, req)
+		return
+	}
+	// the server does not read past the declared length, so only bodies of unknown length are counted
+	if req.ContentLength != -1 || req.Body == nil || req.Body == http.NoBody {
+		l.next.ServeHTTP(w, req)
+		return
+	}
+	body := &limitedBody{r: req.Body, left: l.limit}
+	req.Body = body
+	lw := &bodyLimitWriter{l: l, w: w, req: req, body: body, header: make(http.Header)}
+	l.next.ServeHTTP(lw, req)
+	if !lw.wroteHeader && body.isExceeded() {
+		l.reject(w, req)
+	}
+}
+
+func (l *bodyLimit) reject(w http.ResponseWriter, req *http.Request) {
+	log.Infof("frontend %v rejecting %v %v, request body exceeds %d bytes", l.frontend, req.Method, req.URL, l.limit)
+	l.reporter.ObserveOversizedRequest(l.frontend)
+	// the rest of the body is not read, so the connection can not be reused
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+}
+
+// limitedBody fails the reads once there are more bytes than the limit. It is read by the transport
+// while the handler writes the response, so the exceeded flag is accessed atomically.
+type limitedBody struct {
+	r        io.ReadCloser
+	left     int64
+	exceeded int32
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, errBodyTooLarge
+	}
+	// read one byte past the limit to tell the body of the exact limit size from the larger one
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.r.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		atomic.StoreInt32(&b.exceeded, 1)
+		return 0, errBodyTooLarge
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.r.Close()
+}
+
+func (b *limitedBody) isExceeded() bool {
+	return atomic.LoadInt32(&b.exceeded) == 1
+}
+
+// bodyLimitWriter replaces the response with 413 if the body has exceeded the limit by the time
+// the response code is known
+type bodyLimitWriter struct {
+	l           *bodyLimit
+	w           http.ResponseWriter
+	req         *http.Request
+	body        *limitedBody
+	header      http.Header
+	wroteHeader bool
+	rejected    bool
+}
+
+func (lw *bodyLimitWriter) Header() http.Header {
+	return lw.header
+}
+
+func (lw *bodyLimitWriter) WriteHeader(code int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	if lw.body.isExceeded() {
+		lw.rejected = true
+		lw.l.reject(lw.w, lw.req)
+		return
+	}
+	utils.CopyHeaders(lw.w.Header(), lw.header)
+	lw.w.WriteHeader(code)
+}
+
+func (lw *bodyLimitWriter) Write(b []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.rejected {
+		return len(b), nil
+	}
+	return lw.w.Write(b)
+}
+
+func (lw *bodyLimitWriter) Flush() {
+	if lw.rejected {
+		return
+	}
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/metrics"
+)
+
+// bulkhead bounds the requests the frontend handles at once, so the slow backend does not pile up the requests
+// of the frontend. It is kept across the rebuilds of the frontend as long as the limit is the same, so the
+// requests in flight keep holding their slots.
+type bulkhead struct {
+	frontend string
+	limit    int64
+	wait     time.Duration
+	slots    chan struct{}
+	pages    *errorPages
+	client   metrics.Client
+	rejected metrics.Metric
+}
+
+func newBulkhead(f *frontend, limit int64, wait time.Duration) *bulkhead {
+	c := f.mux.options.MetricsClient
+	return &bulkhead{
+		frontend: f.key.Id,
+		limit:    limit,
+		wait:     wait,
+		slots:    make(chan struct{}, limit),
+		pages:    f.mux.errorPages,
+		client:   c,
+		rejected: c.Metric("frontend", f.mux.frontendLabel(f.key.Id), "inflight", "rejected"),
+	}
+}
+
+// inflight returns the amount of requests holding the slots
+func (b *bulkhead) inflight() int64 {
+	return int64(len(b.slots))
+}
+
+func (b *bulkhead) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !b.acquire(req) {
+			b.reject(w, req)
+			return
+		}
+		// the slot is released even if the handler panics
+		defer b.release()
+		next.ServeHTTP(w, req)
+	})
+}
+
+// acquire takes the slot, the request waits for the slot to be released up to the wait time
+func (b *bulkhead) acquire(req *http.Request) bool {
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if b.wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func (b *bulkhead) release() {
+	<-b.slots
+}
+
+func (b *bulkhead) reject(w http.ResponseWriter, req *http.Request) {
+	log.Debugf("frontend %v rejecting %v %v, %d requests in flight", b.frontend, req.Method, req.URL, b.limit)
+	b.client.Inc(b.rejected, 1, 1)
+	if b.pages.serve(w, req, http.StatusServiceUnavailable) {
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
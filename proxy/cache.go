@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// cacheObserver passes the lookups of the response caches of the frontend middlewares to the reporter,
+// the caches of the frontends with the canary split are bypassed
+type cacheObserver struct {
+	next    http.Handler
+	observe plugin.CacheObserver
+	bypass  bool
+}
+
+func newCacheObserver(f *frontend, next http.Handler, bypass bool) *cacheObserver {
+	frontend, r := f.key.Id, f.mux.options.Reporter
+	return &cacheObserver{next: next, observe: func(hit bool) { r.ObserveCacheLookup(frontend, hit) }, bypass: bypass}
+}
+
+func (c *cacheObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = plugin.WithCacheObserver(req, c.observe)
+	if c.bypass {
+		req = plugin.WithCacheBypass(req)
+	}
+	c.next.ServeHTTP(w, req)
+}
+
+// purgeCache drops the responses of the URLs with the path starting with the prefix from the caches of the
+// frontend middlewares of this proxy instance, returns the amount of the dropped responses
+func (f *frontend) purgeCache(prefix string) int {
+	purged := 0
+	for _, m := range f.middlewares {
+		if p, ok := m.Middleware.(plugin.Purger); ok {
+			purged += p.Purge(prefix)
+		}
+	}
+	return purged
+}
+
+// cached tells whether any of the middlewares caches the responses
+func cached(middlewares []engine.Middleware) bool {
+	for _, m := range middlewares {
+		if _, ok := m.Middleware.(plugin.Purger); ok {
+			return true
+		}
+	}
+	return false
+}
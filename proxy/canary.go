@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	canaryVariant = "canary"
+	stableVariant = "stable"
+)
+
+// balancer load balances the requests between the servers of the backend
+type balancer struct {
+	backend *backend
+	handler http.Handler
+	lb      loadBalancer
+	watcher *RTWatcher
+	weights map[string]int
+}
+
+func (b *balancer) syncServers(m *mux) error {
+	return syncServers(m, b.lb, b.backend, b.watcher, b.weights)
+}
+
+// canarySplit sends every request to the canary backend with the probability set in the canary settings
+// and to the stable backend otherwise
+type canarySplit struct {
+	stable http.Handler
+	canary http.Handler
+	// settings hold engine.HTTPFrontendCanary, they are replaced in place when the split is adjusted
+	settings atomic.Value
+}
+
+func newCanarySplit(stable, canary http.Handler, s engine.HTTPFrontendCanary) *canarySplit {
+	c := &canarySplit{stable: stable, canary: canary}
+	c.settings.Store(s)
+	return c
+}
+
+func (c *canarySplit) update(s engine.HTTPFrontendCanary) {
+	c.settings.Store(s)
+}
+
+func (c *canarySplit) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := c.settings.Load().(engine.HTTPFrontendCanary)
+	next, variant := c.stable, stableVariant
+	if s.Percent > 0 && rand.Float64()*100 < s.Percent {
+		next, variant = c.canary, canaryVariant
+	}
+	if s.Header != "" {
+		w.Header().Set(s.Header, variant)
+	}
+	next.ServeHTTP(w, req)
+}
+
+// canarySplitChanged returns true if the settings differ in the canary percent or header only,
+// these changes do not need the frontend to be rebuilt
+func canarySplitChanged(olds, news engine.HTTPFrontendSettings) bool {
+	if olds.Canary == nil || news.Canary == nil || olds.Canary.BackendId != news.Canary.BackendId {
+		return false
+	}
+	news.Canary = olds.Canary
+	return olds.Equals(news)
+}
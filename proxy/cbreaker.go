@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/metrics"
+	"github.com/vulcand/oxy/cbreaker"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// newCircuitBreaker returns the frontend circuit breaker counting its transitions to the tripped and standby states
+func newCircuitBreaker(f *frontend, next http.Handler, s engine.CircuitBreakerSettings) (*cbreaker.CircuitBreaker, error) {
+	fallback, err := cbreaker.NewResponseFallback(cbreaker.Response{
+		StatusCode:  s.Fallback.StatusCode,
+		ContentType: s.Fallback.ContentType,
+		Body:        []byte(s.Fallback.Body),
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := f.mux.options.MetricsClient
+	m := c.Metric("frontend", f.mux.frontendLabel(f.key.Id), "cbreaker")
+	return cbreaker.New(next, s.Condition,
+		cbreaker.Fallback(fallback),
+		cbreaker.FallbackDuration(s.FallbackDuration),
+		cbreaker.RecoveryDuration(s.RecoveryDuration),
+		cbreaker.CheckPeriod(s.CheckPeriod),
+		cbreaker.Clock(f.mux.options.TimeProvider),
+		cbreaker.OnTripped(&cbreakerTransition{frontend: f.key.Id, state: "tripped", client: c, metric: m.Metric("tripped")}),
+		cbreaker.OnStandby(&cbreakerTransition{frontend: f.key.Id, state: "standby", client: c, metric: m.Metric("standby")}))
+}
+
+// cbreakerTransition is the circuit breaker side effect reporting the state transition
+type cbreakerTransition struct {
+	frontend string
+	state    string
+	client   metrics.Client
+	metric   metrics.Metric
+}
+
+func (t *cbreakerTransition) Exec() error {
+	log.Infof("frontend %v circuit breaker is %v", t.frontend, t.state)
+	return t.client.Inc(t.metric, 1, 1)
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// certSelector picks the certificates of the hosts by the lower case server name. The default certificate is served
+// to the clients not sending the server name, e.g. health checkers and legacy clients, and to the clients asking
+// for the name no certificate covers.
+type certSelector struct {
+	// srv names the listener in the logs
+	srv   string
+	hosts map[string][]tls.Certificate
+	// names are the certificates by the names they cover, including the wildcard names
+	names map[string]*tls.Certificate
+	// fallback is the default certificate, the handshake picks the first listener certificate if empty
+	fallback     []tls.Certificate
+	fallbackName string
+}
+
+func newCertSelector(srv string, pairs map[string][]tls.Certificate, names map[string]*tls.Certificate, fallback []tls.Certificate, fallbackName string) *certSelector {
+	c := &certSelector{
+		srv:          srv,
+		hosts:        make(map[string][]tls.Certificate, len(pairs)),
+		names:        names,
+		fallback:     fallback,
+		fallbackName: fallbackName,
+	}
+	for name, certs := range pairs {
+		c.hosts[strings.ToLower(name)] = certs
+	}
+	return c
+}
+
+// getCertificate picks the first host certificate supported by the client, e.g. ECDSA certificate is skipped
+// for the clients supporting RSA signatures only. Nil certificate makes the handshake pick the first listener
+// certificate.
+func (c *certSelector) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// hosts have no empty names, the clients sending no server name get the default certificate
+	name := strings.ToLower(hello.ServerName)
+	if name != "" {
+		if certs, ok := c.hosts[name]; ok {
+			return supportedCert(hello, certs), nil
+		}
+		// the exact hosts take precedence over the wildcard ones, the wildcard hosts over the certificate names
+		if certs, ok := c.hosts[wildcardHost(name)]; ok {
+			return supportedCert(hello, certs), nil
+		}
+		if cert := c.lookup(name); cert != nil {
+			return cert, nil
+		}
+	}
+	if len(c.fallback) == 0 {
+		return nil, nil
+	}
+	if name == "" {
+		log.Infof("%v %v sent no server name, serving the default certificate of %v", c.srv, remoteAddr(hello), c.fallbackName)
+	} else {
+		log.Infof("%v %v asked for unknown server name %q, serving the default certificate of %v", c.srv, remoteAddr(hello), name, c.fallbackName)
+	}
+	return supportedCert(hello, c.fallback), nil
+}
+
+// lookup returns the certificate covering the name, the wildcard certificates cover the first label of the name
+func (c *certSelector) lookup(name string) *tls.Certificate {
+	if cert, ok := c.names[name]; ok {
+		return cert
+	}
+	return c.names[wildcardHost(name)]
+}
+
+// wildcardHost returns the wildcard name covering the first label of the name, e.g. "*.example.com" for
+// "api.example.com", the hosts and the certificates with the wildcard names serve all the names they cover
+func wildcardHost(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i <= 0 {
+		return ""
+	}
+	return "*" + name[i:]
+}
+
+func supportedCert(hello *tls.ClientHelloInfo, certs []tls.Certificate) *tls.Certificate {
+	for i := range certs {
+		if hello.SupportsCertificate(&certs[i]) == nil {
+			return &certs[i]
+		}
+	}
+	return &certs[0]
+}
+
+func remoteAddr(hello *tls.ClientHelloInfo) string {
+	if hello.Conn == nil {
+		return "client"
+	}
+	return hello.Conn.RemoteAddr().String()
+}
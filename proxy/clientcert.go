@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// ClientCertSubjectHeader carries the subject of the verified client certificate
+	ClientCertSubjectHeader = "X-Client-Cert-Subject"
+	// ClientCertSANHeader carries the comma separated subject alternative names of the verified client certificate
+	ClientCertSANHeader = "X-Client-Cert-San"
+)
+
+// clientCertHeaders passes the verified client certificate identity to middlewares and backends.
+// Headers sent by the clients are always removed, so they can not be spoofed.
+type clientCertHeaders struct {
+	next http.Handler
+}
+
+func (h *clientCertHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Header.Del(ClientCertSubjectHeader)
+	r.Header.Del(ClientCertSANHeader)
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 && len(r.TLS.VerifiedChains[0]) != 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		r.Header.Set(ClientCertSubjectHeader, cert.Subject.String())
+		if sans := subjectAltNames(cert); len(sans) != 0 {
+			r.Header.Set(ClientCertSANHeader, strings.Join(sans, ","))
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func subjectAltNames(cert *x509.Certificate) []string {
+	var sans []string
+	for _, n := range cert.DNSNames {
+		sans = append(sans, "DNS:"+n)
+	}
+	for _, e := range cert.EmailAddresses {
+		sans = append(sans, "email:"+e)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		sans = append(sans, "URI:"+u.String())
+	}
+	return sans
+}
+
+// clientAuthHosts are the server names of the hosts verifying the client certificates, the handshake config is
+// picked by the server name of the client hello, so the requests for these hosts must come with the same name
+type clientAuthHosts struct {
+	names map[string]bool
+	// defaultHost is the host the handshakes sending no server name get the config of
+	defaultHost string
+}
+
+// configName returns the name of the client auth config serving the name, empty if the name has none
+func (h *clientAuthHosts) configName(name string) string {
+	if h.names[name] {
+		return name
+	}
+	if w := wildcardHost(name); h.names[w] {
+		return w
+	}
+	return ""
+}
+
+// misdirected tells whether the request is for the host verifying the client certificates while its connection
+// was set up with the config of another server name, e.g. the client sent the name of the host without client
+// auth and the Host header of the protected one
+func (h *clientAuthHosts) misdirected(r *http.Request) bool {
+	if len(h.names) == 0 {
+		return false
+	}
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	target := h.configName(strings.ToLower(host))
+	if target == "" {
+		return false
+	}
+	serverName := strings.ToLower(r.TLS.ServerName)
+	if serverName == "" {
+		serverName = h.defaultHost
+	}
+	return h.configName(serverName) != target
+}
+
+// clientAuthGuard answers 421 to the requests for the hosts verifying the client certificates sent over the
+// connections not verified for them, the clients retry them over the new connection with the matching name
+type clientAuthGuard struct {
+	srv  *srv
+	next http.Handler
+}
+
+func (g *clientAuthGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hosts, ok := g.srv.clientAuth.Load().(*clientAuthHosts); ok && r.TLS != nil && hosts.misdirected(r) {
+		log.Infof("%v rejecting request for %v over connection for server name %q", g.srv, r.Host, r.TLS.ServerName)
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+	g.next.ServeHTTP(w, r)
+}
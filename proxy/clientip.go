@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// clientIPResolver resolves the client address once per request, so the rate limiting, access log and
+// middlewares all see the same address, see plugin.ClientIP
+type clientIPResolver struct {
+	trusted []*net.IPNet
+	next    http.Handler
+}
+
+func (c *clientIPResolver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	c.next.ServeHTTP(w, plugin.WithClientIP(req, realClientIP(req, c.trusted)))
+}
+
+// realClientIP returns the address of the client behind the trusted proxies. X-Forwarded-For is walked from
+// right to left, skipping the trusted hops, the first untrusted address is the client. The peer address
+// is returned if the peer is not a trusted proxy.
+func realClientIP(req *http.Request, trusted []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		peer = req.RemoteAddr
+	}
+	if len(trusted) == 0 || !isTrusted(peer, trusted) {
+		return peer
+	}
+	var hops []string
+	for _, v := range req.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		client = hop
+		if !isTrusted(hop, trusted) {
+			break
+		}
+	}
+	return client
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,26 +1,44 @@
 package proxy
 
 import (
-	"github.com/vulcand/vulcand/conntracker"
+	"crypto/tls"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/conntracker"
+	"github.com/vulcand/vulcand/reporter"
 )
 
+// connTracker is the default tracker, it counts the connections by state and observes the open connections,
+// the connections accepted and the lifetime of the closed connections per listener address
 type connTracker struct {
 	mtx *sync.Mutex
 
 	new    map[string]int64
 	active map[string]int64
 	idle   map[string]int64
+
+	// open counts the connections accepted and not closed yet, the hijacked ones included
+	open map[string]int64
+	// accepted and lifetimes are reset every time the metrics are emitted
+	accepted  map[string]int64
+	lifetimes map[string]*lifetimeHistogram
 }
 
 func newDefaultConnTracker() conntracker.ConnectionTracker {
 	return &connTracker{
-		mtx:    &sync.Mutex{},
-		new:    make(map[string]int64),
-		active: make(map[string]int64),
-		idle:   make(map[string]int64),
+		mtx:       &sync.Mutex{},
+		new:       make(map[string]int64),
+		active:    make(map[string]int64),
+		idle:      make(map[string]int64),
+		open:      make(map[string]int64),
+		accepted:  make(map[string]int64),
+		lifetimes: make(map[string]*lifetimeHistogram),
 	}
 }
 
@@ -37,6 +55,31 @@ func (c *connTracker) RegisterStateChange(conn net.Conn, prev http.ConnState, cu
 	}
 }
 
+func (c *connTracker) ConnectionOpened(conn net.Conn) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	addr := conn.LocalAddr().String()
+	c.open[addr]++
+	c.accepted[addr]++
+}
+
+func (c *connTracker) ConnectionClosed(conn net.Conn, info conntracker.ConnectionInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	addr := conn.LocalAddr().String()
+	if c.open[addr]--; c.open[addr] <= 0 {
+		delete(c.open, addr)
+	}
+	h, ok := c.lifetimes[addr]
+	if !ok {
+		h = &lifetimeHistogram{}
+		c.lifetimes[addr] = h
+	}
+	h[lifetimeBucket(info.Lifetime())]++
+}
+
 func (c *connTracker) inc(conn net.Conn, state http.ConnState, v int64) {
 	addr := conn.LocalAddr().String()
 	var m map[string]int64
@@ -66,6 +109,33 @@ func (c *connTracker) Counts() conntracker.ConnectionStats {
 	}
 }
 
+// emit emits the open connections, the connections accepted and the lifetime percentiles of the connections
+// closed since the last call
+func (c *connTracker) emit(client metrics.Client) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// the addresses are escaped, so the dots of the IPs do not split the metric names
+	for addr, n := range c.open {
+		client.Gauge(client.Metric("conns", reporter.MetricLabel(addr), "open"), n, 1)
+	}
+	for addr, n := range c.accepted {
+		client.Inc(client.Metric("conns", reporter.MetricLabel(addr), "accepted"), n, 1)
+	}
+	for addr, h := range c.lifetimes {
+		var count int64
+		for _, n := range h {
+			count += n
+		}
+		m := client.Metric("conns", reporter.MetricLabel(addr), "lifetime")
+		client.Gauge(m.Metric("p50"), int64(h.percentile(count, 0.5)/time.Millisecond), 1)
+		client.Gauge(m.Metric("p90"), int64(h.percentile(count, 0.9)/time.Millisecond), 1)
+		client.Gauge(m.Metric("p99"), int64(h.percentile(count, 0.99)/time.Millisecond), 1)
+	}
+	c.accepted = make(map[string]int64)
+	c.lifetimes = make(map[string]*lifetimeHistogram)
+}
+
 func (c *connTracker) copy(s map[string]int64) map[string]int64 {
 	out := make(map[string]int64, len(s))
 	for k, v := range s {
@@ -73,3 +143,104 @@ func (c *connTracker) copy(s map[string]int64) map[string]int64 {
 	}
 	return out
 }
+
+// trackConns wraps the listener, so the connection tracker implementing the connection observer sees every
+// accepted connection opened and closed. The connections are wrapped for the other trackers as well, so the server
+// learns when the hijacked connections close.
+func trackConns(l net.Listener, t conntracker.ConnectionTracker, clock timetools.TimeProvider) net.Listener {
+	o, _ := t.(conntracker.ConnectionObserver)
+	return &trackedListener{Listener: l, observer: o, clock: clock}
+}
+
+type trackedListener struct {
+	net.Listener
+	observer conntracker.ConnectionObserver
+	clock    timetools.TimeProvider
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn, l: l, opened: l.clock.UtcNow()}
+	if l.observer != nil {
+		l.observer.ConnectionOpened(tc)
+	}
+	return tc, nil
+}
+
+// trackedConn counts the bytes of the connection and reports it closed once, whoever closes it: the server,
+// the drain of the listener or the handler of the hijacked connection
+type trackedConn struct {
+	net.Conn
+	l      *trackedListener
+	opened time.Time
+
+	read     int64
+	written  int64
+	hijacked int32
+	// onClose is called once the hijacked connection is closed
+	onClose atomic.Value
+	once    sync.Once
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// CloseWrite lets the server half-close the TCP connection before closing it, as it does for the unwrapped one
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		if fn, ok := c.onClose.Load().(func()); ok {
+			fn()
+		}
+		if c.l.observer == nil {
+			return
+		}
+		c.l.observer.ConnectionClosed(c, conntracker.ConnectionInfo{
+			Opened:       c.opened,
+			Closed:       c.l.clock.UtcNow(),
+			BytesRead:    atomic.LoadInt64(&c.read),
+			BytesWritten: atomic.LoadInt64(&c.written),
+			Hijacked:     atomic.LoadInt32(&c.hijacked) == 1,
+		})
+	})
+	return err
+}
+
+// markHijacked finds the tracked connection under the TLS and the PROXY protocol connections the server
+// reports hijacked and sets onClose to be called once the handler closes it. It returns false if the connection
+// is not tracked.
+func markHijacked(conn net.Conn, onClose func()) bool {
+	for {
+		switch c := conn.(type) {
+		case *trackedConn:
+			c.onClose.Store(onClose)
+			atomic.StoreInt32(&c.hijacked, 1)
+			return true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyProtoConn:
+			conn = c.Conn
+		default:
+			return false
+		}
+	}
+}
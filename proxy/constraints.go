@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// requestConstraints rejects the requests the frontend does not take before they are buffered or forwarded:
+// the methods not allowed with 405 and the bodies of the media types not allowed with 415. OPTIONS is answered
+// with the Allow header unless it is allowed, the CORS preflight requests are passed on, so the CORS middleware
+// of the frontend answers them.
+type requestConstraints struct {
+	next     http.Handler
+	frontend string
+	pages    *errorPages
+	// methods are the allowed methods, all of them are allowed if nil
+	methods map[string]bool
+	allow   string
+	// types are the allowed media types and ranges, all of them are allowed if empty
+	types []string
+}
+
+func newRequestConstraints(f *frontend, s engine.HTTPFrontendSettings, next http.Handler) *requestConstraints {
+	c := &requestConstraints{next: next, frontend: f.key.Id, pages: f.mux.errorPages}
+	if len(s.AllowedMethods) != 0 {
+		c.methods = make(map[string]bool)
+		var allow []string
+		add := func(m string) {
+			if !c.methods[m] {
+				c.methods[m] = true
+				allow = append(allow, m)
+			}
+		}
+		for _, m := range s.AllowedMethods {
+			add(strings.ToUpper(m))
+		}
+		if c.methods[http.MethodGet] {
+			add(http.MethodHead)
+		}
+		// OPTIONS is answered by the proxy if it is not allowed, so it is allowed either way
+		if !c.methods[http.MethodOptions] {
+			allow = append(allow, http.MethodOptions)
+		}
+		c.allow = strings.Join(allow, ", ")
+	}
+	for _, t := range s.AllowedContentTypes {
+		c.types = append(c.types, strings.ToLower(t))
+	}
+	return c
+}
+
+func (c *requestConstraints) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if c.methods != nil && !c.methods[req.Method] {
+		if req.Method != http.MethodOptions {
+			c.reject(w, req, http.StatusMethodNotAllowed)
+			return
+		}
+		if req.Header.Get("Origin") == "" || req.Header.Get("Access-Control-Request-Method") == "" {
+			w.Header().Set("Allow", c.allow)
+			w.Header().Set("Content-Length", "0")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if len(c.types) != 0 && hasBody(req) && !c.allowType(req.Header.Get("Content-Type")) {
+		c.reject(w, req, http.StatusUnsupportedMediaType)
+		return
+	}
+	c.next.ServeHTTP(w, req)
+}
+
+// allowType tells whether the media type of the body matches any of the allowed types or ranges
+func (c *requestConstraints) allowType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range c.types {
+		if t == "*/*" || t == mt || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *requestConstraints) reject(w http.ResponseWriter, req *http.Request, code int) {
+	log.Debugf("frontend %v rejecting %v %v with %v, content type '%v'", c.frontend, req.Method, req.URL, code, req.Header.Get("Content-Type"))
+	if code == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", c.allow)
+	}
+	if c.pages.serve(w, req, code) {
+		return
+	}
+	body := []byte(http.StatusText(code))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// hasBody tells whether the request has the body, the bodies of unknown length are counted
+func hasBody(req *http.Request) bool {
+	return req.ContentLength > 0 || (req.ContentLength == -1 && req.Body != nil && req.Body != http.NoBody)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// LookupSRVFn resolves the SRV records of the name and returns the smallest TTL of the records
+type LookupSRVFn func(name string) ([]*net.SRV, time.Duration, error)
+
+// srvDiscovery periodically resolves the SRV records of the backend and keeps the backend servers in sync
+// with the records. Discovered servers are guarded by the mux lock.
+type srvDiscovery struct {
+	b        *backend
+	settings engine.ServerDiscoverySettings
+	lookup   LookupSRVFn
+	// servers are the ids of the servers added by the discovery
+	servers map[string]bool
+	stopC   chan struct{}
+}
+
+func newSRVDiscovery(b *backend, s engine.ServerDiscoverySettings, servers map[string]bool) *srvDiscovery {
+	if servers == nil {
+		servers = make(map[string]bool)
+	}
+	return &srvDiscovery{
+		b:        b,
+		settings: s,
+		lookup:   b.mux.options.LookupSRV,
+		servers:  servers,
+		stopC:    make(chan struct{}),
+	}
+}
+
+func (d *srvDiscovery) String() string {
+	return fmt.Sprintf("%v discovery(srv=%v)", d.b, d.settings.SRV)
+}
+
+func (d *srvDiscovery) start() {
+	d.b.mux.wg.Add(1)
+	go d.run()
+}
+
+// stop signals the discovery goroutine to exit, it does not wait for it as the caller
+// is holding the mux lock that the discovery may be waiting for.
+func (d *srvDiscovery) stop() {
+	close(d.stopC)
+}
+
+func (d *srvDiscovery) isDiscovered(id string) bool {
+	return d.servers[id]
+}
+
+func (d *srvDiscovery) run() {
+	defer d.b.mux.wg.Done()
+
+	for {
+		interval := d.refresh()
+		timer := time.NewTimer(interval)
+		select {
+		case <-d.stopC:
+			timer.Stop()
+			return
+		case <-d.b.mux.stopC:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh resolves the records and syncs the servers, returns the time to the next refresh. The servers
+// discovered last are kept if the lookup fails, the lookup is retried after the min refresh interval.
+func (d *srvDiscovery) refresh() time.Duration {
+	records, ttl, err := d.lookup(d.settings.SRV)
+	if err != nil {
+		log.Errorf("%v lookup failed, keeping %d servers: %v", d, len(d.servers), err)
+		return d.settings.MinRefresh
+	}
+
+	d.b.mux.mtx.Lock()
+	defer d.b.mux.mtx.Unlock()
+	select {
+	case <-d.stopC:
+		// the backend was updated or closed while the lookup was running
+		return 0
+	default:
+	}
+	if err := d.sync(d.toServers(records)); err != nil {
+		log.Errorf("%v failed to update servers: %v", d, err)
+	}
+	return d.settings.RefreshInterval(ttl)
+}
+
+// toServers converts the records of the lowest priority to servers, the other records are the fallback
+// for these servers and are not used. The records with the "." target tell the service is not available
+// at the name, they are skipped.
+func (d *srvDiscovery) toServers(records []*net.SRV) []engine.Server {
+	var available []*net.SRV
+	for _, r := range records {
+		if r.Target != "." && r.Target != "" {
+			available = append(available, r)
+		}
+	}
+	if len(available) == 0 {
+		return nil
+	}
+	var servers []engine.Server
+	priority := available[0].Priority
+	for _, r := range available {
+		if r.Priority < priority {
+			priority = r.Priority
+		}
+	}
+	for _, r := range available {
+		if r.Priority != priority {
+			continue
+		}
+		host := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		servers = append(servers, engine.Server{
+			Id:     host,
+			URL:    d.settings.Scheme + "://" + host,
+			Weight: int(r.Weight),
+		})
+	}
+	return servers
+}
+
+// sync adds new and changed servers and removes the discovered servers missing in the records, servers
+// configured in the engine are left intact
+func (d *srvDiscovery) sync(servers []engine.Server) error {
+	b := d.b
+	changed := false
+	seen := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		seen[s.Id] = true
+		i := b.indexOfServer(s.Id)
+		if i != -1 && !d.servers[s.Id] && !b.drain.isDraining(s.Id) {
+			continue
+		}
+		if i != -1 && b.drain.cancel(s.Id) {
+			// the server is back in the records before it has drained
+			log.Infof("%v %v is back, stopped draining", d, &s)
+		} else if i != -1 && b.servers[i].URL == s.URL && b.servers[i].Weight == s.Weight {
+			continue
+		}
+		if i != -1 {
+			b.servers[i] = s
+		} else {
+			b.servers = append(b.servers, s)
+			b.beginSlowStart(s.Id)
+			log.Infof("%v added %v", d, &s)
+		}
+		d.servers[s.Id] = true
+		changed = true
+	}
+	for id := range d.servers {
+		if !seen[id] {
+			changed = b.removeServer(id) || changed
+			delete(d.servers, id)
+			log.Infof("%v removed server %v", d, id)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return b.updateFrontends()
+}
@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// defaultDrainTimeout is the time the deleted servers are given to finish the requests in flight if the backend
+// does not set the drain timeout
+const defaultDrainTimeout = 30 * time.Second
+
+// serverDrain counts the requests in flight per server of the backend. Deleted servers are taken out of the load
+// balancers right away but stay in the backend, so their state and stats are kept, and they are removed once their
+// requests have finished or the drain timeout has passed, so the long responses are not cut during the rolling
+// deploys of the upstreams. Draining servers are changed under the mux lock and have the lock of their own, as the
+// requests finishing signal the idle ones. The counters are updated by the requests with atomics.
+type serverDrain struct {
+	b *backend
+
+	// inflight maps the server keys to the *int64 counters, the counter is deleted once no server of the backend
+	// has its key, the requests in flight keep decrementing the counter they have incremented
+	inflight sync.Map
+	// ndraining is the amount of the draining servers, the requests take the lock only if there are any
+	ndraining int32
+
+	mtx      sync.Mutex
+	draining map[string]*drainingServer
+}
+
+type drainingServer struct {
+	server engine.Server
+	key    string
+	// idleC is closed once the requests in flight have finished
+	idleC chan struct{}
+	idle  bool
+	// cancelC is closed when the server is upserted again or the backend is closed
+	cancelC chan struct{}
+}
+
+func newServerDrain(b *backend) *serverDrain {
+	return &serverDrain{
+		b:        b,
+		draining: make(map[string]*drainingServer),
+	}
+}
+
+func (d *serverDrain) counter(key string) *int64 {
+	if v, ok := d.inflight.Load(key); ok {
+		return v.(*int64)
+	}
+	v, _ := d.inflight.LoadOrStore(key, new(int64))
+	return v.(*int64)
+}
+
+// inflightOf returns the amount of the requests in flight to the server
+func (d *serverDrain) inflightOf(key string) int64 {
+	return atomic.LoadInt64(d.counter(key))
+}
+
+// forget deletes the counter of the server key, called with the mux lock held
+func (d *serverDrain) forget(key string) {
+	d.inflight.Delete(key)
+}
+
+// begin counts the request to the server, the returned counter is passed to end
+func (d *serverDrain) begin(key string) *int64 {
+	n := d.counter(key)
+	atomic.AddInt64(n, 1)
+	return n
+}
+
+func (d *serverDrain) end(key string, n *int64) {
+	if atomic.AddInt64(n, -1) > 0 || atomic.LoadInt32(&d.ndraining) == 0 {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, ds := range d.draining {
+		if ds.key == key && !ds.idle && d.inflightOf(key) == 0 {
+			ds.idle = true
+			close(ds.idleC)
+		}
+	}
+}
+
+// isDraining returns true if the server is deleted and has requests in flight
+func (d *serverDrain) isDraining(id string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	_, ok := d.draining[id]
+	return ok
+}
+
+// start drains the server deleted from the backend, the server with no requests in flight is removed right away.
+// The server is registered before its requests are counted, so the request finishing meanwhile signals it.
+func (d *serverDrain) start(s engine.Server) {
+	ds := &drainingServer{
+		server:  s,
+		key:     urlKey(s.URL),
+		idleC:   make(chan struct{}),
+		cancelC: make(chan struct{}),
+	}
+	d.mtx.Lock()
+	d.drop(s.Id)
+	d.draining[s.Id] = ds
+	atomic.AddInt32(&d.ndraining, 1)
+	d.mtx.Unlock()
+
+	inflight := d.inflightOf(ds.key)
+	if inflight == 0 {
+		d.mtx.Lock()
+		d.drop(s.Id)
+		d.mtx.Unlock()
+		d.b.dropServer(s.Id)
+		return
+	}
+	timeout := d.b.settings.Timeouts.Drain
+	if timeout <= 0 {
+		timeout = defaultDrainTimeout
+	}
+	log.Infof("%v draining %v with %d requests in flight for up to %v", d.b, &s, inflight, timeout)
+	d.b.mux.wg.Add(1)
+	go d.wait(ds, timeout)
+}
+
+// drop stops draining the server, called with the drain lock held
+func (d *serverDrain) drop(id string) bool {
+	ds, ok := d.draining[id]
+	if !ok {
+		return false
+	}
+	close(ds.cancelC)
+	delete(d.draining, id)
+	atomic.AddInt32(&d.ndraining, -1)
+	return true
+}
+
+func (d *serverDrain) wait(ds *drainingServer, timeout time.Duration) {
+	defer d.b.mux.wg.Done()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := false
+	select {
+	case <-ds.idleC:
+	case <-timer.C:
+		expired = true
+	case <-ds.cancelC:
+		return
+	case <-d.b.mux.stopC:
+		return
+	}
+
+	d.b.mux.mtx.Lock()
+	defer d.b.mux.mtx.Unlock()
+	d.finish(ds, expired)
+}
+
+// finish removes the drained server, called with the mux lock held
+func (d *serverDrain) finish(ds *drainingServer, expired bool) {
+	d.mtx.Lock()
+	// The drain could have been canceled while we were waiting for the lock
+	if d.draining[ds.server.Id] != ds {
+		d.mtx.Unlock()
+		return
+	}
+	delete(d.draining, ds.server.Id)
+	atomic.AddInt32(&d.ndraining, -1)
+	d.mtx.Unlock()
+
+	inflight := d.inflightOf(ds.key)
+	d.b.dropServer(ds.server.Id)
+	c := d.b.mux.options.MetricsClient
+	id := d.b.mux.backendLabel(d.b.backend.Id)
+	if expired {
+		log.Warningf("%v removed %v after the drain timeout with %d requests in flight", d.b, &ds.server, inflight)
+		c.Inc(c.Metric("backend", id, "servers", "drain_expired"), 1, 1)
+		return
+	}
+	log.Infof("%v removed drained %v", d.b, &ds.server)
+	c.Inc(c.Metric("backend", id, "servers", "drained"), 1, 1)
+}
+
+// cancel stops draining the server upserted again, returns false if the server is not draining
+func (d *serverDrain) cancel(id string) bool {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.drop(id)
+}
+
+// stop cancels the drains in progress, the requests in flight are still allowed to finish
+func (d *serverDrain) stop() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for id := range d.draining {
+		d.drop(id)
+	}
+}
+
+// inflightObserver counts the requests in flight to the server picked by the load balancer
+type inflightObserver struct {
+	next  http.Handler
+	drain *serverDrain
+}
+
+func (o *inflightObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	key := serverKey(req.URL)
+	n := o.drain.begin(key)
+	defer o.drain.end(key, n)
+	o.next.ServeHTTP(w, req)
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	htemplate "html/template"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	ttemplate "text/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// errorPageData are the request fields available to the error page templates
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Method     string
+	Host       string
+	Path       string
+}
+
+type errorTemplate struct {
+	contentType string
+	tmpl        interface {
+		Execute(io.Writer, interface{}) error
+	}
+	// escape is applied to the request fields of the text templates, html templates escape them on their own
+	escape func(string) string
+}
+
+func newErrorTemplate(code int, p engine.ErrorPage) (*errorTemplate, error) {
+	t := &errorTemplate{contentType: p.ContentType}
+	if t.contentType == "" {
+		t.contentType = "text/plain; charset=utf-8"
+	}
+	name := strconv.Itoa(code)
+	mediaType := errorPageMediaType(t.contentType)
+	var err error
+	if mediaType == "text/html" {
+		t.tmpl, err = htemplate.New(name).Parse(p.Body)
+	} else {
+		t.tmpl, err = ttemplate.New(name).Parse(p.Body)
+		t.escape = fieldEscaper(mediaType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// errorPageMediaType returns the lower case media type of the page content type, the media types are case-insensitive
+func errorPageMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// the content type is served as it is set, its media type is taken up to the parameters
+		mediaType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	}
+	return mediaType
+}
+
+// fieldEscaper returns the escaping of the request fields inside the JSON strings or the XML text of the page
+func fieldEscaper(mediaType string) func(string) string {
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return jsonEscape
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return htemplate.HTMLEscapeString
+	}
+	return nil
+}
+
+// jsonEscape escapes the string to be placed between the quotes of a JSON string
+func jsonEscape(v string) string {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(out[1 : len(out)-1])
+}
+
+func newErrorTemplates(pages map[int]engine.ErrorPage) (map[int]*errorTemplate, error) {
+	if len(pages) == 0 {
+		return nil, nil
+	}
+	if err := engine.CheckErrorPages(pages); err != nil {
+		return nil, err
+	}
+	out := make(map[int]*errorTemplate, len(pages))
+	for code, p := range pages {
+		t, err := newErrorTemplate(code, p)
+		if err != nil {
+			return nil, err
+		}
+		out[code] = t
+	}
+	return out, nil
+}
+
+// errorPages are the error page templates set in the options and by the hosts. They are guarded by their own
+// lock, so serving the error pages does not wait for the configuration changes holding the mux lock.
+type errorPages struct {
+	mtx    sync.RWMutex
+	global map[int]*errorTemplate
+	hosts  map[string]map[int]*errorTemplate
+}
+
+func newErrorPages(global map[int]engine.ErrorPage) (*errorPages, error) {
+	templates, err := newErrorTemplates(global)
+	if err != nil {
+		return nil, err
+	}
+	return &errorPages{global: templates, hosts: make(map[string]map[int]*errorTemplate)}, nil
+}
+
+func (p *errorPages) upsertHost(h engine.Host) error {
+	templates, err := newErrorTemplates(h.Settings.ErrorPages)
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if templates == nil {
+		delete(p.hosts, h.Name)
+	} else {
+		p.hosts[h.Name] = templates
+	}
+	return nil
+}
+
+func (p *errorPages) deleteHost(name string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.hosts, name)
+}
+
+func (p *errorPages) find(host string, code int) *errorTemplate {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	if t, ok := p.hosts[host][code]; ok {
+		return t
+	}
+	if t, ok := p.hosts[wildcardHost(host)][code]; ok {
+		return t
+	}
+	return p.global[code]
+}
+
+// serve writes the error page of the request host, returns false if there is no page for the status
+// or the template fails, so the caller can write the default response
+func (p *errorPages) serve(w http.ResponseWriter, req *http.Request, code int) bool {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	t := p.find(host, code)
+	if t == nil {
+		return false
+	}
+	data := &errorPageData{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		Method:     req.Method,
+		Host:       host,
+		Path:       req.URL.Path,
+	}
+	if t.escape != nil {
+		data.Method, data.Host, data.Path = t.escape(data.Method), t.escape(data.Host), t.escape(data.Path)
+	}
+	buf := &bytes.Buffer{}
+	err := t.tmpl.Execute(buf, data)
+	if err != nil {
+		log.Errorf("failed to render error page %d of %v: %v", code, host, err)
+		return false
+	}
+	w.Header().Set("Content-Type", t.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+	return true
+}
+
+// errorHandler serves the error pages instead of the responses of the next handler
+func (p *errorPages) errorHandler(next utils.ErrorHandler) utils.ErrorHandler {
+	return utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		if !p.serve(w, req, errorStatus(err)) {
+			next.ServeHTTP(w, req, err)
+		}
+	})
+}
+
+// errorStatus returns the status code of the forwarding error the way the default error handler picks it
+func errorStatus(err error) int {
+	if _, ok := err.(*poolExhaustedError); ok {
+		return http.StatusServiceUnavailable
+	}
+	if e, ok := err.(net.Error); ok {
+		if e.Timeout() {
+			return http.StatusGatewayTimeout
+		}
+		return http.StatusBadGateway
+	}
+	if err == io.EOF {
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// notFoundPage serves the 404 error page to the requests not matching any frontend
+type notFoundPage struct {
+	pages *errorPages
+	next  http.Handler
+}
+
+func (n *notFoundPage) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !n.pages.serve(w, req, http.StatusNotFound) {
+		n.next.ServeHTTP(w, req)
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// degradedObserver passes the decisions the frontend middlewares make by their fail mode to the reporter
+type degradedObserver struct {
+	next    http.Handler
+	observe plugin.DegradedObserver
+}
+
+func newDegradedObserver(f *frontend, next http.Handler) *degradedObserver {
+	frontend, r := f.key.Id, f.mux.options.Reporter
+	return &degradedObserver{next: next, observe: func(middleware string, allowed bool) {
+		r.ObserveDegradedRequest(frontend, middleware, allowed)
+	}}
+}
+
+func (d *degradedObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	d.next.ServeHTTP(w, plugin.WithDegradedObserver(req, d.observe))
+}
+
+// degradable tells whether any of the middlewares depends on an external service
+func degradable(middlewares []engine.Middleware) bool {
+	for _, m := range middlewares {
+		if _, ok := m.Middleware.(plugin.Degrader); ok {
+			return true
+		}
+	}
+	return false
+}
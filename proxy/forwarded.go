@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// xForwardedPort is the port the client has sent the request to
+const xForwardedPort = "X-Forwarded-Port"
+
+// forwardedHeaders sets X-Forwarded-Proto, X-Forwarded-Host and X-Forwarded-Port before the request is passed
+// to the forwarder, as the forwarders replace the host of the request with the host of the server. The scheme is
+// the one of the listener the request has come to, https for the requests over TLS, the host is the host the
+// client has asked for and the port is the port of the host, the default port of the scheme if the host has none.
+//
+// The frontends trusting the forward headers are behind another proxy, which has terminated the connection of the
+// client, so the values set by it take precedence and the port follows the host and the scheme set by the proxy.
+// Otherwise the values sent by the client are replaced.
+type forwardedHeaders struct {
+	next  http.Handler
+	trust bool
+}
+
+func (f *forwardedHeaders) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	proto, host, port := "http", req.Host, ""
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if f.trust {
+		if v := firstValue(req.Header.Get(forward.XForwardedProto)); v != "" {
+			proto = v
+		}
+		if v := firstValue(req.Header.Get(forward.XForwardedHost)); v != "" {
+			host = v
+		}
+		port = firstValue(req.Header.Get(xForwardedPort))
+	}
+	if port == "" {
+		port = hostPort(host, proto)
+	}
+
+	req.Header.Set(forward.XForwardedProto, proto)
+	if host != "" {
+		req.Header.Set(forward.XForwardedHost, host)
+	} else {
+		req.Header.Del(forward.XForwardedHost)
+	}
+	req.Header.Set(xForwardedPort, port)
+	f.next.ServeHTTP(w, req)
+}
+
+// firstValue returns the first of the comma separated values, the one set by the proxy closest to the client
+func firstValue(v string) string {
+	if i := strings.IndexByte(v, ','); i != -1 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// hostPort returns the port of the host or the default port of the scheme
+func hostPort(host, proto string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil && port != "" {
+		return port
+	}
+	if strings.EqualFold(proto, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// forwardedForRewriter is the request rewriter of the forwarders: it appends the client address to X-Forwarded-For,
+// sets X-Forwarded-Server and removes the hop-by-hop headers. X-Forwarded-Proto, X-Forwarded-Host and
+// X-Forwarded-Port are set by forwardedHeaders, the request the forwarders rewrite has the host of the server.
+type forwardedForRewriter struct {
+	hostname string
+	trust    bool
+}
+
+func (rw *forwardedForRewriter) Rewrite(req *http.Request) {
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if prior, ok := req.Header[forward.XForwardedFor]; ok && rw.trust {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		req.Header.Set(forward.XForwardedFor, clientIP)
+	}
+	if rw.hostname != "" {
+		req.Header.Set(forward.XForwardedServer, rw.hostname)
+	}
+	utils.RemoveHeaders(req.Header, forward.HopHeaders...)
+}
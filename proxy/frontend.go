@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"sort"
@@ -10,8 +11,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/vulcand/oxy/buffer"
 	"github.com/vulcand/oxy/forward"
-	"github.com/vulcand/oxy/roundrobin"
 	"github.com/vulcand/oxy/stream"
+	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/engine"
 )
 
@@ -19,11 +20,26 @@ type frontend struct {
 	key         engine.FrontendKey
 	mux         *mux
 	frontend    engine.Frontend
-	lb          *roundrobin.Rebalancer
+	lb          loadBalancer
 	handler     http.Handler
 	watcher     *RTWatcher
+	weights     map[string]int
 	backend     *backend
 	middlewares map[engine.MiddlewareKey]engine.Middleware
+	// handlers are the middleware handlers of the chain, they are closed once the rebuild replaces them
+	handlers []http.Handler
+	// canary forwards the share of the requests picked by the split to the canary backend
+	canary *balancer
+	split  *canarySplit
+	// mirror copies the share of the requests to the shadow backend
+	mirror *balancer
+	// bulkhead bounds the requests in flight, it survives the rebuilds that keep the limit. The bulkhead, the retry
+	// budget and the rate limiter are kept by the shared limits of the mux, so the workers share them.
+	bulkhead *bulkhead
+	// retryBudget caps the retries of the load balancers, it survives the rebuilds that keep the budget
+	retryBudget *retryBudget
+	// rateLimiter keeps the token buckets of the keys, it survives the rebuilds that keep the rate limit
+	rateLimiter *rateLimiter
 }
 
 func newFrontend(m *mux, f engine.Frontend, b *backend) *frontend {
@@ -34,6 +50,8 @@ func newFrontend(m *mux, f engine.Frontend, b *backend) *frontend {
 		backend:     b,
 		middlewares: make(map[engine.MiddlewareKey]engine.Middleware),
 	}
+	// the metric labels are taken in the order the frontends are created
+	m.frontendLabel(f.Id)
 	return fr
 }
 
@@ -41,16 +59,18 @@ func (f *frontend) String() string {
 	return fmt.Sprintf("%v frontend(wrap=%v)", f.mux, &f.frontend)
 }
 
-// syncs backend servers and rebalancer state
-func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatcher) error {
+// syncs backend servers and rebalancer state, weights hold server weights set in the rebalancer
+func syncServers(m *mux, rb loadBalancer, backend *backend, w *RTWatcher, weights map[string]int) error {
 	// First, collect and parse servers to add
 	newServers := map[string]*url.URL{}
-	for _, s := range backend.servers {
+	newWeights := map[string]int{}
+	for _, s := range backend.activeServers() {
 		u, err := url.Parse(s.URL)
 		if err != nil {
 			return fmt.Errorf("failed to parse url %v", s.URL)
 		}
 		newServers[s.URL] = u
+		newWeights[u.String()] = backend.serverWeight(s)
 	}
 
 	// Memorize what endpoints exist in load balancer at the moment
@@ -59,13 +79,23 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 		existingServers[s.String()] = s
 	}
 
-	// First, add endpoints, that should be added and are not in lb
+	// First, add endpoints, that should be added and are not in lb,
+	// and update weights of the existing ones in place
 	for _, s := range newServers {
+		weight := newWeights[s.String()]
 		if _, exists := existingServers[s.String()]; !exists {
-			if err := rb.UpsertServer(s); err != nil {
+			if err := rb.UpsertServer(s, weight); err != nil {
 				log.Errorf("%v failed to add %v, err: %s", m, s, err)
 			}
+			weights[s.String()] = weight
 			w.upsertServer(s)
+		} else if weights[s.String()] != weight {
+			if err := rb.UpsertServer(s, weight); err != nil {
+				log.Errorf("%v failed to update weight of %v, err: %s", m, s, err)
+			} else {
+				log.Infof("%v updated %v weight to %d", m, s, weight)
+			}
+			weights[s.String()] = weight
 		}
 	}
 
@@ -77,13 +107,14 @@ func syncServers(m *mux, rb *roundrobin.Rebalancer, backend *backend, w *RTWatch
 			} else {
 				log.Infof("%v removed %v", m, v)
 			}
+			delete(weights, k)
 			w.removeServer(v)
 		}
 	}
 	return nil
 }
 
-func (f *frontend) updateTransport(t *http.Transport) error {
+func (f *frontend) updateTransport(t backendTransport) error {
 	return f.rebuild()
 }
 
@@ -99,48 +130,103 @@ func (f *frontend) sortedMiddlewares() []engine.Middleware {
 func (f *frontend) rebuild() error {
 	settings := f.frontend.HTTPSettings()
 
-	// set up forwarder
-	fwd, err := forward.New(
-		forward.RoundTripper(f.backend.transport),
-		forward.Rewriter(
-			&forward.HeaderRewriter{
-				Hostname:           settings.Hostname,
-				TrustForwardHeader: settings.TrustForwardHeader,
-			}),
-		forward.PassHostHeader(settings.PassHostHeader),
-		forward.Stream(settings.Stream),
-		forward.StreamingFlushInterval(time.Duration(settings.StreamFlushIntervalNanoSecs)*time.Nanosecond),
-		forward.StateListener(f.mux.outgoingConnTracker))
+	// retrier needs to know why the forwarding has failed
+	errHandler := f.mux.errorPages.errorHandler(defaultErrorHandler)
+	if settings.Retry != nil {
+		errHandler = attemptErrorHandler(errHandler)
+	}
 
-	// rtwatcher will be observing and aggregating metrics
-	watcher, err := NewWatcher(fwd)
-	if err != nil {
-		return err
+	// access log and traces need to know which server the load balancer has picked
+	accessLog := f.mux.accessLog != nil && !settings.DisableAccessLog
+	traced := f.mux.options.Tracer != nil
+	recordServer := accessLog || traced
+
+	// retry budget is shared by the load balancers of the frontend and survives the rebuilds that keep it
+	var budget *retryBudget
+	if settings.Retry != nil && settings.Retry.Budget != nil {
+		bs := *settings.Retry.Budget
+		v, _ := f.mux.shared.limit(retryBudgetKey(f.key.Id),
+			func(v interface{}) bool { return v.(*retryBudget).settings == bs },
+			func() (interface{}, error) { return newRetryBudget(bs, f.mux.options.TimeProvider), nil })
+		budget = v.(*retryBudget)
 	}
 
-	// Create a load balancer
-	rr, err := roundrobin.New(watcher)
+	stable, err := f.newBalancer(f.backend, settings, errHandler, recordServer, budget)
 	if err != nil {
 		return err
 	}
+	lb := stable.handler
+	isHTTP2 := f.backend.isHTTP2()
+
+	// canary backend gets a load balancer of its own, the split picks the load balancer for every request
+	var canary *balancer
+	var split *canarySplit
+	if settings.Canary != nil {
+		cb, ok := f.mux.backends[engine.BackendKey{Id: settings.Canary.BackendId}]
+		if !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("canary backend %v not found", settings.Canary.BackendId)}
+		}
+		if canary, err = f.newBalancer(cb, settings, errHandler, recordServer, budget); err != nil {
+			return err
+		}
+		split = newCanarySplit(stable.handler, canary.handler, *settings.Canary)
+		lb = split
+		isHTTP2 = isHTTP2 || cb.isHTTP2()
+	}
 
-	// Rebalancer will readjust load balancer weights based on error ratios
-	rb, err := roundrobin.NewRebalancer(rr)
-	if err != nil {
-		return err
+	// mirror copies the requests forwarded to the backends, requests served the fallback by the circuit breaker
+	// are not copied
+	var mirrored *balancer
+	if settings.Mirror != nil {
+		mb, ok := f.mux.backends[engine.BackendKey{Id: settings.Mirror.BackendId}]
+		if !ok {
+			return &engine.NotFoundError{Message: fmt.Sprintf("mirror backend %v not found", settings.Mirror.BackendId)}
+		}
+		// copies are sent once, their errors are not served to the clients
+		ms := settings
+		ms.Retry = nil
+		if mirrored, err = f.newBalancer(mb, ms, defaultErrorHandler, false, nil); err != nil {
+			return err
+		}
+		lb = newMirror(f, lb, mirrored.handler, *settings.Mirror)
+	}
+
+	// circuit breaker serves the fallback without touching the backend while it is failing
+	if settings.CircuitBreaker != nil {
+		cs, err := settings.CircuitBreaker.Settings()
+		if err != nil {
+			return err
+		}
+		if lb, err = newCircuitBreaker(f, lb, *cs); err != nil {
+			return err
+		}
 	}
 
-	// create middlewares sorted by priority and chain them
+	// create middlewares sorted by priority and chain them, the middleware with the lowest priority is
+	// the outermost one and sees the request first. The middleware answering the request on its own short-circuits
+	// the chain, the load balancer and the forwarder below it never see the request, so neither the consumed
+	// body nor the missing server matter to them
 	middlewares := f.sortedMiddlewares()
 	handlers := make([]http.Handler, len(middlewares))
+	installed := false
+	defer func() {
+		if !installed {
+			closeHandlers(handlers)
+		}
+	}()
 	for i, m := range middlewares {
 		var prev http.Handler
 		if i == 0 {
-			prev = rb
+			prev = lb
 		} else {
 			prev = handlers[i-1]
 		}
-		h, err := m.Middleware.NewHandler(prev)
+		var h http.Handler
+		if sharesLimits(m.Middleware) {
+			h, err = f.mux.shared.sharedMiddleware(f.key.Id, m, prev)
+		} else {
+			h, err = m.Middleware.NewHandler(prev)
+		}
 		if err != nil {
 			return err
 		}
@@ -151,46 +237,304 @@ func (f *frontend) rebuild() error {
 	if len(handlers) != 0 {
 		next = handlers[len(handlers)-1]
 	} else {
-		next = rb
+		next = lb
+	}
+	// response caches report their lookups with the frontend id, the responses picked by the canary split
+	// are not cached
+	if cached(middlewares) {
+		next = newCacheObserver(f, next, split != nil)
+	}
+	// middlewares deciding by their fail mode report the degraded decisions with the frontend id
+	if degradable(middlewares) {
+		next = newDegradedObserver(f, next)
 	}
 
 	// stream will retry and replay requests, fix encodings
+	retryPolicy := settings.Retry != nil && settings.FailoverPredicate == ""
 	if settings.FailoverPredicate == "" {
 		settings.FailoverPredicate = `IsNetworkError() && RequestMethod() == "GET" && Attempts() < 2`
 	}
 
 	var str http.Handler
 
-	if settings.Stream {
+	// buffering would hold streaming RPCs, HTTP/2 backends are always streamed
+	if settings.Stream || isHTTP2 {
 		str, err = stream.New(next)
 	} else {
-		str, err = buffer.New(next,
-			buffer.Retry(settings.FailoverPredicate),
-			buffer.MaxRequestBodyBytes(settings.Limits.MaxBodyBytes),
-			buffer.MemRequestBodyBytes(settings.Limits.MaxMemBodyBytes))
+		mem, max := f.bufferLimits(settings)
+		if retryPolicy {
+			// retry policy replaces the default failover
+			str, err = buffer.New(&spillCheck{next: next},
+				buffer.MaxRequestBodyBytes(max),
+				buffer.MemRequestBodyBytes(mem),
+				buffer.MemResponseBodyBytes(mem))
+		} else {
+			str, err = buffer.New(&spillCheck{next: next},
+				buffer.Retry(settings.FailoverPredicate),
+				buffer.MaxRequestBodyBytes(max),
+				buffer.MemRequestBodyBytes(mem),
+				buffer.MemResponseBodyBytes(mem))
+		}
+		if err == nil {
+			str = &spillGuard{next: str, max: max}
+		}
 	}
 
 	if err != nil {
 		return err
 	}
+	// the failover replays the requests through the mirror, the mirror copies the first attempt only
+	if mirrored != nil {
+		str = mirrorOnce(str)
+	}
+
+	// bulkhead goes behind the rate limiter, so the requests over the rate do not take the slots
+	var bh *bulkhead
+	if settings.MaxInFlight > 0 {
+		limit, wait := settings.MaxInFlight, settings.MaxInFlightWaitDuration()
+		v, _ := f.mux.shared.limit(bulkheadKey(f.key.Id),
+			func(v interface{}) bool { return v.(*bulkhead).limit == limit && v.(*bulkhead).wait == wait },
+			func() (interface{}, error) { return newBulkhead(f, limit, wait), nil })
+		bh = v.(*bulkhead)
+		str = bh.wrap(str)
+		next = bh.wrap(next)
+	}
+
+	// rate limiter rejects requests over the limit before they are buffered
+	var limiter *rateLimiter
+	if settings.RateLimit != nil {
+		rl := settings.RateLimit
+		v, err := f.mux.shared.limit(rateLimiterKey(f.key.Id),
+			func(v interface{}) bool { return v.(*rateLimiter).settings.Equals(rl) },
+			func() (interface{}, error) { return newRateLimiter(f, *rl) })
+		if err != nil {
+			return err
+		}
+		limiter = v.(*rateLimiter)
+		str = limiter.wrap(str)
+		next = limiter.wrap(next)
+	}
+
+	// body limit goes in front of the buffer, so the oversized body is never buffered
+	if settings.MaxRequestBodyBytes > 0 {
+		str = newBodyLimit(f, settings.MaxRequestBodyBytes, str)
+	}
+
+	// methods and content types the frontend does not take are rejected before the body is read
+	if len(settings.AllowedMethods) != 0 || len(settings.AllowedContentTypes) != 0 {
+		str = newRequestConstraints(f, settings, str)
+		next = newRequestConstraints(f, settings, next)
+	}
+
+	// frontend in maintenance answers without forwarding, the load balancers are still synced with the backend,
+	// so the traffic goes back to the servers as soon as the maintenance is turned off
+	if settings.Maintenance {
+		str = newMaintenance(f, settings)
+	}
 
-	if err := syncServers(f.mux, rb, f.backend, watcher); err != nil {
+	observe := func(h http.Handler) http.Handler {
+		h = newRequestObserver(f, h)
+		if accessLog {
+			h = newAccessLogger(f, h)
+		}
+		if traced {
+			h = newRequestTracer(f, h)
+		}
+		return h
+	}
+	str = observe(str)
+	// upgraded connections, e.g. WebSockets, skip the buffering and stream right to the forwarder
+	if !isHTTP2 && !settings.Maintenance {
+		str = &upgradeSwitch{upgrade: observe(next), next: str}
+	}
+	// request id goes on top of the access log and the trace, so both of them record it
+	if settings.RequestID != nil {
+		if str, err = newRequestIDAssigner(str, *settings.RequestID); err != nil {
+			return err
+		}
+	}
+	// security headers of the host go on every response of the frontend, including the ones of the proxy itself
+	if !settings.DisableSecurityHeaders {
+		str = f.mux.securityHeaders.wrap(str)
+	}
+
+	if err := stable.syncServers(f.mux); err != nil {
 		return err
 	}
+	if canary != nil {
+		if err := canary.syncServers(f.mux); err != nil {
+			return err
+		}
+	}
+	if mirrored != nil {
+		if err := mirrored.syncServers(f.mux); err != nil {
+			return err
+		}
+	}
 
 	// Add the frontend to the router
 	if err := f.mux.router.Handle(f.frontend.Route, str); err != nil {
 		return err
 	}
 
-	f.lb = rb
+	closeHandlers(f.handlers)
+	f.handlers, installed = handlers, true
+	f.lb = stable.lb
 	f.handler = str
-	f.watcher = watcher
+	f.watcher = stable.watcher
+	f.weights = stable.weights
+	f.bulkhead = bh
+	f.retryBudget = budget
+	f.rateLimiter = limiter
+	f.setBalancers(canary, split, mirrored)
 	return nil
 }
 
+// bufferLimits returns the memory and the total limits of the buffered bodies, the frontend limits override
+// the proxy ones. Bodies over the memory limit spill to temporary files, which are removed once the request
+// is done. The response bodies are limited by the memory limit only.
+func (f *frontend) bufferLimits(settings engine.HTTPFrontendSettings) (int64, int64) {
+	mem, max := settings.Limits.MaxMemBodyBytes, settings.Limits.MaxBodyBytes
+	if mem == 0 {
+		mem = f.mux.options.MaxMemBodyBytes
+	}
+	if mem == 0 {
+		mem = buffer.DefaultMemBodyBytes
+	}
+	if max == 0 {
+		max = f.mux.options.MaxBodyBytes
+	}
+	return mem, max
+}
+
+// newBalancer creates the load balancer forwarding the requests to the servers of the backend
+func (f *frontend) newBalancer(b *backend, settings engine.HTTPFrontendSettings, errHandler utils.ErrorHandler, recordServer bool, budget *retryBudget) (*balancer, error) {
+	// forward timeout replaces the read timeout of the backend
+	rt := b.roundTripper()
+	timeout := settings.ForwardTimeoutDuration()
+	if timeout > 0 {
+		rt = b.timeoutRoundTripper()
+		errHandler = timeoutErrorHandler(errHandler)
+	}
+
+	// set up forwarder, HTTP/2 backends get the forwarder passing trailers and streams
+	var fwd http.Handler
+	var err error
+	if b.isHTTP2() {
+		fwd = newH2CForwarder(h2cForwarderOptions{
+			roundTripper:       rt,
+			hostname:           settings.Hostname,
+			trustForwardHeader: settings.TrustForwardHeader,
+			passHostHeader:     settings.PassHostHeader,
+			stateListener:      f.mux.outgoingConnTracker,
+			errHandler:         errHandler,
+		})
+		if timeout > 0 {
+			fwd = &forwardTimeout{next: fwd, timeout: timeout}
+		}
+	} else {
+		fwd, err = forward.New(
+			forward.RoundTripper(rt),
+			forward.Rewriter(&forwardedForRewriter{hostname: settings.Hostname, trust: settings.TrustForwardHeader}),
+			forward.PassHostHeader(settings.PassHostHeader),
+			forward.Stream(settings.Stream),
+			forward.StreamingFlushInterval(time.Duration(settings.StreamFlushIntervalNanoSecs)*time.Nanosecond),
+			forward.StateListener(f.mux.outgoingConnTracker),
+			forward.ErrorHandler(errHandler))
+		if err != nil {
+			return nil, err
+		}
+		// upgraded connections are limited by the upgrade idle timeout instead
+		if timeout > 0 {
+			fwd = &forwardTimeout{next: fwd, timeout: timeout}
+		}
+		fwd = newUpgradeForwarder(fwd, upgradeForwarderOptions{
+			roundTripper:       b.roundTripper(),
+			hostname:           settings.Hostname,
+			trustForwardHeader: settings.TrustForwardHeader,
+			passHostHeader:     settings.PassHostHeader,
+			idleTimeout:        settings.UpgradeIdleTimeoutDuration(),
+			stateListener:      f.mux.outgoingConnTracker,
+			errHandler:         errHandler,
+		})
+	}
+	fwd = &forwardedHeaders{next: fwd, trust: settings.TrustForwardHeader}
+	fwd = newRouteHeader(fwd, f.key.Id, b.backend.Id, settings.RouteHeader, f.mux.options.RouteHeader)
+
+	// latency of the backend is observed per attempt, so the retries are counted separately
+	fwd = &latencyObserver{next: fwd, backend: b.backend.Id, tracker: f.mux.latency, clock: f.mux.options.TimeProvider}
+	// requests in flight keep the deleted servers draining
+	fwd = &inflightObserver{next: fwd, drain: b.drain}
+
+	// rtwatcher will be observing and aggregating metrics
+	watcher, err := NewWatcher(fwd)
+	if err != nil {
+		return nil, err
+	}
+
+	var lbNext http.Handler = watcher
+	if recordServer {
+		lbNext = &serverRecorder{next: watcher}
+	}
+
+	// sticky sessions need to know which server the load balancer has picked for the client
+	sticky := b.sticky
+	rrNext := lbNext
+	if sticky != nil {
+		rrNext = &stickyRecorder{next: lbNext}
+	}
+
+	// Create a load balancer of the backend algorithm
+	rb, err := newLoadBalancer(b.settings.LoadBalancer, rrNext)
+	if err != nil {
+		return nil, err
+	}
+
+	// sticky session sends clients with the affinity cookie right to their server
+	var lb http.Handler = rb
+	if sticky != nil {
+		lb = &stickySession{settings: *sticky, lb: rb, forward: lbNext}
+	}
+
+	// retrier will replay failed requests against the next server of the same backend
+	if settings.Retry != nil {
+		lb = newRetrier(f, lb, *settings.Retry, budget)
+	}
+
+	return &balancer{
+		backend: b,
+		handler: lb,
+		lb:      rb,
+		watcher: watcher,
+		weights: make(map[string]int),
+	}, nil
+}
+
+// setBalancers replaces the canary and mirror load balancers and links the frontend to their backends, so the
+// frontend follows the changes of their servers
+func (f *frontend) setBalancers(canary *balancer, split *canarySplit, mirrored *balancer) {
+	old := []*balancer{f.canary, f.mirror}
+	f.canary, f.split, f.mirror = canary, split, mirrored
+	for _, b := range old {
+		if b != nil && !f.usesBackend(b.backend) {
+			b.backend.unlinkFrontend(f.key)
+		}
+	}
+	for _, b := range []*balancer{canary, mirrored} {
+		if b != nil {
+			b.backend.linkFrontend(f.key, f)
+		}
+	}
+}
+
+// usesBackend returns true if the frontend forwards or copies the requests to the backend
+func (f *frontend) usesBackend(b *backend) bool {
+	return f.backend == b || (f.canary != nil && f.canary.backend == b) || (f.mirror != nil && f.mirror.backend == b)
+}
+
 func (f *frontend) upsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) error {
-	f.middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: mi.Id}] = mi
+	mk := engine.MiddlewareKey{FrontendKey: fk, Id: mi.Id}
+	f.middlewares[mk] = mi
 	return f.rebuild()
 }
 
@@ -199,6 +543,20 @@ func (f *frontend) deleteMiddleware(mk engine.MiddlewareKey) error {
 	return f.rebuild()
 }
 
+// closeHandlers stops the background work of the middleware handlers, e.g. the key refresh of the JWT
+// middleware, the work shared by the handlers of the same middleware stops with the last of them
+func closeHandlers(handlers []http.Handler) {
+	for _, h := range handlers {
+		c, ok := h.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil {
+			log.Errorf("failed to close middleware handler: %v", err)
+		}
+	}
+}
+
 func (f *frontend) updateBackend(b *backend) error {
 	oldb := f.backend
 	f.backend = b
@@ -206,11 +564,31 @@ func (f *frontend) updateBackend(b *backend) error {
 	// Switching backends, set the new transport and perform switch
 	if b.backend.Id != oldb.backend.Id {
 		log.Infof("%v updating backend from %v to %v", f, &oldb, &f.backend)
-		oldb.unlinkFrontend(f.key)
+		if !f.usesBackend(oldb) {
+			oldb.unlinkFrontend(f.key)
+		}
 		b.linkFrontend(f.key, f)
 		return f.rebuild()
 	}
-	return syncServers(f.mux, f.lb, f.backend, f.watcher)
+	return syncServers(f.mux, f.lb, f.backend, f.watcher, f.weights)
+}
+
+// syncBackend updates the load balancers of the backend, frontend, canary or mirror ones, with the current
+// servers of the backend
+func (f *frontend) syncBackend(b *backend) error {
+	shadow := f.mirror != nil && f.mirror.backend == b
+	if shadow {
+		if err := f.mirror.syncServers(f.mux); err != nil {
+			return err
+		}
+	}
+	if f.canary != nil && f.canary.backend == b {
+		return f.canary.syncServers(f.mux)
+	}
+	if shadow {
+		return nil
+	}
+	return f.updateBackend(b)
 }
 
 // TODO: implement rollback in case of suboperation failure
@@ -235,6 +613,12 @@ func (f *frontend) update(ef engine.Frontend, b *backend) error {
 	olds := oldf.HTTPSettings()
 	news := ef.HTTPSettings()
 	if !olds.Equals(news) {
+		// the traffic split is adjusted in place, so the load balancers and their stats survive
+		if f.split != nil && canarySplitChanged(olds, news) {
+			log.Infof("%v updating canary split to %v%%", f, news.Canary.Percent)
+			f.split.update(*news.Canary)
+			return nil
+		}
 		if err := f.rebuild(); err != nil {
 			return err
 		}
@@ -245,7 +629,13 @@ func (f *frontend) update(ef engine.Frontend, b *backend) error {
 
 func (f *frontend) remove() error {
 	f.backend.unlinkFrontend(f.key)
-	return f.mux.router.Remove(f.frontend.Route)
+	f.setBalancers(nil, nil, nil)
+	if err := f.mux.router.Remove(f.frontend.Route); err != nil {
+		return err
+	}
+	closeHandlers(f.handlers)
+	f.handlers = nil
+	return nil
 }
 
 type middlewareSorter struct {
@@ -260,6 +650,10 @@ func (s *middlewareSorter) Swap(i, j int) {
 	s.ms[i], s.ms[j] = s.ms[j], s.ms[i]
 }
 
+// Less orders middlewares by priority, ties are broken by id so the chain is the same on every rebuild
 func (s *middlewareSorter) Less(i, j int) bool {
-	return s.ms[i].Priority < s.ms[j].Priority
+	if s.ms[i].Priority != s.ms[j].Priority {
+		return s.ms[i].Priority < s.ms[j].Priority
+	}
+	return s.ms[i].Id < s.ms[j].Id
 }
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"golang.org/x/net/http2"
+)
+
+// backendTransport sends requests to the backend servers over HTTP/1.1 or HTTP/2
+type backendTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// newH2CTransport returns HTTP/2 transport talking to the servers with prior knowledge over cleartext connections.
+// MaxConnsPerHost is not applied, the requests to the server share its connection.
+func newH2CTransport(s *engine.TransportSettings) backendTransport {
+	dialer := &net.Dialer{
+		Timeout:   s.Timeouts.Dial,
+		KeepAlive: s.KeepAlive.Period,
+	}
+	t := &http2.Transport{
+		AllowHTTP: true,
+		// the transport dials TLS for HTTP/2 connections, dial plain TCP instead
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, addr)
+		},
+	}
+	return &headerTimeoutTransport{t: t, timeout: s.Timeouts.ResponseHeader}
+}
+
+// headerTimeoutTransport limits the time waiting for the response headers only, so long-lived streams,
+// e.g. streaming RPCs, are not cut off once the server has responded
+type headerTimeoutTransport struct {
+	t       *http2.Transport
+	timeout time.Duration
+}
+
+func (h *headerTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if h.timeout <= 0 {
+		return h.t.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(h.timeout, cancel)
+	re, err := h.t.RoundTrip(req.WithContext(ctx))
+	timedOut := !timer.Stop()
+	if err != nil {
+		cancel()
+		if timedOut {
+			return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout awaiting response headers")}
+		}
+		return nil, err
+	}
+	if timedOut {
+		re.Body.Close()
+		cancel()
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("timeout awaiting response headers")}
+	}
+	re.Body = &cancelBody{ReadCloser: re.Body, cancel: cancel}
+	return re, nil
+}
+
+func (h *headerTimeoutTransport) CloseIdleConnections() {
+	h.t.CloseIdleConnections()
+}
+
+// cancelBody releases the request context once the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+type h2cForwarderOptions struct {
+	roundTripper       http.RoundTripper
+	hostname           string
+	trustForwardHeader bool
+	passHostHeader     bool
+	stateListener      forward.UrlForwardingStateListener
+	errHandler         utils.ErrorHandler
+}
+
+// h2cForwarder forwards requests to HTTP/2 servers. Unlike the oxy forwarder it passes trailers
+// and flushes streamed response bodies right away, as gRPC needs both.
+type h2cForwarder struct {
+	o     h2cForwarderOptions
+	proxy *httputil.ReverseProxy
+}
+
+func newH2CForwarder(o h2cForwarderOptions) *h2cForwarder {
+	f := &h2cForwarder{o: o}
+	f.proxy = &httputil.ReverseProxy{
+		Director:      f.director,
+		Transport:     o.roundTripper,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Errorf("Error forwarding to %v, err: %v", req.URL, err)
+			f.o.errHandler.ServeHTTP(w, req, err)
+		},
+	}
+	return f
+}
+
+func (f *h2cForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if f.o.stateListener != nil {
+		f.o.stateListener(req.URL, forward.StateConnected)
+		defer f.o.stateListener(req.URL, forward.StateDisconnected)
+	}
+	f.proxy.ServeHTTP(w, req)
+}
+
+// director points the request to the server picked by the load balancer, which has set the request URL
+func (f *h2cForwarder) director(req *http.Request) {
+	target := req.URL
+	req.URL = serverURL(req)
+	if !f.o.passHostHeader {
+		req.Host = target.Host
+	}
+
+	prior := req.Header[forward.XForwardedFor]
+	(&forwardedForRewriter{hostname: f.o.hostname, trust: f.o.trustForwardHeader}).Rewrite(req)
+	// reverse proxy appends the client address to X-Forwarded-For on its own
+	if f.o.trustForwardHeader && prior != nil {
+		req.Header[forward.XForwardedFor] = prior
+	} else {
+		req.Header.Del(forward.XForwardedFor)
+	}
+}
+
+// serverURL combines the server URL set by the load balancer with the original request path and query
+func serverURL(req *http.Request) *url.URL {
+	u := &url.URL{Scheme: req.URL.Scheme, Host: req.URL.Host}
+	if in, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		u.Path, u.RawPath, u.RawQuery = in.Path, in.RawPath, in.RawQuery
+	}
+	return u
+}
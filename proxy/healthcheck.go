@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// healthChecker periodically probes servers of the backend and takes the failing ones
+// out of the load balancer rotation. Health state is guarded by the mux lock. The checkers of the muxes
+// following the first mux of the workers do not probe the servers, they take the health the first one checks.
+type healthChecker struct {
+	b        *backend
+	settings engine.HealthCheckSettings
+	state    map[string]*serverHealth
+	stopC    chan struct{}
+}
+
+type serverHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+func newHealthChecker(b *backend, s engine.HealthCheckSettings) *healthChecker {
+	return &healthChecker{
+		b:        b,
+		settings: s,
+		state:    make(map[string]*serverHealth),
+		stopC:    make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) String() string {
+	return fmt.Sprintf("%v healthcheck(path=%v, interval=%v)", h.b, h.settings.Path, h.settings.Interval)
+}
+
+func (h *healthChecker) start() {
+	if h.b.mux.followsHealth {
+		return
+	}
+	h.b.mux.wg.Add(1)
+	go h.run()
+}
+
+// stop signals the checker goroutine to exit, it does not wait for it as the caller
+// is holding the mux lock that the checker may be waiting for.
+func (h *healthChecker) stop() {
+	close(h.stopC)
+}
+
+func (h *healthChecker) run() {
+	defer h.b.mux.wg.Done()
+
+	ticker := time.NewTicker(h.settings.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopC:
+			return
+		case <-h.b.mux.stopC:
+			return
+		case <-ticker.C:
+			h.checkServers()
+		}
+	}
+}
+
+func (h *healthChecker) checkServers() {
+	h.b.mux.mtx.RLock()
+	servers := make([]engine.Server, len(h.b.servers))
+	copy(servers, h.b.servers)
+	client := &http.Client{Transport: h.b.transport, Timeout: h.settings.Timeout}
+	// the backend is replaced on its updates, the id is taken under the lock
+	backendId := h.b.backend.Id
+	h.b.mux.mtx.RUnlock()
+
+	results := make([]error, len(servers))
+	wg := &sync.WaitGroup{}
+	for i := range servers {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = h.probe(client, servers[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if health, ok := h.update(servers, results); ok {
+		h.b.mux.shared.publishHealth(backendId, health)
+	}
+}
+
+// update records the results of the probes and returns the copy of the health state passed to the followers,
+// false if the checker has been stopped
+func (h *healthChecker) update(servers []engine.Server, results []error) (map[string]serverHealth, bool) {
+	h.b.mux.mtx.Lock()
+	defer h.b.mux.mtx.Unlock()
+
+	// The checker could have been stopped while we were probing the servers
+	select {
+	case <-h.stopC:
+		return nil, false
+	default:
+	}
+
+	now := h.b.mux.options.TimeProvider.UtcNow()
+	changed := false
+	ids := make(map[string]bool, len(servers))
+	for i, s := range servers {
+		ids[s.Id] = true
+		if h.record(s, results[i], now) {
+			changed = true
+			if h.isHealthy(s.Id) {
+				// the recovered server could still be cold
+				h.b.beginSlowStart(s.Id)
+			}
+		}
+	}
+	for id := range h.state {
+		if !ids[id] {
+			delete(h.state, id)
+		}
+	}
+	if changed {
+		if err := h.b.updateFrontends(); err != nil {
+			log.Errorf("%v failed to update frontends: %v", h, err)
+		}
+	}
+	health := make(map[string]serverHealth, len(h.state))
+	for id, st := range h.state {
+		health[id] = *st
+	}
+	return health, true
+}
+
+// follow replaces the health state with the one checked by the first mux of the workers
+func (h *healthChecker) follow(health map[string]serverHealth) {
+	changed := false
+	for id, st := range h.state {
+		if _, ok := health[id]; !ok {
+			changed = changed || !st.healthy
+			delete(h.state, id)
+		}
+	}
+	for id, st := range health {
+		st := st
+		if h.isHealthy(id) != st.healthy {
+			changed = true
+			if st.healthy {
+				h.b.beginSlowStart(id)
+			}
+		}
+		h.state[id] = &st
+	}
+	if changed {
+		if err := h.b.updateFrontends(); err != nil {
+			log.Errorf("%v failed to update frontends: %v", h, err)
+		}
+	}
+}
+
+func (h *healthChecker) probe(client *http.Client, s engine.Server) error {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = h.settings.Path
+	u.RawQuery = ""
+
+	re, err := client.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer re.Body.Close()
+	if !h.settings.IsExpectedCode(re.StatusCode) {
+		return fmt.Errorf("unexpected status code: %d", re.StatusCode)
+	}
+	if !h.settings.ChecksBody() {
+		return nil
+	}
+	// the body is read up to the limit, so the server can not make the checker buffer a large response
+	body, err := ioutil.ReadAll(io.LimitReader(re.Body, engine.MaxHealthCheckBodyBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > engine.MaxHealthCheckBodyBytes {
+		return fmt.Errorf("response body exceeds %d bytes", engine.MaxHealthCheckBodyBytes)
+	}
+	return h.settings.CheckBody(body)
+}
+
+// record updates server health state with the check result and returns true if the server
+// changed its state
+func (h *healthChecker) record(s engine.Server, err error, now time.Time) bool {
+	st, ok := h.state[s.Id]
+	if !ok {
+		st = &serverHealth{healthy: true}
+		h.state[s.Id] = st
+	}
+	st.lastCheck = now
+	if err == nil {
+		st.failures = 0
+		st.successes++
+		st.lastError = ""
+		if !st.healthy && st.successes >= h.settings.HealthyThreshold {
+			log.Infof("%v %v is healthy again", h, &s)
+			st.healthy = true
+			return true
+		}
+		return false
+	}
+	st.successes = 0
+	st.failures++
+	st.lastError = err.Error()
+	if st.healthy && st.failures >= h.settings.UnhealthyThreshold {
+		log.Warningf("%v %v is unhealthy: %v", h, &s, err)
+		st.healthy = false
+		return true
+	}
+	return false
+}
+
+func (h *healthChecker) isHealthy(id string) bool {
+	st, ok := h.state[id]
+	return !ok || st.healthy
+}
+
+func (h *healthChecker) serverHealth(s engine.Server) engine.ServerHealth {
+	out := engine.ServerHealth{Id: s.Id, URL: s.URL, Healthy: true}
+	if st, ok := h.state[s.Id]; ok {
+		out.Healthy = st.healthy
+		out.LastCheck = st.lastCheck
+		out.LastError = st.lastError
+	}
+	return out
+}
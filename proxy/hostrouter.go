@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/vulcand/route"
+)
+
+// hostRouter routes the requests by the host first. The routes of the exact hosts take precedence over the routes
+// of the wildcard hosts, e.g. Host("*.example.com") covering the first label of the name, the wildcard hosts go
+// before the host regular expressions, e.g. HostRegexp(".*\.example\.com"), and the host regular expressions
+// before the routes not matching the host. The routes of the same precedence are matched by the routing library.
+type hostRouter struct {
+	// tiers are the routers by precedence, the requests the router does not match go to the next one
+	tiers [hostTierCount]*route.Mux
+}
+
+// the precedences of the routes by the host matchers of the route expressions
+const (
+	hostTierExact = iota
+	hostTierWildcard
+	hostTierRegexp
+	hostTierNone
+	hostTierCount
+)
+
+func newHostRouter() *hostRouter {
+	r := &hostRouter{}
+	for i := range r.tiers {
+		r.tiers[i] = route.NewMux()
+	}
+	for i := 0; i < len(r.tiers)-1; i++ {
+		r.tiers[i].SetNotFound(r.tiers[i+1])
+	}
+	return r
+}
+
+func (r *hostRouter) SetNotFound(h http.Handler) error {
+	return r.tiers[hostTierNone].SetNotFound(h)
+}
+
+func (r *hostRouter) GetNotFound() http.Handler {
+	return r.tiers[hostTierNone].GetNotFound()
+}
+
+func (r *hostRouter) IsValid(expr string) bool {
+	return route.IsValid(hostWildcards(expr))
+}
+
+func (r *hostRouter) Handle(expr string, h http.Handler) error {
+	return r.tiers[hostTier(expr)].Handle(hostWildcards(expr), h)
+}
+
+func (r *hostRouter) Remove(expr string) error {
+	return r.tiers[hostTier(expr)].Remove(hostWildcards(expr))
+}
+
+func (r *hostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.tiers[hostTierExact].ServeHTTP(w, req)
+}
+
+// hostMatcherRe finds the host matchers and their arguments in the route expressions
+var hostMatcherRe = regexp.MustCompile("\\b(Host|HostRegexp)\\(\\s*(\"[^\"]*\"|`[^`]*`)")
+
+// hostTier returns the precedence of the most specific host matcher of the route expression
+func hostTier(expr string) int {
+	tier := hostTierNone
+	for _, m := range hostMatcherRe.FindAllStringSubmatch(expr, -1) {
+		t := hostTierRegexp
+		if m[1] == "Host" {
+			t = hostTierExact
+			if host := m[2][1 : len(m[2])-1]; strings.HasPrefix(host, "*.") || strings.Contains(host, "<") {
+				t = hostTierWildcard
+			}
+		}
+		if t < tier {
+			tier = t
+		}
+	}
+	return tier
+}
+
+// hostWildcards replaces the wildcard labels of the hosts with the pattern the routing library matches a single
+// label with, e.g. Host("*.example.com") matches "api.example.com" and does not match "example.com" or
+// "v1.api.example.com", the way the wildcard certificates do
+func hostWildcards(expr string) string {
+	return hostMatcherRe.ReplaceAllStringFunc(expr, func(m string) string {
+		if !strings.HasPrefix(m, "Host(") {
+			return m
+		}
+		i := strings.IndexAny(m, "\"`")
+		if !strings.HasPrefix(m[i+1:], "*.") {
+			return m
+		}
+		return m[:i+1] + "<wildcard>" + m[i+2:]
+	})
+}
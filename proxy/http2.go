@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// http2HopHeaders are the connection specific headers HTTP/2 does not allow in the responses, RFC 7540 8.1.2.2
+var http2HopHeaders = []string{"Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// http2Responses removes the hop-by-hop headers the backends send over HTTP/1.1 from the responses to the
+// HTTP/2 requests. The requests to the backends are sent over HTTP/1.1 by the forwarder, so the WebSocket
+// upgrades come over HTTP/1.1 connections only and are passed through as is.
+type http2Responses struct {
+	next http.Handler
+}
+
+func (h *http2Responses) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	h.next.ServeHTTP(&http2Writer{ResponseWriter: w}, r)
+}
+
+// http2Writer removes the hop-by-hop headers right before the response is written
+type http2Writer struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (hw *http2Writer) WriteHeader(code int) {
+	if !hw.wroteHeader {
+		hw.wroteHeader = true
+		removeHopHeaders(hw.ResponseWriter.Header())
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *http2Writer) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Flush passes the streamed responses, e.g. server-sent events, to the client as they are written
+func (hw *http2Writer) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// removeHopHeaders removes the connection specific headers and the headers named by the Connection header.
+// Connection: close is kept, the HTTP/2 server closes the connection gracefully then, e.g. when the listener
+// is drained.
+func removeHopHeaders(h http.Header) {
+	closing := false
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if strings.EqualFold(name, "close") {
+				closing = true
+				continue
+			}
+			if name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	h.Del("Connection")
+	for _, name := range http2HopHeaders {
+		h.Del(name)
+	}
+	if closing {
+		h.Set("Connection", "close")
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/reporter"
+)
+
+// otherMetricLabel replaces the ids over the cap in the metric names, the ids are labeled by idLabel, so
+// the label is never taken by an id
+const otherMetricLabel = "other"
+
+// metricLabels sanitizes the frontend and backend ids used in the metric names and caps the number of distinct
+// ids of each kind, so the ids created in bulk do not explode the amount of metrics. The ids over the cap share
+// the "other" label, the ids of the deleted frontends and backends free their slots.
+type metricLabels struct {
+	max int
+
+	mtx   sync.Mutex
+	kinds map[string]*labelSet
+}
+
+type labelSet struct {
+	ids    map[string]string
+	capped bool
+}
+
+func newMetricLabels(max int) *metricLabels {
+	return &metricLabels{max: max, kinds: make(map[string]*labelSet)}
+}
+
+// label returns the label of the id of the kind, e.g. "frontend"
+func (l *metricLabels) label(kind, id string) string {
+	if l.max <= 0 {
+		return idLabel(id)
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	set, ok := l.kinds[kind]
+	if !ok {
+		set = &labelSet{ids: make(map[string]string)}
+		l.kinds[kind] = set
+	}
+	if label, ok := set.ids[id]; ok {
+		return label
+	}
+	if len(set.ids) >= l.max {
+		if !set.capped {
+			set.capped = true
+			log.Warningf("Metric labels of %vs reached the cap of %d, the metrics of %v %v and the %vs created later are emitted as '%v'",
+				kind, l.max, kind, id, kind, otherMetricLabel)
+		}
+		return otherMetricLabel
+	}
+	label := idLabel(id)
+	set.ids[id] = label
+	return label
+}
+
+// idLabel returns the sanitized id, the ids labeled as the ids over the cap, e.g. "other" or "other_", get one more
+// underscore. The dashes are taken for the underscores the metrics client replaces them with.
+func idLabel(id string) string {
+	label := reporter.MetricLabel(id)
+	if strings.TrimRight(label, "-_") == otherMetricLabel {
+		return label + "_"
+	}
+	return label
+}
+
+// forget frees the slot of the deleted id
+func (l *metricLabels) forget(kind, id string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if set, ok := l.kinds[kind]; ok {
+		delete(set.ids, id)
+		set.capped = false
+	}
+}
+
+func (m *mux) frontendLabel(id string) string {
+	return m.labels.label("frontend", id)
+}
+
+func (m *mux) backendLabel(id string) string {
+	return m.labels.label("backend", id)
+}
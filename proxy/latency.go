@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"math/bits"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// latencySubBuckets is the amount of buckets between the powers of two, so the percentiles
+	// are within 1/8 of the observed latency
+	latencySubBuckets = 4
+	// latencyBuckets cover latencies up to ~8 minutes in microseconds, longer ones go to the last bucket
+	latencyBuckets = 28 * latencySubBuckets
+	// lifetimeBuckets cover the connection lifetimes up to ~1 year in milliseconds
+	lifetimeBuckets = 35 * latencySubBuckets
+	// maxLatencyKeys bounds the amount of frontends and backends tracked, the ones over the limit are not
+	// tracked until the others expire
+	maxLatencyKeys = 1024
+)
+
+// latencyHistogram counts latencies in log-linear buckets, so its size does not depend on the traffic
+type latencyHistogram [latencyBuckets]int64
+
+// lifetimeHistogram counts the connection lifetimes in the same buckets as the latencies, counted in milliseconds
+type lifetimeHistogram [lifetimeBuckets]int64
+
+// latencyWindows are the histograms of the last two windows, the histogram of the window that has passed is reused
+// by the next but one. The buckets are counted with atomics, the lock is taken once per window to reset the histogram.
+type latencyWindows struct {
+	mtx   sync.Mutex
+	slots [2]latencySlot
+}
+
+type latencySlot struct {
+	// window is the index of the window counted by the histogram, starting with 1
+	window int64
+	h      latencyHistogram
+}
+
+// current returns the histogram of the window, the histogram of the older window is reset first
+func (w *latencyWindows) current(window int64) *latencyHistogram {
+	s := &w.slots[window%2]
+	if atomic.LoadInt64(&s.window) == window {
+		return &s.h
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if atomic.LoadInt64(&s.window) != window {
+		for i := range s.h {
+			atomic.StoreInt64(&s.h[i], 0)
+		}
+		atomic.StoreInt64(&s.window, window)
+	}
+	return &s.h
+}
+
+// sum adds the latencies of the window and of the previous one to h and returns their count
+func (w *latencyWindows) sum(window int64, h *latencyHistogram) int64 {
+	var count int64
+	for i := range w.slots {
+		s := &w.slots[i]
+		if sw := atomic.LoadInt64(&s.window); sw != window && sw != window-1 {
+			continue
+		}
+		for j := range s.h {
+			n := atomic.LoadInt64(&s.h[j])
+			h[j] += n
+			count += n
+		}
+	}
+	return count
+}
+
+// latencyMap maps the ids of the frontends or the backends to their *latencyWindows
+type latencyMap struct {
+	windows sync.Map
+	keys    int64
+	// expired is the window the full map was last swept in for the new keys
+	expired int64
+}
+
+// latencyTracker keeps the latency histograms of the frontends and the backends. The windows are counted from the
+// start of the tracker, so the percentiles are computed from the latencies observed within the last one or two
+// windows. The requests of the frontends and the backends do not contend on a shared lock.
+type latencyTracker struct {
+	clock     timetools.TimeProvider
+	window    time.Duration
+	started   time.Time
+	frontends latencyMap
+	backends  latencyMap
+}
+
+func newLatencyTracker(clock timetools.TimeProvider, window time.Duration) *latencyTracker {
+	return &latencyTracker{
+		clock:   clock,
+		window:  window,
+		started: clock.UtcNow(),
+	}
+}
+
+func (t *latencyTracker) observeFrontend(id string, d time.Duration) {
+	t.observe(&t.frontends, id, d)
+}
+
+func (t *latencyTracker) observeBackend(id string, d time.Duration) {
+	t.observe(&t.backends, id, d)
+}
+
+// currentWindow returns the index of the window of the current time
+func (t *latencyTracker) currentWindow() int64 {
+	return int64(t.clock.UtcNow().Sub(t.started)/t.window) + 1
+}
+
+func (t *latencyTracker) observe(m *latencyMap, id string, d time.Duration) {
+	window := t.currentWindow()
+	v, ok := m.windows.Load(id)
+	if !ok {
+		if atomic.LoadInt64(&m.keys) >= maxLatencyKeys {
+			if atomic.SwapInt64(&m.expired, window) != window {
+				t.expire(m, window)
+			}
+			if atomic.LoadInt64(&m.keys) >= maxLatencyKeys {
+				return
+			}
+		}
+		var loaded bool
+		if v, loaded = m.windows.LoadOrStore(id, &latencyWindows{}); !loaded {
+			atomic.AddInt64(&m.keys, 1)
+		}
+	}
+	h := v.(*latencyWindows).current(window)
+	atomic.AddInt64(&h[latencyBucket(d)], 1)
+}
+
+// expire removes the histograms of keys with no latencies in both windows, so deleted frontends do not hold memory
+func (t *latencyTracker) expire(m *latencyMap, window int64) {
+	m.windows.Range(func(k, v interface{}) bool {
+		var h latencyHistogram
+		if v.(*latencyWindows).sum(window, &h) != 0 {
+			return true
+		}
+		// the concurrent expire may have deleted the key already, only the one that has deleted it counts it
+		if _, loaded := m.windows.LoadAndDelete(k); loaded {
+			atomic.AddInt64(&m.keys, -1)
+		}
+		return true
+	})
+}
+
+// stats returns the percentiles of all tracked frontends and backends sorted by id
+func (t *latencyTracker) stats() *engine.LatencyStats {
+	window := t.currentWindow()
+	return &engine.LatencyStats{
+		Window:    t.window,
+		Frontends: t.percentilesOf(&t.frontends, window),
+		Backends:  t.percentilesOf(&t.backends, window),
+	}
+}
+
+func (t *latencyTracker) percentilesOf(m *latencyMap, window int64) []engine.LatencyPercentiles {
+	t.expire(m, window)
+	out := []engine.LatencyPercentiles{}
+	m.windows.Range(func(k, v interface{}) bool {
+		var h latencyHistogram
+		count := v.(*latencyWindows).sum(window, &h)
+		if count == 0 {
+			return true
+		}
+		out = append(out, engine.LatencyPercentiles{
+			Id:    k.(string),
+			Count: count,
+			P50:   h.percentile(count, 0.5),
+			P90:   h.percentile(count, 0.9),
+			P99:   h.percentile(count, 0.99),
+		})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Id < out[j].Id })
+	return out
+}
+
+func (h *latencyHistogram) percentile(count int64, q float64) time.Duration {
+	return time.Duration(bucketValue(percentileBucket(h[:], count, q))) * time.Microsecond
+}
+
+func (h *lifetimeHistogram) percentile(count int64, q float64) time.Duration {
+	return time.Duration(bucketValue(percentileBucket(h[:], count, q))) * time.Millisecond
+}
+
+// percentileBucket returns the index of the bucket having the percentile, -1 if the histogram is empty
+func percentileBucket(h []int64, count int64, q float64) int {
+	rank := int64(q*float64(count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, n := range h {
+		seen += n
+		if seen >= rank {
+			return i
+		}
+	}
+	return -1
+}
+
+// latencyBucket returns the index of the bucket of the latency in microseconds
+func latencyBucket(d time.Duration) int {
+	return bucket(d, time.Microsecond, latencyBuckets)
+}
+
+// lifetimeBucket returns the index of the bucket of the connection lifetime in milliseconds
+func lifetimeBucket(d time.Duration) int {
+	return bucket(d, time.Millisecond, lifetimeBuckets)
+}
+
+// bucket returns the index of the bucket of the duration counted in units, values below 8 units have
+// their own buckets and the larger ones are split in latencySubBuckets between the powers of two
+func bucket(d, unit time.Duration, buckets int) int {
+	v := uint64(d / unit)
+	if d < 0 {
+		v = 0
+	}
+	if v < 2*latencySubBuckets {
+		return int(v)
+	}
+	e := bits.Len64(v) - 1
+	i := (e-1)*latencySubBuckets + int((v>>uint(e-2))&(latencySubBuckets-1))
+	if i >= buckets {
+		return buckets - 1
+	}
+	return i
+}
+
+// bucketValue returns the middle of the bucket in units, 0 for the missing bucket
+func bucketValue(i int) uint64 {
+	if i < 0 {
+		return 0
+	}
+	if i < 2*latencySubBuckets {
+		return uint64(i)
+	}
+	e := uint(i/latencySubBuckets + 1)
+	lower := uint64(latencySubBuckets+i%latencySubBuckets) << (e - 2)
+	width := uint64(1) << (e - 2)
+	return lower + width/2
+}
+
+// latencyObserver records the time the backend takes to respond to the forwarded request
+type latencyObserver struct {
+	next    http.Handler
+	backend string
+	tracker *latencyTracker
+	clock   timetools.TimeProvider
+}
+
+func (o *latencyObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := o.clock.UtcNow()
+	o.next.ServeHTTP(w, req)
+	o.tracker.observeBackend(o.backend, o.clock.UtcNow().Sub(start))
+}
@@ -0,0 +1,464 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+const (
+	// hashReplicas is the amount of points the server of weight 1 has on the hash ring
+	hashReplicas = 64
+	// maxHashReplicas bounds the points of the server, e.g. of the large weights scaled by the slow start
+	maxHashReplicas = 4096
+)
+
+// loadBalancer picks the server for the request among the servers synced from the backend
+type loadBalancer interface {
+	http.Handler
+	Servers() []*url.URL
+	UpsertServer(u *url.URL, weight int) error
+	RemoveServer(u *url.URL) error
+}
+
+// newLoadBalancer returns the load balancer of the algorithm, the picked server is set in the request URL
+// passed to the next handler
+func newLoadBalancer(s *engine.LoadBalancerSettings, next http.Handler) (loadBalancer, error) {
+	algorithm := engine.LBRoundRobin
+	if s != nil {
+		algorithm = s.Algorithm
+	}
+	switch algorithm {
+	case engine.LBRoundRobin:
+		return newRRBalancer(next)
+	case engine.LBLeastConn:
+		return &leastConnBalancer{next: next}, nil
+	case engine.LBRandom:
+		return &randomBalancer{next: next}, nil
+	case engine.LBConsistentHash:
+		return &hashBalancer{next: next, settings: *s}, nil
+	}
+	return nil, fmt.Errorf("unsupported load balancer algorithm '%s'", algorithm)
+}
+
+// rrBalancer is the weighted round robin with the weights adjusted by the error ratios of the servers. The
+// rebalancer keeps the weight the server was added with, so the weight change replaces the rebalancer with
+// the one having the servers with their new weights.
+type rrBalancer struct {
+	next http.Handler
+	// rebalancer holds *roundrobin.Rebalancer, it is swapped by the weight changes
+	rebalancer atomic.Value
+	// mtx guards the changes of the servers and weights, the weights the servers are upserted with
+	mtx     sync.Mutex
+	weights map[string]int
+}
+
+func newRRBalancer(next http.Handler) (*rrBalancer, error) {
+	b := &rrBalancer{next: next, weights: make(map[string]int)}
+	rb, err := b.newRebalancer(nil)
+	if err != nil {
+		return nil, err
+	}
+	b.rebalancer.Store(rb)
+	return b, nil
+}
+
+// newRebalancer returns the rebalancer with the servers and their weights
+func (b *rrBalancer) newRebalancer(servers []*url.URL) (*roundrobin.Rebalancer, error) {
+	rr, err := roundrobin.New(b.next)
+	if err != nil {
+		return nil, err
+	}
+	// Rebalancer will readjust load balancer weights based on error ratios
+	rb, err := roundrobin.NewRebalancer(rr)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range servers {
+		if err := rb.UpsertServer(u, roundrobin.Weight(b.weights[u.String()])); err != nil {
+			return nil, err
+		}
+	}
+	return rb, nil
+}
+
+func (b *rrBalancer) current() *roundrobin.Rebalancer {
+	return b.rebalancer.Load().(*roundrobin.Rebalancer)
+}
+
+func (b *rrBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	b.current().ServeHTTP(w, req)
+}
+
+func (b *rrBalancer) Servers() []*url.URL {
+	return b.current().Servers()
+}
+
+func (b *rrBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	previous, exists := b.weights[u.String()]
+	b.weights[u.String()] = weight
+	if !exists {
+		if err := b.current().UpsertServer(u, roundrobin.Weight(weight)); err != nil {
+			delete(b.weights, u.String())
+			return err
+		}
+		return nil
+	}
+	rb, err := b.newRebalancer(b.current().Servers())
+	if err != nil {
+		b.weights[u.String()] = previous
+		return err
+	}
+	b.rebalancer.Store(rb)
+	return nil
+}
+
+func (b *rrBalancer) RemoveServer(u *url.URL) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.weights, u.String())
+	return b.current().RemoveServer(u)
+}
+
+type lbServer struct {
+	url    *url.URL
+	weight int
+	// inflight is the amount of the requests forwarded to the server and not completed yet, it is shared
+	// by the copies of the server updated in the pool
+	inflight *int64
+}
+
+// serverPool holds the servers of the load balancer, the servers are replaced on change, so picking
+// the server copies no state
+type serverPool struct {
+	mtx     sync.RWMutex
+	servers []*lbServer
+}
+
+func (p *serverPool) Servers() []*url.URL {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	out := make([]*url.URL, len(p.servers))
+	for i, s := range p.servers {
+		out[i] = utils.CopyURL(s.url)
+	}
+	return out
+}
+
+func (p *serverPool) upsert(u *url.URL, weight int) {
+	if weight <= 0 {
+		weight = 1
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	servers := make([]*lbServer, 0, len(p.servers)+1)
+	found := false
+	for _, s := range p.servers {
+		if s.url.String() == u.String() {
+			s = &lbServer{url: s.url, weight: weight, inflight: s.inflight}
+			found = true
+		}
+		servers = append(servers, s)
+	}
+	if !found {
+		servers = append(servers, &lbServer{url: utils.CopyURL(u), weight: weight, inflight: new(int64)})
+	}
+	p.servers = servers
+}
+
+func (p *serverPool) remove(u *url.URL) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, s := range p.servers {
+		if s.url.String() == u.String() {
+			servers := make([]*lbServer, 0, len(p.servers)-1)
+			servers = append(servers, p.servers[:i]...)
+			p.servers = append(servers, p.servers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("server %v not found", u)
+}
+
+func (p *serverPool) snapshot() []*lbServer {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.servers
+}
+
+// forwardToServer sends the request to the picked server, or writes the error response if there are no servers
+func forwardToServer(next http.Handler, s *lbServer, w http.ResponseWriter, req *http.Request) {
+	if s == nil {
+		utils.DefaultHandler.ServeHTTP(w, req, fmt.Errorf("no servers in the pool"))
+		return
+	}
+	// make shallow copy of request before changing anything to avoid side effects
+	newReq := *req
+	newReq.URL = utils.CopyURL(s.url)
+	next.ServeHTTP(w, &newReq)
+}
+
+// leastConnBalancer picks the server with the least requests in flight relative to its weight, the servers
+// are scanned from a random one, so the ties are broken randomly and the servers of the idle backend share the load
+type leastConnBalancer struct {
+	serverPool
+	next http.Handler
+}
+
+func (b *leastConnBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.upsert(u, weight)
+	return nil
+}
+
+func (b *leastConnBalancer) RemoveServer(u *url.URL) error {
+	return b.remove(u)
+}
+
+func (b *leastConnBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := b.pick()
+	if s != nil {
+		atomic.AddInt64(s.inflight, 1)
+		defer atomic.AddInt64(s.inflight, -1)
+	}
+	forwardToServer(b.next, s, w, req)
+}
+
+func (b *leastConnBalancer) pick() *lbServer {
+	servers := b.snapshot()
+	if len(servers) == 0 {
+		return nil
+	}
+	var best *lbServer
+	var bestLoad int64
+	start := rand.Intn(len(servers))
+	for i := range servers {
+		s := servers[(start+i)%len(servers)]
+		// compares inflight/weight without the division
+		load := atomic.LoadInt64(s.inflight)
+		if best == nil || load*int64(best.weight) < bestLoad*int64(s.weight) {
+			best, bestLoad = s, load
+		}
+	}
+	return best
+}
+
+// randomBalancer picks the server randomly with the probability proportional to its weight
+type randomBalancer struct {
+	serverPool
+	next http.Handler
+}
+
+func (b *randomBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.upsert(u, weight)
+	return nil
+}
+
+func (b *randomBalancer) RemoveServer(u *url.URL) error {
+	return b.remove(u)
+}
+
+func (b *randomBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	forwardToServer(b.next, b.pick(), w, req)
+}
+
+func (b *randomBalancer) pick() *lbServer {
+	servers := b.snapshot()
+	if len(servers) == 0 {
+		return nil
+	}
+	total := 0
+	for _, s := range servers {
+		total += s.weight
+	}
+	n := rand.Intn(total)
+	for _, s := range servers {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return servers[len(servers)-1]
+}
+
+type ringPoint struct {
+	hash   uint64
+	server *lbServer
+}
+
+// hashBalancer places the servers on the consistent hash ring and sends the request to the server owning
+// the hash of its key. Points of the server do not depend on the other servers, so the membership changes
+// only move the keys of the added or removed server, e.g. the keys of the server failing the health checks
+// go to the next server on the ring until it recovers. With the load factor set the server over its bound
+// passes the request to the next server on the ring, so the hot keys do not overload a single server.
+type hashBalancer struct {
+	serverPool
+	next     http.Handler
+	settings engine.LoadBalancerSettings
+
+	ringMtx sync.RWMutex
+	ring    []ringPoint
+	// dirty is set by the membership changes, the ring is rebuilt by the next pick, so adding the servers
+	// of the backend one by one does not rebuild the ring on every server
+	dirty bool
+}
+
+func (b *hashBalancer) UpsertServer(u *url.URL, weight int) error {
+	b.upsert(u, weight)
+	b.invalidate()
+	return nil
+}
+
+func (b *hashBalancer) RemoveServer(u *url.URL) error {
+	if err := b.remove(u); err != nil {
+		return err
+	}
+	b.invalidate()
+	return nil
+}
+
+// invalidate marks the ring stale after the pool has changed
+func (b *hashBalancer) invalidate() {
+	b.ringMtx.Lock()
+	b.dirty = true
+	b.ringMtx.Unlock()
+}
+
+// currentRing returns the ring of the servers in the pool, rebuilding it if the pool has changed. The
+// flag is cleared before the pool is read, so the change made during the rebuild marks the ring stale again.
+func (b *hashBalancer) currentRing() []ringPoint {
+	b.ringMtx.RLock()
+	ring, dirty := b.ring, b.dirty
+	b.ringMtx.RUnlock()
+	if !dirty {
+		return ring
+	}
+
+	b.ringMtx.Lock()
+	defer b.ringMtx.Unlock()
+	if b.dirty {
+		b.dirty = false
+		b.ring = buildRing(b.snapshot())
+	}
+	return b.ring
+}
+
+func buildRing(servers []*lbServer) []ringPoint {
+	var ring []ringPoint
+	for _, s := range servers {
+		replicas := s.weight * hashReplicas
+		if replicas > maxHashReplicas {
+			replicas = maxHashReplicas
+		}
+		key := s.url.String()
+		for i := 0; i < replicas; i++ {
+			ring = append(ring, ringPoint{hash: hashKey(key + "#" + strconv.Itoa(i)), server: s})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func (b *hashBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := b.pick(b.key(req))
+	if s != nil {
+		atomic.AddInt64(s.inflight, 1)
+		defer atomic.AddInt64(s.inflight, -1)
+	}
+	forwardToServer(b.next, s, w, req)
+}
+
+// key returns the hash key of the request, the client IP is used if the header is not set
+func (b *hashBalancer) key(req *http.Request) string {
+	switch b.settings.HashSource {
+	case engine.HashKeyHeader:
+		if v := req.Header.Get(b.settings.HashHeader); v != "" {
+			return v
+		}
+	case engine.HashKeyPath:
+		return pathPrefix(req.URL.Path, b.settings.HashPathSegments)
+	case engine.HashKeyURL:
+		return req.Host + req.URL.RequestURI()
+	}
+	return plugin.ClientIP(req)
+}
+
+// pathPrefix returns the first segments of the path, the whole path if segments is zero
+func pathPrefix(path string, segments int) string {
+	if segments <= 0 {
+		return path
+	}
+	for i := 1; i < len(path); i++ {
+		if path[i] == '/' {
+			if segments--; segments == 0 {
+				return path[:i]
+			}
+		}
+	}
+	return path
+}
+
+func (b *hashBalancer) pick(key string) *lbServer {
+	ring := b.currentRing()
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	if b.settings.LoadFactor == 0 {
+		return ring[i].server
+	}
+	return b.pickBounded(ring, i)
+}
+
+// pickBounded walks the ring from the point owning the key to the first server under its load bound, the
+// bound of the server is the load factor times its weighted share of the requests in flight, counting the
+// request being picked for. The bounds sum up to more than the requests in flight, so some server is always
+// under its bound.
+func (b *hashBalancer) pickBounded(ring []ringPoint, start int) *lbServer {
+	servers := b.snapshot()
+	var inflight, weights int64
+	for _, s := range servers {
+		inflight += atomic.LoadInt64(s.inflight)
+		weights += int64(s.weight)
+	}
+	factor := b.settings.LoadFactor * float64(inflight+1) / float64(weights)
+	for i := 0; i < len(ring); i++ {
+		s := ring[(start+i)%len(ring)].server
+		if float64(atomic.LoadInt64(s.inflight)+1) <= math.Ceil(factor*float64(s.weight)) {
+			return s
+		}
+	}
+	return ring[start].server
+}
+
+// hashKey is FNV-1a with the 64 bit finalizer of MurmurHash3, so the similar keys spread over the ring
+func hashKey(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/manners"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// staleSocketDialTimeout limits the time the socket file left on the path has to answer, the file nobody answers
+// on is removed
+const staleSocketDialTimeout = time.Second
+
+// listen binds the listener address. The socket file of the unix listener is not removed when the listener is
+// closed, so the reloads and the hot restarts passing the socket to the new server keep the path. The file is
+// removed when the listener is deleted, the stale file left by the process that exited is replaced on start.
+// The TCP address can be bound by several listeners with the port reuse.
+func listen(l engine.Listener, reusePort bool) (net.Listener, error) {
+	if l.Address.Network != engine.UNIX {
+		if reusePort {
+			lc := net.ListenConfig{Control: reusePortControl}
+			return lc.Listen(context.Background(), l.Address.Network, l.Address.Address)
+		}
+		return net.Listen(l.Address.Network, l.Address.Address)
+	}
+	path := l.Address.Address
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(engine.UNIX, path)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := chmodSocket(l); err != nil {
+		listener.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file no one is listening on, the path served by another process
+// is reported as the address in use
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%v exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout(engine.UNIX, path, staleSocketDialTimeout); err == nil {
+		conn.Close()
+		return &net.OpError{Op: "listen", Net: engine.UNIX, Addr: &net.UnixAddr{Name: path, Net: engine.UNIX}, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+	log.Infof("Removing stale socket file %v", path)
+	return os.Remove(path)
+}
+
+// chmodSocket applies the permissions of the listener to its socket file
+func chmodSocket(l engine.Listener) error {
+	mode := l.SocketFileMode()
+	if l.Address.Network != engine.UNIX || mode == 0 {
+		return nil
+	}
+	if err := os.Chmod(l.Address.Address, mode); err != nil {
+		return fmt.Errorf("failed to set permissions of %v: %v", l.Address.Address, err)
+	}
+	return nil
+}
+
+// removeSocket removes the socket file of the deleted unix listener
+func removeSocket(l engine.Listener) {
+	if l.Address.Network != engine.UNIX {
+		return
+	}
+	if err := os.Remove(l.Address.Address); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Failed to remove socket file %v: %v", l.Address.Address, err)
+	}
+}
+
+// keepAlive sets the keep-alive on the accepted TCP connections, the unix listeners are returned as is
+func keepAlive(listener net.Listener) (net.Listener, error) {
+	switch l := listener.(type) {
+	case *net.TCPListener:
+		return &manners.TCPKeepAliveListener{TCPListener: l}, nil
+	case *net.UnixListener:
+		l.SetUnlinkOnClose(false)
+		return l, nil
+	}
+	return nil, fmt.Errorf("expected a TCP or unix listener, got %T", listener)
+}
+
+// socketFile returns the copy of the file of the socket returned by keepAlive
+func socketFile(listener net.Listener) (*os.File, error) {
+	switch l := listener.(type) {
+	case *manners.TCPKeepAliveListener:
+		return l.TCPListener.File()
+	case *net.UnixListener:
+		return l.File()
+	}
+	return nil, fmt.Errorf("expected a TCP or unix listener, got %T", listener)
+}
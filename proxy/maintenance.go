@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/reporter"
+)
+
+// maintenance serves 503 to the requests of the frontend in maintenance instead of forwarding them, the custom
+// body takes precedence over the 503 error page of the host
+type maintenance struct {
+	frontend    string
+	reporter    reporter.Reporter
+	pages       *errorPages
+	body        []byte
+	contentType string
+}
+
+func newMaintenance(f *frontend, s engine.HTTPFrontendSettings) *maintenance {
+	m := &maintenance{
+		frontend: f.key.Id,
+		reporter: f.mux.options.Reporter,
+		pages:    f.mux.errorPages,
+	}
+	if s.MaintenanceBody != "" {
+		m.body = []byte(s.MaintenanceBody)
+		m.contentType = s.MaintenanceContentType
+		if m.contentType == "" {
+			m.contentType = http.DetectContentType(m.body)
+		}
+	}
+	return m
+}
+
+func (m *maintenance) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.reporter.ObserveMaintenanceRequest(m.frontend)
+	if m.body == nil && m.pages.serve(w, req, http.StatusServiceUnavailable) {
+		return
+	}
+	body, contentType := m.body, m.contentType
+	if body == nil {
+		body, contentType = []byte(http.StatusText(http.StatusServiceUnavailable)), "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(body)
+}
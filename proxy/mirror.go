@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/metrics"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// mirrorMaxInFlight bounds the copies sent to the shadow backend at once, the copies over the limit are
+	// dropped, so the slow shadow backend does not hold the memory of the proxy
+	mirrorMaxInFlight = 256
+	// mirrorTimeout limits the time the shadow backend has to respond to the copy
+	mirrorTimeout = 30 * time.Second
+)
+
+// mirror forwards the request to the frontend backend and sends the copy of the sampled request to the shadow
+// backend in the background. The copy does not delay the response and its failures are only counted.
+type mirror struct {
+	next     http.Handler
+	shadow   http.Handler
+	settings engine.HTTPFrontendMirror
+	frontend string
+	slots    chan struct{}
+
+	client  metrics.Client
+	sent    metrics.Metric
+	failed  metrics.Metric
+	dropped metrics.Metric
+}
+
+func newMirror(f *frontend, next, shadow http.Handler, s engine.HTTPFrontendMirror) *mirror {
+	c := f.mux.options.MetricsClient
+	m := c.Metric("frontend", f.mux.frontendLabel(f.key.Id), "mirror")
+	return &mirror{
+		next:     next,
+		shadow:   shadow,
+		settings: s,
+		frontend: f.key.Id,
+		slots:    make(chan struct{}, mirrorMaxInFlight),
+		client:   c,
+		sent:     m.Metric("sent"),
+		failed:   m.Metric("failed"),
+		dropped:  m.Metric("dropped"),
+	}
+}
+
+// mirroredKey holds the flag of the client request set once the mirror has seen one of its attempts
+type mirroredKey struct{}
+
+// mirrorOnce marks the client request before it is replayed by the failover, so the mirror samples and copies
+// the client request once and not every attempt of it
+func mirrorOnce(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), mirroredKey{}, new(int32))))
+	})
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if seen, ok := req.Context().Value(mirroredKey{}).(*int32); ok && !atomic.CompareAndSwapInt32(seen, 0, 1) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	if m.settings.Percent <= 0 || rand.Float64()*100 >= m.settings.Percent || isUpgrade(req) {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	body, ok, err := m.readBody(req)
+	if err != nil {
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if !ok {
+		m.next.ServeHTTP(w, req)
+		return
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	select {
+	case m.slots <- struct{}{}:
+		go m.send(m.copyRequest(req, body))
+	default:
+		m.client.Inc(m.dropped, 1, 1)
+	}
+	m.next.ServeHTTP(w, req)
+}
+
+// readBody reads the body to be sent twice, returns false if the body is too large to be copied
+func (m *mirror) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	limit := m.settings.BodyLimit()
+	if req.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	// Body of unknown size turned out to be too large, pass it without the copy
+	if int64(len(body)) > limit {
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// copyRequest returns the copy of the request detached from the client connection, so the copy outlives
+// the client request
+func (m *mirror) copyRequest(req *http.Request, body []byte) *http.Request {
+	out := req.Clone(context.Background())
+	if body != nil {
+		out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	} else {
+		out.Body = http.NoBody
+	}
+	return out
+}
+
+func (m *mirror) send(req *http.Request) {
+	defer func() { <-m.slots }()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("frontend %v mirror of %v %v panicked: %v", m.frontend, req.Method, req.URL, r)
+			m.client.Inc(m.failed, 1, 1)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(req.Context(), mirrorTimeout)
+	defer cancel()
+
+	w := &discardWriter{header: make(http.Header)}
+	m.shadow.ServeHTTP(w, req.WithContext(ctx))
+	m.client.Inc(m.sent, 1, 1)
+	if w.code >= http.StatusInternalServerError {
+		log.Debugf("frontend %v mirror of %v %v failed with %d", m.frontend, req.Method, req.URL, w.code)
+		m.client.Inc(m.failed, 1, 1)
+	}
+}
+
+// discardWriter records the status code of the shadow response and discards the rest of it
+type discardWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,11 +13,12 @@ import (
 	"github.com/mailgun/timetools"
 	"github.com/pkg/errors"
 	"github.com/vulcand/oxy/forward"
-	"github.com/vulcand/route"
 	"github.com/vulcand/vulcand/conntracker"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/reporter"
 	"github.com/vulcand/vulcand/router"
 	"github.com/vulcand/vulcand/stapler"
+	"github.com/vulcand/vulcand/utils/dnssrv"
 )
 
 // mux is capable of listening on multiple interfaces, graceful shutdowns and updating TLS certificates
@@ -30,6 +32,8 @@ type mux struct {
 	backends map[engine.BackendKey]*backend
 
 	frontends map[engine.FrontendKey]*frontend
+	// tcpFrontends take the connections of the TCP listeners
+	tcpFrontends map[engine.FrontendKey]*tcpFrontend
 
 	hosts map[engine.HostKey]engine.Host
 
@@ -62,6 +66,33 @@ type mux struct {
 
 	// Unsubscribe from staple updates
 	stapleUpdatesC chan *stapler.StapleUpdated
+
+	// Access log shared by all frontends, nil if disabled
+	accessLog *accessLogWriter
+
+	// Latency histograms of the frontends and backends
+	latency *latencyTracker
+	// shared keeps the limits of the frontends and the listeners, the muxes of the workers share them
+	shared *shared
+	// followsHealth is set for the muxes of the workers taking the health checks of the first one
+	followsHealth bool
+
+	// Error page templates of the proxy and the hosts
+	errorPages *errorPages
+
+	// Security headers of the hosts
+	securityHeaders *securityHeaders
+
+	// Labels of the frontends and backends in the metric names
+	labels *metricLabels
+
+	// Servers taken out of the rotation through the API, kept when the servers are deleted, so the servers
+	// re-added by their registrars stay out of the rotation
+	quarantined map[engine.ServerKey]bool
+
+	// Source of the periodically emitted metrics, the mux itself or the workers it is the first of,
+	// the metrics are not emitted if nil
+	metrics metricsSource
 }
 
 func (m *mux) String() string {
@@ -70,6 +101,18 @@ func (m *mux) String() string {
 
 func New(id int, st stapler.Stapler, o Options) (*mux, error) {
 	o = setDefaults(o)
+	if o.MetricsInterval < 0 {
+		return nil, fmt.Errorf("metrics interval should be >= 0, got %v", o.MetricsInterval)
+	}
+	pages, err := newErrorPages(o.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+	if o.DefaultKeyPair != nil {
+		if _, err := tls.X509KeyPair(o.DefaultKeyPair.Cert, o.DefaultKeyPair.Key); err != nil {
+			return nil, fmt.Errorf("bad default certificate: %v", err)
+		}
+	}
 	m := &mux{
 		id:  id,
 		wg:  &sync.WaitGroup{},
@@ -86,12 +129,28 @@ func New(id int, st stapler.Stapler, o Options) (*mux, error) {
 		frontends: make(map[engine.FrontendKey]*frontend),
 		hosts:     make(map[engine.HostKey]engine.Host),
 
+		quarantined: make(map[engine.ServerKey]bool),
+
+		tcpFrontends: make(map[engine.FrontendKey]*tcpFrontend),
+
 		stapleUpdatesC: make(chan *stapler.StapleUpdated),
 		stopC:          make(chan struct{}),
 		stapler:        st,
+
+		latency:         newLatencyTracker(o.TimeProvider, o.LatencyWindow),
+		shared:          newShared(),
+		labels:          newMetricLabels(o.MaxMetricLabels),
+		errorPages:      pages,
+		securityHeaders: newSecurityHeaders(),
+	}
+
+	m.metrics = m
+
+	if o.AccessLog != nil {
+		m.accessLog = newAccessLogWriter(o.AccessLog)
 	}
 
-	m.router.SetNotFound(&DefaultNotFound{})
+	m.router.SetNotFound(&notFoundPage{pages: m.errorPages, next: &DefaultNotFound{}})
 	if o.NotFoundMiddleware != nil {
 		if handler, err := o.NotFoundMiddleware.NewHandler(m.router.GetNotFound()); err == nil {
 			m.router.SetNotFound(handler)
@@ -112,6 +171,10 @@ func (m *mux) Init(ss engine.Snapshot) error {
 
 	for _, host := range ss.Hosts {
 		m.hosts[engine.HostKey{Name: host.Name}] = host
+		if err := m.errorPages.upsertHost(host); err != nil {
+			log.Errorf("%v failed to set error pages of %v: %v", m, &host, err)
+		}
+		m.securityHeaders.upsertHost(host)
 	}
 
 	for _, bes := range ss.BackendSpecs {
@@ -154,6 +217,17 @@ func (m *mux) Init(ss engine.Snapshot) error {
 			return errors.Errorf("unknown backend %v in frontend %v",
 				fes.Frontend.BackendId, fes.Frontend.Id)
 		}
+		if fes.Frontend.Type == engine.TCP {
+			if err := m.checkTCPListener(fes.Frontend.TCPSettings().ListenerId); err != nil {
+				return errors.Wrapf(err, "failed to create frontend %v", fes.Frontend.Id)
+			}
+			f, err := newTCPFrontend(m, fes.Frontend)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create frontend %v", fes.Frontend.Id)
+			}
+			m.tcpFrontends[feKey] = f
+			continue
+		}
 		fe := newFrontend(m, fes.Frontend, be)
 		for _, mw := range fes.Middlewares {
 			fe.middlewares[engine.MiddlewareKey{FrontendKey: feKey, Id: mw.Id}] = mw
@@ -168,6 +242,36 @@ func (m *mux) Init(ss engine.Snapshot) error {
 	return nil
 }
 
+func (m *mux) Snapshot() engine.Snapshot {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var ss engine.Snapshot
+	for _, h := range m.hosts {
+		ss.Hosts = append(ss.Hosts, h)
+	}
+	for lk, s := range m.servers {
+		if m.options.DefaultListener != nil && m.options.DefaultListener.Id == lk.Id {
+			continue
+		}
+		ss.Listeners = append(ss.Listeners, s.listener)
+	}
+	for _, b := range m.backends {
+		ss.BackendSpecs = append(ss.BackendSpecs, engine.BackendSpec{Backend: b.backend, Servers: b.configuredServers()})
+	}
+	for _, f := range m.frontends {
+		fs := engine.FrontendSpec{Frontend: f.frontend}
+		for _, mw := range f.middlewares {
+			fs.Middlewares = append(fs.Middlewares, mw)
+		}
+		ss.FrontendSpecs = append(ss.FrontendSpecs, fs)
+	}
+	for _, f := range m.tcpFrontends {
+		ss.FrontendSpecs = append(ss.FrontendSpecs, engine.FrontendSpec{Frontend: f.frontend})
+	}
+	return ss
+}
+
 func (m *mux) GetFiles() ([]*FileDescriptor, error) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
@@ -238,19 +342,21 @@ func (m *mux) Start() error {
 		}
 	}()
 
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
-		for {
-			select {
-			case <-m.stopC:
-				log.Infof("%v stop emitting metrics", m)
-				return
-			case <-time.After(time.Second):
-				m.emitMetrics()
+	if m.metrics != nil {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			for {
+				select {
+				case <-m.stopC:
+					log.Infof("%v stop emitting metrics", m)
+					return
+				case <-time.After(m.options.MetricsInterval):
+					m.emitMetrics()
+				}
 			}
-		}
-	}()
+		}()
+	}
 
 	m.state = stateActive
 	for _, s := range m.servers {
@@ -266,16 +372,31 @@ func (m *mux) Start() error {
 func (m *mux) Stop(wait bool) {
 	log.Infof("%s Stop(%t)", m, wait)
 
-	m.stopServers()
+	var deadline time.Time
+	if m.options.ShutdownTimeout > 0 {
+		deadline = time.Now().Add(m.options.ShutdownTimeout)
+	}
+	m.stopServers(deadline)
 
 	if wait {
-		log.Infof("%s waiting for the wait group to finish", m)
-		m.wg.Wait()
-		log.Infof("%s wait group finished", m)
+		m.wait()
 	}
 }
 
-func (m *mux) stopServers() {
+func (m *mux) StopBy(deadline time.Time) {
+	log.Infof("%s StopBy(%v)", m, deadline)
+
+	m.stopServers(deadline)
+	m.wait()
+}
+
+func (m *mux) wait() {
+	log.Infof("%s waiting for the wait group to finish", m)
+	m.wg.Wait()
+	log.Infof("%s wait group finished", m)
+}
+
+func (m *mux) stopServers(deadline time.Time) {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -290,25 +411,197 @@ func (m *mux) stopServers() {
 
 	// init state has no running servers, no need to close them
 	if prevState == stateInit {
+		m.closeHandlers()
 		return
 	}
 
+	var draining []*srv
+	for _, s := range m.servers {
+		if s.shutdownBy(deadline) {
+			draining = append(draining, s)
+		}
+	}
+	m.wg.Add(1)
+	go m.reportDrain(draining, deadline)
+}
+
+// reportDrain logs and reports the connections left to drain by the stopping servers until all of them have
+// drained, the report lets the operators tune the shutdown timeout to the time the connections take to finish
+func (m *mux) reportDrain(servers []*srv, deadline time.Time) {
+	defer m.wg.Done()
+
+	started := time.Now()
+	addrs := make([]string, len(servers))
+	drained := make([]<-chan struct{}, len(servers))
+	for i, s := range servers {
+		addrs[i] = s.listener.Address.Address
+		drained[i] = s.drained()
+	}
+	all := drainedAll(drained)
+	ticker := time.NewTicker(m.options.DrainReportPeriod)
+	defer ticker.Stop()
+	for {
+		left, open := 0, 0
+		for i, s := range servers {
+			n := 0
+			select {
+			case <-drained[i]:
+			default:
+				left++
+				n = s.conns.size()
+			}
+			open += n
+			m.options.Reporter.ReportConns(addrs[i], "draining", int64(n))
+		}
+		if left == 0 {
+			log.Infof("%v drained in %v", m, time.Since(started))
+			m.mtx.Lock()
+			m.closeHandlers()
+			m.mtx.Unlock()
+			return
+		}
+		if deadline.IsZero() {
+			log.Infof("%v draining %d connections on %d listeners for %v", m, open, left, time.Since(started))
+		} else {
+			log.Infof("%v draining %d connections on %d listeners for %v, the rest is closed in %v",
+				m, open, left, time.Since(started), time.Until(deadline))
+		}
+		select {
+		case <-ticker.C:
+		case <-all:
+		}
+	}
+}
+
+// closeHandlers closes the middleware handlers of the frontends once the stopped mux serves no requests
+func (m *mux) closeHandlers() {
+	for _, f := range m.frontends {
+		closeHandlers(f.handlers)
+		f.handlers = nil
+	}
+}
+
+// drainedAll returns the channel closed once all the channels are closed
+func drainedAll(cs []<-chan struct{}) <-chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		for _, c := range cs {
+			<-c
+		}
+		close(out)
+	}()
+	return out
+}
+
+func (m *mux) Ready() error {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	if m.state != stateActive {
+		return fmt.Errorf("%v is not active", m)
+	}
+	for _, s := range m.servers {
+		if !s.isServing() {
+			return fmt.Errorf("%v is not serving", &s.listener)
+		}
+	}
+	return nil
+}
+
+func (m *mux) ServerTimeouts() ServerTimeouts {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return m.serverTimeouts()
+}
+
+func (m *mux) serverTimeouts() ServerTimeouts {
+	return ServerTimeouts{Read: m.options.ReadTimeout, Write: m.options.WriteTimeout, Idle: m.options.IdleTimeout}
+}
+
+// UpdateServerTimeouts reloads the listener servers with the new timeouts. The read timeout is the default
+// read timeout of the backends as well, it applies to the backends upserted after the change.
+func (m *mux) UpdateServerTimeouts(t ServerTimeouts) error {
+	if err := t.Check(); err != nil {
+		return err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	prev := m.serverTimeouts()
+	if prev == t {
+		return nil
+	}
+	m.options.ReadTimeout, m.options.WriteTimeout, m.options.IdleTimeout = t.Read, t.Write, t.Idle
+	log.Infof("%v server timeouts changed from %v to %v", m, prev, t)
+	// Servers failing to reload keep serving with the old timeouts, the first error is returned
+	var reloadErr error
 	for _, s := range m.servers {
-		s.shutdown()
+		if err := s.reload(); err != nil {
+			log.Errorf("%v failed to apply server timeouts: %v", s, err)
+			if reloadErr == nil {
+				reloadErr = errors.Wrapf(err, "failed to reload %v", s)
+			}
+		}
 	}
+	return reloadErr
+}
+
+func (m *mux) UpdateDefaultKeyPair(kp engine.KeyPair) error {
+	if _, err := tls.X509KeyPair(kp.Cert, kp.Key); err != nil {
+		return fmt.Errorf("bad default certificate: %v", err)
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if prev := m.options.DefaultKeyPair; prev != nil && prev.Equals(&kp) {
+		return nil
+	}
+	log.Infof("%v default certificate changed", m)
+	m.options.DefaultKeyPair = &kp
+	// the handshakes take the certificate of the reloaded configs, like on the staple updates
+	var reloadErr error
+	for _, s := range m.servers {
+		if err := s.reloadTLS(); err != nil {
+			log.Errorf("%v failed to apply the default certificate: %v", s, err)
+			if reloadErr == nil {
+				reloadErr = errors.Wrapf(err, "failed to reload %v", s)
+			}
+		}
+	}
+	return reloadErr
 }
 
 func (m *mux) UpsertHost(host engine.Host) error {
 	log.Infof("%s UpsertHost %s", m, &host)
 
+	if host.Settings.TLS != nil {
+		if err := host.Settings.TLS.Check(); err != nil {
+			return err
+		}
+	}
+	if host.Settings.ClientAuth != nil {
+		if err := host.Settings.ClientAuth.Check(); err != nil {
+			return err
+		}
+	}
+	if host.Settings.SecurityHeaders != nil {
+		if err := host.Settings.SecurityHeaders.Check(); err != nil {
+			return err
+		}
+	}
+	if err := m.errorPages.upsertHost(host); err != nil {
+		return err
+	}
+	m.securityHeaders.upsertHost(host)
+
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
 	m.hosts[engine.HostKey{Name: host.Name}] = host
 
 	for _, s := range m.servers {
-		if s.isTLS() {
-			s.reload()
+		if err := s.reloadTLS(); err != nil {
+			log.Errorf("%v failed to apply %v: %v", s, &host, err)
 		}
 	}
 	return nil
@@ -327,16 +620,20 @@ func (m *mux) DeleteHost(hk engine.HostKey) error {
 
 	// delete host from the hosts list
 	delete(m.hosts, hk)
+	m.errorPages.deleteHost(hk.Name)
+	m.securityHeaders.deleteHost(hk.Name)
 
 	// delete staple from the cache
 	m.stapler.DeleteHost(hk)
 
-	if host.Settings.KeyPair == nil {
+	if len(host.Settings.AllKeyPairs()) == 0 {
 		return nil
 	}
 
 	for _, s := range m.servers {
-		s.reload()
+		if err := s.reloadTLS(); err != nil {
+			log.Errorf("%v failed to remove %v: %v", s, &hk, err)
+		}
 	}
 	return nil
 }
@@ -350,7 +647,11 @@ func (m *mux) UpsertListener(l engine.Listener) error {
 }
 
 func (m *mux) DeleteListener(lk engine.ListenerKey) error {
-	log.Infof("%v DeleteListener %v", m, &lk)
+	return m.DrainListener(lk, m.options.DrainTimeout)
+}
+
+func (m *mux) DrainListener(lk engine.ListenerKey, drainTimeout time.Duration) error {
+	log.Infof("%v DrainListener %v, drain timeout: %v", m, &lk, drainTimeout)
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
@@ -360,21 +661,28 @@ func (m *mux) DeleteListener(lk engine.ListenerKey) error {
 	}
 
 	delete(m.servers, lk)
-	s.shutdown()
+	m.shared.forget(listenerConnsKey(lk.Id))
+	s.shutdown(drainTimeout)
+	if s.hasListeners() {
+		removeSocket(s.listener)
+	}
 	return nil
 }
 
 func (m *mux) upsertListener(l engine.Listener) error {
 	lk := engine.ListenerKey{Id: l.Id}
 	s, exists := m.servers[lk]
-	if exists {
+	if exists && s.listener.Address.Equals(l.Address) {
 		return s.updateListener(l)
 	}
+	if exists {
+		return m.rebindListener(s, l)
+	}
 
 	// Check if there's a listener with the same address
 	for _, srv := range m.servers {
-		if srv.listener.Address == l.Address {
-			return &engine.AlreadyExistsError{Message: fmt.Sprintf("%v conflicts with existing %v", l, srv.listener)}
+		if srv.listener.Address.Equals(l.Address) {
+			return &engine.ListenerConflictError{Listener: lk, Existing: srv.listener}
 		}
 	}
 
@@ -393,6 +701,34 @@ func (m *mux) upsertListener(l engine.Listener) error {
 	return nil
 }
 
+// rebindListener moves the listener to the new address. The server on the new address is started first, so
+// the listener keeps serving on the old one if the new address can not be bound, then the old server drains.
+func (m *mux) rebindListener(s *srv, l engine.Listener) error {
+	lk := engine.ListenerKey{Id: l.Id}
+	for k, srv := range m.servers {
+		if k != lk && srv.listener.Address.Equals(l.Address) {
+			return &engine.ListenerConflictError{Listener: lk, Existing: srv.listener}
+		}
+	}
+	log.Infof("%v moves %v to %v", m, &s.listener, l.Address)
+
+	ns, err := newSrv(m, l)
+	if err != nil {
+		return err
+	}
+	if m.state == stateActive {
+		if err := ns.start(); err != nil {
+			return err
+		}
+	}
+	m.servers[lk] = ns
+	s.shutdown(m.options.DrainTimeout)
+	if s.hasListeners() {
+		removeSocket(s.listener)
+	}
+	return nil
+}
+
 func (m *mux) UpsertBackend(b engine.Backend) error {
 	log.Infof("%v UpsertBackend %v", m, &b)
 
@@ -435,8 +771,14 @@ func (m *mux) DeleteBackend(bk engine.BackendKey) error {
 	if len(b.frontends) != 0 {
 		return fmt.Errorf("%v is used by frontends: %v", b, b.frontends)
 	}
+	for fk, f := range m.tcpFrontends {
+		if f.frontend.BackendId == bk.Id {
+			return fmt.Errorf("%v is used by frontend %v", b, fk)
+		}
+	}
 
 	b.Close()
+	m.labels.forget("backend", bk.Id)
 	return nil
 }
 
@@ -457,6 +799,12 @@ func (m *mux) upsertFrontend(fe engine.Frontend) (*frontend, error) {
 		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", bk)}
 	}
 	fk := engine.FrontendKey{Id: fe.Id}
+	if fe.Type == engine.TCP {
+		return nil, m.upsertTCPFrontend(fk, fe)
+	}
+	if _, ok := m.tcpFrontends[fk]; ok {
+		return nil, fmt.Errorf("%v can not change the type of the TCP frontend", fk)
+	}
 	f, ok := m.frontends[fk]
 	if ok {
 		return f, f.update(fe, b)
@@ -480,7 +828,41 @@ func (m *mux) DeleteFrontend(fk engine.FrontendKey) error {
 	return m.deleteFrontend(fk)
 }
 
+func (m *mux) upsertTCPFrontend(fk engine.FrontendKey, fe engine.Frontend) error {
+	if _, ok := m.frontends[fk]; ok {
+		return fmt.Errorf("%v can not change the type of the HTTP frontend", fk)
+	}
+	if err := m.checkTCPListener(fe.TCPSettings().ListenerId); err != nil {
+		return err
+	}
+	if f, ok := m.tcpFrontends[fk]; ok {
+		return f.update(fe)
+	}
+	f, err := newTCPFrontend(m, fe)
+	if err != nil {
+		return err
+	}
+	m.tcpFrontends[fk] = f
+	return nil
+}
+
+// checkTCPListener returns an error unless the listener of the TCP frontend exists and takes the TCP connections
+func (m *mux) checkTCPListener(id string) error {
+	s, ok := m.servers[engine.ListenerKey{Id: id}]
+	if !ok {
+		return &engine.NotFoundError{Message: fmt.Sprintf("listener %v not found", id)}
+	}
+	if !s.isTCP() {
+		return fmt.Errorf("listener %v is not a TCP listener", id)
+	}
+	return nil
+}
+
 func (m *mux) deleteFrontend(fk engine.FrontendKey) error {
+	if _, ok := m.tcpFrontends[fk]; ok {
+		delete(m.tcpFrontends, fk)
+		return nil
+	}
 	f, ok := m.frontends[fk]
 	if !ok {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", fk)}
@@ -489,6 +871,12 @@ func (m *mux) deleteFrontend(fk engine.FrontendKey) error {
 		return err
 	}
 	delete(m.frontends, fk)
+	keys := []string{bulkheadKey(fk.Id), rateLimiterKey(fk.Id), retryBudgetKey(fk.Id)}
+	for mk := range f.middlewares {
+		keys = append(keys, middlewareKey(fk.Id, mk.Id))
+	}
+	m.shared.forget(keys...)
+	m.labels.forget("frontend", fk.Id)
 	return nil
 }
 
@@ -520,15 +908,32 @@ func (m *mux) DeleteMiddleware(mk engine.MiddlewareKey) error {
 		return &engine.NotFoundError{Message: fmt.Sprintf("%v not found", mk)}
 	}
 
+	m.shared.forget(middlewareKey(mk.FrontendKey.Id, mk.Id))
 	return f.deleteMiddleware(mk)
 }
 
+func (m *mux) PurgeCache(fk engine.FrontendKey, prefix string) (int, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	f, ok := m.frontends[fk]
+	if !ok {
+		return 0, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", fk)}
+	}
+	purged := f.purgeCache(prefix)
+	log.Infof("%v purged %d cached responses of %v with prefix '%v'", m, purged, &fk, prefix)
+	return purged, nil
+}
+
 func (m *mux) UpsertServer(bk engine.BackendKey, srv engine.Server) error {
 	log.Infof("%v UpsertServer %v %v", m, &bk, &srv)
 
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
+	if srv.Weight < 0 {
+		return fmt.Errorf("%v weight should be >= 0, got %d", &srv, srv.Weight)
+	}
 	if _, err := url.ParseRequestURI(srv.URL); err != nil {
 		return fmt.Errorf("failed to parse %v, error: %v", srv, err)
 	}
@@ -558,6 +963,38 @@ func (m *mux) DeleteServer(sk engine.ServerKey) error {
 	return b.deleteServer(sk)
 }
 
+// followHealth takes the health of the servers of the backend checked by the first mux of the workers
+func (m *mux) followHealth(backendId string, health map[string]serverHealth) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	b, ok := m.backends[engine.BackendKey{Id: backendId}]
+	if !ok || b.checker == nil {
+		return
+	}
+	b.checker.follow(health)
+}
+
+func (m *mux) QuarantineServer(sk engine.ServerKey, quarantined bool) error {
+	log.Infof("%v QuarantineServer %v, quarantined: %t", m, &sk, quarantined)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if m.quarantined[sk] == quarantined {
+		return nil
+	}
+	if quarantined {
+		m.quarantined[sk] = true
+	} else {
+		delete(m.quarantined, sk)
+	}
+	if b, ok := m.backends[sk.BackendKey]; ok {
+		return b.updateFrontends()
+	}
+	return nil
+}
+
 func (m *mux) transportSettings(b engine.Backend) (*engine.TransportSettings, error) {
 	s, err := b.TransportSettings()
 	if err != nil {
@@ -570,6 +1007,9 @@ func (m *mux) transportSettings(b engine.Backend) (*engine.TransportSettings, er
 	if s.Timeouts.Read == 0 {
 		s.Timeouts.Read = m.options.ReadTimeout
 	}
+	if s.Timeouts.ResponseHeader == 0 {
+		s.Timeouts.ResponseHeader = s.Timeouts.Read
+	}
 	return s, nil
 }
 
@@ -578,15 +1018,15 @@ func (m *mux) processStapleUpdate(e *stapler.StapleUpdated) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if _, ok := m.hosts[e.HostKey]; !ok {
+	if _, ok := m.hosts[e.HostKey]; !ok && e.HostKey.Name != defaultCertHostName {
 		log.Infof("%v %v from the staple update is not found, skipping", m, e.HostKey)
 		return nil
 	}
 
 	for _, s := range m.servers {
-		if s.isTLS() {
-			// each server will ask stapler for the new OCSP response during reload
-			s.reload()
+		// each server will ask stapler for the new OCSP response during reload
+		if err := s.reloadTLS(); err != nil {
+			log.Errorf("%v failed to apply the staple of %v: %v", s, e.HostKey, err)
 		}
 	}
 	return nil
@@ -616,15 +1056,30 @@ func setDefaults(o Options) Options {
 	if o.MetricsClient == nil {
 		o.MetricsClient = metrics.NewNop()
 	}
+	if o.Reporter == nil {
+		o.Reporter = reporter.NewStatsd(o.MetricsClient)
+	}
 	if o.TimeProvider == nil {
 		o.TimeProvider = &timetools.RealTime{}
 	}
 	if o.Router == nil {
-		o.Router = route.NewMux()
+		o.Router = newHostRouter()
 	}
 	if o.IncomingConnectionTracker == nil {
 		o.IncomingConnectionTracker = newDefaultConnTracker()
 	}
+	if o.LookupSRV == nil {
+		o.LookupSRV = dnssrv.Lookup
+	}
+	if o.LatencyWindow == 0 {
+		o.LatencyWindow = DefaultLatencyWindow
+	}
+	if o.DrainReportPeriod == 0 {
+		o.DrainReportPeriod = DefaultDrainReportPeriod
+	}
+	if o.MetricsInterval == 0 {
+		o.MetricsInterval = DefaultMetricsInterval
+	}
 	return o
 }
 
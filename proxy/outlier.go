@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// outlierDetector observes results of the requests forwarded to the backend servers and ejects
+// servers with consecutive 5xx responses or network errors out of the load balancer rotation.
+type outlierDetector struct {
+	b        *backend
+	settings engine.OutlierDetectionSettings
+	stopC    chan struct{}
+
+	// mtx guards failure counters that are updated on the request path
+	mtx      sync.Mutex
+	failures map[string]int
+	pending  map[string]bool
+
+	// ejected keeps the time the ejected servers are returned to rotation at, ejected and ejections
+	// are guarded by the mux lock
+	ejected   map[string]time.Time
+	ejections map[string]int
+}
+
+func newOutlierDetector(b *backend, s engine.OutlierDetectionSettings) *outlierDetector {
+	return &outlierDetector{
+		b:         b,
+		settings:  s,
+		stopC:     make(chan struct{}),
+		failures:  make(map[string]int),
+		pending:   make(map[string]bool),
+		ejected:   make(map[string]time.Time),
+		ejections: make(map[string]int),
+	}
+}
+
+// takeOver carries the ejections of the stopped detector over, so the servers ejected before the transport
+// is rebuilt stay out of rotation for the rest of their ejection time
+func (d *outlierDetector) takeOver(previous *outlierDetector) {
+	for key, n := range previous.ejections {
+		d.ejections[key] = n
+	}
+	now := d.b.mux.options.TimeProvider.UtcNow()
+	for key, until := range previous.ejected {
+		d.ejected[key] = until
+		d.b.mux.wg.Add(1)
+		go d.readmit(key, until.Sub(now))
+	}
+}
+
+func (d *outlierDetector) String() string {
+	return fmt.Sprintf("%v outlierdetection(errors=%v)", d.b, d.settings.ConsecutiveErrors)
+}
+
+// stop signals pending ejections to exit, it does not wait for them as the caller
+// is holding the mux lock that they may be waiting for.
+func (d *outlierDetector) stop() {
+	close(d.stopC)
+}
+
+func (d *outlierDetector) stopped() bool {
+	select {
+	case <-d.stopC:
+		return true
+	default:
+		return false
+	}
+}
+
+// observe is called on the request path with the result of the round trip to the server
+func (d *outlierDetector) observe(u *url.URL, failed bool) {
+	key := serverKey(u)
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if !failed {
+		delete(d.failures, key)
+		return
+	}
+	d.failures[key]++
+	if d.failures[key] >= d.settings.ConsecutiveErrors && !d.pending[key] {
+		d.pending[key] = true
+		d.b.mux.wg.Add(1)
+		go d.eject(key)
+	}
+}
+
+// eject takes the server out of rotation unless it is the last server receiving traffic
+func (d *outlierDetector) eject(key string) {
+	defer d.b.mux.wg.Done()
+
+	d.b.mux.mtx.Lock()
+	defer d.b.mux.mtx.Unlock()
+
+	d.mtx.Lock()
+	delete(d.pending, key)
+	delete(d.failures, key)
+	d.mtx.Unlock()
+
+	if _, ok := d.ejected[key]; ok || d.stopped() {
+		return
+	}
+
+	active := d.b.activeServers()
+	var srv *engine.Server
+	for i := range active {
+		if urlKey(active[i].URL) == key {
+			srv = &active[i]
+			break
+		}
+	}
+	if srv == nil {
+		return
+	}
+	if len(active) <= 1 {
+		log.Warningf("%v not ejecting %v as it is the last server in rotation", d, srv)
+		return
+	}
+
+	d.ejections[key]++
+	timeout := d.settings.EjectionTime(d.ejections[key])
+	d.ejected[key] = d.b.mux.options.TimeProvider.UtcNow().Add(timeout)
+	log.Warningf("%v ejecting %v for %v after %d consecutive errors", d, srv, timeout, d.settings.ConsecutiveErrors)
+	if err := d.b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", d, err)
+	}
+
+	d.b.mux.wg.Add(1)
+	go d.readmit(key, timeout)
+}
+
+func (d *outlierDetector) readmit(key string, timeout time.Duration) {
+	defer d.b.mux.wg.Done()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-d.stopC:
+		return
+	case <-d.b.mux.stopC:
+		return
+	case <-timer.C:
+	}
+
+	d.b.mux.mtx.Lock()
+	defer d.b.mux.mtx.Unlock()
+
+	if d.stopped() {
+		return
+	}
+	log.Infof("%v returning %v back to rotation", d, key)
+	delete(d.ejected, key)
+	if err := d.b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", d, err)
+	}
+}
+
+func (d *outlierDetector) isEjected(s engine.Server) bool {
+	_, ok := d.ejected[urlKey(s.URL)]
+	return ok
+}
+
+// outlierTransport reports results of the round trips to the outlier detector
+type outlierTransport struct {
+	d    *outlierDetector
+	next http.RoundTripper
+}
+
+func (t *outlierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	re, err := t.next.RoundTrip(req)
+	t.d.observe(req.URL, err != nil || re.StatusCode >= http.StatusInternalServerError)
+	return re, err
+}
+
+// serverKey identifies the server by the scheme and host the request was forwarded to
+func serverKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func urlKey(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	return serverKey(parsed)
+}
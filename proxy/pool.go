@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// defaultPoolWait limits the time requests wait for a connection when the backend has no dial timeout
+const defaultPoolWait = 30 * time.Second
+
+// poolExhaustedError is returned when no connection to the server became available in time
+type poolExhaustedError struct {
+	host string
+	wait time.Duration
+}
+
+func (e *poolExhaustedError) Error() string {
+	return fmt.Sprintf("no connection to %v became available in %v", e.host, e.wait)
+}
+
+// defaultErrorHandler responds with 503 to the requests that could not get a connection
+// from the exhausted pool and falls back to the standard error responses otherwise
+var defaultErrorHandler = utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+	if _, ok := err.(*poolExhaustedError); ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+	utils.DefaultHandler.ServeHTTP(w, req, err)
+})
+
+const (
+	connWaiting int32 = iota
+	connAcquired
+	connWaitExpired
+)
+
+// poolLimitTransport bounds the time requests queue for a connection once the transport
+// has reached the maximum amount of connections to the server
+type poolLimitTransport struct {
+	*http.Transport
+	wait time.Duration
+}
+
+func newPoolLimitTransport(t *http.Transport, wait time.Duration) *poolLimitTransport {
+	if wait <= 0 {
+		wait = defaultPoolWait
+	}
+	return &poolLimitTransport{Transport: t, wait: wait}
+}
+
+func (t *poolLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	state := connWaiting
+	ctx, cancel := context.WithCancel(req.Context())
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			atomic.CompareAndSwapInt32(&state, connWaiting, connAcquired)
+		},
+	})
+	timer := time.AfterFunc(t.wait, func() {
+		if atomic.CompareAndSwapInt32(&state, connWaiting, connWaitExpired) {
+			cancel()
+		}
+	})
+	re, err := t.Transport.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if atomic.LoadInt32(&state) == connWaitExpired {
+		if re != nil {
+			re.Body.Close()
+		}
+		cancel()
+		return nil, &poolExhaustedError{host: req.URL.Host, wait: t.wait}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// body of the switched protocols response is the connection itself, it is released with the request
+	if re.StatusCode == http.StatusSwitchingProtocols {
+		return re, nil
+	}
+	re.Body = &cancelBody{ReadCloser: re.Body, cancel: cancel}
+	return re, nil
+}
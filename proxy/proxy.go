@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -9,10 +10,13 @@ import (
 	"github.com/mailgun/metrics"
 	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/vulcand/acme"
 	"github.com/vulcand/vulcand/conntracker"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/reporter"
 	"github.com/vulcand/vulcand/router"
+	"github.com/vulcand/vulcand/tracing"
 )
 
 type Proxy interface {
@@ -20,11 +24,18 @@ type Proxy interface {
 
 	Init(snapshot engine.Snapshot) error
 
+	// Snapshot returns the configuration currently applied to the proxy, the default listener is omitted
+	// as it does not come from the engine
+	Snapshot() engine.Snapshot
+
 	UpsertHost(engine.Host) error
 	DeleteHost(engine.HostKey) error
 
 	UpsertListener(engine.Listener) error
 	DeleteListener(engine.ListenerKey) error
+	// DrainListener removes the listener and lets in-flight requests finish for up to the drain timeout,
+	// zero timeout waits for the requests indefinitely
+	DrainListener(engine.ListenerKey, time.Duration) error
 
 	UpsertBackend(engine.Backend) error
 	DeleteBackend(engine.BackendKey) error
@@ -34,9 +45,16 @@ type Proxy interface {
 
 	UpsertMiddleware(engine.FrontendKey, engine.Middleware) error
 	DeleteMiddleware(engine.MiddlewareKey) error
+	// PurgeCache drops the responses of the URLs with the path starting with the prefix from the response caches
+	// of the frontend middlewares, returns the amount of the dropped responses
+	PurgeCache(fk engine.FrontendKey, prefix string) (int, error)
 
 	UpsertServer(engine.BackendKey, engine.Server) error
 	DeleteServer(engine.ServerKey) error
+	// QuarantineServer takes the server out of the load balancer rotation keeping its configuration, or puts
+	// it back if quarantined is false. The server stays quarantined until it is cleared, even if it is deleted
+	// and upserted again.
+	QuarantineServer(sk engine.ServerKey, quarantined bool) error
 
 	// TakeFiles takes file descriptors representing sockets in listening state to start serving on them
 	// instead of binding. This is nessesary if the child process needs to inherit sockets from the parent
@@ -49,14 +67,55 @@ type Proxy interface {
 
 	Start() error
 	Stop(wait bool)
+	// StopBy stops the proxy and waits for the connections to drain, connections still open at the deadline are
+	// closed. Zero deadline waits for the connections indefinitely.
+	StopBy(deadline time.Time)
+
+	// Ready returns an error if the proxy is not started or any of its listeners is not serving
+	Ready() error
+
+	// ServerTimeouts returns the timeouts of the listener servers
+	ServerTimeouts() ServerTimeouts
+	// UpdateServerTimeouts applies the timeouts to the listener servers, the servers are reloaded in place
+	// keeping the listening sockets and the open connections
+	UpdateServerTimeouts(ServerTimeouts) error
+	// UpdateDefaultKeyPair replaces the default certificate of the TLS listeners in place, the new handshakes get
+	// the new certificate and the open connections are kept. The bad key pair is rejected and the listeners keep
+	// serving the previous one.
+	UpdateDefaultKeyPair(engine.KeyPair) error
 }
 
+// ServerTimeouts are the timeouts of the listener servers of the proxy instance
+type ServerTimeouts = engine.ServerTimeouts
+
 type Options struct {
-	MetricsClient             metrics.Client
-	DialTimeout               time.Duration
-	ReadTimeout               time.Duration
-	WriteTimeout              time.Duration
-	MaxHeaderBytes            int
+	MetricsClient metrics.Client
+	// Reporter receives proxy metrics, defaults to the statsd reporter using MetricsClient
+	Reporter     reporter.Reporter
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IdleTimeout closes keep-alive connections idle for longer than this duration, listeners can override it.
+	// The read timeout is used if 0, the same way the HTTP server does.
+	IdleTimeout time.Duration
+	// DrainTimeout limits the time in-flight requests have to finish when the listener is deleted
+	DrainTimeout time.Duration
+	// ShutdownTimeout limits the time in-flight requests have to finish when the proxy is stopped, connections
+	// still open after the timeout are closed. Stop waits for the requests indefinitely if 0.
+	ShutdownTimeout time.Duration
+	MaxHeaderBytes  int
+	// MaxMemBodyBytes is the size of the buffered request and response bodies kept in memory, the rest of the body
+	// spills to a temporary file. 1MB is default, frontends can override it with their limits.
+	MaxMemBodyBytes int64
+	// MaxBodyBytes rejects the buffered requests with larger bodies with 413, 0 means no limit. Frontends can
+	// override it with their limits.
+	MaxBodyBytes int64
+	// MaxMetricLabels caps the number of distinct frontend and backend ids in the metric names, the metrics of
+	// the ids over the cap are emitted with the "other" id. 0 means no limit.
+	MaxMetricLabels int
+	// TrustedProxies are the networks of the proxies in front of vulcand, the client address is taken from
+	// X-Forwarded-For set by these proxies. The peer address is the client address if empty.
+	TrustedProxies            []*net.IPNet
 	DefaultListener           *engine.Listener
 	Files                     []*FileDescriptor
 	TimeProvider              timetools.TimeProvider
@@ -64,8 +123,50 @@ type Options struct {
 	Router                    router.Router
 	IncomingConnectionTracker conntracker.ConnectionTracker
 	OutgoingConnectionTracker forward.UrlForwardingStateListener
+	// AccessLog receives JSON access log lines of all frontends, access logging is disabled if nil
+	AccessLog io.Writer
+	// ACMESolver answers HTTP-01 challenges of the ACME certificate provisioning on all listeners
+	ACMESolver *acme.HTTP01Solver
+	// LookupSRV resolves the SRV records of the backends with server discovery, the records are looked up
+	// with the system name servers by default
+	LookupSRV LookupSRVFn
+	// LatencyWindow is the period the latency histograms are rotated at, the percentiles are computed
+	// from the latencies of the last one or two windows
+	LatencyWindow time.Duration
+	// ErrorPages replace the error responses of the proxy keyed by the status code, hosts can override them
+	ErrorPages map[int]engine.ErrorPage
+	// Tracer starts the span of every proxied request and exports them, tracing is disabled if nil
+	Tracer *tracing.Tracer
+	// DefaultKeyPair is served to the TLS clients not sending the server name or asking for the name no host
+	// certificate covers, unless a host is marked as the default one
+	DefaultKeyPair *engine.KeyPair
+	// DrainReportPeriod is the period the connections left to drain are logged and reported at while the proxy
+	// is stopping
+	DrainReportPeriod time.Duration
+	// RouteHeader passes the ids of the frontend and the backend of every forwarded request to the backend,
+	// frontends can override or turn it off. It is off if nil.
+	RouteHeader *engine.HTTPFrontendRouteHeader
+	// FullTLSReload reloads the TLS listeners on the certificate, staple and TLS settings updates. The TLS config
+	// of the handshakes is swapped in place by default, the listeners are reloaded on the other listener updates.
+	FullTLSReload bool
+	// ReusePort binds the TCP listeners with SO_REUSEPORT, so the workers of the process bind the same addresses
+	// and the kernel balances the accepted connections between them
+	ReusePort bool
+	// MetricsInterval is the period the metrics are emitted at. The emitted values are the gauges of the rolling
+	// windows and the counters of the connections accepted since the last report, so the period changes the
+	// resolution of the metrics and not their meaning.
+	MetricsInterval time.Duration
 }
 
+const (
+	// DefaultLatencyWindow is the default rotation period of the latency histograms
+	DefaultLatencyWindow = time.Minute
+	// DefaultDrainReportPeriod is the default period of the drain progress reports
+	DefaultDrainReportPeriod = 5 * time.Second
+	// DefaultMetricsInterval is the default period the metrics are emitted at
+	DefaultMetricsInterval = time.Second
+)
+
 type NewProxyFn func(id int) (Proxy, error)
 
 type FileDescriptor struct {
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+var (
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyProtoV1MaxLen is the longest v1 header including the CRLF
+	proxyProtoV1MaxLen = 107
+	// proxyProtoV2MaxLen limits the addresses and the TLVs of the v2 header
+	proxyProtoV2MaxLen = 4096
+)
+
+// proxyProtoListener reads the PROXY protocol header of the connections accepted from the trusted peers, the client
+// address of the header becomes the remote address of the connection. Header sent by an untrusted peer closes the
+// connection, so the clients can not spoof their addresses. The headers are read by the goroutines of the accepted
+// connections with the deadline, the slow clients do not hold the accept of the others.
+type proxyProtoListener struct {
+	net.Listener
+	version   string
+	trusted   []*net.IPNet
+	trustUnix bool
+	timeout   time.Duration
+
+	once  sync.Once
+	connC chan net.Conn
+	// errC passes the temporary accept errors, the server retries them
+	errC chan error
+	// closedC is closed with err once the wrapped listener fails to accept
+	closedC chan struct{}
+	err     error
+}
+
+// defaultProxyProtoTimeout limits the time the trusted peers have to send the header if the proxy has no read timeout
+const defaultProxyProtoTimeout = 10 * time.Second
+
+func newProxyProtoListener(l net.Listener, listener engine.Listener, timeout time.Duration) (*proxyProtoListener, error) {
+	trusted, err := listener.ProxyProtocolTrustedNets()
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultProxyProtoTimeout
+	}
+	return &proxyProtoListener{
+		Listener:  l,
+		version:   listener.ProxyProtocol,
+		trusted:   trusted,
+		trustUnix: listener.ProxyProtocolTrustsUnix(),
+		timeout:   timeout,
+		connC:     make(chan net.Conn),
+		errC:      make(chan error),
+		closedC:   make(chan struct{}),
+	}, nil
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.accept() })
+	select {
+	case conn := <-l.connC:
+		return conn, nil
+	case err := <-l.errC:
+		return nil, err
+	case <-l.closedC:
+		return nil, l.err
+	}
+}
+
+// accept accepts the connections of the wrapped listener until it fails, the headers are read by the goroutines
+// of the connections
+func (l *proxyProtoListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case l.errC <- err:
+					continue
+				case <-l.closedC:
+				}
+			}
+			l.err = err
+			close(l.closedC)
+			return
+		}
+		go l.prepare(&proxyProtoConn{Conn: conn, l: l, r: bufio.NewReader(conn), trusted: l.isTrusted(conn.RemoteAddr())})
+	}
+}
+
+// prepare reads the header of the trusted connection before the connection is passed to the server, the untrusted
+// connections are checked on the first read
+func (l *proxyProtoListener) prepare(c *proxyProtoConn) {
+	if c.trusted {
+		c.Conn.SetReadDeadline(time.Now().Add(l.timeout))
+		c.once.Do(c.readHeader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.Conn.Close()
+			return
+		}
+	}
+	select {
+	case l.connC <- c:
+	case <-l.closedC:
+		c.Conn.Close()
+	}
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return l.trustUnix
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return isTrusted(host, l.trusted)
+}
+
+// proxyProtoConn has the header of the trusted connections read by the listener, the untrusted ones keep the peer
+// address and only check on the first read that no header was sent.
+type proxyProtoConn struct {
+	net.Conn
+	l       *proxyProtoListener
+	r       *bufio.Reader
+	trusted bool
+
+	once   sync.Once
+	err    error
+	remote net.Addr
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		// the server closes the connection on the read errors without answering
+		return 0, &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: c.Conn.RemoteAddr(), Err: c.err}
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtoConn) readHeader() {
+	version, err := c.detect()
+	if err != nil {
+		c.err = err
+		return
+	}
+	if version == "" {
+		return
+	}
+	if !c.trusted {
+		log.Warningf("Closing %v: PROXY protocol header from an untrusted peer", c.Conn.RemoteAddr())
+		c.err = fmt.Errorf("PROXY protocol header from untrusted peer %v", c.Conn.RemoteAddr())
+		return
+	}
+	if version != c.l.version {
+		log.Warningf("Closing %v: expected %v header, got %v", c.Conn.RemoteAddr(), c.l.version, version)
+		c.err = fmt.Errorf("expected %v header, got %v", c.l.version, version)
+		return
+	}
+	if version == engine.PROXY_PROTO_V1 {
+		c.remote, c.err = readProxyProtoV1(c.r)
+	} else {
+		c.remote, c.err = readProxyProtoV2(c.r)
+	}
+	if c.err != nil {
+		log.Warningf("Closing %v: bad PROXY protocol header: %v", c.Conn.RemoteAddr(), c.err)
+	}
+}
+
+// detect returns the version of the header the connection starts with, the empty version if there is none
+func (c *proxyProtoConn) detect() (string, error) {
+	first, err := c.r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	switch first[0] {
+	case proxyProtoV1Prefix[0]:
+		if prefix, err := c.r.Peek(len(proxyProtoV1Prefix)); err == nil && bytes.Equal(prefix, proxyProtoV1Prefix) {
+			return engine.PROXY_PROTO_V1, nil
+		}
+	case proxyProtoV2Sig[0]:
+		if sig, err := c.r.Peek(len(proxyProtoV2Sig)); err == nil && bytes.Equal(sig, proxyProtoV2Sig) {
+			return engine.PROXY_PROTO_V2, nil
+		}
+	}
+	return "", nil
+}
+
+// readProxyProtoV1 parses the text header, e.g. "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n". The nil address
+// is returned for the UNKNOWN protocol, the peer address is kept in this case.
+func readProxyProtoV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtoV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header is not terminated within %d bytes", proxyProtoV1MaxLen)
+	}
+	parts := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(parts[2])
+	if ip == nil || (parts[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid v1 source address %q", parts[2])
+	}
+	port, err := strconv.ParseUint(parts[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", parts[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyProtoV2 parses the binary header. The nil address is returned for the LOCAL command and the address
+// families other than TCP and UDP over IPv4 and IPv6, the peer address is kept in these cases.
+func readProxyProtoV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if length > proxyProtoV2MaxLen {
+		return nil, fmt.Errorf("v2 header of %d bytes is too long", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0xF {
+	case 0: // LOCAL, e.g. the health check of the load balancer
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0xF)
+	}
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET
+		if length < 12 {
+			return nil, fmt.Errorf("v2 IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2: // AF_INET6
+		if length < 36 {
+			return nil, fmt.Errorf("v2 IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
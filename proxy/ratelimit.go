@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+	"github.com/mailgun/ttlmap"
+	"github.com/vulcand/oxy/ratelimit"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// rateLimiter keeps the token buckets of the keys in memory, it is shared by the handler chains of the frontend
+type rateLimiter struct {
+	settings engine.HTTPFrontendRateLimit
+	trusted  []*net.IPNet
+	rates    *ratelimit.RateSet
+	ttl      int
+	clock    timetools.TimeProvider
+
+	mtx     sync.Mutex
+	buckets *ttlmap.TtlMap
+}
+
+func newRateLimiter(f *frontend, s engine.HTTPFrontendRateLimit) (*rateLimiter, error) {
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	trusted, err := s.TrustedNets()
+	if err != nil {
+		return nil, err
+	}
+	rates := ratelimit.NewRateSet()
+	if err := rates.Add(time.Second, s.Requests, s.BurstOrDefault()); err != nil {
+		return nil, err
+	}
+	maxKeys := s.MaxKeys
+	if maxKeys == 0 {
+		maxKeys = engine.DefaultRateLimitMaxKeys
+	}
+	clock := f.mux.options.TimeProvider
+	buckets, err := ttlmap.NewMapWithProvider(maxKeys, clock)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		settings: s,
+		trusted:  trusted,
+		rates:    rates,
+		// bucket of the idle key is full once the ttl passes, so evicting it does not change the limits
+		ttl:     int((s.BurstOrDefault()+s.Requests-1)/s.Requests) + 1,
+		clock:   clock,
+		buckets: buckets,
+	}, nil
+}
+
+// wrap returns the handler rejecting requests over the limit with 429
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := l.key(req)
+		if delay := l.consume(key); delay > 0 {
+			log.Infof("limiting request %v %v from '%v', retry in %v", req.Method, req.URL, key, delay)
+			w.Header().Set("Retry-After", strconv.FormatInt(int64((delay+time.Second-1)/time.Second), 10))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(http.StatusText(http.StatusTooManyRequests)))
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// consume takes a token from the bucket of the key and returns the time to wait for if the bucket is empty
+func (l *rateLimiter) consume(key string) time.Duration {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var bs *ratelimit.TokenBucketSet
+	if v, ok := l.buckets.Get(key); ok {
+		bs = v.(*ratelimit.TokenBucketSet)
+	} else {
+		bs = ratelimit.NewTokenBucketSet(l.rates, l.clock)
+	}
+	if err := l.buckets.Set(key, bs, l.ttl); err != nil {
+		log.Errorf("failed to track rate limit key '%v': %v", key, err)
+	}
+	delay, err := bs.Consume(1)
+	if err != nil {
+		return 0
+	}
+	return delay
+}
+
+// key returns the key the request is limited by, requests missing the header or claim share the same key
+func (l *rateLimiter) key(req *http.Request) string {
+	switch k := l.settings.Key; {
+	case strings.HasPrefix(k, engine.RateLimitKeyHeader):
+		return req.Header.Get(strings.TrimPrefix(k, engine.RateLimitKeyHeader))
+	case strings.HasPrefix(k, engine.RateLimitKeyClaim):
+		return bearerClaim(req, strings.TrimPrefix(k, engine.RateLimitKeyClaim))
+	default:
+		if len(l.trusted) == 0 {
+			return plugin.ClientIP(req)
+		}
+		return realClientIP(req, l.trusted)
+	}
+}
+
+// bearerClaim returns the claim of the JWT from the Authorization header. The token is not verified, the
+// limiter goes in front of the middlewares, so any client can send any claim and spread its requests over
+// the keys of its choice
+func bearerClaim(req *http.Request, name string) string {
+	const prefix = "Bearer "
+	h := req.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	parts := strings.Split(strings.TrimSpace(h[len(prefix):]), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return ""
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	v, ok := claims[name]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
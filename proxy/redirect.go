@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpsRedirect answers every request with the permanent redirect to the same host, path and query over https
+type httpsRedirect struct {
+	// port is put in the location unless it is 0 or the default https port
+	port int
+}
+
+func (h *httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if host == "" {
+		http.Error(w, "Host header is required", http.StatusBadRequest)
+		return
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if h.port != 0 && h.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(h.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
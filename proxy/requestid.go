@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// requestIDMaxLen limits the ids supplied by the clients, the longer ids are replaced
+const requestIDMaxLen = 256
+
+// requestIDAssigner is the outermost frontend handler, it takes the request id supplied by the client or
+// generates the new one, so the access log, the trace and the backend see the same id
+type requestIDAssigner struct {
+	next    http.Handler
+	header  string
+	pattern *regexp.Regexp
+}
+
+func newRequestIDAssigner(next http.Handler, s engine.HTTPFrontendRequestID) (*requestIDAssigner, error) {
+	pattern, err := s.Regexp()
+	if err != nil {
+		return nil, err
+	}
+	return &requestIDAssigner{next: next, header: s.HeaderName(), pattern: pattern}, nil
+}
+
+func (r *requestIDAssigner) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(r.header)
+	if !r.accept(id) {
+		id = newRequestID()
+	}
+	req.Header.Set(r.header, id)
+	req = plugin.WithRequestID(req, id)
+	r.next.ServeHTTP(&responseHeadersWriter{ResponseWriter: w, header: http.Header{r.header: []string{id}}}, req)
+}
+
+func (r *requestIDAssigner) accept(id string) bool {
+	if id == "" || len(id) > requestIDMaxLen {
+		return false
+	}
+	return r.pattern == nil || r.pattern.MatchString(id)
+}
+
+// newRequestID returns the random version 4 UUID
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
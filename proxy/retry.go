@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/engine"
+)
+
+type attemptKey struct{}
+
+// attempt holds the number of the attempt and the error of the upstream round trip reported by the forwarder
+type attempt struct {
+	n   int
+	err error
+}
+
+// isRetry returns true if the request is replayed after the failed attempt
+func isRetry(req *http.Request) bool {
+	a, ok := req.Context().Value(attemptKey{}).(*attempt)
+	return ok && a.n > 1
+}
+
+// attemptErrorHandler records forwarding errors for the retrier and writes the error response with the next handler
+func attemptErrorHandler(next utils.ErrorHandler) utils.ErrorHandler {
+	return utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		if a, ok := req.Context().Value(attemptKey{}).(*attempt); ok {
+			a.err = err
+		}
+		next.ServeHTTP(w, req, err)
+	})
+}
+
+// retrier replays failed requests against the next server of the load balancer. It gives up
+// retrying once the server write timeout has elapsed to avoid amplifying latency, or once the retry
+// budget of the frontend is exhausted.
+type retrier struct {
+	next     http.Handler
+	settings engine.HTTPFrontendRetry
+	timeout  time.Duration
+	clock    timetools.TimeProvider
+	budget   *retryBudget
+	client   metrics.Client
+	metric   metrics.Metric
+	// exhausted counts the failed requests served without the retry, as the budget is exhausted
+	exhausted metrics.Metric
+}
+
+func newRetrier(f *frontend, next http.Handler, s engine.HTTPFrontendRetry, budget *retryBudget) *retrier {
+	c := f.mux.options.MetricsClient
+	label := f.mux.frontendLabel(f.key.Id)
+	return &retrier{
+		next:      next,
+		settings:  s,
+		timeout:   f.mux.options.WriteTimeout,
+		clock:     f.mux.options.TimeProvider,
+		budget:    budget,
+		client:    c,
+		metric:    c.Metric("frontend", label, "retries"),
+		exhausted: c.Metric("frontend", label, "retries", "exhausted"),
+	}
+}
+
+func (r *retrier) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.budget != nil {
+		r.budget.observeRequest()
+	}
+	body, ok, err := r.readBody(req)
+	if err != nil {
+		utils.DefaultHandler.ServeHTTP(w, req, err)
+		return
+	}
+	if !ok {
+		r.next.ServeHTTP(w, req)
+		return
+	}
+
+	start := r.clock.UtcNow()
+	for i := 1; ; i++ {
+		a := &attempt{n: i}
+		outReq := copyRequestWithBody(req, body).WithContext(context.WithValue(req.Context(), attemptKey{}, a))
+		if i >= r.settings.MaxAttempts() {
+			r.next.ServeHTTP(w, outReq)
+			return
+		}
+
+		rw := &retryWriter{
+			w:      w,
+			header: make(http.Header),
+			shouldRetry: func(code int) bool {
+				if r.timeout > 0 && r.clock.UtcNow().Sub(start) >= r.timeout {
+					return false
+				}
+				if !r.shouldRetry(code, a.err) {
+					return false
+				}
+				if r.budget != nil && !r.budget.withdraw() {
+					log.Warningf("retry budget exhausted, Request(%v %v) is not retried, err: %v", req.Method, req.URL, a.err)
+					r.client.Inc(r.exhausted, 1, 1)
+					return false
+				}
+				return true
+			},
+		}
+		r.next.ServeHTTP(rw, outReq)
+		if !rw.retry {
+			return
+		}
+		// the retries are counted by the metric, they are logged at debug level so the failing upstream
+		// does not flood the log
+		log.Debugf("retry Request(%v %v) attempt %v, err: %v", req.Method, req.URL, i+1, a.err)
+		r.client.Inc(r.metric, 1, 1)
+	}
+}
+
+// readBody reads the request body into memory if it can be replayed, otherwise
+// request body is left intact and false is returned
+func (r *retrier) readBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	limit := r.settings.BodyLimit()
+	if req.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	// Body of unknown size turned out to be too large, pass it without retries
+	if int64(len(body)) > limit {
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+func (r *retrier) shouldRetry(code int, err error) bool {
+	if err != nil {
+		if e, ok := err.(*net.OpError); ok && e.Op == "dial" {
+			return r.settings.RetryOn(engine.RetryOnConnectFailure)
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return r.settings.RetryOn(engine.RetryOnTimeout)
+		}
+		// the request could have reached the server, it is not safe to replay it
+		return false
+	}
+	return code >= http.StatusInternalServerError && r.settings.RetryOn(engine.RetryOn5xx)
+}
+
+func copyRequestWithBody(req *http.Request, body []byte) *http.Request {
+	o := *req
+	o.Header = make(http.Header)
+	utils.CopyHeaders(o.Header, req.Header)
+	if body == nil {
+		o.Body = http.NoBody
+		o.ContentLength = 0
+	} else {
+		o.Body = ioutil.NopCloser(bytes.NewReader(body))
+		o.ContentLength = int64(len(body))
+	}
+	o.TransferEncoding = nil
+	return &o
+}
+
+// retryWriter decides whether to retry the request once the response code is known. The response
+// of the retried attempt is discarded, otherwise it is passed to the underlying writer as is.
+type retryWriter struct {
+	w           http.ResponseWriter
+	header      http.Header
+	shouldRetry func(code int) bool
+	wroteHeader bool
+	retry       bool
+}
+
+func (rw *retryWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *retryWriter) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	if rw.shouldRetry(code) {
+		rw.retry = true
+		return
+	}
+	utils.CopyHeaders(rw.w.Header(), rw.header)
+	rw.w.WriteHeader(code)
+}
+
+func (rw *retryWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.retry {
+		return len(b), nil
+	}
+	return rw.w.Write(b)
+}
+
+func (rw *retryWriter) Flush() {
+	if rw.retry {
+		return
+	}
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes the connection to the upgraded request, the hijacked attempt is never retried
+func (rw *retryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.w)
+	}
+	if rw.retry {
+		return nil, nil, fmt.Errorf("the response is discarded for the retry")
+	}
+	rw.wroteHeader = true
+	return h.Hijack()
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mailgun/timetools"
+	"github.com/vulcand/vulcand/engine"
+)
+
+// retryBudgetBuckets is the amount of the buckets the sliding window of the retry budget is split into
+const retryBudgetBuckets = 10
+
+// retryBudget caps the retries of the frontend at the share of its requests over the sliding window. It is shared
+// by the load balancers of the frontend and kept across the rebuilds as long as the settings are the same, so the
+// counters survive the changes of the servers.
+type retryBudget struct {
+	mtx      sync.Mutex
+	settings engine.HTTPFrontendRetryBudget
+	clock    timetools.TimeProvider
+	// bucket is the time span counted by every bucket, the oldest bucket is dropped as the window slides
+	bucket  time.Duration
+	buckets [retryBudgetBuckets]retryBudgetBucket
+	current int
+	start   time.Time
+}
+
+type retryBudgetBucket struct {
+	requests int64
+	retries  int64
+}
+
+func newRetryBudget(s engine.HTTPFrontendRetryBudget, clock timetools.TimeProvider) *retryBudget {
+	bucket := s.WindowDuration() / retryBudgetBuckets
+	if bucket <= 0 {
+		bucket = time.Nanosecond
+	}
+	return &retryBudget{
+		settings: s,
+		clock:    clock,
+		bucket:   bucket,
+		start:    clock.UtcNow(),
+	}
+}
+
+// observeRequest counts the request of the frontend, the retries of the request are not counted
+func (b *retryBudget) observeRequest() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.advance()
+	b.buckets[b.current].requests++
+}
+
+// withdraw takes the retry from the budget, false means the budget is exhausted and the request is not retried
+func (b *retryBudget) withdraw() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.advance()
+	requests, retries := b.totals()
+	if float64(retries) >= b.allowance(requests) {
+		return false
+	}
+	b.buckets[b.current].retries++
+	return true
+}
+
+// utilization returns the share of the budget taken by the retries within the window in percents
+func (b *retryBudget) utilization() int64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.advance()
+	requests, retries := b.totals()
+	allowance := b.allowance(requests)
+	if allowance == 0 {
+		if retries == 0 {
+			return 0
+		}
+		return 100
+	}
+	return int64(float64(retries) * 100 / allowance)
+}
+
+func (b *retryBudget) allowance(requests int64) float64 {
+	a := float64(requests) * b.settings.Ratio
+	if min := float64(b.settings.MinRetries); a < min {
+		return min
+	}
+	return a
+}
+
+func (b *retryBudget) totals() (int64, int64) {
+	var requests, retries int64
+	for _, bk := range b.buckets {
+		requests += bk.requests
+		retries += bk.retries
+	}
+	return requests, retries
+}
+
+// advance moves the current bucket to the present time dropping the buckets that have left the window
+func (b *retryBudget) advance() {
+	elapsed := b.clock.UtcNow().Sub(b.start) / b.bucket
+	if elapsed <= 0 {
+		return
+	}
+	b.start = b.start.Add(elapsed * b.bucket)
+	if elapsed > retryBudgetBuckets {
+		elapsed = retryBudgetBuckets
+	}
+	for i := time.Duration(0); i < elapsed; i++ {
+		b.current = (b.current + 1) % retryBudgetBuckets
+		b.buckets[b.current] = retryBudgetBucket{}
+	}
+}
@@ -0,0 +1,23 @@
+//go:build linux && (386 || amd64 || arm || arm64 || mips64 || mips64le || mipsle || ppc64 || ppc64le || s390x || sparc64)
+// +build linux
+// +build 386 amd64 arm arm64 mips64 mips64le mipsle ppc64 ppc64le s390x sparc64
+
+package proxy
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortControl sets SO_REUSEPORT on the socket before it is bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
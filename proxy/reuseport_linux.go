@@ -0,0 +1,11 @@
+//go:build linux && (arm64 || mips64 || mips64le || mipsle || ppc64 || ppc64le || s390x || sparc64)
+// +build linux
+// +build arm64 mips64 mips64le mipsle ppc64 ppc64le s390x sparc64
+
+package proxy
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const soReusePort = unix.SO_REUSEPORT
@@ -0,0 +1,9 @@
+//go:build linux && (386 || amd64 || arm)
+// +build linux
+// +build 386 amd64 arm
+
+package proxy
+
+// soReusePort is SO_REUSEPORT of the architectures above, the vendored golang.org/x/sys/unix does not define
+// it for them
+const soReusePort = 0xf
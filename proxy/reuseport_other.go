@@ -0,0 +1,14 @@
+//go:build !linux || !(386 || amd64 || arm || arm64 || mips64 || mips64le || mipsle || ppc64 || ppc64le || s390x || sparc64)
+// +build !linux !386,!amd64,!arm,!arm64,!mips64,!mips64le,!mipsle,!ppc64,!ppc64le,!s390x,!sparc64
+
+package proxy
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// reusePortControl fails the bind, the port reuse is supported on linux only
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("port reuse is not supported on this platform, can not bind %v", address)
+}
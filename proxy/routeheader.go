@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// routeHeader adds the header with the ids of the frontend and the backend to the request forwarded to the backend.
+// It is a part of the forward step, so the mirrored and the canary requests carry the backend they go to.
+type routeHeader struct {
+	next     http.Handler
+	header   string
+	value    string
+	override bool
+}
+
+// newRouteHeader returns the forwarder adding the route header of the frontend, or the route header of the proxy
+// if the frontend has none, and the forwarder as is if both are off
+func newRouteHeader(next http.Handler, frontendId, backendId string, s, global *engine.HTTPFrontendRouteHeader) http.Handler {
+	if s == nil {
+		s = global
+	}
+	if s == nil || s.Disabled {
+		return next
+	}
+	return &routeHeader{
+		next:     next,
+		header:   s.HeaderName(),
+		value:    fmt.Sprintf("frontend=%v; backend=%v", frontendId, backendId),
+		override: s.Override,
+	}
+}
+
+func (r *routeHeader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if _, ok := req.Header[r.header]; !ok || r.override {
+		req.Header.Set(r.header, r.value)
+	}
+	r.next.ServeHTTP(w, req)
+}
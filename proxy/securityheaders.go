@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// securityHeaders are the headers the hosts set on the responses to the TLS requests. They are guarded by their own
+// lock like the error pages, so the responses do not wait for the configuration changes holding the mux lock.
+type securityHeaders struct {
+	mtx   sync.RWMutex
+	hosts map[string]http.Header
+	// folded holds the headers by the lower case host names, it is rebuilt on the changes, so the requests
+	// find the host in the different case without scanning the hosts
+	folded map[string]http.Header
+}
+
+func newSecurityHeaders() *securityHeaders {
+	return &securityHeaders{hosts: make(map[string]http.Header), folded: make(map[string]http.Header)}
+}
+
+func (s *securityHeaders) upsertHost(h engine.Host) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if h.Settings.SecurityHeaders == nil {
+		delete(s.hosts, h.Name)
+	} else {
+		s.hosts[h.Name] = h.Settings.SecurityHeaders.Header()
+	}
+	s.fold()
+}
+
+func (s *securityHeaders) deleteHost(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.hosts, name)
+	s.fold()
+}
+
+// fold rebuilds the lower case index of the hosts, the host named in lower case wins over the other
+// hosts differing only in case, the caller holds the lock
+func (s *securityHeaders) fold() {
+	folded := make(map[string]http.Header, len(s.hosts))
+	for name, h := range s.hosts {
+		key := strings.ToLower(name)
+		if _, ok := folded[key]; ok && name != key {
+			continue
+		}
+		folded[key] = h
+	}
+	s.folded = folded
+}
+
+// find returns the headers of the request host, host names are matched case-insensitively and the exact hosts
+// take precedence over the wildcard ones
+func (s *securityHeaders) find(req *http.Request) http.Header {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if h := s.lookup(host); h != nil {
+		return h
+	}
+	return s.lookup(wildcardHost(host))
+}
+
+func (s *securityHeaders) lookup(name string) http.Header {
+	if name == "" {
+		return nil
+	}
+	if h, ok := s.hosts[name]; ok {
+		return h
+	}
+	return s.folded[strings.ToLower(name)]
+}
+
+// wrap returns the handler setting the security headers of the request host on the responses to the TLS requests
+func (s *securityHeaders) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		header := s.find(req)
+		if header == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(&responseHeadersWriter{ResponseWriter: w, header: header}, req)
+	})
+}
+
+// responseHeadersWriter sets the headers right before the response is written, so they replace the headers
+// of the same name copied from the backend response
+type responseHeadersWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+func (sw *responseHeadersWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.wroteHeader = true
+		for k, v := range sw.header {
+			sw.ResponseWriter.Header()[k] = append([]string(nil), v...)
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *responseHeadersWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *responseHeadersWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the upgraded connections pass through, the upgrade response is written by the backend
+func (sw *responseHeadersWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", sw.ResponseWriter)
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/plugin"
+)
+
+// shared keeps the limits the muxes of the workers share, so the bulkheads, the rate limits, the retry budgets and
+// the connection limits of the listeners and the middlewares keeping the limits apply to the proxy as a whole and not to every mux. The mux run on its own
+// has the limits of its own. The limits are created by the first mux applying the settings and are taken by the
+// other ones as long as the settings stay the same.
+type shared struct {
+	mtx    sync.Mutex
+	limits map[string]interface{}
+	// followers get the health of the servers checked by the first mux of the workers, the muxes following it
+	// do not probe the servers on their own
+	followers []func(backendId string, health map[string]serverHealth)
+}
+
+func newShared() *shared {
+	return &shared{limits: make(map[string]interface{})}
+}
+
+// limit returns the limit kept under the key if keep accepts it, otherwise the limit made by create replaces it
+func (s *shared) limit(key string, keep func(interface{}) bool, create func() (interface{}, error)) (interface{}, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if v, ok := s.limits[key]; ok && keep(v) {
+		return v, nil
+	}
+	v, err := create()
+	if err != nil {
+		return nil, err
+	}
+	s.limits[key] = v
+	return v, nil
+}
+
+// forget drops the limits of the deleted frontend or listener
+func (s *shared) forget(keys ...string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, key := range keys {
+		delete(s.limits, key)
+	}
+}
+
+// listenerConns returns the counter of the connections open to the listener
+func (s *shared) listenerConns(id string) *int64 {
+	v, _ := s.limit(listenerConnsKey(id), func(interface{}) bool { return true },
+		func() (interface{}, error) { return new(int64), nil })
+	return v.(*int64)
+}
+
+// follow registers the mux following the health checks of the first mux
+func (s *shared) follow(fn func(backendId string, health map[string]serverHealth)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.followers = append(s.followers, fn)
+}
+
+// publishHealth passes the health of the servers of the backend to the followers, it is called without holding
+// the mux lock, as the followers take the locks of their own muxes
+func (s *shared) publishHealth(backendId string, health map[string]serverHealth) {
+	s.mtx.Lock()
+	followers := s.followers
+	s.mtx.Unlock()
+
+	for _, fn := range followers {
+		fn(backendId, health)
+	}
+}
+
+// sharedMiddleware returns the handler of the middleware keeping the limits passing the requests to next. The handler
+// of the middleware is built once for the muxes and kept until the middleware is replaced by the update, the muxes
+// are passed the same middleware instance.
+func (s *shared) sharedMiddleware(frontendId string, m engine.Middleware, next http.Handler) (http.Handler, error) {
+	comparable := reflect.TypeOf(m.Middleware).Comparable()
+	v, err := s.limit(middlewareKey(frontendId, m.Id),
+		func(v interface{}) bool { return comparable && v.(*sharedHandler).middleware == m.Middleware },
+		func() (interface{}, error) { return newSharedHandler(m.Middleware) })
+	if err != nil {
+		return nil, err
+	}
+	return v.(*sharedHandler).wrap(next), nil
+}
+
+// sharesLimits tells whether the handler of the middleware is shared by the muxes
+func sharesLimits(m plugin.Middleware) bool {
+	l, ok := m.(plugin.Limiter)
+	return ok && l.SharesLimits()
+}
+
+// nextHandlerKey is the request context key of the handler the shared middleware handler passes the request to
+type nextHandlerKey struct{}
+
+// sharedHandler is the middleware handler shared by the muxes, it is built with the next handler taken from
+// the request context, so every mux passes the requests on to its own chain
+type sharedHandler struct {
+	middleware plugin.Middleware
+	handler    http.Handler
+}
+
+func newSharedHandler(m plugin.Middleware) (*sharedHandler, error) {
+	h, err := m.NewHandler(http.HandlerFunc(serveNext))
+	if err != nil {
+		return nil, err
+	}
+	return &sharedHandler{middleware: m, handler: h}, nil
+}
+
+// wrap returns the handler of the mux chain passing the requests through the shared handler to next
+func (s *sharedHandler) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.handler.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), nextHandlerKey{}, next)))
+	})
+}
+
+func serveNext(w http.ResponseWriter, req *http.Request) {
+	next, ok := req.Context().Value(nextHandlerKey{}).(http.Handler)
+	if !ok {
+		log.Errorf("shared middleware handler has passed on the request without its context")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	next.ServeHTTP(w, req)
+}
+
+func bulkheadKey(id string) string        { return "bulkhead/" + id }
+func rateLimiterKey(id string) string     { return "ratelimit/" + id }
+func retryBudgetKey(id string) string     { return "retrybudget/" + id }
+func listenerConnsKey(id string) string   { return "conns/" + id }
+func middlewareKey(fid, id string) string { return "middleware/" + fid + "/" + id }
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// slowStartScale multiplies server weights in the load balancer, so the ramping weights have enough steps
+	// between near zero and the full weight
+	slowStartScale = 100
+	// slowStartSteps is the amount of times the weights are updated during the ramp
+	slowStartSteps = 20
+)
+
+// slowStart ramps up weights of the servers added to the backend or recovered from health check failures.
+// Ramps are guarded by the mux lock.
+type slowStart struct {
+	b        *backend
+	settings engine.SlowStartSettings
+	// started holds the ramp start times of the servers that have not reached the full weight yet
+	started map[string]time.Time
+	stopC   chan struct{}
+}
+
+func newSlowStart(b *backend, s engine.SlowStartSettings, started map[string]time.Time) *slowStart {
+	if started == nil {
+		started = make(map[string]time.Time)
+	}
+	return &slowStart{
+		b:        b,
+		settings: s,
+		started:  started,
+		stopC:    make(chan struct{}),
+	}
+}
+
+func (s *slowStart) String() string {
+	return fmt.Sprintf("%v slowstart(duration=%v)", s.b, s.settings.Duration)
+}
+
+func (s *slowStart) start() {
+	s.b.mux.wg.Add(1)
+	go s.run()
+}
+
+// stop signals the ramp goroutine to exit, it does not wait for it as the caller
+// is holding the mux lock that the goroutine may be waiting for.
+func (s *slowStart) stop() {
+	close(s.stopC)
+}
+
+func (s *slowStart) run() {
+	defer s.b.mux.wg.Done()
+
+	ticker := time.NewTicker(s.settings.Duration / slowStartSteps)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-s.b.mux.stopC:
+			return
+		case <-ticker.C:
+			s.update()
+		}
+	}
+}
+
+// begin starts the ramp of the server, the ramp in progress starts over
+func (s *slowStart) begin(id string) {
+	s.started[id] = s.b.mux.options.TimeProvider.UtcNow()
+}
+
+func (s *slowStart) forget(id string) {
+	delete(s.started, id)
+}
+
+// update applies the ramped weights to the frontends, servers that have reached the full weight are done
+func (s *slowStart) update() {
+	s.b.mux.mtx.Lock()
+	defer s.b.mux.mtx.Unlock()
+
+	// The ramp could have been stopped while we were waiting for the lock
+	select {
+	case <-s.stopC:
+		return
+	default:
+	}
+	if len(s.started) == 0 {
+		return
+	}
+	now := s.b.mux.options.TimeProvider.UtcNow()
+	for id, t := range s.started {
+		if now.Sub(t) >= s.settings.Duration {
+			delete(s.started, id)
+			log.Infof("%v server %v has reached the full weight", s, id)
+		}
+	}
+	if err := s.b.updateFrontends(); err != nil {
+		log.Errorf("%v failed to update frontends: %v", s, err)
+	}
+}
+
+// weight returns the load balancer weight of the server, the weight of the ramping server grows linearly
+// from 1 to the scaled server weight
+func (s *slowStart) weight(srv engine.Server) int {
+	full := srv.LBWeight() * slowStartScale
+	t, ok := s.started[srv.Id]
+	if !ok {
+		return full
+	}
+	elapsed := s.b.mux.options.TimeProvider.UtcNow().Sub(t)
+	if elapsed >= s.settings.Duration {
+		return full
+	}
+	w := int(int64(full) * int64(elapsed) / int64(s.settings.Duration))
+	if w < 1 {
+		return 1
+	}
+	return w
+}
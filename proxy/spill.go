@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/mailgun/multibuf"
+	"github.com/vulcand/oxy/buffer"
+)
+
+// spillKey is the request context key of the guarded body of the buffered requests
+type spillKey struct{}
+
+// spillGuard keeps the buffer from leaving open the temporary files the bodies over the memory limit spill to.
+// The buffer does not close the file of the request body if reading the body fails, so the guard ends the body
+// at the total limit or at the read error instead and the spillCheck rejects the request the buffer passes on.
+type spillGuard struct {
+	next http.Handler
+	max  int64
+}
+
+func (g *spillGuard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		g.next.ServeHTTP(w, req)
+		return
+	}
+	body := &guardedBody{ReadCloser: req.Body, max: g.max, left: g.max}
+	req = req.WithContext(context.WithValue(req.Context(), spillKey{}, body))
+	req.Body = body
+	g.next.ServeHTTP(w, req)
+}
+
+// spillCheck goes behind the buffer. It rejects the requests whose bodies were cut by the spillGuard. The buffer
+// removes the file of the response body only once it has read the body, which it does not do for the responses
+// without the length, so the check sets the length of the bodies written by the handlers that do not set it, as
+// the forwarder does.
+type spillCheck struct {
+	next http.Handler
+}
+
+func (s *spillCheck) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sw := &spillWriter{ResponseWriter: w, req: req, code: http.StatusOK}
+	if body, ok := req.Context().Value(spillKey{}).(*guardedBody); ok && body.err != nil {
+		(&buffer.SizeErrHandler{}).ServeHTTP(sw, req, body.err)
+	} else {
+		s.next.ServeHTTP(sw, req)
+	}
+	h := w.Header()
+	if sw.written != 0 && h.Get("Content-Length") == "" && h.Get("Transfer-Encoding") == "" {
+		h.Set("Content-Length", strconv.FormatInt(sw.written, 10))
+	}
+}
+
+// guardedBody reports the end of the body instead of the read errors and of the bytes past the limit,
+// keeping the error for the spillCheck
+type guardedBody struct {
+	io.ReadCloser
+	max  int64
+	left int64
+	err  error
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, io.EOF
+	}
+	if b.max <= 0 {
+		n, err := b.ReadCloser.Read(p)
+		return n, b.end(err)
+	}
+	if b.left == 0 {
+		// read one byte past the limit to tell the body of the exact limit size from the larger one
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n > 0 {
+			b.err = &multibuf.MaxSizeReachedError{MaxSize: b.max}
+			return 0, io.EOF
+		}
+		return 0, b.end(err)
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, b.end(err)
+}
+
+func (b *guardedBody) end(err error) error {
+	if err != nil && err != io.EOF {
+		b.err = err
+		return io.EOF
+	}
+	return err
+}
+
+// spillWriter counts the written bytes and drops the bodies of the responses to HEAD requests and of the
+// responses that can not have a body, the buffer does not read them
+type spillWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	code    int
+	written int64
+}
+
+func (w *spillWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *spillWriter) Write(p []byte) (int, error) {
+	if !w.expectBody() {
+		return len(p), nil
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *spillWriter) expectBody() bool {
+	if w.req.Method == "HEAD" {
+		return false
+	}
+	return (w.code < 100 || w.code >= 200) && w.code != http.StatusNoContent && w.code != http.StatusNotModified
+}
@@ -2,17 +2,23 @@ package proxy
 
 import (
 	"crypto/tls"
-
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ocsp"
 
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/stapler"
 
 	log "github.com/Sirupsen/logrus"
-	proxyproto "github.com/armon/go-proxyproto"
 	"github.com/mailgun/manners"
 	"github.com/vulcand/route"
 )
@@ -20,20 +26,46 @@ import (
 // srv contains all that is necessary to run the HTTP(s) server. server does not work on its own,
 // it heavily depends on MuxServer and acts as its internal data structure.
 type srv struct {
-	defaultHost string
-	mux         *mux
-	srv         *manners.GracefulServer
-	proxy       http.Handler
-	listener    engine.Listener
-	options     Options
-	state       int
+	mux      *mux
+	srv      *manners.GracefulServer
+	proxy    http.Handler
+	listener engine.Listener
+	state    int
+	// socket is the listening socket the listeners of the server wrap, its file is passed to the reloaded
+	// server and to the child process on hot restart
+	socket net.Listener
+	// conns tracks client connections to close the ones left after the drain timeout
+	conns *connSet
+	// doneC is closed when the current server stops serving and all its connections are closed
+	doneC chan struct{}
+	// passing counts the connections the TCP listener passes to the backend servers
+	passing sync.WaitGroup
+	// tlsConfig is the *tls.Config of the handshakes, it is swapped in place on the certificate updates, so
+	// the socket and the open connections are kept
+	tlsConfig atomic.Value
+	// clientAuth is the *clientAuthHosts of the current TLS config
+	clientAuth atomic.Value
+	// stapled are the key pairs of the current TLS config stapled by the stapler
+	stapled map[stapledKey]stapledKeyPair
+}
+
+// stapledKey is the i-th key pair of the host
+type stapledKey struct {
+	host string
+	i    int
+}
+
+// stapledKeyPair is the key pair and the OCSP settings it was stapled with
+type stapledKeyPair struct {
+	keyPair engine.KeyPair
+	ocsp    engine.OCSPSettings
 }
 
 func (s *srv) GetFile() (*FileDescriptor, error) {
 	if !s.hasListeners() || s.srv == nil {
 		return nil, nil
 	}
-	file, err := s.srv.GetFile()
+	file, err := socketFile(s.socket)
 	if err != nil {
 		return nil, err
 	}
@@ -48,26 +80,16 @@ func (s *srv) String() string {
 }
 
 func newSrv(m *mux, l engine.Listener) (*srv, error) {
-	defaultHost := ""
-	keyPairs := make(map[engine.HostKey]engine.KeyPair)
-	for hk, h := range m.hosts {
-		if h.Settings.KeyPair != nil {
-			keyPairs[hk] = *h.Settings.KeyPair
-		}
-		if h.Settings.Default {
-			defaultHost = hk.Name
-		}
-	}
-	h, err := scopedHandler(l.Scope, m.router)
+	h, err := listenerHandler(m, l)
 	if err != nil {
 		return nil, err
 	}
 	return &srv{
-		mux:         m,
-		proxy:       h,
-		listener:    l,
-		defaultHost: defaultHost,
-		state:       srvStateInit,
+		mux:      m,
+		proxy:    h,
+		listener: l,
+		state:    srvStateInit,
+		conns:    newConnSet(m.shared.listenerConns(l.Id)),
 	}, nil
 }
 
@@ -75,10 +97,16 @@ func (s *srv) isTLS() bool {
 	return s.listener.Protocol == engine.HTTPS
 }
 
+func (s *srv) isTCP() bool {
+	return s.listener.Protocol == engine.TCP
+}
+
 func (s *srv) isProxyProto() bool {
-	return s.listener.ProxyProtocol == engine.PROXY_PROTO_V1
+	return s.listener.ProxyProtocol == engine.PROXY_PROTO_V1 || s.listener.ProxyProtocol == engine.PROXY_PROTO_V2
 }
 
+// updateListener applies the settings of the listener with the same address, the mux moves the listeners
+// changing the address to the new socket
 func (s *srv) updateListener(l engine.Listener) error {
 	// We can not listen for different protocols on the same socket
 	if s.listener.Protocol != l.Protocol {
@@ -88,14 +116,33 @@ func (s *srv) updateListener(l engine.Listener) error {
 		return nil
 	}
 
+	// the changes of the TLS settings only are applied to the handshakes, the server keeps running
+	other := l
+	other.Settings = s.listener.Settings
+	if l.Scope == s.listener.Scope && (&other).SettingsEquals(&s.listener) {
+		log.Infof("%v update TLS settings %v", s, &l)
+		prev := s.listener
+		s.listener = l
+		if err := s.reloadTLS(); err != nil {
+			s.listener = prev
+			return err
+		}
+		return nil
+	}
+
 	log.Infof("%v update %v", s, &l)
-	handler, err := scopedHandler(l.Scope, s.mux.router)
+	handler, err := listenerHandler(s.mux, l)
 	if err != nil {
 		return err
 	}
 	s.proxy = handler
 	s.listener = l
 
+	if s.hasListeners() {
+		if err := chmodSocket(l); err != nil {
+			return err
+		}
+	}
 	return s.reload()
 }
 
@@ -115,29 +162,18 @@ func (s *srv) takeFile(f *FileDescriptor) error {
 		return err
 	}
 
-	tcpListener, ok := listener.(*net.TCPListener)
-	if !ok {
-		return fmt.Errorf(`%s failed to take file descriptor - I need a TCP listener, 
-but the file descriptor that was given corresponded to a listener of type %T. More about file descriptor: %s`, listener, s, f)
+	if listener, err = keepAlive(listener); err != nil {
+		return fmt.Errorf("%s failed to take file descriptor %s: %v", s, f, err)
 	}
-
-	listener = &manners.TCPKeepAliveListener{TCPListener: tcpListener}
-
-	if s.isProxyProto() {
-		listener = &proxyproto.Listener{
-			Listener:           listener,
-			ProxyHeaderTimeout: s.options.ReadTimeout,
-		}
+	if err := chmodSocket(s.listener); err != nil {
+		return err
 	}
-
-	if s.isTLS() {
-		config, err := s.newTLSConfig()
-		if err != nil {
-			return err
-		}
-		listener = manners.NewTLSListener(listener, config)
+	socket := listener
+	if listener, err = s.wrapSocket(socket); err != nil {
+		return err
 	}
 
+	s.socket = socket
 	s.srv = manners.NewWithOptions(
 		manners.Options{
 			Server:       s.newHTTPServer(),
@@ -149,12 +185,43 @@ but the file descriptor that was given corresponded to a listener of type %T. Mo
 }
 
 func (s *srv) newHTTPServer() *http.Server {
+	handler := s.proxy
+	if s.isTLS() {
+		handler = &clientAuthGuard{srv: s, next: handler}
+	}
 	return &http.Server{
-		Handler:        s.proxy,
-		ReadTimeout:    s.options.ReadTimeout,
-		WriteTimeout:   s.options.WriteTimeout,
-		MaxHeaderBytes: s.options.MaxHeaderBytes,
+		Handler:        handler,
+		ReadTimeout:    s.mux.options.ReadTimeout,
+		WriteTimeout:   s.mux.options.WriteTimeout,
+		IdleTimeout:    s.idleTimeout(),
+		MaxHeaderBytes: s.maxHeaderBytes(),
+		ConnState:      s.limitConns(),
+	}
+}
+
+// idleTimeout returns the idle timeout of the listener, falling back to the one of the proxy
+func (s *srv) idleTimeout() time.Duration {
+	if d := s.listener.IdleTimeoutDuration(); d != 0 {
+		return d
 	}
+	return s.mux.options.IdleTimeout
+}
+
+// maxHeaderBytes returns the request header limit of the listener, falling back to the one of the proxy
+func (s *srv) maxHeaderBytes() int {
+	if s.listener.MaxHeaderBytes != 0 {
+		return s.listener.MaxHeaderBytes
+	}
+	return s.mux.options.MaxHeaderBytes
+}
+
+// nextProtos returns the protocols the listener offers with ALPN, HTTP/2 is preferred unless it is disabled.
+// The HTTP server serves the connections negotiating h2 with its bundled HTTP/2 server.
+func (s *srv) nextProtos() []string {
+	if s.listener.DisableHTTP2 {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
 }
 
 func (s *srv) reload() error {
@@ -162,120 +229,361 @@ func (s *srv) reload() error {
 		return nil
 	}
 
-	gracefulServer, err := s.srv.HijackListener(s.newHTTPServer(), func(listener net.Listener) (net.Listener, error) {
-		listener = &manners.TCPKeepAliveListener{TCPListener: listener.(*net.TCPListener)}
+	// the reloaded server listens on the copy of the socket, the current one is closed with the current server
+	file, err := socketFile(s.socket)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return err
+	}
+	socket, err := keepAlive(listener)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if listener, err = s.wrapSocket(socket); err != nil {
+		socket.Close()
+		return err
+	}
+	gracefulServer := manners.NewWithOptions(
+		manners.Options{
+			Server:       s.newHTTPServer(),
+			Listener:     listener,
+			StateHandler: s.mux.incomingConnTracker.RegisterStateChange,
+		})
+	s.goServe(gracefulServer)
 
-		if s.isProxyProto() {
-			listener = &proxyproto.Listener{
-				Listener:           listener,
-				ProxyHeaderTimeout: s.options.ReadTimeout,
-			}
+	s.srv.Close()
+	s.srv = gracefulServer
+	s.socket = socket
+	return nil
+}
+
+// wrapSocket wraps the listening socket with the listeners tracking the connections, reading the proxy protocol
+// headers, terminating TLS and passing the TCP connections, as the listener settings ask
+func (s *srv) wrapSocket(listener net.Listener) (net.Listener, error) {
+	listener = trackConns(listener, s.mux.incomingConnTracker, s.mux.options.TimeProvider)
+
+	var err error
+	if s.isProxyProto() {
+		if listener, err = newProxyProtoListener(listener, s.listener, s.mux.options.ReadTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if s.isTLS() {
+		if listener, err = s.newTLSListener(listener); err != nil {
+			return nil, err
 		}
+	}
+	if s.isTCP() {
+		listener = newPassthroughListener(s, listener)
+	}
+	return listener, nil
+}
 
-		if s.isTLS() {
-			config, err := s.newTLSConfig()
-			if err != nil {
-				return nil, err
-			}
-			listener = manners.NewTLSListener(listener, config)
+// shutdown stops accepting new connections and lets in-flight requests finish. If the drain timeout
+// is set, connections that are still open after the deadline are closed, otherwise the server
+// waits for them indefinitely.
+func (s *srv) shutdown(drainTimeout time.Duration) {
+	var deadline time.Time
+	if drainTimeout > 0 {
+		deadline = time.Now().Add(drainTimeout)
+	}
+	s.shutdownBy(deadline)
+}
+
+// shutdownBy stops accepting new connections and closes the connections still open at the deadline, zero deadline
+// waits for them indefinitely. It returns true if the server was serving and its connections are draining.
+func (s *srv) shutdownBy(deadline time.Time) bool {
+	if s.srv == nil {
+		return false
+	}
+	s.srv.Close()
+	if s.doneC == nil {
+		return false
+	}
+	if deadline.IsZero() {
+		return true
+	}
+
+	doneC := s.drained()
+	s.mux.wg.Add(1)
+	go func() {
+		defer s.mux.wg.Done()
+
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		select {
+		case <-doneC:
+			log.Infof("%v drained", s)
+		case <-timer.C:
+			closed := s.conns.closeAll()
+			log.Warningf("%v drain deadline %v has passed, force closed %d connections", s, deadline, closed)
 		}
+	}()
+	return true
+}
 
-		return listener, nil
-	})
+// reloadTLS applies the updated certificates, staples and TLS settings to the new handshakes. The config is
+// swapped in place unless the proxy is set to reload the listeners, the open connections keep their sessions.
+func (s *srv) reloadTLS() error {
+	if !s.isServing() || !s.isTLS() {
+		return nil
+	}
+	if s.mux.options.FullTLSReload {
+		return s.reload()
+	}
+	config, hosts, err := s.newTLSConfig()
 	if err != nil {
 		return err
 	}
-	go s.serve(gracefulServer)
-
-	s.srv.Close()
-	s.srv = gracefulServer
+	s.tlsConfig.Store(config)
+	s.clientAuth.Store(hosts)
 	return nil
 }
 
-func (s *srv) shutdown() {
-	if s.srv != nil {
-		s.srv.Close()
+// newTLSListener wraps the listener with the TLS one, the handshakes take the current config
+func (s *srv) newTLSListener(listener net.Listener) (net.Listener, error) {
+	config, hosts, err := s.newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	s.tlsConfig.Store(config)
+	s.clientAuth.Store(hosts)
+	return manners.NewTLSListener(listener, &tls.Config{GetConfigForClient: s.getConfigForClient}), nil
+}
+
+// getConfigForClient returns the current config of the handshake, the config of the host with its own TLS
+// settings if there is one
+func (s *srv) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config := s.tlsConfig.Load().(*tls.Config)
+	if config.GetConfigForClient != nil {
+		if hc, err := config.GetConfigForClient(hello); hc != nil || err != nil {
+			return hc, err
+		}
 	}
+	return config, nil
 }
 
-func (s *srv) newTLSConfig() (*tls.Config, error) {
+// newTLSConfig returns the config of the handshakes and the hosts verifying the client certificates
+func (s *srv) newTLSConfig() (*tls.Config, *clientAuthHosts, error) {
 	config, err := s.listener.TLSConfig()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if config.NextProtos == nil {
-		config.NextProtos = []string{"http/1.1"}
+		config.NextProtos = s.nextProtos()
 	}
 
-	pairs := map[string]tls.Certificate{}
+	stapled := map[stapledKey]stapledKeyPair{}
+	pairs := map[string][]tls.Certificate{}
 	for _, host := range s.mux.hosts {
-		c := host.Settings.KeyPair
-		if c == nil {
+		keyPairs := host.Settings.AllKeyPairs()
+		if len(keyPairs) == 0 {
 			continue
 		}
-		keyPair, err := tls.X509KeyPair(c.Cert, c.Key)
-		if err != nil {
-			return nil, err
-		}
 		if host.Settings.OCSP.Enabled {
 			log.Infof("%v OCSP is enabled for %v, resolvers: %v", s, host, host.Settings.OCSP.Responders)
-			r, err := s.mux.stapler.StapleHost(&host)
+		}
+		certs := make([]tls.Certificate, 0, len(keyPairs))
+		for i, c := range keyPairs {
+			keyPair, err := tls.X509KeyPair(c.Cert, c.Key)
 			if err != nil {
-				log.Warningf("%v failed to staple %v, error %v", s, host, err)
-			} else if r.Response.Status == ocsp.Good || r.Response.Status == ocsp.Revoked {
-				keyPair.OCSPStaple = r.Staple
-			} else {
-				log.Warningf("%s got undefined status from OCSP responder: %v", s, r.Response.Status)
+				return nil, nil, err
+			}
+			if host.Settings.OCSP.Enabled {
+				r, err := s.staple(stapled, &host, i)
+				if err != nil {
+					log.Warningf("%v failed to staple %v key pair %d, error %v", s, host, i, err)
+				} else if r == nil {
+					log.Infof("%v has no staple of %v key pair %d", s, host, i)
+				} else if r.Response.Status == ocsp.Good || r.Response.Status == ocsp.Revoked {
+					keyPair.OCSPStaple = r.Staple
+				} else {
+					log.Warningf("%s got undefined status from OCSP responder: %v", s, r.Response.Status)
+				}
 			}
+			certs = append(certs, keyPair)
 		}
-		pairs[host.Name] = keyPair
+		pairs[host.Name] = certs
 	}
 
-	config.Certificates = make([]tls.Certificate, 0, len(pairs))
-	if s.defaultHost != "" {
-		keyPair, exists := pairs[s.defaultHost]
+	// default host certificates go first, the proxy default certificate is served if there is no default host.
+	// The default host is looked up on every reload, so the hosts can become the default ones at runtime.
+	defaultHost := s.defaultHost()
+	var fallback []tls.Certificate
+	fallbackName := ""
+	if defaultHost != "" {
+		certs, exists := pairs[defaultHost]
 		if !exists {
-			return nil, fmt.Errorf("default host '%s' certificate is not passed", s.defaultHost)
+			return nil, nil, fmt.Errorf("default host '%s' certificate is not passed", defaultHost)
 		}
-		config.Certificates = append(config.Certificates, keyPair)
+		fallback, fallbackName = certs, "host "+defaultHost
+	} else if s.mux.options.DefaultKeyPair != nil {
+		cert, err := s.defaultCertificate(stapled)
+		if err != nil {
+			return nil, nil, err
+		}
+		fallback, fallbackName = []tls.Certificate{*cert}, "the proxy"
 	}
+	config.Certificates = make([]tls.Certificate, 0, len(pairs)+1)
+	config.Certificates = append(config.Certificates, fallback...)
 
-	for h, keyPair := range pairs {
-		if h != s.defaultHost {
-			config.Certificates = append(config.Certificates, keyPair)
+	for h, certs := range pairs {
+		if h != defaultHost {
+			config.Certificates = append(config.Certificates, certs...)
 		}
 	}
 
 	config.BuildNameToCertificate()
-	return config, nil
+	if len(config.Certificates) != 0 {
+		selector := newCertSelector(s.String(), pairs, config.NameToCertificate, fallback, fallbackName)
+		config.GetCertificate = selector.getCertificate
+	}
+
+	// hosts with their own TLS or client auth settings override the listener config for their server names
+	hostConfigs := make(map[string]*tls.Config)
+	clientAuth := &clientAuthHosts{names: make(map[string]bool), defaultHost: strings.ToLower(defaultHost)}
+	for _, host := range s.mux.hosts {
+		certs, ok := pairs[host.Name]
+		if !ok || (host.Settings.TLS == nil && host.Settings.ClientAuth == nil) {
+			continue
+		}
+		hc := config.Clone()
+		hc.Certificates = certs
+		hc.NameToCertificate = nil
+		// the handshake picks the first of the host certificates supported by the client
+		hc.GetCertificate = nil
+		if host.Settings.TLS != nil {
+			// the host carries its private keys, so the error names the host and the field only
+			if err := host.Settings.TLS.Apply(hc); err != nil {
+				return nil, nil, fmt.Errorf("listener %v host %v TLS settings: %v", s.listener.Id, host.Name, err)
+			}
+		}
+		if host.Settings.ClientAuth != nil {
+			if err := host.Settings.ClientAuth.Apply(hc); err != nil {
+				return nil, nil, fmt.Errorf("listener %v host %v ClientAuth settings: %v", s.listener.Id, host.Name, err)
+			}
+			clientAuth.names[strings.ToLower(host.Name)] = true
+		}
+		hostConfigs[strings.ToLower(host.Name)] = hc
+	}
+	if len(hostConfigs) != 0 {
+		defaultHost := strings.ToLower(defaultHost)
+		// clients sending no server name can reach any host with the Host header, so unless the default host has
+		// settings of its own they are held to the strictest min version of the hosts
+		var noSNI *tls.Config
+		for _, hc := range hostConfigs {
+			if hc.MinVersion > config.MinVersion && (noSNI == nil || hc.MinVersion > noSNI.MinVersion) {
+				if noSNI == nil {
+					noSNI = config.Clone()
+				}
+				noSNI.MinVersion = hc.MinVersion
+			}
+		}
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name := strings.ToLower(hello.ServerName)
+			if name == "" {
+				name = defaultHost
+			}
+			if hc, ok := hostConfigs[name]; ok {
+				return hc, nil
+			}
+			if hello.ServerName == "" && noSNI != nil {
+				return noSNI, nil
+			}
+			// nil config makes the handshake proceed with the listener config
+			return hostConfigs[wildcardHost(name)], nil
+		}
+	}
+	s.stapled = stapled
+	return config, clientAuth, nil
+}
+
+// defaultHost returns the name of the host marked as the default one, empty if there is none
+func (s *srv) defaultHost() string {
+	for hk, h := range s.mux.hosts {
+		if h.Settings.Default {
+			return hk.Name
+		}
+	}
+	return ""
+}
+
+// defaultCertificate returns the proxy default certificate, it is stapled if the certificate names
+// the OCSP responders
+func (s *srv) defaultCertificate(stapled map[stapledKey]stapledKeyPair) (*tls.Certificate, error) {
+	kp := s.mux.options.DefaultKeyPair
+	cert, err := tls.X509KeyPair(kp.Cert, kp.Key)
+	if err != nil {
+		return nil, fmt.Errorf("bad default certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad default certificate: %v", err)
+	}
+	if len(leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return &cert, nil
+	}
+	host := defaultCertHost(kp)
+	r, err := s.staple(stapled, &host, 0)
+	if err != nil {
+		log.Warningf("%v failed to staple the default certificate, error %v", s, err)
+	} else if r != nil && r.Response.Status == ocsp.Good || r.Response.Status == ocsp.Revoked {
+		cert.OCSPStaple = r.Staple
+	}
+	return &cert, nil
+}
+
+// staple returns the staple of the i-th key pair of the host and records the key pair in stapled. The stapler
+// staples the key pairs that are new to the server or have changed, the staples of the other ones are taken from
+// the stapler cache, so the reloads do not fetch them again. Nil staple is returned if there is none cached.
+func (s *srv) staple(stapled map[stapledKey]stapledKeyPair, host *engine.Host, i int) (*stapler.StapleResponse, error) {
+	key := stapledKey{host: host.Name, i: i}
+	kp := stapledKeyPair{keyPair: host.Settings.AllKeyPairs()[i], ocsp: host.Settings.OCSP}
+	stapled[key] = kp
+	if prev, ok := s.stapled[key]; ok && prev.keyPair.Equals(&kp.keyPair) && prev.ocsp.Equals(&kp.ocsp) {
+		r, _ := s.mux.stapler.CachedStaple(host, i)
+		return r, nil
+	}
+	return s.mux.stapler.StapleKeyPair(host, i)
+}
+
+// defaultCertHostName keys the staple of the proxy default certificate, it is not a valid host name so it does
+// not clash with the hosts
+const defaultCertHostName = "<default>"
+
+func defaultCertHost(kp *engine.KeyPair) engine.Host {
+	return engine.Host{
+		Name:     defaultCertHostName,
+		Settings: engine.HostSettings{KeyPair: kp, OCSP: engine.OCSPSettings{Enabled: true}},
+	}
 }
 
 func (s *srv) start() error {
 	log.Infof("%s start", s)
 	switch s.state {
 	case srvStateInit:
-		listener, err := net.Listen(s.listener.Address.Network, s.listener.Address.Address)
+		listener, err := listen(s.listener, s.mux.options.ReusePort)
 		if err != nil {
+			if errors.Is(err, syscall.EADDRINUSE) {
+				return &engine.AddressInUseError{Listener: engine.ListenerKey{Id: s.listener.Id}, Address: s.listener.Address}
+			}
 			return err
 		}
-
-		listener = &manners.TCPKeepAliveListener{TCPListener: listener.(*net.TCPListener)}
-
-		if s.isProxyProto() {
-			listener = &proxyproto.Listener{
-				Listener:           listener,
-				ProxyHeaderTimeout: s.options.ReadTimeout,
-			}
+		if listener, err = keepAlive(listener); err != nil {
+			return err
 		}
-
-		if s.isTLS() {
-			config, err := s.newTLSConfig()
-			if err != nil {
-				return err
-			}
-			listener = manners.NewTLSListener(listener, config)
+		socket := listener
+		if listener, err = s.wrapSocket(socket); err != nil {
+			socket.Close()
+			return err
 		}
+		s.socket = socket
 		s.srv = manners.NewWithOptions(
 			manners.Options{
 				Server:       s.newHTTPServer(),
@@ -283,27 +591,137 @@ func (s *srv) start() error {
 				StateHandler: s.mux.incomingConnTracker.RegisterStateChange,
 			})
 		s.state = srvStateActive
-		go s.serve(s.srv)
+		s.goServe(s.srv)
 		return nil
 	case srvStateHijacked:
 		s.state = srvStateActive
-		go s.serve(s.srv)
+		s.goServe(s.srv)
 		return nil
 	}
 	return fmt.Errorf("%v Calling start in unsupported state", s)
 }
 
-func (s *srv) serve(srv *manners.GracefulServer) {
+// goServe starts serving in a separate goroutine, the mux wait group is incremented before,
+// so Stop(true) accounts for the server being started
+func (s *srv) goServe(srv *manners.GracefulServer) {
+	s.mux.wg.Add(1)
+	s.doneC = make(chan struct{})
+	go s.serve(srv, s.doneC)
+}
+
+func (s *srv) serve(srv *manners.GracefulServer, doneC chan struct{}) {
 	log.Infof("%s serve", s)
 
-	s.mux.wg.Add(1)
 	defer s.mux.wg.Done()
+	defer close(doneC)
 
 	srv.ListenAndServe()
 
 	log.Infof("%v stop", s)
 }
 
+// connSet is a set of client connections of the server
+type connSet struct {
+	mtx   sync.Mutex
+	conns map[net.Conn]struct{}
+	// accepted is the total amount of connections tracked by the set
+	accepted int64
+	// listener counts the connections open to the listener by all the servers of the listener, e.g. the ones
+	// of the workers and the draining ones
+	listener *int64
+}
+
+func newConnSet(listener *int64) *connSet {
+	return &connSet{conns: make(map[net.Conn]struct{}), listener: listener}
+}
+
+func (c *connSet) track(conn net.Conn, state http.ConnState) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, tracked := c.conns[conn]
+	switch state {
+	case http.StateHijacked:
+		// the hijacked connection counts until the handler closes it, unless it can't be told when it closes
+		if markHijacked(conn, func() { c.track(conn, http.StateClosed) }) {
+			return
+		}
+		fallthrough
+	case http.StateClosed:
+		if tracked {
+			delete(c.conns, conn)
+			atomic.AddInt64(c.listener, -1)
+		}
+		return
+	case http.StateNew:
+		c.accepted++
+	}
+	if !tracked {
+		c.conns[conn] = struct{}{}
+		atomic.AddInt64(c.listener, 1)
+	}
+}
+
+// listenerSize returns the amount of the connections open to the listener by all the servers of the listener
+func (c *connSet) listenerSize() int {
+	return int(atomic.LoadInt64(c.listener))
+}
+
+func (c *connSet) size() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.conns)
+}
+
+// stats returns the amount of open connections and the total amount of connections accepted
+func (c *connSet) stats() (int, int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.conns), c.accepted
+}
+
+// closeAll closes all tracked connections and returns the amount of connections closed
+func (c *connSet) closeAll() int {
+	c.mtx.Lock()
+	conns := make([]net.Conn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+		delete(c.conns, conn)
+		atomic.AddInt64(c.listener, -1)
+	}
+	c.mtx.Unlock()
+
+	// the connections are closed without holding the lock, the hijacked ones report themselves closed
+	closed := 0
+	for _, conn := range conns {
+		if err := conn.Close(); err == nil {
+			closed++
+		}
+	}
+	return closed
+}
+
+// limitConns returns the connection state hook that closes new connections while the server has the maximum
+// amount of connections open to the listener, the connections of the workers serving the same listener count as
+// well. Connections are counted by the connection sets of the servers, hijacked connections, e.g. WebSockets,
+// count until they are closed.
+func (s *srv) limitConns() func(net.Conn, http.ConnState) {
+	if s.listener.MaxConnections <= 0 {
+		return s.conns.track
+	}
+	id, limit, r := s.listener.Id, s.listener.MaxConnections, s.mux.options.Reporter
+	return func(conn net.Conn, state http.ConnState) {
+		// the server reports new connections before accepting the next one, so the count is exact
+		if state == http.StateNew && s.conns.listenerSize() >= limit {
+			log.Debugf("listener %v has reached %d connections, closing connection from %v", id, limit, conn.RemoteAddr())
+			conn.Close()
+			r.ObserveRejectedConn(id)
+			return
+		}
+		s.conns.track(conn, state)
+	}
+}
+
 type srvState int
 
 const (
@@ -324,6 +742,30 @@ func (s srvState) String() string {
 	return "undefined"
 }
 
+// listenerHandler returns the listener handler, it resolves the client address and answers pending ACME
+// challenges before routing requests
+func listenerHandler(m *mux, l engine.Listener) (http.Handler, error) {
+	if r := l.RedirectToHTTPS; r != nil {
+		var h http.Handler = &httpsRedirect{port: r.Port}
+		if r.ACME && m.options.ACMESolver != nil {
+			h = m.options.ACMESolver.Wrap(h)
+		}
+		return h, nil
+	}
+	h, err := scopedHandler(l.Scope, m.router)
+	if err != nil {
+		return nil, err
+	}
+	if m.options.ACMESolver != nil {
+		h = m.options.ACMESolver.Wrap(h)
+	}
+	h = &clientCertHeaders{next: &clientIPResolver{trusted: m.options.TrustedProxies, next: h}}
+	if l.Protocol == engine.HTTPS && !l.DisableHTTP2 {
+		h = &http2Responses{next: h}
+	}
+	return h, nil
+}
+
 func scopedHandler(scope string, proxy http.Handler) (http.Handler, error) {
 	if scope == "" {
 		return proxy, nil
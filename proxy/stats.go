@@ -2,55 +2,226 @@ package proxy
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/metrics"
+	"github.com/mailgun/timetools"
 	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/oxy/utils"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/reporter"
 )
 
+// metricsSource provides the stats the metrics are emitted from
+type metricsSource interface {
+	TopFrontends(*engine.BackendKey) ([]engine.Frontend, error)
+	frontendsInFlight() map[string]int64
+	frontendsRetryBudget() map[string]int64
+	serverStates() []reporter.ServerState
+}
+
 func (m *mux) emitMetrics() error {
 	c := m.options.MetricsClient
+	r := m.options.Reporter
 
 	// Emit connection stats
 	counts := m.incomingConnTracker.Counts()
 	for state, values := range counts {
 		for addr, count := range values {
-			c.Gauge(c.Metric("conns", addr, state.String()), count, 1)
+			r.ReportConns(addr, state.String(), count)
 		}
 	}
+	if t, ok := m.incomingConnTracker.(*connTracker); ok {
+		t.emit(c)
+	}
+
+	// Emit backend servers state
+	r.ReportServers(m.metrics.serverStates())
 
-	// Emit frontend metrics stats
-	frontends, err := m.TopFrontends(nil)
+	// Emit frontend metrics stats. The counters of the frontends over the label cap are summed up
+	// under the "other" label, their percentiles are not emitted as they can not be summed up.
+	frontends, err := m.metrics.TopFrontends(nil)
 	if err != nil {
 		log.Errorf("failed to get top frontends: %v", err)
 		return err
 	}
+	var other *frontendCounters
 	for _, f := range frontends {
-		fem := c.Metric("frontend", strings.Replace(f.Id, ".", "_", -1))
 		s := f.Stats
-		for _, scode := range s.Counters.StatusCodes {
-			// response codes counters
-			c.Gauge(fem.Metric("code", strconv.Itoa(scode.Code)), scode.Count, 1)
+		label := m.frontendLabel(f.Id)
+		if label == otherMetricLabel {
+			if other == nil {
+				other = &frontendCounters{codes: make(map[int]int64)}
+			}
+			other.add(s)
+			continue
 		}
-		// network errors
-		c.Gauge(fem.Metric("neterr"), s.Counters.NetErrors, 1)
-		// requests
-		c.Gauge(fem.Metric("reqs"), s.Counters.Total, 1)
+		fem := c.Metric("frontend", label)
+		(&frontendCounters{codes: make(map[int]int64)}).add(s).emit(c, fem)
 
 		// round trip times in microsecond resolution
 		for _, b := range s.LatencyBrackets {
 			c.Gauge(fem.Metric("rtt", strconv.Itoa(int(b.Quantile*10.0))), int64(b.Value/time.Microsecond), 1)
 		}
 	}
+	if other != nil {
+		other.emit(c, c.Metric("frontend", otherMetricLabel))
+	}
+
+	// Emit requests in flight of the frontends with the limit
+	inflight := make(map[string]int64)
+	for id, n := range m.metrics.frontendsInFlight() {
+		inflight[m.frontendLabel(id)] += n
+	}
+	for label, n := range inflight {
+		c.Gauge(c.Metric("frontend", label, "inflight"), n, 1)
+	}
+
+	// Emit utilization of the retry budgets in percents, the most used budget of the frontends over the label cap
+	budgets := make(map[string]int64)
+	for id, n := range m.metrics.frontendsRetryBudget() {
+		if label := m.frontendLabel(id); n >= budgets[label] {
+			budgets[label] = n
+		}
+	}
+	for label, n := range budgets {
+		c.Gauge(c.Metric("frontend", label, "retries", "budget"), n, 1)
+	}
+
+	// Emit latency percentiles of the rolling window in microsecond resolution
+	latency := m.latency.stats()
+	for _, p := range latency.Frontends {
+		if label := m.frontendLabel(p.Id); label != otherMetricLabel {
+			emitPercentiles(c, c.Metric("frontend", label), p)
+		}
+	}
+	for _, p := range latency.Backends {
+		if label := m.backendLabel(p.Id); label != otherMetricLabel {
+			emitPercentiles(c, c.Metric("backend", label), p)
+		}
+	}
 
 	return nil
 }
 
+// frontendCounters are the response code, network error and request counters of one or more frontends
+type frontendCounters struct {
+	codes  map[int]int64
+	neterr int64
+	reqs   int64
+}
+
+func (f *frontendCounters) add(s *engine.RoundTripStats) *frontendCounters {
+	for _, scode := range s.Counters.StatusCodes {
+		f.codes[scode.Code] += scode.Count
+	}
+	f.neterr += s.Counters.NetErrors
+	f.reqs += s.Counters.Total
+	return f
+}
+
+func (f *frontendCounters) emit(c metrics.Client, fem metrics.Metric) {
+	for code, count := range f.codes {
+		// response codes counters
+		c.Gauge(fem.Metric("code", strconv.Itoa(code)), count, 1)
+	}
+	// network errors
+	c.Gauge(fem.Metric("neterr"), f.neterr, 1)
+	// requests
+	c.Gauge(fem.Metric("reqs"), f.reqs, 1)
+}
+
+func emitPercentiles(c metrics.Client, m metrics.Metric, p engine.LatencyPercentiles) {
+	c.Gauge(m.Metric("latency", "p50"), int64(p.P50/time.Microsecond), 1)
+	c.Gauge(m.Metric("latency", "p90"), int64(p.P90/time.Microsecond), 1)
+	c.Gauge(m.Metric("latency", "p99"), int64(p.P99/time.Microsecond), 1)
+}
+
+// LatencyStats returns the latency percentiles of the frontends and the backends within the rolling window
+func (m *mux) LatencyStats() (*engine.LatencyStats, error) {
+	return m.latency.stats(), nil
+}
+
+// requestObserver reports status code and latency of every request served by the frontend
+type requestObserver struct {
+	next     http.Handler
+	frontend string
+	reporter reporter.Reporter
+	latency  *latencyTracker
+	clock    timetools.TimeProvider
+}
+
+func newRequestObserver(f *frontend, next http.Handler) *requestObserver {
+	return &requestObserver{
+		next:     next,
+		frontend: f.key.Id,
+		reporter: f.mux.options.Reporter,
+		latency:  f.mux.latency,
+		clock:    f.mux.options.TimeProvider,
+	}
+}
+
+func (o *requestObserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := o.clock.UtcNow()
+	pw := &utils.ProxyWriter{W: w}
+	o.next.ServeHTTP(pw, req)
+	d := o.clock.UtcNow().Sub(start)
+	o.reporter.ObserveRequest(o.frontend, pw.StatusCode(), d)
+	o.latency.observeFrontend(o.frontend, d)
+}
+
+// frontendsInFlight returns the requests in flight of the frontends limiting them
+func (m *mux) frontendsInFlight() map[string]int64 {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	out := make(map[string]int64)
+	for k, f := range m.frontends {
+		if f.bulkhead != nil {
+			out[k.Id] = f.bulkhead.inflight()
+		}
+	}
+	return out
+}
+
+// frontendsRetryBudget returns the utilization of the retry budgets of the frontends with the budget in percents
+func (m *mux) frontendsRetryBudget() map[string]int64 {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	out := make(map[string]int64)
+	for k, f := range m.frontends {
+		if f.retryBudget != nil {
+			out[k.Id] = f.retryBudget.utilization()
+		}
+	}
+	return out
+}
+
+// serverStates returns servers of all backends, the server is up if it receives traffic,
+// i.e. it passes health checks and is not ejected by the outlier detection
+func (m *mux) serverStates() []reporter.ServerState {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var out []reporter.ServerState
+	for _, b := range m.backends {
+		active := make(map[string]bool)
+		for _, s := range b.activeServers() {
+			active[s.Id] = true
+		}
+		for _, s := range b.servers {
+			out = append(out, reporter.ServerState{Backend: b.backend.Id, Server: s.Id, Up: active[s.Id]})
+		}
+	}
+	return out
+}
+
 func (m *mux) FrontendStats(key engine.FrontendKey) (*engine.RoundTripStats, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -62,6 +233,15 @@ func (m *mux) FrontendStats(key engine.FrontendKey) (*engine.RoundTripStats, err
 	return f.watcher.rtStats()
 }
 
+// collectFrontendMetrics adds the round trip metrics of the frontend to rtm, the caller holds the lock
+func (m *mux) collectFrontendMetrics(key engine.FrontendKey, rtm *memmetrics.RTMetrics) error {
+	f, ok := m.frontends[key]
+	if !ok {
+		return fmt.Errorf("%v not found", key)
+	}
+	return f.watcher.collectMetrics(rtm)
+}
+
 func (m *mux) BackendStats(key engine.BackendKey) (*engine.RoundTripStats, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
@@ -70,21 +250,47 @@ func (m *mux) BackendStats(key engine.BackendKey) (*engine.RoundTripStats, error
 	if err != nil {
 		return nil, err
 	}
+	if err := m.collectBackendMetrics(key, rtm); err != nil {
+		return nil, err
+	}
+	return engine.NewRoundTripStats(rtm)
+}
+
+// collectBackendMetrics adds the round trip metrics of the frontends of the backend to rtm, the caller
+// holds the lock
+func (m *mux) collectBackendMetrics(key engine.BackendKey, rtm *memmetrics.RTMetrics) error {
 	for _, f := range m.frontends {
 		if f.backend.backend.Id != key.Id {
 			continue
 		}
 		if err := f.watcher.collectMetrics(rtm); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return engine.NewRoundTripStats(rtm)
+	return nil
 }
 
 func (m *mux) ServerStats(key engine.ServerKey) (*engine.RoundTripStats, error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
+	u, err := m.serverURL(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rtm, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		return nil, err
+	}
+	if err := m.collectServerMetrics(&key.BackendKey, u, rtm); err != nil {
+		return nil, err
+	}
+	return engine.NewRoundTripStats(rtm)
+}
+
+// serverURL returns the parsed URL of the server, the caller holds the lock
+func (m *mux) serverURL(key engine.ServerKey) (*url.URL, error) {
 	b, ok := m.backends[key.BackendKey]
 	if !ok {
 		return nil, fmt.Errorf("%v not found", key.BackendKey)
@@ -93,25 +299,74 @@ func (m *mux) ServerStats(key engine.ServerKey) (*engine.RoundTripStats, error)
 	if !ok {
 		return nil, fmt.Errorf("%v not found", key)
 	}
+	return url.Parse(srv.URL)
+}
 
-	u, err := url.Parse(srv.URL)
-	if err != nil {
-		return nil, err
-	}
-
-	rtm, err := memmetrics.NewRTMetrics()
-	if err != nil {
-		return nil, err
-	}
+// collectServerMetrics adds the round trip metrics of the server URL to rtm, from the frontends of the backend
+// or of all frontends if the key is nil. The caller holds the lock.
+func (m *mux) collectServerMetrics(key *engine.BackendKey, u *url.URL, rtm *memmetrics.RTMetrics) error {
 	for _, f := range m.frontends {
-		if f.backend.backend.Id != key.BackendKey.Id {
+		if key != nil && f.backend.backend.Id != key.Id {
 			continue
 		}
 		if err := f.watcher.collectServerMetrics(rtm, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackendHealth returns health state of the backend servers as reported by the active health checks
+func (m *mux) BackendHealth(key engine.BackendKey) ([]engine.ServerHealth, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	b, ok := m.backends[key]
+	if !ok {
+		return nil, &engine.NotFoundError{Message: fmt.Sprintf("%v not found", key)}
+	}
+	return b.serversHealth(), nil
+}
+
+// ProxyStats returns the listener connections and the frontend request rates, the snapshot is taken
+// under the mux lock
+func (m *mux) ProxyStats() (*engine.ProxyStats, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	stats := &engine.ProxyStats{
+		State:     m.state.String(),
+		Listeners: []engine.ListenerStats{},
+		Frontends: []engine.FrontendRate{},
+	}
+	for _, s := range m.servers {
+		active, accepted := s.conns.stats()
+		stats.Listeners = append(stats.Listeners, engine.ListenerStats{
+			Id:                  s.listener.Id,
+			Address:             s.listener.Address,
+			ActiveConnections:   active,
+			AcceptedConnections: accepted,
+		})
+	}
+	for _, f := range m.frontends {
+		rts, err := f.watcher.rtStats()
+		if err != nil {
 			return nil, err
 		}
+		rate := engine.FrontendRate{
+			Id:        f.frontend.Id,
+			Period:    rts.Counters.Period,
+			Requests:  rts.Counters.Total,
+			NetErrors: rts.Counters.NetErrors,
+		}
+		if rate.Period > 0 {
+			rate.RequestsPerSecond = float64(rate.Requests) / rate.Period.Seconds()
+		}
+		stats.Frontends = append(stats.Frontends, rate)
 	}
-	return engine.NewRoundTripStats(rtm)
+	sort.Slice(stats.Listeners, func(i, j int) bool { return stats.Listeners[i].Id < stats.Listeners[j].Id })
+	sort.Slice(stats.Frontends, func(i, j int) bool { return stats.Frontends[i].Id < stats.Frontends[j].Id })
+	return stats, nil
 }
 
 // TopFrontends returns locations sorted by criteria (faulty, slow, most used)
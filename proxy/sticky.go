@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// stickyKey is the request context key of the sticky session of the request passed to the load balancer
+type stickyKey struct{}
+
+// stickySession sends requests carrying the affinity cookie of a server in rotation right to this server.
+// Other requests, including retries, are balanced and get the cookie of the picked server, so clients
+// of the deleted or failing servers are moved to the other servers. The cookie with the TTL is set again on
+// every request sticking to the server, so the affinity of the active clients does not expire.
+type stickySession struct {
+	settings engine.StickySessionSettings
+	lb       loadBalancer
+	forward  http.Handler
+}
+
+func (s *stickySession) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isRetry(req) {
+		if u := s.pinnedServer(req); u != nil {
+			if s.settings.TTL > 0 {
+				http.SetCookie(w, s.cookie(u))
+			}
+			// make shallow copy of request before changing anything to avoid side effects
+			newReq := *req
+			newReq.URL = u
+			s.forward.ServeHTTP(w, &newReq)
+			return
+		}
+	}
+	s.lb.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), stickyKey{}, s)))
+}
+
+// pinnedServer returns the server from the affinity cookie if it is still in rotation
+func (s *stickySession) pinnedServer(req *http.Request) *url.URL {
+	c, err := req.Cookie(s.settings.CookieName)
+	if err != nil || c.Value == "" {
+		return nil
+	}
+	for _, u := range s.lb.Servers() {
+		if stickyValue(u) == c.Value {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *stickySession) cookie(u *url.URL) *http.Cookie {
+	c := &http.Cookie{
+		Name:     s.settings.CookieName,
+		Value:    stickyValue(u),
+		Path:     "/",
+		Secure:   s.settings.Secure,
+		HttpOnly: s.settings.HTTPOnly,
+	}
+	if s.settings.TTL > 0 {
+		c.MaxAge = int((s.settings.TTL + time.Second - 1) / time.Second)
+	}
+	return c
+}
+
+// stickyValue identifies the server in the affinity cookie without revealing its address
+func stickyValue(u *url.URL) string {
+	sum := sha1.Sum([]byte(u.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// stickyRecorder sits right below the load balancer and sets the affinity cookie of the server it has picked
+type stickyRecorder struct {
+	next http.Handler
+}
+
+func (r *stickyRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s, ok := req.Context().Value(stickyKey{}).(*stickySession); ok {
+		http.SetCookie(w, s.cookie(req.URL))
+	}
+	r.next.ServeHTTP(w, req)
+}
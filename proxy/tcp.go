@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+)
+
+const (
+	// tcpHelloTimeout limits the time waiting for the TLS client hello on the listeners with every frontend routing
+	// by the server name
+	tcpHelloTimeout = 10 * time.Second
+	// tcpFirstBytesTimeout limits the time waiting for the client hello on the listeners with the frontend taking
+	// the rest of the connections, the connections the clients are silent on go to that frontend, so the servers
+	// speaking first do not wait for the client hello timeout
+	tcpFirstBytesTimeout = 500 * time.Millisecond
+)
+
+// tcpFrontend passes the connections of the TCP listener to the servers of its backend. It keeps the connections
+// open to every server, so the new connections go to the server with the least of them.
+type tcpFrontend struct {
+	mux      *mux
+	frontend engine.Frontend
+	settings engine.TCPFrontendSettings
+	dial     time.Duration
+	idle     time.Duration
+
+	mtx   sync.Mutex
+	conns map[string]int
+	// next rotates the servers with the same amount of connections
+	next int
+}
+
+func newTCPFrontend(m *mux, f engine.Frontend) (*tcpFrontend, error) {
+	s := f.TCPSettings()
+	dial, idle, err := s.Timeouts()
+	if err != nil {
+		return nil, err
+	}
+	return &tcpFrontend{
+		mux:      m,
+		frontend: f,
+		settings: s,
+		dial:     dial,
+		idle:     idle,
+		conns:    make(map[string]int),
+	}, nil
+}
+
+func (f *tcpFrontend) String() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return fmt.Sprintf("%v tcpFrontend(%v)", f.mux, &f.frontend)
+}
+
+// update swaps the settings, the connections in progress keep the servers they are connected to. The settings
+// are read by the routing under the mux lock and by the connections in progress under the frontend lock.
+func (f *tcpFrontend) update(ef engine.Frontend) error {
+	s := ef.TCPSettings()
+	dial, idle, err := s.Timeouts()
+	if err != nil {
+		return err
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.frontend, f.settings, f.dial, f.idle = ef, s, dial, idle
+	return nil
+}
+
+// match returns how the frontend matches the lower case server name
+func (f *tcpFrontend) match(name string) int {
+	if len(f.settings.ServerNames) == 0 {
+		return tcpMatchAny
+	}
+	m := tcpMatchNone
+	for _, n := range f.settings.ServerNames {
+		if n == name {
+			return tcpMatchExact
+		}
+		if !strings.HasPrefix(n, "*.") || !strings.HasSuffix(name, n[1:]) {
+			continue
+		}
+		// the wildcard covers the first label only
+		if label := strings.TrimSuffix(name, n[1:]); label != "" && !strings.Contains(label, ".") {
+			m = tcpMatchWildcard
+		}
+	}
+	return m
+}
+
+// the matches of the server names in the order of precedence
+const (
+	tcpMatchExact = iota
+	tcpMatchWildcard
+	tcpMatchAny
+	tcpMatchNone
+)
+
+// acquire returns the active server with the least connections, the caller should release it
+func (f *tcpFrontend) acquire(servers []engine.Server) (string, bool) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if len(servers) == 0 {
+		return "", false
+	}
+	f.next++
+	best := -1
+	for i := range servers {
+		j := (f.next + i) % len(servers)
+		if best == -1 || f.conns[servers[j].URL] < f.conns[servers[best].URL] {
+			best = j
+		}
+	}
+	u := servers[best].URL
+	f.conns[u]++
+	return u, true
+}
+
+func (f *tcpFrontend) release(u string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.conns[u]--; f.conns[u] <= 0 {
+		delete(f.conns, u)
+	}
+}
+
+// timeouts returns the dial and the idle timeouts of the frontend
+func (f *tcpFrontend) timeouts() (time.Duration, time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.dial, f.idle
+}
+
+// routeTCP returns the frontend of the listener taking the connections with the server name and the servers
+// of its backend. The frontends with the exact server name go first, then the wildcard ones and then the frontend
+// without the server names. The frontends matching the name the same way are ordered by id.
+func (m *mux) routeTCP(listenerId, name string) (*tcpFrontend, []engine.Server) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	var best *tcpFrontend
+	bestMatch := tcpMatchNone
+	for _, f := range m.tcpFrontends {
+		if f.settings.ListenerId != listenerId {
+			continue
+		}
+		match := f.match(name)
+		if match < bestMatch || (match == bestMatch && best != nil && f.frontend.Id < best.frontend.Id) {
+			best, bestMatch = f, match
+		}
+	}
+	if best == nil || bestMatch == tcpMatchNone {
+		return nil, nil
+	}
+	b, ok := m.backends[engine.BackendKey{Id: best.frontend.BackendId}]
+	if !ok {
+		return best, nil
+	}
+	servers := b.activeServers()
+	out := make([]engine.Server, len(servers))
+	copy(out, servers)
+	return best, out
+}
+
+// routesByName tells whether any frontend of the listener is matched by the server name and whether all of them
+// are, the connections to the listeners without such frontends are passed without waiting for the client to speak
+// first
+func (m *mux) routesByName(listenerId string) (bool, bool) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	some, all := false, true
+	for _, f := range m.tcpFrontends {
+		if f.settings.ListenerId != listenerId {
+			continue
+		}
+		if len(f.settings.ServerNames) != 0 {
+			some = true
+		} else {
+			all = false
+		}
+	}
+	return some, some && all
+}
+
+// passthroughListener takes the connections of the TCP listener over from the HTTP server, the server never gets
+// a connection and keeps the listener running, so the listener is started, reloaded and passed to the child
+// process as the HTTP ones are
+type passthroughListener struct {
+	net.Listener
+	srv *srv
+	// id and limit are taken from the listener settings, the updated settings come with the new listener
+	id    string
+	limit int
+}
+
+func newPassthroughListener(s *srv, l net.Listener) net.Listener {
+	return &passthroughListener{Listener: l, srv: s, id: s.listener.Id, limit: s.listener.MaxConnections}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		s := l.srv
+		if l.limit > 0 && s.conns.listenerSize() >= l.limit {
+			log.Debugf("listener %v has reached %d connections, closing connection from %v", l.id, l.limit, conn.RemoteAddr())
+			conn.Close()
+			s.mux.options.Reporter.ObserveRejectedConn(l.id)
+			continue
+		}
+		s.conns.track(conn, http.StateNew)
+		s.passing.Add(1)
+		go s.pass(conn, l.id)
+	}
+}
+
+// pass routes the client connection and passes the bytes between the client and the backend server until
+// either of them closes the connection
+func (s *srv) pass(conn net.Conn, listenerId string) {
+	defer s.passing.Done()
+	defer s.conns.track(conn, http.StateClosed)
+	defer conn.Close()
+
+	var name string
+	var hello []byte
+	if byName, allByName := s.mux.routesByName(listenerId); allByName {
+		var err error
+		if name, hello, err = readServerName(conn, tcpHelloTimeout); err != nil {
+			log.Debugf("listener %v failed to read the client hello from %v: %v", listenerId, conn.RemoteAddr(), err)
+			return
+		}
+	} else if byName {
+		// the silent clients go to the frontend without the server names with the bytes read so far
+		var err error
+		if name, hello, err = readServerName(conn, tcpFirstBytesTimeout); err != nil {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				log.Debugf("listener %v failed to read the client hello from %v: %v", listenerId, conn.RemoteAddr(), err)
+				return
+			}
+			name = ""
+		}
+	}
+
+	f, servers := s.mux.routeTCP(listenerId, name)
+	if f == nil {
+		log.Debugf("listener %v has no frontend taking the connection from %v, server name %q", listenerId, conn.RemoteAddr(), name)
+		return
+	}
+	u, ok := f.acquire(servers)
+	if !ok {
+		log.Warningf("%v has no servers to pass the connection from %v to", f, conn.RemoteAddr())
+		return
+	}
+	defer f.release(u)
+
+	dialTimeout, idleTimeout := f.timeouts()
+	addr := u
+	if parsed, err := url.Parse(u); err == nil && parsed.Host != "" {
+		addr = parsed.Host
+	}
+	upstream, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		log.Warningf("%v failed to connect to %v: %v", f, u, err)
+		return
+	}
+	defer upstream.Close()
+
+	if len(hello) != 0 {
+		if _, err := upstream.Write(hello); err != nil {
+			return
+		}
+	}
+	client, server := &idleConn{Conn: conn, timeout: idleTimeout}, &idleConn{Conn: upstream, timeout: idleTimeout}
+	client.touch()
+	server.touch()
+	doneC := make(chan struct{}, 2)
+	go splice(server, client, doneC)
+	go splice(client, server, doneC)
+	<-doneC
+	<-doneC
+}
+
+// drained returns the channel closed once the server has stopped and the passed connections are closed
+func (s *srv) drained() <-chan struct{} {
+	if !s.isTCP() {
+		return s.doneC
+	}
+	doneC, passedC := s.doneC, make(chan struct{})
+	go func() {
+		<-doneC
+		s.passing.Wait()
+		close(passedC)
+	}()
+	return passedC
+}
+
+// splice copies the bytes until the source is closed, the destination is closed for writing then, so the other
+// side sees the end of the stream and the connection is closed once both sides are done
+func splice(dst, src *idleConn, doneC chan<- struct{}) {
+	io.Copy(dst, src)
+	if cw, ok := dst.Conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+		src.Close()
+	}
+	doneC <- struct{}{}
+}
+
+var errHelloRead = errors.New("client hello read")
+
+// readServerName reads the TLS client hello and returns the lower case server name and the bytes read, so
+// they are passed on to the server. The name is empty for the clients not speaking TLS or not sending one.
+// The bytes read are returned along with the read error as well.
+func readServerName(conn net.Conn, timeout time.Duration) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := &recordingConn{Conn: conn}
+	name := ""
+	err := tls.Server(r, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = strings.ToLower(hello.ServerName)
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if r.err != nil {
+		return "", r.buf.Bytes(), r.err
+	}
+	if !errors.Is(err, errHelloRead) {
+		// the client does not speak TLS, the bytes read are passed on as they are
+		return "", r.buf.Bytes(), nil
+	}
+	return name, r.buf.Bytes(), nil
+}
+
+// recordingConn records the bytes read and discards the writes, so the handshake fails before answering
+// the client
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+	err error
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.buf.Write(b[:n])
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
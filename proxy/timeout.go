@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/vulcand/oxy/utils"
+)
+
+// forwardTimeout limits the time the forwarder has to complete the request to the server, once the deadline
+// expires the upstream request is cancelled and the client gets 504
+type forwardTimeout struct {
+	next    http.Handler
+	timeout time.Duration
+}
+
+func (t *forwardTimeout) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	defer cancel()
+	t.next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// forwardTimeoutError is the timeout error, so the error handlers respond with 504 and retries consider
+// the expired forward timeout a timeout
+type forwardTimeoutError struct{}
+
+func (e *forwardTimeoutError) Error() string   { return "forward timeout expired" }
+func (e *forwardTimeoutError) Timeout() bool   { return true }
+func (e *forwardTimeoutError) Temporary() bool { return true }
+
+// timeoutErrorHandler replaces the errors caused by the expired deadline of the request, the transport
+// reports them as cancelled requests otherwise
+func timeoutErrorHandler(next utils.ErrorHandler) utils.ErrorHandler {
+	return utils.ErrorHandlerFunc(func(w http.ResponseWriter, req *http.Request, err error) {
+		if req.Context().Err() == context.DeadlineExceeded {
+			err = &forwardTimeoutError{}
+		}
+		next.ServeHTTP(w, req, err)
+	})
+}
+
+// bodyIdleTransport cancels the responses with no bytes of the body read from the server for longer than the
+// timeout. Unlike the response header timeout it does not limit the whole response, only the pauses in it.
+type bodyIdleTransport struct {
+	backendTransport
+	timeout time.Duration
+}
+
+func (t *bodyIdleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// body of the switched protocols response is the connection itself, upgrades have an idle timeout of their own
+	if req.Header.Get("Upgrade") != "" {
+		return t.backendTransport.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	re, err := t.backendTransport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	re.Body = &idleTimeoutBody{ReadCloser: re.Body, cancel: cancel, timeout: t.timeout}
+	return re, nil
+}
+
+// idleTimeoutBody cancels the response if a read of the body does not return in time. The time the client
+// takes to consume the body is not counted, the timer runs only while the body is read from the server. The timer
+// is created with the first read and is reset by the following ones.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	cancel  context.CancelFunc
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.timeout, b.expire)
+	} else {
+		b.timer.Reset(b.timeout)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && atomic.LoadInt32(&b.expired) == 1 {
+		return n, &bodyIdleTimeoutError{}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&b.expired, 1)
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// bodyIdleTimeoutError is returned by the reads of the response body cancelled by the body idle timeout
+type bodyIdleTimeoutError struct{}
+
+func (e *bodyIdleTimeoutError) Error() string   { return "timeout awaiting response body" }
+func (e *bodyIdleTimeoutError) Timeout() bool   { return true }
+func (e *bodyIdleTimeoutError) Temporary() bool { return true }
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/vulcand/oxy/utils"
+	"github.com/vulcand/vulcand/plugin"
+	"github.com/vulcand/vulcand/tracing"
+)
+
+// requestTracer is the outermost frontend handler, it starts the span of the request and ends it once
+// the response is written, the span is ended with the error status if the backend fails or the handler panics
+type requestTracer struct {
+	next     http.Handler
+	tracer   *tracing.Tracer
+	frontend string
+	backend  string
+}
+
+func newRequestTracer(f *frontend, next http.Handler) *requestTracer {
+	return &requestTracer{
+		next:     next,
+		tracer:   f.mux.options.Tracer,
+		frontend: f.key.Id,
+		backend:  f.backend.backend.Id,
+	}
+}
+
+func (t *requestTracer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	span, req := t.tracer.StartSpan(req, req.Method+" "+t.frontend)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.Host)
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("vulcand.frontend", t.frontend)
+	span.SetAttribute("vulcand.backend", t.backend)
+	if id := plugin.RequestID(req); id != "" {
+		span.SetAttribute("vulcand.request_id", id)
+	}
+
+	pw := &utils.ProxyWriter{W: w}
+	completed := false
+	defer func() {
+		code := pw.StatusCode()
+		span.SetAttribute("http.response.status_code", code)
+		if !completed || code >= http.StatusInternalServerError {
+			span.SetStatus(tracing.StatusError)
+		}
+		span.End()
+	}()
+	t.next.ServeHTTP(pw, req)
+	completed = true
+}
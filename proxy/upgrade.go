@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/oxy/forward"
+	"github.com/vulcand/oxy/utils"
+)
+
+// upgradeWriterKey is the request context key of the original response writer of the upgrade requests
+type upgradeWriterKey struct{}
+
+// isUpgrade returns true for the requests asking to switch protocols, e.g. WebSocket handshakes
+func isUpgrade(req *http.Request) bool {
+	if req.ProtoMajor != 1 || req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeSwitch sends the upgrade requests through the chain bypassing the buffering, as it would hold
+// the connection. It keeps the original response writer for the upgradeForwarder, as the writers wrapped
+// by the middlewares and observers can not be hijacked.
+type upgradeSwitch struct {
+	upgrade http.Handler
+	next    http.Handler
+}
+
+func (s *upgradeSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !isUpgrade(req) {
+		s.next.ServeHTTP(w, req)
+		return
+	}
+	s.upgrade.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), upgradeWriterKey{}, w)))
+}
+
+type upgradeForwarderOptions struct {
+	roundTripper       http.RoundTripper
+	hostname           string
+	trustForwardHeader bool
+	passHostHeader     bool
+	idleTimeout        time.Duration
+	stateListener      forward.UrlForwardingStateListener
+	errHandler         utils.ErrorHandler
+}
+
+// upgradeForwarder performs the protocol switch with the server picked by the load balancer and
+// copies the data between the client and server connections. Other requests are passed to the next handler.
+type upgradeForwarder struct {
+	o    upgradeForwarderOptions
+	next http.Handler
+}
+
+func newUpgradeForwarder(next http.Handler, o upgradeForwarderOptions) *upgradeForwarder {
+	return &upgradeForwarder{o: o, next: next}
+}
+
+func (f *upgradeForwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rw, ok := req.Context().Value(upgradeWriterKey{}).(http.ResponseWriter)
+	if !ok || !isUpgrade(req) {
+		f.next.ServeHTTP(w, req)
+		return
+	}
+	if f.o.stateListener != nil {
+		f.o.stateListener(req.URL, forward.StateConnected)
+		defer f.o.stateListener(req.URL, forward.StateDisconnected)
+	}
+
+	re, err := f.o.roundTripper.RoundTrip(f.outRequest(req))
+	if err != nil {
+		log.Errorf("Error forwarding upgrade to %v, err: %v", req.URL, err)
+		f.o.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	// server has declined to switch protocols, pass its response as is
+	if re.StatusCode != http.StatusSwitchingProtocols {
+		defer re.Body.Close()
+		utils.CopyHeaders(w.Header(), re.Header)
+		w.WriteHeader(re.StatusCode)
+		io.Copy(w, re.Body)
+		return
+	}
+	backendConn, ok := re.Body.(io.ReadWriteCloser)
+	if !ok {
+		re.Body.Close()
+		f.o.errHandler.ServeHTTP(w, req, fmt.Errorf("upgraded connection to %v is not writable", req.URL))
+		return
+	}
+	defer backendConn.Close()
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		f.o.errHandler.ServeHTTP(w, req, fmt.Errorf("connection does not support hijacking"))
+		return
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorf("Unable to hijack the connection: %v", err)
+		f.o.errHandler.ServeHTTP(w, req, err)
+		return
+	}
+	defer conn.Close()
+
+	// server read and write timeouts would cut off the long-lived connection, the idle timeout applies instead
+	clientConn := &idleConn{Conn: conn, timeout: f.o.idleTimeout}
+	clientConn.SetDeadline(time.Time{})
+	clientConn.touch()
+
+	fmt.Fprintf(brw, "HTTP/1.1 %s\r\n", re.Status)
+	re.Header.Write(brw)
+	brw.WriteString("\r\n")
+	if err := brw.Flush(); err != nil {
+		log.Errorf("Unable to write upgrade response to the client: %v", err)
+		return
+	}
+	// client could have sent data right after the handshake
+	if n := brw.Reader.Buffered(); n != 0 {
+		buffered, _ := brw.Reader.Peek(n)
+		if _, err := backendConn.Write(buffered); err != nil {
+			return
+		}
+	}
+
+	errc := make(chan error, 2)
+	replicate := func(dst io.Writer, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		errc <- err
+	}
+	go replicate(backendConn, clientConn)
+	go replicate(clientConn, backendConn)
+	<-errc
+}
+
+// outRequest makes the upgrade request to the server picked by the load balancer
+func (f *upgradeForwarder) outRequest(req *http.Request) *http.Request {
+	outReq := req.Clone(req.Context())
+	outReq.URL = serverURL(req)
+	outReq.RequestURI = ""
+	if !f.o.passHostHeader {
+		outReq.Host = req.URL.Host
+	}
+	upgrade := req.Header.Get("Upgrade")
+	(&forwardedForRewriter{hostname: f.o.hostname, trust: f.o.trustForwardHeader}).Rewrite(outReq)
+	// header rewriter removes the hop-by-hop headers the protocol switch is negotiated with
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", upgrade)
+	return outReq
+}
+
+// idleConn extends the connection deadline on every read and write, closing the connection
+// idle for longer than the timeout in both directions
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) touch() {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
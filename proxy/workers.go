@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vulcand/oxy/memmetrics"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/reporter"
+	"github.com/vulcand/vulcand/stapler"
+)
+
+// workers runs several muxes with the same configuration to spread the load over the CPUs. The TCP listeners
+// of every mux bind the same addresses with SO_REUSEPORT and the kernel balances the accepted connections
+// between them. The unix sockets can not be shared this way, they are served by the first mux only. The muxes
+// share the connection tracker, the latency histograms, the limits of the frontends and the listeners and
+// the handlers of the middlewares keeping the limits, e.g. the rate limits and the circuit breakers, see
+// plugin.Limiter. The other middlewares are built by every mux. The first one emits the metrics of all of them
+// and checks the health of the servers for all of them.
+type workers struct {
+	id    int
+	muxes []*mux
+}
+
+// NewWorkers returns the proxy running n muxes, the proxy is managed as a single one: the changes, the files
+// and the lifecycle calls are passed to all muxes and their stats are summed up.
+func NewWorkers(id, n int, st stapler.Stapler, o Options) (Proxy, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("number of the workers should be >= 1, got %d", n)
+	}
+	o.ReusePort = true
+	if o.IncomingConnectionTracker == nil {
+		o.IncomingConnectionTracker = newDefaultConnTracker()
+	}
+	w := &workers{id: id}
+	for i := 0; i < n; i++ {
+		m, err := New(id, st, o)
+		if err != nil {
+			return nil, err
+		}
+		if i != 0 {
+			m.latency = w.muxes[0].latency
+			m.metrics = nil
+			m.shared = w.muxes[0].shared
+			m.followsHealth = true
+			m.shared.follow(m.followHealth)
+		}
+		w.muxes = append(w.muxes, m)
+	}
+	w.muxes[0].metrics = w
+	return w, nil
+}
+
+func (w *workers) String() string {
+	return fmt.Sprintf("mux_%d(%d workers)", w.id, len(w.muxes))
+}
+
+// each calls fn for every mux in turn and returns the first error
+func (w *workers) each(fn func(m *mux) error) error {
+	errs := make([]error, len(w.muxes))
+	for i, m := range w.muxes {
+		errs[i] = fn(m)
+	}
+	return firstError(errs)
+}
+
+// firstError returns the first error of the muxes, the not found errors of the muxes but the first one
+// are ignored, as they do not serve the unix sockets
+func firstError(errs []error) error {
+	for i, err := range errs {
+		if _, ok := err.(*engine.NotFoundError); ok && i != 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parallel calls fn for every mux at once and waits for all of them
+func (w *workers) parallel(fn func(i int, m *mux)) {
+	var wg sync.WaitGroup
+	for i, m := range w.muxes {
+		wg.Add(1)
+		go func(i int, m *mux) {
+			defer wg.Done()
+			fn(i, m)
+		}(i, m)
+	}
+	wg.Wait()
+}
+
+func (w *workers) Init(ss engine.Snapshot) error {
+	tcp := ss
+	tcp.Listeners = nil
+	for _, l := range ss.Listeners {
+		if l.Address.Network != engine.UNIX {
+			tcp.Listeners = append(tcp.Listeners, l)
+		}
+	}
+	for i, m := range w.muxes {
+		if i == 0 {
+			if err := m.Init(ss); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := m.Init(tcp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *workers) Snapshot() engine.Snapshot {
+	return w.muxes[0].Snapshot()
+}
+
+func (w *workers) UpsertHost(h engine.Host) error {
+	return w.each(func(m *mux) error { return m.UpsertHost(h) })
+}
+
+func (w *workers) DeleteHost(hk engine.HostKey) error {
+	return w.each(func(m *mux) error { return m.DeleteHost(hk) })
+}
+
+func (w *workers) UpsertListener(l engine.Listener) error {
+	if l.Address.Network != engine.UNIX {
+		return w.each(func(m *mux) error { return m.UpsertListener(l) })
+	}
+	// the listener moved to the unix socket is left to the first mux
+	return w.each(func(m *mux) error {
+		if m == w.muxes[0] {
+			return m.UpsertListener(l)
+		}
+		return m.DeleteListener(engine.ListenerKey{Id: l.Id})
+	})
+}
+
+func (w *workers) DeleteListener(lk engine.ListenerKey) error {
+	return w.each(func(m *mux) error { return m.DeleteListener(lk) })
+}
+
+// DrainListener drains the listener of all the muxes at once
+func (w *workers) DrainListener(lk engine.ListenerKey, drainTimeout time.Duration) error {
+	errs := make([]error, len(w.muxes))
+	w.parallel(func(i int, m *mux) { errs[i] = m.DrainListener(lk, drainTimeout) })
+	return firstError(errs)
+}
+
+func (w *workers) UpsertBackend(b engine.Backend) error {
+	return w.each(func(m *mux) error { return m.UpsertBackend(b) })
+}
+
+func (w *workers) DeleteBackend(bk engine.BackendKey) error {
+	return w.each(func(m *mux) error { return m.DeleteBackend(bk) })
+}
+
+func (w *workers) UpsertFrontend(f engine.Frontend) error {
+	return w.each(func(m *mux) error { return m.UpsertFrontend(f) })
+}
+
+func (w *workers) DeleteFrontend(fk engine.FrontendKey) error {
+	return w.each(func(m *mux) error { return m.DeleteFrontend(fk) })
+}
+
+func (w *workers) UpsertMiddleware(fk engine.FrontendKey, mi engine.Middleware) error {
+	return w.each(func(m *mux) error { return m.UpsertMiddleware(fk, mi) })
+}
+
+func (w *workers) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	return w.each(func(m *mux) error { return m.DeleteMiddleware(mk) })
+}
+
+func (w *workers) PurgeCache(fk engine.FrontendKey, prefix string) (int, error) {
+	total := 0
+	err := w.each(func(m *mux) error {
+		n, err := m.PurgeCache(fk, prefix)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+func (w *workers) UpsertServer(bk engine.BackendKey, srv engine.Server) error {
+	return w.each(func(m *mux) error { return m.UpsertServer(bk, srv) })
+}
+
+func (w *workers) DeleteServer(sk engine.ServerKey) error {
+	return w.each(func(m *mux) error { return m.DeleteServer(sk) })
+}
+
+func (w *workers) QuarantineServer(sk engine.ServerKey, quarantined bool) error {
+	return w.each(func(m *mux) error { return m.QuarantineServer(sk, quarantined) })
+}
+
+// TakeFiles passes the files to every mux, the muxes accept the connections from the same inherited sockets
+// and bind the addresses with no files of their own
+func (w *workers) TakeFiles(files []*FileDescriptor) error {
+	return w.each(func(m *mux) error { return m.TakeFiles(files) })
+}
+
+// GetFiles returns the files of the first mux, the files cover all the listeners
+func (w *workers) GetFiles() ([]*FileDescriptor, error) {
+	return w.muxes[0].GetFiles()
+}
+
+func (w *workers) Start() error {
+	return w.each(func(m *mux) error { return m.Start() })
+}
+
+// Stop stops all the muxes at once, so their connections are drained in parallel
+func (w *workers) Stop(wait bool) {
+	w.parallel(func(i int, m *mux) { m.Stop(wait) })
+}
+
+func (w *workers) StopBy(deadline time.Time) {
+	w.parallel(func(i int, m *mux) { m.StopBy(deadline) })
+}
+
+func (w *workers) Ready() error {
+	return w.each(func(m *mux) error { return m.Ready() })
+}
+
+func (w *workers) ServerTimeouts() ServerTimeouts {
+	return w.muxes[0].ServerTimeouts()
+}
+
+func (w *workers) UpdateServerTimeouts(t ServerTimeouts) error {
+	return w.each(func(m *mux) error { return m.UpdateServerTimeouts(t) })
+}
+
+func (w *workers) UpdateDefaultKeyPair(kp engine.KeyPair) error {
+	return w.each(func(m *mux) error { return m.UpdateDefaultKeyPair(kp) })
+}
+
+// collect sums up the round trip metrics the collector reads from every mux
+func (w *workers) collect(fn func(m *mux, rtm *memmetrics.RTMetrics) error) (*engine.RoundTripStats, error) {
+	rtm, err := memmetrics.NewRTMetrics()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range w.muxes {
+		m.mtx.RLock()
+		err := fn(m, rtm)
+		m.mtx.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return engine.NewRoundTripStats(rtm)
+}
+
+func (w *workers) FrontendStats(key engine.FrontendKey) (*engine.RoundTripStats, error) {
+	return w.collect(func(m *mux, rtm *memmetrics.RTMetrics) error {
+		return m.collectFrontendMetrics(key, rtm)
+	})
+}
+
+func (w *workers) BackendStats(key engine.BackendKey) (*engine.RoundTripStats, error) {
+	return w.collect(func(m *mux, rtm *memmetrics.RTMetrics) error {
+		return m.collectBackendMetrics(key, rtm)
+	})
+}
+
+func (w *workers) ServerStats(key engine.ServerKey) (*engine.RoundTripStats, error) {
+	return w.collect(func(m *mux, rtm *memmetrics.RTMetrics) error {
+		u, err := m.serverURL(key)
+		if err != nil {
+			return err
+		}
+		return m.collectServerMetrics(&key.BackendKey, u, rtm)
+	})
+}
+
+func (w *workers) TopFrontends(key *engine.BackendKey) ([]engine.Frontend, error) {
+	frontends, err := w.muxes[0].TopFrontends(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range frontends {
+		if frontends[i].Stats, err = w.FrontendStats(engine.FrontendKey{Id: f.Id}); err != nil {
+			return nil, err
+		}
+	}
+	sort.Stable(&frontendSorter{frontends: frontends})
+	return frontends, nil
+}
+
+func (w *workers) TopServers(key *engine.BackendKey) ([]engine.Server, error) {
+	servers, err := w.muxes[0].TopServers(key)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range servers {
+		sv, err := newSval(s)
+		if err != nil {
+			return nil, err
+		}
+		if servers[i].Stats, err = w.collect(func(m *mux, rtm *memmetrics.RTMetrics) error {
+			return m.collectServerMetrics(key, sv.url, rtm)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	sort.Stable(&serverSorter{es: servers})
+	return servers, nil
+}
+
+// BackendHealth returns the health of the servers checked by the first mux, the other muxes follow its checks
+func (w *workers) BackendHealth(key engine.BackendKey) ([]engine.ServerHealth, error) {
+	return w.muxes[0].BackendHealth(key)
+}
+
+// ProxyStats sums up the listener connections and the frontend requests of the muxes
+func (w *workers) ProxyStats() (*engine.ProxyStats, error) {
+	out, err := w.muxes[0].ProxyStats()
+	if err != nil {
+		return nil, err
+	}
+	listeners := make(map[string]*engine.ListenerStats, len(out.Listeners))
+	for i := range out.Listeners {
+		listeners[out.Listeners[i].Id] = &out.Listeners[i]
+	}
+	frontends := make(map[string]*engine.FrontendRate, len(out.Frontends))
+	for i := range out.Frontends {
+		frontends[out.Frontends[i].Id] = &out.Frontends[i]
+	}
+	for _, m := range w.muxes[1:] {
+		stats, err := m.ProxyStats()
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range stats.Listeners {
+			if t, ok := listeners[l.Id]; ok {
+				t.ActiveConnections += l.ActiveConnections
+				t.AcceptedConnections += l.AcceptedConnections
+			}
+		}
+		for _, f := range stats.Frontends {
+			if t, ok := frontends[f.Id]; ok {
+				t.Requests += f.Requests
+				t.NetErrors += f.NetErrors
+				t.RequestsPerSecond += f.RequestsPerSecond
+			}
+		}
+	}
+	return out, nil
+}
+
+// LatencyStats returns the percentiles of the histograms shared by the muxes
+func (w *workers) LatencyStats() (*engine.LatencyStats, error) {
+	return w.muxes[0].LatencyStats()
+}
+
+// frontendsInFlight returns the requests in flight of the bulkheads the muxes share
+func (w *workers) frontendsInFlight() map[string]int64 {
+	return w.muxes[0].frontendsInFlight()
+}
+
+// frontendsRetryBudget returns the utilization of the retry budgets the muxes share
+func (w *workers) frontendsRetryBudget() map[string]int64 {
+	return w.muxes[0].frontendsRetryBudget()
+}
+
+func (w *workers) serverStates() []reporter.ServerState {
+	return w.muxes[0].serverStates()
+}
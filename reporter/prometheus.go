@@ -0,0 +1,212 @@
+package reporter
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Prometheus collects metrics to be scraped by Prometheus from the handler
+type Prometheus struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	up       *prometheus.GaugeVec
+	conns    *prometheus.GaugeVec
+	resyncs  prometheus.Counter
+	rejected *prometheus.CounterVec
+	oversize *prometheus.CounterVec
+	maint    *prometheus.CounterVec
+	cache    *prometheus.CounterVec
+	degraded *prometheus.CounterVec
+	expiry   *prometheus.GaugeVec
+	startup  *prometheus.GaugeVec
+
+	mtx     sync.Mutex
+	servers map[ServerState]bool
+	certs   map[CertState]bool
+}
+
+// NewPrometheus returns Prometheus reporter, latency histogram uses the given buckets in seconds,
+// prometheus.DefBuckets are used if none are given
+func NewPrometheus(buckets []float64) (*Prometheus, error) {
+	p := &Prometheus{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_requests_total",
+			Help:      "Number of requests served by the frontend",
+		}, []string{"frontend", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_request_duration_seconds",
+			Help:      "Latency of requests served by the frontend",
+			Buckets:   buckets,
+		}, []string{"frontend"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vulcand",
+			Name:      "backend_server_up",
+			Help:      "Whether the backend server receives traffic",
+		}, []string{"backend", "server"}),
+		conns: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vulcand",
+			Name:      "connections",
+			Help:      "Number of client connections in the given state",
+		}, []string{"addr", "state"}),
+		resyncs: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "engine_resyncs_total",
+			Help:      "Number of full resyncs with the engine after the engine watch fell behind",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "listener_rejected_connections_total",
+			Help:      "Number of client connections closed because the listener was at its connection limit",
+		}, []string{"listener"}),
+		oversize: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_oversized_requests_total",
+			Help:      "Number of requests rejected because the body exceeded the frontend limit",
+		}, []string{"frontend"}),
+		maint: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_maintenance_requests_total",
+			Help:      "Number of requests served the maintenance response by the frontend in maintenance",
+		}, []string{"frontend"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_cache_lookups_total",
+			Help:      "Number of lookups of the frontend response cache by the result, hit or miss",
+		}, []string{"frontend", "result"}),
+		degraded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "vulcand",
+			Name:      "frontend_degraded_requests_total",
+			Help:      "Number of requests decided by the fail mode of the middleware without the service it depends on, allowed or denied",
+		}, []string{"frontend", "middleware", "decision"}),
+		expiry: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vulcand",
+			Name:      "certificate_expiry_days",
+			Help:      "Days left until the host certificate or its OCSP staple expires",
+		}, []string{"host", "kind"}),
+		startup: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "vulcand",
+			Name:      "startup_phase_duration_seconds",
+			Help:      "Time the phase of the service startup took, the whole startup is the total phase",
+		}, []string{"phase"}),
+		servers: make(map[ServerState]bool),
+		certs:   make(map[CertState]bool),
+	}
+	for _, c := range []prometheus.Collector{p.requests, p.latency, p.up, p.conns, p.resyncs, p.rejected, p.oversize, p.maint, p.cache, p.degraded, p.expiry, p.startup, prometheus.NewGoCollector()} {
+		if err := p.registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *Prometheus) ObserveRequest(frontend string, code int, latency time.Duration) {
+	p.requests.WithLabelValues(frontend, strconv.Itoa(code)).Inc()
+	p.latency.WithLabelValues(frontend).Observe(latency.Seconds())
+}
+
+func (p *Prometheus) ReportServers(servers []ServerState) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	reported := make(map[ServerState]bool, len(servers))
+	for _, s := range servers {
+		key := ServerState{Backend: s.Backend, Server: s.Server}
+		reported[key] = true
+		var up float64
+		if s.Up {
+			up = 1
+		}
+		p.up.WithLabelValues(s.Backend, s.Server).Set(up)
+	}
+	for key := range p.servers {
+		if !reported[key] {
+			p.up.DeleteLabelValues(key.Backend, key.Server)
+		}
+	}
+	p.servers = reported
+}
+
+func (p *Prometheus) ReportConns(addr, state string, count int64) {
+	p.conns.WithLabelValues(addr, state).Set(float64(count))
+}
+
+func (p *Prometheus) ObserveResync() {
+	p.resyncs.Inc()
+}
+
+func (p *Prometheus) ObserveRejectedConn(listener string) {
+	p.rejected.WithLabelValues(listener).Inc()
+}
+
+func (p *Prometheus) ObserveOversizedRequest(frontend string) {
+	p.oversize.WithLabelValues(frontend).Inc()
+}
+
+func (p *Prometheus) ObserveMaintenanceRequest(frontend string) {
+	p.maint.WithLabelValues(frontend).Inc()
+}
+
+func (p *Prometheus) ObserveCacheLookup(frontend string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	p.cache.WithLabelValues(frontend, result).Inc()
+}
+
+func (p *Prometheus) ObserveDegradedRequest(frontend, middleware string, allowed bool) {
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+	p.degraded.WithLabelValues(frontend, middleware, decision).Inc()
+}
+
+func (p *Prometheus) ReportCerts(certs []CertState) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	reported := make(map[CertState]bool, len(certs))
+	for _, c := range certs {
+		reported[CertState{Host: c.Host, Kind: c.Kind}] = true
+		p.expiry.WithLabelValues(c.Host, c.Kind).Set(c.DaysLeft)
+	}
+	for key := range p.certs {
+		if !reported[key] {
+			p.expiry.DeleteLabelValues(key.Host, key.Kind)
+		}
+	}
+	p.certs = reported
+}
+
+func (p *Prometheus) ObserveStartupPhase(phase string, d time.Duration) {
+	p.startup.WithLabelValues(phase).Set(d.Seconds())
+}
+
+// Handler returns HTTP handler exposing the metrics in Prometheus format
+func (p *Prometheus) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mfs, err := p.registry.Gather()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		contentType := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(contentType))
+		enc := expfmt.NewEncoder(w, contentType)
+		for _, mf := range mfs {
+			if err := enc.Encode(mf); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,132 @@
+// Package reporter provides a metrics abstraction the proxy reports to, so the same metrics
+// can be exported to several metrics backends, e.g. statsd and Prometheus, at once.
+package reporter
+
+import (
+	"time"
+)
+
+// Reporter receives metrics emitted by the proxy
+type Reporter interface {
+	// ObserveRequest records the request served by the frontend
+	ObserveRequest(frontend string, code int, latency time.Duration)
+	// ReportServers records the state of the backend servers, servers that were reported
+	// before but are missing from the list are considered removed
+	ReportServers(servers []ServerState)
+	// ReportConns records the amount of client connections in the given state on the listener address
+	ReportConns(addr, state string, count int64)
+	// ObserveResync records the full resync of the proxy with the engine after the engine watch fell behind
+	ObserveResync()
+	// ObserveRejectedConn records the client connection closed because the listener is at its connection limit
+	ObserveRejectedConn(listener string)
+	// ObserveOversizedRequest records the request rejected because its body exceeds the frontend limit
+	ObserveOversizedRequest(frontend string)
+	// ObserveMaintenanceRequest records the request served the maintenance response by the frontend in maintenance
+	ObserveMaintenanceRequest(frontend string)
+	// ObserveCacheLookup records the lookup of the response cache of the frontend, hit tells whether the response
+	// was served from the cache
+	ObserveCacheLookup(frontend string, hit bool)
+	// ObserveDegradedRequest records the request decided by the fail mode of the middleware of the type, as the
+	// service the middleware depends on is unreachable, allowed tells whether the request was passed through
+	ObserveDegradedRequest(frontend, middleware string, allowed bool)
+	// ReportCerts records the days left until the host certificates and OCSP staples expire, certificates
+	// that were reported before but are missing from the list are considered removed
+	ReportCerts(certs []CertState)
+	// ObserveStartupPhase records the duration of the phase of the service startup, the whole startup is
+	// reported as the total phase
+	ObserveStartupPhase(phase string, d time.Duration)
+}
+
+// ServerState tells whether the backend server receives traffic
+type ServerState struct {
+	Backend string
+	Server  string
+	Up      bool
+}
+
+const (
+	// CertKindCertificate is the host certificate
+	CertKindCertificate = "certificate"
+	// CertKindOCSP is the OCSP staple of the host certificate
+	CertKindOCSP = "ocsp"
+)
+
+// CertState tells how many days are left until the host certificate or its OCSP staple expires
+type CertState struct {
+	Host     string
+	Kind     string
+	DaysLeft float64
+}
+
+// Multi returns a reporter that fans out metrics to all the given reporters
+func Multi(rs ...Reporter) Reporter {
+	return multi(rs)
+}
+
+type multi []Reporter
+
+func (m multi) ObserveRequest(frontend string, code int, latency time.Duration) {
+	for _, r := range m {
+		r.ObserveRequest(frontend, code, latency)
+	}
+}
+
+func (m multi) ReportServers(servers []ServerState) {
+	for _, r := range m {
+		r.ReportServers(servers)
+	}
+}
+
+func (m multi) ReportConns(addr, state string, count int64) {
+	for _, r := range m {
+		r.ReportConns(addr, state, count)
+	}
+}
+
+func (m multi) ObserveResync() {
+	for _, r := range m {
+		r.ObserveResync()
+	}
+}
+
+func (m multi) ObserveRejectedConn(listener string) {
+	for _, r := range m {
+		r.ObserveRejectedConn(listener)
+	}
+}
+
+func (m multi) ObserveOversizedRequest(frontend string) {
+	for _, r := range m {
+		r.ObserveOversizedRequest(frontend)
+	}
+}
+
+func (m multi) ObserveMaintenanceRequest(frontend string) {
+	for _, r := range m {
+		r.ObserveMaintenanceRequest(frontend)
+	}
+}
+
+func (m multi) ObserveCacheLookup(frontend string, hit bool) {
+	for _, r := range m {
+		r.ObserveCacheLookup(frontend, hit)
+	}
+}
+
+func (m multi) ObserveDegradedRequest(frontend, middleware string, allowed bool) {
+	for _, r := range m {
+		r.ObserveDegradedRequest(frontend, middleware, allowed)
+	}
+}
+
+func (m multi) ReportCerts(certs []CertState) {
+	for _, r := range m {
+		r.ReportCerts(certs)
+	}
+}
+
+func (m multi) ObserveStartupPhase(phase string, d time.Duration) {
+	for _, r := range m {
+		r.ObserveStartupPhase(phase, d)
+	}
+}
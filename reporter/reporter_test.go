@@ -0,0 +1,105 @@
+package reporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mailgun/metrics"
+	. "gopkg.in/check.v1"
+)
+
+func TestReporter(t *testing.T) { TestingT(t) }
+
+type ReporterSuite struct{}
+
+var _ = Suite(&ReporterSuite{})
+
+func (s *ReporterSuite) TestPrometheus(c *C) {
+	p, err := NewPrometheus([]float64{0.1, 1})
+	c.Assert(err, IsNil)
+
+	p.ObserveRequest("fe1", 200, 50*time.Millisecond)
+	p.ObserveRequest("fe1", 200, 500*time.Millisecond)
+	p.ObserveRequest("fe1", 502, time.Second)
+	p.ReportServers([]ServerState{{Backend: "b1", Server: "s1", Up: true}, {Backend: "b1", Server: "s2"}})
+	p.ReportConns("localhost:8181", "active", 3)
+	p.ObserveResync()
+	p.ObserveRejectedConn("l1")
+	p.ObserveOversizedRequest("fe1")
+	p.ObserveMaintenanceRequest("fe1")
+	p.ObserveCacheLookup("fe1", true)
+	p.ObserveCacheLookup("fe1", false)
+	p.ObserveCacheLookup("fe1", true)
+	p.ObserveDegradedRequest("fe1", "jwt", false)
+	p.ReportCerts([]CertState{{Host: "example.com", Kind: CertKindCertificate, DaysLeft: 30.5}, {Host: "example.com", Kind: CertKindOCSP, DaysLeft: 2}})
+	p.ObserveStartupPhase("supervisor", 1500*time.Millisecond)
+
+	out := scrape(c, p)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_requests_total{code="200",frontend="fe1"} 2\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_requests_total{code="502",frontend="fe1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_request_duration_seconds_bucket{frontend="fe1",le="0.1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_request_duration_seconds_bucket{frontend="fe1",le="1"} 3\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_backend_server_up{backend="b1",server="s1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_backend_server_up{backend="b1",server="s2"} 0\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_connections{addr="localhost:8181",state="active"} 3\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_engine_resyncs_total 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_listener_rejected_connections_total{listener="l1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_oversized_requests_total{frontend="fe1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_maintenance_requests_total{frontend="fe1"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_cache_lookups_total{frontend="fe1",result="hit"} 2\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_cache_lookups_total{frontend="fe1",result="miss"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_frontend_degraded_requests_total{decision="denied",frontend="fe1",middleware="jwt"} 1\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_certificate_expiry_days{host="example.com",kind="certificate"} 30.5\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_certificate_expiry_days{host="example.com",kind="ocsp"} 2\n.*`)
+	c.Assert(out, Matches, `(?s).*vulcand_startup_phase_duration_seconds{phase="supervisor"} 1.5\n.*`)
+
+	// removed servers are no longer exported
+	p.ReportServers([]ServerState{{Backend: "b1", Server: "s1", Up: true}})
+	out = scrape(c, p)
+	c.Assert(out, Matches, `(?s).*vulcand_backend_server_up{backend="b1",server="s1"} 1\n.*`)
+	c.Assert(out, Not(Matches), `(?s).*server="s2".*`)
+
+	// so are the removed certificates
+	p.ReportCerts([]CertState{{Host: "example.com", Kind: CertKindCertificate, DaysLeft: 30}})
+	out = scrape(c, p)
+	c.Assert(out, Not(Matches), `(?s).*kind="ocsp".*`)
+}
+
+func (s *ReporterSuite) TestMetricLabel(c *C) {
+	c.Assert(MetricLabel("frontend-1_a"), Equals, "frontend-1_a")
+	c.Assert(MetricLabel("a.b:c|d@e f"), Equals, "a_b_c_d_e_f")
+	c.Assert(MetricLabel(""), Equals, "_")
+}
+
+func (s *ReporterSuite) TestMulti(c *C) {
+	p1, err := NewPrometheus(nil)
+	c.Assert(err, IsNil)
+	p2, err := NewPrometheus(nil)
+	c.Assert(err, IsNil)
+
+	r := Multi(NewStatsd(metrics.NewNop()), p1, p2)
+	r.ObserveRequest("fe1", 200, time.Millisecond)
+	r.ReportConns("localhost:8181", "idle", 1)
+
+	for _, p := range []*Prometheus{p1, p2} {
+		out := scrape(c, p)
+		c.Assert(out, Matches, `(?s).*vulcand_frontend_requests_total{code="200",frontend="fe1"} 1\n.*`)
+		c.Assert(out, Matches, `(?s).*vulcand_connections{addr="localhost:8181",state="idle"} 1\n.*`)
+	}
+}
+
+func scrape(c *C, p *Prometheus) string {
+	srv := httptest.NewServer(p.Handler())
+	defer srv.Close()
+
+	re, err := http.Get(srv.URL)
+	c.Assert(err, IsNil)
+	defer re.Body.Close()
+	c.Assert(re.StatusCode, Equals, http.StatusOK)
+	body, err := ioutil.ReadAll(re.Body)
+	c.Assert(err, IsNil)
+	return string(body)
+}
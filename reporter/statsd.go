@@ -0,0 +1,97 @@
+package reporter
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mailgun/metrics"
+)
+
+// NewStatsd returns a reporter emitting gauges with the statsd metrics client
+func NewStatsd(c metrics.Client) Reporter {
+	return &statsd{c: c}
+}
+
+type statsd struct {
+	c metrics.Client
+}
+
+// ObserveRequest is a no-op, statsd frontend stats are emitted from the aggregated round trip metrics
+func (s *statsd) ObserveRequest(frontend string, code int, latency time.Duration) {
+}
+
+func (s *statsd) ReportServers(servers []ServerState) {
+	for _, srv := range servers {
+		var up int64
+		if srv.Up {
+			up = 1
+		}
+		s.c.Gauge(s.c.Metric("backend", escape(srv.Backend), "server", escape(srv.Server), "up"), up, 1)
+	}
+}
+
+func (s *statsd) ReportConns(addr, state string, count int64) {
+	s.c.Gauge(s.c.Metric("conns", addr, state), count, 1)
+}
+
+func (s *statsd) ObserveResync() {
+	s.c.Inc(s.c.Metric("engine", "resyncs"), 1, 1)
+}
+
+func (s *statsd) ObserveRejectedConn(listener string) {
+	s.c.Inc(s.c.Metric("listener", escape(listener), "rejected_conns"), 1, 1)
+}
+
+func (s *statsd) ObserveOversizedRequest(frontend string) {
+	s.c.Inc(s.c.Metric("frontend", escape(frontend), "oversized_requests"), 1, 1)
+}
+
+func (s *statsd) ObserveMaintenanceRequest(frontend string) {
+	s.c.Inc(s.c.Metric("frontend", escape(frontend), "maintenance_requests"), 1, 1)
+}
+
+func (s *statsd) ObserveCacheLookup(frontend string, hit bool) {
+	result := "cache_misses"
+	if hit {
+		result = "cache_hits"
+	}
+	s.c.Inc(s.c.Metric("frontend", escape(frontend), result), 1, 1)
+}
+
+func (s *statsd) ObserveDegradedRequest(frontend, middleware string, allowed bool) {
+	decision := "denied"
+	if allowed {
+		decision = "allowed"
+	}
+	s.c.Inc(s.c.Metric("frontend", escape(frontend), "degraded", escape(middleware), decision), 1, 1)
+}
+
+func (s *statsd) ReportCerts(certs []CertState) {
+	for _, c := range certs {
+		s.c.Gauge(s.c.Metric("host", escape(c.Host), c.Kind, "expiry_days"), int64(c.DaysLeft), 1)
+	}
+}
+
+func (s *statsd) ObserveStartupPhase(phase string, d time.Duration) {
+	s.c.TimingMs(s.c.Metric("startup", escape(phase)), d, 1)
+}
+
+func escape(in string) string {
+	return MetricLabel(in)
+}
+
+// MetricLabel returns the id safe to be used as the component of the statsd metric name. The dots would split
+// the component, the colons, pipes and at signs would break the statsd line, so every character other than
+// the letters, digits, dashes and underscores is replaced with the underscore.
+func MetricLabel(id string) string {
+	if id == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, id)
+}
@@ -5,4 +5,5 @@ docker run --rm \
  -e HOST_PROJECT_PATH=$(pwd) \
  -e HOST_GOPATH=${GOPATH} \
  -e DOCKER_IMAGE_NAME=${DOCKER_IMAGE_NAME-mailgun/vulcand} \
- golang:1.4-onbuild bash $(pwd)/scripts/static-compile-docker.sh
+ -e GO111MODULE=off \
+ golang:1.21 bash $(pwd)/scripts/static-compile-docker.sh
@@ -2,7 +2,9 @@ package secret
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+
 	"github.com/vulcand/vulcand/engine"
 )
 
@@ -44,4 +46,53 @@ func SealKeyPairToJSON(box *Box, keyPair *engine.KeyPair) ([]byte, error) {
 	return SealedValueToJSON(sealed)
 }
 
+// SealMiddlewareToJSON encodes the middleware with its parameters sealed, so the credentials held by the
+// middleware are not stored in the clear
+func SealMiddlewareToJSON(box *Box, m engine.Middleware) ([]byte, error) {
+	bytes, err := json.Marshal(m.Middleware)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := box.Seal(bytes)
+	if err != nil {
+		return nil, err
+	}
+	data, err := SealedValueToJSON(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&engine.RawMiddleware{
+		Id:         m.Id,
+		Type:       m.Type,
+		Priority:   m.Priority,
+		Middleware: data,
+		Sealed:     true,
+	})
+}
+
+// OpenMiddlewareJSON returns the middleware JSON with its parameters opened, middlewares that are not
+// sealed are returned as is
+func OpenMiddlewareJSON(box *Box, in []byte) ([]byte, error) {
+	var m engine.RawMiddleware
+	if err := json.Unmarshal(in, &m); err != nil {
+		return nil, err
+	}
+	if !m.Sealed {
+		return in, nil
+	}
+	if box == nil {
+		return nil, errors.New("need secretbox to open sealed data")
+	}
+	sv, err := SealedValueFromJSON(m.Middleware)
+	if err != nil {
+		return nil, err
+	}
+	opened, err := box.Open(sv)
+	if err != nil {
+		return nil, err
+	}
+	m.Middleware, m.Sealed = opened, false
+	return json.Marshal(&m)
+}
+
 const encryptionSecretBox = "secretbox.v1"
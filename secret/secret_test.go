@@ -1,8 +1,13 @@
 package secret
 
 import (
+	"encoding/json"
+	"net/http"
+	"strings"
 	"testing"
 
+	"github.com/vulcand/vulcand/engine"
+
 	. "gopkg.in/check.v1"
 )
 
@@ -58,3 +63,46 @@ func (s *SecretSuite) TestEncryptDecryptJSON(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(out, DeepEquals, message)
 }
+
+func (s *SecretSuite) TestSealOpenMiddleware(c *C) {
+	b, err := NewBoxFromKeyString(mustKeyString(c))
+	c.Assert(err, IsNil)
+
+	m := engine.Middleware{Id: "auth", Type: "test", Priority: 1, Middleware: &testMiddleware{User: "hash"}}
+	data, err := SealMiddlewareToJSON(b, m)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(data), "hash"), Equals, false)
+
+	out, err := OpenMiddlewareJSON(b, data)
+	c.Assert(err, IsNil)
+	var raw engine.RawMiddleware
+	c.Assert(json.Unmarshal(out, &raw), IsNil)
+	c.Assert(raw.Id, Equals, "auth")
+	c.Assert(raw.Priority, Equals, 1)
+	c.Assert(raw.Sealed, Equals, false)
+	c.Assert(string(raw.Middleware), Equals, `{"User":"hash"}`)
+
+	// middlewares that are not sealed are returned as is
+	plain := []byte(`{"Id":"auth","Type":"test","Middleware":{"User":"hash"}}`)
+	out, err = OpenMiddlewareJSON(nil, plain)
+	c.Assert(err, IsNil)
+	c.Assert(out, DeepEquals, plain)
+
+	// sealed ones can not be opened without the box
+	_, err = OpenMiddlewareJSON(nil, data)
+	c.Assert(err, NotNil)
+}
+
+type testMiddleware struct {
+	User string
+}
+
+func (*testMiddleware) NewHandler(next http.Handler) (http.Handler, error) {
+	return next, nil
+}
+
+func mustKeyString(c *C) string {
+	key, err := NewKeyString()
+	c.Assert(err, IsNil)
+	return key
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// certWatcher reloads the key pair when its files change on disk. The files are polled, the change is applied
+// once the files stay the same for a whole interval, so the certificate and the key written one after another
+// result in one reload. The key pair failing to load is not applied, the previous one is served until the files
+// change again.
+type certWatcher struct {
+	name     string
+	files    []string
+	interval time.Duration
+	reload   func() error
+	stopC    chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newCertWatcher(name string, interval time.Duration, reload func() error, files ...string) *certWatcher {
+	return &certWatcher{
+		name:     name,
+		files:    files,
+		interval: interval,
+		reload:   reload,
+		stopC:    make(chan struct{}),
+	}
+}
+
+func (w *certWatcher) Start() {
+	log.Infof("Watching %v certificate files %v every %v", w.name, w.files, w.interval)
+	// the files are compared to the ones seen on start, so the changes made right after it are not missed
+	applied, _ := w.signature()
+	w.wg.Add(1)
+	go w.watch(applied)
+}
+
+func (w *certWatcher) Stop() {
+	close(w.stopC)
+	w.wg.Wait()
+}
+
+// watch polls the files, applied is the state of the files served at the moment
+func (w *certWatcher) watch(applied string) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// pending is the state seen by the last poll
+	pending := applied
+	for {
+		select {
+		case <-ticker.C:
+			sig, err := w.signature()
+			if err != nil {
+				// the files are being replaced, e.g. renamed over, the next poll sees them
+				log.Debugf("Failed to stat %v certificate files: %v", w.name, err)
+				pending = ""
+				continue
+			}
+			if sig == applied || sig != pending {
+				pending = sig
+				continue
+			}
+			applied = sig
+			if err := w.reload(); err != nil {
+				log.Errorf("Failed to reload %v certificate, keeping the previous one: %v", w.name, err)
+				continue
+			}
+			log.Infof("Reloaded %v certificate from %v", w.name, w.files)
+		case <-w.stopC:
+			return
+		}
+	}
+}
+
+// signature returns the modification times and the sizes of the files
+func (w *certWatcher) signature() (string, error) {
+	parts := make([]string, 0, len(w.files))
+	for _, path := range w.files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("%v:%d:%d", path, fi.ModTime().UnixNano(), fi.Size()))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// certificateHolder serves the key pair to the TLS handshakes, the key pair is swapped in place on reload
+type certificateHolder struct {
+	certFile, keyFile string
+	cert              atomic.Value
+}
+
+// load reads and validates the key pair, the one served so far is kept if it fails
+func (h *certificateHolder) load() error {
+	keyPair, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		return err
+	}
+	h.cert.Store(&keyPair)
+	return nil
+}
+
+func (h *certificateHolder) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load().(*tls.Certificate), nil
+}
@@ -0,0 +1,174 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+const testWatchInterval = 20 * time.Millisecond
+
+// newTestKeyPair returns the PEM encoded self-signed certificate and its key
+func newTestKeyPair(c *check.C) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// writeKeyPair writes the certificate and the key files to the dir and returns their paths
+func writeKeyPair(c *check.C, dir string, cert, key []byte) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	c.Assert(ioutil.WriteFile(certFile, cert, 0600), check.IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, key, 0600), check.IsNil)
+	return certFile, keyFile
+}
+
+// touch changes the modification time of the file, so the watcher sees the file changed
+func touch(c *check.C, path string, t time.Time) {
+	c.Assert(os.Chtimes(path, t, t), check.IsNil)
+}
+
+// waitReloads waits until the reloads counted reach the expected number, then checks no more follow
+func waitReloads(c *check.C, reloads *int32, expected int32) {
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(reloads) < expected && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(5 * testWatchInterval)
+	c.Assert(atomic.LoadInt32(reloads), check.Equals, expected)
+}
+
+func (s *ServiceSuite) TestCertWatcherDebounce(c *check.C) {
+	certFile, keyFile := writeKeyPair(c, c.MkDir(), []byte("cert"), []byte("key"))
+	var reloads int32
+	w := newCertWatcher("test", testWatchInterval, func() error {
+		atomic.AddInt32(&reloads, 1)
+		return nil
+	}, certFile, keyFile)
+	w.Start()
+	defer w.Stop()
+
+	// the files not changing are not reloaded
+	time.Sleep(5 * testWatchInterval)
+	c.Assert(atomic.LoadInt32(&reloads), check.Equals, int32(0))
+
+	// the certificate and the key written one after another are reloaded once
+	now := time.Now()
+	touch(c, certFile, now.Add(time.Second))
+	touch(c, keyFile, now.Add(time.Second))
+	waitReloads(c, &reloads, 1)
+
+	touch(c, certFile, now.Add(2*time.Second))
+	waitReloads(c, &reloads, 2)
+}
+
+func (s *ServiceSuite) TestCertWatcherFailedReload(c *check.C) {
+	certFile, keyFile := writeKeyPair(c, c.MkDir(), []byte("cert"), []byte("key"))
+	var reloads int32
+	w := newCertWatcher("test", testWatchInterval, func() error {
+		if atomic.AddInt32(&reloads, 1) == 1 {
+			return errors.New("bad key pair")
+		}
+		return nil
+	}, certFile, keyFile)
+	w.Start()
+	defer w.Stop()
+
+	// the failed reload is not retried until the files change again
+	now := time.Now()
+	touch(c, keyFile, now.Add(time.Second))
+	waitReloads(c, &reloads, 1)
+
+	touch(c, keyFile, now.Add(2*time.Second))
+	waitReloads(c, &reloads, 2)
+}
+
+func (s *ServiceSuite) TestCertWatcherMissingFiles(c *check.C) {
+	certFile, keyFile := writeKeyPair(c, c.MkDir(), []byte("cert"), []byte("key"))
+	var reloads int32
+	w := newCertWatcher("test", testWatchInterval, func() error {
+		atomic.AddInt32(&reloads, 1)
+		return nil
+	}, certFile, keyFile)
+	w.Start()
+	defer w.Stop()
+
+	// the files being replaced are reloaded once they are back
+	c.Assert(os.Remove(keyFile), check.IsNil)
+	time.Sleep(5 * testWatchInterval)
+	c.Assert(atomic.LoadInt32(&reloads), check.Equals, int32(0))
+
+	writeKeyPair(c, filepath.Dir(certFile), []byte("cert"), []byte("key"))
+	touch(c, keyFile, time.Now().Add(time.Second))
+	waitReloads(c, &reloads, 1)
+}
+
+func (s *ServiceSuite) TestCertWatcherStop(c *check.C) {
+	certFile, keyFile := writeKeyPair(c, c.MkDir(), []byte("cert"), []byte("key"))
+	var reloads int32
+	w := newCertWatcher("test", testWatchInterval, func() error {
+		atomic.AddInt32(&reloads, 1)
+		return nil
+	}, certFile, keyFile)
+	w.Start()
+	w.Stop()
+
+	// the stopped watcher does not reload the changed files
+	touch(c, certFile, time.Now().Add(time.Second))
+	time.Sleep(5 * testWatchInterval)
+	c.Assert(atomic.LoadInt32(&reloads), check.Equals, int32(0))
+}
+
+func (s *ServiceSuite) TestCertificateHolder(c *check.C) {
+	cert, key := newTestKeyPair(c)
+	certFile, keyFile := writeKeyPair(c, c.MkDir(), cert, key)
+	h := &certificateHolder{certFile: certFile, keyFile: keyFile}
+	c.Assert(h.load(), check.IsNil)
+
+	first, err := h.getCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, check.IsNil)
+	expected, err := tls.X509KeyPair(cert, key)
+	c.Assert(err, check.IsNil)
+	c.Assert(first.Certificate, check.DeepEquals, expected.Certificate)
+
+	// the bad key pair is not loaded, the previous one is served
+	writeKeyPair(c, filepath.Dir(certFile), cert, []byte("bad key"))
+	c.Assert(h.load(), check.NotNil)
+	out, err := h.getCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, check.IsNil)
+	c.Assert(out, check.Equals, first)
+
+	// the good key pair replaces the served one
+	cert, key = newTestKeyPair(c)
+	writeKeyPair(c, filepath.Dir(certFile), cert, key)
+	c.Assert(h.load(), check.IsNil)
+	out, err = h.getCertificate(&tls.ClientHelloInfo{})
+	c.Assert(err, check.IsNil)
+	expected, err = tls.X509KeyPair(cert, key)
+	c.Assert(err, check.IsNil)
+	c.Assert(out.Certificate, check.DeepEquals, expected.Certificate)
+}
@@ -0,0 +1,222 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vulcand/vulcand/proxy"
+)
+
+const (
+	// maxFilesPerMessage keeps the descriptors of the message below SCM_MAX_FD of the kernel
+	maxFilesPerMessage = 200
+	// maxFilesMetadataBytes limits the metadata of the message read by the child
+	maxFilesMetadataBytes = 1 << 20
+)
+
+// filesSocketPair returns the connected unix sockets the parent passes the listening sockets to the child with,
+// the child end is inherited by the child process
+func filesSocketPair() (*net.UnixConn, *os.File, error) {
+	// SOCK_CLOEXEC is not defined on darwin and the BSDs, the fork lock keeps the descriptors from leaking
+	// to the processes started before they are marked
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
+	parent := os.NewFile(uintptr(fds[0]), "files-parent")
+	defer parent.Close()
+	child := os.NewFile(uintptr(fds[1]), "files-child")
+	conn, err := net.FileConn(parent)
+	if err != nil {
+		child.Close()
+		return nil, nil, err
+	}
+	return conn.(*net.UnixConn), child, nil
+}
+
+// sendFiles passes the files with SCM_RIGHTS, every message is the length of the JSON metadata followed by the
+// metadata, with the descriptors attached. The message with no metadata ends the transfer.
+func sendFiles(conn *net.UnixConn, files []*proxy.FileDescriptor, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	for len(files) != 0 {
+		batch := files
+		if len(batch) > maxFilesPerMessage {
+			batch = batch[:maxFilesPerMessage]
+		}
+		files = files[len(batch):]
+
+		meta := make([]fileDescriptor, len(batch))
+		fds := make([]int, len(batch))
+		for i, f := range batch {
+			// FileFD is the index of the descriptor in the message
+			meta[i] = fileDescriptor{FileFD: i, FileName: f.File.Name(), Address: f.Address}
+			fds[i] = int(f.File.Fd())
+		}
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := writeFilesMessage(conn, data, syscall.UnixRights(fds...)); err != nil {
+			return err
+		}
+	}
+	return writeFilesMessage(conn, nil, nil)
+}
+
+func writeFilesMessage(conn *net.UnixConn, data, oob []byte) error {
+	msg := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(msg, uint32(len(data)))
+	copy(msg[4:], data)
+	n, _, err := conn.WriteMsgUnix(msg, oob, nil)
+	if err != nil {
+		return err
+	}
+	// the descriptors are sent with the first write, the rest of the metadata does not carry them
+	if n < len(msg) {
+		_, err = conn.Write(msg[n:])
+	}
+	return err
+}
+
+// receiveFiles reads the files passed by sendFiles
+func receiveFiles(conn *net.UnixConn, timeout time.Duration) ([]*proxy.FileDescriptor, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	var files []*proxy.FileDescriptor
+	closeAll := func() {
+		for _, f := range files {
+			f.File.Close()
+		}
+	}
+	for {
+		batch, done, err := readFilesMessage(conn)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if done {
+			return files, nil
+		}
+		files = append(files, batch...)
+	}
+}
+
+func readFilesMessage(conn *net.UnixConn) ([]*proxy.FileDescriptor, bool, error) {
+	header := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(maxFilesPerMessage*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, false, err
+	}
+	var fds []int
+	if oobn != 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, false, err
+		}
+		for i := range msgs {
+			rights, err := syscall.ParseUnixRights(&msgs[i])
+			if err != nil {
+				return nil, false, err
+			}
+			fds = append(fds, rights...)
+		}
+	}
+	closeFds := func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		closeFds()
+		return nil, false, fmt.Errorf("passed descriptors were truncated")
+	}
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		closeFds()
+		return nil, false, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size == 0 {
+		closeFds()
+		return nil, true, nil
+	}
+	if size > maxFilesMetadataBytes {
+		closeFds()
+		return nil, false, fmt.Errorf("files metadata of %d bytes exceeds the limit", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		closeFds()
+		return nil, false, err
+	}
+	var meta []fileDescriptor
+	if err := json.Unmarshal(data, &meta); err != nil {
+		closeFds()
+		return nil, false, err
+	}
+	if len(meta) != len(fds) {
+		closeFds()
+		return nil, false, fmt.Errorf("got %d descriptors for %d files", len(fds), len(meta))
+	}
+	files := make([]*proxy.FileDescriptor, len(meta))
+	for i, m := range meta {
+		if m.FileFD < 0 || m.FileFD >= len(fds) {
+			closeFds()
+			return nil, false, fmt.Errorf("bad descriptor index %d", m.FileFD)
+		}
+		files[i] = &proxy.FileDescriptor{File: os.NewFile(uintptr(fds[m.FileFD]), m.FileName), Address: m.Address}
+	}
+	return files, false, nil
+}
+
+// filesFromSocket reads the files passed by the parent over the inherited unix socket descriptor
+func filesFromSocket(fdString string, timeout time.Duration) ([]*proxy.FileDescriptor, error) {
+	fd, err := strconv.Atoi(fdString)
+	if err != nil {
+		return nil, fmt.Errorf("bad socket descriptor '%v': %v", fdString, err)
+	}
+	f := os.NewFile(uintptr(fd), "files-child")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("descriptor %d is not a unix socket", fd)
+	}
+	return receiveFiles(uc, timeout)
+}
+
+// childEnv is the environment of this process without the variables describing the files passed by the parent
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, vulcandFilesKey+"=") || strings.HasPrefix(kv, vulcandFilesSocketKey+"=") || strings.HasPrefix(kv, vulcandReadyKey+"=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
@@ -0,0 +1,153 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy"
+	check "gopkg.in/check.v1"
+)
+
+// socketPair returns the connected ends the parent sends the files with and the child receives them with
+func socketPair(c *check.C) (*net.UnixConn, *net.UnixConn) {
+	parent, child, err := filesSocketPair()
+	c.Assert(err, check.IsNil)
+	defer child.Close()
+	conn, err := net.FileConn(child)
+	c.Assert(err, check.IsNil)
+	return parent, conn.(*net.UnixConn)
+}
+
+// tempFiles returns the files with their index as the content
+func tempFiles(c *check.C, n int) []*proxy.FileDescriptor {
+	dir := c.MkDir()
+	files := make([]*proxy.FileDescriptor, n)
+	for i := range files {
+		path := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		c.Assert(ioutil.WriteFile(path, []byte(fmt.Sprint(i)), 0600), check.IsNil)
+		f, err := os.Open(path)
+		c.Assert(err, check.IsNil)
+		files[i] = &proxy.FileDescriptor{File: f, Address: engine.Address{Network: "tcp", Address: fmt.Sprintf("localhost:%d", 8000+i)}}
+	}
+	return files
+}
+
+func (s *ServiceSuite) TestSendReceiveFiles(c *check.C) {
+	parent, child := socketPair(c)
+	defer parent.Close()
+	defer child.Close()
+
+	// the files take more than one message
+	files := tempFiles(c, maxFilesPerMessage+5)
+	defer closeFiles(files)
+	errC := make(chan error, 1)
+	go func() { errC <- sendFiles(parent, files, time.Second) }()
+
+	received, err := receiveFiles(child, time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(<-errC, check.IsNil)
+	defer closeFiles(received)
+	c.Assert(received, check.HasLen, len(files))
+	for i, f := range received {
+		c.Assert(f.Address, check.Equals, files[i].Address)
+		c.Assert(f.File.Name(), check.Equals, files[i].File.Name())
+		// the received descriptor is open on the same file
+		data, err := ioutil.ReadAll(f.File)
+		c.Assert(err, check.IsNil)
+		c.Assert(string(data), check.Equals, fmt.Sprint(i))
+	}
+
+	// no files end the transfer right away
+	go func() { errC <- sendFiles(parent, nil, time.Second) }()
+	received, err = receiveFiles(child, time.Second)
+	c.Assert(err, check.IsNil)
+	c.Assert(<-errC, check.IsNil)
+	c.Assert(received, check.HasLen, 0)
+}
+
+func (s *ServiceSuite) TestReceiveFilesErrors(c *check.C) {
+	files := tempFiles(c, 2)
+	defer closeFiles(files)
+	fds := syscall.UnixRights(int(files[0].File.Fd()), int(files[1].File.Fd()))
+	message := func(meta []fileDescriptor) []byte {
+		data, err := json.Marshal(meta)
+		c.Assert(err, check.IsNil)
+		return data
+	}
+
+	for _, t := range []struct {
+		name string
+		send func(*net.UnixConn)
+		err  string
+	}{
+		{
+			name: "parent exits before the end of the transfer",
+			send: func(conn *net.UnixConn) {
+				c.Assert(writeFilesMessage(conn, message([]fileDescriptor{{FileFD: 0}, {FileFD: 1}}), fds), check.IsNil)
+			},
+			err: "EOF",
+		},
+		{
+			name: "descriptors do not match the files",
+			send: func(conn *net.UnixConn) {
+				c.Assert(writeFilesMessage(conn, message([]fileDescriptor{{FileFD: 0}}), fds), check.IsNil)
+			},
+			err: "got 2 descriptors for 1 files",
+		},
+		{
+			name: "descriptor index is out of range",
+			send: func(conn *net.UnixConn) {
+				c.Assert(writeFilesMessage(conn, message([]fileDescriptor{{FileFD: 0}, {FileFD: 2}}), fds), check.IsNil)
+			},
+			err: "bad descriptor index 2",
+		},
+		{
+			name: "metadata is too large",
+			send: func(conn *net.UnixConn) {
+				header := make([]byte, 4)
+				binary.BigEndian.PutUint32(header, maxFilesMetadataBytes+1)
+				conn.Write(header)
+			},
+			err: "files metadata of .* bytes exceeds the limit",
+		},
+		{
+			name: "metadata is not JSON",
+			send: func(conn *net.UnixConn) {
+				c.Assert(writeFilesMessage(conn, []byte("files"), fds), check.IsNil)
+			},
+			err: "invalid character .*",
+		},
+	} {
+		parent, child := socketPair(c)
+		t.send(parent)
+		parent.Close()
+		received, err := receiveFiles(child, time.Second)
+		c.Assert(err, check.ErrorMatches, t.err, check.Commentf(t.name))
+		c.Assert(received, check.IsNil)
+		child.Close()
+	}
+
+	// the child does not wait for the parent past the timeout
+	parent, child := socketPair(c)
+	defer parent.Close()
+	defer child.Close()
+	_, err := receiveFiles(child, 50*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, ".*i/o timeout")
+}
+
+func closeFiles(files []*proxy.FileDescriptor) {
+	for _, f := range files {
+		f.File.Close()
+	}
+}
@@ -3,17 +3,41 @@ package service
 import (
 	"flag"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mailgun/metrics"
+	"github.com/vulcand/vulcand/acme"
+	"github.com/vulcand/vulcand/certmon"
+	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/stapler"
 )
 
+// DefaultSystemMetricsInterval is the default period the runtime metrics are emitted at
+const DefaultSystemMetricsInterval = 300 * time.Millisecond
+
+// DefaultCertWatchInterval is the default period the files of the default and the API certificates are polled at
+const DefaultCertWatchInterval = 10 * time.Second
+
 type Options struct {
 	ApiPort      int
 	ApiInterface string
 
+	// ApiCertFile and ApiKeyFile turn on TLS for the API server, ApiClientCAFile additionally
+	// requires API clients to present certificates signed by one of the CAs
+	ApiCertFile     string
+	ApiKeyFile      string
+	ApiClientCAFile string
+	// ApiTokenFile is the file with bearer tokens required by the mutating API endpoints, one per line.
+	// The token can also be passed in the VULCAND_API_TOKEN environment variable.
+	ApiTokenFile string
+	// EnablePprof exposes the runtime profiles and the goroutine dump on the API server, behind the API auth
+	EnablePprof bool
+
 	PidPath string
 	Port    int
 
@@ -28,23 +52,118 @@ type Options struct {
 	EtcdKeyFile             string
 	EtcdConsistency         string
 	EtcdSyncIntervalSeconds int64
+	// EtcdNamespaces are served instead of EtcdKey if set, in 'name=key' format. The key is EtcdKey/name if omitted.
+	EtcdNamespaces listOptions
+
+	// Engine is the backend storing the configuration, etcd or consul
+	Engine string
+	// ConsulAddr is the address of the Consul agent, e.g. http://localhost:8500
+	ConsulAddr string
+	// ConsulKey is the key of the Consul KV store with the configuration, namespaces use it instead of EtcdKey
+	ConsulKey string
+	// ConsulToken is the ACL token, it can also be passed in the CONSUL_HTTP_TOKEN environment variable
+	ConsulToken       string
+	ConsulDatacenter  string
+	ConsulCaFile      string
+	ConsulCertFile    string
+	ConsulKeyFile     string
+	ConsulConsistency string
 
 	Log          string
 	LogSeverity  SeverityFlag
 	LogFormatter log.Formatter // if set, .Log will be ignored
+	AccessLog    string        // path to the JSON access log file or "stdout"
+	AuditLog     string        // path to the JSON audit log of the API changes and the changes applied to the proxy or "stdout"
 
 	ServerReadTimeout    time.Duration
 	ServerWriteTimeout   time.Duration
+	ServerIdleTimeout    time.Duration
 	ServerMaxHeaderBytes int
+	ServerDrainTimeout   time.Duration
+	ShutdownTimeout      time.Duration
+
+	// TerminationDrainTimeout is the time the connections have to drain after SIGTERM before the rest are closed,
+	// counted from the signal. ShutdownTimeout applies if 0.
+	TerminationDrainTimeout time.Duration
+
+	// MaxMemBodyBytes and MaxBodyBytes limit the buffered bodies of the frontends that do not set the limits
+	MaxMemBodyBytes int64
+	MaxBodyBytes    int64
+
+	// ChildStartTimeout is the time the child forked on SIGUSR2 has to signal it is serving
+	ChildStartTimeout time.Duration
+	// ChildGracePeriod is the time the child has to keep running after the startup before the parent stops
+	ChildGracePeriod time.Duration
+
+	// StartupRetries is the number of times the engine is tried again if it is not available at startup,
+	// the default listener is served and the service is not ready in the meantime
+	StartupRetries int
+	// StartupRetryPeriod is the pause between the startup attempts
+	StartupRetryPeriod time.Duration
+
+	// TrustedProxies are the networks of the proxies in front of vulcand allowed to set X-Forwarded-For
+	TrustedProxies cidrListOptions
+
+	// RouteHeader is the header passing the ids of the frontend and the backend to the backends, off if empty
+	RouteHeader         string
+	RouteHeaderOverride bool
+
+	// FullTLSReload reloads the TLS listeners on the certificate updates instead of swapping the TLS config in place
+	FullTLSReload bool
+
+	// Workers is the number of the proxies the process runs, the proxies bind the listener addresses with
+	// SO_REUSEPORT and the kernel balances the connections between them. The limits of the frontends, the listeners
+	// and the ratelimit, connlimit and cbreaker middlewares apply to the process as a whole.
+	Workers int
 
 	EndpointDialTimeout time.Duration
 	EndpointReadTimeout time.Duration
 
 	SealKey string
 
+	ACMERenewBefore time.Duration
+
+	OCSPCacheDir string
+
+	// DefaultCertFile and DefaultKeyFile are the certificate served to the TLS clients not sending the server name
+	// or asking for an unknown one, unless a host is marked as the default one
+	DefaultCertFile string
+	DefaultKeyFile  string
+	// OCSPRetryPeriod and OCSPMaxRetryBackoff bound the delays between the retries of the failed staple refreshes
+	OCSPRetryPeriod     time.Duration
+	OCSPMaxRetryBackoff time.Duration
+
+	CertWarnBefore time.Duration
+	// CertWatchInterval is how often the files of the default and the API certificates are polled for changes,
+	// the changed certificates are reloaded in place. The files are polled as there is no file system notification
+	// available to vulcand, the rotated certificate is served one to two intervals after its files are written, as
+	// the files have to stay the same for a whole interval. Disabled if zero.
+	CertWatchInterval time.Duration
+
 	StatsdAddr    string
 	StatsdPrefix  string
 	MetricsClient metrics.Client
+	// MaxMetricLabels caps the number of distinct frontend and backend ids in the statsd metric names
+	MaxMetricLabels int
+	// MetricsInterval is how often the proxy metrics are emitted to statsd, and SystemMetricsInterval how often
+	// the runtime metrics are. The proxy metrics are the gauges of the rolling windows, so the longer interval
+	// only lowers the resolution and the statsd load, the runtime metrics miss the GC pauses past the 256 kept
+	// by the runtime between the reports.
+	MetricsInterval       time.Duration
+	SystemMetricsInterval time.Duration
+
+	// PrometheusBuckets are latency histogram buckets in seconds
+	PrometheusBuckets floatListOptions
+
+	// ErrorPages are the files served instead of the proxy error responses, in 'status=path' format
+	ErrorPages listOptions
+
+	// TracingEndpoint is the OTLP/HTTP traces endpoint of the OpenTelemetry collector, tracing is disabled if empty
+	TracingEndpoint   string
+	TracingSampleRate float64
+
+	// LatencyWindow is the rotation period of the latency percentiles emitted to statsd and served by the API
+	LatencyWindow time.Duration
 
 	DefaultListener bool
 
@@ -85,7 +204,76 @@ func (o *listOptions) Set(value string) error {
 	return nil
 }
 
+// Helper to parse comma separated list of floats, e.g. histogram buckets
+type floatListOptions []float64
+
+func (o *floatListOptions) String() string {
+	return fmt.Sprint(*o)
+}
+
+func (o *floatListOptions) Set(value string) error {
+	var vals []float64
+	for _, v := range strings.Split(value, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return fmt.Errorf("invalid value '%v': %v", v, err)
+		}
+		vals = append(vals, f)
+	}
+	*o = vals
+	return nil
+}
+
+// Helper to parse comma separated list of CIDRs, e.g. trusted proxy networks
+type cidrListOptions []*net.IPNet
+
+func (o *cidrListOptions) String() string {
+	return fmt.Sprint(*o)
+}
+
+func (o *cidrListOptions) Set(value string) error {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(value, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid CIDR '%v': %v", v, err)
+		}
+		nets = append(nets, n)
+	}
+	*o = nets
+	return nil
+}
+
 func validateOptions(o Options) (Options, error) {
+	if o.Engine != engineEtcd && o.Engine != engineConsul {
+		return o, fmt.Errorf("unsupported engine '%v', use %v or %v", o.Engine, engineEtcd, engineConsul)
+	}
+	if o.MaxMemBodyBytes < 0 || o.MaxBodyBytes < 0 {
+		return o, fmt.Errorf("buffer limits should be >= 0, got maxMemBodyBytes %v and maxBodyBytes %v", o.MaxMemBodyBytes, o.MaxBodyBytes)
+	}
+	if o.MaxMetricLabels < 0 {
+		return o, fmt.Errorf("maxMetricLabels should be >= 0, got %v", o.MaxMetricLabels)
+	}
+	if o.OCSPRetryPeriod < 0 || o.OCSPMaxRetryBackoff < 0 {
+		return o, fmt.Errorf("OCSP retry delays should be >= 0, got ocspRetryPeriod %v and ocspMaxRetryBackoff %v", o.OCSPRetryPeriod, o.OCSPMaxRetryBackoff)
+	}
+	if o.TerminationDrainTimeout < 0 {
+		return o, fmt.Errorf("terminationDrainTimeout should be >= 0, got %v", o.TerminationDrainTimeout)
+	}
+	if o.RouteHeader != "" {
+		if err := (&engine.HTTPFrontendRouteHeader{Header: o.RouteHeader}).Check(); err != nil {
+			return o, err
+		}
+	}
+	if o.Workers < 1 {
+		return o, fmt.Errorf("workers should be >= 1, got %v", o.Workers)
+	}
+	if o.StartupRetries < 0 {
+		return o, fmt.Errorf("startupRetries should be >= 0, got %v", o.StartupRetries)
+	}
+	if o.MetricsInterval <= 0 || o.SystemMetricsInterval <= 0 {
+		return o, fmt.Errorf("metrics intervals should be > 0, got metricsInterval %v and systemMetricsInterval %v", o.MetricsInterval, o.SystemMetricsInterval)
+	}
 	if o.EndpointDialTimeout+o.EndpointReadTimeout >= o.ServerWriteTimeout {
 		fmt.Printf("!!!!!! WARN: serverWriteTimout(%s) should be > endpointDialTimeout(%s) + endpointReadTimeout(%s)\n\n",
 			o.ServerWriteTimeout, o.EndpointDialTimeout, o.EndpointReadTimeout)
@@ -105,35 +293,83 @@ func ParseCommandLine() (options Options, err error) {
 	flag.Var(&options.EtcdNodes, "etcd", "Etcd discovery service API endpoints")
 	flag.IntVar(&options.EtcdApiVersion, "etcdApiVer", 2, "Etcd Client API version (When 3, Etcd 3.x API is used. All other values default to v2.)")
 	flag.StringVar(&options.EtcdKey, "etcdKey", "vulcand", "Etcd key for storing configuration")
+	flag.Var(&options.EtcdNamespaces, "etcdNamespace", "Namespace in 'name=key' format served instead of etcdKey, can be given several times. Ids of the namespaced objects are prefixed with 'name.'")
 	flag.StringVar(&options.EtcdCaFile, "etcdCaFile", "", "Path to CA file for etcd communication")
 	flag.StringVar(&options.EtcdCertFile, "etcdCertFile", "", "Path to cert file for etcd communication")
 	flag.StringVar(&options.EtcdKeyFile, "etcdKeyFile", "", "Path to key file for etcd communication")
 	flag.StringVar(&options.EtcdConsistency, "etcdConsistency", "STRONG", "Etcd consistency (STRONG or WEAK)")
 	flag.Int64Var(&options.EtcdSyncIntervalSeconds, "etcdSyncIntervalSeconds", 0, "Interval between updating etcd cluster information. Use 0 to disable any syncing (default behavior.)")
+	flag.StringVar(&options.Engine, "engine", engineEtcd, "Backend storing the configuration ("+engineEtcd+" or "+engineConsul+")")
+	flag.StringVar(&options.ConsulAddr, "consulAddr", "http://localhost:8500", "Consul agent HTTP API address")
+	flag.StringVar(&options.ConsulKey, "consulKey", "vulcand", "Consul KV key for storing configuration")
+	flag.StringVar(&options.ConsulToken, "consulToken", "", "Consul ACL token (the token can be set in "+consulTokenEnv+" instead)")
+	flag.StringVar(&options.ConsulDatacenter, "consulDatacenter", "", "Consul datacenter, the datacenter of the agent if empty")
+	flag.StringVar(&options.ConsulCaFile, "consulCaFile", "", "Path to CA file for Consul communication")
+	flag.StringVar(&options.ConsulCertFile, "consulCertFile", "", "Path to cert file for Consul communication")
+	flag.StringVar(&options.ConsulKeyFile, "consulKeyFile", "", "Path to key file for Consul communication")
+	flag.StringVar(&options.ConsulConsistency, "consulConsistency", "default", "Consul read consistency (default, consistent or stale)")
 	flag.StringVar(&options.PidPath, "pidPath", "", "Path to write PID file to")
 	flag.IntVar(&options.Port, "port", 8181, "Port to listen on")
 	flag.IntVar(&options.ApiPort, "apiPort", 8182, "Port to provide api on")
 
 	flag.StringVar(&options.Interface, "interface", "", "Interface to bind to")
 	flag.StringVar(&options.ApiInterface, "apiInterface", "", "Interface to for API to bind to")
+	flag.StringVar(&options.ApiCertFile, "apiCertFile", "", "Path to the API server certificate (enables TLS for the API)")
+	flag.StringVar(&options.ApiKeyFile, "apiKeyFile", "", "Path to the API server private key")
+	flag.StringVar(&options.ApiTokenFile, "apiTokenFile", "", "Path to the file with API bearer tokens, one per line (the token can be set in "+apiTokenEnv+" instead)")
+	flag.StringVar(&options.ApiClientCAFile, "apiClientCAFile", "", "Path to the CA bundle to verify API client certificates against (requires client certificates)")
+	flag.BoolVar(&options.EnablePprof, "enablePprof", false, "Expose the pprof profiles and the goroutine dump on the API server under /debug/pprof/ and /v2/debug/goroutines")
 	flag.StringVar(&options.CertPath, "certPath", "", "KeyPair to use (enables TLS)")
 	flag.StringVar(&options.Log, "log", "console", "Logging to use (console, json, syslog or logstash)")
+	flag.StringVar(&options.AccessLog, "accessLog", "", "Path to the JSON access log file or 'stdout', access logging is disabled if empty")
+	flag.StringVar(&options.AuditLog, "auditLog", "", "Path to the JSON audit log of the changes made through the API and applied to the proxy or 'stdout', disabled if empty")
 
 	options.LogSeverity.S = log.WarnLevel
 	flag.Var(&options.LogSeverity, "logSeverity", "logs at or above this level to the logging output")
 
 	flag.IntVar(&options.ServerMaxHeaderBytes, "serverMaxHeaderBytes", 1<<20, "Maximum size of request headers")
+	flag.Int64Var(&options.MaxMemBodyBytes, "maxMemBodyBytes", 1<<20, "Size of the buffered request and response bodies kept in memory, the rest spills to temporary files")
+	flag.Int64Var(&options.MaxBodyBytes, "maxBodyBytes", 0, "Buffered requests with larger bodies are rejected with 413, 0 means no limit")
 	flag.DurationVar(&options.ServerReadTimeout, "readTimeout", time.Duration(60)*time.Second, "HTTP server read timeout (deprecated)")
 	flag.DurationVar(&options.ServerReadTimeout, "serverReadTimeout", time.Duration(60)*time.Second, "HTTP server read timeout")
 	flag.DurationVar(&options.ServerWriteTimeout, "writeTimeout", time.Duration(60)*time.Second, "HTTP server write timeout (deprecated)")
 	flag.DurationVar(&options.ServerWriteTimeout, "serverWriteTimeout", time.Duration(60)*time.Second, "HTTP server write timeout")
+	flag.DurationVar(&options.ServerIdleTimeout, "serverIdleTimeout", time.Duration(90)*time.Second, "HTTP server keep-alive idle timeout, the read timeout is used if 0")
+	flag.Var(&options.TrustedProxies, "trustedProxies", "Comma separated CIDRs of the proxies in front of vulcand, the client IP is taken from X-Forwarded-For set by these proxies")
+	flag.StringVar(&options.RouteHeader, "routeHeader", "", "Header passing the ids of the matched frontend and its backend to the backends, e.g. X-Vulcand-Route, frontends can override it (disabled if empty)")
+	flag.BoolVar(&options.RouteHeaderOverride, "routeHeaderOverride", false, "Replace the route header sent by the client, the client's one is passed by default")
+	flag.BoolVar(&options.FullTLSReload, "fullTLSReload", false, "Reload the TLS listeners on the certificate and staple updates, the TLS config is swapped in place keeping the connections by default")
+	flag.IntVar(&options.Workers, "workers", 1, "Number of the proxies serving the listeners, the proxies bind the same addresses with SO_REUSEPORT (linux only) to spread the connections over the CPUs")
+	flag.DurationVar(&options.ServerDrainTimeout, "serverDrainTimeout", 0, "Time in-flight requests have to finish when the listener is removed, waits indefinitely if 0")
+	flag.DurationVar(&options.ShutdownTimeout, "shutdownTimeout", 0, "Time in-flight requests have to finish on graceful shutdown and reload, waits indefinitely if 0")
+	flag.DurationVar(&options.TerminationDrainTimeout, "terminationDrainTimeout", 0, "Time the connections have to drain after SIGTERM before the rest are force closed, shutdownTimeout applies if 0")
+	flag.DurationVar(&options.ChildStartTimeout, "childStartTimeout", 30*time.Second, "Time the child forked on SIGUSR2 has to signal the startup before it is killed")
+	flag.DurationVar(&options.ChildGracePeriod, "childGracePeriod", 10*time.Second, "Time the child has to keep running after the startup before the parent hands off and shuts down")
+	flag.IntVar(&options.StartupRetries, "startupRetries", 0, "Times the engine is tried again if it is not available at startup, the default listener is served in the meantime, fails right away if 0")
+	flag.DurationVar(&options.StartupRetryPeriod, "startupRetryPeriod", 5*time.Second, "Pause between the startup attempts to reach the engine")
 	flag.DurationVar(&options.EndpointDialTimeout, "endpointDialTimeout", time.Duration(5)*time.Second, "Endpoint dial timeout")
 	flag.DurationVar(&options.EndpointReadTimeout, "endpointReadTimeout", time.Duration(50)*time.Second, "Endpoint read timeout")
 
 	flag.StringVar(&options.SealKey, "sealKey", "", "Seal key used to store encrypted data in the backend")
+	flag.DurationVar(&options.ACMERenewBefore, "acmeRenewBefore", acme.DefaultRenewBefore, "How long before the expiry ACME certificates are renewed")
+	flag.StringVar(&options.OCSPCacheDir, "ocspCacheDir", "", "Directory to persist OCSP staples in, so they survive restarts (disabled if empty)")
+	flag.DurationVar(&options.OCSPRetryPeriod, "ocspRetryPeriod", stapler.ErrRetryPeriod, "Delay before the first retry of the failed OCSP staple refresh, doubled with every consecutive failure")
+	flag.DurationVar(&options.OCSPMaxRetryBackoff, "ocspMaxRetryBackoff", stapler.DefaultMaxRetryBackoff, "Longest delay between the retries of the failed OCSP staple refreshes")
+	flag.StringVar(&options.DefaultCertFile, "defaultCertFile", "", "Path to the certificate served to the TLS clients asking for no host or an unknown one, unless a host is the default one")
+	flag.StringVar(&options.DefaultKeyFile, "defaultKeyFile", "", "Path to the key of the default certificate")
+	flag.DurationVar(&options.CertWarnBefore, "certWarnBefore", certmon.DefaultWarnBefore, "How long before the expiry of host certificates and OCSP staples the warnings are logged")
+	flag.DurationVar(&options.CertWatchInterval, "certWatchInterval", DefaultCertWatchInterval, "How often the files of the default and the API certificates are polled for changes, the rotated certificate is reloaded in place one to two intervals after its files are written (disabled if 0)")
 
 	flag.StringVar(&options.StatsdPrefix, "statsdPrefix", "", "Statsd prefix will be appended to the metrics emitted by this instance")
 	flag.StringVar(&options.StatsdAddr, "statsdAddr", "", "Statsd address in form of 'host:port'")
+	flag.IntVar(&options.MaxMetricLabels, "maxMetricLabels", 0, "Maximum distinct frontend and backend ids in the statsd metric names, the rest are emitted as 'other', no limit if 0")
+	flag.DurationVar(&options.MetricsInterval, "metricsInterval", proxy.DefaultMetricsInterval, "How often the proxy metrics are emitted to statsd, longer intervals lower the resolution of the metrics and the statsd load")
+	flag.DurationVar(&options.SystemMetricsInterval, "systemMetricsInterval", DefaultSystemMetricsInterval, "How often the runtime metrics are emitted to statsd, the GC pauses are sampled less accurately over 1s")
+	flag.Var(&options.PrometheusBuckets, "prometheusBuckets", "Comma separated latency histogram buckets in seconds, e.g. '0.01,0.1,1'")
+	flag.Var(&options.ErrorPages, "errorPage", "Error page in 'status=path' format served instead of the proxy error response, e.g. '502=/etc/vulcand/502.html', can be given several times. Content type is guessed from the file extension")
+	flag.StringVar(&options.TracingEndpoint, "tracingEndpoint", "", "OTLP/HTTP traces endpoint of the OpenTelemetry collector, e.g. 'http://localhost:4318/v1/traces' (disabled if empty)")
+	flag.Float64Var(&options.TracingSampleRate, "tracingSampleRate", 1, "Share of the traces started by vulcand that are exported, requests with the trace context keep the caller's decision")
+	flag.DurationVar(&options.LatencyWindow, "latencyWindow", proxy.DefaultLatencyWindow, "Rotation period of the frontend and backend latency percentiles")
 
 	flag.BoolVar(&options.DefaultListener, "default-listener", true, "Enables the default listener on startup (Default value: true)")
 
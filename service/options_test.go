@@ -0,0 +1,25 @@
+package service
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *ServiceSuite) TestValidateMetricsIntervals(c *check.C) {
+	o := Options{
+		Engine:                engineEtcd,
+		Workers:               1,
+		ServerWriteTimeout:    time.Minute,
+		MetricsInterval:       time.Second,
+		SystemMetricsInterval: DefaultSystemMetricsInterval,
+	}
+	_, err := validateOptions(o)
+	c.Assert(err, check.IsNil)
+
+	for _, intervals := range [][2]time.Duration{{0, time.Second}, {-time.Second, time.Second}, {time.Second, 0}, {time.Second, -time.Second}} {
+		o.MetricsInterval, o.SystemMetricsInterval = intervals[0], intervals[1]
+		_, err := validateOptions(o)
+		c.Assert(err, check.NotNil, check.Commentf("%v", intervals))
+	}
+}
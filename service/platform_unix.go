@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import (
+	"log/syslog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
+)
+
+// forkSupported tells if the child process can be started with the listening sockets of this process
+const forkSupported = true
+
+// controlSignals are the signals handled by the service and their control codes
+var controlSignals = map[os.Signal]ControlCode{
+	syscall.SIGTERM: ControlCodeGracefulShutdown,
+	syscall.SIGINT:  ControlCodeGracefulShutdown,
+	syscall.SIGKILL: ControlCodeImmediateShutdown,
+	syscall.SIGUSR2: ControlCodeForkChild,
+	syscall.SIGHUP:  ControlCodeReload,
+}
+
+// notifyChildExit relays the exit signals of the child processes to the channel
+func notifyChildExit(sigC chan os.Signal) {
+	signal.Notify(sigC, syscall.SIGCHLD)
+}
+
+// collectChildStatus collects the exit status of the exited child, so it does not stay a zombie
+func collectChildStatus() {
+	var wait syscall.WaitStatus
+	syscall.Wait4(-1, &wait, syscall.WNOHANG, nil)
+}
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
+
+func newSyslogHook() (log.Hook, error) {
+	return logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "")
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/proxy"
+)
+
+// forkSupported is false as the processes do not inherit the listening sockets on Windows, restarts are
+// not graceful
+const forkSupported = false
+
+// controlSignals are the console events delivered as signals, they shut the service down gracefully
+var controlSignals = map[os.Signal]ControlCode{
+	os.Interrupt:    ControlCodeGracefulShutdown,
+	syscall.SIGTERM: ControlCodeGracefulShutdown,
+}
+
+var errForkNotSupported = fmt.Errorf("passing files to the child is not supported on Windows")
+
+// notifyChildExit does nothing, the child processes are never started
+func notifyChildExit(sigC chan os.Signal) {
+}
+
+func collectChildStatus() {
+}
+
+func closeOnExec(fd int) {
+}
+
+func newSyslogHook() (log.Hook, error) {
+	return nil, fmt.Errorf("syslog is not supported on Windows")
+}
+
+func filesSocketPair() (*net.UnixConn, *os.File, error) {
+	return nil, nil, errForkNotSupported
+}
+
+func sendFiles(conn *net.UnixConn, files []*proxy.FileDescriptor, timeout time.Duration) error {
+	return errForkNotSupported
+}
+
+func filesFromSocket(fdString string, timeout time.Duration) ([]*proxy.FileDescriptor, error) {
+	return nil, errForkNotSupported
+}
+
+func childEnv() []string {
+	return os.Environ()
+}
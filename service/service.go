@@ -1,35 +1,46 @@
 package service
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log/syslog"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	logrus_syslog "github.com/Sirupsen/logrus/hooks/syslog"
 	logrus_logstash "github.com/bshuster-repo/logrus-logstash-hook"
 	etcd "github.com/coreos/etcd/client"
 	"github.com/gorilla/mux"
 	"github.com/mailgun/manners"
 	"github.com/mailgun/metrics"
+	"github.com/vulcand/vulcand/acme"
 	"github.com/vulcand/vulcand/api"
+	"github.com/vulcand/vulcand/certmon"
 	"github.com/vulcand/vulcand/engine"
+	"github.com/vulcand/vulcand/engine/consulng"
 	"github.com/vulcand/vulcand/engine/etcdv2ng"
 	"github.com/vulcand/vulcand/engine/etcdv3ng"
+	"github.com/vulcand/vulcand/engine/nsng"
 	"github.com/vulcand/vulcand/plugin"
 	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/reporter"
 	"github.com/vulcand/vulcand/secret"
 	"github.com/vulcand/vulcand/stapler"
 	"github.com/vulcand/vulcand/supervisor"
+	"github.com/vulcand/vulcand/tracing"
 )
 
 type ControlCode int
@@ -38,11 +49,17 @@ const (
 	ControlCodeGracefulShutdown ControlCode = iota
 	ControlCodeImmediateShutdown
 	ControlCodeForkChild
+	ControlCodeReload
 )
 
+// waitForSignals turns the signals of the platform, see controlSignals, into the control codes
 func waitForSignals() chan ControlCode {
 	sigC := make(chan os.Signal, 1024)
-	signal.Notify(sigC, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGUSR2)
+	signals := make([]os.Signal, 0, len(controlSignals))
+	for sig := range controlSignals {
+		signals = append(signals, sig)
+	}
+	signal.Notify(sigC, signals...)
 	controlC := make(chan ControlCode, 1024)
 
 	go func() {
@@ -50,14 +67,9 @@ func waitForSignals() chan ControlCode {
 			signal := <-sigC
 			log.Infof("Got signal '%s'", signal)
 
-			switch signal {
-			case syscall.SIGTERM, syscall.SIGINT:
-				controlC <- ControlCodeGracefulShutdown
-			case syscall.SIGKILL:
-				controlC <- ControlCodeImmediateShutdown
-			case syscall.SIGUSR2:
-				controlC <- ControlCodeForkChild
-			default:
+			if code, ok := controlSignals[signal]; ok {
+				controlC <- code
+			} else {
 				log.Infof("Ignoring signal '%s'", signal)
 			}
 		}
@@ -92,9 +104,38 @@ type Service struct {
 	errorC        chan error
 	supervisor    *supervisor.Supervisor
 	metricsClient metrics.Client
+	prometheus    *reporter.Prometheus
+	accessLog     io.Writer
+	auditLog      *api.AuditLog
+	// auditStopC stops recording the changes applied to the proxy in the audit log
+	auditStopC chan struct{}
+	acmeSolver    *acme.HTTP01Solver
+	acme          *acme.Manager
+	certmon       *certmon.Monitor
+	tracer        *tracing.Tracer
+	errorPages    map[int]engine.ErrorPage
+	defaultCert   *engine.KeyPair
 	apiServer     *manners.GracefulServer
+	apiTLSConfig  *tls.Config
+	apiCert       *certificateHolder
+	// certWatchers reload the default and the API certificates when their files change
+	certWatchers []*certWatcher
+	apiAuth       *api.TokenAuth
 	ng            engine.Engine
 	stapler       stapler.Stapler
+	// handoffC receives the outcome of the hot restart, childPid is the child being started, 0 if none
+	handoffC chan handoff
+	childPid int
+	// readyFile is kept open by the child until it exits, so the parent notices the exit in the grace period
+	readyFile *os.File
+	// startup records the durations of the startup phases
+	startup *startupPhases
+}
+
+// handoff is the outcome of the hot restart, err is set if the parent should keep serving
+type handoff struct {
+	pid int
+	err error
 }
 
 func NewService(options Options, registry *plugin.Registry) *Service {
@@ -102,10 +143,12 @@ func NewService(options Options, registry *plugin.Registry) *Service {
 		registry: registry,
 		options:  options,
 		errorC:   make(chan error),
+		handoffC: make(chan handoff, 1),
 	}
 }
 
 func (s *Service) Start(controlC chan ControlCode) error {
+	s.startup = newStartupPhases()
 	// if .LogFormatter is set, it'll be used in log.SetFormatter() and .Log will be ignored.
 	if s.options.LogFormatter != nil {
 		log.SetFormatter(s.options.LogFormatter)
@@ -121,7 +164,7 @@ func (s *Service) Start(controlC chan ControlCode) error {
 			}
 		case "syslog":
 			{
-				hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "")
+				hook, err := newSyslogHook()
 				if err == nil {
 					log.SetFormatter(&log.TextFormatter{DisableColors: true})
 					log.AddHook(hook)
@@ -141,6 +184,7 @@ func (s *Service) Start(controlC chan ControlCode) error {
 	log.SetLevel(s.options.LogSeverity.S)
 
 	log.Infof("Service starts with options: %#v", s.options)
+	s.startup.begin("config")
 
 	if s.options.PidPath != "" {
 		ioutil.WriteFile(s.options.PidPath, []byte(fmt.Sprint(os.Getpid())), 0644)
@@ -156,68 +200,183 @@ func (s *Service) Start(controlC chan ControlCode) error {
 		}
 	}
 
+	switch s.options.AccessLog {
+	case "":
+	case "stdout":
+		s.accessLog = os.Stdout
+	default:
+		f, err := os.OpenFile(s.options.AccessLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		s.accessLog = f
+	}
+
+	switch s.options.AuditLog {
+	case "":
+	case "stdout":
+		s.auditLog = api.NewAuditLog(os.Stdout)
+	default:
+		f, err := os.OpenFile(s.options.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		s.auditLog = api.NewAuditLog(f)
+	}
+
+	if s.options.TracingEndpoint != "" {
+		tracer, err := tracing.New(tracing.Options{
+			Endpoint:   s.options.TracingEndpoint,
+			SampleRate: s.options.TracingSampleRate,
+		})
+		if err != nil {
+			return err
+		}
+		s.tracer = tracer
+		s.tracer.Start()
+	}
+
+	prom, err := reporter.NewPrometheus(s.options.PrometheusBuckets)
+	if err != nil {
+		return err
+	}
+	s.prometheus = prom
+
+	if s.apiTLSConfig, s.apiCert, err = newAPITLSConfig(s.options); err != nil {
+		return err
+	}
+	if s.apiAuth, err = newAPIAuth(s.options); err != nil {
+		return err
+	}
+	if s.errorPages, err = readErrorPages(s.options.ErrorPages); err != nil {
+		return err
+	}
+	if s.defaultCert, err = readDefaultCert(s.options); err != nil {
+		return err
+	}
+
 	apiFile, muxFiles, err := s.getFiles()
 	if err != nil {
 		return err
 	}
 
+	s.startup.begin("engine")
 	if err := s.newEngine(); err != nil {
 		return err
 	}
 
-	s.stapler = stapler.New()
-	s.supervisor = supervisor.New(s.newProxy, s.ng, supervisor.Options{Files: muxFiles})
+	s.startup.begin("stapler")
+	staplerOpts := []stapler.StaplerOption{stapler.RetryBackoff(s.options.OCSPRetryPeriod, s.options.OCSPMaxRetryBackoff)}
+	if s.options.OCSPCacheDir != "" {
+		staplerOpts = append(staplerOpts, stapler.CacheDir(s.options.OCSPCacheDir))
+	}
+	s.stapler = stapler.New(staplerOpts...)
+	// the challenges are shared by the instances if the engine keeps the ACME state, so any of them answers
+	s.acmeSolver = acme.NewHTTP01Solver()
+	if st, ok := s.ng.(engine.ACMEStore); ok {
+		s.acmeSolver = acme.NewSharedHTTP01Solver(st)
+	}
+	s.supervisor = supervisor.New(s.newProxy, s.ng, supervisor.Options{
+		Files:              muxFiles,
+		Reporter:           s.reporter(),
+		StartupRetries:     s.options.StartupRetries,
+		StartupRetryPeriod: s.options.StartupRetryPeriod,
+		OnStartupFailure:   func(err error) { s.errorC <- err },
+	})
+	s.certmon = certmon.New(s.ng, certmon.Options{
+		WarnBefore: s.options.CertWarnBefore,
+		Stapler:    s.stapler,
+		Reporter:   s.reporter(),
+	})
+
+	// the changes are recorded from the start, so the ones made to the engine directly are audited too
+	if s.auditLog != nil {
+		s.auditStopC = make(chan struct{})
+		go s.auditLog.RecordChanges(s.supervisor.SubscribeChanges(), s.auditStopC)
+	}
+
+	// API is served before the proxy is configured, so the readiness probe tells the phase the startup is blocked on
+	if err := s.startApi(apiFile); err != nil {
+		return err
+	}
 
 	// Tells configurator to perform initial proxy configuration and start watching changes
+	s.startup.begin("supervisor")
 	if err := s.supervisor.Start(); err != nil {
+		s.apiServer.Close()
 		return err
 	}
 
-	go func() {
-		s.errorC <- s.startApi(apiFile)
-	}()
+	s.startup.begin("certmon")
+	s.certmon.Start()
+	s.startCertWatchers()
+
+	s.startup.begin("acme")
+	s.acme = acme.NewManager(s.ng, acme.Options{Solver: s.acmeSolver, RenewBefore: s.options.ACMERenewBefore})
+	s.acme.Start()
+	s.startup.finish(s.reporter())
 
 	if s.metricsClient != nil {
 		go s.reportSystemMetrics()
 	}
 
+	if err := s.signalReady(); err != nil {
+		log.Errorf("Failed to signal the startup to the parent: %v", err)
+	}
+
 	sigC := make(chan os.Signal, 1024)
-	signal.Notify(sigC, syscall.SIGCHLD)
+	notifyChildExit(sigC)
 
 	// Block until a signal is received or we got an error
 	for {
 		select {
 		case signal := <-sigC:
-			switch signal {
-			case syscall.SIGCHLD:
-				log.Warningf("Child exited, got '%s', collecting status", signal)
-				var wait syscall.WaitStatus
-				syscall.Wait4(-1, &wait, syscall.WNOHANG, nil)
-				log.Warningf("Collected exit status from child")
-			default:
-				log.Infof("Ignoring signal '%s'", signal)
-			}
+			log.Warningf("Child exited, got '%s', collecting status", signal)
+			collectChildStatus()
+			log.Warningf("Collected exit status from child")
 
 		case controlCode := <-controlC:
 			switch controlCode {
 			case ControlCodeGracefulShutdown:
 				log.Info("Got graceful shutdown control code")
-				s.supervisor.Stop()
-				log.Infof("All servers stopped")
+				s.stopGracefully()
 				return nil
 			case ControlCodeImmediateShutdown:
 				log.Info("Got immediate shutdown control code")
+				s.acme.Stop()
+				s.certmon.Stop()
+				s.stopCertWatchers()
 				s.supervisor.Stop()
+				s.stopTracer()
 				return nil
 			case ControlCodeForkChild:
 				log.Infof("Got fork child control code")
-				if err := s.startChild(); err != nil {
+				if s.childPid != 0 {
+					log.Warningf("Child pid=%d is still starting, ignoring fork child control code", s.childPid)
+				} else if err := s.startChild(); err != nil {
 					log.Infof("Failed to start self: %s", err)
 				} else {
 					log.Infof("Successfully started self")
 				}
+			case ControlCodeReload:
+				log.Infof("Got reload control code")
+				if err := s.supervisor.Reload(); err != nil {
+					log.Errorf("Failed to reload: %v", err)
+				} else {
+					log.Infof("Successfully reloaded")
+				}
 			}
 
+		case h := <-s.handoffC:
+			s.childPid = 0
+			if h.err != nil {
+				log.Errorf("Hot restart rolled back, child pid=%d failed: %v, continuing to serve", h.pid, h.err)
+				continue
+			}
+			log.Infof("Hot restart succeeded, handed off to child pid=%d, shutting down gracefully", h.pid)
+			s.stopGracefully()
+			return nil
+
 		case err := <-s.errorC:
 			log.Infof("Got request to shutdown with error: %s", err)
 			return err
@@ -225,16 +384,46 @@ func (s *Service) Start(controlC chan ControlCode) error {
 	}
 }
 
-func (s *Service) getFiles() (*proxy.FileDescriptor, []*proxy.FileDescriptor, error) {
-	// These files may be passed in by the parent process
-	filesString := os.Getenv(vulcandFilesKey)
-	if filesString == "" {
-		return nil, nil, nil
+// signalReady tells the parent that started this process on hot restart that it serves, the parent stops
+// once this process keeps running for the grace period
+func (s *Service) signalReady() error {
+	fdString := os.Getenv(vulcandReadyKey)
+	if fdString == "" {
+		return nil
 	}
-
-	files, err := filesFromString(filesString)
+	os.Unsetenv(vulcandReadyKey)
+	fd, err := strconv.Atoi(fdString)
 	if err != nil {
-		return nil, nil, fmt.Errorf("child failed to start: failed to read files from string, error %s", err)
+		return fmt.Errorf("bad ready file descriptor '%v': %v", fdString, err)
+	}
+	// the file is never closed, so the parent sees it closed when this process exits, and is not passed
+	// to the children of this process
+	closeOnExec(fd)
+	s.readyFile = os.NewFile(uintptr(fd), "ready")
+	if _, err := s.readyFile.Write([]byte{1}); err != nil {
+		return err
+	}
+	log.Infof("Signaled the startup to the parent pid=%d", os.Getppid())
+	return nil
+}
+
+func (s *Service) getFiles() (*proxy.FileDescriptor, []*proxy.FileDescriptor, error) {
+	// These files may be passed in by the parent process over the unix socket, or in the environment
+	// by the parent that does not support the socket
+	var files []*proxy.FileDescriptor
+	if fdString := os.Getenv(vulcandFilesSocketKey); fdString != "" {
+		os.Unsetenv(vulcandFilesSocketKey)
+		var err error
+		if files, err = filesFromSocket(fdString, s.options.ChildStartTimeout); err != nil {
+			return nil, nil, fmt.Errorf("child failed to start: failed to read files from socket, error %s", err)
+		}
+	} else if filesString := os.Getenv(vulcandFilesKey); filesString != "" {
+		var err error
+		if files, err = filesFromString(filesString); err != nil {
+			return nil, nil, fmt.Errorf("child failed to start: failed to read files from string, error %s", err)
+		}
+	} else {
+		return nil, nil, nil
 	}
 
 	if len(files) != 0 {
@@ -255,6 +444,9 @@ func (s *Service) splitFiles(files []*proxy.FileDescriptor) (*proxy.FileDescript
 }
 
 func (s *Service) startChild() error {
+	if !forkSupported {
+		return fmt.Errorf("forking the child is not supported on %s", runtime.GOOS)
+	}
 	log.Infof("Starting child")
 	path, err := execPath()
 	if err != nil {
@@ -281,34 +473,111 @@ func (s *Service) startChild() error {
 
 	// These files will be passed to the child process
 	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
-	for _, f := range extraFiles {
-		files = append(files, f.File)
+	env := childEnv()
+
+	// The socket files are passed over the unix socket, so their addresses do not show up in the environment
+	// of the child, the environment is the fallback if the socket can not be created
+	conn, socket, err := filesSocketPair()
+	if err != nil {
+		log.Warningf("Failed to create the files socket, passing files in the environment: %v", err)
+		for _, f := range extraFiles {
+			files = append(files, f.File)
+		}
+
+		// Serialize files to JSON string representation
+		vals, err := filesToString(extraFiles)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Passing %s to child", vals)
+		env = append(env, fmt.Sprintf("%s=%s", vulcandFilesKey, vals))
+	} else {
+		env = append(env, fmt.Sprintf("%s=%d", vulcandFilesSocketKey, len(files)))
+		files = append(files, socket)
 	}
 
-	// Serialize files to JSON string representation
-	vals, err := filesToString(extraFiles)
+	// The child writes to the pipe once it serves and keeps the write end open until it exits
+	readyR, readyW, err := os.Pipe()
 	if err != nil {
+		if conn != nil {
+			conn.Close()
+			socket.Close()
+		}
 		return err
 	}
-
-	log.Infof("Passing %s to child", vals)
-	os.Setenv(vulcandFilesKey, vals)
+	env = append(env, fmt.Sprintf("%s=%d", vulcandReadyKey, len(files)))
+	files = append(files, readyW)
 
 	p, err := os.StartProcess(path, os.Args, &os.ProcAttr{
 		Dir:   wd,
-		Env:   os.Environ(),
+		Env:   env,
 		Files: files,
 		Sys:   &syscall.SysProcAttr{},
 	})
+	readyW.Close()
+	if conn != nil {
+		socket.Close()
+		defer conn.Close()
+	}
 
 	if err != nil {
+		readyR.Close()
 		return err
 	}
 
 	log.Infof("Started new child pid=%d binary=%s", p.Pid, path)
+	if conn != nil {
+		log.Infof("Passing %s to child over the socket", extraFiles)
+		if err := sendFiles(conn, extraFiles, s.options.ChildStartTimeout); err != nil {
+			p.Kill()
+			readyR.Close()
+			return fmt.Errorf("failed to pass files to child pid=%d: %v", p.Pid, err)
+		}
+	}
+	s.childPid = p.Pid
+	go func() {
+		s.handoffC <- handoff{pid: p.Pid, err: waitForChild(p, readyR, s.options.ChildStartTimeout, s.options.ChildGracePeriod)}
+	}()
 	return nil
 }
 
+// waitForChild returns nil if the child signals the startup in time and keeps running for the grace period,
+// the child that does not signal the startup in time is killed
+func waitForChild(p *os.Process, ready *os.File, timeout, grace time.Duration) error {
+	defer ready.Close()
+	readyC := make(chan error, 2)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := ready.Read(buf); err != nil {
+			readyC <- fmt.Errorf("exited before signaling the startup")
+			return
+		}
+		readyC <- nil
+		// blocks until the child exits or the pipe is closed once the grace period is over
+		ready.Read(buf)
+		readyC <- fmt.Errorf("exited within the grace period of %v", grace)
+	}()
+
+	select {
+	case err := <-readyC:
+		if err != nil {
+			return err
+		}
+	case <-time.After(timeout):
+		p.Kill()
+		return fmt.Errorf("did not signal the startup in %v, killed", timeout)
+	}
+	log.Infof("Child pid=%d signaled the startup, waiting %v before handing off", p.Pid, grace)
+
+	select {
+	case err := <-readyC:
+		return err
+	case <-time.After(grace):
+		return nil
+	}
+}
+
 func (s *Service) GetAPIFile() (*proxy.FileDescriptor, error) {
 	file, err := s.apiServer.GetFile()
 	if err != nil {
@@ -337,27 +606,70 @@ func (s *Service) newEngine() error {
 	if err != nil {
 		return err
 	}
-	var ng engine.Engine
+	root := s.options.EtcdKey
+	if s.options.Engine == engineConsul {
+		root = s.options.ConsulKey
+	}
+	if len(s.options.EtcdNamespaces) == 0 {
+		s.ng, err = s.newBackendEngine(root, box)
+		return err
+	}
 
-	if s.options.EtcdApiVersion == 3 {
-		ng, err = etcdv3ng.New(
-			s.options.EtcdNodes,
-			s.options.EtcdKey,
+	var namespaces []nsng.Namespace
+	keys := map[string]string{}
+	for _, ns := range s.options.EtcdNamespaces {
+		name, key := ns, root+"/"+ns
+		if i := strings.Index(ns, "="); i >= 0 {
+			name, key = ns[:i], strings.TrimPrefix(ns[i+1:], "/")
+		}
+		// the watch of the key would see the changes of the nested namespace
+		for other, otherName := range keys {
+			if strings.HasPrefix(key+"/", other+"/") || strings.HasPrefix(other+"/", key+"/") {
+				return fmt.Errorf("keys of namespaces %v and %v overlap", otherName, name)
+			}
+		}
+		keys[key] = name
+		ng, err := s.newBackendEngine(key, box)
+		if err != nil {
+			return fmt.Errorf("failed to create engine of namespace %v: %v", name, err)
+		}
+		namespaces = append(namespaces, nsng.Namespace{Name: name, Engine: ng})
+	}
+	s.ng, err = nsng.New(namespaces)
+	return err
+}
+
+// newBackendEngine returns the engine of the backend chosen by the options storing the configuration under the key
+func (s *Service) newBackendEngine(key string, box *secret.Box) (engine.Engine, error) {
+	if s.options.Engine == engineConsul {
+		token := s.options.ConsulToken
+		if token == "" {
+			token = os.Getenv(consulTokenEnv)
+		}
+		return consulng.New(
+			s.options.ConsulAddr,
+			key,
 			s.registry,
-			etcdv3ng.Options{
-				EtcdCaFile:              s.options.EtcdCaFile,
-				EtcdCertFile:            s.options.EtcdCertFile,
-				EtcdKeyFile:             s.options.EtcdKeyFile,
-				EtcdConsistency:         s.options.EtcdConsistency,
-				EtcdSyncIntervalSeconds: s.options.EtcdSyncIntervalSeconds,
-				Box: box,
+			consulng.Options{
+				Token:       token,
+				Datacenter:  s.options.ConsulDatacenter,
+				Consistency: s.options.ConsulConsistency,
+				CaFile:      s.options.ConsulCaFile,
+				CertFile:    s.options.ConsulCertFile,
+				KeyFile:     s.options.ConsulKeyFile,
+				Box:         box,
 			})
-	} else {
-		ng, err = etcdv2ng.New(
+	}
+	return s.newEtcdEngine(key, box)
+}
+
+func (s *Service) newEtcdEngine(key string, box *secret.Box) (engine.Engine, error) {
+	if s.options.EtcdApiVersion == 3 {
+		return etcdv3ng.New(
 			s.options.EtcdNodes,
-			s.options.EtcdKey,
+			key,
 			s.registry,
-			etcdv2ng.Options{
+			etcdv3ng.Options{
 				EtcdCaFile:              s.options.EtcdCaFile,
 				EtcdCertFile:            s.options.EtcdCertFile,
 				EtcdKeyFile:             s.options.EtcdKeyFile,
@@ -366,11 +678,18 @@ func (s *Service) newEngine() error {
 				Box: box,
 			})
 	}
-	if err != nil {
-		return err
-	}
-	s.ng = ng
-	return err
+	return etcdv2ng.New(
+		s.options.EtcdNodes,
+		key,
+		s.registry,
+		etcdv2ng.Options{
+			EtcdCaFile:              s.options.EtcdCaFile,
+			EtcdCertFile:            s.options.EtcdCertFile,
+			EtcdKeyFile:             s.options.EtcdKeyFile,
+			EtcdConsistency:         s.options.EtcdConsistency,
+			EtcdSyncIntervalSeconds: s.options.EtcdSyncIntervalSeconds,
+			Box: box,
+		})
 }
 
 func (s *Service) reportSystemMetrics() {
@@ -379,34 +698,127 @@ func (s *Service) reportSystemMetrics() {
 			log.Infof("Recovered in reportSystemMetrics", r)
 		}
 	}()
+	interval := s.options.SystemMetricsInterval
+	if interval <= 0 {
+		interval = DefaultSystemMetricsInterval
+	}
 	for {
 		s.metricsClient.ReportRuntimeMetrics("sys", 1.0)
 		// we have 256 time buckets for gc stats, GC is being executed every 4ms on average
-		// so we have 256 * 4 = 1024 around one second to report it. To play safe, let's report every 300ms
-		time.Sleep(300 * time.Millisecond)
+		// so we have 256 * 4 = 1024 around one second to report it. To play safe, the default is 300ms
+		time.Sleep(interval)
+	}
+}
+
+// stopGracefully stops the service letting the requests in flight finish until the drain deadline, on the graceful
+// shutdown and once the child has taken over on hot restart
+func (s *Service) stopGracefully() {
+	// the drain deadline counts from the signal, not from the moment the listeners are closed
+	deadline := s.drainDeadline()
+	s.acme.Stop()
+	s.certmon.Stop()
+	s.stopCertWatchers()
+	if deadline.IsZero() {
+		s.supervisor.Stop()
+	} else {
+		s.supervisor.StopBy(deadline)
+	}
+	if s.auditStopC != nil {
+		close(s.auditStopC)
+	}
+	s.stopTracer()
+	log.Infof("All servers stopped")
+}
+
+// drainDeadline returns the time the connections still open on graceful shutdown are force closed at, zero if
+// the connections are waited for indefinitely
+func (s *Service) drainDeadline() time.Time {
+	timeout := s.options.TerminationDrainTimeout
+	if timeout == 0 {
+		timeout = s.options.ShutdownTimeout
+	}
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// stopTracer exports the spans of the requests served before the shutdown
+func (s *Service) stopTracer() {
+	if s.tracer != nil {
+		s.tracer.Stop()
 	}
 }
 
+func (s *Service) reporter() reporter.Reporter {
+	if s.metricsClient != nil {
+		return reporter.Multi(reporter.NewStatsd(s.metricsClient), s.prometheus)
+	}
+	return s.prometheus
+}
+
+// newProxy returns the proxy, the workers running several proxies if there are more than one
 func (s *Service) newProxy(id int) (proxy.Proxy, error) {
-	return proxy.New(id, s.stapler, proxy.Options{
+	o := proxy.Options{
 		MetricsClient:      s.metricsClient,
+		Reporter:           s.reporter(),
 		DialTimeout:        s.options.EndpointDialTimeout,
 		ReadTimeout:        s.options.ServerReadTimeout,
 		WriteTimeout:       s.options.ServerWriteTimeout,
+		IdleTimeout:        s.options.ServerIdleTimeout,
+		DrainTimeout:       s.options.ServerDrainTimeout,
+		ShutdownTimeout:    s.options.ShutdownTimeout,
 		MaxHeaderBytes:     s.options.ServerMaxHeaderBytes,
+		MaxMemBodyBytes:    s.options.MaxMemBodyBytes,
+		MaxBodyBytes:       s.options.MaxBodyBytes,
+		TrustedProxies:     s.options.TrustedProxies,
 		DefaultListener:    constructDefaultListener(s.options),
 		NotFoundMiddleware: s.registry.GetNotFoundMiddleware(),
 		Router:             s.registry.GetRouter(),
 		IncomingConnectionTracker: s.registry.GetIncomingConnectionTracker(),
 		OutgoingConnectionTracker: s.registry.GetOutgoingConnectionTracker(),
-	})
+		AccessLog:                 s.accessLog,
+		ACMESolver:                s.acmeSolver,
+		LatencyWindow:             s.options.LatencyWindow,
+		MaxMetricLabels:           s.options.MaxMetricLabels,
+		MetricsInterval:           s.options.MetricsInterval,
+		Tracer:                    s.tracer,
+		ErrorPages:                s.errorPages,
+		DefaultKeyPair:            s.defaultCert,
+		RouteHeader:               s.routeHeader(),
+		FullTLSReload:             s.options.FullTLSReload,
+	}
+	if s.options.Workers > 1 {
+		return proxy.NewWorkers(id, s.options.Workers, s.stapler, o)
+	}
+	return proxy.New(id, s.stapler, o)
 }
 
+// routeHeader returns the route header of the proxy, nil if it is off
+func (s *Service) routeHeader() *engine.HTTPFrontendRouteHeader {
+	if s.options.RouteHeader == "" {
+		return nil
+	}
+	return &engine.HTTPFrontendRouteHeader{Header: s.options.RouteHeader, Override: s.options.RouteHeaderOverride}
+}
+
+// startApi listens on the API address, or takes the listener passed by the parent, and serves the API in the
+// background, the serving errors are sent to the error channel
 func (s *Service) startApi(file *proxy.FileDescriptor) error {
 	addr := fmt.Sprintf("%s:%d", s.options.ApiInterface, s.options.ApiPort)
 
+	box, err := s.newBox()
+	if err != nil {
+		return err
+	}
+
 	router := mux.NewRouter()
-	api.InitProxyController(s.ng, s.supervisor, router)
+	router.Handle("/metrics", s.prometheus.Handler()).Methods("GET")
+	api.InitProxyController(s.ng, s.supervisor, router, s.apiAuth, box, s.auditLog, s.startup)
+	api.InitCertController(router, s.certmon)
+	if s.options.EnablePprof {
+		api.InitDebugController(router, s.apiAuth)
+	}
 
 	server := &http.Server{
 		Addr:           addr,
@@ -424,9 +836,155 @@ func (s *Service) startApi(file *proxy.FileDescriptor) error {
 			return err
 		}
 	}
+	if listener == nil {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		// the keep-alives close the connections of the clients gone away without closing them
+		listener = &manners.TCPKeepAliveListener{TCPListener: l.(*net.TCPListener)}
+	}
+	if s.apiTLSConfig != nil {
+		// TLS listener is unwrapped by the graceful server when the file is passed to the child
+		listener = manners.NewTLSListener(listener, s.apiTLSConfig)
+	}
 
 	s.apiServer = manners.NewWithOptions(manners.Options{Server: server, Listener: listener})
-	return s.apiServer.ListenAndServe()
+	go func() {
+		s.errorC <- s.apiServer.ListenAndServe()
+	}()
+	return nil
+}
+
+// newAPITLSConfig returns the API server TLS config, nil if the API is served over plain HTTP. The certificate is
+// served by the holder returned, so it can be reloaded without restarting the API server.
+func newAPITLSConfig(o Options) (*tls.Config, *certificateHolder, error) {
+	if o.ApiCertFile == "" && o.ApiKeyFile == "" && o.ApiClientCAFile == "" {
+		return nil, nil, nil
+	}
+	if o.ApiCertFile == "" || o.ApiKeyFile == "" {
+		return nil, nil, fmt.Errorf("both apiCertFile and apiKeyFile have to be set to serve the API over TLS, got apiCertFile=%q, apiKeyFile=%q",
+			o.ApiCertFile, o.ApiKeyFile)
+	}
+	holder := &certificateHolder{certFile: o.ApiCertFile, keyFile: o.ApiKeyFile}
+	if err := holder.load(); err != nil {
+		return nil, nil, fmt.Errorf("failed to load API key pair: %v", err)
+	}
+	config := &tls.Config{
+		GetCertificate: holder.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if o.ApiClientCAFile != "" {
+		ca, err := ioutil.ReadFile(o.ApiClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read API client CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, nil, fmt.Errorf("API client CA file %v has no PEM encoded certificates", o.ApiClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, holder, nil
+}
+
+// startCertWatchers watches the files of the default and the API certificates if the watch interval is set
+func (s *Service) startCertWatchers() {
+	if s.options.CertWatchInterval <= 0 {
+		return
+	}
+	if s.defaultCert != nil {
+		s.certWatchers = append(s.certWatchers, newCertWatcher("default", s.options.CertWatchInterval, func() error {
+			kp, err := readDefaultCert(s.options)
+			if err != nil {
+				return err
+			}
+			return s.supervisor.UpdateDefaultKeyPair(*kp)
+		}, s.options.DefaultCertFile, s.options.DefaultKeyFile))
+	}
+	if s.apiCert != nil {
+		s.certWatchers = append(s.certWatchers, newCertWatcher("API", s.options.CertWatchInterval,
+			s.apiCert.load, s.options.ApiCertFile, s.options.ApiKeyFile))
+	}
+	for _, w := range s.certWatchers {
+		w.Start()
+	}
+}
+
+func (s *Service) stopCertWatchers() {
+	for _, w := range s.certWatchers {
+		w.Stop()
+	}
+}
+
+// newAPIAuth returns the API token auth, nil if neither the token file nor the environment token is set
+func newAPIAuth(o Options) (*api.TokenAuth, error) {
+	var tokens []string
+	if o.ApiTokenFile != "" {
+		fileTokens, err := api.ReadTokens(o.ApiTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API tokens: %v", err)
+		}
+		if len(fileTokens) == 0 {
+			return nil, fmt.Errorf("API token file %v has no tokens", o.ApiTokenFile)
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+	if t := os.Getenv(apiTokenEnv); t != "" {
+		tokens = append(tokens, t)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	return api.NewTokenAuth(tokens)
+}
+
+// readDefaultCert reads the certificate served to the TLS clients asking for no host or an unknown one
+func readDefaultCert(o Options) (*engine.KeyPair, error) {
+	if o.DefaultCertFile == "" && o.DefaultKeyFile == "" {
+		return nil, nil
+	}
+	if o.DefaultCertFile == "" || o.DefaultKeyFile == "" {
+		return nil, fmt.Errorf("both defaultCertFile and defaultKeyFile should be set")
+	}
+	cert, err := ioutil.ReadFile(o.DefaultCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default certificate: %v", err)
+	}
+	key, err := ioutil.ReadFile(o.DefaultKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default certificate key: %v", err)
+	}
+	return engine.NewKeyPair(cert, key)
+}
+
+// readErrorPages reads the error page files given in 'status=path' format
+func readErrorPages(specs []string) (map[int]engine.ErrorPage, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	pages := make(map[int]engine.ErrorPage, len(specs))
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("error page should be in 'status=path' format, got '%v'", spec)
+		}
+		code, err := strconv.Atoi(spec[:i])
+		if err != nil {
+			return nil, fmt.Errorf("bad error page status '%v': %v", spec[:i], err)
+		}
+		path := spec[i+1:]
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read error page: %v", err)
+		}
+		pages[code] = engine.ErrorPage{ContentType: mime.TypeByExtension(filepath.Ext(path)), Body: string(body)}
+	}
+	if err := engine.CheckErrorPages(pages); err != nil {
+		return nil, err
+	}
+	return pages, nil
 }
 
 func constructDefaultListener(options Options) *engine.Listener {
@@ -502,3 +1060,20 @@ func setFallbackLogFormatter(options Options) {
 }
 
 const vulcandFilesKey = "VULCAND_FILES_KEY"
+
+// vulcandFilesSocketKey is the environment variable with the descriptor of the unix socket the files are passed over
+const vulcandFilesSocketKey = "VULCAND_FILES_SOCKET"
+
+// vulcandReadyKey is the environment variable with the descriptor of the pipe the child signals the startup to
+const vulcandReadyKey = "VULCAND_READY_FD"
+
+const (
+	engineEtcd   = "etcd"
+	engineConsul = "consul"
+)
+
+// consulTokenEnv is the environment variable with the Consul ACL token, the same as used by the Consul tools
+const consulTokenEnv = "CONSUL_HTTP_TOKEN"
+
+// apiTokenEnv is the environment variable with the API bearer token, so it does not show up in the process arguments
+const apiTokenEnv = "VULCAND_API_TOKEN"
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+// the package is imported by name, as the service has Run of its own
+func TestService(t *testing.T) { check.TestingT(t) }
+
+type ServiceSuite struct{}
+
+var _ = check.Suite(&ServiceSuite{})
+
+// startChild starts the process standing for the child and returns the pipe the child signals the startup with
+func startChild(c *check.C) (*exec.Cmd, *os.File, *os.File) {
+	cmd := exec.Command("sleep", "10")
+	c.Assert(cmd.Start(), check.IsNil)
+	readyR, readyW, err := os.Pipe()
+	c.Assert(err, check.IsNil)
+	return cmd, readyR, readyW
+}
+
+func (s *ServiceSuite) TestWaitForChild(c *check.C) {
+	// the child signals the startup and keeps running for the grace period
+	cmd, readyR, readyW := startChild(c)
+	defer cmd.Process.Kill()
+	readyW.Write([]byte{1})
+	c.Assert(waitForChild(cmd.Process, readyR, time.Second, 50*time.Millisecond), check.IsNil)
+	readyW.Close()
+}
+
+func (s *ServiceSuite) TestWaitForChildExits(c *check.C) {
+	// the child exits before signaling the startup
+	cmd, readyR, readyW := startChild(c)
+	defer cmd.Process.Kill()
+	readyW.Close()
+	err := waitForChild(cmd.Process, readyR, time.Second, 50*time.Millisecond)
+	c.Assert(err, check.ErrorMatches, "exited before signaling the startup")
+
+	// the child exits right after signaling the startup, within the grace period
+	cmd, readyR, readyW = startChild(c)
+	defer cmd.Process.Kill()
+	readyW.Write([]byte{1})
+	readyW.Close()
+	err = waitForChild(cmd.Process, readyR, time.Second, time.Second)
+	c.Assert(err, check.ErrorMatches, "exited within the grace period .*")
+
+	// the child exits while the parent waits for the grace period
+	cmd, readyR, readyW = startChild(c)
+	defer cmd.Process.Kill()
+	readyW.Write([]byte{1})
+	time.AfterFunc(50*time.Millisecond, func() { readyW.Close() })
+	err = waitForChild(cmd.Process, readyR, time.Second, time.Second)
+	c.Assert(err, check.ErrorMatches, "exited within the grace period .*")
+}
+
+func (s *ServiceSuite) TestWaitForChildTimeout(c *check.C) {
+	// the child that does not signal the startup in time is killed
+	cmd, readyR, readyW := startChild(c)
+	defer readyW.Close()
+	err := waitForChild(cmd.Process, readyR, 50*time.Millisecond, time.Second)
+	c.Assert(err, check.ErrorMatches, "did not signal the startup in .*, killed")
+	c.Assert(cmd.Wait(), check.NotNil)
+
+	// the startup signaled as the timeout passes either hands off or kills the child, never both
+	for i := 0; i < 10; i++ {
+		cmd, readyR, readyW := startChild(c)
+		time.AfterFunc(20*time.Millisecond, func() { readyW.Write([]byte{1}) })
+		err := waitForChild(cmd.Process, readyR, 20*time.Millisecond, 10*time.Millisecond)
+		if err != nil {
+			c.Assert(err, check.ErrorMatches, "did not signal the startup in .*, killed")
+			c.Assert(cmd.Wait(), check.NotNil)
+		} else {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		readyW.Close()
+	}
+}
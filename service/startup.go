@@ -0,0 +1,78 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/api"
+	"github.com/vulcand/vulcand/reporter"
+)
+
+// startupPhases records the durations of the startup phases, so the slow startup, e.g. loading the large
+// configuration from etcd, shows where the time goes. The phases run one after another, the pending phase is
+// the one the startup is blocked on. It is read by the readiness probe while the service is starting.
+type startupPhases struct {
+	mtx     sync.Mutex
+	start   time.Time
+	phases  []api.StartupPhase
+	pending string
+	// started is the time the pending phase started at
+	started time.Time
+	done    time.Time
+}
+
+func newStartupPhases() *startupPhases {
+	return &startupPhases{start: time.Now()}
+}
+
+// begin completes the pending phase and starts the next one
+func (p *startupPhases) begin(phase string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	now := time.Now()
+	p.complete(now)
+	p.pending, p.started = phase, now
+}
+
+// finish completes the startup and reports the durations of the phases and of the whole startup
+func (p *startupPhases) finish(r reporter.Reporter) {
+	p.mtx.Lock()
+	now := time.Now()
+	p.complete(now)
+	p.done = now
+	phases, total := append([]api.StartupPhase(nil), p.phases...), now.Sub(p.start)
+	p.mtx.Unlock()
+
+	log.Infof("Startup took %v", total)
+	for _, ph := range phases {
+		r.ObserveStartupPhase(ph.Name, ph.Duration)
+	}
+	r.ObserveStartupPhase("total", total)
+}
+
+func (p *startupPhases) complete(now time.Time) {
+	if p.pending == "" {
+		return
+	}
+	d := now.Sub(p.started)
+	log.Infof("Startup phase %v took %v", p.pending, d)
+	p.phases = append(p.phases, api.StartupPhase{Name: p.pending, Duration: d})
+	p.pending = ""
+}
+
+func (p *startupPhases) StartupStatus() api.StartupStatus {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	st := api.StartupStatus{Pending: p.pending, Phases: append([]api.StartupPhase(nil), p.phases...)}
+	if p.done.IsZero() {
+		now := time.Now()
+		st.Elapsed = now.Sub(p.start)
+		if p.pending != "" {
+			st.Phases = append(st.Phases, api.StartupPhase{Name: p.pending, Duration: now.Sub(p.started)})
+		}
+	} else {
+		st.Elapsed = p.done.Sub(p.start)
+	}
+	return st
+}
@@ -0,0 +1,124 @@
+package stapler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vulcand/vulcand/engine"
+	"golang.org/x/crypto/ocsp"
+)
+
+// diskCache keeps the raw OCSP responses in files named after the host and the certificate,
+// so the response of the replaced certificate is never picked up
+type diskCache struct {
+	dir string
+}
+
+func (c *diskCache) path(host string, leaf []byte) string {
+	h := sha256.New()
+	h.Write([]byte(host))
+	h.Write([]byte{0})
+	h.Write(leaf)
+	return filepath.Join(c.dir, hex.EncodeToString(h.Sum(nil))+".ocsp")
+}
+
+func (c *diskCache) load(host string, leaf []byte) ([]byte, error) {
+	return ioutil.ReadFile(c.path(host, leaf))
+}
+
+// save writes the response to the temporary file first, so the cache never has partially written responses
+func (c *diskCache) save(host string, leaf, raw []byte) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, ".ocsp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(raw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), c.path(host, leaf))
+}
+
+func (c *diskCache) remove(host string, leaf []byte) error {
+	err := os.Remove(c.path(host, leaf))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// cachedStaple returns the persisted response of the host, responses that are stale, fail the signature check
+// or are not about the host certificate are not used
+func (s *stapler) cachedStaple(host *engine.Host, kp *engine.KeyPair) *StapleResponse {
+	if s.cache == nil {
+		return nil
+	}
+	leaf, issuer, err := parseKeyPair(kp)
+	if err != nil {
+		return nil
+	}
+	raw, err := s.cache.load(host.Name, leaf.Raw)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("%v failed to read persisted staple of %v: %v", s, host, err)
+		}
+		return nil
+	}
+	if host.Settings.OCSP.SkipSignatureCheck {
+		issuer = nil
+	}
+	re, err := ocsp.ParseResponse(raw, issuer)
+	if err != nil {
+		log.Warningf("%v discarding persisted staple of %v: %v", s, host, err)
+		return nil
+	}
+	if re.SerialNumber == nil || re.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+		log.Warningf("%v discarding persisted staple of %v: serial number does not match the certificate", s, host)
+		return nil
+	}
+	now := s.clock.UtcNow()
+	if re.Status != ocsp.Good || re.NextUpdate.IsZero() || !now.Before(re.NextUpdate) || now.Before(re.ThisUpdate) {
+		log.Infof("%v persisted staple of %v is not fresh: status=%v, this update=%v, next update=%v",
+			s, host, re.Status, re.ThisUpdate, re.NextUpdate)
+		return nil
+	}
+	return &StapleResponse{Response: re, Staple: raw}
+}
+
+func (s *stapler) saveStaple(host *engine.Host, kp *engine.KeyPair, re *StapleResponse) {
+	if s.cache == nil {
+		return
+	}
+	leaf, _, err := parseKeyPair(kp)
+	if err != nil {
+		return
+	}
+	if err := s.cache.save(host.Name, leaf.Raw, re.Staple); err != nil {
+		log.Warningf("%v failed to persist staple of %v: %v", s, host, err)
+	}
+}
+
+func (s *stapler) forgetStaple(host *engine.Host, kp *engine.KeyPair) {
+	if s.cache == nil {
+		return
+	}
+	leaf, _, err := parseKeyPair(kp)
+	if err != nil {
+		return
+	}
+	if err := s.cache.remove(host.Name, leaf.Raw); err != nil {
+		log.Warningf("%v failed to remove persisted staple of %v: %v", s, host, err)
+	}
+}
@@ -13,8 +13,10 @@ import (
 	"fmt"
 	"golang.org/x/crypto/ocsp"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -31,6 +33,12 @@ type Stapler interface {
 	HasHost(host engine.HostKey) bool
 	// StapleHost returns the relevant StapleResponse, or error in case if response is unavailable
 	StapleHost(host *engine.Host) (*StapleResponse, error)
+	// StapleKeyPair returns the StapleResponse of the i-th key pair returned by the host AllKeyPairs,
+	// each key pair is stapled independently
+	StapleKeyPair(host *engine.Host, i int) (*StapleResponse, error)
+	// CachedStaple returns the cached StapleResponse of the i-th key pair of the host, the staple is neither
+	// fetched nor refreshed, false is returned if there is no staple of the current key pair
+	CachedStaple(host *engine.Host, i int) (*StapleResponse, bool)
 	// DeleteHost deletes any OCSP data associated with the host entry
 	DeleteHost(host engine.HostKey)
 	// Subscribe subscribes the channel to the series of OCSP updates
@@ -49,9 +57,29 @@ func Clock(clock timetools.TimeProvider) StaplerOption {
 	}
 }
 
+// CacheDir is an optional argument to the New function, OCSP responses are persisted in the directory
+// so the staples are available right after the restart
+func CacheDir(dir string) StaplerOption {
+	return func(s *stapler) {
+		s.cache = &diskCache{dir: dir}
+	}
+}
+
+// RetryBackoff is an optional argument to the New function, the failed refreshes are retried after the base
+// period doubled with every consecutive failure up to the max period, ErrRetryPeriod and DefaultMaxRetryBackoff
+// are used by default
+func RetryBackoff(base, max time.Duration) StaplerOption {
+	return func(s *stapler) {
+		s.retryPeriod = base
+		s.maxBackoff = max
+	}
+}
+
 // New returns a new instance of in-memory Staple resolver and cache
 func New(opts ...StaplerOption) Stapler {
 	s := &stapler{
+		retryPeriod: ErrRetryPeriod,
+		maxBackoff:  DefaultMaxRetryBackoff,
 		v:           make(map[string]*hostStapler),
 		mtx:         &sync.Mutex{},
 		eventsC:     make(chan *stapleFetched),
@@ -76,6 +104,15 @@ func New(opts ...StaplerOption) Stapler {
 	if s.clock == nil {
 		s.clock = &timetools.RealTime{}
 	}
+	if s.retryPeriod <= 0 {
+		s.retryPeriod = ErrRetryPeriod
+	}
+	if s.maxBackoff <= 0 {
+		s.maxBackoff = DefaultMaxRetryBackoff
+	}
+	if s.maxBackoff < s.retryPeriod {
+		s.maxBackoff = s.retryPeriod
+	}
 	go s.fanOut()
 	return s
 }
@@ -96,6 +133,11 @@ type stapler struct {
 	client *http.Client
 	// subcscibrers holds a list of subscribers for OCSP updates
 	subscribers map[int32]chan *StapleUpdated
+	// cache persists the OCSP responses, nil if persistence is disabled
+	cache *diskCache
+	// retryPeriod and maxBackoff bound the delays between the retries of the failed refreshes
+	retryPeriod time.Duration
+	maxBackoff  time.Duration
 
 	// these channels are set up for test purposes
 	discardC      chan bool
@@ -104,26 +146,46 @@ type stapler struct {
 }
 
 func (s *stapler) StapleHost(host *engine.Host) (*StapleResponse, error) {
-	if host.Settings.KeyPair == nil {
-		return nil, fmt.Errorf("%v has no key pair to staple", host)
+	return s.StapleKeyPair(host, 0)
+}
+
+func (s *stapler) StapleKeyPair(host *engine.Host, i int) (*StapleResponse, error) {
+	keyPairs := host.Settings.AllKeyPairs()
+	if i < 0 || i >= len(keyPairs) {
+		return nil, fmt.Errorf("%v has no key pair %d to staple", host, i)
 	}
-	hs, found := s.getStapler(host)
+	hs, found := s.getStapler(host, i)
 	if found {
 		return hs.response, nil
 	}
-	hs, err := newHostStapler(s, host)
+	hs, err := newHostStapler(s, host, i, &keyPairs[i])
 	if err != nil {
 		return nil, err
 	}
-	s.setStapler(host, hs)
+	s.setStapler(hs)
 	return hs.response, nil
 }
 
+func (s *stapler) CachedStaple(host *engine.Host, i int) (*StapleResponse, bool) {
+	keyPairs := host.Settings.AllKeyPairs()
+	if i < 0 || i >= len(keyPairs) {
+		return nil, false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	hs, ok := s.v[stapleKey(host.Name, i)]
+	if !ok || !hs.keyPair.Equals(&keyPairs[i]) || hs.response == nil {
+		return nil, false
+	}
+	return hs.response, true
+}
+
 func (s *stapler) HasHost(hk engine.HostKey) bool {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	_, ok := s.v[hk.Name]
+	_, ok := s.v[stapleKey(hk.Name, 0)]
 	return ok
 }
 
@@ -131,13 +193,15 @@ func (s *stapler) DeleteHost(hk engine.HostKey) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	hs, ok := s.v[hk.Name]
-	if !ok {
-		return
+	for key, hs := range s.v {
+		if hs.host.Name != hk.Name {
+			continue
+		}
+		hs.stop()
+		delete(s.v, key)
+		s.forgetStaple(hs.host, hs.keyPair)
+		log.Infof("%s deleted %v", s, hs)
 	}
-	hs.stop()
-	delete(s.v, hk.Name)
-	log.Infof("%s deleted %v", s, hs)
 }
 
 func (s *stapler) Subscribe(in chan *StapleUpdated, closeC chan struct{}) {
@@ -205,11 +269,17 @@ func (s *stapler) nextId() int32 {
 type hostStapler struct {
 	id   int32
 	host *engine.Host
-
-	timer  *time.Timer
-	s      *stapler
-	stopC  chan struct{}
+	// index and keyPair identify the stapled key pair among the host key pairs
+	index   int
+	keyPair *engine.KeyPair
+
+	s     *stapler
+	stopC chan struct{}
+	// resetC passes the next update delay to the goroutine that runs the update timer
+	resetC chan time.Duration
 	period time.Duration
+	// failures counts the consecutive failed refreshes, the retries back off with every failure
+	failures int
 
 	response *StapleResponse
 }
@@ -227,8 +297,8 @@ func (s *StapleResponse) String() string {
 	return fmt.Sprintf("StapleResponse(status=%v)", s.Response.Status)
 }
 
-func (hs *hostStapler) sameTo(host *engine.Host) bool {
-	if !hs.host.Settings.KeyPair.Equals(host.Settings.KeyPair) {
+func (hs *hostStapler) sameTo(host *engine.Host, kp *engine.KeyPair) bool {
+	if !hs.keyPair.Equals(kp) {
 		log.Infof("%v key pair updated", hs)
 		return false
 	}
@@ -239,38 +309,57 @@ func (hs *hostStapler) sameTo(host *engine.Host) bool {
 	return true
 }
 
-func (s *stapler) getStapler(host *engine.Host) (*hostStapler, bool) {
+// stapleKey returns the key of the host stapler, the first key pair of the host is keyed by the host name
+func stapleKey(hostName string, i int) string {
+	if i == 0 {
+		return hostName
+	}
+	return hostName + "#" + strconv.Itoa(i)
+}
+
+func (s *stapler) getStapler(host *engine.Host, i int) (*hostStapler, bool) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	hs, ok := s.v[host.Name]
-	if ok && hs.sameTo(host) {
+	keyPairs := host.Settings.AllKeyPairs()
+	// staples of the key pairs removed from the host are not needed anymore
+	for key, hs := range s.v {
+		if hs.host.Name == host.Name && hs.index >= len(keyPairs) {
+			hs.stop()
+			delete(s.v, key)
+		}
+	}
+
+	key := stapleKey(host.Name, i)
+	hs, ok := s.v[key]
+	if ok && hs.sameTo(host, &keyPairs[i]) {
 		return hs, true
 	}
 	// delete the previous entry
 	if ok {
 		hs.stop()
-		delete(s.v, host.Name)
+		delete(s.v, key)
 	}
 	return nil, false
 }
 
-func (s *stapler) setStapler(host *engine.Host, re *hostStapler) {
+func (s *stapler) setStapler(re *hostStapler) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	other, ok := s.v[host.Name]
+	key := stapleKey(re.host.Name, re.index)
+	other, ok := s.v[key]
 	if ok {
 		other.stop()
 	}
-	s.v[host.Name] = re
+	s.v[key] = re
 }
 
 func (s *stapler) updateStaple(e *stapleFetched) bool {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	hs, ok := s.v[e.hostName]
+	hs, ok := s.v[e.key]
 	if !ok || hs.id != e.id {
 		log.Infof("%v: %v replaced or removed", s, hs)
 		// the stapler may have been replaced by concurrent call to StapleHost()
@@ -280,32 +369,80 @@ func (s *stapler) updateStaple(e *stapleFetched) bool {
 
 	if e.err != nil {
 		log.Errorf("%v failed to fetch staple response for %v, error: %v", s, hs, e.err)
-		if hs.response.Response.NextUpdate.Before(hs.s.clock.UtcNow()) {
-			log.Errorf("%v Now: %v, next: %v retry attempts exceeded, invalidating staple %v",
-				s, hs.s.clock.UtcNow(), hs.response.Response.NextUpdate, hs)
-			delete(s.v, e.hostName)
-			return true
-		}
-		hs.schedule(hs.s.clock.UtcNow().Add(ErrRetryPeriod))
-		return false
+		return s.retryStaple(e.key, hs)
+	}
+
+	// the good staple is served until it expires, the failing responder does not replace it
+	failed := e.re.Response.Status == ocsp.Unknown || e.re.Response.Status == ocsp.ServerFailed
+	if failed && hs.response.IsValid() {
+		log.Warningf("%v status: %v for %v, keeping the last good staple", s, e.re.Response.Status, hs)
+		return s.retryStaple(e.key, hs)
 	}
 
 	hs.response = e.re
+	s.saveStaple(hs.host, hs.keyPair, e.re)
 
 	switch e.re.Response.Status {
 	case ocsp.Good:
 		log.Infof("%v got good status for %v", s, hs)
-		hs.schedule(hs.userUpdate(e.re.Response.NextUpdate))
+		hs.failures = 0
+		hs.schedule(s.jitter(hs.userUpdate(e.re.Response.NextUpdate)))
 	case ocsp.Revoked:
 		// no need to reschedule if it's revoked
 		log.Warningf("%v revoked %v", s, hs)
 	case ocsp.Unknown, ocsp.ServerFailed:
 		log.Warningf("%v status: %v for %v", s, e.re.Response.Status, hs)
-		hs.schedule(hs.s.clock.UtcNow().Add(hs.period))
+		hs.failures++
+		hs.schedule(s.clock.UtcNow().Add(s.retryDelay(hs.failures)))
 	}
 	return true
 }
 
+// retryStaple schedules the retry of the failed refresh and keeps serving the current staple, the staple is
+// invalidated once it expires. Returns true if the staple has been invalidated.
+func (s *stapler) retryStaple(key string, hs *hostStapler) bool {
+	now := s.clock.UtcNow()
+	expires := hs.response.Response.NextUpdate
+	if !expires.After(now) {
+		log.Errorf("%v Now: %v, next: %v retry attempts exceeded, invalidating staple %v", s, now, expires, hs)
+		delete(s.v, key)
+		s.forgetStaple(hs.host, hs.keyPair)
+		return true
+	}
+	hs.failures++
+	next := now.Add(s.retryDelay(hs.failures))
+	// the last retry happens when the staple expires, so the expired staple is not served
+	if next.After(expires) {
+		next = expires
+	}
+	hs.schedule(next)
+	return false
+}
+
+// retryDelay returns the delay before the retry of the refresh failed the given number of times in a row,
+// the delay doubles with every failure up to the max backoff and is randomized by half, so the hosts sharing
+// the responder do not retry at once
+func (s *stapler) retryDelay(failures int) time.Duration {
+	d := s.retryPeriod
+	for i := 1; i < failures && d < s.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.maxBackoff {
+		d = s.maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// jitter moves the refresh scheduled at the given time earlier by up to the tenth of the time left, so the
+// staples fetched at once, e.g. on startup, are not refreshed at the same instant
+func (s *stapler) jitter(next time.Time) time.Time {
+	d := next.Sub(s.clock.UtcNow())
+	if d <= 0 {
+		return next
+	}
+	return next.Add(-time.Duration(rand.Int63n(int64(float64(d)*refreshJitter) + 1)))
+}
+
 func (s *stapler) String() string {
 	return fmt.Sprintf("Stapler()")
 }
@@ -358,6 +495,7 @@ type StapleUpdated struct {
 
 type stapleFetched struct {
 	id       int32
+	key      string
 	hostName string
 	re       *StapleResponse
 	err      error
@@ -371,28 +509,37 @@ func (s *StapleUpdated) String() string {
 	return fmt.Sprintf("StapleUpdated(host=%v, response=%v, err=%v)", s.HostKey, s.Staple, s.Err)
 }
 
-func newHostStapler(s *stapler, host *engine.Host) (*hostStapler, error) {
+func newHostStapler(s *stapler, host *engine.Host, i int, kp *engine.KeyPair) (*hostStapler, error) {
 	period, err := host.Settings.OCSP.RefreshPeriod()
 	if err != nil {
 		return nil, err
 	}
 	hs := &hostStapler{
-		id:     s.nextId(),
-		host:   host,
-		s:      s,
-		period: period,
-		stopC:  make(chan struct{}),
+		id:      s.nextId(),
+		host:    host,
+		index:   i,
+		keyPair: kp,
+		s:       s,
+		period:  period,
+		stopC:   make(chan struct{}),
+	}
+
+	if re := s.cachedStaple(host, kp); re != nil {
+		log.Infof("%v using persisted staple, next update: %v", hs, re.Response.NextUpdate)
+		hs.response = re
+		if err := hs.schedule(s.jitter(hs.userUpdate(re.Response.NextUpdate))); err != nil {
+			return nil, err
+		}
+		return hs, nil
 	}
 
-	re, err := s.getStaple(&host.Settings)
-	if err != nil {
-		return nil, err
-	}
+	re, err := s.getStaple(kp, &host.Settings.OCSP)
 	if err != nil {
 		return nil, err
 	}
 	hs.response = re
-	if err := hs.schedule(re.Response.NextUpdate); err != nil {
+	s.saveStaple(host, kp, re)
+	if err := hs.schedule(s.jitter(re.Response.NextUpdate)); err != nil {
 		return nil, err
 	}
 	return hs, nil
@@ -400,19 +547,18 @@ func newHostStapler(s *stapler, host *engine.Host) (*hostStapler, error) {
 
 func (hs *hostStapler) stop() {
 	log.Infof("Stopping %v", hs)
-	hs.timer.Stop()
 	close(hs.stopC)
 }
 
 func (hs *hostStapler) String() string {
-	return fmt.Sprintf("hostStapler(%v, %v)", hs.id, hs.host)
+	return fmt.Sprintf("hostStapler(%v, %v, keyPair=%d)", hs.id, hs.host, hs.index)
 }
 
 func (hs *hostStapler) update() {
-	re, err := hs.s.getStaple(&hs.host.Settings)
+	re, err := hs.s.getStaple(hs.keyPair, &hs.host.Settings.OCSP)
 	log.Infof("%v got %v %v", hs, re, err)
 	select {
-	case hs.s.eventsC <- &stapleFetched{id: hs.id, hostName: hs.host.Name, re: re, err: err}:
+	case hs.s.eventsC <- &stapleFetched{id: hs.id, key: stapleKey(hs.host.Name, hs.index), hostName: hs.host.Name, re: re, err: err}:
 	case <-hs.stopC:
 		log.Infof("%v stopped", hs)
 	}
@@ -434,39 +580,73 @@ func (hs *hostStapler) userUpdate(nextUpdate time.Time) time.Time {
 
 func (hs *hostStapler) schedule(nextUpdate time.Time) error {
 	log.Infof("%v schedule update for %v", hs, nextUpdate)
-	hs.timer = time.NewTimer(nextUpdate.Sub(hs.s.clock.UtcNow()))
-	go func() {
+	d := nextUpdate.Sub(hs.s.clock.UtcNow())
+	if hs.resetC == nil {
+		hs.resetC = make(chan time.Duration, 1)
+		go hs.run(d)
+		return nil
+	}
+	// the pending delay has not been picked up yet, it is replaced by the new one
+	select {
+	case <-hs.resetC:
+	default:
+	}
+	hs.resetC <- d
+	return nil
+}
+
+// run updates the staple every time the timer fires, the single timer is reset on every schedule
+func (hs *hostStapler) run(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
 		select {
-		case <-hs.timer.C:
+		case <-timer.C:
 			log.Infof("%v update by timer", hs)
 			hs.update()
 		case <-hs.s.kickC:
 			log.Infof("%v update by kick channel", hs)
 			hs.update()
+		case d := <-hs.resetC:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(d)
 		case <-hs.stopC:
 			log.Infof("%v stopped", hs)
+			return
 		}
-	}()
-	return nil
+	}
 }
 
-func (st *stapler) getStaple(s *engine.HostSettings) (*StapleResponse, error) {
-	kp := s.KeyPair
+// parseKeyPair returns the leaf certificate and its issuer
+func parseKeyPair(kp *engine.KeyPair) (*x509.Certificate, *x509.Certificate, error) {
 	cert, err := tls.X509KeyPair(kp.Cert, kp.Key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if len(cert.Certificate) < 2 {
-		return nil, fmt.Errorf("Need at least leaf and peer certificate")
+		return nil, nil, fmt.Errorf("Need at least leaf and peer certificate")
 	}
 
 	xc, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	xi, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return xc, xi, nil
+}
+
+func (st *stapler) getStaple(kp *engine.KeyPair, o *engine.OCSPSettings) (*StapleResponse, error) {
+	xc, xi, err := parseKeyPair(kp)
 	if err != nil {
 		return nil, err
 	}
@@ -476,8 +656,8 @@ func (st *stapler) getStaple(s *engine.HostSettings) (*StapleResponse, error) {
 		return nil, err
 	}
 	servers := xc.OCSPServer
-	if len(s.OCSP.Responders) != 0 {
-		servers = s.OCSP.Responders
+	if len(o.Responders) != 0 {
+		servers = o.Responders
 	}
 
 	if len(servers) == 0 {
@@ -489,7 +669,7 @@ func (st *stapler) getStaple(s *engine.HostSettings) (*StapleResponse, error) {
 	for _, srv := range servers {
 		log.Infof("OCSP about to query: %v for OCSP", srv)
 		issuer := xi
-		if s.OCSP.SkipSignatureCheck {
+		if o.SkipSignatureCheck {
 			log.Warningf("Bypassing signature check")
 			// this will bypass signature check
 			issuer = nil
@@ -532,4 +712,11 @@ func (s *stapler) getOCSPResponse(server string, request []byte, issuer *x509.Ce
 	return re, body, nil
 }
 
-const ErrRetryPeriod = 60 * time.Second
+const (
+	// ErrRetryPeriod is the default delay before the first retry of the failed refresh
+	ErrRetryPeriod = 60 * time.Second
+	// DefaultMaxRetryBackoff is the default longest delay between the retries of the failed refreshes
+	DefaultMaxRetryBackoff = 30 * time.Minute
+	// refreshJitter is the share of the time left until the refresh it may be moved earlier by
+	refreshJitter = 0.1
+)
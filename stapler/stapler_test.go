@@ -1,6 +1,18 @@
 package stapler
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -272,6 +284,70 @@ func (s *StaplerSuite) TestResponderUnavailable(c *C) {
 	}
 }
 
+// Failed refreshes keep the last good staple until it expires
+func (s *StaplerSuite) TestKeepStapleOnFailures(c *C) {
+	h, err := engine.NewHost("localhost",
+		engine.HostSettings{
+			KeyPair: &engine.KeyPair{Key: testutils.LocalhostKey, Cert: testutils.LocalhostCertChain},
+			OCSP:    engine.OCSPSettings{Enabled: true, Period: "1h", SkipSignatureCheck: true},
+		})
+	c.Assert(err, IsNil)
+
+	re := &StapleResponse{Response: s.re}
+	hs := &hostStapler{id: s.st.nextId(), host: h, keyPair: h.Settings.KeyPair, s: s.st, period: time.Hour,
+		stopC: make(chan struct{}), response: re}
+	c.Assert(hs.schedule(s.re.NextUpdate), IsNil)
+	s.st.setStapler(hs)
+
+	failed := &StapleResponse{Response: &ocsp.Response{Status: ocsp.ServerFailed}}
+	for i, e := range []*stapleFetched{
+		{id: hs.id, key: h.Name, hostName: h.Name, err: fmt.Errorf("responder is down")},
+		{id: hs.id, key: h.Name, hostName: h.Name, re: failed},
+	} {
+		c.Assert(s.st.updateStaple(e), Equals, false)
+		c.Assert(hs.response, Equals, re)
+		c.Assert(hs.failures, Equals, i+1)
+	}
+
+	// the successful refresh resets the backoff
+	c.Assert(s.st.updateStaple(&stapleFetched{id: hs.id, key: h.Name, hostName: h.Name, re: re}), Equals, true)
+	c.Assert(hs.failures, Equals, 0)
+
+	// the staple is invalidated once it expires
+	s.clock.CurrentTime = s.re.NextUpdate
+	c.Assert(s.st.updateStaple(&stapleFetched{id: hs.id, key: h.Name, hostName: h.Name, err: fmt.Errorf("responder is down")}), Equals, true)
+	c.Assert(s.st.HasHost(engine.HostKey{Name: h.Name}), Equals, false)
+}
+
+func (s *StaplerSuite) TestRetryBackoff(c *C) {
+	c.Assert(s.st.retryPeriod, Equals, ErrRetryPeriod)
+	c.Assert(s.st.maxBackoff, Equals, DefaultMaxRetryBackoff)
+
+	st := New(Clock(s.clock), RetryBackoff(time.Second, 10*time.Second)).(*stapler)
+	defer st.Close()
+
+	for failures, max := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		4:  8 * time.Second,
+		5:  10 * time.Second,
+		50: 10 * time.Second,
+	} {
+		for i := 0; i < 10; i++ {
+			d := st.retryDelay(failures)
+			c.Assert(d >= max/2 && d <= max, Equals, true, Commentf("failures %d, delay %v", failures, d))
+		}
+	}
+
+	// refreshes are moved earlier by up to the tenth of the time left, never later
+	next := s.clock.UtcNow().Add(10 * time.Hour)
+	for i := 0; i < 10; i++ {
+		at := st.jitter(next)
+		c.Assert(!at.After(next) && !at.Before(next.Add(-time.Hour)), Equals, true, Commentf("%v", at))
+	}
+}
+
 func (s *StaplerSuite) TestStopInFlightTimers(c *C) {
 	srv := testutils.NewOCSPResponder()
 	defer srv.Close()
@@ -309,6 +385,146 @@ func (s *StaplerSuite) TestStapleFailed(c *C) {
 	c.Assert(re, IsNil)
 }
 
+func (s *StaplerSuite) TestCacheDir(c *C) {
+	dir := c.MkDir()
+	thisUpdate := s.clock.CurrentTime.Add(-time.Hour)
+	nextUpdate := thisUpdate.Add(24 * time.Hour)
+	f := newOCSPFixture(c, thisUpdate, nextUpdate)
+	srv := f.responder(c)
+
+	h, err := engine.NewHost("localhost",
+		engine.HostSettings{
+			KeyPair: f.keyPair,
+			OCSP:    engine.OCSPSettings{Enabled: true, Period: "1h", Responders: []string{srv.URL}},
+		})
+	c.Assert(err, IsNil)
+
+	st := New(Clock(s.clock), CacheDir(dir))
+	re, err := st.StapleHost(h)
+	c.Assert(err, IsNil)
+	c.Assert(re.Response.Status, Equals, ocsp.Good)
+	st.Close()
+
+	// The restarted stapler serves the persisted staple without querying the responder
+	srv.Close()
+	st = New(Clock(s.clock), CacheDir(dir))
+	other, err := st.StapleHost(h)
+	c.Assert(err, IsNil)
+	c.Assert(other.Staple, DeepEquals, re.Staple)
+	c.Assert(other.Response.Status, Equals, ocsp.Good)
+	c.Assert(other.Response.SerialNumber.Cmp(f.leaf.SerialNumber), Equals, 0)
+	st.Close()
+
+	// Stale staples are not used
+	s.clock.CurrentTime = nextUpdate.Add(time.Hour)
+	st = New(Clock(s.clock), CacheDir(dir))
+	_, err = st.StapleHost(h)
+	c.Assert(err, NotNil)
+	st.Close()
+
+	// Nor are the ones signed by someone else than the issuer
+	s.clock.CurrentTime = thisUpdate.Add(time.Hour)
+	files, err := filepath.Glob(filepath.Join(dir, "*.ocsp"))
+	c.Assert(err, IsNil)
+	c.Assert(len(files), Equals, 1)
+	forged := newOCSPFixture(c, thisUpdate, nextUpdate)
+	forged.leaf = f.leaf
+	c.Assert(ioutil.WriteFile(files[0], forged.response(c), 0600), IsNil)
+	st = New(Clock(s.clock), CacheDir(dir))
+	_, err = st.StapleHost(h)
+	c.Assert(err, NotNil)
+	st.Close()
+
+	// Nor are the corrupted ones
+	c.Assert(ioutil.WriteFile(files[0], []byte("garbage"), 0600), IsNil)
+	st = New(Clock(s.clock), CacheDir(dir))
+	_, err = st.StapleHost(h)
+	c.Assert(err, NotNil)
+	st.Close()
+}
+
+// ocspFixture is a leaf certificate issued by its own CA, with the responder signing the staples by the CA key
+type ocspFixture struct {
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	leaf       *x509.Certificate
+	keyPair    *engine.KeyPair
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+func newOCSPFixture(c *C, thisUpdate, nextUpdate time.Time) *ocspFixture {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Vulcand Test CA"}},
+		NotBefore:             thisUpdate.Add(-24 * time.Hour),
+		NotAfter:              nextUpdate.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+	ca, err := x509.ParseCertificate(caDER)
+	c.Assert(err, IsNil)
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    caTemplate.NotBefore,
+		NotAfter:     caTemplate.NotAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	c.Assert(err, IsNil)
+	leaf, err := x509.ParseCertificate(leafDER)
+	c.Assert(err, IsNil)
+
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	c.Assert(err, IsNil)
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})...)
+
+	return &ocspFixture{
+		ca:    ca,
+		caKey: caKey,
+		leaf:  leaf,
+		keyPair: &engine.KeyPair{
+			Cert: chain,
+			Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		},
+		thisUpdate: thisUpdate,
+		nextUpdate: nextUpdate,
+	}
+}
+
+// response returns the good status of the leaf signed by the CA
+func (f *ocspFixture) response(c *C) []byte {
+	raw, err := ocsp.CreateResponse(f.ca, f.ca, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: f.leaf.SerialNumber,
+		ThisUpdate:   f.thisUpdate,
+		NextUpdate:   f.nextUpdate,
+	}, f.caKey)
+	c.Assert(err, IsNil)
+	return raw
+}
+
+// responder serves the response of the fixture to any request
+func (f *ocspFixture) responder(c *C) *httptest.Server {
+	raw := f.response(c)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(raw)
+	}))
+}
+
 func (s *StaplerSuite) TestBadArguments(c *C) {
 	h, err := engine.NewHost("localhost", engine.HostSettings{})
 	c.Assert(err, IsNil)
@@ -0,0 +1,131 @@
+package supervisor
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// snapshotChanges returns the changes bringing the configuration of the current snapshot to the target one.
+// The objects added or changed are upserted first, in the order of their dependencies: hosts, listeners,
+// backends with their servers and frontends with their middlewares. The objects missing from the target are
+// deleted afterwards, the dependent ones first. The objects equal in both snapshots are left out, so syncing
+// the unchanged configuration makes no changes at all.
+func snapshotChanges(current, ss engine.Snapshot) []interface{} {
+	var upserts, deletes []interface{}
+
+	hosts := make(map[engine.HostKey]engine.Host)
+	for _, h := range current.Hosts {
+		hosts[engine.HostKey{Name: h.Name}] = h
+	}
+	for _, h := range ss.Hosts {
+		hk := engine.HostKey{Name: h.Name}
+		if old, ok := hosts[hk]; !ok || !reflect.DeepEqual(old, h) {
+			upserts = append(upserts, &engine.HostUpserted{Host: h})
+		}
+		delete(hosts, hk)
+	}
+
+	listeners := make(map[engine.ListenerKey]engine.Listener)
+	for _, l := range current.Listeners {
+		listeners[engine.ListenerKey{Id: l.Id}] = l
+	}
+	for _, l := range ss.Listeners {
+		lk := engine.ListenerKey{Id: l.Id}
+		if old, ok := listeners[lk]; !ok || !reflect.DeepEqual(old, l) {
+			upserts = append(upserts, &engine.ListenerUpserted{Listener: l})
+		}
+		delete(listeners, lk)
+	}
+
+	backends := make(map[engine.BackendKey]engine.BackendSpec)
+	for _, bs := range current.BackendSpecs {
+		backends[engine.BackendKey{Id: bs.Backend.Id}] = bs
+	}
+	for _, bs := range ss.BackendSpecs {
+		bk := engine.BackendKey{Id: bs.Backend.Id}
+		old, ok := backends[bk]
+		if !ok || !reflect.DeepEqual(old.Backend, bs.Backend) {
+			upserts = append(upserts, &engine.BackendUpserted{Backend: bs.Backend})
+		}
+		servers := make(map[engine.ServerKey]engine.Server)
+		for _, srv := range old.Servers {
+			servers[engine.ServerKey{BackendKey: bk, Id: srv.Id}] = srv
+		}
+		for _, srv := range bs.Servers {
+			sk := engine.ServerKey{BackendKey: bk, Id: srv.Id}
+			if oldSrv, ok := servers[sk]; !ok || !reflect.DeepEqual(oldSrv, srv) {
+				upserts = append(upserts, &engine.ServerUpserted{BackendKey: bk, Server: srv})
+			}
+			delete(servers, sk)
+		}
+		for sk := range servers {
+			upserts = append(upserts, &engine.ServerDeleted{ServerKey: sk})
+		}
+		delete(backends, bk)
+	}
+
+	frontends := make(map[engine.FrontendKey]engine.FrontendSpec)
+	for _, fs := range current.FrontendSpecs {
+		frontends[engine.FrontendKey{Id: fs.Frontend.Id}] = fs
+	}
+	for _, fs := range ss.FrontendSpecs {
+		fk := engine.FrontendKey{Id: fs.Frontend.Id}
+		old, ok := frontends[fk]
+		if !ok || !reflect.DeepEqual(old.Frontend, fs.Frontend) {
+			upserts = append(upserts, &engine.FrontendUpserted{Frontend: fs.Frontend})
+		}
+		middlewares := make(map[engine.MiddlewareKey]engine.Middleware)
+		for _, mw := range old.Middlewares {
+			middlewares[engine.MiddlewareKey{FrontendKey: fk, Id: mw.Id}] = mw
+		}
+		for _, mw := range fs.Middlewares {
+			mk := engine.MiddlewareKey{FrontendKey: fk, Id: mw.Id}
+			if oldMw, ok := middlewares[mk]; !ok || !middlewaresEqual(oldMw, mw) {
+				upserts = append(upserts, &engine.MiddlewareUpserted{FrontendKey: fk, Middleware: mw})
+			}
+			delete(middlewares, mk)
+		}
+		for mk := range middlewares {
+			upserts = append(upserts, &engine.MiddlewareDeleted{MiddlewareKey: mk})
+		}
+		delete(frontends, fk)
+	}
+
+	for fk := range frontends {
+		deletes = append(deletes, &engine.FrontendDeleted{FrontendKey: fk})
+	}
+	for bk := range backends {
+		deletes = append(deletes, &engine.BackendDeleted{BackendKey: bk})
+	}
+	for lk := range listeners {
+		deletes = append(deletes, &engine.ListenerDeleted{ListenerKey: lk})
+	}
+	for hk := range hosts {
+		deletes = append(deletes, &engine.HostDeleted{HostKey: hk})
+	}
+	return append(upserts, deletes...)
+}
+
+// middlewaresEqual compares the middlewares by their configuration. The middleware instances of the proxy keep
+// the state of their handlers, e.g. the cached responses or the fetched keys, which the instances read from the
+// engine do not have, so the instances are compared by their serialized form the engine stores.
+func middlewaresEqual(a, b engine.Middleware) bool {
+	if a.Id != b.Id || a.Type != b.Type || a.Priority != b.Priority {
+		return false
+	}
+	if reflect.DeepEqual(a.Middleware, b.Middleware) {
+		return true
+	}
+	ja, err := json.Marshal(a.Middleware)
+	if err != nil {
+		return false
+	}
+	jb, err := json.Marshal(b.Middleware)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ja, jb)
+}
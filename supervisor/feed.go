@@ -0,0 +1,80 @@
+package supervisor
+
+import (
+	"sync"
+
+	"github.com/vulcand/vulcand/engine"
+)
+
+// changeFeedBufferSize is the amount of events a subscriber can fall behind before the events are dropped
+const changeFeedBufferSize = 256
+
+// changeSubscription receives the changes applied to the proxy
+type changeSubscription struct {
+	// C receives the change events in the order they are applied
+	C chan *engine.ChangeEvent
+	// LostC is signalled when events were dropped because the subscriber has fallen behind,
+	// the subscriber should re-read the configuration then
+	LostC chan struct{}
+	feed  *changeFeed
+}
+
+func (c *changeSubscription) Changes() <-chan *engine.ChangeEvent {
+	return c.C
+}
+
+func (c *changeSubscription) Lost() <-chan struct{} {
+	return c.LostC
+}
+
+// Close unsubscribes from the changes
+func (c *changeSubscription) Close() {
+	c.feed.unsubscribe(c)
+}
+
+// changeFeed fans out the change events to the subscribers. Publishing never blocks the watcher,
+// events are dropped for the subscribers that can not keep up.
+type changeFeed struct {
+	mtx  sync.Mutex
+	subs map[*changeSubscription]struct{}
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{subs: make(map[*changeSubscription]struct{})}
+}
+
+func (f *changeFeed) subscribe() *changeSubscription {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	c := &changeSubscription{
+		C:     make(chan *engine.ChangeEvent, changeFeedBufferSize),
+		LostC: make(chan struct{}, 1),
+		feed:  f,
+	}
+	f.subs[c] = struct{}{}
+	return c
+}
+
+func (f *changeFeed) unsubscribe(c *changeSubscription) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	delete(f.subs, c)
+}
+
+func (f *changeFeed) publish(e *engine.ChangeEvent) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for c := range f.subs {
+		select {
+		case c.C <- e:
+		default:
+			// the lost signals coalesce, the subscriber re-reads the configuration once
+			select {
+			case c.LostC <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/vulcand/vulcand/engine"
 	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/reporter"
 )
 
 const (
@@ -41,17 +42,54 @@ type Supervisor struct {
 	// engine is used for reading configuration details
 	engine engine.Engine
 
+	// restarting is set while the proxy is being reinitialized after the engine watcher failure
+	restarting bool
+
+	// degraded is set while the proxy serves the default listener only, because the engine was not
+	// available at startup
+	degraded bool
+
+	// changeMtx serializes changes coming from the engine watcher and reloads
+	changeMtx sync.Mutex
+
 	watcherWg      sync.WaitGroup
 	watcherCancelC chan struct{}
 	watcherErrorC  chan struct{}
 
 	stopWg sync.WaitGroup
 	stopC  chan struct{}
+	// stopDeadline is the time the connections left open by the stopping proxy are closed at, the shutdown
+	// timeout of the proxy applies if zero
+	stopDeadline time.Time
+
+	// feed notifies the subscribers about the changes applied to the proxy
+	feed *changeFeed
+
+	// timeouts are the server timeouts updated at runtime, they are applied to the proxies created
+	// after the update as well
+	timeouts *proxy.ServerTimeouts
+
+	// quarantined are the servers taken out of rotation at runtime, they are quarantined in the proxies
+	// created later as well
+	quarantined map[engine.ServerKey]bool
+
+	// defaultKeyPair is the default certificate reloaded at runtime, it replaces the one of the options
+	// in the proxies created after the reload
+	defaultKeyPair *engine.KeyPair
 }
 
 type Options struct {
 	Clock timetools.TimeProvider
 	Files []*proxy.FileDescriptor
+	// Reporter counts the resyncs with the engine, optional
+	Reporter reporter.Reporter
+	// StartupRetries is the number of times the engine is tried again if it is not available at startup,
+	// the proxy serves the default listener only in the meantime. Start fails right away if it is 0.
+	StartupRetries int
+	// StartupRetryPeriod is the pause between the startup attempts, retryPeriod by default
+	StartupRetryPeriod time.Duration
+	// OnStartupFailure is called once the startup retries are exhausted, optional
+	OnStartupFailure func(error)
 }
 
 func New(newProxy proxy.NewProxyFn, engine engine.Engine, options Options) *Supervisor {
@@ -60,24 +98,118 @@ func New(newProxy proxy.NewProxyFn, engine engine.Engine, options Options) *Supe
 		engine:     engine,
 		options:    setDefaults(options),
 		stopC:      make(chan struct{}),
+		feed:       newChangeFeed(),
 	}
 }
 
 func (s *Supervisor) Start() error {
-	if err := s.init(); err != nil {
+	err := s.init()
+	if err == nil {
+		s.stopWg.Add(1)
+		go s.run()
+		return nil
+	}
+	if s.options.StartupRetries <= 0 {
 		return errors.Wrap(err, "initialization failed")
 	}
+	log.Warningf("%v failed to init, err=%v, serving the default listener while retrying", s, err)
+	if err := s.startDegraded(); err != nil {
+		return errors.Wrap(err, "degraded initialization failed")
+	}
 	s.stopWg.Add(1)
-	go s.run()
+	go s.retryStart()
+	return nil
+}
+
+// startDegraded starts the proxy with the empty configuration, so the default listener and the files
+// inherited from the parent are served until the engine becomes available
+func (s *Supervisor) startDegraded() error {
+	newMuxId := s.lastId
+	s.lastId += 1
+
+	p, err := s.newProxy(newMuxId)
+	if err != nil {
+		return errors.Wrap(err, "failed to create mux")
+	}
+	if err := p.Init(engine.Snapshot{}); err != nil {
+		return errors.Wrap(err, "failed to init mux")
+	}
+	if len(s.options.Files) != 0 {
+		log.Infof("Passing files %v to %v", s.options.Files, p)
+		if err := p.TakeFiles(s.options.Files); err != nil {
+			return errors.Wrap(err, "failed to inherit files from parrent process")
+		}
+	}
+	if err := p.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start mux %v", p)
+	}
+	s.mtx.Lock()
+	s.proxy, s.degraded = p, true
+	s.mtx.Unlock()
 	return nil
 }
 
+// retryStart keeps trying to initialize the proxy from the engine, the degraded proxy hands its files to the
+// new one once the engine is available. When the retries are exhausted the degraded proxy keeps serving
+// until the supervisor is stopped.
+func (s *Supervisor) retryStart() {
+	defer s.stopWg.Done()
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-time.After(s.options.StartupRetryPeriod):
+		case <-s.stopC:
+			s.stopProxy(s.getCurrentProxy())
+			return
+		}
+		err := s.init()
+		if err == nil {
+			s.mtx.Lock()
+			s.degraded = false
+			s.mtx.Unlock()
+			log.Infof("%v initialized after %d startup retries", s, attempt)
+			s.stopWg.Add(1)
+			go s.run()
+			return
+		}
+		if attempt >= s.options.StartupRetries {
+			log.Errorf("%v giving up after %d startup retries, err=%v", s, attempt, err)
+			if s.options.OnStartupFailure != nil {
+				s.options.OnStartupFailure(errors.Wrap(err, "initialization failed"))
+			}
+			<-s.stopC
+			s.stopProxy(s.getCurrentProxy())
+			return
+		}
+		log.Warningf("%v startup retry %d of %d failed, err=%v", s, attempt, s.options.StartupRetries, err)
+	}
+}
+
 func (s *Supervisor) Stop() {
 	close(s.stopC)
 	s.stopWg.Wait()
 	log.Infof("All operations stopped")
 }
 
+// StopBy stops the supervisor, the connections still open at the deadline are closed. The deadline is taken
+// once the shutdown is requested, so the time spent stopping the rest of the service counts towards the drain.
+func (s *Supervisor) StopBy(deadline time.Time) {
+	s.mtx.Lock()
+	s.stopDeadline = deadline
+	s.mtx.Unlock()
+	s.Stop()
+}
+
+func (s *Supervisor) stopProxy(p proxy.Proxy) {
+	s.mtx.Lock()
+	deadline := s.stopDeadline
+	s.mtx.Unlock()
+	if deadline.IsZero() {
+		p.Stop(true)
+		return
+	}
+	p.StopBy(deadline)
+}
+
 func (s *Supervisor) String() string {
 	return "sup"
 }
@@ -136,6 +268,192 @@ func (s *Supervisor) TopServers(key *engine.BackendKey) ([]engine.Server, error)
 	return nil, fmt.Errorf("no current proxy")
 }
 
+// BackendHealth returns health state of the backend servers.
+func (s *Supervisor) BackendHealth(key engine.BackendKey) ([]engine.ServerHealth, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.BackendHealth(key)
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+// ProxyStats returns the runtime stats of the current proxy.
+func (s *Supervisor) ProxyStats() (*engine.ProxyStats, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.ProxyStats()
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+// LatencyStats returns the latency percentiles of the current proxy.
+func (s *Supervisor) LatencyStats() (*engine.LatencyStats, error) {
+	p := s.getCurrentProxy()
+	if p != nil {
+		return p.LatencyStats()
+	}
+	return nil, fmt.Errorf("no current proxy")
+}
+
+// Reload re-reads the engine snapshot and applies the difference to the running proxy in place,
+// listening sockets are kept and no new proxy is created.
+func (s *Supervisor) Reload() error {
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+
+	p := s.getCurrentProxy()
+	if p == nil {
+		return fmt.Errorf("no current proxy")
+	}
+	snapshot, err := s.engine.GetSnapshot()
+	if err != nil {
+		return errors.Wrap(err, "failed to get snapshot")
+	}
+	checkpoint := time.Now()
+	if err := syncProxy(p, *snapshot); err != nil {
+		return err
+	}
+	log.Infof("%v reloaded %v, took=%v", s, p, time.Now().Sub(checkpoint))
+	return nil
+}
+
+// ServerTimeouts returns the server timeouts of the current proxy
+func (s *Supervisor) ServerTimeouts() (*proxy.ServerTimeouts, error) {
+	p := s.getCurrentProxy()
+	if p == nil {
+		return nil, fmt.Errorf("no current proxy")
+	}
+	t := p.ServerTimeouts()
+	return &t, nil
+}
+
+// PurgeCache drops the cached responses of the frontend with the path starting with the prefix from the current
+// proxy, the caches are kept by every proxy instance
+func (s *Supervisor) PurgeCache(fk engine.FrontendKey, prefix string) (int, error) {
+	p := s.getCurrentProxy()
+	if p == nil {
+		return 0, fmt.Errorf("no current proxy")
+	}
+	return p.PurgeCache(fk, prefix)
+}
+
+// UpdateServerTimeouts applies the server timeouts to the current proxy without dropping the connections,
+// the timeouts are kept for the proxies created later on recovery
+func (s *Supervisor) UpdateServerTimeouts(t proxy.ServerTimeouts) error {
+	if err := t.Check(); err != nil {
+		return err
+	}
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+
+	p := s.getCurrentProxy()
+	if p == nil {
+		return fmt.Errorf("no current proxy")
+	}
+	s.mtx.Lock()
+	s.timeouts = &t
+	s.mtx.Unlock()
+	return p.UpdateServerTimeouts(t)
+}
+
+// UpdateDefaultKeyPair replaces the default certificate of the current proxy in place and keeps it for the proxies
+// created later on recovery. The certificate is kept even if there is no current proxy at the moment, the proxy
+// created next picks it up.
+func (s *Supervisor) UpdateDefaultKeyPair(kp engine.KeyPair) error {
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+
+	s.mtx.Lock()
+	s.defaultKeyPair = &kp
+	s.mtx.Unlock()
+
+	p := s.getCurrentProxy()
+	if p == nil {
+		return nil
+	}
+	return p.UpdateDefaultKeyPair(kp)
+}
+
+// QuarantineServer takes the server out of rotation of the current proxy keeping its configuration in the engine,
+// or puts it back if quarantined is false. The quarantine is not stored in the engine, it is kept for the proxies
+// created later on recovery until it is cleared or vulcand restarts.
+func (s *Supervisor) QuarantineServer(sk engine.ServerKey, quarantined bool) error {
+	s.changeMtx.Lock()
+	defer s.changeMtx.Unlock()
+
+	p := s.getCurrentProxy()
+	if p == nil {
+		return fmt.Errorf("no current proxy")
+	}
+	s.mtx.Lock()
+	if s.quarantined == nil {
+		s.quarantined = make(map[engine.ServerKey]bool)
+	}
+	if quarantined {
+		s.quarantined[sk] = true
+	} else {
+		delete(s.quarantined, sk)
+	}
+	s.mtx.Unlock()
+	return p.QuarantineServer(sk, quarantined)
+}
+
+// newProxy creates the proxy with the server timeouts, the quarantined servers and the default certificate
+// updated at runtime
+func (s *Supervisor) newProxy(id int) (proxy.Proxy, error) {
+	p, err := s.newProxyFn(id)
+	if err != nil {
+		return nil, err
+	}
+	s.mtx.RLock()
+	t, kp := s.timeouts, s.defaultKeyPair
+	quarantined := make([]engine.ServerKey, 0, len(s.quarantined))
+	for sk := range s.quarantined {
+		quarantined = append(quarantined, sk)
+	}
+	s.mtx.RUnlock()
+	if t != nil {
+		if err := p.UpdateServerTimeouts(*t); err != nil {
+			return nil, err
+		}
+	}
+	for _, sk := range quarantined {
+		if err := p.QuarantineServer(sk, true); err != nil {
+			return nil, err
+		}
+	}
+	if kp != nil {
+		if err := p.UpdateDefaultKeyPair(*kp); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Ready returns an error if there is no active proxy serving the engine configuration
+func (s *Supervisor) Ready() error {
+	s.mtx.RLock()
+	p, restarting, degraded := s.proxy, s.restarting, s.degraded
+	s.mtx.RUnlock()
+
+	if degraded {
+		return fmt.Errorf("engine is not available, serving the default listener only")
+	}
+	if restarting {
+		return fmt.Errorf("engine watcher failed, reinitializing")
+	}
+	if p == nil {
+		return fmt.Errorf("no current proxy")
+	}
+	return p.Ready()
+}
+
+func (s *Supervisor) setRestarting(restarting bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.restarting = restarting
+}
+
 func (s *Supervisor) getCurrentProxy() proxy.Proxy {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
@@ -169,7 +487,7 @@ func (s *Supervisor) init() error {
 	go func() {
 		defer s.watcherWg.Done()
 		defer close(changesC)
-		if err := s.engine.Subscribe(changesC, snapshot.Index, s.watcherCancelC); err != nil {
+		if err := s.watch(newMuxId, changesC, snapshot.Index); err != nil {
 			log.Infof("mux_%d engine watcher failed: '%v' will restart", newMuxId, err)
 			s.watcherErrorC <- struct{}{}
 			return
@@ -185,7 +503,7 @@ func (s *Supervisor) init() error {
 	}()
 
 	checkpoint := time.Now()
-	newProxy, err := s.newProxyFn(newMuxId)
+	newProxy, err := s.newProxy(newMuxId)
 	if err != nil {
 		return errors.Wrap(err, "failed to create mux")
 	}
@@ -242,28 +560,80 @@ func (s *Supervisor) init() error {
 	go func() {
 		defer s.watcherWg.Done()
 		for change := range changesC {
-			if err := processChange(newProxy, change); err != nil {
+			s.changeMtx.Lock()
+			err := processChange(newProxy, change)
+			s.changeMtx.Unlock()
+			if err != nil {
 				log.Errorf("%v failed to process, change=%#v, err=%s", newProxy, change, err)
 			}
+			s.publishChange(change)
 		}
 		log.Infof("%v change processor shutdown", newProxy)
 	}()
 	return nil
 }
 
+// SubscribeChanges returns the subscription to the changes applied to the proxy, the subscription
+// must be closed when it is not needed anymore.
+func (s *Supervisor) SubscribeChanges() engine.ChangeSubscription {
+	return s.feed.subscribe()
+}
+
+func (s *Supervisor) publishChange(change interface{}) {
+	if _, ok := change.(*resync); ok {
+		s.feed.publish(&engine.ChangeEvent{Op: engine.ChangeResync})
+		return
+	}
+	if e, ok := engine.NewChangeEvent(change); ok {
+		s.feed.publish(e)
+	}
+}
+
+// resync carries the snapshot re-read after the engine watch fell behind, the proxy is synced with it
+// in order with the other changes
+type resync struct {
+	snapshot engine.Snapshot
+}
+
+// watch subscribes to the engine changes. When the changes the watch needs are compacted away, the snapshot
+// is read again and passed on to resync the proxy, then the watch continues from the snapshot index.
+func (s *Supervisor) watch(muxId int, changesC chan interface{}, idx uint64) error {
+	for {
+		err := s.engine.Subscribe(changesC, idx, s.watcherCancelC)
+		if _, ok := err.(*engine.CompactedError); !ok {
+			return err
+		}
+		log.Warningf("mux_%d engine watcher fell behind: %v, resyncing with the engine snapshot", muxId, err)
+		snapshot, err := s.engine.GetSnapshot()
+		if err != nil {
+			return errors.Wrap(err, "failed to get snapshot")
+		}
+		select {
+		case changesC <- &resync{snapshot: *snapshot}:
+		case <-s.watcherCancelC:
+			return nil
+		}
+		if s.options.Reporter != nil {
+			s.options.Reporter.ObserveResync()
+		}
+		idx = snapshot.Index
+	}
+}
+
 // supervise listens for error notifications and triggers graceful restart.
 func (s *Supervisor) run() {
 	defer s.stopWg.Done()
 	for {
 		select {
 		case <-s.watcherErrorC:
+			s.setRestarting(true)
 			s.watcherWg.Wait()
 			s.watcherErrorC = nil
 		case <-s.stopC:
 			close(s.watcherCancelC)
 			s.watcherWg.Wait()
 			if s.proxy != nil {
-				s.proxy.Stop(true)
+				s.stopProxy(s.proxy)
 			}
 			return
 		}
@@ -280,6 +650,7 @@ func (s *Supervisor) run() {
 			}
 			err = s.init()
 		}
+		s.setRestarting(false)
 	}
 }
 
@@ -287,13 +658,79 @@ func setDefaults(o Options) Options {
 	if o.Clock == nil {
 		o.Clock = &timetools.RealTime{}
 	}
+	if o.StartupRetryPeriod <= 0 {
+		o.StartupRetryPeriod = retryPeriod
+	}
 	return o
 }
 
+// syncProxy brings the proxy configuration to the snapshot with the changes between the snapshot of the proxy
+// and the target one, the unchanged objects are not touched. Everything is upserted before anything is deleted,
+// so frontends are switched to their new backends before the old ones are removed, and backends still
+// referenced by frontends are never deleted. Failed operations do not stop the sync, the first error is
+// returned after all the changes have been attempted.
+func syncProxy(p proxy.Proxy, ss engine.Snapshot) error {
+	var errs []error
+	apply := func(err error) {
+		if err != nil {
+			log.Errorf("%v sync failed: %v", p, err)
+			errs = append(errs, err)
+		}
+	}
+
+	failed := make(map[engine.FrontendKey]bool)
+	var used map[engine.BackendKey]bool
+	for _, ch := range snapshotChanges(p.Snapshot(), ss) {
+		switch change := ch.(type) {
+		case *engine.FrontendUpserted:
+			if err := p.UpsertFrontend(change.Frontend); err != nil {
+				apply(err)
+				failed[engine.FrontendKey{Id: change.Frontend.Id}] = true
+			}
+			continue
+		case *engine.MiddlewareUpserted:
+			// the middlewares of the frontend that failed to upsert are skipped
+			if failed[change.FrontendKey] {
+				continue
+			}
+		case *engine.MiddlewareDeleted:
+			if failed[change.MiddlewareKey.FrontendKey] {
+				continue
+			}
+		case *engine.BackendDeleted:
+			if used == nil {
+				used = make(map[engine.BackendKey]bool)
+				// the canary and the mirror backends of the frontends are used too
+				for _, fs := range p.Snapshot().FrontendSpecs {
+					for _, id := range fs.Frontend.BackendIds() {
+						used[engine.BackendKey{Id: id}] = true
+					}
+				}
+			}
+			if used[change.BackendKey] {
+				apply(fmt.Errorf("%v is still used by frontends, not deleting", change.BackendKey))
+				continue
+			}
+		}
+		apply(processChange(p, ch))
+	}
+
+	if len(errs) != 0 {
+		return errors.Wrapf(errs[0], "%d of the changes failed", len(errs))
+	}
+	return nil
+}
+
 // processChange takes the backend change notification emitted by the backend
 // and applies it to the server.
 func processChange(p proxy.Proxy, ch interface{}) error {
 	switch change := ch.(type) {
+	case *resync:
+		checkpoint := time.Now()
+		err := syncProxy(p, change.snapshot)
+		log.Infof("%v resynced with the engine snapshot, index=%d, took=%v", p, change.snapshot.Index, time.Now().Sub(checkpoint))
+		return err
+
 	case *engine.HostUpserted:
 		return p.UpsertHost(change.Host)
 	case *engine.HostDeleted:
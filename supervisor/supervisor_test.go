@@ -3,6 +3,7 @@ package supervisor
 import (
 	"fmt"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/vulcand/vulcand/engine/memng"
 	"github.com/vulcand/vulcand/plugin/registry"
 	"github.com/vulcand/vulcand/proxy"
+	"github.com/vulcand/vulcand/reporter"
 	"github.com/vulcand/vulcand/stapler"
 	. "github.com/vulcand/vulcand/testutils"
 	. "gopkg.in/check.v1"
@@ -164,6 +166,393 @@ func (s *SupervisorSuite) TestTransferFiles(c *C) {
 	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
 }
 
+func (s *SupervisorSuite) TestReload(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11801", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertFrontend(b.F, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertListener(b.L), IsNil)
+
+	sup := New(newProxy, s.ng, Options{Clock: s.clock})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	// The proxy drifts away from the engine: the frontend is lost and the unknown one is added
+	p := sup.getCurrentProxy()
+	c.Assert(p.DeleteFrontend(b.FK), IsNil)
+	stale := MakeBatch(Batch{Addr: "localhost:11801", Route: `Path("/stale")`, URL: e.URL})
+	c.Assert(p.UpsertBackend(stale.B), IsNil)
+	c.Assert(p.UpsertServer(stale.BK, stale.S), IsNil)
+	c.Assert(p.UpsertFrontend(stale.F), IsNil)
+
+	c.Assert(sup.Reload(), IsNil)
+
+	// The same proxy serves the engine configuration again
+	c.Assert(sup.getCurrentProxy(), Equals, p)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	re, _, err := testutils.Get(b.FrontendURL("/stale"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+
+	ss := p.Snapshot()
+	c.Assert(len(ss.FrontendSpecs), Equals, 1)
+	c.Assert(len(ss.BackendSpecs), Equals, 1)
+	c.Assert(ss.BackendSpecs[0].Backend.Id, Equals, b.B.Id)
+}
+
+func (s *SupervisorSuite) TestResyncOnCompaction(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11802", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertFrontend(b.F, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertListener(b.L), IsNil)
+
+	rep := &resyncCounter{}
+	sup := New(newProxy, s.ng, Options{Clock: s.clock, Reporter: rep})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+
+	// The changes the watch has missed are compacted away
+	p := sup.getCurrentProxy()
+	c.Assert(p.DeleteFrontend(b.FK), IsNil)
+	s.ng.ErrorsC <- &engine.CompactedError{Index: 10}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The same proxy is synced with the engine and keeps getting changes
+	c.Assert(sup.getCurrentProxy(), Equals, p)
+	c.Assert(sup.Ready(), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+	c.Assert(rep.Resyncs(), Equals, 1)
+
+	c.Assert(s.ng.DeleteFrontend(b.FK), IsNil)
+	time.Sleep(10 * time.Millisecond)
+	re, _, err := testutils.Get(b.FrontendURL("/"))
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *SupervisorSuite) TestSyncUnchangedSnapshot(c *C) {
+	b := MakeBatch(Batch{Addr: "localhost:11805", Route: `Path("/")`, URL: "http://localhost:5000"})
+	ss := func(hits int) engine.Snapshot {
+		out := b.Snapshot()
+		out.FrontendSpecs[0].Middlewares = []engine.Middleware{{Id: "m1", Type: "stateful", Middleware: &stateful{Limit: 1, hits: hits}}}
+		return out
+	}
+	p, err := newProxy(1)
+	c.Assert(err, IsNil)
+	c.Assert(p.Init(ss(0)), IsNil)
+
+	// the middleware state of the proxy differs from the snapshot read from the engine
+	c.Assert(snapshotChanges(p.Snapshot(), ss(10)), HasLen, 0)
+	counted := &changeCounter{Proxy: p}
+	c.Assert(syncProxy(counted, ss(10)), IsNil)
+	c.Assert(counted.changes, HasLen, 0)
+
+	// only the changed frontend is upserted
+	changed := ss(0)
+	changed.FrontendSpecs[0].Frontend.Route = `Path("/v2")`
+	c.Assert(syncProxy(counted, changed), IsNil)
+	c.Assert(counted.changes, DeepEquals, []string{"UpsertFrontend"})
+
+	counted.changes = nil
+	changed.FrontendSpecs[0].Middlewares[0].Middleware = &stateful{Limit: 2}
+	c.Assert(syncProxy(counted, changed), IsNil)
+	c.Assert(counted.changes, DeepEquals, []string{"UpsertMiddleware"})
+}
+
+func (s *SupervisorSuite) TestSyncKeepsCanaryAndMirrorBackends(c *C) {
+	b := MakeBatch(Batch{Addr: "localhost:11808", Route: `Path("/")`, URL: "http://localhost:5000"})
+	canary := MakeBatch(Batch{Route: `Path("/canary")`, URL: "http://localhost:5001"})
+	mirror := MakeBatch(Batch{Route: `Path("/mirror")`, URL: "http://localhost:5002"})
+	current := b.Snapshot()
+	settings := current.FrontendSpecs[0].Frontend.HTTPSettings()
+	settings.Canary = &engine.HTTPFrontendCanary{BackendId: canary.B.Id, Percent: 10}
+	settings.Mirror = &engine.HTTPFrontendMirror{BackendId: mirror.B.Id, Percent: 10}
+	current.FrontendSpecs[0].Frontend.Settings = settings
+	target := current
+	current.BackendSpecs = append(append(current.BackendSpecs, canary.Snapshot().BackendSpecs...), mirror.Snapshot().BackendSpecs...)
+
+	p, err := newProxy(1)
+	c.Assert(err, IsNil)
+	c.Assert(p.Init(current), IsNil)
+
+	// the backends the frontend sends the canary and the mirrored requests to are not deleted
+	c.Assert(syncProxy(p, target), NotNil)
+	c.Assert(p.Snapshot().BackendSpecs, HasLen, 3)
+}
+
+func (s *SupervisorSuite) TestSnapshotChanges(c *C) {
+	b1 := MakeBatch(Batch{Addr: "localhost:11806", Route: `Path("/")`, URL: "http://localhost:5000"})
+	b2 := MakeBatch(Batch{Host: "example.com", Addr: "localhost:11807", Route: `Path("/")`, URL: "http://localhost:5001"})
+	current := MakeSnapshot(b1, b2)
+
+	c.Assert(snapshotChanges(current, current), HasLen, 0)
+
+	// b2 is gone, the server of b1 is replaced
+	target := MakeSnapshot(b1)
+	srv := MakeServer("http://localhost:5002")
+	target.BackendSpecs[0].Servers = []engine.Server{srv}
+	c.Assert(snapshotChanges(current, target), DeepEquals, []interface{}{
+		&engine.ServerUpserted{BackendKey: b1.BK, Server: srv},
+		&engine.ServerDeleted{ServerKey: b1.SK},
+		&engine.FrontendDeleted{FrontendKey: b2.FK},
+		&engine.BackendDeleted{BackendKey: b2.BK},
+		&engine.ListenerDeleted{ListenerKey: b2.LK},
+		&engine.HostDeleted{HostKey: engine.HostKey{Name: b2.H.Name}},
+	})
+}
+
+func (s *SupervisorSuite) TestStartWhileEngineUnavailable(c *C) {
+	e := testutils.NewResponder("Hi, I'm endpoint")
+	defer e.Close()
+
+	ng := &unavailableEngine{Engine: s.ng, down: true}
+	l := MakeListener("localhost:11803", engine.HTTP)
+	newProxy := func(id int) (proxy.Proxy, error) {
+		return proxy.New(id, stapler.New(), proxy.Options{DefaultListener: &l})
+	}
+	sup := New(newProxy, ng, Options{Clock: s.clock, StartupRetries: 100, StartupRetryPeriod: 10 * time.Millisecond})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+
+	// The default listener is served, but the supervisor is not ready
+	re, _, err := testutils.Get("http://localhost:11803/")
+	c.Assert(err, IsNil)
+	c.Assert(re.StatusCode, Equals, http.StatusNotFound)
+	c.Assert(sup.Ready(), NotNil)
+
+	b := MakeBatch(Batch{Addr: "localhost:11804", Route: `Path("/")`, URL: e.URL})
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertFrontend(b.F, engine.NoTTL), IsNil)
+	c.Assert(s.ng.UpsertListener(b.L), IsNil)
+	ng.setDown(false)
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(sup.Ready(), IsNil)
+	c.Assert(GETResponse(c, b.FrontendURL("/")), Equals, "Hi, I'm endpoint")
+}
+
+func (s *SupervisorSuite) TestStartRetriesExhausted(c *C) {
+	ng := &unavailableEngine{Engine: s.ng, down: true}
+	failedC := make(chan error, 1)
+	sup := New(newProxy, ng, Options{
+		Clock:              s.clock,
+		StartupRetries:     2,
+		StartupRetryPeriod: time.Millisecond,
+		OnStartupFailure:   func(err error) { failedC <- err },
+	})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+
+	select {
+	case err := <-failedC:
+		c.Assert(err, NotNil)
+	case <-time.After(time.Second):
+		c.Fatalf("startup failure was not reported")
+	}
+	c.Assert(sup.Ready(), NotNil)
+}
+
+func (s *SupervisorSuite) TestStartFailsWithoutRetries(c *C) {
+	sup := New(newProxy, &unavailableEngine{Engine: s.ng, down: true}, Options{Clock: s.clock})
+	c.Assert(sup.Start(), NotNil)
+}
+
+func (s *SupervisorSuite) TestSubscribeChanges(c *C) {
+	sup := New(newProxy, s.ng, Options{Clock: s.clock})
+	c.Assert(sup.Start(), IsNil)
+	defer sup.Stop()
+
+	sub := sup.SubscribeChanges()
+	defer sub.Close()
+
+	b := MakeBatch(Batch{Addr: "localhost:11800", Route: `Path("/")`, URL: "http://localhost:5000"})
+	c.Assert(s.ng.UpsertBackend(b.B), IsNil)
+	c.Assert(s.ng.UpsertServer(b.BK, b.S, engine.NoTTL), IsNil)
+
+	select {
+	case e := <-sub.Changes():
+		c.Assert(*e, DeepEquals, engine.ChangeEvent{Type: "backend", Id: b.B.Id, Op: engine.ChangeUpsert})
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for the backend change")
+	}
+	select {
+	case e := <-sub.Changes():
+		c.Assert(*e, DeepEquals, engine.ChangeEvent{Type: "server", Id: b.S.Id, Parent: b.B.Id, Op: engine.ChangeUpsert})
+	case <-time.After(time.Second):
+		c.Fatalf("timeout waiting for the server change")
+	}
+}
+
+func (s *SupervisorSuite) TestChangeFeedDropsForSlowSubscribers(c *C) {
+	f := newChangeFeed()
+	slow := f.subscribe()
+	fast := f.subscribe()
+
+	for i := 0; i < changeFeedBufferSize+10; i++ {
+		f.publish(&engine.ChangeEvent{Type: "backend", Id: fmt.Sprintf("b%d", i), Op: engine.ChangeUpsert})
+		if i < changeFeedBufferSize {
+			<-fast.C
+		}
+	}
+	c.Assert(len(slow.C), Equals, changeFeedBufferSize)
+	c.Assert(len(slow.LostC), Equals, 1)
+	c.Assert(len(fast.C), Equals, 10)
+	c.Assert(len(fast.LostC), Equals, 0)
+
+	// closed subscriptions receive nothing
+	slow.Close()
+	<-slow.LostC
+	f.publish(&engine.ChangeEvent{Type: "backend", Id: "b", Op: engine.ChangeDelete})
+	c.Assert(len(slow.LostC), Equals, 0)
+	c.Assert(len(fast.C), Equals, 11)
+}
+
+// stateful is the middleware keeping the state of its handlers, which is not a part of its configuration
+type stateful struct {
+	Limit int
+	hits  int
+}
+
+func (m *stateful) NewHandler(next http.Handler) (http.Handler, error) {
+	return next, nil
+}
+
+// changeCounter records the changes made to the proxy
+type changeCounter struct {
+	proxy.Proxy
+	changes []string
+}
+
+func (p *changeCounter) record(name string) {
+	p.changes = append(p.changes, name)
+}
+
+func (p *changeCounter) UpsertHost(h engine.Host) error {
+	p.record("UpsertHost")
+	return p.Proxy.UpsertHost(h)
+}
+
+func (p *changeCounter) DeleteHost(hk engine.HostKey) error {
+	p.record("DeleteHost")
+	return p.Proxy.DeleteHost(hk)
+}
+
+func (p *changeCounter) UpsertListener(l engine.Listener) error {
+	p.record("UpsertListener")
+	return p.Proxy.UpsertListener(l)
+}
+
+func (p *changeCounter) DeleteListener(lk engine.ListenerKey) error {
+	p.record("DeleteListener")
+	return p.Proxy.DeleteListener(lk)
+}
+
+func (p *changeCounter) UpsertBackend(b engine.Backend) error {
+	p.record("UpsertBackend")
+	return p.Proxy.UpsertBackend(b)
+}
+
+func (p *changeCounter) DeleteBackend(bk engine.BackendKey) error {
+	p.record("DeleteBackend")
+	return p.Proxy.DeleteBackend(bk)
+}
+
+func (p *changeCounter) UpsertFrontend(f engine.Frontend) error {
+	p.record("UpsertFrontend")
+	return p.Proxy.UpsertFrontend(f)
+}
+
+func (p *changeCounter) DeleteFrontend(fk engine.FrontendKey) error {
+	p.record("DeleteFrontend")
+	return p.Proxy.DeleteFrontend(fk)
+}
+
+func (p *changeCounter) UpsertMiddleware(fk engine.FrontendKey, m engine.Middleware) error {
+	p.record("UpsertMiddleware")
+	return p.Proxy.UpsertMiddleware(fk, m)
+}
+
+func (p *changeCounter) DeleteMiddleware(mk engine.MiddlewareKey) error {
+	p.record("DeleteMiddleware")
+	return p.Proxy.DeleteMiddleware(mk)
+}
+
+func (p *changeCounter) UpsertServer(bk engine.BackendKey, srv engine.Server) error {
+	p.record("UpsertServer")
+	return p.Proxy.UpsertServer(bk, srv)
+}
+
+func (p *changeCounter) DeleteServer(sk engine.ServerKey) error {
+	p.record("DeleteServer")
+	return p.Proxy.DeleteServer(sk)
+}
+
+type resyncCounter struct {
+	mtx     sync.Mutex
+	resyncs int
+}
+
+func (r *resyncCounter) ObserveRequest(frontend string, code int, latency time.Duration)  {}
+func (r *resyncCounter) ObserveRejectedConn(listener string)                              {}
+func (r *resyncCounter) ObserveOversizedRequest(frontend string)                          {}
+func (r *resyncCounter) ObserveMaintenanceRequest(frontend string)                        {}
+func (r *resyncCounter) ObserveCacheLookup(frontend string, hit bool)                     {}
+func (r *resyncCounter) ObserveDegradedRequest(frontend, middleware string, allowed bool) {}
+func (r *resyncCounter) ReportCerts(certs []reporter.CertState)                           {}
+func (r *resyncCounter) ReportServers(servers []reporter.ServerState)                     {}
+func (r *resyncCounter) ReportConns(addr, state string, count int64)                      {}
+func (r *resyncCounter) ObserveStartupPhase(phase string, d time.Duration)                {}
+
+func (r *resyncCounter) ObserveResync() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.resyncs++
+}
+
+func (r *resyncCounter) Resyncs() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.resyncs
+}
+
+// unavailableEngine fails to return the snapshot while it is down
+type unavailableEngine struct {
+	engine.Engine
+	mtx  sync.Mutex
+	down bool
+}
+
+func (e *unavailableEngine) setDown(down bool) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	e.down = down
+}
+
+func (e *unavailableEngine) GetSnapshot() (*engine.Snapshot, error) {
+	e.mtx.Lock()
+	down := e.down
+	e.mtx.Unlock()
+	if down {
+		return nil, fmt.Errorf("engine is unavailable")
+	}
+	return e.Engine.GetSnapshot()
+}
+
 func GETResponse(c *C, url string, opts ...testutils.ReqOption) string {
 	response, body, err := testutils.Get(url, opts...)
 	c.Assert(err, IsNil)
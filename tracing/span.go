@@ -0,0 +1,170 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context of the request
+const TraceparentHeader = "traceparent"
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies the span within the trace
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// Traceparent returns the traceparent header value of the span context
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%v-%v-%v", c.TraceID, c.SpanID, flags)
+}
+
+// ParseTraceparent parses the traceparent header, invalid headers and headers with all zero ids are ignored
+// the way the W3C trace context requires
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return c, false
+	}
+	// version 00 has exactly four fields, the future versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return c, false
+	}
+	if !decodeID(c.TraceID[:], parts[1]) || !decodeID(c.SpanID[:], parts[2]) {
+		return c, false
+	}
+	var flags [1]byte
+	if len(parts[3]) != 2 {
+		return c, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return c, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, true
+}
+
+// decodeID decodes the lowercase hex id, ids with all zero bytes are invalid
+func decodeID(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range dst {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type StatusCode int
+
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Span is the server span of the proxied request, it is not safe for concurrent use
+type Span struct {
+	tracer *Tracer
+	ctx    SpanContext
+	parent SpanID
+	name   string
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	status StatusCode
+	ended  bool
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Context returns the span context that is propagated to the upstream
+func (s *Span) Context() SpanContext {
+	return s.ctx
+}
+
+// SetAttribute sets the string, bool or integer attribute of the span, attributes are not recorded
+// if the span is not sampled
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.ctx.Sampled {
+		return
+	}
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+func (s *Span) SetStatus(code StatusCode) {
+	s.status = code
+}
+
+// End ends the span and queues it for export if it is sampled, the calls after the first one are ignored
+func (s *Span) End() {
+	if s.ended {
+		return
+	}
+	s.ended = true
+	if !s.ctx.Sampled {
+		return
+	}
+	s.end = s.tracer.options.TimeProvider.UtcNow()
+	s.tracer.export(s)
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span of the request, nil if the request is not traced
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
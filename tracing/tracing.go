@@ -0,0 +1,190 @@
+// Package tracing starts spans of the proxied requests, propagates the W3C trace context to the upstreams
+// and exports the sampled spans to the OpenTelemetry collector over OTLP/HTTP.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mailgun/timetools"
+)
+
+const (
+	DefaultServiceName   = "vulcand"
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 4096
+	DefaultFlushInterval = 5 * time.Second
+	DefaultExportTimeout = 10 * time.Second
+)
+
+type Options struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	// SampleRate is the share of the traces started by vulcand that are exported, between 0 and 1.
+	// Requests coming with the trace context keep the sampling decision of the caller.
+	SampleRate float64
+	// ServiceName is the service.name resource attribute of the spans
+	ServiceName string
+	// BatchSize is the max amount of spans sent to the collector at once
+	BatchSize int
+	// QueueSize is the amount of the ended spans waiting for the export, spans over it are dropped
+	QueueSize int
+	// FlushInterval is the max time the ended span waits for the export
+	FlushInterval time.Duration
+	Client        *http.Client
+	TimeProvider  timetools.TimeProvider
+}
+
+// Tracer creates spans and exports them in batches in the background, so the requests never wait for the collector
+type Tracer struct {
+	options Options
+	queue   chan *Span
+	dropped int64
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+func New(o Options) (*Tracer, error) {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad tracing endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("tracing endpoint should be http or https URL, got '%v'", o.Endpoint)
+	}
+	if o.SampleRate < 0 || o.SampleRate > 1 {
+		return nil, fmt.Errorf("tracing sample rate should be between 0 and 1, got %v", o.SampleRate)
+	}
+	if o.ServiceName == "" {
+		o.ServiceName = DefaultServiceName
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = DefaultBatchSize
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = DefaultQueueSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = DefaultFlushInterval
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: DefaultExportTimeout}
+	}
+	if o.TimeProvider == nil {
+		o.TimeProvider = &timetools.RealTime{}
+	}
+	return &Tracer{
+		options: o,
+		queue:   make(chan *Span, o.QueueSize),
+		stopC:   make(chan struct{}),
+	}, nil
+}
+
+func (t *Tracer) String() string {
+	return fmt.Sprintf("tracer(endpoint=%v, sampleRate=%v)", t.options.Endpoint, t.options.SampleRate)
+}
+
+func (t *Tracer) Start() {
+	t.wg.Add(1)
+	go t.run()
+}
+
+// Stop exports the spans ended so far and stops the export
+func (t *Tracer) Stop() {
+	close(t.stopC)
+	t.wg.Wait()
+}
+
+// StartSpan starts the server span of the request, the span continues the trace of the caller if the request
+// has the traceparent header. The returned request carries the span in its context and the traceparent of the span,
+// so the upstream sees vulcand as the parent.
+func (t *Tracer) StartSpan(req *http.Request, name string) (*Span, *http.Request) {
+	s := &Span{
+		tracer: t,
+		name:   name,
+		start:  t.options.TimeProvider.UtcNow(),
+	}
+	if parent, ok := ParseTraceparent(req.Header.Get(TraceparentHeader)); ok {
+		s.ctx.TraceID = parent.TraceID
+		s.ctx.Sampled = parent.Sampled
+		s.parent = parent.SpanID
+	} else {
+		s.ctx.TraceID = newTraceID()
+		s.ctx.Sampled = t.options.SampleRate > 0 && rand.Float64() < t.options.SampleRate
+	}
+	s.ctx.SpanID = newSpanID()
+	req.Header.Set(TraceparentHeader, s.ctx.Traceparent())
+	return s, req.WithContext(context.WithValue(req.Context(), spanKey{}, s))
+}
+
+// export queues the span without blocking, the span is dropped if the collector can not keep up
+func (t *Tracer) export(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		if n := atomic.AddInt64(&t.dropped, 1); n%1000 == 1 {
+			log.Warningf("%v export queue is full, %d spans dropped so far", t, n)
+		}
+	}
+}
+
+func (t *Tracer) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.options.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.options.BatchSize)
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < t.options.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-t.stopC:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					t.flush(batch)
+					return
+				}
+			}
+		}
+		t.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (t *Tracer) flush(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	data, err := json.Marshal(newExportRequest(t.options.ServiceName, batch))
+	if err != nil {
+		log.Errorf("%v failed to encode %d spans: %v", t, len(batch), err)
+		return
+	}
+	re, err := t.options.Client.Post(t.options.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Warningf("%v failed to export %d spans: %v", t, len(batch), err)
+		return
+	}
+	re.Body.Close()
+	if re.StatusCode/100 != 2 {
+		log.Warningf("%v failed to export %d spans: collector responded with %v", t, len(batch), re.Status)
+	}
+}
@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func TestTracing(t *testing.T) { TestingT(t) }
+
+type TracingSuite struct {
+}
+
+var _ = Suite(&TracingSuite{})
+
+func (s *TracingSuite) TestParseTraceparent(c *C) {
+	sc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.Assert(ok, Equals, true)
+	c.Assert(sc.TraceID.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(sc.SpanID.String(), Equals, "00f067aa0ba902b7")
+	c.Assert(sc.Sampled, Equals, true)
+	c.Assert(sc.Traceparent(), Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	sc, ok = ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	c.Assert(ok, Equals, true)
+	c.Assert(sc.Sampled, Equals, false)
+
+	// future versions may add fields
+	_, ok = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra")
+	c.Assert(ok, Equals, true)
+
+	bad := []string{
+		"",
+		"garbage",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, v := range bad {
+		_, ok := ParseTraceparent(v)
+		c.Assert(ok, Equals, false, Commentf("%v", v))
+	}
+}
+
+func (s *TracingSuite) TestNewBadOptions(c *C) {
+	bad := []Options{
+		{Endpoint: ""},
+		{Endpoint: "localhost:4318"},
+		{Endpoint: "http://localhost:4318/v1/traces", SampleRate: -1},
+		{Endpoint: "http://localhost:4318/v1/traces", SampleRate: 1.5},
+	}
+	for _, o := range bad {
+		_, err := New(o)
+		c.Assert(err, NotNil, Commentf("%#v", o))
+	}
+}
+
+func (s *TracingSuite) TestStartSpan(c *C) {
+	t, err := New(Options{Endpoint: "http://localhost:4318/v1/traces", SampleRate: 0})
+	c.Assert(err, IsNil)
+
+	// the trace of the caller is continued with its sampling decision
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span, req := t.StartSpan(req, "GET")
+	c.Assert(SpanFromContext(req.Context()), Equals, span)
+	c.Assert(span.Context().TraceID.String(), Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(span.Context().SpanID.String(), Not(Equals), "00f067aa0ba902b7")
+	c.Assert(span.Context().Sampled, Equals, true)
+	c.Assert(req.Header.Get(TraceparentHeader), Equals, span.Context().Traceparent())
+
+	// new traces are sampled by the rate
+	req, _ = http.NewRequest("GET", "http://localhost/", nil)
+	span, req = t.StartSpan(req, "GET")
+	c.Assert(span.Context().Sampled, Equals, false)
+	c.Assert(req.Header.Get(TraceparentHeader), Equals, span.Context().Traceparent())
+}
+
+func (s *TracingSuite) TestExport(c *C) {
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		bodies <- data
+	}))
+	defer collector.Close()
+
+	t, err := New(Options{Endpoint: collector.URL, SampleRate: 1, FlushInterval: time.Hour})
+	c.Assert(err, IsNil)
+	t.Start()
+
+	req, _ := http.NewRequest("GET", "http://localhost/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	span, _ := t.StartSpan(req, "GET f1")
+	span.SetAttribute("vulcand.frontend", "f1")
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetStatus(StatusError)
+	span.End()
+	span.End()
+
+	// unsampled spans are not exported
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	span, _ = t.StartSpan(req, "GET f1")
+	span.End()
+
+	// spans ended before the stop are flushed
+	t.Stop()
+
+	var re exportRequest
+	select {
+	case data := <-bodies:
+		c.Assert(json.Unmarshal(data, &re), IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("spans were not exported")
+	}
+	c.Assert(re.ResourceSpans, HasLen, 1)
+	c.Assert(*re.ResourceSpans[0].Resource.Attributes[0].Value.StringValue, Equals, DefaultServiceName)
+	spans := re.ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, HasLen, 1)
+	c.Assert(spans[0].TraceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(spans[0].ParentSpanID, Equals, "00f067aa0ba902b7")
+	c.Assert(spans[0].Name, Equals, "GET f1")
+	c.Assert(spans[0].Kind, Equals, spanKindServer)
+	c.Assert(spans[0].Status.Code, Equals, StatusError)
+	c.Assert(spans[0].Attributes, HasLen, 2)
+	c.Assert(*spans[0].Attributes[0].Value.StringValue, Equals, "f1")
+	c.Assert(*spans[0].Attributes[1].Value.IntValue, Equals, "502")
+}
@@ -0,0 +1,312 @@
+// Package dnssrv looks up DNS SRV records together with their TTLs, which the standard resolver does not report.
+package dnssrv
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	typeSRV   = 33
+	classINET = 1
+
+	headerLen = 12
+	// maxPointers limits compression pointers followed in a single name, so looped pointers can not hang the parser
+	maxPointers = 16
+
+	rcodeNameError = 3
+)
+
+// DefaultTimeout is the time a single name server has to answer
+const DefaultTimeout = 5 * time.Second
+
+// Resolver queries the name servers directly
+type Resolver struct {
+	// Servers are the name server addresses in host:port format, the name servers of /etc/resolv.conf are used if empty
+	Servers []string
+	// Timeout of the query to a single name server, DefaultTimeout is used if zero
+	Timeout time.Duration
+}
+
+// Lookup resolves the SRV records with the system name servers
+func Lookup(name string) ([]*net.SRV, time.Duration, error) {
+	return (&Resolver{}).Lookup(name)
+}
+
+// Lookup returns the SRV records of the name sorted by priority and the smallest TTL of the records.
+// Name servers are tried in order until one of them answers.
+func (r *Resolver) Lookup(name string) ([]*net.SRV, time.Duration, error) {
+	servers := r.Servers
+	if len(servers) == 0 {
+		servers = systemServers()
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	var lastErr error
+	for _, server := range servers {
+		records, ttl, err := query(server, name, timeout)
+		if err == nil {
+			return records, ttl, nil
+		}
+		if _, ok := err.(*NotFoundError); ok {
+			return nil, 0, err
+		}
+		lastErr = err
+	}
+	return nil, 0, fmt.Errorf("failed to look up SRV records of %v: %v", name, lastErr)
+}
+
+// NotFoundError is returned when the name does not exist
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("SRV records of %v not found", e.Name)
+}
+
+// systemServers reads the name servers from /etc/resolv.conf, falls back to the local name server
+func systemServers() []string {
+	var servers []string
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				servers = append(servers, net.JoinHostPort(fields[1], "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+func query(server, name string, timeout time.Duration) ([]*net.SRV, time.Duration, error) {
+	// the unpredictable id keeps the off-path answers from being accepted
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	q, err := newQuery(id, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	answer, err := exchangeUDP(server, q, timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	if truncated(answer) {
+		// the records did not fit the datagram, TCP has no size limit
+		if answer, err = exchangeTCP(server, q, timeout); err != nil {
+			return nil, 0, err
+		}
+	}
+	return parseAnswer(id, name, answer)
+}
+
+func exchangeUDP(server string, q []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func exchangeTCP(server string, q []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// newQuery builds a recursive query of the SRV records of the name
+func newQuery(id uint16, name string) ([]byte, error) {
+	q := make([]byte, headerLen, headerLen+len(name)+6)
+	binary.BigEndian.PutUint16(q[0:], id)
+	// recursion desired
+	binary.BigEndian.PutUint16(q[2:], 1<<8)
+	// one question
+	binary.BigEndian.PutUint16(q[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name '%v'", name)
+		}
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, 0, typeSRV, 0, classINET)
+	return q, nil
+}
+
+func truncated(msg []byte) bool {
+	return len(msg) >= headerLen && msg[2]&0x02 != 0
+}
+
+var errShort = errors.New("short DNS message")
+
+func parseAnswer(id uint16, name string, msg []byte) ([]*net.SRV, time.Duration, error) {
+	if len(msg) < headerLen {
+		return nil, 0, errShort
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id || msg[2]&0x80 == 0 {
+		return nil, 0, fmt.Errorf("DNS answer id does not match the query")
+	}
+	switch rcode := msg[3] & 0x0f; rcode {
+	case 0:
+	case rcodeNameError:
+		return nil, 0, &NotFoundError{Name: name}
+	default:
+		return nil, 0, fmt.Errorf("DNS server failed with code %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+
+	// the answer should repeat the question of the query
+	if questions != 1 {
+		return nil, 0, fmt.Errorf("DNS answer has %d questions, expected 1", questions)
+	}
+	qname, off, err := readName(msg, headerLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off+4 > len(msg) {
+		return nil, 0, errShort
+	}
+	if !strings.EqualFold(qname, strings.TrimSuffix(name, ".")+".") ||
+		binary.BigEndian.Uint16(msg[off:]) != typeSRV || binary.BigEndian.Uint16(msg[off+2:]) != classINET {
+		return nil, 0, fmt.Errorf("DNS answer question does not match the query of %v", name)
+	}
+	off += 4
+
+	var records []*net.SRV
+	var ttl time.Duration
+	for i := 0; i < answers; i++ {
+		if _, off, err = readName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errShort
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		rttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, 0, errShort
+		}
+		data := off
+		off += length
+		// CNAME records leading to the SRV records are skipped
+		if rtype != typeSRV || class != classINET {
+			continue
+		}
+		if length < 7 {
+			return nil, 0, errShort
+		}
+		target, _, err := readName(msg, data+6)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, &net.SRV{
+			Priority: binary.BigEndian.Uint16(msg[data:]),
+			Weight:   binary.BigEndian.Uint16(msg[data+2:]),
+			Port:     binary.BigEndian.Uint16(msg[data+4:]),
+			Target:   target,
+		})
+		if len(records) == 1 || rttl < ttl {
+			ttl = rttl
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, &NotFoundError{Name: name}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+	return records, ttl, nil
+}
+
+// readName reads the possibly compressed name at the offset, returns the name with the trailing dot
+// and the offset past the name
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errShort
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			off++
+			if next == -1 {
+				next = off
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errShort
+			}
+			if pointers++; pointers > maxPointers {
+				return "", 0, fmt.Errorf("too many compression pointers in DNS name")
+			}
+			if next == -1 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported DNS label type %x", length&0xc0)
+		default:
+			off++
+			if off+length > len(msg) {
+				return "", 0, errShort
+			}
+			labels = append(labels, string(msg[off:off+length]))
+			off += length
+		}
+	}
+}
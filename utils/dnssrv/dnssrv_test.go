@@ -0,0 +1,153 @@
+package dnssrv
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve answers every query with the records built by the answer function
+func serve(t *testing.T, answer func(q []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(answer(buf[:n]), addr)
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().String()
+}
+
+// reply copies the query header and question and appends SRV answers of the queried name
+func reply(q []byte, rcode byte, records []*net.SRV, ttls []uint32) []byte {
+	msg := append([]byte{}, q...)
+	msg[2] |= 0x80
+	msg[3] = rcode
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(records)))
+	for i, r := range records {
+		// name is a pointer to the question
+		msg = append(msg, 0xc0, headerLen, 0, typeSRV, 0, classINET)
+		msg = binary.BigEndian.AppendUint32(msg, ttls[i])
+		target := []byte{}
+		for _, label := range []string{r.Target[:len(r.Target)-len(".example.com.")], "example", "com"} {
+			target = append(append(target, byte(len(label))), label...)
+		}
+		target = append(target, 0)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(6+len(target)))
+		msg = binary.BigEndian.AppendUint16(msg, r.Priority)
+		msg = binary.BigEndian.AppendUint16(msg, r.Weight)
+		msg = binary.BigEndian.AppendUint16(msg, r.Port)
+		msg = append(msg, target...)
+	}
+	return msg
+}
+
+func TestLookup(t *testing.T) {
+	records := []*net.SRV{
+		{Target: "b.example.com.", Port: 8001, Priority: 20, Weight: 1},
+		{Target: "a.example.com.", Port: 8000, Priority: 10, Weight: 5},
+	}
+	addr := serve(t, func(q []byte) []byte {
+		return reply(q, 0, records, []uint32{60, 30})
+	})
+
+	r := &Resolver{Servers: []string{addr}, Timeout: time.Second}
+	out, ttl, err := r.Lookup("_http._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != 30*time.Second {
+		t.Errorf("expected TTL 30s, got %v", ttl)
+	}
+	if len(out) != 2 || *out[0] != *records[1] || *out[1] != *records[0] {
+		t.Errorf("unexpected records %v %v", out[0], out[1])
+	}
+}
+
+func TestLookupNotFound(t *testing.T) {
+	addr := serve(t, func(q []byte) []byte {
+		return reply(q, rcodeNameError, nil, nil)
+	})
+	r := &Resolver{Servers: []string{addr}, Timeout: time.Second}
+	if _, _, err := r.Lookup("_http._tcp.example.com"); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*NotFoundError); !ok {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+func TestLookupFailover(t *testing.T) {
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	records := []*net.SRV{{Target: "a.example.com.", Port: 8000}}
+	addr := serve(t, func(q []byte) []byte {
+		return reply(q, 0, records, []uint32{10})
+	})
+	r := &Resolver{Servers: []string{deadAddr, addr}, Timeout: 200 * time.Millisecond}
+	out, _, err := r.Lookup("_http._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Target != "a.example.com." {
+		t.Errorf("unexpected records %v", out)
+	}
+}
+
+func TestBadAnswers(t *testing.T) {
+	q, err := newQuery(1, "_http._tcp.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := reply(q, 0, []*net.SRV{{Target: "a.example.com.", Port: 8000}}, []uint32{10})
+	looped := append([]byte{}, q...)
+	looped[headerLen] = 0xc0
+	looped[headerLen+1] = headerLen
+
+	for i, msg := range [][]byte{
+		nil,
+		good[:len(good)-3],
+		reply(q, 2, nil, nil),
+		looped,
+	} {
+		if _, _, err := parseAnswer(1, "_http._tcp.example.com", msg); err == nil {
+			t.Errorf("%d: expected error", i)
+		}
+	}
+	if _, _, err := parseAnswer(2, "_http._tcp.example.com", good); err == nil {
+		t.Error("expected id mismatch error")
+	}
+	// the answers to the other questions are not accepted
+	if _, _, err := parseAnswer(1, "_http._tcp.other.com", good); err == nil {
+		t.Error("expected question name mismatch error")
+	}
+	if _, _, err := parseAnswer(1, "_HTTP._tcp.example.com.", good); err != nil {
+		t.Errorf("expected the name to match regardless of the case, got %v", err)
+	}
+	otherType := append([]byte{}, good...)
+	otherType[len(q)-3] = 1
+	if _, _, err := parseAnswer(1, "_http._tcp.example.com", otherType); err == nil {
+		t.Error("expected question type mismatch error")
+	}
+	query := append([]byte{}, good...)
+	query[2] &^= 0x80
+	if _, _, err := parseAnswer(1, "_http._tcp.example.com", query); err == nil {
+		t.Error("expected the query to be rejected as the answer")
+	}
+	if _, err := newQuery(1, "example..com"); err == nil {
+		t.Error("expected bad name error")
+	}
+}
@@ -1,6 +1,9 @@
 package command
 
 import (
+	"fmt"
+	"io/ioutil"
+
 	"github.com/codegangsta/cli"
 	"github.com/vulcand/vulcand/engine"
 )
@@ -14,10 +17,11 @@ func NewBackendCommand(cmd *Command) cli.Command {
 				Name:   "upsert",
 				Usage:  "Update or insert a new backend to vulcan",
 				Action: cmd.upsertBackendAction,
-				Flags: append(append([]cli.Flag{
+				Flags: append(append(append([]cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "backend id"}},
 					backendOptions()...),
 					getTLSFlags()...),
+					healthCheckOptions()...),
 			},
 			{
 				Name:   "rm",
@@ -40,6 +44,14 @@ func NewBackendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "backend id"},
 				},
 			},
+			{
+				Name:   "health",
+				Usage:  "Show health state of the backend servers",
+				Action: cmd.printBackendHealthAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "backend id"},
+				},
+			},
 		},
 	}
 }
@@ -79,6 +91,15 @@ func (cmd *Command) printBackendAction(c *cli.Context) error {
 	return nil
 }
 
+func (cmd *Command) printBackendHealthAction(c *cli.Context) error {
+	out, err := cmd.client.GetBackendHealth(engine.BackendKey{Id: c.String("id")})
+	if err != nil {
+		return err
+	}
+	cmd.printServersHealth(out)
+	return nil
+}
+
 func (cmd *Command) listBackendsAction(c *cli.Context) error {
 	out, err := cmd.client.GetBackends()
 	if err != nil {
@@ -89,32 +110,236 @@ func (cmd *Command) listBackendsAction(c *cli.Context) error {
 }
 
 func getBackendSettings(c *cli.Context) (engine.HTTPBackendSettings, error) {
-	s := engine.HTTPBackendSettings{}
+	s := engine.HTTPBackendSettings{Protocol: c.String("protocol")}
 
 	s.Timeouts.Read = c.Duration("readTimeout").String()
 	s.Timeouts.Dial = c.Duration("dialTimeout").String()
 	s.Timeouts.TLSHandshake = c.Duration("handshakeTimeout").String()
+	if d := c.Duration("drainTimeout"); d != 0 {
+		s.Timeouts.Drain = d.String()
+	}
+	if d := c.Duration("responseHeaderTimeout"); d != 0 {
+		s.Timeouts.ResponseHeader = d.String()
+	}
+	if d := c.Duration("bodyIdleTimeout"); d != 0 {
+		s.Timeouts.BodyIdle = d.String()
+	}
 
 	s.KeepAlive.Period = c.Duration("keepAlivePeriod").String()
 	s.KeepAlive.MaxIdleConnsPerHost = c.Int("maxIdleConns")
+	s.KeepAlive.MaxConnsPerHost = c.Int("maxConns")
 
 	tlsSettings, err := getTLSSettings(c)
 	if err != nil {
 		return s, err
 	}
+	if err := getUpstreamTLSSettings(c, tlsSettings); err != nil {
+		return s, err
+	}
 	s.TLS = tlsSettings
+
+	hc, err := getHealthCheck(c)
+	if err != nil {
+		return s, err
+	}
+	s.HealthCheck = hc
+
+	od, err := getOutlierDetection(c)
+	if err != nil {
+		return s, err
+	}
+	s.OutlierDetection = od
+
+	d, err := getDiscovery(c)
+	if err != nil {
+		return s, err
+	}
+	s.Discovery = d
+
+	if v := c.Duration("slowStart"); v != 0 {
+		s.SlowStart = &engine.SlowStart{Duration: v.String()}
+	}
+
+	sticky, err := getStickySession(c)
+	if err != nil {
+		return s, err
+	}
+	s.StickySession = sticky
+
+	if c.String("lb") != "" || c.String("lbHashKey") != "" || c.Float64("lbLoadFactor") != 0 {
+		s.LoadBalancer = &engine.LoadBalancer{
+			Algorithm:  c.String("lb"),
+			HashKey:    c.String("lbHashKey"),
+			LoadFactor: c.Float64("lbLoadFactor"),
+		}
+	}
 	return s, nil
 }
 
+func getStickySession(c *cli.Context) (*engine.StickySession, error) {
+	if !c.Bool("sticky") && c.String("stickyCookie") == "" {
+		return nil, nil
+	}
+	ss := &engine.StickySession{
+		CookieName: c.String("stickyCookie"),
+		Secure:     c.Bool("stickySecure"),
+		HTTPOnly:   c.Bool("stickyHTTPOnly"),
+	}
+	if d := c.Duration("stickyTTL"); d != 0 {
+		ss.TTL = d.String()
+	}
+	if _, err := ss.Settings(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+func getHealthCheck(c *cli.Context) (*engine.HealthCheck, error) {
+	if c.String("hcPath") == "" && c.Duration("hcInterval") == 0 {
+		return nil, nil
+	}
+	hc := &engine.HealthCheck{
+		Path:               c.String("hcPath"),
+		HealthyThreshold:   c.Int("hcHealthy"),
+		UnhealthyThreshold: c.Int("hcUnhealthy"),
+		ExpectedCodes:      c.IntSlice("hcCodes"),
+		ExpectBody:         c.String("hcBody"),
+		ExpectJSONPath:     c.String("hcJSONPath"),
+		ExpectJSONValue:    c.String("hcJSONValue"),
+	}
+	if d := c.Duration("hcInterval"); d != 0 {
+		hc.Interval = d.String()
+	}
+	if d := c.Duration("hcTimeout"); d != 0 {
+		hc.Timeout = d.String()
+	}
+	if _, err := hc.Settings(); err != nil {
+		return nil, err
+	}
+	return hc, nil
+}
+
+func getOutlierDetection(c *cli.Context) (*engine.OutlierDetection, error) {
+	if c.Int("odErrors") == 0 && c.Duration("odBaseEjection") == 0 {
+		return nil, nil
+	}
+	od := &engine.OutlierDetection{
+		ConsecutiveErrors: c.Int("odErrors"),
+	}
+	if d := c.Duration("odBaseEjection"); d != 0 {
+		od.BaseEjectionTime = d.String()
+	}
+	if d := c.Duration("odMaxEjection"); d != 0 {
+		od.MaxEjectionTime = d.String()
+	}
+	if _, err := od.Settings(); err != nil {
+		return nil, err
+	}
+	return od, nil
+}
+
+func getDiscovery(c *cli.Context) (*engine.ServerDiscovery, error) {
+	if c.String("srv") == "" {
+		return nil, nil
+	}
+	d := &engine.ServerDiscovery{
+		SRV:    c.String("srv"),
+		Scheme: c.String("srvScheme"),
+	}
+	if v := c.Duration("srvMinRefresh"); v != 0 {
+		d.MinRefresh = v.String()
+	}
+	if v := c.Duration("srvMaxRefresh"); v != 0 {
+		d.MaxRefresh = v.String()
+	}
+	if _, err := d.Settings(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// getUpstreamTLSSettings reads the CA bundle and the client key pair verifying and authenticating the backend servers
+func getUpstreamTLSSettings(c *cli.Context, s *engine.TLSSettings) error {
+	if path := c.String("tlsCA"); path != "" {
+		ca, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %s", err)
+		}
+		s.CA = ca
+	}
+	if c.String("tlsCert") != "" || c.String("tlsKey") != "" {
+		keyPair, err := readKeyPair(c.String("tlsCert"), c.String("tlsKey"))
+		if err != nil {
+			return fmt.Errorf("failed to read client key pair: %s", err)
+		}
+		s.ClientKeyPair = keyPair
+	}
+	s.ServerName = c.String("tlsServerName")
+	_, err := engine.NewTLSConfig(s)
+	return err
+}
+
 func backendOptions() []cli.Flag {
 	return []cli.Flag{
+		cli.StringFlag{Name: "protocol", Usage: "protocol to talk to the servers, 'http/1.1' or 'h2c' for HTTP/2 cleartext, e.g. gRPC"},
+
 		// Timeouts
 		cli.DurationFlag{Name: "readTimeout", Usage: "read timeout"},
 		cli.DurationFlag{Name: "dialTimeout", Usage: "dial timeout"},
 		cli.DurationFlag{Name: "handshakeTimeout", Usage: "TLS handshake timeout"},
+		cli.DurationFlag{Name: "drainTimeout", Usage: "time the deleted servers are given to finish the requests in flight, 30s by default"},
+		cli.DurationFlag{Name: "responseHeaderTimeout", Usage: "time to the first byte of the response, the read timeout if not set"},
+		cli.DurationFlag{Name: "bodyIdleTimeout", Usage: "cancel the responses with no bytes of the body received for this long, no limit by default"},
+
+		// TLS to the servers
+		cli.StringFlag{Name: "tlsCA", Usage: "path to the PEM bundle of the CAs verifying the server certificates, system roots by default"},
+		cli.StringFlag{Name: "tlsCert", Usage: "path to the client certificate presented to the servers"},
+		cli.StringFlag{Name: "tlsKey", Usage: "path to the private key of the client certificate"},
+		cli.StringFlag{Name: "tlsServerName", Usage: "server name sent in SNI and verified, the host of the server URL by default"},
 
 		// Keep-alive parameters
 		cli.StringFlag{Name: "keepAlivePeriod", Usage: "keep-alive period"},
 		cli.IntFlag{Name: "maxIdleConns", Usage: "maximum idle connections per host"},
+		cli.IntFlag{Name: "maxConns", Usage: "maximum connections per host of the HTTP/1.1 backends, requests over the limit wait up to the dial timeout"},
+
+		// Sticky sessions
+		cli.BoolFlag{Name: "sticky", Usage: "pins clients to the servers with the affinity cookie"},
+		cli.StringFlag{Name: "stickyCookie", Usage: "affinity cookie name, enables sticky sessions"},
+		cli.DurationFlag{Name: "stickyTTL", Usage: "affinity cookie TTL, the cookie lasts for the browser session by default"},
+		cli.BoolFlag{Name: "stickySecure", Usage: "sends the affinity cookie over HTTPS only"},
+		cli.BoolFlag{Name: "stickyHTTPOnly", Usage: "hides the affinity cookie from the client scripts"},
+	}
+}
+
+func healthCheckOptions() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{Name: "hcPath", Usage: "health check path, enables active health checks"},
+		cli.DurationFlag{Name: "hcInterval", Usage: "interval between health checks, enables active health checks"},
+		cli.DurationFlag{Name: "hcTimeout", Usage: "health check request timeout"},
+		cli.IntFlag{Name: "hcHealthy", Usage: "consecutive successful checks to mark server healthy"},
+		cli.IntFlag{Name: "hcUnhealthy", Usage: "consecutive failed checks to mark server unhealthy"},
+		cli.IntSliceFlag{Name: "hcCodes", Usage: "status codes considered healthy, any 2xx by default", Value: &cli.IntSlice{}},
+		cli.StringFlag{Name: "hcBody", Usage: "substring the health check response body should contain"},
+		cli.StringFlag{Name: "hcJSONPath", Usage: "dot separated path of the health check response JSON field, e.g. 'status'"},
+		cli.StringFlag{Name: "hcJSONValue", Usage: "expected value of the health check response JSON field, e.g. 'ok'"},
+
+		// Outlier detection
+		cli.IntFlag{Name: "odErrors", Usage: "consecutive 5xx or network errors to eject server, enables outlier detection"},
+		cli.DurationFlag{Name: "odBaseEjection", Usage: "base server ejection time, enables outlier detection"},
+		cli.DurationFlag{Name: "odMaxEjection", Usage: "max server ejection time"},
+
+		// Server discovery
+		cli.StringFlag{Name: "srv", Usage: "DNS SRV name to resolve the servers from, e.g. _http._tcp.example.com"},
+		cli.StringFlag{Name: "srvScheme", Usage: "scheme of the discovered server URLs, 'http' or 'https'"},
+		cli.DurationFlag{Name: "srvMinRefresh", Usage: "shortest interval between SRV lookups, also the retry interval of failed lookups"},
+		cli.DurationFlag{Name: "srvMaxRefresh", Usage: "longest interval between SRV lookups"},
+
+		// Slow start
+		cli.DurationFlag{Name: "slowStart", Usage: "ramp up the traffic to the added and recovered servers over this duration, at least 1s"},
+
+		// Load balancing
+		cli.StringFlag{Name: "lb", Usage: "load balancing algorithm, 'roundrobin', 'leastconn', 'random' or 'hash'"},
+		cli.StringFlag{Name: "lbHashKey", Usage: "hash key of the 'hash' algorithm, 'ip', 'header:<name>', 'path', 'path:<segments>' or 'url'"},
+		cli.Float64Flag{Name: "lbLoadFactor", Usage: "load bound of the 'hash' algorithm, e.g. 1.25, the servers take at most this many times their share of the requests in flight"},
 	}
 }
@@ -35,6 +35,8 @@ func (cmd *Command) Run(args []string) error {
 	}
 	cmd.vulcanUrl = url
 	cmd.client = api.NewClient(cmd.vulcanUrl, cmd.registry)
+	cmd.client.Token = os.Getenv(apiTokenEnv)
+	cmd.client.Namespace = os.Getenv(namespaceEnv)
 
 	app := cli.NewApp()
 	app.Name = "vctl"
@@ -43,6 +45,7 @@ func (cmd *Command) Run(args []string) error {
 
 	app.Commands = []cli.Command{
 		NewLogCommand(cmd),
+		NewTimeoutsCommand(cmd),
 		NewKeyCommand(cmd),
 		NewTopCommand(cmd),
 		NewHostCommand(cmd),
@@ -79,6 +82,12 @@ func cut(i, j int, args []string) []string {
 	return append(s, args[j:]...)
 }
 
+// apiTokenEnv is the environment variable with the bearer token sent to the API
+const apiTokenEnv = "VULCAND_API_TOKEN"
+
+// namespaceEnv is the environment variable with the namespace the commands are scoped to
+const namespaceEnv = "VULCAND_NAMESPACE"
+
 func flags() []cli.Flag {
 	return []cli.Flag{
 		cli.StringFlag{Name: "vulcan", Value: "http://localhost:8182", Usage: "Url for vulcan server"},
@@ -115,3 +124,18 @@ func readBox(key string) (*secret.Box, error) {
 	}
 	return secret.NewBox(keyB)
 }
+
+// listPageLimit is the size of the pages the listings are read in when the limit is omitted
+const listPageLimit = 500
+
+// isPaged returns true if the listing is asked for the ids with the prefix or for a page of them
+func isPaged(c *cli.Context) bool {
+	return c.String("prefix") != "" || c.Int("limit") > 0 || c.String("cursor") != ""
+}
+
+func pageLimit(c *cli.Context) int {
+	if l := c.Int("limit"); l > 0 {
+		return l
+	}
+	return listPageLimit
+}
@@ -49,7 +49,7 @@ func (s *CmdSuite) SetUpTest(c *C) {
 	s.sup = sv
 
 	router := mux.NewRouter()
-	api.InitProxyController(s.ng, sv, router)
+	api.InitProxyController(s.ng, sv, router, nil, nil, nil, nil)
 	s.testServer = httptest.NewServer(router)
 
 	s.out = &bytes.Buffer{}
@@ -118,6 +118,11 @@ func (s *CmdSuite) TestLogSeverity(c *C) {
 	}
 }
 
+func (s *CmdSuite) TestServerTimeouts(c *C) {
+	c.Assert(s.run("timeouts", "set", "-read", "5s", "-idle", "9s"), Matches, ".*updated.*")
+	c.Assert(s.run("timeouts", "show"), Matches, ".*read=5s, write=0s, idle=9s.*")
+}
+
 func (s *CmdSuite) TestListenerCRUD(c *C) {
 	host := "host"
 	c.Assert(s.run("host", "upsert", "-name", host), Matches, OK)
@@ -12,9 +12,13 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 		Usage: "Operations with vulcan frontends",
 		Subcommands: []cli.Command{
 			{
-				Name:   "ls",
-				Usage:  "List all frontends",
-				Flags:  []cli.Flag{},
+				Name:  "ls",
+				Usage: "List all frontends",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "prefix", Usage: "list the frontends with the ids starting with the prefix"},
+					cli.IntFlag{Name: "limit", Usage: "list a page of up to limit frontends, all the pages if omitted"},
+					cli.StringFlag{Name: "cursor", Usage: "cursor of the page to list, printed with the previous page"},
+				},
 				Action: cmd.printFrontendsAction,
 			},
 			{
@@ -33,6 +37,11 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "route", Usage: "roue, will be matched against request's path"},
 					cli.DurationFlag{Name: "ttl", Usage: "time to live duration, persistent if omitted"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+					cli.StringFlag{Name: "type", Value: engine.HTTP, Usage: "frontend type, either http or tcp"},
+					cli.StringFlag{Name: "listener", Usage: "TCP frontend: id of the TCP listener the connections are taken from"},
+					cli.StringSliceFlag{Name: "serverName", Value: &cli.StringSlice{}, Usage: "TCP frontend: TLS server name the connections are matched by, e.g. db.example.com or *.example.com"},
+					cli.DurationFlag{Name: "dialTimeout", Usage: "TCP frontend: timeout connecting to the backend server"},
+					cli.DurationFlag{Name: "tcpIdleTimeout", Usage: "TCP frontend: close the connections idle for longer than this"},
 				}, frontendOptions()...),
 				Action: cmd.upsertFrontendAction,
 			},
@@ -44,16 +53,42 @@ func NewFrontendCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "id"},
 				},
 			},
+			{
+				Name:   "purge-cache",
+				Usage:  "Drop the cached responses of a frontend kept by the vulcand instance serving the API",
+				Action: cmd.purgeCacheAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "id"},
+					cli.StringFlag{Name: "prefix", Usage: "drop the responses of the paths starting with the prefix, all if omitted"},
+				},
+			},
 		},
 	}
 }
 
 func (cmd *Command) printFrontendsAction(c *cli.Context) error {
-	fs, err := cmd.client.GetFrontends()
-	if err != nil {
-		return err
+	if !isPaged(c) {
+		fs, err := cmd.client.GetFrontends()
+		if err != nil {
+			return err
+		}
+		cmd.printFrontends(fs)
+		return nil
+	}
+	var out []engine.Frontend
+	cursor := c.String("cursor")
+	for {
+		fs, next, err := cmd.client.GetFrontendsPage(c.String("prefix"), cursor, pageLimit(c))
+		if err != nil {
+			return err
+		}
+		out, cursor = append(out, fs...), next
+		if cursor == "" || c.Int("limit") > 0 {
+			break
+		}
 	}
-	cmd.printFrontends(fs)
+	cmd.printFrontends(out)
+	cmd.printNextPage(cursor)
 	return nil
 }
 
@@ -73,11 +108,17 @@ func (cmd *Command) printFrontendAction(c *cli.Context) error {
 }
 
 func (cmd *Command) upsertFrontendAction(c *cli.Context) error {
-	settings, err := getFrontendSettings(c)
-	if err != nil {
-		return err
+	var f *engine.Frontend
+	var err error
+	if c.String("type") == engine.TCP {
+		f, err = engine.NewTCPFrontend(c.String("id"), c.String("b"), getTCPFrontendSettings(c))
+	} else {
+		var settings engine.HTTPFrontendSettings
+		if settings, err = getFrontendSettings(c); err != nil {
+			return err
+		}
+		f, err = engine.NewHTTPFrontend(route.NewMux(), c.String("id"), c.String("b"), c.String("route"), settings)
 	}
-	f, err := engine.NewHTTPFrontend(route.NewMux(), c.String("id"), c.String("b"), c.String("route"), settings)
 	if err != nil {
 		return err
 	}
@@ -97,16 +138,149 @@ func (cmd *Command) deleteFrontendAction(c *cli.Context) error {
 	return nil
 }
 
+func (cmd *Command) purgeCacheAction(c *cli.Context) error {
+	purged, err := cmd.client.PurgeCache(engine.FrontendKey{Id: c.String("id")}, c.String("prefix"))
+	if err != nil {
+		return err
+	}
+	cmd.printOk("%d cached responses purged", purged)
+	return nil
+}
+
+func getTCPFrontendSettings(c *cli.Context) engine.TCPFrontendSettings {
+	s := engine.TCPFrontendSettings{ListenerId: c.String("listener"), ServerNames: c.StringSlice("serverName")}
+	if d := c.Duration("dialTimeout"); d != 0 {
+		s.DialTimeout = d.String()
+	}
+	if d := c.Duration("tcpIdleTimeout"); d != 0 {
+		s.IdleTimeout = d.String()
+	}
+	return s
+}
+
 func getFrontendSettings(c *cli.Context) (engine.HTTPFrontendSettings, error) {
 	s := engine.HTTPFrontendSettings{}
 
 	s.Limits.MaxMemBodyBytes = int64(c.Int("maxMemBodyKB") * 1024)
 	s.Limits.MaxBodyBytes = int64(c.Int("maxBodyKB") * 1024)
+	s.MaxRequestBodyBytes = int64(c.Int("maxRequestBodyKB") * 1024)
 
 	s.FailoverPredicate = c.String("failoverPredicate")
 	s.Hostname = c.String("forwardHost")
 	s.TrustForwardHeader = c.Bool("trustForwardHeader")
 	s.PassHostHeader = c.Bool("passHostHeader")
+	s.DisableAccessLog = c.Bool("disableAccessLog")
+	s.DisableSecurityHeaders = c.Bool("disableSecurityHeaders")
+	if d := c.Duration("upgradeIdleTimeout"); d != 0 {
+		s.UpgradeIdleTimeout = d.String()
+	}
+	if d := c.Duration("forwardTimeout"); d != 0 {
+		s.ForwardTimeout = d.String()
+	}
+	s.MaxInFlight = int64(c.Int("maxInFlight"))
+	s.AllowedMethods = c.StringSlice("allowedMethod")
+	s.AllowedContentTypes = c.StringSlice("allowedContentType")
+	if d := c.Duration("maxInFlightWait"); d != 0 {
+		s.MaxInFlightWait = d.String()
+	}
+
+	s.Maintenance = c.Bool("maintenance")
+	s.MaintenanceBody = c.String("maintenanceBody")
+	s.MaintenanceContentType = c.String("maintenanceType")
+
+	if c.Int("retryAttempts") != 0 || len(c.StringSlice("retryOn")) != 0 {
+		s.Retry = &engine.HTTPFrontendRetry{
+			Attempts:     c.Int("retryAttempts"),
+			On:           c.StringSlice("retryOn"),
+			MaxBodyBytes: int64(c.Int("retryMaxBodyKB") * 1024),
+		}
+		if c.Float64("retryBudget") != 0 {
+			s.Retry.Budget = &engine.HTTPFrontendRetryBudget{
+				Ratio:      c.Float64("retryBudget"),
+				MinRetries: int64(c.Int("retryBudgetMin")),
+			}
+			if d := c.Duration("retryBudgetWindow"); d != 0 {
+				s.Retry.Budget.Window = d.String()
+			}
+		}
+		if err := s.Retry.Check(); err != nil {
+			return s, err
+		}
+	}
+
+	if c.Int("rlRequests") != 0 {
+		s.RateLimit = &engine.HTTPFrontendRateLimit{
+			Requests:       int64(c.Int("rlRequests")),
+			Burst:          int64(c.Int("rlBurst")),
+			Key:            c.String("rlKey"),
+			TrustedProxies: c.StringSlice("rlTrustedProxies"),
+			MaxKeys:        c.Int("rlMaxKeys"),
+		}
+		if err := s.RateLimit.Check(); err != nil {
+			return s, err
+		}
+	}
+
+	if c.String("cbCondition") != "" {
+		s.CircuitBreaker = &engine.HTTPFrontendCircuitBreaker{
+			Condition: c.String("cbCondition"),
+			Fallback: engine.HTTPFallbackResponse{
+				StatusCode:  c.Int("cbFallbackCode"),
+				ContentType: c.String("cbFallbackType"),
+				Body:        c.String("cbFallbackBody"),
+			},
+		}
+		if d := c.Duration("cbFallbackDuration"); d != 0 {
+			s.CircuitBreaker.FallbackDuration = d.String()
+		}
+		if d := c.Duration("cbRecoveryDuration"); d != 0 {
+			s.CircuitBreaker.RecoveryDuration = d.String()
+		}
+		if d := c.Duration("cbCheckPeriod"); d != 0 {
+			s.CircuitBreaker.CheckPeriod = d.String()
+		}
+		if _, err := s.CircuitBreaker.Settings(); err != nil {
+			return s, err
+		}
+	}
+
+	// canary settings are checked against the frontend backend once the frontend is created
+	if c.String("canaryBackend") != "" {
+		s.Canary = &engine.HTTPFrontendCanary{
+			BackendId: c.String("canaryBackend"),
+			Percent:   c.Float64("canaryPercent"),
+			Header:    c.String("canaryHeader"),
+		}
+	}
+
+	if c.String("mirrorBackend") != "" {
+		s.Mirror = &engine.HTTPFrontendMirror{
+			BackendId:    c.String("mirrorBackend"),
+			Percent:      c.Float64("mirrorPercent"),
+			MaxBodyBytes: int64(c.Int("mirrorMaxBodyKB") * 1024),
+		}
+	}
+
+	if c.Bool("requestId") || c.String("requestIdHeader") != "" || c.String("requestIdPattern") != "" {
+		s.RequestID = &engine.HTTPFrontendRequestID{
+			Header:  c.String("requestIdHeader"),
+			Pattern: c.String("requestIdPattern"),
+		}
+		if err := s.RequestID.Check(); err != nil {
+			return s, err
+		}
+	}
+
+	if c.Bool("routeHeader") || c.String("routeHeaderName") != "" || c.Bool("routeHeaderOverride") || c.Bool("noRouteHeader") {
+		s.RouteHeader = &engine.HTTPFrontendRouteHeader{
+			Header:   c.String("routeHeaderName"),
+			Override: c.Bool("routeHeaderOverride"),
+			Disabled: c.Bool("noRouteHeader"),
+		}
+		if err := s.RouteHeader.Check(); err != nil {
+			return s, err
+		}
+	}
 
 	return s, nil
 }
@@ -116,11 +290,70 @@ func frontendOptions() []cli.Flag {
 		// Frontend limits
 		cli.IntFlag{Name: "maxMemBodyKB", Usage: "maximum request size to cache in memory, in KB"},
 		cli.IntFlag{Name: "maxBodyKB", Usage: "maximum request size to allow for a frontend, in KB"},
+		cli.IntFlag{Name: "maxRequestBodyKB", Usage: "rejects requests with larger bodies with 413, streamed requests included, in KB"},
 
 		// Misc options
 		cli.StringFlag{Name: "failoverPredicate", Usage: "predicate that defines cases when failover is allowed"},
 		cli.StringFlag{Name: "forwardHost", Usage: "hostname to set when forwarding a request"},
-		cli.BoolFlag{Name: "trustForwardHeader", Usage: "allows copying X-Forwarded-For header value from the original request"},
+		cli.BoolFlag{Name: "trustForwardHeader", Usage: "trust the X-Forwarded-* headers of the original request, for the frontends behind another proxy"},
 		cli.BoolFlag{Name: "passHostHeader", Usage: "allows passing custom headers to the backend servers"},
+		cli.BoolFlag{Name: "disableAccessLog", Usage: "turns off access logging for a frontend"},
+		cli.BoolFlag{Name: "disableSecurityHeaders", Usage: "turns off the security headers of the host for a frontend"},
+		cli.DurationFlag{Name: "upgradeIdleTimeout", Usage: "closes upgraded connections, e.g. WebSockets, idle for longer than this duration"},
+		cli.DurationFlag{Name: "forwardTimeout", Usage: "time the server has to respond to the forwarded request, overrides the backend read timeout"},
+		cli.IntFlag{Name: "maxInFlight", Usage: "rejects requests over this many requests in flight with 503, unlimited by default"},
+		cli.DurationFlag{Name: "maxInFlightWait", Usage: "time the requests over the in flight limit wait for a slot, they are rejected right away by default"},
+		cli.StringSliceFlag{Name: "allowedMethod", Usage: "method the frontend takes, others are rejected with 405, can be given several times", Value: &cli.StringSlice{}},
+		cli.StringSliceFlag{Name: "allowedContentType", Usage: "media type of the request bodies the frontend takes, e.g. application/json or text/*, others are rejected with 415, can be given several times", Value: &cli.StringSlice{}},
+
+		// Retry policy
+		cli.IntFlag{Name: "retryAttempts", Usage: "maximum attempts to forward a request, enables retries of the failed requests"},
+		cli.StringSliceFlag{Name: "retryOn", Usage: "conditions to retry on: connect-failure, timeout or 5xx, enables retries of the failed requests", Value: &cli.StringSlice{}},
+		cli.IntFlag{Name: "retryMaxBodyKB", Usage: "maximum request size to buffer for retries, in KB"},
+		cli.Float64Flag{Name: "retryBudget", Usage: "maximum share of the retries to the requests, e.g. 0.1, retries are not limited by default"},
+		cli.DurationFlag{Name: "retryBudgetWindow", Usage: "sliding window the retry budget is counted over, 10s by default"},
+		cli.IntFlag{Name: "retryBudgetMin", Usage: "retries allowed within the window regardless of the retry budget"},
+
+		// Rate limit
+		cli.IntFlag{Name: "rlRequests", Usage: "average requests per second allowed for every key, enables rate limiting"},
+		cli.IntFlag{Name: "rlBurst", Usage: "maximum requests allowed at once, defaults to the average"},
+		cli.StringFlag{Name: "rlKey", Usage: "key to limit requests by: client.ip, request.header.<Name> or request.claim.<name>, the bearer JWT claim is not verified"},
+		cli.StringSliceFlag{Name: "rlTrustedProxies", Usage: "CIDRs of the proxies trusted to set X-Forwarded-For", Value: &cli.StringSlice{}},
+		cli.IntFlag{Name: "rlMaxKeys", Usage: "maximum keys tracked in memory, idle keys are evicted first"},
+
+		// Circuit breaker
+		cli.StringFlag{Name: "cbCondition", Usage: "condition tripping the circuit breaker, e.g. 'NetworkErrorRatio() > 0.5', enables the circuit breaker"},
+		cli.IntFlag{Name: "cbFallbackCode", Usage: "status code of the fallback response, 503 by default"},
+		cli.StringFlag{Name: "cbFallbackType", Usage: "content type of the fallback response"},
+		cli.StringFlag{Name: "cbFallbackBody", Usage: "body of the fallback response"},
+		cli.DurationFlag{Name: "cbFallbackDuration", Usage: "time to serve the fallback response for once tripped"},
+		cli.DurationFlag{Name: "cbRecoveryDuration", Usage: "time to bring the traffic back to the backend"},
+		cli.DurationFlag{Name: "cbCheckPeriod", Usage: "period between the condition checks"},
+
+		// Canary
+		cli.StringFlag{Name: "canaryBackend", Usage: "id of the backend receiving the canary share of the requests, enables the canary split"},
+		cli.Float64Flag{Name: "canaryPercent", Usage: "percent of the requests sent to the canary backend"},
+		cli.StringFlag{Name: "canaryHeader", Usage: "response header naming the backend that served the request, 'canary' or 'stable'"},
+
+		// Mirror
+		cli.StringFlag{Name: "mirrorBackend", Usage: "id of the shadow backend receiving the copies of the requests, enables the mirroring"},
+		cli.Float64Flag{Name: "mirrorPercent", Usage: "percent of the requests copied to the shadow backend"},
+		cli.IntFlag{Name: "mirrorMaxBodyKB", Usage: "requests with larger bodies are not copied, in KB, 64KB by default"},
+
+		// Request id
+		cli.BoolFlag{Name: "requestId", Usage: "assigns the id to every request, the id is passed to the backend and returned to the client"},
+		cli.StringFlag{Name: "requestIdHeader", Usage: "header carrying the request id, X-Request-Id by default, enables the request ids"},
+		cli.StringFlag{Name: "requestIdPattern", Usage: "regular expression the ids supplied by the clients should match as a whole, enables the request ids"},
+
+		// Route header
+		cli.BoolFlag{Name: "routeHeader", Usage: "passes the ids of the frontend and the backend to the backend in the route header"},
+		cli.StringFlag{Name: "routeHeaderName", Usage: "route header, X-Vulcand-Route by default, enables the route header"},
+		cli.BoolFlag{Name: "routeHeaderOverride", Usage: "replaces the route header sent by the client, enables the route header"},
+		cli.BoolFlag{Name: "noRouteHeader", Usage: "turns the route header of the proxy off for the frontend"},
+
+		// Maintenance
+		cli.BoolFlag{Name: "maintenance", Usage: "serves 503 to all requests instead of forwarding them to the backend"},
+		cli.StringFlag{Name: "maintenanceBody", Usage: "body of the maintenance response, the 503 error page of the host by default"},
+		cli.StringFlag{Name: "maintenanceType", Usage: "content type of the maintenance body, detected from the body by default"},
 	}
 }
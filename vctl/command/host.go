@@ -2,6 +2,11 @@ package command
 
 import (
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/cli"
@@ -19,6 +24,12 @@ func NewHostCommand(cmd *Command) cli.Command {
 				Flags:  []cli.Flag{},
 				Action: cmd.printHostsAction,
 			},
+			{
+				Name:   "certs",
+				Usage:  "List host certificates with their expiry",
+				Flags:  []cli.Flag{},
+				Action: cmd.printCertsAction,
+			},
 			{
 				Name:  "show",
 				Usage: "Show host details",
@@ -33,11 +44,35 @@ func NewHostCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "name", Usage: "hostname"},
 					cli.StringFlag{Name: "privateKey", Usage: "Path to a private key"},
 					cli.StringFlag{Name: "cert", Usage: "Path to a certificate"},
+					cli.StringSliceFlag{Name: "extraPrivateKey", Usage: "Paths to private keys of the additional certificates, e.g. ECDSA next to RSA", Value: &cli.StringSlice{}},
+					cli.StringSliceFlag{Name: "extraCert", Usage: "Paths to additional certificates, in the order of extraPrivateKey", Value: &cli.StringSlice{}},
 
 					cli.BoolFlag{Name: "ocsp", Usage: "Turn OCSP on"},
 					cli.BoolFlag{Name: "ocspSkipCheck", Usage: "Insecure: skip signature checking for the OCSP certificate"},
 					cli.DurationFlag{Name: "ocspPeriod", Usage: "optional OCSP period", Value: time.Hour},
 					cli.StringSliceFlag{Name: "ocspResponder", Usage: "Optional list of OCSP responders", Value: &cli.StringSlice{}},
+
+					cli.BoolFlag{Name: "acme", Usage: "Obtain and renew the certificate automatically via ACME"},
+					cli.StringFlag{Name: "acmeEmail", Usage: "Contact email of the ACME account"},
+					cli.StringFlag{Name: "acmeDirectory", Usage: "ACME directory URL, Let's Encrypt is used by default"},
+					cli.StringFlag{Name: "acmeChallenge", Usage: "ACME challenge type, only http-01 is supported"},
+
+					cli.StringFlag{Name: "tlsMinV", Usage: "minimum supported TLS version, overrides the listener setting"},
+					cli.StringFlag{Name: "tlsMaxV", Usage: "maximum supported TLS version, overrides the listener setting"},
+					cli.StringSliceFlag{Name: "tlsCS", Usage: "optional list of allowed cipher suites, overrides the listener setting", Value: &cli.StringSlice{}},
+					cli.BoolFlag{Name: "tlsPreferServerCS", Usage: "prefer server cipher suites"},
+
+					cli.StringFlag{Name: "clientCA", Usage: "Path to a CA bundle to verify client certificates against"},
+					cli.BoolFlag{Name: "clientCertRequired", Usage: "Reject clients without a valid certificate"},
+
+					cli.StringSliceFlag{Name: "errorPage", Usage: "Error page template in 'status=path' format, content type is guessed from the file extension", Value: &cli.StringSlice{}},
+
+					cli.DurationFlag{Name: "hstsMaxAge", Usage: "Send Strict-Transport-Security with this max age on the TLS responses"},
+					cli.BoolFlag{Name: "hstsIncludeSubDomains", Usage: "Apply the HSTS policy to the subdomains"},
+					cli.BoolFlag{Name: "hstsPreload", Usage: "Allow the host to be included in the HSTS preload lists"},
+					cli.BoolFlag{Name: "contentTypeNosniff", Usage: "Send X-Content-Type-Options: nosniff on the TLS responses"},
+					cli.StringFlag{Name: "frameOptions", Usage: "X-Frame-Options sent on the TLS responses, DENY or SAMEORIGIN"},
+					cli.StringFlag{Name: "csp", Usage: "Content-Security-Policy sent on the TLS responses"},
 				},
 				Usage:  "Update or insert a new host to vulcan proxy",
 				Action: cmd.upsertHostAction,
@@ -63,6 +98,15 @@ func (cmd *Command) printHostsAction(c *cli.Context) error {
 	return nil
 }
 
+func (cmd *Command) printCertsAction(c *cli.Context) error {
+	certs, err := cmd.client.GetCerts()
+	if err != nil {
+		return err
+	}
+	cmd.printCerts(certs)
+	return nil
+}
+
 func (cmd *Command) printHostAction(c *cli.Context) error {
 	host, err := cmd.client.GetHost(engine.HostKey{Name: c.String("name")})
 	if err != nil {
@@ -84,12 +128,85 @@ func (cmd *Command) upsertHostAction(c *cli.Context) error {
 		}
 		host.Settings.KeyPair = keyPair
 	}
+	certs, keys := c.StringSlice("extraCert"), c.StringSlice("extraPrivateKey")
+	if len(certs) != len(keys) {
+		return fmt.Errorf("got %d extra certificates and %d private keys", len(certs), len(keys))
+	}
+	for i := range certs {
+		keyPair, err := readKeyPair(certs[i], keys[i])
+		if err != nil {
+			return fmt.Errorf("failed to read key pair %s: %s", certs[i], err)
+		}
+		host.Settings.KeyPairs = append(host.Settings.KeyPairs, *keyPair)
+	}
 	host.Settings.OCSP = engine.OCSPSettings{
 		Enabled:            c.Bool("ocsp"),
 		SkipSignatureCheck: c.Bool("ocspSkipCheck"),
 		Period:             c.Duration("ocspPeriod").String(),
 		Responders:         c.StringSlice("ocspResponder"),
 	}
+	if c.Bool("acme") {
+		host.Settings.ACME = &engine.ACMESettings{
+			Email:        c.String("acmeEmail"),
+			DirectoryURL: c.String("acmeDirectory"),
+			Challenge:    c.String("acmeChallenge"),
+		}
+		if err := host.Settings.ACME.Check(); err != nil {
+			return err
+		}
+	}
+	if c.String("tlsMinV") != "" || c.String("tlsMaxV") != "" || len(c.StringSlice("tlsCS")) != 0 || c.Bool("tlsPreferServerCS") {
+		host.Settings.TLS = &engine.HostTLSSettings{
+			MinVersion:               c.String("tlsMinV"),
+			MaxVersion:               c.String("tlsMaxV"),
+			CipherSuites:             c.StringSlice("tlsCS"),
+			PreferServerCipherSuites: c.Bool("tlsPreferServerCS"),
+		}
+		if err := host.Settings.TLS.Check(); err != nil {
+			return err
+		}
+	}
+	if c.String("clientCA") != "" {
+		ca, err := ioutil.ReadFile(c.String("clientCA"))
+		if err != nil {
+			return fmt.Errorf("failed to read client CA bundle: %s", err)
+		}
+		host.Settings.ClientAuth = &engine.ClientAuthSettings{CA: ca, Required: c.Bool("clientCertRequired")}
+		if err := host.Settings.ClientAuth.Check(); err != nil {
+			return err
+		}
+	}
+	for _, spec := range c.StringSlice("errorPage") {
+		code, page, err := readErrorPage(spec)
+		if err != nil {
+			return err
+		}
+		if host.Settings.ErrorPages == nil {
+			host.Settings.ErrorPages = make(map[int]engine.ErrorPage)
+		}
+		host.Settings.ErrorPages[code] = *page
+	}
+	if err := engine.CheckErrorPages(host.Settings.ErrorPages); err != nil {
+		return err
+	}
+	headers := engine.SecurityHeadersSettings{
+		ContentTypeNosniff:    c.Bool("contentTypeNosniff"),
+		FrameOptions:          c.String("frameOptions"),
+		ContentSecurityPolicy: c.String("csp"),
+	}
+	if c.IsSet("hstsMaxAge") {
+		headers.HSTS = &engine.HSTSSettings{
+			MaxAge:            int64(c.Duration("hstsMaxAge") / time.Second),
+			IncludeSubDomains: c.Bool("hstsIncludeSubDomains"),
+			Preload:           c.Bool("hstsPreload"),
+		}
+	}
+	if headers != (engine.SecurityHeadersSettings{}) {
+		if err := headers.Check(); err != nil {
+			return err
+		}
+		host.Settings.SecurityHeaders = &headers
+	}
 	if err := cmd.client.UpsertHost(*host); err != nil {
 		return err
 	}
@@ -104,3 +221,20 @@ func (cmd *Command) deleteHostAction(c *cli.Context) error {
 	cmd.printOk("host deleted")
 	return nil
 }
+
+// readErrorPage reads the error page given in 'status=path' format
+func readErrorPage(spec string) (int, *engine.ErrorPage, error) {
+	i := strings.Index(spec, "=")
+	if i < 0 {
+		return 0, nil, fmt.Errorf("error page should be in 'status=path' format, got '%s'", spec)
+	}
+	code, err := strconv.Atoi(spec[:i])
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad error page status '%s': %s", spec[:i], err)
+	}
+	body, err := ioutil.ReadFile(spec[i+1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read error page: %s", err)
+	}
+	return code, &engine.ErrorPage{ContentType: mime.TypeByExtension(filepath.Ext(spec[i+1:])), Body: string(body)}, nil
+}
@@ -16,6 +16,12 @@ func NewListenerCommand(cmd *Command) cli.Command {
 				Flags:  []cli.Flag{},
 				Action: cmd.printListenersAction,
 			},
+			{
+				Name:   "stats",
+				Usage:  "Show client connections of the listeners and request rates of the frontends",
+				Flags:  []cli.Flag{},
+				Action: cmd.printProxyStatsAction,
+			},
 			{
 				Name:  "show",
 				Usage: "Show listener details",
@@ -29,14 +35,31 @@ func NewListenerCommand(cmd *Command) cli.Command {
 				Usage: "Update or insert a listener",
 				Flags: append([]cli.Flag{
 					cli.StringFlag{Name: "id", Usage: "id"},
-					cli.StringFlag{Name: "proto", Usage: "protocol, either http or https"},
+					cli.StringFlag{Name: "proto", Usage: "protocol, either http, https or tcp"},
 					cli.StringFlag{Name: "net", Value: "tcp", Usage: "network, tcp or unix"},
 					cli.StringFlag{Name: "addr", Value: "tcp", Usage: "address to bind to, e.g. 'localhost:31000'"},
 					cli.StringFlag{Name: "scope", Usage: "scope expression limits the listener, e.g. 'Hostname(`myhost`)'"},
-					cli.StringFlag{Name: "proxy-header", Value: "none", Usage: "none or PROXY_V1"},
+					cli.StringFlag{Name: "proxy-header", Value: "none", Usage: "none, PROXY_V1 or PROXY_V2"},
+					cli.StringSliceFlag{Name: "proxy-trusted", Usage: "networks in CIDR format allowed to send the PROXY header, none if empty, 'unix' trusts the unix socket peers", Value: &cli.StringSlice{}},
+					cli.StringFlag{Name: "socketMode", Usage: "permissions of the unix socket file in octal, e.g. 0660"},
+					cli.IntFlag{Name: "maxConns", Usage: "maximum concurrent client connections, unlimited by default"},
+					cli.IntFlag{Name: "maxHeaderBytes", Usage: "maximum size of the request headers, overrides the proxy limit"},
+					cli.BoolFlag{Name: "disableHTTP2", Usage: "serve HTTP/1.1 only on the https listener"},
+					cli.DurationFlag{Name: "idleTimeout", Usage: "closes keep-alive connections idle for longer than this, overrides the proxy idle timeout"},
+					cli.BoolFlag{Name: "redirectToHTTPS", Usage: "redirect all requests to https, frontends are not matched"},
+					cli.IntFlag{Name: "redirectPort", Usage: "https port in the redirect location, 443 by default"},
+					cli.BoolFlag{Name: "redirectACME", Usage: "answer ACME HTTP-01 challenges instead of redirecting them"},
 				}, getTLSFlags()...),
 				Action: cmd.upsertListenerAction,
 			},
+			{
+				Name:   "rotate-keys",
+				Usage:  "Rotate the session ticket keys of the HTTPS listener",
+				Action: cmd.rotateSessionTicketKeysAction,
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "id"},
+				},
+			},
 			{
 				Name:   "rm",
 				Usage:  "Remove a listener",
@@ -62,6 +85,23 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	listener.MaxConnections = c.Int("maxConns")
+	listener.MaxHeaderBytes = c.Int("maxHeaderBytes")
+	listener.DisableHTTP2 = c.Bool("disableHTTP2")
+	listener.SocketMode = c.String("socketMode")
+	if d := c.Duration("idleTimeout"); d != 0 {
+		listener.IdleTimeout = d.String()
+	}
+	listener.ProxyProtocolTrustedCIDRs = c.StringSlice("proxy-trusted")
+	if _, err := listener.ProxyProtocolTrustedNets(); err != nil {
+		return err
+	}
+	if c.Bool("redirectToHTTPS") {
+		listener.RedirectToHTTPS = &engine.HTTPSRedirectSettings{Port: c.Int("redirectPort"), ACME: c.Bool("redirectACME")}
+		if err := listener.RedirectToHTTPS.Check(); err != nil {
+			return err
+		}
+	}
 	if err := cmd.client.UpsertListener(*listener); err != nil {
 		return err
 	}
@@ -69,6 +109,24 @@ func (cmd *Command) upsertListenerAction(c *cli.Context) error {
 	return nil
 }
 
+func (cmd *Command) rotateSessionTicketKeysAction(c *cli.Context) error {
+	keys, err := cmd.client.RotateSessionTicketKeys(engine.ListenerKey{Id: c.String("id")})
+	if err != nil {
+		return err
+	}
+	cmd.printOk("session ticket keys rotated, %d keys in use", keys)
+	return nil
+}
+
+func (cmd *Command) printProxyStatsAction(c *cli.Context) error {
+	stats, err := cmd.client.GetProxyStats()
+	if err != nil {
+		return err
+	}
+	cmd.printProxyStats(stats)
+	return nil
+}
+
 func (cmd *Command) deleteListenerAction(c *cli.Context) error {
 	if err := cmd.client.DeleteListener(engine.ListenerKey{Id: c.String("id")}); err != nil {
 		return err
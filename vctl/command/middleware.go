@@ -22,7 +22,7 @@ func makeMiddlewareCommands(cmd *Command, spec *plugin.MiddlewareSpec) cli.Comma
 	flags = append(flags,
 		cli.StringFlag{Name: "frontend, f", Usage: "location id"},
 		cli.DurationFlag{Name: "ttl", Usage: "ttl"},
-		cli.IntFlag{Name: "priority", Value: 1, Usage: "middleware priority, smaller values are lower"},
+		cli.IntFlag{Name: "priority", Value: 1, Usage: "middleware priority, middlewares with smaller values handle requests first"},
 		cli.StringFlag{Name: "id", Usage: fmt.Sprintf("%s id", spec.Type)})
 
 	return cli.Command{
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/buger/goterm"
 	"github.com/vulcand/vulcand/engine"
@@ -37,6 +38,13 @@ func (cmd *Command) printInfo(message string, params ...interface{}) {
 	fmt.Fprintf(cmd.out, "INFO: %s\n", fmt.Sprintf(message, params...))
 }
 
+// printNextPage prints the cursor of the next page of the listing, if any
+func (cmd *Command) printNextPage(cursor string) {
+	if cursor != "" {
+		cmd.printInfo("more items, list the next page with --cursor=%s", cursor)
+	}
+}
+
 func (cmd *Command) printHosts(hosts []engine.Host) {
 	fmt.Fprintf(cmd.out, "\n[Hosts]\n")
 	writeS(cmd.out, hostsView(hosts))
@@ -57,6 +65,14 @@ func (cmd *Command) printListener(l *engine.Listener) {
 	writeS(cmd.out, listenersView([]engine.Listener{*l}))
 }
 
+func (cmd *Command) printProxyStats(stats *engine.ProxyStats) {
+	fmt.Fprintf(cmd.out, "\n[Proxy]\n%s\n", stats.State)
+	fmt.Fprintf(cmd.out, "\n[Listeners]\n")
+	writeS(cmd.out, listenerStatsView(stats.Listeners))
+	fmt.Fprintf(cmd.out, "\n[Frontends]\n")
+	writeS(cmd.out, frontendRatesView(stats.Frontends))
+}
+
 func (cmd *Command) printServers(srvs []engine.Server) {
 	fmt.Fprintf(cmd.out, "\n[Servers]\n")
 	writeS(cmd.out, serversView(srvs))
@@ -67,6 +83,16 @@ func (cmd *Command) printServer(s *engine.Server) {
 	writeS(cmd.out, serversView([]engine.Server{*s}))
 }
 
+func (cmd *Command) printServersHealth(hs []engine.ServerHealth) {
+	fmt.Fprintf(cmd.out, "\n[Servers]\n")
+	writeS(cmd.out, serversHealthView(hs))
+}
+
+func (cmd *Command) printCerts(certs []engine.CertExpiry) {
+	fmt.Fprintf(cmd.out, "\n[Certificates]\n")
+	writeS(cmd.out, certsView(certs, time.Now()))
+}
+
 func (cmd *Command) printOverview(frontend []engine.Frontend, servers []engine.Server) {
 	out := &bytes.Buffer{}
 	fmt.Fprintf(out, "\n[Frontend]\n")
@@ -15,6 +15,9 @@ func NewServerCommand(cmd *Command) cli.Command {
 				Usage: "List all servers for a given backend",
 				Flags: []cli.Flag{
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+					cli.StringFlag{Name: "prefix", Usage: "list the servers with the ids starting with the prefix"},
+					cli.IntFlag{Name: "limit", Usage: "list a page of up to limit servers, all the pages if omitted"},
+					cli.StringFlag{Name: "cursor", Usage: "cursor of the page to list, printed with the previous page"},
 				},
 				Action: cmd.printServersAction,
 			},
@@ -35,6 +38,7 @@ func NewServerCommand(cmd *Command) cli.Command {
 					cli.StringFlag{Name: "id", Usage: "server id"},
 					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
 					cli.StringFlag{Name: "url", Usage: "url in form <scheme>://<host>:<port>"},
+					cli.IntFlag{Name: "weight", Usage: "relative share of traffic sent to the server, 1 by default"},
 					cli.DurationFlag{Name: "ttl", Usage: "ttl"},
 				},
 			},
@@ -47,6 +51,24 @@ func NewServerCommand(cmd *Command) cli.Command {
 				},
 				Action: cmd.deleteServerAction,
 			},
+			{
+				Name:  "quarantine",
+				Usage: "Take the server out of rotation of the instance keeping it in the configuration, until it is released or the instance restarts",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "server id"},
+					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+				},
+				Action: cmd.quarantineServerAction,
+			},
+			{
+				Name:  "release",
+				Usage: "Put the server quarantined on the instance back to rotation",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "id", Usage: "server id"},
+					cli.StringFlag{Name: "backend, b", Usage: "backend id"},
+				},
+				Action: cmd.releaseServerAction,
+			},
 		},
 	}
 }
@@ -56,6 +78,7 @@ func (cmd *Command) upsertServerAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	s.Weight = c.Int("weight")
 	if err := cmd.client.UpsertServer(engine.BackendKey{Id: c.String("backend")}, *s, c.Duration("ttl")); err != nil {
 		return err
 	}
@@ -72,12 +95,48 @@ func (cmd *Command) deleteServerAction(c *cli.Context) error {
 	return nil
 }
 
-func (cmd *Command) printServersAction(c *cli.Context) error {
-	srvs, err := cmd.client.GetServers(engine.BackendKey{Id: c.String("backend")})
-	if err != nil {
+func (cmd *Command) quarantineServerAction(c *cli.Context) error {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: c.String("id")}
+	if err := cmd.client.QuarantineServer(sk); err != nil {
+		return err
+	}
+	cmd.printOk("Server %v quarantined", sk.Id)
+	return nil
+}
+
+func (cmd *Command) releaseServerAction(c *cli.Context) error {
+	sk := engine.ServerKey{BackendKey: engine.BackendKey{Id: c.String("backend")}, Id: c.String("id")}
+	if err := cmd.client.ReleaseServer(sk); err != nil {
 		return err
 	}
-	cmd.printServers(srvs)
+	cmd.printOk("Server %v released", sk.Id)
+	return nil
+}
+
+func (cmd *Command) printServersAction(c *cli.Context) error {
+	bk := engine.BackendKey{Id: c.String("backend")}
+	if !isPaged(c) {
+		srvs, err := cmd.client.GetServers(bk)
+		if err != nil {
+			return err
+		}
+		cmd.printServers(srvs)
+		return nil
+	}
+	var out []engine.Server
+	cursor := c.String("cursor")
+	for {
+		srvs, next, err := cmd.client.GetServersPage(bk, c.String("prefix"), cursor, pageLimit(c))
+		if err != nil {
+			return err
+		}
+		out, cursor = append(out, srvs...), next
+		if cursor == "" || c.Int("limit") > 0 {
+			break
+		}
+	}
+	cmd.printServers(out)
+	cmd.printNextPage(cursor)
 	return nil
 }
 
@@ -0,0 +1,62 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+func NewTimeoutsCommand(cmd *Command) cli.Command {
+	return cli.Command{
+		Name:  "timeouts",
+		Usage: "Operations with the server timeouts of the listeners of the instance, the timeouts are not stored in the engine",
+		Subcommands: []cli.Command{
+			{
+				Name:  "set",
+				Usage: "Update the server timeouts of the instance without a restart, the timeouts not given are kept",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "read", Usage: "server read timeout, e.g. 60s"},
+					cli.StringFlag{Name: "write", Usage: "server write timeout, e.g. 60s"},
+					cli.StringFlag{Name: "idle", Usage: "server idle timeout, e.g. 90s"},
+				},
+				Action: cmd.updateServerTimeoutsAction,
+			},
+			{
+				Name:   "show",
+				Usage:  "Show the server timeouts of the instance",
+				Action: cmd.getServerTimeoutsAction,
+			},
+		},
+	}
+}
+
+func (cmd *Command) updateServerTimeoutsAction(c *cli.Context) error {
+	t, err := cmd.client.GetServerTimeouts()
+	if err != nil {
+		return err
+	}
+	for name, d := range map[string]*time.Duration{"read": &t.Read, "write": &t.Write, "idle": &t.Idle} {
+		v := c.String(name)
+		if v == "" {
+			continue
+		}
+		if *d, err = time.ParseDuration(v); err != nil {
+			return fmt.Errorf("invalid %v timeout: %v", name, err)
+		}
+	}
+	if err := cmd.client.UpdateServerTimeouts(*t); err != nil {
+		return err
+	}
+	cmd.printOk("server timeouts updated: %v", t)
+	return nil
+}
+
+func (cmd *Command) getServerTimeoutsAction(c *cli.Context) error {
+	t, err := cmd.client.GetServerTimeouts()
+	if err != nil {
+		return err
+	}
+	cmd.printOk("server timeouts: %v", t)
+	return nil
+}
@@ -3,6 +3,7 @@ package command
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/buger/goterm"
 	"github.com/vulcand/vulcand/engine"
@@ -78,7 +79,7 @@ func backendView(b *engine.Backend) string {
 
 func serversView(srvs []engine.Server) string {
 	t := goterm.NewTable(0, 10, 5, ' ', 0)
-	fmt.Fprint(t, "Id\tURL\n")
+	fmt.Fprint(t, "Id\tURL\tWeight\n")
 	if len(srvs) == 0 {
 		return t.String()
 	}
@@ -89,7 +90,66 @@ func serversView(srvs []engine.Server) string {
 }
 
 func serverView(s *engine.Server) string {
-	return fmt.Sprintf("%s\t%s\n", s.Id, s.URL)
+	return fmt.Sprintf("%s\t%s\t%d\n", s.Id, s.URL, s.LBWeight())
+}
+
+func serversHealthView(hs []engine.ServerHealth) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Id\tURL\tHealthy\tEjected\tDraining\tLastCheck\tLastError\n")
+	if len(hs) == 0 {
+		return t.String()
+	}
+	for _, v := range hs {
+		fmt.Fprint(t, serverHealthView(&v))
+	}
+	return t.String()
+}
+
+func serverHealthView(h *engine.ServerHealth) string {
+	lastCheck := "-"
+	if !h.LastCheck.IsZero() {
+		lastCheck = h.LastCheck.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s\t%s\t%t\t%t\t%t\t%s\t%s\n", h.Id, h.URL, h.Healthy, h.Ejected, h.Draining, lastCheck, h.LastError)
+}
+
+func listenerStatsView(ls []engine.ListenerStats) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Id\tAddress\tActiveConnections\tAcceptedConnections\n")
+	for _, l := range ls {
+		fmt.Fprintf(t, "%s\t%s\t%d\t%d\n", l.Id, l.Address.Address, l.ActiveConnections, l.AcceptedConnections)
+	}
+	return t.String()
+}
+
+func frontendRatesView(fs []engine.FrontendRate) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Id\tPeriod\tRequests\tNetErrors\tRequestsPerSecond\n")
+	for _, f := range fs {
+		fmt.Fprintf(t, "%s\t%v\t%d\t%d\t%.2f\n", f.Id, f.Period, f.Requests, f.NetErrors, f.RequestsPerSecond)
+	}
+	return t.String()
+}
+
+func certsView(certs []engine.CertExpiry, now time.Time) string {
+	t := goterm.NewTable(0, 10, 5, ' ', 0)
+	fmt.Fprint(t, "Host\tSubject\tIssuer\tNotAfter\tDaysLeft\tOCSPNextUpdate\tError\n")
+	for _, v := range certs {
+		fmt.Fprint(t, certView(&v, now))
+	}
+	return t.String()
+}
+
+func certView(c *engine.CertExpiry, now time.Time) string {
+	if c.Error != "" {
+		return fmt.Sprintf("%s\t-\t-\t-\t-\t-\t%s\n", c.Host, c.Error)
+	}
+	ocspUpdate := "-"
+	if !c.OCSPNextUpdate.IsZero() {
+		ocspUpdate = c.OCSPNextUpdate.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%.1f\t%s\t-\n",
+		c.Host, c.Subject, c.Issuer, c.NotAfter.Format(time.RFC3339), c.DaysLeft(now), ocspUpdate)
 }
 
 func middlewaresView(ms []engine.Middleware) string {
@@ -126,5 +186,8 @@ func (s *middlewareSorter) Swap(i, j int) {
 }
 
 func (s *middlewareSorter) Less(i, j int) bool {
-	return s.ms[i].Priority < s.ms[j].Priority
+	if s.ms[i].Priority != s.ms[j].Priority {
+		return s.ms[i].Priority < s.ms[j].Priority
+	}
+	return s.ms[i].Id < s.ms[j].Id
 }